@@ -36,6 +36,10 @@ func DecodeDeviceID(rdev uint32) (uint16, uint32) {
 //
 // See Documentations/devices.txt and uapi/linux/major.h.
 const (
+	// MEM_MAJOR is the major device number for "memory" character devices,
+	// like /dev/null.
+	MEM_MAJOR = 1
+
 	// TTYAUX_MAJOR is the major device number for alternate TTY devices.
 	TTYAUX_MAJOR = 5
 
@@ -48,8 +52,29 @@ const (
 	UNIX98_PTY_SLAVE_MAJOR = 136
 )
 
+// Minor device numbers for MEM_MAJOR.
+const (
+	// NULL_MINOR is the minor device number for /dev/null.
+	NULL_MINOR = 3
+
+	// ZERO_MINOR is the minor device number for /dev/zero.
+	ZERO_MINOR = 5
+
+	// FULL_MINOR is the minor device number for /dev/full.
+	FULL_MINOR = 7
+
+	// RANDOM_MINOR is the minor device number for /dev/random.
+	RANDOM_MINOR = 8
+
+	// URANDOM_MINOR is the minor device number for /dev/urandom.
+	URANDOM_MINOR = 9
+)
+
 // Minor device numbers for TTYAUX_MAJOR.
 const (
+	// TTY_MINOR is the minor device number for /dev/tty.
+	TTY_MINOR = 0
+
 	// PTMX_MINOR is the minor device number for /dev/ptmx.
 	PTMX_MINOR = 2
 )
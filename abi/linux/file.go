@@ -91,6 +91,19 @@ const (
 	AT_REMOVEDIR = 0x200
 )
 
+// Constants for faccessat(2).
+const (
+	AT_EACCESS = 0x200
+)
+
+// Modes for access(2).
+const (
+	F_OK = 0
+	X_OK = 1
+	W_OK = 2
+	R_OK = 4
+)
+
 // Constants for linkat(2) and fchownat(2).
 const (
 	AT_SYMLINK_FOLLOW = 0x400
@@ -67,10 +67,34 @@ const (
 
 // ioctl(2) requests provided by uapi/linux/sockios.h
 const (
-	SIOCGIFMEM    = 0x891f
-	SIOCGIFPFLAGS = 0x8935
-	SIOCGMIIPHY   = 0x8947
-	SIOCGMIIREG   = 0x8948
+	SIOCGIFNAME    = 0x8910
+	SIOCGIFCONF    = 0x8912
+	SIOCGIFFLAGS   = 0x8913
+	SIOCGIFADDR    = 0x8915
+	SIOCGIFDSTADDR = 0x8917
+	SIOCGIFBRDADDR = 0x8919
+	SIOCGIFNETMASK = 0x891b
+	SIOCGIFMETRIC  = 0x891d
+	SIOCGIFMTU     = 0x8921
+	SIOCGIFHWADDR  = 0x8927
+	SIOCGIFINDEX   = 0x8933
+	SIOCGIFTXQLEN  = 0x8942
+	SIOCGIFMAP     = 0x8970
+	SIOCGIFMEM     = 0x891f
+	SIOCGIFPFLAGS  = 0x8935
+	SIOCGMIIPHY    = 0x8947
+	SIOCGMIIREG    = 0x8948
+	SIOCSIFFLAGS   = 0x8914
+	SIOCSIFADDR    = 0x8916
+	SIOCSIFDSTADDR = 0x8918
+	SIOCSIFBRDADDR = 0x891a
+	SIOCSIFNETMASK = 0x891c
+	SIOCSIFMETRIC  = 0x891e
+	SIOCSIFMTU     = 0x8922
+	SIOCSIFNAME    = 0x8923
+	SIOCSIFHWADDR  = 0x8924
+	SIOCSIFTXQLEN  = 0x8943
+	SIOCSIFMAP     = 0x8971
 )
 
 // ioctl(2) requests provided by uapi/linux/android/binder.h
@@ -79,6 +79,12 @@ const (
 	NLM_F_APPEND    = 0x800
 )
 
+// Flags of an NLMSG_ERROR message, from uapi/linux/netlink.h.
+const (
+	NLM_F_CAPPED   = 0x100
+	NLM_F_ACK_TLVS = 0x200
+)
+
 // Standard netlink message types, from uapi/linux/netlink.h.
 const (
 	NLMSG_NOOP    = 0x1
@@ -90,6 +96,13 @@ const (
 	NLMSG_MIN_TYPE = 0x10
 )
 
+// NetlinkErrorMessage is struct nlmsgerr, from uapi/linux/netlink.h. It's
+// followed by the rest of the request, unless NLM_F_CAPPED is set.
+type NetlinkErrorMessage struct {
+	Error  int32
+	Header NetlinkMessageHeader
+}
+
 // NLMSG_ALIGNTO is the alignment of netlink messages, from
 // uapi/linux/netlink.h.
 const NLMSG_ALIGNTO = 4
@@ -185,7 +185,92 @@ const (
 	IFA_FLAGS     = 8
 )
 
+// Interface address flags, from uapi/linux/if_addr.h.
+const (
+	IFA_F_PERMANENT = 0x80
+)
+
+// Interface operational states, from uapi/linux/if.h.
+const (
+	IF_OPER_UNKNOWN = 0
+	IF_OPER_DOWN    = 2
+	IF_OPER_UP      = 6
+)
+
 // Device types, from uapi/linux/if_arp.h.
 const (
+	ARPHRD_ETHER    = 1
 	ARPHRD_LOOPBACK = 772
 )
+
+// RouteMessage is struct rtmsg, from uapi/linux/rtnetlink.h.
+type RouteMessage struct {
+	Family uint8
+	DstLen uint8
+	SrcLen uint8
+	TOS    uint8
+
+	Table    uint8
+	Protocol uint8
+	Scope    uint8
+	Type     uint8
+
+	Flags uint32
+}
+
+// Route attributes, from uapi/linux/rtnetlink.h.
+const (
+	RTA_UNSPEC    = 0
+	RTA_DST       = 1
+	RTA_SRC       = 2
+	RTA_IIF       = 3
+	RTA_OIF       = 4
+	RTA_GATEWAY   = 5
+	RTA_PRIORITY  = 6
+	RTA_PREFSRC   = 7
+	RTA_METRICS   = 8
+	RTA_MULTIPATH = 9
+	RTA_FLOW      = 11
+	RTA_CACHEINFO = 12
+	RTA_TABLE     = 15
+	RTA_MARK      = 16
+)
+
+// Route tables, from uapi/linux/rtnetlink.h.
+const (
+	RT_TABLE_UNSPEC  = 0
+	RT_TABLE_DEFAULT = 253
+	RT_TABLE_MAIN    = 254
+	RT_TABLE_LOCAL   = 255
+)
+
+// Route protocols, which say where a route came from, from
+// uapi/linux/rtnetlink.h.
+const (
+	RTPROT_UNSPEC = 0
+	RTPROT_KERNEL = 2
+	RTPROT_BOOT   = 3
+	RTPROT_STATIC = 4
+)
+
+// Route scopes, from uapi/linux/rtnetlink.h.
+const (
+	RT_SCOPE_UNIVERSE = 0
+	RT_SCOPE_SITE     = 200
+	RT_SCOPE_LINK     = 253
+	RT_SCOPE_HOST     = 254
+	RT_SCOPE_NOWHERE  = 255
+)
+
+// Route types, from uapi/linux/rtnetlink.h.
+const (
+	RTN_UNSPEC      = 0
+	RTN_UNICAST     = 1
+	RTN_LOCAL       = 2
+	RTN_BROADCAST   = 3
+	RTN_ANYCAST     = 4
+	RTN_MULTICAST   = 5
+	RTN_BLACKHOLE   = 6
+	RTN_UNREACHABLE = 7
+	RTN_PROHIBIT    = 8
+)
@@ -143,6 +143,17 @@ const (
 	// PR_MPX_DISABLE_MANAGEMENTdisable kernel management of Memory Protection
 	// eXtensions (MPX) bounds tables.
 	PR_MPX_DISABLE_MANAGEMENT = 44
+
+	// PR_CAP_AMBIENT reads or changes the ambient capability set.
+	PR_CAP_AMBIENT = 47
+)
+
+// PR_CAP_AMBIENT operations, from <linux/prctl.h>.
+const (
+	PR_CAP_AMBIENT_IS_SET    = 1
+	PR_CAP_AMBIENT_RAISE     = 2
+	PR_CAP_AMBIENT_LOWER     = 3
+	PR_CAP_AMBIENT_CLEAR_ALL = 4
 )
 
 // From <asm/prctl.h>
@@ -58,3 +58,18 @@ const (
 	MAX_TCP_KEEPIDLE  = 32767
 	MAX_TCP_KEEPINTVL = 32767
 )
+
+// TCP states, as TCP_INFO reports them, from include/net/tcp_states.h.
+const (
+	TCP_ESTABLISHED = 1
+	TCP_SYN_SENT    = 2
+	TCP_SYN_RECV    = 3
+	TCP_FIN_WAIT1   = 4
+	TCP_FIN_WAIT2   = 5
+	TCP_TIME_WAIT   = 6
+	TCP_CLOSE       = 7
+	TCP_CLOSE_WAIT  = 8
+	TCP_LAST_ACK    = 9
+	TCP_LISTEN      = 10
+	TCP_CLOSING     = 11
+)
@@ -0,0 +1,96 @@
+package auth
+
+import "github.com/evanphx/columbia/abi/linux"
+
+// The kinds of access to a file, as access(2) takes them. They're also
+// the bits each class has in a file's permissions.
+const (
+	MayExec  = linux.X_OK
+	MayWrite = linux.W_OK
+	MayRead  = linux.R_OK
+)
+
+// OverridesDAC reports whether c can read and write any file, and search
+// any directory, as CAP_DAC_OVERRIDE allows.
+func (c *Credentials) OverridesDAC() bool {
+	return c.HasCapability(linux.CAP_DAC_OVERRIDE)
+}
+
+// MayAccess reports whether c can access a file owned by uid and gid with
+// perms as mode, a combination of MayRead, MayWrite and MayExec. Only the
+// class c falls in counts, so an owner can be denied what others are
+// allowed. Even with privilege, a file no one can execute can't be.
+func (c *Credentials) MayAccess(uid, gid, perms int, dir bool, mode int) bool {
+	if c.OverridesDAC() {
+		return mode&MayExec == 0 || dir || perms&0111 != 0
+	}
+
+	// CAP_DAC_READ_SEARCH allows reading files and directories, and
+	// searching directories.
+	if c.HasCapability(linux.CAP_DAC_READ_SEARCH) && mode&MayWrite == 0 && (mode&MayExec == 0 || dir) {
+		return true
+	}
+
+	var class int
+
+	switch {
+	case c.FilesystemUID == uid:
+		class = perms >> 6
+	case c.InGroup(gid):
+		class = perms >> 3
+	default:
+		class = perms
+	}
+
+	return mode&^class&7 == 0
+}
+
+// IsOwner reports whether c can act as the owner of a file owned by uid:
+// change its permissions and times, or remove it from a sticky directory.
+func (c *Credentials) IsOwner(uid int) bool {
+	return c.HasCapability(linux.CAP_FOWNER) || c.FilesystemUID == uid
+}
+
+// MayChown reports whether c can change the owner of a file owned by uid
+// and gid to newUID and newGID, either of which can be NoID to leave it.
+// Without CAP_CHOWN, only the owner can, and only to change the group to
+// one it's in.
+func (c *Credentials) MayChown(uid, gid, newUID, newGID int) bool {
+	if c.HasCapability(linux.CAP_CHOWN) {
+		return true
+	}
+
+	if newUID != NoID && (c.FilesystemUID != uid || newUID != uid) {
+		return false
+	}
+
+	if newGID != NoID && (c.FilesystemUID != uid || (newGID != gid && !c.InGroup(newGID))) {
+		return false
+	}
+
+	return true
+}
+
+// MayKeepSetGID reports whether a file of gid that c changes the
+// permissions of can be setgid. Without CAP_FSETID, c must be in gid, so
+// it can't hand out a group it doesn't have.
+func (c *Credentials) MayKeepSetGID(gid int) bool {
+	return c.HasCapability(linux.CAP_FSETID) || c.InGroup(gid)
+}
+
+// MaySignal reports whether c can send a signal to a process running as
+// target: with CAP_KILL, or if c's real or effective uid is target's real
+// or saved one.
+func (c *Credentials) MaySignal(target *Credentials) bool {
+	if c.HasCapability(linux.CAP_KILL) {
+		return true
+	}
+
+	for _, uid := range []int{c.RealUID, c.EffectiveUID} {
+		if uid == target.RealUID || uid == target.SavedUID {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccess(t *testing.T) {
+	t.Run("checks the class the process falls in", func(t *testing.T) {
+		owner := New(1000, 1000)
+		member := New(2000, 2000)
+		member.Groups = []int{100}
+		other := New(3000, 3000)
+
+		require.True(t, owner.MayAccess(1000, 100, 0640, false, MayRead|MayWrite))
+		require.False(t, owner.MayAccess(1000, 100, 0640, false, MayExec))
+		require.True(t, member.MayAccess(1000, 100, 0640, false, MayRead))
+		require.False(t, member.MayAccess(1000, 100, 0640, false, MayWrite))
+		require.False(t, other.MayAccess(1000, 100, 0640, false, MayRead))
+
+		// Others being allowed doesn't help the owner.
+		require.False(t, owner.MayAccess(1000, 100, 0007, false, MayRead))
+	})
+
+	t.Run("lets root past all but execution", func(t *testing.T) {
+		root := New(0, 0)
+
+		require.True(t, root.MayAccess(1000, 100, 0, false, MayRead|MayWrite))
+		require.True(t, root.MayAccess(1000, 100, 0, true, MayExec))
+		require.False(t, root.MayAccess(1000, 100, 0644, false, MayExec))
+		require.True(t, root.MayAccess(1000, 100, 0744, false, MayExec))
+	})
+
+	t.Run("goes by the filesystem ids", func(t *testing.T) {
+		c := New(0, 0)
+		c.SetFSUID(1000)
+
+		require.False(t, c.MayAccess(2000, 2000, 0600, false, MayRead))
+		require.True(t, c.MayAccess(1000, 2000, 0600, false, MayRead))
+	})
+
+	t.Run("only lets the owner give a file to its own groups", func(t *testing.T) {
+		c := New(1000, 1000)
+		c.Groups = []int{100}
+
+		require.True(t, c.MayChown(1000, 1000, NoID, 100))
+		require.True(t, c.MayChown(1000, 1000, 1000, NoID))
+		require.False(t, c.MayChown(1000, 1000, NoID, 200))
+		require.False(t, c.MayChown(1000, 1000, 2000, NoID))
+		require.False(t, c.MayChown(2000, 1000, NoID, 1000))
+
+		require.True(t, New(0, 0).MayChown(1000, 1000, 2000, 200))
+	})
+
+	t.Run("keeps setgid only for members", func(t *testing.T) {
+		c := New(1000, 1000)
+
+		require.True(t, c.MayKeepSetGID(1000))
+		require.False(t, c.MayKeepSetGID(100))
+		require.True(t, c.IsOwner(1000))
+		require.False(t, c.IsOwner(0))
+	})
+
+	t.Run("reads and searches anything with CAP_DAC_READ_SEARCH", func(t *testing.T) {
+		c := New(1000, 1000)
+		c.PermittedCaps = CapabilitySetOf(linux.CAP_DAC_READ_SEARCH)
+		c.EffectiveCaps = c.PermittedCaps
+
+		require.True(t, c.MayAccess(0, 0, 0, false, MayRead))
+		require.True(t, c.MayAccess(0, 0, 0, true, MayRead|MayExec))
+		require.False(t, c.MayAccess(0, 0, 0, false, MayExec))
+		require.False(t, c.MayAccess(0, 0, 0, true, MayWrite))
+	})
+
+	t.Run("signals its own user's processes without CAP_KILL", func(t *testing.T) {
+		c := New(1000, 1000)
+
+		require.True(t, c.MaySignal(New(1000, 100)))
+		require.False(t, c.MaySignal(New(2000, 1000)))
+		require.True(t, New(0, 0).MaySignal(New(2000, 1000)))
+
+		setuid := New(2000, 2000)
+		setuid.SavedUID = 1000
+		require.True(t, c.MaySignal(setuid))
+	})
+}
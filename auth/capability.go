@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/pkg/errors"
+)
+
+var ErrUnknownCapability = errors.New("unknown capability")
+
+// CapabilitySet is a set of capabilities, a bit for each.
+type CapabilitySet uint64
+
+// AllCapabilities holds every capability Linux defines.
+const AllCapabilities = CapabilitySet(1)<<(linux.MaxCapability+1) - 1
+
+// DefaultCapabilities are the capabilities root starts with, the same as a
+// Docker container's. The rest, like CAP_SYS_ADMIN and CAP_NET_ADMIN, have
+// to be given explicitly.
+var DefaultCapabilities = CapabilitySetOf(
+	linux.CAP_CHOWN,
+	linux.CAP_DAC_OVERRIDE,
+	linux.CAP_FSETID,
+	linux.CAP_FOWNER,
+	linux.CAP_MKNOD,
+	linux.CAP_NET_RAW,
+	linux.CAP_SETGID,
+	linux.CAP_SETUID,
+	linux.CAP_SETFCAP,
+	linux.CAP_SETPCAP,
+	linux.CAP_NET_BIND_SERVICE,
+	linux.CAP_SYS_CHROOT,
+	linux.CAP_KILL,
+	linux.CAP_AUDIT_WRITE,
+)
+
+// CapabilitySetOf returns the set holding caps.
+func CapabilitySetOf(caps ...linux.Capability) CapabilitySet {
+	var s CapabilitySet
+
+	for _, cp := range caps {
+		s |= CapabilitySet(1) << uint(cp)
+	}
+
+	return s
+}
+
+// Has reports whether cp is in s.
+func (s CapabilitySet) Has(cp linux.Capability) bool {
+	return cp.Ok() && s&CapabilitySetOf(cp) != 0
+}
+
+// fsCapabilities are the capabilities that go with the filesystem uid
+// being 0, dropped from the effective set when it changes to another, and
+// raised again when it changes back.
+var fsCapabilities = CapabilitySetOf(
+	linux.CAP_CHOWN,
+	linux.CAP_DAC_OVERRIDE,
+	linux.CAP_DAC_READ_SEARCH,
+	linux.CAP_FOWNER,
+	linux.CAP_FSETID,
+	linux.CAP_LINUX_IMMUTABLE,
+	linux.CAP_MAC_OVERRIDE,
+	linux.CAP_MKNOD,
+)
+
+var capabilityNames = [...]string{
+	linux.CAP_CHOWN:            "CHOWN",
+	linux.CAP_DAC_OVERRIDE:     "DAC_OVERRIDE",
+	linux.CAP_DAC_READ_SEARCH:  "DAC_READ_SEARCH",
+	linux.CAP_FOWNER:           "FOWNER",
+	linux.CAP_FSETID:           "FSETID",
+	linux.CAP_KILL:             "KILL",
+	linux.CAP_SETGID:           "SETGID",
+	linux.CAP_SETUID:           "SETUID",
+	linux.CAP_SETPCAP:          "SETPCAP",
+	linux.CAP_LINUX_IMMUTABLE:  "LINUX_IMMUTABLE",
+	linux.CAP_NET_BIND_SERVICE: "NET_BIND_SERVICE",
+	linux.CAP_NET_BROADCAST:    "NET_BROADCAST",
+	linux.CAP_NET_ADMIN:        "NET_ADMIN",
+	linux.CAP_NET_RAW:          "NET_RAW",
+	linux.CAP_IPC_LOCK:         "IPC_LOCK",
+	linux.CAP_IPC_OWNER:        "IPC_OWNER",
+	linux.CAP_SYS_MODULE:       "SYS_MODULE",
+	linux.CAP_SYS_RAWIO:        "SYS_RAWIO",
+	linux.CAP_SYS_CHROOT:       "SYS_CHROOT",
+	linux.CAP_SYS_PTRACE:       "SYS_PTRACE",
+	linux.CAP_SYS_PACCT:        "SYS_PACCT",
+	linux.CAP_SYS_ADMIN:        "SYS_ADMIN",
+	linux.CAP_SYS_BOOT:         "SYS_BOOT",
+	linux.CAP_SYS_NICE:         "SYS_NICE",
+	linux.CAP_SYS_RESOURCE:     "SYS_RESOURCE",
+	linux.CAP_SYS_TIME:         "SYS_TIME",
+	linux.CAP_SYS_TTY_CONFIG:   "SYS_TTY_CONFIG",
+	linux.CAP_MKNOD:            "MKNOD",
+	linux.CAP_LEASE:            "LEASE",
+	linux.CAP_AUDIT_WRITE:      "AUDIT_WRITE",
+	linux.CAP_AUDIT_CONTROL:    "AUDIT_CONTROL",
+	linux.CAP_SETFCAP:          "SETFCAP",
+	linux.CAP_MAC_OVERRIDE:     "MAC_OVERRIDE",
+	linux.CAP_MAC_ADMIN:        "MAC_ADMIN",
+	linux.CAP_SYSLOG:           "SYSLOG",
+	linux.CAP_WAKE_ALARM:       "WAKE_ALARM",
+	linux.CAP_BLOCK_SUSPEND:    "BLOCK_SUSPEND",
+	linux.CAP_AUDIT_READ:       "AUDIT_READ",
+}
+
+// ParseCapabilities parses a capability name, with or without the CAP_
+// prefix and in any case, into the set holding it. ALL is every
+// capability.
+func ParseCapabilities(name string) (CapabilitySet, error) {
+	name = strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+
+	if name == "ALL" {
+		return AllCapabilities, nil
+	}
+
+	for cp, n := range capabilityNames {
+		if n == name {
+			return CapabilitySetOf(linux.Capability(cp)), nil
+		}
+	}
+
+	return 0, errors.Wrapf(ErrUnknownCapability, "capability: %s", name)
+}
+
+// HasCapability reports whether c can use cp: whether it's in the
+// effective set.
+func (c *Credentials) HasCapability(cp linux.Capability) bool {
+	return c.EffectiveCaps.Has(cp)
+}
+
+// updateCapabilities adjusts the capabilities after the uids changed from
+// old, as Linux does for a process that isn't using securebits: leaving
+// uid 0 behind entirely loses them, unless KeepCaps is set, and the
+// effective set follows the effective uid and filesystem uid to and from
+// 0.
+func (c *Credentials) updateCapabilities(old *Credentials) {
+	wasRoot := old.RealUID == 0 || old.EffectiveUID == 0 || old.SavedUID == 0
+	isRoot := c.RealUID == 0 || c.EffectiveUID == 0 || c.SavedUID == 0
+
+	if wasRoot && !isRoot {
+		if !c.KeepCaps {
+			c.PermittedCaps = 0
+			c.EffectiveCaps = 0
+		}
+
+		c.AmbientCaps = 0
+	}
+
+	switch {
+	case old.EffectiveUID == 0 && c.EffectiveUID != 0:
+		c.EffectiveCaps = 0
+	case old.EffectiveUID != 0 && c.EffectiveUID == 0:
+		c.EffectiveCaps = c.PermittedCaps
+	}
+
+	switch {
+	case old.FilesystemUID == 0 && c.FilesystemUID != 0:
+		c.EffectiveCaps &^= fsCapabilities
+	case old.FilesystemUID != 0 && c.FilesystemUID == 0:
+		c.EffectiveCaps |= c.PermittedCaps & fsCapabilities
+	}
+}
+
+// SetCapabilities is capset(2): the permitted set can only shrink, the
+// effective set must be permitted, and the inheritable set can only gain
+// what's permitted, or with CAP_SETPCAP what's in the bounding set.
+func (c *Credentials) SetCapabilities(permitted, inheritable, effective CapabilitySet) error {
+	allowed := c.InheritableCaps | c.PermittedCaps
+	if c.HasCapability(linux.CAP_SETPCAP) {
+		allowed = c.InheritableCaps | c.BoundingCaps
+	}
+
+	if inheritable&^allowed != 0 || inheritable&^(c.InheritableCaps|c.BoundingCaps) != 0 {
+		return ErrNotPermitted
+	}
+
+	if permitted&^c.PermittedCaps != 0 || effective&^permitted != 0 {
+		return ErrNotPermitted
+	}
+
+	c.PermittedCaps = permitted
+	c.InheritableCaps = inheritable
+	c.EffectiveCaps = effective
+	c.AmbientCaps &= permitted & inheritable
+
+	return nil
+}
+
+// DropBoundingCapability is PR_CAPBSET_DROP, which takes CAP_SETPCAP.
+func (c *Credentials) DropBoundingCapability(cp linux.Capability) error {
+	if !cp.Ok() {
+		return ErrUnknownCapability
+	}
+
+	if !c.HasCapability(linux.CAP_SETPCAP) {
+		return ErrNotPermitted
+	}
+
+	c.BoundingCaps &^= CapabilitySetOf(cp)
+
+	return nil
+}
+
+// RaiseAmbientCapability is PR_CAP_AMBIENT_RAISE: only a capability that's
+// both permitted and inheritable can be kept across execve(2) this way.
+func (c *Credentials) RaiseAmbientCapability(cp linux.Capability) error {
+	if !cp.Ok() {
+		return ErrUnknownCapability
+	}
+
+	if !c.PermittedCaps.Has(cp) || !c.InheritableCaps.Has(cp) {
+		return ErrNotPermitted
+	}
+
+	c.AmbientCaps |= CapabilitySetOf(cp)
+
+	return nil
+}
+
+// Exec updates the capabilities for execve(2) of a program without file
+// capabilities. Root is treated as if the program had them all, so it
+// keeps what's in the bounding set; anyone else only keeps the ambient
+// set.
+func (c *Credentials) Exec() {
+	c.PermittedCaps = c.AmbientCaps
+
+	if c.RealUID == 0 || c.EffectiveUID == 0 {
+		c.PermittedCaps |= c.InheritableCaps | c.BoundingCaps
+	}
+
+	if c.EffectiveUID == 0 {
+		c.EffectiveCaps = c.PermittedCaps
+	} else {
+		c.EffectiveCaps = c.AmbientCaps
+	}
+
+	// Linux keeps KEEPCAPS only until execve(2).
+	c.KeepCaps = false
+}
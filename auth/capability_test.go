@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapabilities(t *testing.T) {
+	t.Run("gives root Docker's default capabilities", func(t *testing.T) {
+		root := New(0, 0)
+		require.Equal(t, DefaultCapabilities, root.EffectiveCaps)
+		require.True(t, root.HasCapability(linux.CAP_NET_BIND_SERVICE))
+		require.False(t, root.HasCapability(linux.CAP_SYS_ADMIN))
+		require.False(t, root.HasCapability(linux.CAP_NET_ADMIN))
+
+		require.Zero(t, New(1000, 1000).EffectiveCaps)
+		require.Equal(t, DefaultCapabilities, New(1000, 1000).BoundingCaps)
+	})
+
+	t.Run("parses names with or without the prefix", func(t *testing.T) {
+		caps, err := ParseCapabilities("net_bind_service")
+		require.NoError(t, err)
+		require.Equal(t, CapabilitySetOf(linux.CAP_NET_BIND_SERVICE), caps)
+
+		caps, err = ParseCapabilities("CAP_KILL")
+		require.NoError(t, err)
+		require.True(t, caps.Has(linux.CAP_KILL))
+
+		caps, err = ParseCapabilities("all")
+		require.NoError(t, err)
+		require.Equal(t, AllCapabilities, caps)
+
+		_, err = ParseCapabilities("FLY")
+		require.Equal(t, ErrUnknownCapability, errors.Cause(err))
+	})
+
+	t.Run("loses them all on giving up uid 0", func(t *testing.T) {
+		c := New(0, 0)
+		require.NoError(t, c.SetUID(1000))
+
+		require.Zero(t, c.PermittedCaps)
+		require.Zero(t, c.EffectiveCaps)
+	})
+
+	t.Run("keeps the permitted set with keepcaps", func(t *testing.T) {
+		c := New(0, 0)
+		c.KeepCaps = true
+
+		require.NoError(t, c.SetUID(1000))
+		require.Equal(t, DefaultCapabilities, c.PermittedCaps)
+		require.Zero(t, c.EffectiveCaps)
+
+		require.NoError(t, c.SetCapabilities(c.PermittedCaps, 0, CapabilitySetOf(linux.CAP_KILL)))
+		require.True(t, c.HasCapability(linux.CAP_KILL))
+	})
+
+	t.Run("follows the effective uid in and out of 0", func(t *testing.T) {
+		c := New(0, 0)
+
+		require.NoError(t, c.SetREUID(NoID, 1000))
+		require.Zero(t, c.EffectiveCaps)
+		require.Equal(t, DefaultCapabilities, c.PermittedCaps)
+
+		require.NoError(t, c.SetREUID(NoID, 0))
+		require.Equal(t, DefaultCapabilities, c.EffectiveCaps)
+	})
+
+	t.Run("drops the filesystem capabilities with the filesystem uid", func(t *testing.T) {
+		c := New(0, 0)
+		c.SetFSUID(1000)
+
+		require.False(t, c.HasCapability(linux.CAP_DAC_OVERRIDE))
+		require.True(t, c.HasCapability(linux.CAP_KILL))
+
+		c.SetFSUID(0)
+		require.True(t, c.HasCapability(linux.CAP_DAC_OVERRIDE))
+	})
+
+	t.Run("only shrinks the permitted set", func(t *testing.T) {
+		c := New(0, 0)
+		kill := CapabilitySetOf(linux.CAP_KILL)
+
+		require.Equal(t, ErrNotPermitted, c.SetCapabilities(kill, 0, CapabilitySetOf(linux.CAP_CHOWN)))
+		require.NoError(t, c.SetCapabilities(kill, 0, kill))
+		require.Equal(t, ErrNotPermitted, c.SetCapabilities(AllCapabilities, 0, 0))
+		require.Equal(t, ErrNotPermitted, c.SetCapabilities(kill, kill|CapabilitySetOf(linux.CAP_CHOWN), kill))
+	})
+
+	t.Run("drops from the bounding set with CAP_SETPCAP", func(t *testing.T) {
+		c := New(0, 0)
+		require.NoError(t, c.DropBoundingCapability(linux.CAP_NET_RAW))
+		require.False(t, c.BoundingCaps.Has(linux.CAP_NET_RAW))
+
+		require.Equal(t, ErrNotPermitted, New(1000, 1000).DropBoundingCapability(linux.CAP_NET_RAW))
+		require.Equal(t, ErrUnknownCapability, c.DropBoundingCapability(linux.MaxCapability+1))
+	})
+
+	t.Run("keeps only ambient capabilities across exec without root", func(t *testing.T) {
+		c := New(0, 0)
+		c.KeepCaps = true
+		require.NoError(t, c.SetUID(1000))
+
+		bind := CapabilitySetOf(linux.CAP_NET_BIND_SERVICE)
+		require.Equal(t, ErrNotPermitted, c.RaiseAmbientCapability(linux.CAP_NET_BIND_SERVICE))
+
+		require.NoError(t, c.SetCapabilities(c.PermittedCaps, bind, 0))
+		require.NoError(t, c.RaiseAmbientCapability(linux.CAP_NET_BIND_SERVICE))
+
+		c.Exec()
+		require.Equal(t, bind, c.PermittedCaps)
+		require.Equal(t, bind, c.EffectiveCaps)
+		require.False(t, c.KeepCaps)
+	})
+
+	t.Run("gives root the bounding set on exec", func(t *testing.T) {
+		c := New(0, 0)
+		require.NoError(t, c.DropBoundingCapability(linux.CAP_NET_RAW))
+		require.NoError(t, c.SetCapabilities(0, 0, 0))
+
+		c.Exec()
+		require.Equal(t, c.BoundingCaps, c.EffectiveCaps)
+		require.False(t, c.HasCapability(linux.CAP_NET_RAW))
+	})
+}
@@ -0,0 +1,19 @@
+package auth
+
+import "context"
+
+type credentialsKey struct{}
+
+// ContextWithCredentials returns a context that acts with creds, which
+// the filesystem checks access against.
+func ContextWithCredentials(ctx context.Context, creds *Credentials) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, creds)
+}
+
+// CredentialsFromContext returns the credentials ctx acts with. A context
+// without any is the kernel acting on its own, which isn't subject to
+// access checks.
+func CredentialsFromContext(ctx context.Context) (*Credentials, bool) {
+	creds, ok := ctx.Value(credentialsKey{}).(*Credentials)
+	return creds, ok
+}
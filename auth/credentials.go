@@ -0,0 +1,340 @@
+// Package auth implements the credentials of credentials(7): the user and
+// group ids a process acts as, and the rules by which it can change them.
+package auth
+
+import (
+	"sort"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotPermitted = errors.New("operation not permitted")
+	ErrInvalidID    = errors.New("invalid user or group id")
+)
+
+const (
+	// NoID is the id setreuid(2) and the like take to leave an id as it
+	// is, (uid_t)-1. It's never a valid id.
+	NoID = -1
+
+	// MaxGroups is NGROUPS_MAX, the most supplementary groups a process
+	// can have.
+	MaxGroups = 65536
+)
+
+// Credentials are the ids of a process. A process's Credentials are never
+// changed once they're its own; changing them means replacing them with
+// a changed Copy.
+type Credentials struct {
+	RealUID       int
+	EffectiveUID  int
+	SavedUID      int
+	FilesystemUID int
+
+	RealGID       int
+	EffectiveGID  int
+	SavedGID      int
+	FilesystemGID int
+
+	// Groups are the supplementary groups, sorted.
+	Groups []int
+
+	// The capability sets of capabilities(7). Only the effective set
+	// is checked; the others limit what it can become.
+	PermittedCaps   CapabilitySet
+	InheritableCaps CapabilitySet
+	EffectiveCaps   CapabilitySet
+	BoundingCaps    CapabilitySet
+	AmbientCaps     CapabilitySet
+
+	// KeepCaps is PR_SET_KEEPCAPS, which keeps the permitted set when
+	// the process gives up uid 0.
+	KeepCaps bool
+}
+
+// New returns the credentials of a process that is uid and gid in every
+// respect, without supplementary groups. Root has DefaultCapabilities, and
+// anyone else none; nothing it runs can get more.
+func New(uid, gid int) *Credentials {
+	c := &Credentials{
+		RealUID:       uid,
+		EffectiveUID:  uid,
+		SavedUID:      uid,
+		FilesystemUID: uid,
+		RealGID:       gid,
+		EffectiveGID:  gid,
+		SavedGID:      gid,
+		FilesystemGID: gid,
+		BoundingCaps:  DefaultCapabilities,
+	}
+
+	if uid == 0 {
+		c.PermittedCaps = DefaultCapabilities
+		c.EffectiveCaps = DefaultCapabilities
+	}
+
+	return c
+}
+
+// Copy returns a copy of c that can be changed.
+func (c *Credentials) Copy() *Credentials {
+	n := *c
+	n.Groups = append([]int(nil), c.Groups...)
+
+	return &n
+}
+
+// InGroup reports whether files of gid are accessed with its group
+// permissions: whether it's the filesystem gid or a supplementary group.
+func (c *Credentials) InGroup(gid int) bool {
+	if gid == c.FilesystemGID {
+		return true
+	}
+
+	i := sort.SearchInts(c.Groups, gid)
+
+	return i < len(c.Groups) && c.Groups[i] == gid
+}
+
+// canSetUID reports whether c can take on any uid, as CAP_SETUID allows.
+func (c *Credentials) canSetUID() bool {
+	return c.HasCapability(linux.CAP_SETUID)
+}
+
+// canSetGID reports whether c can take on any gid, as CAP_SETGID allows.
+func (c *Credentials) canSetGID() bool {
+	return c.HasCapability(linux.CAP_SETGID)
+}
+
+// MayClaimUID reports whether the process can pass uid off as its own, as
+// in SCM_CREDENTIALS: it can if it's one of its uids, or any with
+// privilege.
+func (c *Credentials) MayClaimUID(uid int) bool {
+	return c.canSetUID() || uid == c.RealUID || uid == c.EffectiveUID || uid == c.SavedUID
+}
+
+// MayClaimGID reports whether the process can pass gid off as its own.
+func (c *Credentials) MayClaimGID(gid int) bool {
+	return c.canSetGID() || gid == c.RealGID || gid == c.EffectiveGID || gid == c.SavedGID
+}
+
+func validID(id int) bool {
+	return id >= 0 && int64(id) <= 0xfffffffe
+}
+
+// SetUID is setuid(2): a privileged process becomes uid in every respect,
+// and any other only changes its effective uid, to its real or saved one.
+func (c *Credentials) SetUID(uid int) error {
+	if !validID(uid) {
+		return ErrInvalidID
+	}
+
+	old := *c
+
+	switch {
+	case c.canSetUID():
+		c.RealUID, c.SavedUID = uid, uid
+	case uid != c.RealUID && uid != c.SavedUID:
+		return ErrNotPermitted
+	}
+
+	c.EffectiveUID, c.FilesystemUID = uid, uid
+	c.updateCapabilities(&old)
+
+	return nil
+}
+
+// SetGID is setgid(2), as SetUID is setuid(2).
+func (c *Credentials) SetGID(gid int) error {
+	if !validID(gid) {
+		return ErrInvalidID
+	}
+
+	switch {
+	case c.canSetGID():
+		c.RealGID, c.SavedGID = gid, gid
+	case gid != c.RealGID && gid != c.SavedGID:
+		return ErrNotPermitted
+	}
+
+	c.EffectiveGID, c.FilesystemGID = gid, gid
+
+	return nil
+}
+
+// setre is the rule of setreuid(2) and setregid(2), for the real,
+// effective and saved ids in ids: without privilege, the real id can only
+// be swapped with the effective one, and the effective one only set to one
+// of the three. The saved id follows the effective one whenever the real
+// one is set, or the effective one is set to something other than it.
+func setre(ids [3]*int, r, e int, privileged bool) error {
+	realID, effectiveID, savedID := ids[0], ids[1], ids[2]
+
+	if (r != NoID && !validID(r)) || (e != NoID && !validID(e)) {
+		return ErrInvalidID
+	}
+
+	if !privileged {
+		if r != NoID && r != *realID && r != *effectiveID {
+			return ErrNotPermitted
+		}
+
+		if e != NoID && e != *realID && e != *effectiveID && e != *savedID {
+			return ErrNotPermitted
+		}
+	}
+
+	oldReal := *realID
+
+	if r != NoID {
+		*realID = r
+	}
+
+	if e != NoID {
+		*effectiveID = e
+	}
+
+	if r != NoID || (e != NoID && e != oldReal) {
+		*savedID = *effectiveID
+	}
+
+	return nil
+}
+
+// SetREUID is setreuid(2).
+func (c *Credentials) SetREUID(r, e int) error {
+	old := *c
+
+	err := setre([3]*int{&c.RealUID, &c.EffectiveUID, &c.SavedUID}, r, e, c.canSetUID())
+	if err != nil {
+		return err
+	}
+
+	c.FilesystemUID = c.EffectiveUID
+	c.updateCapabilities(&old)
+
+	return nil
+}
+
+// SetREGID is setregid(2).
+func (c *Credentials) SetREGID(r, e int) error {
+	err := setre([3]*int{&c.RealGID, &c.EffectiveGID, &c.SavedGID}, r, e, c.canSetGID())
+	if err != nil {
+		return err
+	}
+
+	c.FilesystemGID = c.EffectiveGID
+
+	return nil
+}
+
+// setres is the rule of setresuid(2) and setresgid(2): without privilege,
+// each id can only be set to one of the three the process has.
+func setres(ids [3]*int, values [3]int, privileged bool) error {
+	for _, v := range values {
+		if v != NoID && !validID(v) {
+			return ErrInvalidID
+		}
+	}
+
+	if !privileged {
+		for _, v := range values {
+			if v != NoID && v != *ids[0] && v != *ids[1] && v != *ids[2] {
+				return ErrNotPermitted
+			}
+		}
+	}
+
+	for i, v := range values {
+		if v != NoID {
+			*ids[i] = v
+		}
+	}
+
+	return nil
+}
+
+// SetRESUID is setresuid(2).
+func (c *Credentials) SetRESUID(r, e, s int) error {
+	old := *c
+
+	err := setres([3]*int{&c.RealUID, &c.EffectiveUID, &c.SavedUID}, [3]int{r, e, s}, c.canSetUID())
+	if err != nil {
+		return err
+	}
+
+	c.FilesystemUID = c.EffectiveUID
+	c.updateCapabilities(&old)
+
+	return nil
+}
+
+// SetRESGID is setresgid(2).
+func (c *Credentials) SetRESGID(r, e, s int) error {
+	err := setres([3]*int{&c.RealGID, &c.EffectiveGID, &c.SavedGID}, [3]int{r, e, s}, c.canSetGID())
+	if err != nil {
+		return err
+	}
+
+	c.FilesystemGID = c.EffectiveGID
+
+	return nil
+}
+
+// SetFSUID is setfsuid(2). The filesystem uid can be set to any of the
+// process's uids, or anything with privilege, and is otherwise left be
+// without an error. It returns the filesystem uid from before.
+func (c *Credentials) SetFSUID(uid int) int {
+	old := c.FilesystemUID
+
+	if !validID(uid) {
+		return old
+	}
+
+	if c.canSetUID() || uid == c.RealUID || uid == c.EffectiveUID || uid == c.SavedUID || uid == c.FilesystemUID {
+		prev := *c
+		c.FilesystemUID = uid
+		c.updateCapabilities(&prev)
+	}
+
+	return old
+}
+
+// SetFSGID is setfsgid(2), as SetFSUID is setfsuid(2).
+func (c *Credentials) SetFSGID(gid int) int {
+	old := c.FilesystemGID
+
+	if !validID(gid) {
+		return old
+	}
+
+	if c.canSetGID() || gid == c.RealGID || gid == c.EffectiveGID || gid == c.SavedGID || gid == c.FilesystemGID {
+		c.FilesystemGID = gid
+	}
+
+	return old
+}
+
+// SetGroups is setgroups(2), which only a privileged process can do.
+func (c *Credentials) SetGroups(groups []int) error {
+	if !c.canSetGID() {
+		return ErrNotPermitted
+	}
+
+	if len(groups) > MaxGroups {
+		return ErrInvalidID
+	}
+
+	for _, g := range groups {
+		if !validID(g) {
+			return ErrInvalidID
+		}
+	}
+
+	c.Groups = append([]int(nil), groups...)
+	sort.Ints(c.Groups)
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentials(t *testing.T) {
+	uids := func(c *Credentials) [4]int {
+		return [4]int{c.RealUID, c.EffectiveUID, c.SavedUID, c.FilesystemUID}
+	}
+
+	gids := func(c *Credentials) [4]int {
+		return [4]int{c.RealGID, c.EffectiveGID, c.SavedGID, c.FilesystemGID}
+	}
+
+	t.Run("setuid as root changes every uid", func(t *testing.T) {
+		c := New(0, 0)
+		require.NoError(t, c.SetUID(1000))
+		require.Equal(t, [4]int{1000, 1000, 1000, 1000}, uids(c))
+
+		require.Equal(t, ErrNotPermitted, c.SetUID(0))
+	})
+
+	t.Run("setuid without privilege only changes the effective uid", func(t *testing.T) {
+		c := New(1000, 1000)
+		c.SavedUID = 0
+
+		require.NoError(t, c.SetUID(0))
+		require.Equal(t, [4]int{1000, 0, 0, 0}, uids(c))
+
+		c = New(1000, 1000)
+		require.Equal(t, ErrNotPermitted, c.SetUID(2000))
+		require.Equal(t, ErrInvalidID, c.SetUID(NoID))
+	})
+
+	t.Run("setgid follows the effective uid", func(t *testing.T) {
+		c := New(0, 0)
+		require.NoError(t, c.SetGID(100))
+		require.Equal(t, [4]int{100, 100, 100, 100}, gids(c))
+
+		c = New(1000, 100)
+		require.Equal(t, ErrNotPermitted, c.SetGID(0))
+		require.NoError(t, c.SetGID(100))
+	})
+
+	t.Run("setreuid swaps the real and effective uids", func(t *testing.T) {
+		c := New(0, 0)
+		require.NoError(t, c.SetREUID(NoID, 1000))
+		require.Equal(t, [4]int{0, 1000, 1000, 1000}, uids(c))
+
+		c = New(1000, 1000)
+		c.EffectiveUID = 2000
+
+		require.NoError(t, c.SetREUID(2000, 1000))
+		require.Equal(t, [4]int{2000, 1000, 1000, 1000}, uids(c))
+
+		require.Equal(t, ErrNotPermitted, c.SetREUID(3000, NoID))
+		require.Equal(t, ErrNotPermitted, c.SetREUID(NoID, 3000))
+	})
+
+	t.Run("setreuid leaves the saved uid when the effective one returns to the real one", func(t *testing.T) {
+		c := New(1000, 1000)
+		c.EffectiveUID, c.SavedUID = 0, 0
+
+		require.NoError(t, c.SetREUID(NoID, 1000))
+		require.Equal(t, [4]int{1000, 1000, 0, 1000}, uids(c))
+	})
+
+	t.Run("setresuid without privilege only shuffles the uids", func(t *testing.T) {
+		c := New(1000, 1000)
+		c.SavedUID = 2000
+
+		require.NoError(t, c.SetRESUID(2000, NoID, 1000))
+		require.Equal(t, [4]int{2000, 1000, 1000, 1000}, uids(c))
+
+		require.Equal(t, ErrNotPermitted, c.SetRESUID(NoID, NoID, 3000))
+		require.Equal(t, [4]int{2000, 1000, 1000, 1000}, uids(c))
+	})
+
+	t.Run("setresgid as root sets anything", func(t *testing.T) {
+		c := New(0, 0)
+		require.NoError(t, c.SetRESGID(1, 2, 3))
+		require.Equal(t, [4]int{1, 2, 3, 2}, gids(c))
+	})
+
+	t.Run("setfsuid silently refuses what isn't permitted", func(t *testing.T) {
+		c := New(1000, 1000)
+		c.SavedUID = 2000
+
+		require.Equal(t, 1000, c.SetFSUID(2000))
+		require.Equal(t, 2000, c.FilesystemUID)
+
+		require.Equal(t, 2000, c.SetFSUID(0))
+		require.Equal(t, 2000, c.FilesystemUID)
+
+		require.Equal(t, 1000, c.SetFSGID(NoID))
+	})
+
+	t.Run("setgroups needs privilege", func(t *testing.T) {
+		c := New(0, 0)
+		require.NoError(t, c.SetGroups([]int{20, 4, 10}))
+		require.Equal(t, []int{4, 10, 20}, c.Groups)
+
+		require.True(t, c.InGroup(10))
+		require.True(t, c.InGroup(0))
+		require.False(t, c.InGroup(5))
+
+		require.NoError(t, c.SetUID(1000))
+		require.Equal(t, ErrNotPermitted, c.SetGroups(nil))
+		require.Equal(t, []int{4, 10, 20}, c.Groups)
+	})
+
+	t.Run("copies don't share groups", func(t *testing.T) {
+		c := New(0, 0)
+		require.NoError(t, c.SetGroups([]int{1, 2}))
+
+		n := c.Copy()
+		n.Groups[0] = 5
+
+		require.Equal(t, []int{1, 2}, c.Groups)
+	})
+
+	t.Run("only claims its own ids without privilege", func(t *testing.T) {
+		c := New(1000, 100)
+		c.SavedUID = 2000
+
+		require.True(t, c.MayClaimUID(2000))
+		require.False(t, c.MayClaimUID(0))
+		require.True(t, c.MayClaimGID(100))
+		require.False(t, c.MayClaimGID(0))
+
+		require.True(t, New(0, 0).MayClaimUID(1234))
+	})
+}
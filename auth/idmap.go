@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidIDMap = errors.New("invalid id map")
+
+const (
+	// UnmappedID is the guest id of a host id that isn't mapped into the
+	// guest, Linux's INVALID_UID. No credentials have it, so no one is
+	// the owner of what it owns.
+	UnmappedID = -1
+
+	// OverflowID is the id UnmappedID is shown as, as Linux shows
+	// /proc/sys/kernel/overflowuid.
+	OverflowID = 65534
+)
+
+// ShownID returns the id a file owned by id is shown to be owned by.
+func ShownID(id int) int {
+	if id == UnmappedID {
+		return OverflowID
+	}
+
+	return id
+}
+
+// maxID is the highest id there is, past which ranges can't go.
+const maxID = 1<<32 - 1
+
+// IDMapEntry maps Count ids, starting at First in the guest, onto those
+// starting at HostFirst on the host. It's a line of /proc/self/uid_map.
+type IDMapEntry struct {
+	First     int
+	HostFirst int
+	Count     int
+}
+
+// IDMap maps the uids or gids of the guest onto those of the host. A nil
+// map is the identity, mapping every id onto itself.
+type IDMap []IDMapEntry
+
+// ParseIDMapEntry parses an entry given as GUEST:HOST:COUNT.
+func ParseIDMapEntry(spec string) (IDMapEntry, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 {
+		return IDMapEntry{}, errors.Wrapf(ErrInvalidIDMap, "expected GUEST:HOST:COUNT: %s", spec)
+	}
+
+	var ids [3]int
+
+	for i, part := range parts {
+		id, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return IDMapEntry{}, errors.Wrapf(ErrInvalidIDMap, "bad id %q: %s", part, spec)
+		}
+
+		ids[i] = int(id)
+	}
+
+	return IDMapEntry{First: ids[0], HostFirst: ids[1], Count: ids[2]}, nil
+}
+
+// NewIDMap returns the map of entries, which, as Linux requires, must not
+// overlap on either side.
+func NewIDMap(entries ...IDMapEntry) (IDMap, error) {
+	for i, e := range entries {
+		if e.Count <= 0 || e.First < 0 || e.HostFirst < 0 ||
+			e.First+e.Count-1 > maxID || e.HostFirst+e.Count-1 > maxID {
+			return nil, errors.Wrapf(ErrInvalidIDMap, "bad range %d:%d:%d", e.First, e.HostFirst, e.Count)
+		}
+
+		for _, o := range entries[:i] {
+			if overlaps(e.First, o.First, e.Count, o.Count) || overlaps(e.HostFirst, o.HostFirst, e.Count, o.Count) {
+				return nil, errors.Wrapf(ErrInvalidIDMap, "overlapping ranges %d:%d:%d and %d:%d:%d",
+					o.First, o.HostFirst, o.Count, e.First, e.HostFirst, e.Count)
+			}
+		}
+	}
+
+	return IDMap(entries), nil
+}
+
+// overlaps reports whether the ranges of a and b ids from a0 and b0 do.
+func overlaps(a0, b0, a, b int) bool {
+	return a0 < b0+b && b0 < a0+a
+}
+
+// ToHost returns the host id the guest id is mapped onto, if it is.
+func (m IDMap) ToHost(id int) (int, bool) {
+	if m == nil {
+		return id, true
+	}
+
+	for _, e := range m {
+		if id >= e.First && id < e.First+e.Count {
+			return e.HostFirst + id - e.First, true
+		}
+	}
+
+	return 0, false
+}
+
+// FromHost returns the guest id the host id is mapped from, or UnmappedID
+// if it isn't.
+func (m IDMap) FromHost(id int) int {
+	if m == nil {
+		return id
+	}
+
+	for _, e := range m {
+		if id >= e.HostFirst && id < e.HostFirst+e.Count {
+			return e.First + id - e.HostFirst
+		}
+	}
+
+	return UnmappedID
+}
+
+// String formats m as /proc/self/uid_map does.
+func (m IDMap) String() string {
+	if m == nil {
+		m = IDMap{{First: 0, HostFirst: 0, Count: maxID}}
+	}
+
+	var buf bytes.Buffer
+
+	for _, e := range m {
+		fmt.Fprintf(&buf, "%10d %10d %10d\n", e.First, e.HostFirst, e.Count)
+	}
+
+	return buf.String()
+}
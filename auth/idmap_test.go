@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIDMap(t *testing.T) {
+	t.Run("maps ranges both ways", func(t *testing.T) {
+		m, err := NewIDMap(IDMapEntry{0, 1000, 1}, IDMapEntry{1, 100000, 65536})
+		require.NoError(t, err)
+
+		id, ok := m.ToHost(0)
+		require.True(t, ok)
+		require.Equal(t, 1000, id)
+
+		id, ok = m.ToHost(1000)
+		require.True(t, ok)
+		require.Equal(t, 100999, id)
+
+		_, ok = m.ToHost(65537)
+		require.False(t, ok)
+
+		require.Equal(t, 0, m.FromHost(1000))
+		require.Equal(t, 5, m.FromHost(100004))
+		require.Equal(t, UnmappedID, m.FromHost(0))
+		require.Equal(t, OverflowID, ShownID(m.FromHost(0)))
+	})
+
+	t.Run("leaves ids alone without entries", func(t *testing.T) {
+		var m IDMap
+
+		id, ok := m.ToHost(1234)
+		require.True(t, ok)
+		require.Equal(t, 1234, id)
+		require.Equal(t, 0, m.FromHost(0))
+
+		require.Equal(t, "         0          0 4294967295\n", m.String())
+	})
+
+	t.Run("parses GUEST:HOST:COUNT", func(t *testing.T) {
+		e, err := ParseIDMapEntry("0:1000:1")
+		require.NoError(t, err)
+		require.Equal(t, IDMapEntry{First: 0, HostFirst: 1000, Count: 1}, e)
+
+		_, err = ParseIDMapEntry("0:1000")
+		require.Equal(t, ErrInvalidIDMap, errors.Cause(err))
+
+		_, err = ParseIDMapEntry("0:-1:1")
+		require.Equal(t, ErrInvalidIDMap, errors.Cause(err))
+	})
+
+	t.Run("rejects overlapping ranges", func(t *testing.T) {
+		_, err := NewIDMap(IDMapEntry{0, 1000, 10}, IDMapEntry{5, 2000, 10})
+		require.Equal(t, ErrInvalidIDMap, errors.Cause(err))
+
+		_, err = NewIDMap(IDMapEntry{0, 1000, 10}, IDMapEntry{20, 1005, 10})
+		require.Equal(t, ErrInvalidIDMap, errors.Cause(err))
+
+		_, err = NewIDMap(IDMapEntry{0, 1000, 0})
+		require.Equal(t, ErrInvalidIDMap, errors.Cause(err))
+	})
+
+	t.Run("formats as uid_map", func(t *testing.T) {
+		m, err := NewIDMap(IDMapEntry{0, 1000, 1})
+		require.NoError(t, err)
+
+		require.Equal(t, "         0       1000          1\n", m.String())
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/tmpfs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/oci"
+)
+
+var ErrNoCommand = errors.New("no command given and the image has no Entrypoint or Cmd")
+
+// imageOptions controls how startImage runs an image.
+type imageOptions struct {
+	// Ref selects the image within the layout.
+	Ref string
+
+	// LayerCache is where decompressed layers are kept, if anywhere.
+	LayerCache string
+
+	// User overrides the user of the image config, if set.
+	User string
+}
+
+// startImage creates the init process for the image stored in the layout
+// directory dir, using the image config for the command, environment,
+// working directory and user.
+func startImage(ctx context.Context, k *kernel.Kernel, dir string, opts imageOptions, args []string) (*kernel.Process, error) {
+	img, err := oci.Open(dir, opts.Ref)
+	if err != nil {
+		return nil, err
+	}
+
+	img.CacheDir = opts.LayerCache
+
+	// Changes made by the container are kept in memory, discarded when it
+	// exits.
+	upper, err := tmpfs.NewTmpFS(tmpfs.Options{Mode: 0755}).Root()
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := img.RootFS(ctx, upper)
+	if err != nil {
+		return nil, err
+	}
+
+	mount := fs.NewMountNamespace()
+	mount.SetRoot(root)
+
+	argv := img.Args(args)
+	if len(argv) == 0 {
+		return nil, ErrNoCommand
+	}
+
+	env := img.Env()
+	cwd := img.WorkingDir()
+
+	cmd, err := lookupCommand(ctx, mount, argv[0], cwd, env)
+	if err != nil {
+		return nil, err
+	}
+
+	user := img.Config.Config.User
+	if opts.User != "" {
+		user = opts.User
+	}
+
+	creds, err := resolveCredentials(ctx, mount, user)
+	if err != nil {
+		return nil, err
+	}
+
+	proc, err := k.InitProcessInNamespace(ctx, mount, cwd, cmd, argv, env)
+	if err != nil {
+		return nil, err
+	}
+
+	proc.SetCredentials(creds)
+
+	return proc, nil
+}
+
+// lookupCommand finds cmd in the PATH given by env, the way a shell would.
+func lookupCommand(ctx context.Context, mount *fs.MountNamespace, cmd, cwd string, env []string) (string, error) {
+	if strings.Contains(cmd, "/") {
+		if !path.IsAbs(cmd) {
+			cmd = path.Join(cwd, cmd)
+		}
+
+		return cmd, nil
+	}
+
+	search := "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			search = kv[len("PATH="):]
+		}
+	}
+
+	for _, dir := range strings.Split(search, ":") {
+		if dir == "" {
+			dir = cwd
+		}
+
+		full := path.Join(dir, cmd)
+
+		dirent, err := mount.LookupPath(ctx, full)
+		if err != nil {
+			continue
+		}
+
+		switch dirent.Inode.StableAttr.Type {
+		case fs.RegularFile, fs.SpecialFile:
+			return full, nil
+		}
+	}
+
+	return "", fs.ErrUnknownPath
+}
@@ -8,9 +8,14 @@ import (
 	"path/filepath"
 	"runtime/pprof"
 
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
 	"github.com/evanphx/columbia/boundary"
-	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/dns"
+	"github.com/evanphx/columbia/fs/dev"
+	kern "github.com/evanphx/columbia/kernel"
 	clog "github.com/evanphx/columbia/log"
+	"github.com/evanphx/columbia/publish"
 	"github.com/evanphx/columbia/syscalls"
 	"github.com/spf13/pflag"
 )
@@ -25,8 +30,40 @@ func (_ closeProtect) Close() error {
 
 var (
 	fRoot = pflag.StringP("root", "r", "", "directory to mount as the root")
+	fRef  = pflag.String("ref", "", "tag of the image to run when the layout holds several")
+
+	fLayerCache = pflag.String("layer-cache", "", "directory to keep decompressed image layers in between runs")
+
+	fTmpfs  = pflag.StringArray("tmpfs", nil, "mount a tmpfs, given as PATH[:size=N,nr_inodes=N,mode=OCTAL,uid=N,gid=N] (repeatable)")
+	fVolume = pflag.StringArrayP("volume", "v", nil, "bind mount a host directory or file, given as HOST:GUEST[:ro] (repeatable)")
+
+	fUser    = pflag.StringP("user", "u", "", "run the command as USER[:GROUP], by name or id, overriding the image's user")
+	fCapAdd  = pflag.StringArray("cap-add", nil, "give the command a capability beyond Docker's defaults, such as SYS_ADMIN to mount or NET_ADMIN, or ALL (repeatable)")
+	fCapDrop = pflag.StringArray("cap-drop", nil, "take a capability, or ALL, away from the command and everything it runs (repeatable)")
+	fUIDMap  = pflag.StringArray("uid-map", nil, "map guest uids onto host uids for the ownership of host files, given as GUEST:HOST:COUNT (repeatable)")
+	fGIDMap  = pflag.StringArray("gid-map", nil, "map guest gids onto host gids for the ownership of host files, given as GUEST:HOST:COUNT (repeatable)")
+
+	fRandomSeed = pflag.Int64("random-seed", 0, "seed /dev/random and /dev/urandom so they produce the same bytes on every run")
+
+	fTTY         = pflag.BoolP("tty", "t", false, "run the command on a pty connected to this terminal, which is put in raw mode")
+	fInteractive = pflag.BoolP("interactive", "i", true, "connect stdin to the command; --interactive=false gives it an empty stdin")
+
+	fIP      = pflag.StringArray("ip", nil, "give the guest a virtual NIC, eth0, with an address, given as ADDR/PREFIX (repeatable)")
+	fPublish = pflag.StringArrayP("publish", "p", nil, "publish a guest port on the host, given as [HOSTIP:]HOSTPORT:GUESTPORT[/tcp|udp] (repeatable)")
+	fHostNet = pflag.StringArray("host-net", nil, "pass sockets through to the host's network, allowing only what the rules allow, each given as in|out:CIDR:PORTS (repeatable)")
+
+	fHostname   = pflag.String("hostname", "", "set the guest's hostname and give it a generated /etc/hostname, /etc/hosts and /etc/resolv.conf naming it, resolved by a DNS stub at 127.0.0.11")
+	fAddHost    = pflag.StringArray("add-host", nil, "add a name to the generated /etc/hosts and the DNS stub, given as NAME:IP (repeatable)")
+	fDNSForward = pflag.Bool("dns-forward", false, "have the DNS stub forward what it can't answer to the host's nameservers")
 )
 
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  %s [flags] --root DIR COMMAND [ARG...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [flags] run IMAGE-DIR [COMMAND [ARG...]]\n\n", os.Args[0])
+	pflag.PrintDefaults()
+}
+
 func main() {
 	cpuprofile := os.Getenv("CPUPROFILE")
 	if cpuprofile != "" {
@@ -40,6 +77,7 @@ func main() {
 		fmt.Printf("pprof: profiling started\n")
 	}
 
+	pflag.Usage = usage
 	pflag.Parse()
 
 	var wi boundary.WasmInterface
@@ -47,30 +85,219 @@ func main() {
 
 	ctx := context.Background()
 
-	kernel, err := kernel.NewKernel(wi.EnvModule())
+	kernel, err := kern.NewKernel(wi.EnvModule())
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if len(*fUIDMap) > 0 || len(*fGIDMap) > 0 {
+		uids, err := parseIDMap(*fUIDMap)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		gids, err := parseIDMap(*fGIDMap)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		kernel.SetIDMaps(uids, gids)
+	}
+
+	if len(*fIP) > 0 {
+		err = addInterface(kernel.Network(), *fIP)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *fHostname != "" {
+		if len(*fHostname) > linux.UTSLen {
+			log.Fatalf("--hostname can't be longer than %d bytes", linux.UTSLen)
+		}
+
+		kernel.UTSNamespace().SetHostName(*fHostname)
+	}
+
+	if len(*fHostNet) > 0 {
+		if len(*fIP) > 0 || len(*fPublish) > 0 {
+			log.Fatal("--host-net can't be combined with --ip or --publish")
+		}
+
+		policy, err := hostNetworkPolicy(*fHostNet)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		kernel.SetNetworkPolicy(policy)
+	}
+
 	wi.Invoker = &syscalls.Invoker{
 		Kernel: kernel,
 	}
 
 	inputArgs := pflag.Args()
+	if len(inputArgs) == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	var proc *kern.Process
+
+	if inputArgs[0] == "run" {
+		if len(inputArgs) < 2 {
+			usage()
+			os.Exit(1)
+		}
+
+		opts := imageOptions{
+			Ref:        *fRef,
+			LayerCache: *fLayerCache,
+			User:       *fUser,
+		}
+
+		proc, err = startImage(ctx, kernel, inputArgs[1], opts, inputArgs[2:])
+	} else {
+		cmd := inputArgs[0]
 
-	cmd := inputArgs[0]
+		args := append([]string{filepath.Base(cmd)}, inputArgs[1:]...)
 
-	args := append([]string{filepath.Base(cmd)}, inputArgs[1:]...)
+		proc, err = kernel.InitProcess(ctx, cmd, args, os.Environ(), *fRoot)
+	}
 
-	proc, err := kernel.InitProcess(ctx, cmd, args, os.Environ(), *fRoot)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	proc.HookupStdio(os.Stdin, closeProtect{os.Stdout}, closeProtect{os.Stderr})
+	// Images resolve the user themselves, as it can come from their config.
+	if *fUser != "" && inputArgs[0] != "run" {
+		creds, err := resolveCredentials(ctx, proc.Mount, *fUser)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		proc.SetCredentials(creds)
+	}
+
+	if len(*fCapAdd) > 0 || len(*fCapDrop) > 0 {
+		add, err := parseCapabilities(*fCapAdd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		drop, err := parseCapabilities(*fCapDrop)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		proc.UpdateCredentials(func(creds *auth.Credentials) error {
+			applyCapabilities(creds, add, drop)
+			return nil
+		})
+	}
+
+	// Images get a /proc and /dev even if they lack the directories, but a
+	// host root is only given them where it already has them.
+	err = mountProc(ctx, kernel, proc.Mount, inputArgs[0] == "run")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	devOpts := dev.Options{Signaler: kernel}
+
+	if pflag.CommandLine.Changed("random-seed") {
+		devOpts.Random = dev.NewSeededRandom(*fRandomSeed)
+	}
+
+	// The guest shares our controlling terminal, if there is one.
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		devOpts.TTY = tty
+	}
+
+	devfs := dev.NewDevFS(devOpts)
+
+	err = mountDev(ctx, proc.Mount, devfs, inputArgs[0] == "run")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var stub *dns.Server
+
+	if *fHostname != "" || len(*fAddHost) > 0 || *fDNSForward {
+		opts := nameOptions{
+			Hostname: *fHostname,
+			AddHosts: *fAddHost,
+			Forward:  *fDNSForward,
+		}
+
+		stub, err = setupNameResolution(ctx, kernel, proc.Mount, opts, inputArgs[0] == "run")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, spec := range *fVolume {
+		err = mountVolume(ctx, kernel, proc.Mount, spec, inputArgs[0] == "run")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, spec := range *fTmpfs {
+		err = mountTmpfs(ctx, proc.Mount, spec, inputArgs[0] == "run")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var published []*publish.Publisher
+
+	for _, s := range *fPublish {
+		spec, err := publish.ParseSpec(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		p, err := publish.Publish(clog.L, kernel.Network(), spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		published = append(published, p)
+	}
+
+	finish := func() {}
+
+	if *fTTY {
+		finish, err = attachTerminal(ctx, proc, devfs.PTS(), *fInteractive)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		stdin := os.Stdin
+
+		if !*fInteractive {
+			stdin, err = os.Open(os.DevNull)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		proc.HookupStdio(stdin, closeProtect{os.Stdout}, closeProtect{os.Stderr})
+	}
 
 	err = kernel.StartProcess(proc)
 
+	finish()
+
+	for _, p := range published {
+		p.Close()
+	}
+
+	if stub != nil {
+		stub.Close()
+	}
+
 	if cpuprofile != "" {
 		pprof.StopCPUProfile()
 		fmt.Printf("pprof: profiling finished\n")
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/dev"
+	"github.com/evanphx/columbia/fs/host"
+	"github.com/evanphx/columbia/fs/proc"
+	"github.com/evanphx/columbia/fs/tmpfs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/pkg/errors"
+)
+
+var ErrBadMountSpec = errors.New("invalid mount specification")
+
+// parseTmpfs parses a --tmpfs value, PATH[:OPT,...], where the options
+// are those of tmpfs.ParseOptions.
+func parseTmpfs(spec string) (string, tmpfs.Options, error) {
+	target := spec
+
+	var data string
+
+	if idx := strings.IndexByte(spec, ':'); idx != -1 {
+		target = spec[:idx]
+		data = spec[idx+1:]
+	}
+
+	if !path.IsAbs(target) {
+		return "", tmpfs.Options{}, errors.Wrapf(ErrBadMountSpec, "mount point must be absolute: %s", spec)
+	}
+
+	opts, err := tmpfs.ParseOptions(data)
+	if err != nil {
+		return "", opts, errors.Wrapf(ErrBadMountSpec, "%s: %s", spec, err)
+	}
+
+	return path.Clean(target), opts, nil
+}
+
+// mountTmpfs mounts a new tmpfs described by spec into m. With create, a
+// missing mount point is created first.
+func mountTmpfs(ctx context.Context, m *fs.MountNamespace, spec string, create bool) error {
+	target, opts, err := parseTmpfs(spec)
+	if err != nil {
+		return err
+	}
+
+	err = mountPoint(ctx, m, target, true, create)
+	if err != nil {
+		return err
+	}
+
+	root, err := tmpfs.NewTmpFS(opts).Root()
+	if err != nil {
+		return err
+	}
+
+	return m.Mount(ctx, target, &fs.Mount{
+		Root:   root,
+		Source: "tmpfs",
+		Type:   "tmpfs",
+	})
+}
+
+// mkdirAll creates the directory dir and any missing parents.
+func mkdirAll(ctx context.Context, m *fs.MountNamespace, dir string) error {
+	_, err := m.LookupPath(ctx, dir)
+	if err == nil || errors.Cause(err) != fs.ErrUnknownPath {
+		return err
+	}
+
+	err = mkdirAll(ctx, m, path.Dir(dir))
+	if err != nil {
+		return err
+	}
+
+	parent, name, err := m.LookupParent(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	err = fs.CheckWrite(parent)
+	if err != nil {
+		return err
+	}
+
+	return parent.Inode.Ops.CreateDirectory(ctx, parent.Inode, name, 0755)
+}
+
+// parseVolume parses a --volume value, HOST:GUEST[:ro|rw].
+func parseVolume(spec string) (string, string, bool, error) {
+	parts := strings.Split(spec, ":")
+
+	readOnly := false
+
+	switch len(parts) {
+	case 2:
+		// ok
+	case 3:
+		switch parts[2] {
+		case "ro":
+			readOnly = true
+		case "rw":
+			// ok
+		default:
+			return "", "", false, errors.Wrapf(ErrBadMountSpec, "unknown volume option: %s", parts[2])
+		}
+	default:
+		return "", "", false, errors.Wrapf(ErrBadMountSpec, "volume: %s", spec)
+	}
+
+	hostPath, guest := parts[0], parts[1]
+
+	if hostPath == "" || !path.IsAbs(guest) {
+		return "", "", false, errors.Wrapf(ErrBadMountSpec, "volume must be HOST:/GUEST: %s", spec)
+	}
+
+	return hostPath, path.Clean(guest), readOnly, nil
+}
+
+// mountVolume bind mounts the host directory or file described by spec
+// into m. The guest only ever sees what's beneath the host path: lookups
+// of .. stop at the guest's view of the mount point, and symlinks are
+// resolved within the guest's namespace rather than on the host. Its files
+// are owned as k's id maps say. With create, a missing mount point is
+// created first.
+func mountVolume(ctx context.Context, k *kernel.Kernel, m *fs.MountNamespace, spec string, create bool) error {
+	hostPath, guest, readOnly, err := parseVolume(spec)
+	if err != nil {
+		return err
+	}
+
+	hostPath, err = filepath.Abs(hostPath)
+	if err != nil {
+		return err
+	}
+
+	// Symlinks in the host path itself are the user's to choose, so they
+	// are resolved up front.
+	hostPath, err = filepath.EvalSymlinks(hostPath)
+	if err != nil {
+		return err
+	}
+
+	hf, err := host.NewHostFS(hostPath)
+	if err != nil {
+		return err
+	}
+
+	hf.SetIDMaps(k.IDMaps())
+
+	root, err := hf.Root()
+	if err != nil {
+		return err
+	}
+
+	err = mountPoint(ctx, m, guest, root.StableAttr.Type == fs.Directory, create)
+	if err != nil {
+		return err
+	}
+
+	return m.Mount(ctx, guest, &fs.Mount{
+		Root:   root,
+		Flags:  fs.MountFlags{ReadOnly: readOnly, LockReadOnly: readOnly},
+		Source: hostPath,
+		Type:   "hostfs",
+	})
+}
+
+// mountPoint makes sure there's a directory, or a file unless isDir, at p
+// to mount over. Only with create is a missing one made, along with its
+// parents: a host root directory is never changed, so under --root it has
+// to exist already.
+func mountPoint(ctx context.Context, m *fs.MountNamespace, p string, isDir, create bool) error {
+	if !create {
+		_, err := m.LookupPath(ctx, p)
+		if errors.Cause(err) == fs.ErrUnknownPath {
+			return errors.Errorf("mount point %s doesn't exist in the root directory", p)
+		}
+
+		return err
+	}
+
+	err := mkdirAll(ctx, m, path.Dir(p))
+	if err == nil {
+		err = createMountPoint(ctx, m, p, isDir)
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "creating mount point %s", p)
+	}
+
+	return nil
+}
+
+// createMountPoint creates the directory or empty file at p unless it
+// already exists.
+func createMountPoint(ctx context.Context, m *fs.MountNamespace, p string, isDir bool) error {
+	if isDir {
+		return mkdirAll(ctx, m, p)
+	}
+
+	_, err := m.LookupPath(ctx, p)
+	if err == nil || errors.Cause(err) != fs.ErrUnknownPath {
+		return err
+	}
+
+	parent, name, err := m.LookupParent(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	err = fs.CheckWrite(parent)
+	if err != nil {
+		return err
+	}
+
+	_, err = parent.Inode.Ops.Create(ctx, parent.Inode, name, 0644)
+	return err
+}
+
+// mountKernelFS mounts root, a filesystem the kernel provides, at target.
+// With create, a missing target is created first, otherwise the mount is
+// skipped so a host root directory isn't changed.
+func mountKernelFS(ctx context.Context, m *fs.MountNamespace, target, typ string, root *fs.Inode, create bool) error {
+	_, err := m.LookupPath(ctx, target)
+	if err != nil {
+		if errors.Cause(err) != fs.ErrUnknownPath {
+			return err
+		}
+
+		if !create {
+			return nil
+		}
+
+		err = mkdirAll(ctx, m, target)
+		if err != nil {
+			return errors.Wrapf(err, "creating mount point %s", target)
+		}
+	}
+
+	return m.Mount(ctx, target, &fs.Mount{
+		Root:   root,
+		Source: typ,
+		Type:   typ,
+	})
+}
+
+// mountProc mounts a procfs for k at /proc.
+func mountProc(ctx context.Context, k *kernel.Kernel, m *fs.MountNamespace, create bool) error {
+	root, err := proc.NewProcFS(k).Root()
+	if err != nil {
+		return err
+	}
+
+	return mountKernelFS(ctx, m, "/proc", "proc", root, create)
+}
+
+// mountDev mounts devfs at /dev.
+func mountDev(ctx context.Context, m *fs.MountNamespace, devfs *dev.DevFS, create bool) error {
+	root, err := devfs.Root()
+	if err != nil {
+		return err
+	}
+
+	return mountKernelFS(ctx, m, "/dev", "devtmpfs", root, create)
+}
+
+// mountGeneratedFile mounts a file of tfs holding data at target, as Docker
+// mounts the files it generates over those of the image. With create, a
+// missing target is created first, otherwise the mount is skipped.
+func mountGeneratedFile(ctx context.Context, m *fs.MountNamespace, tfs *tmpfs.TmpFS, target string, data []byte, create bool) error {
+	_, err := m.LookupPath(ctx, target)
+	if err != nil {
+		if errors.Cause(err) != fs.ErrUnknownPath {
+			return err
+		}
+
+		if !create {
+			return nil
+		}
+
+		err = mkdirAll(ctx, m, path.Dir(target))
+		if err == nil {
+			err = createMountPoint(ctx, m, target, false)
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "creating mount point %s", target)
+		}
+	}
+
+	dir, err := tfs.Root()
+	if err != nil {
+		return err
+	}
+
+	root, err := dir.Ops.Create(ctx, dir, path.Base(target), 0644)
+	if err != nil {
+		return err
+	}
+
+	w, err := root.Ops.Writer(root)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+
+	return m.Mount(ctx, target, &fs.Mount{
+		Root:   root,
+		Source: "tmpfs",
+		Type:   "tmpfs",
+	})
+}
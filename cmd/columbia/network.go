@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/evanphx/columbia/dns"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/tmpfs"
+	"github.com/evanphx/columbia/kernel"
+	clog "github.com/evanphx/columbia/log"
+	"github.com/evanphx/columbia/netpolicy"
+	"github.com/evanphx/columbia/netstack"
+	"github.com/pkg/errors"
+)
+
+var ErrBadAddress = errors.New("invalid interface address")
+
+// addInterface gives the stack eth0 with the addresses of the --ip flags,
+// each given as ADDR/PREFIX. Its MAC address is locally administered and
+// made from the first address, as Docker makes those of containers.
+func addInterface(stack *netstack.Stack, specs []string) error {
+	addrs := make([]net.IPNet, 0, len(specs))
+
+	for _, spec := range specs {
+		ip, ipnet, err := net.ParseCIDR(spec)
+		if err != nil {
+			return errors.Wrapf(ErrBadAddress, "%s: %s", spec, err)
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		addrs = append(addrs, net.IPNet{IP: ip, Mask: ipnet.Mask})
+	}
+
+	first := addrs[0].IP
+	hw := net.HardwareAddr{0x02, 0x42, 0, 0, 0, 0}
+	copy(hw[2:], first[len(first)-4:])
+
+	stack.AddNIC("eth0", hw, addrs...)
+
+	return nil
+}
+
+// hostNetworkPolicy builds the policy of the --host-net flags, each a rule.
+func hostNetworkPolicy(specs []string) (*netpolicy.Policy, error) {
+	var policy netpolicy.Policy
+
+	for _, spec := range specs {
+		rule, err := netpolicy.ParseRule(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		policy.Rules = append(policy.Rules, rule)
+	}
+
+	return &policy, nil
+}
+
+// nameOptions are the flags that give the guest name resolution.
+type nameOptions struct {
+	Hostname string
+	AddHosts []string
+	Forward  bool
+}
+
+// setupNameResolution mounts the /etc/hostname, /etc/hosts and
+// /etc/resolv.conf of opts into m, and starts the DNS stub resolv.conf
+// points to. With create, missing files are created first, otherwise
+// they're skipped so a host root directory isn't changed.
+//
+// When sockets pass through to the host's network, the stub on the
+// kernel's stack can't be reached, so resolv.conf gives the host's own
+// nameservers instead and no stub is started.
+func setupNameResolution(ctx context.Context, k *kernel.Kernel, m *fs.MountNamespace, opts nameOptions, create bool) (*dns.Server, error) {
+	cfg := dns.Config{Hostname: opts.Hostname}
+
+	for _, spec := range opts.AddHosts {
+		h, err := dns.ParseHost(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Hosts = append(cfg.Hosts, h)
+	}
+
+	for _, nic := range k.Network().NICs() {
+		if nic.Loopback {
+			continue
+		}
+
+		for _, a := range nic.Addrs {
+			cfg.Addrs = append(cfg.Addrs, a.IP)
+		}
+	}
+
+	var (
+		hostServers []net.IP
+		hostSearch  []string
+	)
+
+	hostNet := k.NetworkPolicy() != nil
+
+	if opts.Forward || hostNet {
+		var err error
+
+		hostServers, hostSearch, err = dns.ReadResolvConf(dns.HostResolvConf)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Search = hostSearch
+	}
+
+	cfg.Nameservers = []net.IP{dns.StubAddr}
+	if hostNet {
+		cfg.Nameservers = hostServers
+	}
+
+	type generated struct {
+		path string
+		data []byte
+	}
+
+	files := []generated{
+		{"/etc/hosts", cfg.HostsFile()},
+		{"/etc/resolv.conf", cfg.ResolvConf()},
+	}
+
+	if cfg.Hostname != "" {
+		files = append(files, generated{"/etc/hostname", cfg.HostnameFile()})
+	}
+
+	// The files are kept in a tmpfs of their own, so the guest can change
+	// them as it can on Docker.
+	tfs := tmpfs.NewTmpFS(tmpfs.Options{})
+
+	for _, f := range files {
+		err := mountGeneratedFile(ctx, m, tfs, f.path, f.data, create)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if hostNet {
+		return nil, nil
+	}
+
+	return dns.Serve(clog.L, k.Network(), dns.Options{
+		Hosts:   cfg.Table(),
+		Forward: dns.HostResolvers(hostServers),
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/fs/dev"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// outputGrace is how long the guest's last output is waited for after it
+// exits, in case something it started still holds the terminal open.
+const outputGrace = 250 * time.Millisecond
+
+// hostTerminal is the terminal columbia was started from, with the settings
+// it had so they can be restored.
+type hostTerminal struct {
+	fd    int
+	saved unix.Termios
+}
+
+// makeRaw puts the terminal on fd in raw mode, as cfmakeraw(3) does, so
+// that what's typed reaches the guest's terminal untouched. It fails if fd
+// isn't a terminal.
+func makeRaw(fd int) (*hostTerminal, error) {
+	saved, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := *saved
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+
+	err = unix.IoctlSetTermios(fd, ioctlSetTermios, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hostTerminal{fd: fd, saved: *saved}, nil
+}
+
+func (h *hostTerminal) restore() error {
+	return unix.IoctlSetTermios(h.fd, ioctlSetTermios, &h.saved)
+}
+
+func (h *hostTerminal) windowSize() (linux.Winsize, error) {
+	ws, err := unix.IoctlGetWinsize(h.fd, unix.TIOCGWINSZ)
+	if err != nil {
+		return linux.Winsize{}, err
+	}
+
+	return linux.Winsize{Row: ws.Row, Col: ws.Col, Xpixel: ws.Xpixel, Ypixel: ws.Ypixel}, nil
+}
+
+// attachTerminal creates a pty in pts and makes its slave the controlling
+// terminal and stdio of proc, which must not have any files open yet. The
+// master is connected to our stdin, unless interactive is false, and our
+// stdout. If stdin is a terminal, it's put in raw mode and its size kept
+// in step with the pty's.
+//
+// The returned function is called once proc has exited. It waits for the
+// guest's output to be written and restores the host terminal.
+func attachTerminal(ctx context.Context, proc *kernel.Process, pts *dev.PTS, interactive bool) (func(), error) {
+	// The slave belongs to the user the guest runs as, as it would if the
+	// guest had opened /dev/ptmx itself.
+	master, err := pts.OpenMaster(auth.ContextWithCredentials(ctx, proc.Credentials()))
+	if err != nil {
+		return nil, err
+	}
+
+	term := master.Terminal()
+	term.SetLocked(false)
+
+	path := "/dev/pts/" + strconv.Itoa(term.Index())
+
+	tctx := kernel.SetTask(ctx, &kernel.Task{Process: proc})
+
+	for i := 0; i < 3; i++ {
+		_, err = proc.OpenFile(tctx, path, linux.O_RDWR, 0)
+		if err != nil {
+			return nil, errors.Wrapf(err, "opening %s, --tty needs /dev", path)
+		}
+	}
+
+	err = proc.SetControllingTerminal(term, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a terminal to put in raw mode, the pty is still used so the
+	// guest sees one.
+	host, err := makeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		host = nil
+	}
+
+	winch := make(chan os.Signal, 1)
+
+	if host != nil {
+		resize := func() {
+			if ws, err := host.windowSize(); err == nil {
+				term.SetWindowSize(ws)
+			}
+		}
+
+		resize()
+
+		signal.Notify(winch, unix.SIGWINCH)
+
+		go func() {
+			for range winch {
+				resize()
+			}
+		}()
+	}
+
+	if interactive {
+		go io.Copy(master, os.Stdin)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		io.Copy(os.Stdout, master)
+		close(done)
+	}()
+
+	return func() {
+		select {
+		case <-done:
+		case <-time.After(outputGrace):
+		}
+
+		if host != nil {
+			signal.Stop(winch)
+			host.restore()
+		}
+	}, nil
+}
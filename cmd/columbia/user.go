@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/oci"
+)
+
+// resolveCredentials returns the credentials of user, given as USER[:GROUP]
+// by name or id, looking names up in the databases under mount. The user
+// also gets the supplementary groups /etc/group lists them in.
+func resolveCredentials(ctx context.Context, mount *fs.MountNamespace, user string) (*auth.Credentials, error) {
+	uid, gid, err := oci.ResolveUser(ctx, mount, user)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := oci.SupplementaryGroups(ctx, mount, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := auth.New(uid, gid)
+	creds.Groups = groups
+
+	return creds, nil
+}
+
+// parseCapabilities parses the capabilities named by --cap-add or
+// --cap-drop into a set.
+func parseCapabilities(names []string) (auth.CapabilitySet, error) {
+	var set auth.CapabilitySet
+
+	for _, name := range names {
+		caps, err := auth.ParseCapabilities(name)
+		if err != nil {
+			return 0, err
+		}
+
+		set |= caps
+	}
+
+	return set, nil
+}
+
+// applyCapabilities gives creds, those of the init process, the
+// capabilities in add and takes away those in drop, which wins. Both change
+// the bounding set too, so what's added can be had by what's run later and
+// what's dropped can't be got back. Root gets the added ones outright;
+// anyone else gets them as ambient capabilities, so they're kept across
+// execve(2).
+func applyCapabilities(creds *auth.Credentials, add, drop auth.CapabilitySet) {
+	creds.BoundingCaps |= add
+	creds.PermittedCaps |= add
+	creds.EffectiveCaps |= add
+
+	if creds.EffectiveUID != 0 {
+		creds.InheritableCaps |= add
+		creds.AmbientCaps |= add
+	}
+
+	creds.BoundingCaps &^= drop
+	creds.PermittedCaps &^= drop
+	creds.InheritableCaps &^= drop
+	creds.EffectiveCaps &^= drop
+	creds.AmbientCaps &^= drop
+}
+
+// parseIDMap parses the entries of --uid-map or --gid-map into a map. No
+// entries is the identity.
+func parseIDMap(specs []string) (auth.IDMap, error) {
+	var entries []auth.IDMapEntry
+
+	for _, spec := range specs {
+		e, err := auth.ParseIDMapEntry(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	return auth.NewIDMap(entries...)
+}
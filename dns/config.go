@@ -0,0 +1,132 @@
+// Package dns gives the guest name resolution: the /etc/hosts,
+// /etc/hostname and /etc/resolv.conf it reads, and a DNS stub on the
+// kernel's network stack that its resolver sends queries to. The stub
+// answers from a static table, and can forward what it doesn't know to the
+// host's resolver.
+package dns
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrBadHost = errors.New("invalid host entry")
+
+// StubAddr is where the stub listens, on port 53, and so the nameserver
+// resolv.conf gives. It's on lo, as Docker's embedded DNS is, so it's
+// reachable whatever addresses the guest has.
+var StubAddr = net.IPv4(127, 0, 0, 11)
+
+// Host is a name and one of its addresses.
+type Host struct {
+	Name string
+	IP   net.IP
+}
+
+// ParseHost parses an --add-host value, NAME:IP, as docker run has it. An
+// IPv6 address isn't bracketed.
+func ParseHost(s string) (Host, error) {
+	idx := strings.IndexByte(s, ':')
+	if idx == -1 {
+		return Host{}, errors.Wrapf(ErrBadHost, "expected NAME:IP: %s", s)
+	}
+
+	name := s[:idx]
+
+	if name == "" || strings.ContainsAny(name, " \t\n#") {
+		return Host{}, errors.Wrapf(ErrBadHost, "invalid name: %s", s)
+	}
+
+	ip := net.ParseIP(s[idx+1:])
+	if ip == nil {
+		return Host{}, errors.Wrapf(ErrBadHost, "invalid address: %s", s)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return Host{Name: name, IP: ip}, nil
+}
+
+// Config is how the guest resolves names.
+type Config struct {
+	// Hostname is the guest's name, which resolves to Addrs.
+	Hostname string
+
+	// Addrs are the guest's own addresses. Without any, Hostname
+	// resolves to 127.0.1.1, as Debian has it.
+	Addrs []net.IP
+
+	// Hosts are the further names, as --add-host gives them.
+	Hosts []Host
+
+	// Nameservers and Search are what resolv.conf gives.
+	Nameservers []net.IP
+	Search      []string
+}
+
+// Table returns the names the stub answers for: Hostname, then Hosts.
+func (c *Config) Table() []Host {
+	var hosts []Host
+
+	if c.Hostname != "" {
+		addrs := c.Addrs
+		if len(addrs) == 0 {
+			addrs = []net.IP{net.IPv4(127, 0, 1, 1)}
+		}
+
+		for _, ip := range addrs {
+			hosts = append(hosts, Host{Name: c.Hostname, IP: ip})
+		}
+	}
+
+	return append(hosts, c.Hosts...)
+}
+
+// HostsFile returns the contents of /etc/hosts: the loopback entries
+// Docker writes, then the table.
+func (c *Config) HostsFile() []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("127.0.0.1\tlocalhost\n")
+	buf.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	buf.WriteString("fe00::0\tip6-localnet\n")
+	buf.WriteString("ff00::0\tip6-mcastprefix\n")
+	buf.WriteString("ff02::1\tip6-allnodes\n")
+	buf.WriteString("ff02::2\tip6-allrouters\n")
+
+	for _, h := range c.Table() {
+		fmt.Fprintf(&buf, "%s\t%s\n", h.IP, h.Name)
+	}
+
+	return buf.Bytes()
+}
+
+// HostnameFile returns the contents of /etc/hostname.
+func (c *Config) HostnameFile() []byte {
+	return []byte(c.Hostname + "\n")
+}
+
+// ResolvConf returns the contents of /etc/resolv.conf.
+func (c *Config) ResolvConf() []byte {
+	var buf bytes.Buffer
+
+	for _, ip := range c.Nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ip)
+	}
+
+	if len(c.Search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(c.Search, " "))
+	}
+
+	// The guest's names are all fully qualified as far as the stub is
+	// concerned, so there's no point trying the search domains first.
+	buf.WriteString("options ndots:0\n")
+
+	return buf.Bytes()
+}
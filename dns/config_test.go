@@ -0,0 +1,99 @@
+package dns_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evanphx/columbia/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHost(t *testing.T) {
+	h, err := dns.ParseHost("db:10.0.0.5")
+	require.NoError(t, err)
+	require.Equal(t, "db", h.Name)
+	require.Equal(t, net.IPv4(10, 0, 0, 5).To4(), h.IP)
+
+	h, err = dns.ParseHost("db6:fd00::5")
+	require.NoError(t, err)
+	require.Equal(t, "db6", h.Name)
+	require.True(t, h.IP.Equal(net.ParseIP("fd00::5")))
+
+	for _, s := range []string{"db", ":10.0.0.5", "db:nope", "my db:10.0.0.5"} {
+		_, err := dns.ParseHost(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	t.Run("writes the hosts file", func(t *testing.T) {
+		cfg := dns.Config{
+			Hostname: "box",
+			Addrs:    []net.IP{net.IPv4(10, 0, 0, 2).To4()},
+			Hosts:    []dns.Host{{Name: "db", IP: net.IPv4(10, 0, 0, 5).To4()}},
+		}
+
+		require.Equal(t, "127.0.0.1\tlocalhost\n"+
+			"::1\tlocalhost ip6-localhost ip6-loopback\n"+
+			"fe00::0\tip6-localnet\n"+
+			"ff00::0\tip6-mcastprefix\n"+
+			"ff02::1\tip6-allnodes\n"+
+			"ff02::2\tip6-allrouters\n"+
+			"10.0.0.2\tbox\n"+
+			"10.0.0.5\tdb\n", string(cfg.HostsFile()))
+
+		require.Equal(t, "box\n", string(cfg.HostnameFile()))
+	})
+
+	t.Run("resolves the hostname locally without addresses", func(t *testing.T) {
+		cfg := dns.Config{Hostname: "box"}
+
+		table := cfg.Table()
+		require.Len(t, table, 1)
+		require.True(t, table[0].IP.Equal(net.IPv4(127, 0, 1, 1)))
+	})
+
+	t.Run("writes resolv.conf", func(t *testing.T) {
+		cfg := dns.Config{
+			Nameservers: []net.IP{dns.StubAddr},
+			Search:      []string{"example.com", "corp"},
+		}
+
+		require.Equal(t, "nameserver 127.0.0.11\nsearch example.com corp\noptions ndots:0\n", string(cfg.ResolvConf()))
+	})
+}
+
+func TestReadResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolv")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "resolv.conf")
+
+	write := func(t *testing.T, s string) {
+		require.NoError(t, ioutil.WriteFile(path, []byte(s), 0644))
+	}
+
+	t.Run("reads nameservers and search domains", func(t *testing.T) {
+		write(t, "# generated\nnameserver 1.1.1.1\nnameserver fe80::1%eth0\nnameserver 2606:4700::1111\nsearch a.example b.example\noptions edns0\n")
+
+		servers, search, err := dns.ReadResolvConf(path)
+		require.NoError(t, err)
+		require.Equal(t, []string{"a.example", "b.example"}, search)
+		require.Len(t, servers, 2)
+		require.Equal(t, []string{"1.1.1.1:53", "[2606:4700::1111]:53"}, dns.HostResolvers(servers))
+	})
+
+	t.Run("uses the local nameserver without any", func(t *testing.T) {
+		write(t, "domain example.com\n")
+
+		servers, search, err := dns.ReadResolvConf(path)
+		require.NoError(t, err)
+		require.Equal(t, []string{"example.com"}, search)
+		require.Equal(t, []string{"127.0.0.1:53"}, dns.HostResolvers(servers))
+	})
+}
@@ -0,0 +1,234 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrBadMessage = errors.New("malformed DNS message")
+
+const (
+	headerSize = 12
+
+	// maxUDPSize is the largest reply sent over UDP, the limit of a
+	// client that doesn't say otherwise with EDNS. The stub's own replies
+	// only go past it for a name with a great many addresses.
+	maxUDPSize = 512
+
+	// maxNameSize is the longest a name can be in its wire form.
+	maxNameSize = 255
+
+	// ttl is how long the stub's answers can be cached for, in seconds.
+	ttl = 60
+)
+
+// The types and class of RFC 1035, and RFC 3596 for AAAA.
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeAAAA = 28
+
+	classINET = 1
+)
+
+// The bits of a header's flags.
+const (
+	flagQR     = 1 << 15
+	flagAA     = 1 << 10
+	flagTC     = 1 << 9
+	flagRD     = 1 << 8
+	flagRA     = 1 << 7
+	opcodeMask = 0xf << 11
+)
+
+// The response codes.
+const (
+	rcodeSuccess  = 0
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+)
+
+type header struct {
+	ID      uint16
+	Flags   uint16
+	QDCount uint16
+	ANCount uint16
+	NSCount uint16
+	ARCount uint16
+}
+
+type question struct {
+	// name is in lower case, without the trailing dot.
+	name  string
+	typ   uint16
+	class uint16
+
+	// raw is the question as it was sent, which the reply echoes.
+	raw []byte
+}
+
+// record is an answer to a question, whose name it has.
+type record struct {
+	typ  uint16
+	data []byte
+}
+
+func parseHeader(b []byte) (header, bool) {
+	if len(b) < headerSize {
+		return header{}, false
+	}
+
+	return header{
+		ID:      binary.BigEndian.Uint16(b),
+		Flags:   binary.BigEndian.Uint16(b[2:]),
+		QDCount: binary.BigEndian.Uint16(b[4:]),
+		ANCount: binary.BigEndian.Uint16(b[6:]),
+		NSCount: binary.BigEndian.Uint16(b[8:]),
+		ARCount: binary.BigEndian.Uint16(b[10:]),
+	}, true
+}
+
+// parseQuestion parses the one question a query has, which follows the
+// header. Its name can't be compressed, as there's nothing before it to
+// point to.
+func parseQuestion(b []byte) (question, error) {
+	var labels []string
+
+	off := headerSize
+
+	for {
+		if off >= len(b) {
+			return question{}, ErrBadMessage
+		}
+
+		n := int(b[off])
+		off++
+
+		if n == 0 {
+			break
+		}
+
+		if n > 63 || off+n > len(b) || off-headerSize+n > maxNameSize {
+			return question{}, ErrBadMessage
+		}
+
+		labels = append(labels, strings.ToLower(string(b[off:off+n])))
+		off += n
+	}
+
+	if off+4 > len(b) {
+		return question{}, ErrBadMessage
+	}
+
+	return question{
+		name:  strings.Join(labels, "."),
+		typ:   binary.BigEndian.Uint16(b[off:]),
+		class: binary.BigEndian.Uint16(b[off+2:]),
+		raw:   b[headerSize : off+4],
+	}, nil
+}
+
+// encodeName returns name in its wire form.
+func encodeName(name string) []byte {
+	var b []byte
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+
+	return append(b, 0)
+}
+
+// response builds the reply to the query with hdr, which answers q with
+// answers. q is nil if the query's question couldn't be parsed.
+func response(hdr header, q *question, rcode uint16, flags uint16, answers []record) []byte {
+	b := make([]byte, headerSize, maxUDPSize)
+
+	binary.BigEndian.PutUint16(b, hdr.ID)
+	binary.BigEndian.PutUint16(b[2:], flagQR|hdr.Flags&(opcodeMask|flagRD)|flags|rcode)
+
+	if q == nil {
+		return b
+	}
+
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint16(b[6:], uint16(len(answers)))
+
+	b = append(b, q.raw...)
+
+	for _, a := range answers {
+		var rr [12]byte
+
+		// The name is the question's, which follows the header.
+		binary.BigEndian.PutUint16(rr[0:], 0xc000|headerSize)
+		binary.BigEndian.PutUint16(rr[2:], a.typ)
+		binary.BigEndian.PutUint16(rr[4:], classINET)
+		binary.BigEndian.PutUint32(rr[6:], ttl)
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(a.data)))
+
+		b = append(b, rr[:]...)
+		b = append(b, a.data...)
+	}
+
+	return b
+}
+
+// reverseIP returns the address a name under in-addr.arpa or ip6.arpa is
+// for.
+func reverseIP(name string) (net.IP, bool) {
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		parts := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(parts) != net.IPv4len {
+			return nil, false
+		}
+
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+
+		ip := net.ParseIP(strings.Join(parts, "."))
+		if ip == nil {
+			return nil, false
+		}
+
+		return ip.To4(), true
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil, false
+		}
+
+		ip := make(net.IP, net.IPv6len)
+
+		for i, n := range nibbles {
+			if len(n) != 1 {
+				return nil, false
+			}
+
+			v := strings.IndexByte("0123456789abcdef", n[0])
+			if v == -1 {
+				return nil, false
+			}
+
+			// The last nibble of the name is the first of the
+			// address.
+			pos := len(nibbles) - 1 - i
+			ip[pos/2] |= byte(v) << (4 * uint(1-pos%2))
+		}
+
+		return ip, true
+	}
+
+	return nil, false
+}
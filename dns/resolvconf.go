@@ -0,0 +1,77 @@
+package dns
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// HostResolvConf is where the host's resolver is configured.
+const HostResolvConf = "/etc/resolv.conf"
+
+// ReadResolvConf reads the nameservers and search domains of the
+// resolv.conf at path. Without any nameservers, the one on the local
+// machine is used, as resolv.conf(5) has it.
+func ReadResolvConf(path string) ([]net.IP, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer f.Close()
+
+	return parseResolvConf(f)
+}
+
+func parseResolvConf(r io.Reader) ([]net.IP, []string, error) {
+	var (
+		servers []net.IP
+		search  []string
+	)
+
+	sc := bufio.NewScanner(r)
+
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			// A scoped IPv6 address can't be reached through the
+			// zone-less addresses forwarding uses.
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				servers = append(servers, ip)
+			}
+		case "search":
+			search = fields[1:]
+		case "domain":
+			search = fields[1:2]
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(servers) == 0 {
+		servers = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+
+	return servers, search, nil
+}
+
+// HostResolvers returns the addresses of nameservers as Options.Forward
+// has them.
+func HostResolvers(nameservers []net.IP) []string {
+	var servers []string
+
+	for _, ip := range nameservers {
+		servers = append(servers, net.JoinHostPort(ip.String(), "53"))
+	}
+
+	return servers
+}
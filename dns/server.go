@@ -0,0 +1,422 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evanphx/columbia/netstack"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// forwardTimeout is how long a resolver of the host is given to reply, as
+// long as the resolv.conf default.
+const forwardTimeout = 5 * time.Second
+
+// Options configure the stub.
+type Options struct {
+	// Addr is the address to listen on, StubAddr if it's nil.
+	Addr net.IP
+
+	// Port is the port to listen on, 53 if it's 0.
+	Port int
+
+	// Hosts is the static table answered from.
+	Hosts []Host
+
+	// Forward are the host's resolvers, as HOST:PORT, that the queries
+	// the table doesn't answer are forwarded to, in turn. Without any,
+	// names that aren't in the table don't exist.
+	Forward []string
+}
+
+// Server is the DNS stub. It listens for UDP and TCP on the kernel's
+// network stack, so it's reached only from inside the guest.
+type Server struct {
+	l       hclog.Logger
+	hosts   []Host
+	forward []string
+
+	ctx    context.Context
+	cancel func()
+
+	wg sync.WaitGroup
+
+	packets  *netstack.UDPEndpoint
+	listener *netstack.TCPEndpoint
+
+	mu    sync.Mutex
+	conns map[io.Closer]struct{}
+}
+
+// Serve starts the stub on stack, which answers queries until the Server
+// is closed.
+func Serve(l hclog.Logger, stack *netstack.Stack, opts Options) (*Server, error) {
+	addr := netstack.Address{IP: opts.Addr, Port: opts.Port}
+
+	if addr.IP == nil {
+		addr.IP = StubAddr
+	}
+
+	if addr.Port == 0 {
+		addr.Port = 53
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Server{
+		l:        l,
+		hosts:    opts.Hosts,
+		forward:  opts.Forward,
+		ctx:      ctx,
+		cancel:   cancel,
+		packets:  stack.NewUDPEndpoint(false),
+		listener: stack.NewTCPEndpoint(false),
+		conns:    make(map[io.Closer]struct{}),
+	}
+
+	err := s.packets.Bind(addr)
+	if err == nil {
+		err = s.listener.Bind(addr)
+	}
+
+	if err == nil {
+		err = s.listener.Listen(128)
+	}
+
+	if err != nil {
+		cancel()
+		s.packets.Close()
+		s.listener.Close()
+
+		return nil, err
+	}
+
+	s.wg.Add(2)
+	go s.packetLoop()
+	go s.acceptLoop()
+
+	return s, nil
+}
+
+// Addr returns the address the stub listens on.
+func (s *Server) Addr() netstack.Address {
+	return s.packets.LocalAddress()
+}
+
+// Close stops the stub, abandoning the queries being forwarded.
+func (s *Server) Close() error {
+	s.cancel()
+
+	s.packets.Close()
+	s.listener.Close()
+
+	s.mu.Lock()
+
+	for c := range s.conns {
+		c.Close()
+	}
+
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return nil
+}
+
+// track keeps c to be closed with the Server, returning false if it's
+// already closed.
+func (s *Server) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx.Err() != nil {
+		return false
+	}
+
+	s.conns[c] = struct{}{}
+
+	return true
+}
+
+func (s *Server) untrack(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, c)
+}
+
+// endpointCloser closes a TCP endpoint, whose Close returns nothing.
+type endpointCloser struct {
+	ep *netstack.TCPEndpoint
+}
+
+func (c endpointCloser) Close() error {
+	c.ep.Close()
+	return nil
+}
+
+func (s *Server) packetLoop() {
+	defer s.wg.Done()
+
+	for {
+		query, from, _, err := s.packets.RecvFrom(s.ctx, 65535, false, false)
+		if err != nil || from.IP == nil {
+			return
+		}
+
+		// Each query is answered on its own, so one that's forwarded
+		// doesn't hold up the rest.
+		s.wg.Add(1)
+
+		go func() {
+			defer s.wg.Done()
+
+			reply := s.handle("udp", query)
+			if reply == nil {
+				return
+			}
+
+			if _, err := s.packets.SendTo(reply, &from); err != nil {
+				s.l.Debug("dns reply not delivered", "client", from, "error", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept(s.ctx, false)
+		if err != nil {
+			return
+		}
+
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers the queries of a TCP connection, each preceded by its
+// length, until the client closes it.
+func (s *Server) serveConn(conn *netstack.TCPEndpoint) {
+	defer s.wg.Done()
+
+	c := endpointCloser{conn}
+	if !s.track(c) {
+		conn.Close()
+		return
+	}
+
+	defer func() {
+		s.untrack(c)
+		conn.Close()
+	}()
+
+	for {
+		var size [2]byte
+
+		if n, err := conn.Read(s.ctx, size[:], false, true, false); err != nil || n < len(size) {
+			return
+		}
+
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+
+		if n, err := conn.Read(s.ctx, query, false, true, false); err != nil || n < len(query) {
+			return
+		}
+
+		reply := s.handle("tcp", query)
+		if reply == nil {
+			return
+		}
+
+		binary.BigEndian.PutUint16(size[:], uint16(len(reply)))
+
+		if _, err := conn.Write(s.ctx, append(size[:], reply...), false); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the reply to query, which came over network, or nil if
+// there's none to give.
+func (s *Server) handle(network string, query []byte) []byte {
+	hdr, ok := parseHeader(query)
+	if !ok || hdr.Flags&flagQR != 0 {
+		return nil
+	}
+
+	if hdr.Flags&opcodeMask != 0 {
+		return response(hdr, nil, rcodeNotImp, 0, nil)
+	}
+
+	q, err := parseQuestion(query)
+	if err != nil || hdr.QDCount != 1 {
+		return response(hdr, nil, rcodeFormErr, 0, nil)
+	}
+
+	// Recursion is only available by forwarding.
+	var ra uint16
+	if len(s.forward) > 0 {
+		ra = flagRA
+	}
+
+	answers, found := s.lookup(q)
+
+	switch {
+	case found:
+		reply := response(hdr, &q, rcodeSuccess, flagAA|ra, answers)
+
+		if network == "udp" && len(reply) > maxUDPSize {
+			reply = response(hdr, &q, rcodeSuccess, flagAA|ra|flagTC, nil)
+		}
+
+		return reply
+	case len(s.forward) == 0:
+		return response(hdr, &q, rcodeNXDomain, flagAA, nil)
+	}
+
+	reply, err := s.exchange(network, query)
+	if err != nil {
+		s.l.Debug("dns query not forwarded", "name", q.name, "error", err)
+		return response(hdr, &q, rcodeServFail, ra, nil)
+	}
+
+	return reply
+}
+
+// lookup answers q from the table, reporting whether it has the name at
+// all. A name it has is answered even when it has no records of the type
+// asked for, rather than forwarded.
+func (s *Server) lookup(q question) ([]record, bool) {
+	if q.class != classINET {
+		return nil, false
+	}
+
+	var (
+		answers []record
+		found   bool
+	)
+
+	if q.typ == typePTR {
+		ip, ok := reverseIP(q.name)
+		if !ok {
+			return nil, false
+		}
+
+		for _, h := range s.hosts {
+			if h.IP.Equal(ip) {
+				return []record{{typ: typePTR, data: encodeName(h.Name)}}, true
+			}
+		}
+
+		return nil, false
+	}
+
+	for _, h := range s.hosts {
+		if strings.ToLower(strings.TrimSuffix(h.Name, ".")) != q.name {
+			continue
+		}
+
+		found = true
+
+		switch ip4 := h.IP.To4(); {
+		case q.typ == typeA && ip4 != nil:
+			answers = append(answers, record{typ: typeA, data: ip4})
+		case q.typ == typeAAAA && ip4 == nil:
+			answers = append(answers, record{typ: typeAAAA, data: h.IP.To16()})
+		}
+	}
+
+	return answers, found
+}
+
+// exchange forwards query to the host's resolvers in turn, over network,
+// returning the first reply.
+func (s *Server) exchange(network string, query []byte) ([]byte, error) {
+	var lastErr error
+
+	for _, server := range s.forward {
+		reply, err := s.exchangeWith(network, server, query)
+		if err == nil {
+			return reply, nil
+		}
+
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+func (s *Server) exchangeWith(network, server string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, forwardTimeout)
+	defer cancel()
+
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	// Closing the Server abandons the exchange.
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 65535)
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+
+			// Anything but the reply to this query is ignored.
+			if n >= headerSize && binary.BigEndian.Uint16(buf) == binary.BigEndian.Uint16(query) {
+				return buf[:n], nil
+			}
+		}
+	}
+
+	msg := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+
+	var size [2]byte
+
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, binary.BigEndian.Uint16(size[:]))
+
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
@@ -0,0 +1,252 @@
+package dns_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/evanphx/columbia/dns"
+	"github.com/evanphx/columbia/netstack"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeAAAA = 28
+)
+
+func query(id uint16, name string, typ uint16) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b, id)
+	binary.BigEndian.PutUint16(b[2:], 1<<8) // RD
+	binary.BigEndian.PutUint16(b[4:], 1)
+
+	for _, label := range strings.Split(name, ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+
+	b = append(b, 0, 0, 0, 0, 1)
+	binary.BigEndian.PutUint16(b[len(b)-4:], typ)
+
+	return b
+}
+
+type answer struct {
+	typ  uint16
+	data []byte
+}
+
+type result struct {
+	id      uint16
+	flags   uint16
+	rcode   int
+	answers []answer
+}
+
+// parseReply parses a reply of the stub, whose answers all point to the
+// question's name.
+func parseReply(t *testing.T, b []byte) result {
+	require.True(t, len(b) >= 12)
+
+	r := result{
+		id:    binary.BigEndian.Uint16(b),
+		flags: binary.BigEndian.Uint16(b[2:]),
+	}
+
+	r.rcode = int(r.flags & 0xf)
+
+	qd := binary.BigEndian.Uint16(b[4:])
+	an := binary.BigEndian.Uint16(b[6:])
+
+	off := 12
+
+	if qd == 1 {
+		for b[off] != 0 {
+			off += int(b[off]) + 1
+		}
+
+		off += 5
+	}
+
+	for i := 0; i < int(an); i++ {
+		require.Equal(t, uint16(0xc00c), binary.BigEndian.Uint16(b[off:]))
+
+		size := int(binary.BigEndian.Uint16(b[off+10:]))
+
+		r.answers = append(r.answers, answer{
+			typ:  binary.BigEndian.Uint16(b[off+2:]),
+			data: b[off+12 : off+12+size],
+		})
+
+		off += 12 + size
+	}
+
+	return r
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+
+	hosts := []dns.Host{
+		{Name: "box", IP: net.IPv4(10, 0, 0, 2).To4()},
+		{Name: "box", IP: net.ParseIP("fd00::2")},
+		{Name: "db", IP: net.IPv4(10, 0, 0, 5).To4()},
+	}
+
+	serve := func(t *testing.T, stack *netstack.Stack, forward []string) *dns.Server {
+		s, err := dns.Serve(hclog.NewNullLogger(), stack, dns.Options{Hosts: hosts, Forward: forward})
+		require.NoError(t, err)
+
+		t.Cleanup(func() { s.Close() })
+
+		return s
+	}
+
+	exchange := func(t *testing.T, stack *netstack.Stack, q []byte) result {
+		c := stack.NewUDPEndpoint(false)
+		defer c.Close()
+
+		_, err := c.SendTo(q, &netstack.Address{IP: dns.StubAddr, Port: 53})
+		require.NoError(t, err)
+
+		data, from, _, err := c.RecvFrom(ctx, 65535, false, false)
+		require.NoError(t, err)
+		require.True(t, from.IP.Equal(dns.StubAddr))
+
+		return parseReply(t, data)
+	}
+
+	t.Run("answers from the table", func(t *testing.T) {
+		stack := netstack.New()
+		serve(t, stack, nil)
+
+		r := exchange(t, stack, query(42, "BOX", typeA))
+		require.Equal(t, uint16(42), r.id)
+		require.Equal(t, 0, r.rcode)
+		require.NotZero(t, r.flags&(1<<10), "authoritative")
+		require.Equal(t, []answer{{typeA, []byte{10, 0, 0, 2}}}, r.answers)
+
+		r = exchange(t, stack, query(43, "box", typeAAAA))
+		require.Equal(t, []answer{{typeAAAA, []byte(net.ParseIP("fd00::2"))}}, r.answers)
+
+		r = exchange(t, stack, query(44, "db", typeAAAA))
+		require.Equal(t, 0, r.rcode)
+		require.Empty(t, r.answers)
+
+		r = exchange(t, stack, query(45, "5.0.0.10.in-addr.arpa", typePTR))
+		require.Equal(t, []answer{{typePTR, []byte("\x02db\x00")}}, r.answers)
+	})
+
+	t.Run("knows nothing else without forwarding", func(t *testing.T) {
+		stack := netstack.New()
+		serve(t, stack, nil)
+
+		r := exchange(t, stack, query(1, "example.com", typeA))
+		require.Equal(t, 3, r.rcode)
+		require.Empty(t, r.answers)
+
+		r = exchange(t, stack, query(2, "9.0.0.10.in-addr.arpa", typePTR))
+		require.Equal(t, 3, r.rcode)
+	})
+
+	t.Run("rejects what it can't parse", func(t *testing.T) {
+		stack := netstack.New()
+		serve(t, stack, nil)
+
+		q := query(1, "box", typeA)
+		r := exchange(t, stack, q[:14])
+		require.Equal(t, 1, r.rcode)
+
+		q = query(2, "box", typeA)
+		binary.BigEndian.PutUint16(q[2:], 2<<11) // STATUS
+		r = exchange(t, stack, q)
+		require.Equal(t, 4, r.rcode)
+	})
+
+	t.Run("answers over TCP", func(t *testing.T) {
+		stack := netstack.New()
+		serve(t, stack, nil)
+
+		c := stack.NewTCPEndpoint(false)
+		defer c.Close()
+
+		require.NoError(t, c.Connect(ctx, netstack.Address{IP: dns.StubAddr, Port: 53}, false))
+
+		for id := uint16(1); id <= 2; id++ {
+			q := query(id, "db", typeA)
+
+			msg := make([]byte, 2)
+			binary.BigEndian.PutUint16(msg, uint16(len(q)))
+
+			_, err := c.Write(ctx, append(msg, q...), false)
+			require.NoError(t, err)
+
+			_, err = c.Read(ctx, msg, false, true, false)
+			require.NoError(t, err)
+
+			reply := make([]byte, binary.BigEndian.Uint16(msg))
+
+			_, err = c.Read(ctx, reply, false, true, false)
+			require.NoError(t, err)
+
+			r := parseReply(t, reply)
+			require.Equal(t, id, r.id)
+			require.Equal(t, []answer{{typeA, []byte{10, 0, 0, 5}}}, r.answers)
+		}
+	})
+
+	t.Run("forwards to the host", func(t *testing.T) {
+		upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+
+		defer upstream.Close()
+
+		go func() {
+			buf := make([]byte, 512)
+
+			for {
+				n, from, err := upstream.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+
+				// NXDOMAIN, as a resolver of the host would reply.
+				reply := append([]byte(nil), buf[:n]...)
+				binary.BigEndian.PutUint16(reply[2:], 1<<15|1<<8|1<<7|3)
+
+				upstream.WriteToUDP(reply, from)
+			}
+		}()
+
+		stack := netstack.New()
+		serve(t, stack, []string{upstream.LocalAddr().String()})
+
+		r := exchange(t, stack, query(7, "example.com", typeA))
+		require.Equal(t, uint16(7), r.id)
+		require.Equal(t, 3, r.rcode)
+		require.Zero(t, r.flags&(1<<10), "authoritative")
+
+		r = exchange(t, stack, query(8, "db", typeA))
+		require.NotZero(t, r.flags&(1<<7), "recursion available")
+		require.Len(t, r.answers, 1)
+	})
+
+	t.Run("fails when the host's resolvers do", func(t *testing.T) {
+		closed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+
+		addr := closed.LocalAddr().String()
+		closed.Close()
+
+		stack := netstack.New()
+		serve(t, stack, []string{addr})
+
+		r := exchange(t, stack, query(9, "example.com", typeA))
+		require.Equal(t, 2, r.rcode)
+	})
+}
@@ -206,7 +206,20 @@ func (vm *VM) currentMemory() {
 func (vm *VM) growMemory() {
 	_ = vm.fetchInt8() // reserved (https://github.com/WebAssembly/design/blob/27ac254c854994103c24834a994be16f74f54186/BinaryEncoding.md#memory-related-operators-described-here)
 	curLen := vm.memory.Size() / wasmPageSize
-	n := vm.popInt32()
-	vm.memory.Grow(n * wasmPageSize)
+	n := vm.popUint32()
+
+	// As per the spec, grow_memory returns -1 rather than trapping when
+	// the memory can't be grown.
+	if n > math.MaxInt32/wasmPageSize {
+		vm.pushInt32(-1)
+		return
+	}
+
+	err := vm.memory.Grow(int32(n) * wasmPageSize)
+	if err != nil {
+		vm.pushInt32(-1)
+		return
+	}
+
 	vm.pushInt32(int32(curLen))
 }
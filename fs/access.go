@@ -0,0 +1,128 @@
+package fs
+
+import (
+	"context"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
+)
+
+// CheckAccess checks that the credentials ctx acts with can access inode
+// as mode, a combination of auth.MayRead, auth.MayWrite and auth.MayExec,
+// failing with ErrPermission. Without credentials, anything goes.
+func CheckAccess(ctx context.Context, inode *Inode, mode int) error {
+	creds, ok := auth.CredentialsFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	// This is what MayAccess would allow whatever the attributes, and
+	// saves looking them up on every step of a privileged lookup.
+	if creds.OverridesDAC() && (mode&auth.MayExec == 0 || isDir(inode)) {
+		return nil
+	}
+
+	attr, err := inode.Ops.UnstableAttr(ctx, inode)
+	if err != nil {
+		return err
+	}
+
+	if !creds.MayAccess(attr.UserId, attr.GroupId, attr.Perms, isDir(inode), mode) {
+		return ErrPermission
+	}
+
+	return nil
+}
+
+// CheckOwner checks that the credentials ctx acts with can act as the
+// owner of inode, failing with ErrNotPermitted.
+func CheckOwner(ctx context.Context, inode *Inode) error {
+	creds, ok := auth.CredentialsFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	attr, err := inode.Ops.UnstableAttr(ctx, inode)
+	if err != nil {
+		return err
+	}
+
+	if !creds.IsOwner(attr.UserId) {
+		return ErrNotPermitted
+	}
+
+	return nil
+}
+
+// CheckRemove checks that the credentials ctx acts with can remove name
+// from dir, or rename it away. That takes write and search permission on
+// dir and, if dir is sticky, owning either dir or the entry.
+func CheckRemove(ctx context.Context, dir *Inode, name string) error {
+	creds, ok := auth.CredentialsFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	if err := CheckAccess(ctx, dir, auth.MayWrite|auth.MayExec); err != nil {
+		return err
+	}
+
+	dattr, err := dir.Ops.UnstableAttr(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	if dattr.Perms&linux.ModeSticky == 0 || creds.IsOwner(dattr.UserId) {
+		return nil
+	}
+
+	child, err := dir.Ops.LookupChild(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+
+	cattr, err := child.Ops.UnstableAttr(ctx, child)
+	if err != nil {
+		return err
+	}
+
+	if !creds.IsOwner(cattr.UserId) {
+		return ErrNotPermitted
+	}
+
+	return nil
+}
+
+// Owner returns who owns an inode created in a directory with attr: the
+// filesystem ids of the credentials ctx acts with, or root without any.
+// A setgid directory gives its own group instead.
+func Owner(ctx context.Context, dir *InodeUnstableAttr) (int, int) {
+	uid, gid := 0, 0
+
+	if creds, ok := auth.CredentialsFromContext(ctx); ok {
+		uid, gid = creds.FilesystemUID, creds.FilesystemGID
+	}
+
+	if dir.Perms&linux.ModeSetGID != 0 {
+		gid = dir.GroupId
+	}
+
+	return uid, gid
+}
+
+// checkSearch checks that the credentials ctx acts with can search every
+// directory d was looked up through.
+func checkSearch(ctx context.Context, d *Dirent) error {
+	creds, ok := auth.CredentialsFromContext(ctx)
+	if !ok || creds.OverridesDAC() {
+		return nil
+	}
+
+	for p := d.Parent; p != nil; p = p.Parent {
+		if err := CheckAccess(ctx, p.Inode, auth.MayExec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package dev
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	mrand "math/rand"
+	"sync"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/tty"
+)
+
+// charDevice is a character device. Every open gets a handle of its own
+// that both reads and writes, whatever the access mode.
+type charDevice struct {
+	fs.StandardFileOps
+	node
+
+	open func(ctx context.Context) (io.ReadWriteSeeker, error)
+}
+
+func (d *DevFS) newCharDevice(major uint16, minor uint32, open func(ctx context.Context) (io.ReadWriteSeeker, error)) *fs.Inode {
+	return newInode(d.Device, fs.CharacterDevice, major, minor, &charDevice{node: newNode(0666), open: open})
+}
+
+func (c *charDevice) ReadLink(ctx context.Context, inode *fs.Inode) (string, error) {
+	return "", fs.ErrNotSymlink
+}
+
+// Open opens the device for the task in ctx, which decides what some
+// devices, like /dev/tty, refer to.
+func (c *charDevice) Open(ctx context.Context, inode *fs.Inode) (io.ReadWriteSeeker, error) {
+	return c.open(ctx)
+}
+
+func (c *charDevice) Reader(inode *fs.Inode) (io.ReadSeeker, error) {
+	return c.open(context.Background())
+}
+
+func (c *charDevice) Writer(inode *fs.Inode) (io.WriteSeeker, error) {
+	return c.open(context.Background())
+}
+
+// Truncate fails as truncate(2) does on a device. Opening with O_TRUNC
+// doesn't get this far.
+func (c *charDevice) Truncate(ctx context.Context, inode *fs.Inode, size int64) error {
+	return fs.ErrInvalid
+}
+
+// memory implements the devices of linux.MEM_MAJOR. Reads come from read,
+// and writes are discarded unless full is set, in which case they fail.
+type memory struct {
+	read func(b []byte) (int, error)
+	full bool
+}
+
+func (m *memory) Read(b []byte) (int, error) {
+	return m.read(b)
+}
+
+func (m *memory) Write(b []byte) (int, error) {
+	if m.full {
+		return 0, fs.ErrNoSpace
+	}
+
+	return len(b), nil
+}
+
+// Seek always succeeds and leaves the position at 0, as on Linux.
+func (m *memory) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func readZeros(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+
+	return len(b), nil
+}
+
+func openNull(ctx context.Context) (io.ReadWriteSeeker, error) {
+	return &memory{read: func(b []byte) (int, error) {
+		return 0, io.EOF
+	}}, nil
+}
+
+func openZero(ctx context.Context) (io.ReadWriteSeeker, error) {
+	return &memory{read: readZeros}, nil
+}
+
+func openFull(ctx context.Context) (io.ReadWriteSeeker, error) {
+	return &memory{read: readZeros, full: true}, nil
+}
+
+// openRandom opens a random device reading from r. Writes are accepted
+// but, unlike Linux, don't add to the entropy of r.
+func openRandom(r io.Reader) func(ctx context.Context) (io.ReadWriteSeeker, error) {
+	return func(ctx context.Context) (io.ReadWriteSeeker, error) {
+		return &memory{read: r.Read}, nil
+	}
+}
+
+var hostRandom io.Reader = rand.Reader
+
+// seededRandom produces the same bytes for the same seed, however many
+// handles read from it.
+type seededRandom struct {
+	mu  sync.Mutex
+	src *mrand.Rand
+}
+
+// NewSeededRandom returns a deterministic source for the random devices,
+// so that runs given the same seed see the same bytes.
+func NewSeededRandom(seed int64) io.Reader {
+	return &seededRandom{src: mrand.New(mrand.NewSource(seed))}
+}
+
+func (s *seededRandom) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.src.Read(b)
+}
+
+// openTTY opens the controlling terminal of the task's session. Without
+// one, it's host if that's set, and otherwise the open fails as Linux does
+// for a process that has none.
+func openTTY(host io.ReadWriter) func(ctx context.Context) (io.ReadWriteSeeker, error) {
+	return func(ctx context.Context) (io.ReadWriteSeeker, error) {
+		if task, ok := kernel.GetTask(ctx); ok {
+			if ctty := task.ControllingTerminal(); ctty != nil {
+				return tty.OpenSlave(ctty)
+			}
+		}
+
+		if host == nil {
+			return nil, fs.ErrNoDevice
+		}
+
+		return &terminal{host}, nil
+	}
+}
+
+// terminal is an open handle on the host's terminal. It doesn't close the
+// terminal, which outlives the handle.
+type terminal struct {
+	io.ReadWriter
+}
+
+func (t *terminal) Seek(offset int64, whence int) (int64, error) {
+	return 0, fs.ErrInvalid
+}
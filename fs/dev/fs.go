@@ -0,0 +1,243 @@
+// Package dev implements devfs, which holds the standard character devices
+// of /dev along with links to the open files of the reading process, and
+// devpts, which holds the ptys.
+package dev
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/device"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/tty"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	fs.RegisterFilesystem("devtmpfs", func(ctx context.Context, source, data string) (*fs.Inode, error) {
+		opts, err := ParseOptions(data)
+		if err != nil {
+			return nil, err
+		}
+
+		if task, ok := kernel.GetTask(ctx); ok {
+			opts.Signaler = task.Kernel
+		}
+
+		return NewDevFS(opts).Root()
+	})
+}
+
+type Options struct {
+	// Random is read by /dev/random and /dev/urandom. The host's random
+	// source is used when it's nil.
+	Random io.Reader
+
+	// TTY is what /dev/tty opens for a process whose session has no
+	// controlling terminal. Without one, opening it fails with
+	// fs.ErrNoDevice.
+	TTY io.ReadWriter
+
+	// Signaler is sent the signals that the ptys generate.
+	Signaler tty.Signaler
+}
+
+// ParseOptions parses mount options, a comma separated list where seed=N
+// makes the random devices produce the same bytes for the same N.
+func ParseOptions(data string) (Options, error) {
+	var opts Options
+
+	for _, opt := range strings.Split(data, ",") {
+		if opt == "" || opt == "rw" {
+			continue
+		}
+
+		if !strings.HasPrefix(opt, "seed=") {
+			return opts, errors.Wrapf(fs.ErrInvalid, "devtmpfs option: %s", opt)
+		}
+
+		seed, err := strconv.ParseInt(strings.TrimPrefix(opt, "seed="), 10, 64)
+		if err != nil {
+			return opts, errors.Wrapf(fs.ErrInvalid, "devtmpfs option %s: %s", opt, err)
+		}
+
+		opts.Random = NewSeededRandom(seed)
+	}
+
+	return opts, nil
+}
+
+type DevFS struct {
+	Device *device.Device
+	opts   Options
+	root   *fs.Inode
+
+	// pts holds the ptys created through /dev/ptmx, and is /dev/pts.
+	pts *PTS
+}
+
+// NewDevFS creates a devfs whose devices are configured by opts.
+func NewDevFS(opts Options) *DevFS {
+	d := &DevFS{
+		Device: device.NewAnonDevice(),
+		opts:   opts,
+		pts:    NewPTS(opts.Signaler),
+	}
+
+	d.root = d.newRoot()
+
+	return d
+}
+
+func (d *DevFS) Root() (*fs.Inode, error) {
+	return d.root, nil
+}
+
+// PTS returns the devpts at /dev/pts, for creating ptys from outside the
+// guest.
+func (d *DevFS) PTS() *PTS {
+	return d.pts
+}
+
+func (d *DevFS) newRoot() *fs.Inode {
+	random := d.opts.Random
+	if random == nil {
+		random = hostRandom
+	}
+
+	memDevice := func(minor uint32, open func(ctx context.Context) (io.ReadWriteSeeker, error)) *fs.Inode {
+		return d.newCharDevice(linux.MEM_MAJOR, minor, open)
+	}
+
+	link := func(target string) *fs.Inode {
+		return newInode(d.Device, fs.Symlink, 0, 0, &symlink{node: newNode(0777), target: target})
+	}
+
+	pts, _ := d.pts.Root()
+
+	return newInode(d.Device, fs.Directory, 0, 0, newDir(map[string]*fs.Inode{
+		"null":    memDevice(linux.NULL_MINOR, openNull),
+		"zero":    memDevice(linux.ZERO_MINOR, openZero),
+		"full":    memDevice(linux.FULL_MINOR, openFull),
+		"random":  memDevice(linux.RANDOM_MINOR, openRandom(random)),
+		"urandom": memDevice(linux.URANDOM_MINOR, openRandom(random)),
+		"tty":     d.newCharDevice(linux.TTYAUX_MAJOR, linux.TTY_MINOR, openTTY(d.opts.TTY)),
+		"ptmx":    d.newCharDevice(linux.TTYAUX_MAJOR, linux.PTMX_MINOR, d.pts.openMaster),
+		"pts":     pts,
+		"fd":      link("/proc/self/fd"),
+		"stdin":   link("/proc/self/fd/0"),
+		"stdout":  link("/proc/self/fd/1"),
+		"stderr":  link("/proc/self/fd/2"),
+	}))
+}
+
+// newInode returns an inode on dev. Device files have their own major and
+// minor numbers, which are otherwise those of dev.
+func newInode(dev *device.Device, typ fs.InodeType, major uint16, minor uint32, ops fs.InodeOps) *fs.Inode {
+	attr := fs.InodeStableAttr{
+		Type:            typ,
+		DeviceID:        dev.DeviceID(),
+		InodeID:         dev.NextIno(),
+		BlockSize:       4096,
+		DeviceFileMajor: uint16(dev.Major),
+		DeviceFileMinor: uint32(dev.Minor),
+	}
+
+	if typ == fs.CharacterDevice {
+		attr.DeviceFileMajor = major
+		attr.DeviceFileMinor = minor
+	}
+
+	return fs.NewInode(attr, ops)
+}
+
+// node holds the attributes common to every kind of inode.
+type node struct {
+	perms    int
+	uid, gid int
+	created  linux.Timespec
+}
+
+func newNode(perms int) node {
+	return node{
+		perms:   perms,
+		created: linux.TimeToTimespec(time.Now()),
+	}
+}
+
+func (n *node) UnstableAttr(ctx context.Context, inode *fs.Inode) (*fs.InodeUnstableAttr, error) {
+	return &fs.InodeUnstableAttr{
+		Perms:            n.perms,
+		UserId:           n.uid,
+		GroupId:          n.gid,
+		AccessTime:       n.created,
+		ModificationTime: n.created,
+		StatusChangeTime: n.created,
+		Links:            1,
+	}, nil
+}
+
+// dir is the root directory, which has a fixed set of entries.
+type dir struct {
+	fs.StandardDirOps
+	node
+
+	names   []string
+	entries map[string]*fs.Inode
+}
+
+func newDir(entries map[string]*fs.Inode) *dir {
+	d := &dir{node: newNode(0755), entries: entries}
+
+	for name := range entries {
+		d.names = append(d.names, name)
+	}
+
+	sort.Strings(d.names)
+
+	return d
+}
+
+func (d *dir) LookupChild(ctx context.Context, inode *fs.Inode, name string) (*fs.Inode, error) {
+	child, ok := d.entries[name]
+	if !ok {
+		return nil, fs.ErrUnknownPath
+	}
+
+	return child, nil
+}
+
+func (d *dir) ReadDir(ctx context.Context, inode *fs.Inode, offset int, emit fs.ReadDirEmit) error {
+	if offset >= len(d.names) {
+		return nil
+	}
+
+	for _, name := range d.names[offset:] {
+		if !emit.EmitEntry(name, d.entries[name]) {
+			break
+		}
+	}
+
+	return nil
+}
+
+type symlink struct {
+	fs.StandardFileOps
+	node
+
+	target string
+}
+
+func (s *symlink) ReadLink(ctx context.Context, inode *fs.Inode) (string, error) {
+	return s.target, nil
+}
+
+func (s *symlink) Reader(inode *fs.Inode) (io.ReadSeeker, error) {
+	return nil, fs.ErrNotImplemented
+}
@@ -0,0 +1,253 @@
+package dev_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/dev"
+	"github.com/evanphx/columbia/fs/proc"
+	"github.com/evanphx/columbia/fs/tmpfs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/tty"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type names struct {
+	list []string
+}
+
+func (n *names) EmitEntry(name string, inode *fs.Inode) bool {
+	n.list = append(n.list, name)
+	return true
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (_ nopCloser) Close() error {
+	return nil
+}
+
+func TestDevFS(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := dev.NewDevFS(dev.Options{}).Root()
+	require.NoError(t, err)
+
+	open := func(t *testing.T, root *fs.Inode, name string) io.ReadWriteSeeker {
+		inode, err := root.Ops.LookupChild(ctx, root, name)
+		require.NoError(t, err)
+
+		w, err := inode.Ops.Writer(inode)
+		require.NoError(t, err)
+
+		return w.(io.ReadWriteSeeker)
+	}
+
+	t.Run("lists the devices", func(t *testing.T) {
+		var n names
+		require.NoError(t, root.Ops.ReadDir(ctx, root, 0, &n))
+		require.Equal(t, []string{"fd", "full", "null", "ptmx", "pts", "random", "stderr", "stdin", "stdout", "tty", "urandom", "zero"}, n.list)
+	})
+
+	t.Run("numbers the devices as Linux does", func(t *testing.T) {
+		for name, id := range map[string][2]int{
+			"null":    {1, 3},
+			"zero":    {1, 5},
+			"full":    {1, 7},
+			"random":  {1, 8},
+			"urandom": {1, 9},
+			"tty":     {5, 0},
+			"ptmx":    {5, 2},
+		} {
+			inode, err := root.Ops.LookupChild(ctx, root, name)
+			require.NoError(t, err)
+			require.Equal(t, fs.CharacterDevice, inode.StableAttr.Type, "device: %s", name)
+
+			rdev := linux.MakeDeviceID(inode.StableAttr.DeviceFileMajor, inode.StableAttr.DeviceFileMinor)
+			require.Equal(t, linux.MakeDeviceID(uint16(id[0]), uint32(id[1])), rdev, "device: %s", name)
+
+			attr, err := inode.Ops.UnstableAttr(ctx, inode)
+			require.NoError(t, err)
+			require.Equal(t, 0666, attr.Perms)
+		}
+	})
+
+	t.Run("reads and writes like the memory devices", func(t *testing.T) {
+		null := open(t, root, "null")
+
+		n, err := null.Write([]byte("discarded"))
+		require.NoError(t, err)
+		require.Equal(t, 9, n)
+
+		data, err := ioutil.ReadAll(null)
+		require.NoError(t, err)
+		require.Empty(t, data)
+
+		buf := []byte("xxxx")
+
+		_, err = open(t, root, "zero").Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, []byte{0, 0, 0, 0}, buf)
+
+		full := open(t, root, "full")
+
+		_, err = full.Write([]byte("x"))
+		require.Equal(t, fs.ErrNoSpace, err)
+
+		buf = []byte("xxxx")
+
+		_, err = full.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, []byte{0, 0, 0, 0}, buf)
+
+		inode, err := root.Ops.LookupChild(ctx, root, "null")
+		require.NoError(t, err)
+		require.Equal(t, fs.ErrInvalid, inode.Ops.Truncate(ctx, inode, 0))
+	})
+
+	t.Run("produces the same random bytes from a seed", func(t *testing.T) {
+		read := func(opts dev.Options, name string) []byte {
+			root, err := dev.NewDevFS(opts).Root()
+			require.NoError(t, err)
+
+			buf := make([]byte, 32)
+
+			_, err = io.ReadFull(open(t, root, name), buf)
+			require.NoError(t, err)
+
+			return buf
+		}
+
+		opts, err := dev.ParseOptions("seed=42")
+		require.NoError(t, err)
+
+		require.Equal(t, read(opts, "urandom"), read(dev.Options{Random: dev.NewSeededRandom(42)}, "random"))
+		require.NotEqual(t, read(opts, "urandom"), read(dev.Options{Random: dev.NewSeededRandom(43)}, "urandom"))
+		require.NotEqual(t, read(dev.Options{}, "urandom"), read(dev.Options{}, "urandom"))
+
+		_, err = dev.ParseOptions("seed=abc")
+		require.Equal(t, fs.ErrInvalid, errors.Cause(err))
+	})
+
+	t.Run("opens the controlling terminal", func(t *testing.T) {
+		inode, err := root.Ops.LookupChild(ctx, root, "tty")
+		require.NoError(t, err)
+
+		_, err = inode.Ops.Reader(inode)
+		require.Equal(t, fs.ErrNoDevice, err)
+
+		var term bytes.Buffer
+
+		root, err := dev.NewDevFS(dev.Options{TTY: &term}).Root()
+		require.NoError(t, err)
+
+		_, err = open(t, root, "tty").Write([]byte("prompt> "))
+		require.NoError(t, err)
+		require.Equal(t, "prompt> ", term.String())
+	})
+
+	t.Run("creates ptys through ptmx", func(t *testing.T) {
+		pts, err := root.Ops.LookupChild(ctx, root, "pts")
+		require.NoError(t, err)
+
+		master, ok := open(t, root, "ptmx").(*tty.Master)
+		require.True(t, ok)
+
+		var n names
+		require.NoError(t, pts.Ops.ReadDir(ctx, pts, 0, &n))
+		require.Equal(t, []string{"ptmx", "0"}, n.list)
+
+		slave, err := pts.Ops.LookupChild(ctx, pts, "0")
+		require.NoError(t, err)
+		require.Equal(t, uint16(136), slave.StableAttr.DeviceFileMajor)
+
+		attr, err := slave.Ops.UnstableAttr(ctx, slave)
+		require.NoError(t, err)
+		require.Equal(t, 0620, attr.Perms)
+		require.Equal(t, 5, attr.GroupId)
+
+		_, err = slave.Ops.Reader(slave)
+		require.Equal(t, tty.ErrHangup, err)
+
+		master.Terminal().SetLocked(false)
+
+		r, err := slave.Ops.Reader(slave)
+		require.NoError(t, err)
+
+		_, err = master.Write([]byte("ls\r"))
+		require.NoError(t, err)
+
+		buf := make([]byte, 10)
+		nread, err := r.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, "ls\n", string(buf[:nread]))
+
+		require.NoError(t, master.Close())
+
+		_, err = pts.Ops.LookupChild(ctx, pts, "0")
+		require.Equal(t, fs.ErrUnknownPath, err)
+	})
+
+	t.Run("links to the open files of the process", func(t *testing.T) {
+		k, err := kernel.NewKernel(nil)
+		require.NoError(t, err)
+
+		tmp, err := tmpfs.NewTmpFS(tmpfs.Options{}).Root()
+		require.NoError(t, err)
+
+		m := fs.NewMountNamespace()
+		m.SetRoot(tmp)
+
+		require.NoError(t, tmp.Ops.CreateDirectory(ctx, tmp, "proc", 0555))
+		require.NoError(t, tmp.Ops.CreateDirectory(ctx, tmp, "dev", 0755))
+
+		init := k.NewProcess("/")
+		init.Mount = m
+
+		var stdout bytes.Buffer
+		init.HookupStdio(ioutil.NopCloser(&bytes.Buffer{}), nopCloser{&stdout}, nopCloser{ioutil.Discard})
+
+		ctx := kernel.SetTask(ctx, &kernel.Task{Process: init})
+
+		procfs, err := proc.NewProcFS(k).Root()
+		require.NoError(t, err)
+
+		require.NoError(t, m.Mount(ctx, "/proc", &fs.Mount{Root: procfs, Source: "proc", Type: "proc"}))
+		require.NoError(t, m.Mount(ctx, "/dev", &fs.Mount{Root: root, Source: "devtmpfs", Type: "devtmpfs"}))
+
+		fd, err := init.OpenFile(ctx, "/dev/stdout", linux.O_WRONLY|linux.O_CREAT|linux.O_TRUNC, 0644)
+		require.NoError(t, err)
+
+		f, ok := init.GetFile(fd)
+		require.True(t, ok)
+
+		w, ok := f.Writer()
+		require.True(t, ok)
+
+		_, err = w.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.Equal(t, "hello", stdout.String())
+
+		require.NoError(t, init.CloseFile(fd))
+
+		_, rfd, _, _, err := init.CreatePipe()
+		require.NoError(t, err)
+
+		pipe, err := m.LookupPath(ctx, "/dev/fd/"+strconv.Itoa(rfd))
+		require.NoError(t, err)
+		require.Equal(t, fs.Pipe, pipe.Inode.StableAttr.Type)
+
+		fd, err = init.OpenFile(ctx, "/dev/null", linux.O_WRONLY|linux.O_TRUNC, 0)
+		require.NoError(t, err)
+		require.NoError(t, init.CloseFile(fd))
+	})
+}
@@ -0,0 +1,237 @@
+package dev
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/device"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/tty"
+)
+
+// ttyGroup is the group that owns the slaves, as glibc's grantpt expects.
+const ttyGroup = 5
+
+func init() {
+	fs.RegisterFilesystem("devpts", func(ctx context.Context, source, data string) (*fs.Inode, error) {
+		var signaler tty.Signaler
+
+		if task, ok := kernel.GetTask(ctx); ok {
+			signaler = task.Kernel
+		}
+
+		return NewPTS(signaler).Root()
+	})
+}
+
+// PTS is devpts, which has a ptmx to create ptys with and a slave device
+// for each of them, named by its number.
+type PTS struct {
+	Device   *device.Device
+	signaler tty.Signaler
+	root     *fs.Inode
+	ptmx     *fs.Inode
+
+	mu     sync.Mutex
+	slaves map[int]*fs.Inode
+}
+
+// NewPTS creates a devpts, whose ptys send their signals to signaler.
+func NewPTS(signaler tty.Signaler) *PTS {
+	p := &PTS{
+		Device:   device.NewAnonDevice(),
+		signaler: signaler,
+		slaves:   make(map[int]*fs.Inode),
+	}
+
+	p.ptmx = newInode(p.Device, fs.CharacterDevice, linux.TTYAUX_MAJOR, linux.PTMX_MINOR,
+		&charDevice{node: newNode(0666), open: p.openMaster})
+
+	p.root = newInode(p.Device, fs.SpecialDirectory, 0, 0, &ptsDir{node: newNode(0755), pts: p})
+
+	return p
+}
+
+func (p *PTS) Root() (*fs.Inode, error) {
+	return p.root, nil
+}
+
+// OpenMaster creates a pty with the lowest free number and returns its
+// master. The slave appears in the directory until the master is closed,
+// owned by whoever ctx acts as.
+func (p *PTS) OpenMaster(ctx context.Context) (*tty.Master, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	index := 0
+	for p.slaves[index] != nil {
+		index++
+	}
+
+	master := tty.NewPTY(p.signaler, index, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		delete(p.slaves, index)
+	})
+
+	slave := &ptsSlave{t: master.Terminal(), node: newNode(0620)}
+	slave.gid = ttyGroup
+
+	if creds, ok := auth.CredentialsFromContext(ctx); ok {
+		slave.uid = creds.FilesystemUID
+	}
+
+	p.slaves[index] = newInode(p.Device, fs.CharacterDevice, linux.UNIX98_PTY_SLAVE_MAJOR, uint32(index), slave)
+
+	return master, nil
+}
+
+func (p *PTS) openMaster(ctx context.Context) (io.ReadWriteSeeker, error) {
+	return p.OpenMaster(ctx)
+}
+
+func (p *PTS) names() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var indexes []int
+
+	for index := range p.slaves {
+		indexes = append(indexes, index)
+	}
+
+	sort.Ints(indexes)
+
+	names := []string{"ptmx"}
+
+	for _, index := range indexes {
+		names = append(names, strconv.Itoa(index))
+	}
+
+	return names
+}
+
+func (p *PTS) lookup(name string) (*fs.Inode, error) {
+	if name == "ptmx" {
+		return p.ptmx, nil
+	}
+
+	index, err := strconv.Atoi(name)
+	if err != nil {
+		return nil, fs.ErrUnknownPath
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	slave, ok := p.slaves[index]
+	if !ok {
+		return nil, fs.ErrUnknownPath
+	}
+
+	return slave, nil
+}
+
+// ptsDir is the root of devpts. Its entries come and go with the ptys, so
+// it's a special directory that lookups aren't cached through.
+type ptsDir struct {
+	fs.StandardDirOps
+	node
+
+	pts *PTS
+}
+
+func (d *ptsDir) LookupChild(ctx context.Context, inode *fs.Inode, name string) (*fs.Inode, error) {
+	return d.pts.lookup(name)
+}
+
+func (d *ptsDir) ReadDir(ctx context.Context, inode *fs.Inode, offset int, emit fs.ReadDirEmit) error {
+	names := d.pts.names()
+
+	if offset >= len(names) {
+		return nil
+	}
+
+	for _, name := range names[offset:] {
+		child, err := d.pts.lookup(name)
+		if err != nil {
+			// Closed since it was listed.
+			continue
+		}
+
+		if !emit.EmitEntry(name, child) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// ptsSlave is the slave device of a pty. Unlike the other devices, its
+// owner and permissions can be changed, as grantpt(3) does.
+type ptsSlave struct {
+	fs.StandardFileOps
+
+	t *tty.Terminal
+
+	mu sync.Mutex
+	node
+}
+
+func (s *ptsSlave) UnstableAttr(ctx context.Context, inode *fs.Inode) (*fs.InodeUnstableAttr, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.node.UnstableAttr(ctx, inode)
+}
+
+func (s *ptsSlave) SetPermissions(ctx context.Context, inode *fs.Inode, perms int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.perms = perms & 07777
+
+	return nil
+}
+
+func (s *ptsSlave) SetOwner(ctx context.Context, inode *fs.Inode, uid, gid int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if uid != -1 {
+		s.uid = uid
+	}
+
+	if gid != -1 {
+		s.gid = gid
+	}
+
+	return nil
+}
+
+func (s *ptsSlave) ReadLink(ctx context.Context, inode *fs.Inode) (string, error) {
+	return "", fs.ErrNotSymlink
+}
+
+func (s *ptsSlave) Open(ctx context.Context, inode *fs.Inode) (io.ReadWriteSeeker, error) {
+	return tty.OpenSlave(s.t)
+}
+
+func (s *ptsSlave) Reader(inode *fs.Inode) (io.ReadSeeker, error) {
+	return tty.OpenSlave(s.t)
+}
+
+func (s *ptsSlave) Writer(inode *fs.Inode) (io.WriteSeeker, error) {
+	return tty.OpenSlave(s.t)
+}
+
+func (s *ptsSlave) Truncate(ctx context.Context, inode *fs.Inode, size int64) error {
+	return fs.ErrInvalid
+}
@@ -1,11 +1,26 @@
 package fs
 
-import "io"
+import (
+	"io"
+	"path"
+)
 
 type Dirent struct {
 	Name   string
 	Parent *Dirent
 	Inode  *Inode
+
+	// Mount is the mount the dirent was reached through.
+	Mount *Mount
+}
+
+// Path returns the absolute path the dirent was looked up by.
+func (d *Dirent) Path() string {
+	if d.Parent == nil {
+		return "/"
+	}
+
+	return path.Join(d.Parent.Path(), d.Name)
 }
 
 func (d *Dirent) Reader() (io.ReadSeeker, error) {
@@ -0,0 +1,194 @@
+package host_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/host"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEscapes(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "escape")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	outside := filepath.Join(dir, "outside")
+	secret := filepath.Join(outside, "secret")
+
+	require.NoError(t, os.Mkdir(outside, 0755))
+
+	setup := func(t *testing.T) (string, *fs.Inode) {
+		require.NoError(t, ioutil.WriteFile(secret, []byte("secret"), 0600))
+
+		root, err := ioutil.TempDir(dir, "root")
+		require.NoError(t, err)
+
+		require.NoError(t, os.Mkdir(filepath.Join(root, "sub"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "sub", "file"), []byte("file"), 0644))
+
+		hf, err := host.NewHostFS(root)
+		require.NoError(t, err)
+
+		hroot, err := hf.Root()
+		require.NoError(t, err)
+
+		return root, hroot
+	}
+
+	lookup := func(t *testing.T, dir *fs.Inode, name string) *fs.Inode {
+		inode, err := dir.Ops.LookupChild(ctx, dir, name)
+		require.NoError(t, err)
+		return inode
+	}
+
+	requireUntouched := func(t *testing.T) {
+		data, err := ioutil.ReadFile(secret)
+		require.NoError(t, err)
+		require.Equal(t, "secret", string(data))
+
+		stat, err := os.Stat(secret)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+		names, err := ioutil.ReadDir(outside)
+		require.NoError(t, err)
+		require.Len(t, names, 1)
+	}
+
+	t.Run("rejects names that leave the directory", func(t *testing.T) {
+		_, root := setup(t)
+
+		for _, name := range []string{"", ".", "..", "../outside", "sub/../..", "/etc"} {
+			_, err := root.Ops.LookupChild(ctx, root, name)
+			require.Equal(t, fs.ErrInvalid, err, "name: %q", name)
+
+			_, err = root.Ops.Create(ctx, root, name, 0644)
+			require.Equal(t, fs.ErrInvalid, err, "name: %q", name)
+
+			require.Equal(t, fs.ErrInvalid, root.Ops.CreateDirectory(ctx, root, name, 0755), "name: %q", name)
+			require.Equal(t, fs.ErrInvalid, root.Ops.Remove(ctx, root, name), "name: %q", name)
+			require.Equal(t, fs.ErrInvalid, root.Ops.Rename(ctx, root, "sub", root, name), "name: %q", name)
+		}
+
+		requireUntouched(t)
+	})
+
+	t.Run("doesn't follow symlinks out of the directory", func(t *testing.T) {
+		path, root := setup(t)
+
+		require.NoError(t, os.Symlink(outside, filepath.Join(path, "dirlink")))
+		require.NoError(t, os.Symlink(secret, filepath.Join(path, "filelink")))
+
+		dirlink := lookup(t, root, "dirlink")
+		require.Equal(t, fs.Symlink, dirlink.StableAttr.Type)
+
+		_, err := dirlink.Ops.LookupChild(ctx, dirlink, "secret")
+		require.Error(t, err)
+
+		target, err := dirlink.Ops.ReadLink(ctx, dirlink)
+		require.NoError(t, err)
+		require.Equal(t, outside, target)
+
+		filelink := lookup(t, root, "filelink")
+
+		_, err = filelink.Ops.Reader(filelink)
+		require.Error(t, err)
+
+		_, err = filelink.Ops.Writer(filelink)
+		require.Error(t, err)
+
+		require.Error(t, filelink.Ops.Truncate(ctx, filelink, 0))
+		require.Error(t, filelink.Ops.SetPermissions(ctx, filelink, 0777))
+
+		requireUntouched(t)
+	})
+
+	t.Run("doesn't follow a directory swapped for a symlink", func(t *testing.T) {
+		path, root := setup(t)
+
+		sub := lookup(t, root, "sub")
+		file := lookup(t, sub, "file")
+
+		require.NoError(t, os.Rename(filepath.Join(path, "sub"), filepath.Join(path, "moved")))
+		require.NoError(t, os.Symlink(outside, filepath.Join(path, "sub")))
+
+		_, err := sub.Ops.LookupChild(ctx, sub, "secret")
+		require.Error(t, err)
+
+		_, err = sub.Ops.Create(ctx, sub, "created", 0644)
+		require.Error(t, err)
+
+		require.Error(t, sub.Ops.CreateDirectory(ctx, sub, "created", 0755))
+		require.Error(t, sub.Ops.CreateLink(ctx, sub, "/", "created"))
+		require.Error(t, sub.Ops.Remove(ctx, sub, "secret"))
+		require.Error(t, sub.Ops.Rename(ctx, sub, "secret", root, "stolen"))
+		require.Error(t, sub.Ops.ReadDir(ctx, sub, 0, nil))
+		require.Error(t, sub.Ops.SetPermissions(ctx, sub, 0777))
+
+		_, err = file.Ops.Reader(file)
+		require.Error(t, err)
+
+		requireUntouched(t)
+	})
+
+	t.Run("doesn't follow a file swapped for a symlink", func(t *testing.T) {
+		path, root := setup(t)
+
+		sub := lookup(t, root, "sub")
+		file := lookup(t, sub, "file")
+
+		require.NoError(t, os.Remove(filepath.Join(path, "sub", "file")))
+		require.NoError(t, os.Symlink(secret, filepath.Join(path, "sub", "file")))
+
+		_, err := file.Ops.Reader(file)
+		require.Error(t, err)
+
+		_, err = file.Ops.Writer(file)
+		require.Error(t, err)
+
+		require.Error(t, file.Ops.Truncate(ctx, file, 0))
+		require.Error(t, file.Ops.SetPermissions(ctx, file, 0777))
+
+		// Both change the symlink itself rather than its target.
+		require.NoError(t, file.Ops.SetTimestamps(ctx, file, linux.Timespec{Sec: 1}, linux.Timespec{Sec: 1}))
+		require.NoError(t, root.Ops.CreateHardLink(ctx, root, file, "hardlink"))
+
+		stat, err := os.Lstat(filepath.Join(path, "hardlink"))
+		require.NoError(t, err)
+		require.Equal(t, os.ModeSymlink, stat.Mode()&os.ModeType)
+
+		stat, err = os.Stat(secret)
+		require.NoError(t, err)
+		require.NotEqual(t, int64(1), stat.ModTime().Unix())
+
+		requireUntouched(t)
+	})
+
+	t.Run("keeps a single file mount to that file", func(t *testing.T) {
+		hf, err := host.NewHostFS(secret)
+		require.NoError(t, err)
+
+		file, err := hf.Root()
+		require.NoError(t, err)
+		require.Equal(t, fs.RegularFile, file.StableAttr.Type)
+
+		_, err = file.Ops.LookupChild(ctx, file, "..")
+		require.Error(t, err)
+
+		r, err := file.Ops.Reader(file)
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, "secret", string(data))
+	})
+}
@@ -3,54 +3,87 @@ package host
 import (
 	"context"
 	"io"
-	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
-	"syscall"
+	"sort"
 
-	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
 	"github.com/evanphx/columbia/device"
 	"github.com/evanphx/columbia/fs"
 	"github.com/evanphx/columbia/log"
+	"golang.org/x/sys/unix"
 )
 
+// HostFS exposes a host directory to the guest. Everything is resolved
+// relative to an open descriptor for the directory, one component at a
+// time and without following symlinks, so nothing the guest does can
+// reach a host path outside of it. Symlinks are returned to the guest
+// as-is and resolved by the guest's own namespace.
 type HostFS struct {
 	Device *device.Device
 	root   *fs.Inode
-}
 
-func statToStableAttr(stat os.FileInfo) fs.InodeStableAttr {
-	lower := stat.Sys().(*syscall.Stat_t)
+	// dir is the host directory everything is resolved beneath.
+	dir *os.File
 
-	var attr fs.InodeStableAttr
-	attr.BlockSize = int64(lower.Blksize)
-	major, minor := linux.DecodeDeviceID(uint32(lower.Dev))
-	attr.DeviceFileMajor = major
-	attr.DeviceFileMinor = minor
-	attr.DeviceID = uint64(lower.Dev)
-	attr.InodeID = lower.Ino
-	attr.SetType(stat.Mode())
+	// uids and gids map the ids of the guest onto those of the host.
+	uids, gids auth.IDMap
+}
 
-	return attr
+func fileType(mode uint32) fs.InodeType {
+	switch mode & unix.S_IFMT {
+	case unix.S_IFREG:
+		return fs.RegularFile
+	case unix.S_IFDIR:
+		return fs.Directory
+	case unix.S_IFLNK:
+		return fs.Symlink
+	case unix.S_IFIFO:
+		return fs.Pipe
+	case unix.S_IFSOCK:
+		return fs.Socket
+	case unix.S_IFCHR:
+		return fs.CharacterDevice
+	case unix.S_IFBLK:
+		return fs.BlockDevice
+	default:
+		return fs.Anonymous
+	}
 }
 
-func NewHostFS(path string) (*HostFS, error) {
+func NewHostFS(dir string) (*HostFS, error) {
 	dev := device.NewAnonDevice()
 	h := &HostFS{
 		Device: dev,
 	}
 
-	log.L.Trace("creating host fs", "path", path)
+	log.L.Trace("creating host fs", "path", dir)
 
-	stat, err := os.Lstat(path)
+	stat, err := os.Lstat(dir)
 	if err != nil {
 		log.L.Error("error stating hostfs path", "error", err)
 		return nil, err
 	}
 
-	attr := statToStableAttr(stat)
+	// A single file, for mounting over a file in the guest, is reached
+	// through the directory holding it.
+	rel := "."
+	if !stat.IsDir() {
+		rel = filepath.Base(dir)
+		dir = filepath.Dir(dir)
+	}
+
+	h.dir, err = os.OpenFile(dir, os.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
 
-	h.root = fs.NewInode(attr, &Dir{host: h, FSPath: FSPath{Path: path, Info: stat}})
+	h.root, err = h.newInode(rel)
+	if err != nil {
+		h.dir.Close()
+		return nil, err
+	}
 
 	return h, nil
 }
@@ -59,34 +92,137 @@ func (h *HostFS) Root() (*fs.Inode, error) {
 	return h.root, nil
 }
 
+// SetIDMaps maps the ownership of files between the guest and the host:
+// the host's ids become the guest ids mapped onto them, or
+// auth.UnmappedID if none are, and guest ids are turned into the host's
+// when files are created or change owner. Without maps, files keep the
+// ids they have on the host, and new ones are owned by whoever runs us.
+func (h *HostFS) SetIDMaps(uids, gids auth.IDMap) {
+	h.uids, h.gids = uids, gids
+}
+
+// mapsIDs reports whether h has id maps.
+func (h *HostFS) mapsIDs() bool {
+	return h.uids != nil || h.gids != nil
+}
+
+// hostOwner returns the host ids uid and gid of the guest are mapped onto.
+// Either can be auth.NoID, which stays as it is.
+func (h *HostFS) hostOwner(uid, gid int) (int, int, bool) {
+	var ok bool
+
+	if uid != auth.NoID {
+		if uid, ok = h.uids.ToHost(uid); !ok {
+			return 0, 0, false
+		}
+	}
+
+	if gid != auth.NoID {
+		if gid, ok = h.gids.ToHost(gid); !ok {
+			return 0, 0, false
+		}
+	}
+
+	return uid, gid, true
+}
+
+// Close releases the host directory. Inodes of the filesystem can't be
+// used afterwards.
+func (h *HostFS) Close() error {
+	return h.dir.Close()
+}
+
+// openDir opens the directory at rel, relative to the host directory.
+func (h *HostFS) openDir(rel string, flags int) (int, error) {
+	if rel == "." {
+		return unix.Openat(int(h.dir.Fd()), ".", flags|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	}
+
+	return openBeneath(int(h.dir.Fd()), rel, flags|unix.O_DIRECTORY)
+}
+
+// newInode stats the entry at rel and returns an inode for it.
+func (h *HostFS) newInode(rel string) (*fs.Inode, error) {
+	p := FSPath{host: h, Path: rel}
+
+	stat, err := p.stat()
+	if err != nil {
+		return nil, err
+	}
+
+	attr := statToStableAttr(stat)
+
+	if attr.Type == fs.Directory {
+		return fs.NewInode(attr, &Dir{FSPath: p}), nil
+	}
+
+	return fs.NewInode(attr, &Entry{FSPath: p}), nil
+}
+
+// FSPath is an entry of a HostFS.
 type FSPath struct {
+	host *HostFS
+
+	// Path is relative to the host directory, and never contains ".."
+	// or leads through a symlink.
 	Path string
-	Info os.FileInfo
 }
 
-func convertTS(ts syscall.Timespec) linux.Timespec {
-	return linux.Timespec{
-		Sec:  ts.Sec,
-		Nsec: int32(ts.Nsec),
+// parent opens the directory holding p, returning it along with the name
+// of p within it. The caller closes the descriptor.
+func (p *FSPath) parent() (int, string, error) {
+	fd, err := p.host.openDir(path.Dir(p.Path), pathFlags)
+	if err != nil {
+		return -1, "", convertErr(err)
 	}
+
+	return fd, path.Base(p.Path), nil
 }
 
-func (p *FSPath) UnstableAttr(ctx context.Context, inode *fs.Inode) (*fs.InodeUnstableAttr, error) {
-	stat, err := os.Lstat(p.Path)
+func (p *FSPath) stat() (*unix.Stat_t, error) {
+	dirfd, name, err := p.parent()
 	if err != nil {
 		return nil, err
 	}
 
-	lower := stat.Sys().(*syscall.Stat_t)
+	defer unix.Close(dirfd)
 
-	var us fs.InodeUnstableAttr
-	us.AccessTime = convertTS(lower.Atimespec)
-	us.ModificationTime = convertTS(lower.Mtimespec)
-	us.StatusChangeTime = convertTS(lower.Ctimespec)
-	us.GroupId = int(lower.Gid)
-	us.UserId = int(lower.Uid)
-	us.Perms = int(stat.Mode().Perm())
-	us.Size = stat.Size()
+	var stat unix.Stat_t
+
+	err = unix.Fstatat(dirfd, name, &stat, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil, convertErr(err)
+	}
+
+	return &stat, nil
+}
+
+// open opens p itself with flags, failing if it's a symlink.
+func (p *FSPath) open(flags int) (*os.File, error) {
+	dirfd, name, err := p.parent()
+	if err != nil {
+		return nil, err
+	}
+
+	defer unix.Close(dirfd)
+
+	fd, err := unix.Openat(dirfd, name, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, convertErr(err)
+	}
+
+	return os.NewFile(uintptr(fd), p.Path), nil
+}
+
+func (p *FSPath) UnstableAttr(ctx context.Context, inode *fs.Inode) (*fs.InodeUnstableAttr, error) {
+	stat, err := p.stat()
+	if err != nil {
+		return nil, err
+	}
+
+	us := statToUnstableAttr(stat)
+	us.UserId = p.host.uids.FromHost(us.UserId)
+	us.GroupId = p.host.gids.FromHost(us.GroupId)
 
 	return &us, nil
 }
@@ -94,8 +230,6 @@ func (p *FSPath) UnstableAttr(ctx context.Context, inode *fs.Inode) (*fs.InodeUn
 type Dir struct {
 	fs.StandardDirOps
 	FSPath
-
-	host *HostFS
 }
 
 type Entry struct {
@@ -103,53 +237,84 @@ type Entry struct {
 	FSPath
 }
 
+// ReadLink returns the target as stored on the host. It's resolved by the
+// guest's namespace, so absolute targets stay within the guest.
 func (e *Entry) ReadLink(ctx context.Context, inode *fs.Inode) (string, error) {
-	return os.Readlink(e.Path)
+	dirfd, name, err := e.parent()
+	if err != nil {
+		return "", err
+	}
+
+	defer unix.Close(dirfd)
+
+	buf := make([]byte, 256)
+
+	for {
+		n, err := unix.Readlinkat(dirfd, name, buf)
+		if err != nil {
+			if err == unix.EINVAL {
+				return "", fs.ErrNotSymlink
+			}
+
+			return "", convertErr(err)
+		}
+
+		if n < len(buf) {
+			return string(buf[:n]), nil
+		}
+
+		buf = make([]byte, len(buf)*2)
+	}
 }
 
 func (e *Entry) Reader(inode *fs.Inode) (io.ReadSeeker, error) {
-	return os.Open(e.Path)
+	return e.open(unix.O_RDONLY)
 }
 
 func (d *Dir) LookupChild(ctx context.Context, inode *fs.Inode, name string) (*fs.Inode, error) {
 	log.L.Trace("lookup child on host fs", "dir", d.Path, "name", name)
 
-	cp := filepath.Join(d.Path, name)
-
-	stat, err := os.Lstat(cp)
+	cp, err := d.child(name)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fs.ErrUnknownPath
-		}
-
 		return nil, err
 	}
 
-	attr := statToStableAttr(stat)
+	return d.host.newInode(cp)
+}
 
-	if stat.IsDir() {
-		return fs.NewInode(attr, &Dir{host: d.host, FSPath: FSPath{Path: cp, Info: stat}}), nil
+func (d *Dir) ReadDir(ctx context.Context, inode *fs.Inode, offset int, emit fs.ReadDirEmit) error {
+	fd, err := d.host.openDir(d.Path, unix.O_RDONLY)
+	if err != nil {
+		return convertErr(err)
 	}
 
-	return fs.NewInode(attr, &Entry{FSPath: FSPath{Path: cp, Info: stat}}), nil
-}
+	f := os.NewFile(uintptr(fd), d.Path)
+	defer f.Close()
 
-func (d *Dir) ReadDir(ctx context.Context, inode *fs.Inode, offset int, emit fs.ReadDirEmit) error {
-	infos, err := ioutil.ReadDir(d.Path)
+	names, err := f.Readdirnames(-1)
 	if err != nil {
-		return err
+		return convertErr(err)
 	}
 
-	infos = infos[offset:]
-	if len(infos) == 0 {
+	// Sorted so offsets stay stable between calls.
+	sort.Strings(names)
+
+	if offset >= len(names) {
 		return nil
 	}
 
-	for _, ent := range infos {
-		attr := statToStableAttr(ent)
-		inode := fs.NewInode(attr, &Entry{FSPath: FSPath{Path: filepath.Join(d.Path, ent.Name()), Info: ent}})
+	for _, name := range names[offset:] {
+		inode, err := d.host.newInode(path.Join(d.Path, name))
+		if err != nil {
+			// Removed since it was listed.
+			if err == fs.ErrUnknownPath {
+				continue
+			}
+
+			return err
+		}
 
-		if !emit.EmitEntry(ent.Name(), inode) {
+		if !emit.EmitEntry(name, inode) {
 			break
 		}
 	}
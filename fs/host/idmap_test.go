@@ -0,0 +1,109 @@
+package host_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/host"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestIDMaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idmap")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644))
+
+	uid, gid := os.Getuid(), os.Getgid()
+
+	// The guest's root is whoever runs the test.
+	uids, err := auth.NewIDMap(auth.IDMapEntry{First: 0, HostFirst: uid, Count: 1})
+	require.NoError(t, err)
+
+	gids, err := auth.NewIDMap(auth.IDMapEntry{First: 0, HostFirst: gid, Count: 1})
+	require.NoError(t, err)
+
+	hf, err := host.NewHostFS(dir)
+	require.NoError(t, err)
+
+	defer hf.Close()
+
+	hf.SetIDMaps(uids, gids)
+
+	root, err := hf.Root()
+	require.NoError(t, err)
+
+	rootCtx := auth.ContextWithCredentials(context.Background(), auth.New(0, 0))
+	userCtx := auth.ContextWithCredentials(context.Background(), auth.New(1000, 1000))
+
+	t.Run("shows host ids as the guest's", func(t *testing.T) {
+		inode, err := root.Ops.LookupChild(rootCtx, root, "file")
+		require.NoError(t, err)
+
+		attr, err := inode.Ops.UnstableAttr(rootCtx, inode)
+		require.NoError(t, err)
+
+		require.Equal(t, 0, attr.UserId)
+		require.Equal(t, 0, attr.GroupId)
+	})
+
+	t.Run("marks unmapped ids", func(t *testing.T) {
+		other, err := auth.NewIDMap(auth.IDMapEntry{First: 0, HostFirst: uid + 1, Count: 1})
+		require.NoError(t, err)
+
+		hf, err := host.NewHostFS(dir)
+		require.NoError(t, err)
+
+		defer hf.Close()
+
+		hf.SetIDMaps(other, other)
+
+		root, err := hf.Root()
+		require.NoError(t, err)
+
+		attr, err := root.Ops.UnstableAttr(rootCtx, root)
+		require.NoError(t, err)
+
+		require.Equal(t, auth.UnmappedID, attr.UserId)
+		require.Equal(t, auth.OverflowID, auth.ShownID(attr.UserId))
+	})
+
+	t.Run("creates files owned by the mapped ids", func(t *testing.T) {
+		_, err := root.Ops.Create(rootCtx, root, "created", 0644)
+		require.NoError(t, err)
+
+		require.NoError(t, root.Ops.CreateDirectory(rootCtx, root, "subdir", 0755))
+
+		for _, name := range []string{"created", "subdir"} {
+			var stat unix.Stat_t
+			require.NoError(t, unix.Lstat(filepath.Join(dir, name), &stat))
+
+			require.Equal(t, uid, int(stat.Uid))
+			require.Equal(t, gid, int(stat.Gid))
+		}
+	})
+
+	t.Run("refuses to create files for unmapped ids", func(t *testing.T) {
+		_, err := root.Ops.Create(userCtx, root, "unmapped", 0644)
+		require.Equal(t, fs.ErrOverflow, err)
+
+		_, err = os.Lstat(filepath.Join(dir, "unmapped"))
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("only gives files to mapped ids", func(t *testing.T) {
+		inode, err := root.Ops.LookupChild(rootCtx, root, "file")
+		require.NoError(t, err)
+
+		require.Equal(t, fs.ErrInvalid, inode.Ops.SetOwner(rootCtx, inode, 1000, auth.NoID))
+		require.NoError(t, inode.Ops.SetOwner(rootCtx, inode, 0, 0))
+	})
+}
@@ -0,0 +1,45 @@
+package host
+
+import (
+	"strings"
+
+	"github.com/evanphx/columbia/fs"
+	"golang.org/x/sys/unix"
+)
+
+// walkBeneath opens rel relative to dirfd one component at a time, refusing
+// to follow symlinks or to leave dirfd with "..".
+func walkBeneath(dirfd int, rel string, flags int) (int, error) {
+	parts := strings.Split(rel, "/")
+
+	fd := dirfd
+
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			if fd != dirfd {
+				unix.Close(fd)
+			}
+
+			return -1, fs.ErrInvalid
+		}
+
+		f := pathFlags | unix.O_DIRECTORY
+		if i == len(parts)-1 {
+			f = flags
+		}
+
+		next, err := unix.Openat(fd, part, f|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+
+		if fd != dirfd {
+			unix.Close(fd)
+		}
+
+		if err != nil {
+			return -1, err
+		}
+
+		fd = next
+	}
+
+	return fd, nil
+}
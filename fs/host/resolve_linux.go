@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package host
+
+import (
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// pathFlags opens a descriptor that's only used to reach other files.
+const pathFlags = unix.O_PATH
+
+// openBeneath opens rel relative to dirfd without following symlinks or
+// leaving dirfd. openat2(2) has the kernel enforce that, and older kernels
+// fall back to walking the path ourselves.
+func openBeneath(dirfd int, rel string, flags int) (int, error) {
+	fd, err := unix.Openat2(dirfd, rel, &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_NOFOLLOW | unix.O_CLOEXEC),
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	})
+
+	// Seccomp policies commonly reject syscalls they don't know with
+	// EPERM rather than ENOSYS.
+	if err == unix.ENOSYS || err == unix.EPERM {
+		return walkBeneath(dirfd, rel, flags)
+	}
+
+	return fd, err
+}
+
+// chmodNoFollow changes the mode of name in dirfd without following a
+// symlink. Linux's fchmodat(2) has no AT_SYMLINK_NOFOLLOW, so the file is
+// pinned with an O_PATH descriptor and changed through its /proc link.
+func chmodNoFollow(dirfd int, name string, mode uint32) error {
+	fd, err := unix.Openat(dirfd, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(fd)
+
+	var stat unix.Stat_t
+
+	err = unix.Fstat(fd, &stat)
+	if err != nil {
+		return err
+	}
+
+	// Linux symlinks have no mode of their own.
+	if stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return unix.EOPNOTSUPP
+	}
+
+	return unix.Chmod("/proc/self/fd/"+strconv.Itoa(fd), mode)
+}
+
+// mknodSocket creates a socket file called name in dirfd.
+func mknodSocket(dirfd int, name string, perms uint32) error {
+	return unix.Mknodat(dirfd, name, unix.S_IFSOCK|perms, 0)
+}
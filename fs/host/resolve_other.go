@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package host
+
+import (
+	"github.com/evanphx/columbia/fs"
+	"golang.org/x/sys/unix"
+)
+
+// pathFlags opens a descriptor that's only used to reach other files.
+const pathFlags = unix.O_RDONLY
+
+// openBeneath opens rel relative to dirfd without following symlinks or
+// leaving dirfd.
+func openBeneath(dirfd int, rel string, flags int) (int, error) {
+	return walkBeneath(dirfd, rel, flags)
+}
+
+// chmodNoFollow changes the mode of name in dirfd without following a
+// symlink.
+func chmodNoFollow(dirfd int, name string, mode uint32) error {
+	return unix.Fchmodat(dirfd, name, mode, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// mknodSocket fails, since there's no mknodat to create a socket file
+// relative to dirfd with.
+func mknodSocket(dirfd int, name string, perms uint32) error {
+	return fs.ErrNotImplemented
+}
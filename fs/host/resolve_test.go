@@ -0,0 +1,42 @@
+package host
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestWalkBeneath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walk")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	require.NoError(t, os.Symlink("/", filepath.Join(dir, "a", "link")))
+
+	root, err := os.Open(dir)
+	require.NoError(t, err)
+
+	defer root.Close()
+
+	fd, err := walkBeneath(int(root.Fd()), "a/b", unix.O_RDONLY|unix.O_DIRECTORY)
+	require.NoError(t, err)
+	unix.Close(fd)
+
+	_, err = walkBeneath(int(root.Fd()), "a/link", unix.O_RDONLY|unix.O_DIRECTORY)
+	require.Error(t, err)
+
+	_, err = walkBeneath(int(root.Fd()), "a/link/tmp", unix.O_RDONLY|unix.O_DIRECTORY)
+	require.Error(t, err)
+
+	for _, rel := range []string{"..", "a/../..", "a//b", "/a", ""} {
+		_, err = walkBeneath(int(root.Fd()), rel, unix.O_RDONLY|unix.O_DIRECTORY)
+		require.Equal(t, fs.ErrInvalid, err, "path: %q", rel)
+	}
+}
@@ -0,0 +1,48 @@
+package host
+
+import (
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"golang.org/x/sys/unix"
+)
+
+func statToStableAttr(stat *unix.Stat_t) fs.InodeStableAttr {
+	var attr fs.InodeStableAttr
+	attr.Type = fileType(uint32(stat.Mode))
+	attr.BlockSize = int64(stat.Blksize)
+	attr.DeviceID = uint64(uint32(stat.Dev))
+	attr.InodeID = stat.Ino
+
+	// Device files carry the device they refer to, everything else the
+	// device they reside on.
+	dev := uint64(uint32(stat.Dev))
+	if attr.Type == fs.CharacterDevice || attr.Type == fs.BlockDevice {
+		dev = uint64(uint32(stat.Rdev))
+	}
+
+	attr.DeviceFileMajor = uint16(unix.Major(dev))
+	attr.DeviceFileMinor = unix.Minor(dev)
+
+	return attr
+}
+
+func statToUnstableAttr(stat *unix.Stat_t) fs.InodeUnstableAttr {
+	return fs.InodeUnstableAttr{
+		Size:             stat.Size,
+		Usage:            stat.Blocks * 512,
+		Perms:            int(stat.Mode) & 07777,
+		UserId:           int(stat.Uid),
+		GroupId:          int(stat.Gid),
+		AccessTime:       convertTS(stat.Atim),
+		ModificationTime: convertTS(stat.Mtim),
+		StatusChangeTime: convertTS(stat.Ctim),
+		Links:            uint64(stat.Nlink),
+	}
+}
+
+func convertTS(ts unix.Timespec) linux.Timespec {
+	return linux.Timespec{
+		Sec:  ts.Sec,
+		Nsec: int32(ts.Nsec),
+	}
+}
@@ -0,0 +1,124 @@
+package host_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/host"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "stat")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 8192)
+	for i := range data {
+		data[i] = 1
+	}
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), data, 0640))
+	require.NoError(t, os.Link(filepath.Join(dir, "file"), filepath.Join(dir, "hardlink")))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "dir"), 0750))
+	require.NoError(t, os.Symlink("file", filepath.Join(dir, "symlink")))
+	require.NoError(t, unix.Mkfifo(filepath.Join(dir, "fifo"), 0600))
+
+	sock, err := net.Listen("unix", filepath.Join(dir, "socket"))
+	require.NoError(t, err)
+
+	defer sock.Close()
+
+	// Creating device nodes needs CAP_MKNOD.
+	devices := unix.Mknod(filepath.Join(dir, "chr"), unix.S_IFCHR|0600, int(unix.Mkdev(1, 3))) == nil &&
+		unix.Mknod(filepath.Join(dir, "blk"), unix.S_IFBLK|0600, int(unix.Mkdev(7, 0))) == nil
+
+	mtime := time.Unix(1500000000, 5000)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "file"), mtime, mtime))
+
+	hf, err := host.NewHostFS(dir)
+	require.NoError(t, err)
+
+	root, err := hf.Root()
+	require.NoError(t, err)
+
+	stat := func(t *testing.T, name string) (*fs.Inode, *fs.InodeUnstableAttr) {
+		inode, err := root.Ops.LookupChild(ctx, root, name)
+		require.NoError(t, err)
+
+		attr, err := inode.Ops.UnstableAttr(ctx, inode)
+		require.NoError(t, err)
+
+		return inode, attr
+	}
+
+	t.Run("stats regular files", func(t *testing.T) {
+		inode, attr := stat(t, "file")
+
+		require.Equal(t, fs.RegularFile, inode.StableAttr.Type)
+		require.Equal(t, int64(8192), attr.Size)
+		require.True(t, attr.Usage >= 8192, "usage: %d", attr.Usage)
+		require.Equal(t, 0640, attr.Perms)
+		require.Equal(t, uint64(2), attr.Links)
+		require.Equal(t, os.Getuid(), attr.UserId)
+		require.Equal(t, mtime.Unix(), attr.ModificationTime.Sec)
+		require.Equal(t, int32(mtime.Nanosecond()), attr.ModificationTime.Nsec)
+
+		hardlink, _ := stat(t, "hardlink")
+		require.Equal(t, inode.StableAttr.InodeID, hardlink.StableAttr.InodeID)
+		require.Equal(t, inode.StableAttr.DeviceID, hardlink.StableAttr.DeviceID)
+	})
+
+	t.Run("stats directories", func(t *testing.T) {
+		inode, attr := stat(t, "dir")
+
+		require.Equal(t, fs.Directory, inode.StableAttr.Type)
+		require.Equal(t, 0750, attr.Perms)
+		require.Equal(t, uint64(2), attr.Links)
+
+		rootAttr, err := root.Ops.UnstableAttr(ctx, root)
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), rootAttr.Links)
+	})
+
+	t.Run("stats symlinks", func(t *testing.T) {
+		inode, attr := stat(t, "symlink")
+
+		require.Equal(t, fs.Symlink, inode.StableAttr.Type)
+		require.Equal(t, int64(len("file")), attr.Size)
+	})
+
+	t.Run("stats fifos and sockets", func(t *testing.T) {
+		inode, _ := stat(t, "fifo")
+		require.Equal(t, fs.Pipe, inode.StableAttr.Type)
+
+		inode, _ = stat(t, "socket")
+		require.Equal(t, fs.Socket, inode.StableAttr.Type)
+	})
+
+	t.Run("stats devices", func(t *testing.T) {
+		if !devices {
+			t.Skip("can't create device nodes")
+		}
+
+		inode, _ := stat(t, "chr")
+		require.Equal(t, fs.CharacterDevice, inode.StableAttr.Type)
+		require.Equal(t, uint16(1), inode.StableAttr.DeviceFileMajor)
+		require.Equal(t, uint32(3), inode.StableAttr.DeviceFileMinor)
+
+		inode, _ = stat(t, "blk")
+		require.Equal(t, fs.BlockDevice, inode.StableAttr.Type)
+		require.Equal(t, uint16(7), inode.StableAttr.DeviceFileMajor)
+		require.Equal(t, uint32(0), inode.StableAttr.DeviceFileMinor)
+	})
+}
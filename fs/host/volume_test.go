@@ -0,0 +1,138 @@
+package host_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/host"
+	"github.com/evanphx/columbia/fs/tmpfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolume(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "volume")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	vol := filepath.Join(dir, "vol")
+	require.NoError(t, os.Mkdir(vol, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(vol, "file"), []byte("file"), 0644))
+	require.NoError(t, os.Symlink("../secret", filepath.Join(vol, "relative")))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "secret"), filepath.Join(vol, "absolute")))
+
+	setup := func(t *testing.T, readOnly bool) *fs.MountNamespace {
+		root, err := tmpfs.NewTmpFS(tmpfs.Options{}).Root()
+		require.NoError(t, err)
+
+		require.NoError(t, root.Ops.CreateDirectory(ctx, root, "mnt", 0755))
+
+		hf, err := host.NewHostFS(vol)
+		require.NoError(t, err)
+
+		hroot, err := hf.Root()
+		require.NoError(t, err)
+
+		m := fs.NewMountNamespace()
+		m.SetRoot(root)
+
+		require.NoError(t, m.Mount(ctx, "/mnt", &fs.Mount{
+			Root:  hroot,
+			Flags: fs.MountFlags{ReadOnly: readOnly},
+			Type:  "hostfs",
+		}))
+
+		return m
+	}
+
+	t.Run("keeps .. inside the guest", func(t *testing.T) {
+		m := setup(t, false)
+
+		dirent, err := m.LookupPath(ctx, "/mnt/..")
+		require.NoError(t, err)
+		require.Equal(t, m.Root, dirent)
+
+		_, err = m.LookupPath(ctx, "/mnt/../secret")
+		require.Equal(t, fs.ErrUnknownPath, errors.Cause(err))
+
+		mnt, err := m.LookupPath(ctx, "/mnt")
+		require.NoError(t, err)
+
+		_, err = mnt.Inode.Ops.LookupChild(ctx, mnt.Inode, "..")
+		require.Equal(t, fs.ErrInvalid, err)
+
+		_, err = mnt.Inode.Ops.LookupChild(ctx, mnt.Inode, "../secret")
+		require.Equal(t, fs.ErrInvalid, err)
+
+		require.Equal(t, fs.ErrInvalid, mnt.Inode.Ops.CreateLink(ctx, mnt.Inode, "x", "../escape"))
+	})
+
+	t.Run("resolves symlinks within the guest", func(t *testing.T) {
+		m := setup(t, false)
+
+		_, err := m.LookupPath(ctx, "/mnt/relative")
+		require.Equal(t, fs.ErrUnknownPath, errors.Cause(err))
+
+		_, err = m.LookupPath(ctx, "/mnt/absolute")
+		require.Equal(t, fs.ErrUnknownPath, errors.Cause(err))
+
+		dirent, err := m.LookupPath(ctx, "/mnt/file")
+		require.NoError(t, err)
+
+		r, err := dirent.Reader()
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, "file", string(data))
+	})
+
+	t.Run("enforces read-only volumes", func(t *testing.T) {
+		m := setup(t, true)
+
+		mnt, err := m.LookupPath(ctx, "/mnt")
+		require.NoError(t, err)
+		require.Equal(t, fs.ErrReadOnly, fs.CheckWrite(mnt))
+
+		file, err := m.LookupPath(ctx, "/mnt/file")
+		require.NoError(t, err)
+		require.Equal(t, fs.ErrReadOnly, fs.CheckWrite(file))
+
+		// Remounting makes the same dirents writable.
+		require.NoError(t, m.Remount(ctx, "/mnt", fs.MountFlags{}))
+		require.NoError(t, fs.CheckWrite(file))
+	})
+
+	t.Run("reports the host's errors for writers", func(t *testing.T) {
+		m := setup(t, false)
+
+		require.NoError(t, ioutil.WriteFile(filepath.Join(vol, "writeonly"), nil, 0200))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(vol, "readonly"), nil, 0400))
+
+		file, err := m.LookupPath(ctx, "/mnt/writeonly")
+		require.NoError(t, err)
+
+		w, err := file.Inode.Ops.Writer(file.Inode)
+		require.NoError(t, err)
+		w.(io.Closer).Close()
+
+		if os.Getuid() == 0 {
+			t.Skip("root can write anything")
+		}
+
+		file, err = m.LookupPath(ctx, "/mnt/readonly")
+		require.NoError(t, err)
+
+		_, err = file.Inode.Ops.Writer(file.Inode)
+		require.Equal(t, fs.ErrPermission, err)
+	})
+}
@@ -0,0 +1,377 @@
+package host
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/fs"
+	"golang.org/x/sys/unix"
+)
+
+// convertErr maps host errors onto the errors the rest of the fs layer
+// understands.
+func convertErr(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err):
+		return fs.ErrUnknownPath
+	case os.IsExist(err):
+		return fs.ErrExists
+	}
+
+	var errno syscall.Errno
+
+	switch e := err.(type) {
+	case *os.PathError:
+		errno, _ = e.Err.(syscall.Errno)
+	case *os.LinkError:
+		errno, _ = e.Err.(syscall.Errno)
+	case *os.SyscallError:
+		errno, _ = e.Err.(syscall.Errno)
+	case syscall.Errno:
+		errno = e
+	}
+
+	switch errno {
+	case syscall.ENOTEMPTY:
+		return fs.ErrNotEmpty
+	case syscall.EISDIR:
+		return fs.ErrIsDirectory
+	case syscall.ENOTDIR:
+		return fs.ErrNotDirectory
+	case syscall.EXDEV:
+		return fs.ErrCrossDevice
+	case syscall.EROFS:
+		return fs.ErrReadOnly
+	case syscall.ENOSPC:
+		return fs.ErrNoSpace
+	case syscall.ELOOP:
+		return fs.ErrLoop
+	case syscall.EPERM:
+		return fs.ErrNotPermitted
+	case syscall.EACCES:
+		return fs.ErrPermission
+	}
+
+	return err
+}
+
+// child returns the path of the entry name in d. Names that would reach
+// outside of d are rejected, so the guest can't use them to escape the host
+// directory.
+func (d *Dir) child(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return "", fs.ErrInvalid
+	}
+
+	return path.Join(d.Path, name), nil
+}
+
+// withDir calls f with a descriptor for d, for operating on its entries.
+func (d *Dir) withDir(f func(dirfd int) error) error {
+	dirfd, err := d.host.openDir(d.Path, pathFlags)
+	if err != nil {
+		return convertErr(err)
+	}
+
+	defer unix.Close(dirfd)
+
+	return convertErr(f(dirfd))
+}
+
+// owner returns the host ids of an entry created in d on behalf of ctx,
+// and whether it's to be given them at all. It only is with id maps, and
+// only for the guest: without maps the host decides, as it always has.
+// An owner that isn't mapped onto the host can't create anything.
+func (d *Dir) owner(ctx context.Context) (int, int, bool, error) {
+	if !d.host.mapsIDs() {
+		return 0, 0, false, nil
+	}
+
+	if _, ok := auth.CredentialsFromContext(ctx); !ok {
+		return 0, 0, false, nil
+	}
+
+	attr, err := d.UnstableAttr(ctx, nil)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	uid, gid, ok := d.host.hostOwner(fs.Owner(ctx, attr))
+	if !ok {
+		return 0, 0, false, fs.ErrOverflow
+	}
+
+	return uid, gid, true, nil
+}
+
+// create makes the entry name in d with f, then gives it to the host ids
+// its owner is mapped onto. An entry that can't be given them is removed
+// again with rmflags, rather than left owned by the wrong host user.
+func (d *Dir) create(ctx context.Context, name string, rmflags int, f func(dirfd int) error) error {
+	uid, gid, own, err := d.owner(ctx)
+	if err != nil {
+		return err
+	}
+
+	return d.withDir(func(dirfd int) error {
+		if err := f(dirfd); err != nil || !own {
+			return err
+		}
+
+		err := unix.Fchownat(dirfd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			unix.Unlinkat(dirfd, name, rmflags)
+		}
+
+		return err
+	})
+}
+
+func (d *Dir) Create(ctx context.Context, dir *fs.Inode, name string, perms int) (*fs.Inode, error) {
+	cp, err := d.child(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.create(ctx, name, 0, func(dirfd int) error {
+		fd, err := unix.Openat(dirfd, name, unix.O_CREAT|unix.O_EXCL|unix.O_WRONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perms)&0777)
+		if err != nil {
+			return err
+		}
+
+		return unix.Close(fd)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return d.host.newInode(cp)
+}
+
+func (d *Dir) CreateSocket(ctx context.Context, dir *fs.Inode, name string, perms int) (*fs.Inode, error) {
+	cp, err := d.child(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.create(ctx, name, 0, func(dirfd int) error {
+		return mknodSocket(dirfd, name, uint32(perms)&0777)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return d.host.newInode(cp)
+}
+
+func (d *Dir) CreateDirectory(ctx context.Context, dir *fs.Inode, name string, perms int) error {
+	if _, err := d.child(name); err != nil {
+		return err
+	}
+
+	return d.create(ctx, name, unix.AT_REMOVEDIR, func(dirfd int) error {
+		return unix.Mkdirat(dirfd, name, uint32(perms)&0777)
+	})
+}
+
+func (d *Dir) CreateLink(ctx context.Context, dir *fs.Inode, target, name string) error {
+	if _, err := d.child(name); err != nil {
+		return err
+	}
+
+	return d.create(ctx, name, 0, func(dirfd int) error {
+		return unix.Symlinkat(target, dirfd, name)
+	})
+}
+
+func (d *Dir) CreateHardLink(ctx context.Context, dir *fs.Inode, target *fs.Inode, name string) error {
+	if _, err := d.child(name); err != nil {
+		return err
+	}
+
+	var src *FSPath
+
+	switch ops := target.Ops.(type) {
+	case *Entry:
+		src = &ops.FSPath
+	case *Dir:
+		return fs.ErrIsDirectory
+	default:
+		return fs.ErrCrossDevice
+	}
+
+	if src.host != d.host {
+		return fs.ErrCrossDevice
+	}
+
+	srcfd, srcName, err := src.parent()
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(srcfd)
+
+	// Without AT_SYMLINK_FOLLOW a symlink is linked itself, never its
+	// target.
+	return d.withDir(func(dirfd int) error {
+		return unix.Linkat(srcfd, srcName, dirfd, name, 0)
+	})
+}
+
+func (d *Dir) Remove(ctx context.Context, dir *fs.Inode, name string) error {
+	if _, err := d.child(name); err != nil {
+		return err
+	}
+
+	return d.withDir(func(dirfd int) error {
+		var stat unix.Stat_t
+
+		err := unix.Fstatat(dirfd, name, &stat, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			return err
+		}
+
+		if fileType(uint32(stat.Mode)) == fs.Directory {
+			return fs.ErrIsDirectory
+		}
+
+		return unix.Unlinkat(dirfd, name, 0)
+	})
+}
+
+func (d *Dir) RemoveDirectory(ctx context.Context, dir *fs.Inode, name string) error {
+	if _, err := d.child(name); err != nil {
+		return err
+	}
+
+	return d.withDir(func(dirfd int) error {
+		return unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+	})
+}
+
+func (d *Dir) Rename(ctx context.Context, oldParent *fs.Inode, oldName string, newParent *fs.Inode, newName string) error {
+	np, ok := newParent.Ops.(*Dir)
+	if !ok || np.host != d.host {
+		return fs.ErrCrossDevice
+	}
+
+	if _, err := d.child(oldName); err != nil {
+		return err
+	}
+
+	if _, err := np.child(newName); err != nil {
+		return err
+	}
+
+	return d.withDir(func(olddirfd int) error {
+		return np.withDir(func(newdirfd int) error {
+			return unix.Renameat(olddirfd, oldName, newdirfd, newName)
+		})
+	})
+}
+
+func (d *Dir) SetPermissions(ctx context.Context, inode *fs.Inode, perms int) error {
+	return d.FSPath.setPermissions(perms)
+}
+
+func (d *Dir) SetOwner(ctx context.Context, inode *fs.Inode, uid, gid int) error {
+	return d.FSPath.setOwner(uid, gid)
+}
+
+func (d *Dir) SetTimestamps(ctx context.Context, inode *fs.Inode, atime, mtime linux.Timespec) error {
+	return d.FSPath.setTimestamps(atime, mtime)
+}
+
+func (e *Entry) Writer(inode *fs.Inode) (io.WriteSeeker, error) {
+	// Opened for reading too when possible, so the handle can back an
+	// O_RDWR file.
+	f, err := e.open(unix.O_RDWR)
+	if err == fs.ErrPermission {
+		f, err = e.open(unix.O_WRONLY)
+	}
+
+	if err != nil {
+		return nil, convertErr(err)
+	}
+
+	return f, nil
+}
+
+func (e *Entry) Truncate(ctx context.Context, inode *fs.Inode, size int64) error {
+	f, err := e.open(unix.O_WRONLY | unix.O_NONBLOCK)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return convertErr(f.Truncate(size))
+}
+
+func (e *Entry) SetPermissions(ctx context.Context, inode *fs.Inode, perms int) error {
+	return e.FSPath.setPermissions(perms)
+}
+
+func (e *Entry) SetOwner(ctx context.Context, inode *fs.Inode, uid, gid int) error {
+	return e.FSPath.setOwner(uid, gid)
+}
+
+func (e *Entry) SetTimestamps(ctx context.Context, inode *fs.Inode, atime, mtime linux.Timespec) error {
+	return e.FSPath.setTimestamps(atime, mtime)
+}
+
+func (p *FSPath) setPermissions(perms int) error {
+	dirfd, name, err := p.parent()
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(dirfd)
+
+	return convertErr(chmodNoFollow(dirfd, name, uint32(perms)&07777))
+}
+
+// setOwner gives p to the host ids uid and gid of the guest are mapped
+// onto. Ids that aren't mapped can't be given, as with chown(2) in a user
+// namespace.
+func (p *FSPath) setOwner(uid, gid int) error {
+	uid, gid, ok := p.host.hostOwner(uid, gid)
+	if !ok {
+		return fs.ErrInvalid
+	}
+
+	dirfd, name, err := p.parent()
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(dirfd)
+
+	return convertErr(unix.Fchownat(dirfd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW))
+}
+
+func (p *FSPath) setTimestamps(atime, mtime linux.Timespec) error {
+	dirfd, name, err := p.parent()
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(dirfd)
+
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.ToNsec()),
+		unix.NsecToTimespec(mtime.ToNsec()),
+	}
+
+	return convertErr(unix.UtimesNanoAt(dirfd, name, ts, unix.AT_SYMLINK_NOFOLLOW))
+}
@@ -14,6 +14,21 @@ var (
 	ErrNotSymlink     = errors.New("not symlink")
 	ErrNotDirectory   = errors.New("not a directory")
 	ErrNotImplemented = errors.New("not implemented")
+	ErrReadOnly       = errors.New("read-only file system")
+	ErrExists         = errors.New("file exists")
+	ErrNotEmpty       = errors.New("directory not empty")
+	ErrIsDirectory    = errors.New("is a directory")
+	ErrCrossDevice    = errors.New("cross-device link")
+	ErrInvalid        = errors.New("invalid argument")
+	ErrNoSpace        = errors.New("no space left on device")
+	ErrLoop           = errors.New("too many levels of symbolic links")
+	ErrNoDevice       = errors.New("no such device or address")
+	ErrInterrupted    = errors.New("interrupted system call")
+	ErrPermission     = errors.New("permission denied")
+	ErrNotPermitted   = errors.New("operation not permitted")
+	ErrOverflow       = errors.New("value too large for defined data type")
+	ErrWouldBlock     = errors.New("operation would block")
+	ErrFileTooBig     = errors.New("file too large")
 )
 
 // InodeType enumerates types of Inodes.
@@ -124,7 +139,6 @@ func (attr *InodeStableAttr) SetType(mode os.FileMode) {
 
 // UnstableAttr contains Inode attributes that may change over the lifetime
 // of the Inode.
-//
 type InodeUnstableAttr struct {
 	// Size is the file size in bytes.
 	Size int64
@@ -156,6 +170,69 @@ type InodeOps interface {
 	ReadLink(ctx context.Context, inode *Inode) (string, error)
 	Reader(inode *Inode) (io.ReadSeeker, error)
 	ReadDir(ctx context.Context, inode *Inode, offset int, emit ReadDirEmit) error
+
+	// Writer returns a handle to write the contents of a file, positioned
+	// at the start. If the handle implements io.Closer, the caller must
+	// close it.
+	Writer(inode *Inode) (io.WriteSeeker, error)
+
+	// Truncate changes the size of a file.
+	Truncate(ctx context.Context, inode *Inode, size int64) error
+
+	// Create creates a regular file called name in the directory dir.
+	Create(ctx context.Context, dir *Inode, name string, perms int) (*Inode, error)
+
+	// CreateDirectory creates a directory called name in dir.
+	CreateDirectory(ctx context.Context, dir *Inode, name string, perms int) error
+
+	// CreateLink creates a symlink called name in dir pointing to target.
+	CreateLink(ctx context.Context, dir *Inode, target, name string) error
+
+	// CreateHardLink creates an entry called name in dir that refers to
+	// target, which must be on the same filesystem.
+	CreateHardLink(ctx context.Context, dir *Inode, target *Inode, name string) error
+
+	// Remove removes the non-directory entry name from dir.
+	Remove(ctx context.Context, dir *Inode, name string) error
+
+	// RemoveDirectory removes the empty directory name from dir.
+	RemoveDirectory(ctx context.Context, dir *Inode, name string) error
+
+	// Rename moves oldName in oldParent to newName in newParent, replacing
+	// any existing entry.
+	Rename(ctx context.Context, oldParent *Inode, oldName string, newParent *Inode, newName string) error
+
+	SetPermissions(ctx context.Context, inode *Inode, perms int) error
+	SetOwner(ctx context.Context, inode *Inode, uid, gid int) error
+	SetTimestamps(ctx context.Context, inode *Inode, atime, mtime linux.Timespec) error
+}
+
+// MagicLink is implemented by the ops of symlinks that lead straight to
+// an open file rather than through their target, such as those in
+// /proc/[pid]/fd. The file may not be reachable by any path.
+type MagicLink interface {
+	Follow(ctx context.Context, inode *Inode) (*Dirent, error)
+}
+
+// Opener is implemented by the ops of inodes whose handles depend on who
+// opens them, like /dev/tty. Opening a file uses it in place of Reader and
+// Writer, and closes the handle if it's an io.Closer.
+type Opener interface {
+	Open(ctx context.Context, inode *Inode) (io.ReadWriteSeeker, error)
+}
+
+// ContextReader is implemented by handles whose reads wait for data, like
+// terminals, so read(2) can be interrupted through ctx. If nonBlocking is
+// set they fail with ErrWouldBlock instead of waiting.
+type ContextReader interface {
+	ReadContext(ctx context.Context, b []byte, nonBlocking bool) (int, error)
+}
+
+// SocketCreator is implemented by the ops of directories that can hold the
+// socket files that AF_UNIX sockets are bound to. The file is only a name;
+// the socket it leads to is found by its inode.
+type SocketCreator interface {
+	CreateSocket(ctx context.Context, dir *Inode, name string, perms int) (*Inode, error)
 }
 
 type Inode struct {
@@ -0,0 +1,362 @@
+package fs
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrBusy          = errors.New("device or resource busy")
+	ErrNotMountPoint = errors.New("not a mount point")
+	ErrUnknownFSType = errors.New("unknown filesystem type")
+)
+
+// MountFlags are the per-mount options.
+type MountFlags struct {
+	// ReadOnly makes every change through the mount fail with
+	// ErrReadOnly, as CheckWrite reports.
+	ReadOnly bool
+
+	// LockReadOnly keeps a read-only mount read-only, as Linux's
+	// MNT_LOCK_READONLY does for mounts set up by whoever started the
+	// guest: remounting it, or a bind of it, can't clear ReadOnly.
+	LockReadOnly bool
+}
+
+// Mount is a filesystem, or a subtree of one for bind mounts, attached to
+// a MountNamespace.
+type Mount struct {
+	// Path is the absolute path the mount is attached at.
+	Path string
+
+	// Root is the inode at the top of the mount.
+	Root *Inode
+
+	Flags MountFlags
+
+	// Source and Type describe the mount as mount(2) was given them.
+	Source string
+	Type   string
+
+	// covered is the mount this one was stacked on top of at the same
+	// path, which is uncovered again by an unmount.
+	covered *Mount
+}
+
+// dirent returns the dirent for the root of the mount, reached from parent
+// through name.
+func (mnt *Mount) dirent(parent *Dirent, name string) *Dirent {
+	return &Dirent{
+		Name:   name,
+		Parent: parent,
+		Inode:  mnt.Root,
+		Mount:  mnt,
+	}
+}
+
+// CheckWrite checks that dirent can be changed, failing with ErrReadOnly
+// if the mount it was reached through is read-only. Whatever changes the
+// filesystem checks this first, as Linux's mnt_want_write, so the mount's
+// flags as they are now decide, even for a mount remounted since.
+func CheckWrite(dirent *Dirent) error {
+	if dirent.Mount != nil && dirent.Mount.Flags.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return nil
+}
+
+// Filesystem creates an instance of a filesystem type for mount(2). source
+// and data are the mount(2) arguments of the same name.
+type Filesystem func(ctx context.Context, source, data string) (*Inode, error)
+
+var filesystems = map[string]Filesystem{}
+
+// RegisterFilesystem makes a filesystem type available to mount(2). It is
+// meant to be called from the init function of the filesystem's package.
+func RegisterFilesystem(name string, f Filesystem) {
+	filesystems[name] = f
+}
+
+// FindFilesystem returns the registered filesystem type called name.
+func FindFilesystem(name string) (Filesystem, error) {
+	f, ok := filesystems[name]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownFSType, "type: %s", name)
+	}
+
+	return f, nil
+}
+
+func mountKey(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// mountAt returns the mount attached at the absolute path p, if any.
+func (m *MountNamespace) mountAt(p string) (*Mount, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mnt, ok := m.mounts[mountKey(p)]
+	return mnt, ok
+}
+
+// Mount attaches mnt over the directory at target, hiding the directory's
+// contents until it's unmounted. A mount whose root isn't a directory is
+// attached over a file instead. Mounting over an existing mount point
+// stacks the new mount on top.
+func (m *MountNamespace) Mount(ctx context.Context, target string, mnt *Mount) error {
+	dirent, err := m.LookupPath(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	// Directories mount over directories, and anything else over files.
+	if isDir(dirent.Inode) != isDir(mnt.Root) {
+		return errors.Wrapf(ErrNotDirectory, "mount point: %s", target)
+	}
+
+	m.attach(dirent, mnt)
+
+	return nil
+}
+
+func (m *MountNamespace) attach(dirent *Dirent, mnt *Mount) {
+	mnt.Path = dirent.Path()
+	key := mountKey(mnt.Path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mnt.covered = m.mounts[key]
+	m.mounts[key] = mnt
+
+	if key == "" {
+		m.Root = mnt.dirent(nil, "")
+	}
+
+	m.DirentCache.Purge()
+}
+
+// BindMount attaches the subtree at source to target. With recursive, the
+// mounts beneath source are bound beneath target too. The new mount starts
+// with the flags of the one source is on, so binding can't make anything
+// writable that wasn't.
+func (m *MountNamespace) BindMount(ctx context.Context, source, target string, flags MountFlags, recursive bool) error {
+	src, err := m.LookupPath(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	dst, err := m.LookupPath(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	if isDir(src.Inode) != isDir(dst.Inode) {
+		if isDir(dst.Inode) {
+			return errors.Wrapf(ErrNotDirectory, "bind source: %s", source)
+		}
+
+		return errors.Wrapf(ErrNotDirectory, "mount point: %s", target)
+	}
+
+	var submounts []*Mount
+
+	if recursive {
+		srcPath := src.Path()
+
+		for _, mnt := range m.Mounts() {
+			if mnt.Path != srcPath && isBeneath(srcPath, mnt.Path) {
+				submounts = append(submounts, mnt)
+			}
+		}
+	}
+
+	typ := "none"
+	if src.Mount != nil {
+		typ = src.Mount.Type
+		flags.ReadOnly = flags.ReadOnly || src.Mount.Flags.ReadOnly
+		flags.LockReadOnly = src.Mount.Flags.LockReadOnly
+	}
+
+	m.attach(dst, &Mount{
+		Root:   src.Inode,
+		Flags:  flags,
+		Source: source,
+		Type:   typ,
+	})
+
+	// Mounts() is sorted by path, so parents are attached first.
+	for _, sub := range submounts {
+		rel := strings.TrimPrefix(sub.Path, src.Path())
+
+		dirent, err := m.LookupPath(ctx, path.Join(dst.Path(), rel))
+		if err != nil {
+			return err
+		}
+
+		m.attach(dirent, &Mount{
+			Root:   sub.Root,
+			Flags:  sub.Flags,
+			Source: sub.Source,
+			Type:   sub.Type,
+		})
+	}
+
+	return nil
+}
+
+// Remount changes the flags of the mount attached at target. A mount with
+// LockReadOnly can't be made writable, and keeps the lock.
+func (m *MountNamespace) Remount(ctx context.Context, target string, flags MountFlags) error {
+	mnt, err := m.mountFor(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if mnt.Flags.LockReadOnly {
+		if !flags.ReadOnly {
+			return errors.Wrapf(ErrNotPermitted, "locked read-only: %s", target)
+		}
+
+		flags.LockReadOnly = true
+	}
+
+	mnt.Flags = flags
+
+	return nil
+}
+
+// Unmount detaches the mount attached at target, uncovering whatever it was
+// mounted over. Mounts beneath it make it busy unless detach is set, in
+// which case they're unmounted too.
+func (m *MountNamespace) Unmount(ctx context.Context, target string, detach bool) error {
+	mnt, err := m.mountFor(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	if mnt.Path == "/" {
+		return errors.Wrapf(ErrBusy, "mount point: %s", target)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := mountKey(mnt.Path)
+
+	var beneath []string
+
+	for k := range m.mounts {
+		if k != key && isBeneath(mnt.Path, "/"+k) {
+			beneath = append(beneath, k)
+		}
+	}
+
+	// A mount stacked over another at the same path can always go.
+	if len(beneath) > 0 && !detach {
+		return errors.Wrapf(ErrBusy, "mount point: %s", target)
+	}
+
+	for _, k := range beneath {
+		delete(m.mounts, k)
+	}
+
+	if mnt.covered != nil {
+		m.mounts[key] = mnt.covered
+	} else {
+		delete(m.mounts, key)
+	}
+
+	m.DirentCache.Purge()
+
+	return nil
+}
+
+// mountFor returns the mount whose root is at target.
+func (m *MountNamespace) mountFor(ctx context.Context, target string) (*Mount, error) {
+	dirent, err := m.LookupPath(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	mnt := dirent.Mount
+	if mnt == nil || mnt.Path != dirent.Path() {
+		return nil, errors.Wrapf(ErrNotMountPoint, "path: %s", target)
+	}
+
+	return mnt, nil
+}
+
+// Mounts returns the visible mounts, sorted by path.
+func (m *MountNamespace) Mounts() []*Mount {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var mounts []*Mount
+
+	for _, mnt := range m.mounts {
+		mounts = append(mounts, mnt)
+	}
+
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].Path < mounts[j].Path
+	})
+
+	return mounts
+}
+
+// isBeneath reports whether p is dir or inside it.
+func isBeneath(dir, p string) bool {
+	if dir == "/" {
+		return true
+	}
+
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// Clone returns a copy of the namespace sharing the mounted filesystems,
+// whose mount table can then change independently, as for CLONE_NEWNS.
+func (m *MountNamespace) Clone() *MountNamespace {
+	c := NewMountNamespace()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copies := make(map[*Mount]*Mount)
+
+	var copyMount func(mnt *Mount) *Mount
+	copyMount = func(mnt *Mount) *Mount {
+		if mnt == nil {
+			return nil
+		}
+
+		if cp, ok := copies[mnt]; ok {
+			return cp
+		}
+
+		cp := *mnt
+		cp.covered = copyMount(mnt.covered)
+		copies[mnt] = &cp
+
+		return &cp
+	}
+
+	for k, mnt := range m.mounts {
+		c.mounts[k] = copyMount(mnt)
+	}
+
+	if root, ok := c.mounts[""]; ok {
+		c.Root = root.dirent(nil, "")
+	}
+
+	return c
+}
@@ -0,0 +1,206 @@
+package fs_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/tmpfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func newTmpfs(t *testing.T, dirs ...string) *fs.Inode {
+	root, err := tmpfs.NewTmpFS(tmpfs.Options{}).Root()
+	require.NoError(t, err)
+
+	for _, dir := range dirs {
+		require.NoError(t, root.Ops.CreateDirectory(context.Background(), root, dir, 0755))
+	}
+
+	return root
+}
+
+func create(t *testing.T, m *fs.MountNamespace, path string) error {
+	parent, name, err := m.LookupParent(context.Background(), path)
+	require.NoError(t, err)
+
+	err = fs.CheckWrite(parent)
+	if err != nil {
+		return err
+	}
+
+	_, err = parent.Inode.Ops.Create(context.Background(), parent.Inode, name, 0644)
+	return err
+}
+
+func TestMountNamespace(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T) *fs.MountNamespace {
+		m := fs.NewMountNamespace()
+		m.SetRoot(newTmpfs(t, "tmp", "mnt", "data"))
+
+		require.NoError(t, create(t, m, "/tmp/hidden"))
+		require.NoError(t, create(t, m, "/data/file"))
+
+		return m
+	}
+
+	t.Run("crosses mount points", func(t *testing.T) {
+		m := setup(t)
+
+		require.NoError(t, m.Mount(ctx, "/tmp", &fs.Mount{Root: newTmpfs(t, "sub"), Type: "tmpfs"}))
+
+		_, err := m.LookupPath(ctx, "/tmp/hidden")
+		require.Equal(t, fs.ErrUnknownPath, err)
+
+		sub, err := m.LookupPath(ctx, "/tmp/sub")
+		require.NoError(t, err)
+		require.Equal(t, "/tmp", sub.Mount.Path)
+		require.Equal(t, "/tmp/sub", sub.Path())
+
+		data, err := m.LookupPath(ctx, "/tmp/sub/../../data/file")
+		require.NoError(t, err)
+		require.Equal(t, m.Root.Mount, data.Mount)
+
+		_, err = m.LookupPath(ctx, "/../tmp/./sub")
+		require.NoError(t, err)
+	})
+
+	t.Run("stacks and unmounts", func(t *testing.T) {
+		m := setup(t)
+
+		require.NoError(t, m.Mount(ctx, "/tmp", &fs.Mount{Root: newTmpfs(t, "first")}))
+		require.NoError(t, m.Mount(ctx, "/tmp", &fs.Mount{Root: newTmpfs(t, "second")}))
+		require.NoError(t, m.Mount(ctx, "/tmp/second", &fs.Mount{Root: newTmpfs(t)}))
+
+		require.Equal(t, fs.ErrBusy, errors.Cause(m.Unmount(ctx, "/tmp", false)))
+		require.NoError(t, m.Unmount(ctx, "/tmp/second", false))
+		require.NoError(t, m.Unmount(ctx, "/tmp", false))
+
+		_, err := m.LookupPath(ctx, "/tmp/first")
+		require.NoError(t, err)
+
+		require.NoError(t, m.Unmount(ctx, "/tmp", false))
+
+		_, err = m.LookupPath(ctx, "/tmp/hidden")
+		require.NoError(t, err)
+
+		require.Equal(t, fs.ErrNotMountPoint, errors.Cause(m.Unmount(ctx, "/tmp", false)))
+		require.Equal(t, fs.ErrBusy, errors.Cause(m.Unmount(ctx, "/", false)))
+	})
+
+	t.Run("bind mounts read-only", func(t *testing.T) {
+		m := setup(t)
+
+		require.NoError(t, m.BindMount(ctx, "/data", "/mnt", fs.MountFlags{ReadOnly: true}, false))
+
+		_, err := m.LookupPath(ctx, "/mnt/file")
+		require.NoError(t, err)
+
+		require.Equal(t, fs.ErrReadOnly, create(t, m, "/mnt/new"))
+
+		mnt, err := m.LookupPath(ctx, "/mnt")
+		require.NoError(t, err)
+		require.Equal(t, fs.ErrReadOnly, fs.CheckWrite(mnt))
+
+		// The original is still writable, and changes show through.
+		require.NoError(t, create(t, m, "/data/new"))
+
+		_, err = m.LookupPath(ctx, "/mnt/new")
+		require.NoError(t, err)
+
+		require.NoError(t, m.Remount(ctx, "/mnt", fs.MountFlags{}))
+		require.NoError(t, create(t, m, "/mnt/other"))
+	})
+
+	t.Run("keeps binds of read-only mounts read-only", func(t *testing.T) {
+		m := setup(t)
+
+		require.NoError(t, m.Mount(ctx, "/data", &fs.Mount{
+			Root:  newTmpfs(t, "sub"),
+			Flags: fs.MountFlags{ReadOnly: true},
+		}))
+
+		require.NoError(t, m.BindMount(ctx, "/data/sub", "/mnt", fs.MountFlags{}, false))
+
+		mnt, err := m.LookupPath(ctx, "/mnt")
+		require.NoError(t, err)
+		require.True(t, mnt.Mount.Flags.ReadOnly)
+
+		require.Equal(t, fs.ErrReadOnly, create(t, m, "/mnt/new"))
+	})
+
+	t.Run("makes binds of read-only mounts writable by remounting", func(t *testing.T) {
+		m := setup(t)
+
+		require.NoError(t, m.Mount(ctx, "/data", &fs.Mount{
+			Root:  newTmpfs(t, "sub"),
+			Flags: fs.MountFlags{ReadOnly: true},
+		}))
+
+		require.NoError(t, m.BindMount(ctx, "/data/sub", "/mnt", fs.MountFlags{}, false))
+
+		// A dirent looked up before the remount sees it too.
+		mnt, err := m.LookupPath(ctx, "/mnt")
+		require.NoError(t, err)
+
+		require.NoError(t, m.Remount(ctx, "/mnt", fs.MountFlags{}))
+		require.NoError(t, fs.CheckWrite(mnt))
+		require.NoError(t, create(t, m, "/mnt/new"))
+
+		require.Equal(t, fs.ErrReadOnly, create(t, m, "/data/new"))
+	})
+
+	t.Run("won't make locked mounts writable", func(t *testing.T) {
+		m := setup(t)
+
+		require.NoError(t, m.Mount(ctx, "/data", &fs.Mount{
+			Root:  newTmpfs(t, "sub"),
+			Flags: fs.MountFlags{ReadOnly: true, LockReadOnly: true},
+		}))
+
+		require.Equal(t, fs.ErrNotPermitted, errors.Cause(m.Remount(ctx, "/data", fs.MountFlags{})))
+		require.NoError(t, m.Remount(ctx, "/data", fs.MountFlags{ReadOnly: true}))
+		require.Equal(t, fs.ErrNotPermitted, errors.Cause(m.Remount(ctx, "/data", fs.MountFlags{})))
+
+		require.NoError(t, m.BindMount(ctx, "/data/sub", "/mnt", fs.MountFlags{}, false))
+		require.Equal(t, fs.ErrNotPermitted, errors.Cause(m.Remount(ctx, "/mnt", fs.MountFlags{})))
+
+		require.Equal(t, fs.ErrReadOnly, create(t, m, "/data/new"))
+		require.Equal(t, fs.ErrReadOnly, create(t, m, "/mnt/new"))
+	})
+
+	t.Run("binds submounts recursively", func(t *testing.T) {
+		m := setup(t)
+
+		require.NoError(t, m.Mount(ctx, "/data", &fs.Mount{Root: newTmpfs(t, "inner")}))
+		require.NoError(t, m.Mount(ctx, "/data/inner", &fs.Mount{Root: newTmpfs(t, "deep")}))
+
+		require.NoError(t, m.BindMount(ctx, "/data", "/mnt", fs.MountFlags{}, true))
+
+		_, err := m.LookupPath(ctx, "/mnt/inner/deep")
+		require.NoError(t, err)
+	})
+
+	t.Run("clones the mount table", func(t *testing.T) {
+		m := setup(t)
+
+		c := m.Clone()
+
+		require.NoError(t, c.Mount(ctx, "/tmp", &fs.Mount{Root: newTmpfs(t)}))
+
+		_, err := m.LookupPath(ctx, "/tmp/hidden")
+		require.NoError(t, err)
+
+		_, err = c.LookupPath(ctx, "/tmp/hidden")
+		require.Equal(t, fs.ErrUnknownPath, err)
+
+		// The filesystems themselves are shared.
+		require.NoError(t, create(t, c, "/data/shared"))
+
+		_, err = m.LookupPath(ctx, "/data/shared")
+		require.NoError(t, err)
+	})
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"path/filepath"
 	"strings"
+	"sync"
 
+	"github.com/evanphx/columbia/auth"
 	"github.com/hashicorp/golang-lru"
 	"github.com/pkg/errors"
 )
@@ -12,6 +14,12 @@ import (
 type MountNamespace struct {
 	Root        *Dirent
 	DirentCache *lru.ARCCache
+
+	mu sync.Mutex
+
+	// mounts maps the path of each mount point, without the leading /, to
+	// the mount attached there. The root mount is under "".
+	mounts map[string]*Mount
 }
 
 func NewMountNamespace() *MountNamespace {
@@ -22,64 +30,294 @@ func NewMountNamespace() *MountNamespace {
 
 	return &MountNamespace{
 		DirentCache: cache,
+		mounts:      make(map[string]*Mount),
 	}
 }
 
+// SetRoot replaces the whole namespace with a single mount of i at /.
 func (m *MountNamespace) SetRoot(i *Inode) {
-	m.Root = &Dirent{Inode: i}
+	mnt := &Mount{
+		Path: "/",
+		Root: i,
+		Type: "rootfs",
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mounts = map[string]*Mount{"": mnt}
+	m.Root = mnt.dirent(nil, "")
+
+	m.DirentCache.Purge()
 }
 
+// maxSymlinks is how many symlinks a single lookup follows before failing
+// with ErrLoop, as on Linux.
+const maxSymlinks = 40
+
+// LookupPath walks path from the root, following symlinks wherever they
+// appear.
 func (m *MountNamespace) LookupPath(ctx context.Context, path string) (*Dirent, error) {
-	dirent, err := m.LookupDirent(ctx, path)
-	if err != nil {
-		return nil, err
+	return m.lookup(ctx, path, true)
+}
+
+// LookupDirent walks path from the root, crossing into the filesystems
+// mounted along the way. A final symlink is not followed unless the path
+// ends in a slash.
+func (m *MountNamespace) LookupDirent(ctx context.Context, path string) (*Dirent, error) {
+	return m.lookup(ctx, path, false)
+}
+
+func (m *MountNamespace) lookup(ctx context.Context, path string, follow bool) (*Dirent, error) {
+	key := strings.TrimPrefix(path, "/")
+
+	if key == "" {
+		return m.Root, nil
 	}
 
-	if dirent.Inode.StableAttr.Type != Symlink {
-		return dirent, nil
+	if val, ok := m.DirentCache.Get(key); ok && isClean(key) {
+		dirent := val.(*Dirent)
+		if !follow || dirent.Inode.StableAttr.Type != Symlink {
+			// The walk that cached it may have been allowed through
+			// directories this one isn't.
+			if err := checkSearch(ctx, dirent); err != nil {
+				return nil, errors.Wrapf(err, "path: %s", path)
+			}
+
+			return dirent, nil
+		}
 	}
 
-	target, err := dirent.Inode.Ops.ReadLink(ctx, dirent.Inode)
+	w := walker{m: m}
+
+	dirent, err := w.walk(ctx, m.Root, key, follow)
 	if err != nil {
 		return nil, err
 	}
 
-	fullTarget := filepath.Clean(filepath.Join(filepath.Dir(path), target))
+	// Invalidate only knows the paths that were walked, so lookups that
+	// went through a symlink, or with . or .., aren't cached. Nor are those
+	// through special directories, whose entries come and go without any
+	// invalidation.
+	if w.links == 0 && !w.special && isClean(key) {
+		m.DirentCache.Add(key, dirent)
+	}
 
-	return m.LookupPath(ctx, fullTarget)
+	return dirent, nil
 }
 
-func (m *MountNamespace) LookupDirent(ctx context.Context, path string) (*Dirent, error) {
-	if path[0] == '/' {
-		path = path[1:]
-	}
+// isClean reports whether key, a path without the leading slash, is
+// already as filepath.Clean would make it.
+func isClean(key string) bool {
+	return "/"+key == filepath.Clean("/"+key)
+}
 
-	if path == "" {
-		return m.Root, nil
+// walker resolves a path, counting the symlinks followed along the way.
+type walker struct {
+	m     *MountNamespace
+	links int
+
+	// special is set once a lookup was made in a SpecialDirectory.
+	special bool
+}
+
+func isDir(inode *Inode) bool {
+	switch inode.StableAttr.Type {
+	case Directory, SpecialDirectory:
+		return true
+	default:
+		return false
 	}
+}
 
-	if val, ok := m.DirentCache.Get(path); ok {
-		return val.(*Dirent), nil
+// walk resolves path relative to start, or from the root of the namespace
+// if it's absolute. Symlinks before the final component are always
+// followed, and the final one when follow is set.
+func (w *walker) walk(ctx context.Context, start *Dirent, path string, follow bool) (*Dirent, error) {
+	cur := start
+	if strings.HasPrefix(path, "/") {
+		cur = w.m.Root
 	}
 
-	sections := strings.Split(path, "/")
+	parts := strings.Split(path, "/")
 
-	cur := m.Root
+	// A trailing slash or "." needs a directory, following a final
+	// symlink to reach one.
+	last := parts[len(parts)-1]
+	mustDir := len(parts) > 1 && (last == "" || last == ".")
 
-	for _, part := range sections {
-		if cur.Inode.StableAttr.Type != Directory {
+	if mustDir {
+		follow = true
+	}
+
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+
+		if !isDir(cur.Inode) {
 			return nil, errors.Wrapf(ErrNotDirectory, "component: %s", cur.Name)
 		}
 
-		i, err := cur.Inode.Ops.LookupChild(ctx, cur.Inode, part)
+		if err := CheckAccess(ctx, cur.Inode, auth.MayExec); err != nil {
+			return nil, errors.Wrapf(err, "component: %s", cur.Name)
+		}
+
+		switch part {
+		case ".":
+			continue
+		case "..":
+			// The parent of a mount's root is the directory holding the
+			// mount point, so this crosses back out of mounts.
+			if cur.Parent != nil {
+				cur = cur.Parent
+			}
+
+			continue
+		}
+
+		next, err := w.child(ctx, cur, part)
 		if err != nil {
 			return nil, err
 		}
 
-		cur = &Dirent{Inode: i, Parent: cur, Name: part}
+		if next.Inode.StableAttr.Type == Symlink && (follow || !isLast(parts, i)) {
+			next, err = w.follow(ctx, cur, next)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		cur = next
 	}
 
-	m.DirentCache.Add(path, cur)
+	if mustDir && !isDir(cur.Inode) {
+		return nil, errors.Wrapf(ErrNotDirectory, "path: %s", path)
+	}
 
 	return cur, nil
 }
+
+// isLast reports whether parts[i] is the final component naming an entry.
+func isLast(parts []string, i int) bool {
+	for _, part := range parts[i+1:] {
+		if part != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// child looks up name in dir, crossing into a filesystem mounted there.
+func (w *walker) child(ctx context.Context, dir *Dirent, name string) (*Dirent, error) {
+	if dir.Inode.StableAttr.Type == SpecialDirectory {
+		w.special = true
+	}
+
+	i, err := dir.Inode.Ops.LookupChild(ctx, dir.Inode, name)
+	if err != nil {
+		return nil, err
+	}
+
+	next := &Dirent{Inode: i, Parent: dir, Name: name, Mount: dir.Mount}
+
+	if mnt, ok := w.m.mountAt(next.Path()); ok {
+		next = mnt.dirent(dir, name)
+	}
+
+	return next, nil
+}
+
+// follow resolves the symlink link found in dir. Targets are resolved
+// within the namespace, so symlinks on mounted host directories can't
+// point outside of what the guest can see.
+func (w *walker) follow(ctx context.Context, dir, link *Dirent) (*Dirent, error) {
+	w.links++
+
+	if w.links > maxSymlinks {
+		return nil, errors.Wrapf(ErrLoop, "symlink: %s", link.Path())
+	}
+
+	if magic, ok := link.Inode.Ops.(MagicLink); ok {
+		return magic.Follow(ctx, link.Inode)
+	}
+
+	target, err := link.Inode.Ops.ReadLink(ctx, link.Inode)
+	if err != nil {
+		return nil, err
+	}
+
+	if target == "" {
+		return nil, errors.Wrapf(ErrUnknownPath, "symlink: %s", link.Path())
+	}
+
+	return w.walk(ctx, dir, target, true)
+}
+
+// LookupParent resolves the directory that holds the final component of
+// path, returning it along with that component's name. The path is walked
+// as it is, so .. is resolved after the symlinks before it. With a trailing
+// slash, the component must be a directory, if it exists.
+func (m *MountNamespace) LookupParent(ctx context.Context, path string) (*Dirent, string, error) {
+	trimmed := strings.TrimRight(path, "/")
+
+	dir, name := "/", trimmed
+	if i := strings.LastIndex(trimmed, "/"); i != -1 {
+		dir, name = trimmed[:i+1], trimmed[i+1:]
+	}
+
+	switch name {
+	case "", ".", "..":
+		return nil, "", errors.Wrapf(ErrExists, "path: %s", path)
+	}
+
+	parent, err := m.LookupPath(ctx, dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !isDir(parent.Inode) {
+		return nil, "", errors.Wrapf(ErrNotDirectory, "path: %s", dir)
+	}
+
+	if len(trimmed) < len(path) {
+		w := walker{m: m}
+
+		if _, err := w.walk(ctx, parent, name+"/", true); errors.Cause(err) == ErrNotDirectory {
+			return nil, "", err
+		}
+	}
+
+	return parent, name, nil
+}
+
+// JoinPath makes path absolute against dir. Unlike filepath.Join, it
+// leaves the path as it is, so .. and a trailing slash are left for the
+// walk to resolve.
+func JoinPath(dir, path string) string {
+	if strings.HasPrefix(path, "/") {
+		return path
+	}
+
+	return strings.TrimSuffix(dir, "/") + "/" + path
+}
+
+// Invalidate drops the cached lookups of path and everything beneath it,
+// after it has been removed or renamed.
+func (m *MountNamespace) Invalidate(path string) {
+	path = strings.TrimPrefix(filepath.Clean("/"+path), "/")
+
+	if path == "" {
+		m.DirentCache.Purge()
+		return
+	}
+
+	prefix := path + "/"
+
+	for _, key := range m.DirentCache.Keys() {
+		if k := key.(string); k == path || strings.HasPrefix(k, prefix) {
+			m.DirentCache.Remove(key)
+		}
+	}
+}
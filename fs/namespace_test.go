@@ -0,0 +1,225 @@
+package fs_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/fs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func symlink(t *testing.T, m *fs.MountNamespace, target, path string) {
+	parent, name, err := m.LookupParent(context.Background(), path)
+	require.NoError(t, err)
+
+	require.NoError(t, parent.Inode.Ops.CreateLink(context.Background(), parent.Inode, target, name))
+}
+
+func TestLookupPath(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T) *fs.MountNamespace {
+		m := fs.NewMountNamespace()
+		m.SetRoot(newTmpfs(t, "usr", "lib", "mnt"))
+
+		require.NoError(t, m.Root.Inode.Ops.CreateDirectory(ctx, m.Root.Inode, "real", 0755))
+
+		usr, err := m.LookupPath(ctx, "/usr")
+		require.NoError(t, err)
+		require.NoError(t, usr.Inode.Ops.CreateDirectory(ctx, usr.Inode, "share", 0755))
+
+		require.NoError(t, create(t, m, "/usr/share/foo"))
+		require.NoError(t, create(t, m, "/file"))
+
+		return m
+	}
+
+	t.Run("follows symlinks in any position", func(t *testing.T) {
+		m := setup(t)
+
+		symlink(t, m, "usr/share", "/share")
+		symlink(t, m, "/usr", "/lib/usr")
+		symlink(t, m, "foo", "/usr/share/bar")
+
+		foo, err := m.LookupPath(ctx, "/usr/share/foo")
+		require.NoError(t, err)
+
+		for _, path := range []string{"/share/foo", "/lib/usr/share/foo", "/lib/usr/share/bar", "/share/bar"} {
+			dirent, err := m.LookupPath(ctx, path)
+			require.NoError(t, err, "path: %s", path)
+			require.Equal(t, foo.Inode, dirent.Inode, "path: %s", path)
+			require.Equal(t, "/usr/share/foo", dirent.Path(), "path: %s", path)
+		}
+
+		link, err := m.LookupDirent(ctx, "/share/bar")
+		require.NoError(t, err)
+		require.Equal(t, fs.Symlink, link.Inode.StableAttr.Type)
+		require.Equal(t, "/usr/share/bar", link.Path())
+	})
+
+	t.Run("resolves .. from where a symlink leads", func(t *testing.T) {
+		m := setup(t)
+
+		symlink(t, m, "/usr/share", "/lib/share")
+
+		dirent, err := m.LookupPath(ctx, "/lib/share/../share/foo")
+		require.NoError(t, err)
+		require.Equal(t, "/usr/share/foo", dirent.Path())
+
+		dirent, err = m.LookupPath(ctx, "/../../usr/./share/../share")
+		require.NoError(t, err)
+		require.Equal(t, "/usr/share", dirent.Path())
+
+		_, err = m.LookupPath(ctx, "/file/..")
+		require.Equal(t, fs.ErrNotDirectory, errors.Cause(err))
+	})
+
+	t.Run("finds parents after following symlinks", func(t *testing.T) {
+		m := setup(t)
+
+		symlink(t, m, "/usr/share", "/lib/share")
+
+		parent, name, err := m.LookupParent(ctx, "/lib/share/../new")
+		require.NoError(t, err)
+		require.Equal(t, "/usr", parent.Path())
+		require.Equal(t, "new", name)
+
+		parent, name, err = m.LookupParent(ctx, "/lib/share/../share/")
+		require.NoError(t, err)
+		require.Equal(t, "/usr", parent.Path())
+		require.Equal(t, "share", name)
+
+		_, _, err = m.LookupParent(ctx, "/usr/..")
+		require.Equal(t, fs.ErrExists, errors.Cause(err))
+
+		_, name, err = m.LookupParent(ctx, "/newdir/")
+		require.NoError(t, err)
+		require.Equal(t, "newdir", name)
+
+		_, _, err = m.LookupParent(ctx, "/file/")
+		require.Equal(t, fs.ErrNotDirectory, errors.Cause(err))
+	})
+
+	t.Run("doesn't cache lookups with ..", func(t *testing.T) {
+		m := setup(t)
+
+		dirent, err := m.LookupPath(ctx, "/usr/share/..")
+		require.NoError(t, err)
+		require.Equal(t, "/usr", dirent.Path())
+
+		require.NoError(t, m.Root.Inode.Ops.Rename(ctx, m.Root.Inode, "usr", m.Root.Inode, "other"))
+		m.Invalidate("/usr")
+
+		_, err = m.LookupPath(ctx, "/usr/share/..")
+		require.Equal(t, fs.ErrUnknownPath, errors.Cause(err))
+	})
+
+	t.Run("re-roots absolute targets at the namespace root", func(t *testing.T) {
+		m := setup(t)
+
+		require.NoError(t, m.Mount(ctx, "/mnt", &fs.Mount{Root: newTmpfs(t, "etc"), Type: "tmpfs"}))
+
+		symlink(t, m, "/usr", "/mnt/etc/usr")
+
+		dirent, err := m.LookupPath(ctx, "/mnt/etc/usr/share/foo")
+		require.NoError(t, err)
+		require.Equal(t, "/usr/share/foo", dirent.Path())
+		require.Equal(t, m.Root.Mount, dirent.Mount)
+	})
+
+	t.Run("fails after 40 symlinks", func(t *testing.T) {
+		m := setup(t)
+
+		symlink(t, m, "/real", "/real/link0")
+
+		for i := 1; i <= 40; i++ {
+			symlink(t, m, fmt.Sprintf("link%d", i-1), fmt.Sprintf("/real/link%d", i))
+		}
+
+		_, err := m.LookupPath(ctx, "/real/link39")
+		require.NoError(t, err)
+
+		_, err = m.LookupPath(ctx, "/real/link40")
+		require.Equal(t, fs.ErrLoop, errors.Cause(err))
+
+		symlink(t, m, "loop", "/loop")
+
+		_, err = m.LookupPath(ctx, "/loop")
+		require.Equal(t, fs.ErrLoop, errors.Cause(err))
+
+		_, err = m.LookupDirent(ctx, "/loop")
+		require.NoError(t, err)
+	})
+
+	t.Run("treats trailing slashes as directories", func(t *testing.T) {
+		m := setup(t)
+
+		symlink(t, m, "usr", "/dirlink")
+		symlink(t, m, "file", "/filelink")
+
+		dirent, err := m.LookupDirent(ctx, "/dirlink/")
+		require.NoError(t, err)
+		require.Equal(t, "/usr", dirent.Path())
+
+		dirent, err = m.LookupDirent(ctx, "/dirlink/.")
+		require.NoError(t, err)
+		require.Equal(t, "/usr", dirent.Path())
+
+		dirent, err = m.LookupDirent(ctx, "/dirlink")
+		require.NoError(t, err)
+		require.Equal(t, fs.Symlink, dirent.Inode.StableAttr.Type)
+
+		_, err = m.LookupPath(ctx, "/file/")
+		require.Equal(t, fs.ErrNotDirectory, errors.Cause(err))
+
+		_, err = m.LookupDirent(ctx, "/filelink/")
+		require.Equal(t, fs.ErrNotDirectory, errors.Cause(err))
+	})
+
+	t.Run("doesn't cache lookups through symlinks", func(t *testing.T) {
+		m := setup(t)
+
+		symlink(t, m, "usr", "/link")
+
+		_, err := m.LookupPath(ctx, "/link/share/foo")
+		require.NoError(t, err)
+
+		usr, err := m.LookupPath(ctx, "/usr/share")
+		require.NoError(t, err)
+		require.NoError(t, usr.Inode.Ops.Remove(ctx, usr.Inode, "foo"))
+		m.Invalidate("/usr/share/foo")
+
+		_, err = m.LookupPath(ctx, "/link/share/foo")
+		require.Equal(t, fs.ErrUnknownPath, errors.Cause(err))
+	})
+
+	t.Run("needs search permission on each directory", func(t *testing.T) {
+		m := setup(t)
+
+		usr, err := m.LookupPath(ctx, "/usr")
+		require.NoError(t, err)
+		require.NoError(t, usr.Inode.Ops.SetPermissions(ctx, usr.Inode, 0700))
+
+		user := auth.ContextWithCredentials(ctx, auth.New(1000, 1000))
+
+		_, err = m.LookupPath(user, "/usr/share/foo")
+		require.Equal(t, fs.ErrPermission, errors.Cause(err))
+
+		// Root's lookup is cached, which mustn't let the user through.
+		root := auth.ContextWithCredentials(ctx, auth.New(0, 0))
+
+		_, err = m.LookupPath(root, "/usr/share/foo")
+		require.NoError(t, err)
+
+		_, err = m.LookupPath(user, "/usr/share/foo")
+		require.Equal(t, fs.ErrPermission, errors.Cause(err))
+
+		require.NoError(t, usr.Inode.Ops.SetOwner(ctx, usr.Inode, 1000, 1000))
+
+		_, err = m.LookupPath(user, "/usr/share/foo")
+		require.NoError(t, err)
+	})
+}
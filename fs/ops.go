@@ -3,8 +3,12 @@ package fs
 import (
 	"context"
 	"io"
+
+	"github.com/evanphx/columbia/abi/linux"
 )
 
+// StandardDirOps provides the operations of a read-only directory that
+// don't apply to directories.
 type StandardDirOps struct{}
 
 func (_ StandardDirOps) ReadLink(ctx context.Context, inode *Inode) (string, error) {
@@ -15,6 +19,56 @@ func (_ StandardDirOps) Reader(inode *Inode) (io.ReadSeeker, error) {
 	return nil, ErrNotImplemented
 }
 
+func (_ StandardDirOps) Writer(inode *Inode) (io.WriteSeeker, error) {
+	return nil, ErrIsDirectory
+}
+
+func (_ StandardDirOps) Truncate(ctx context.Context, inode *Inode, size int64) error {
+	return ErrIsDirectory
+}
+
+func (_ StandardDirOps) Create(ctx context.Context, dir *Inode, name string, perms int) (*Inode, error) {
+	return nil, ErrReadOnly
+}
+
+func (_ StandardDirOps) CreateDirectory(ctx context.Context, dir *Inode, name string, perms int) error {
+	return ErrReadOnly
+}
+
+func (_ StandardDirOps) CreateLink(ctx context.Context, dir *Inode, target, name string) error {
+	return ErrReadOnly
+}
+
+func (_ StandardDirOps) CreateHardLink(ctx context.Context, dir *Inode, target *Inode, name string) error {
+	return ErrReadOnly
+}
+
+func (_ StandardDirOps) Remove(ctx context.Context, dir *Inode, name string) error {
+	return ErrReadOnly
+}
+
+func (_ StandardDirOps) RemoveDirectory(ctx context.Context, dir *Inode, name string) error {
+	return ErrReadOnly
+}
+
+func (_ StandardDirOps) Rename(ctx context.Context, oldParent *Inode, oldName string, newParent *Inode, newName string) error {
+	return ErrReadOnly
+}
+
+func (_ StandardDirOps) SetPermissions(ctx context.Context, inode *Inode, perms int) error {
+	return ErrReadOnly
+}
+
+func (_ StandardDirOps) SetOwner(ctx context.Context, inode *Inode, uid, gid int) error {
+	return ErrReadOnly
+}
+
+func (_ StandardDirOps) SetTimestamps(ctx context.Context, inode *Inode, atime, mtime linux.Timespec) error {
+	return ErrReadOnly
+}
+
+// StandardFileOps provides the operations of a read-only file that only
+// apply to directories.
 type StandardFileOps struct{}
 
 func (_ StandardFileOps) LookupChild(ctx context.Context, inode *Inode, name string) (*Inode, error) {
@@ -24,3 +78,51 @@ func (_ StandardFileOps) LookupChild(ctx context.Context, inode *Inode, name str
 func (_ StandardFileOps) ReadDir(ctx context.Context, inode *Inode, offset int, emit ReadDirEmit) error {
 	return ErrNotImplemented
 }
+
+func (_ StandardFileOps) Writer(inode *Inode) (io.WriteSeeker, error) {
+	return nil, ErrReadOnly
+}
+
+func (_ StandardFileOps) Truncate(ctx context.Context, inode *Inode, size int64) error {
+	return ErrReadOnly
+}
+
+func (_ StandardFileOps) Create(ctx context.Context, dir *Inode, name string, perms int) (*Inode, error) {
+	return nil, ErrNotDirectory
+}
+
+func (_ StandardFileOps) CreateDirectory(ctx context.Context, dir *Inode, name string, perms int) error {
+	return ErrNotDirectory
+}
+
+func (_ StandardFileOps) CreateLink(ctx context.Context, dir *Inode, target, name string) error {
+	return ErrNotDirectory
+}
+
+func (_ StandardFileOps) CreateHardLink(ctx context.Context, dir *Inode, target *Inode, name string) error {
+	return ErrNotDirectory
+}
+
+func (_ StandardFileOps) Remove(ctx context.Context, dir *Inode, name string) error {
+	return ErrNotDirectory
+}
+
+func (_ StandardFileOps) RemoveDirectory(ctx context.Context, dir *Inode, name string) error {
+	return ErrNotDirectory
+}
+
+func (_ StandardFileOps) Rename(ctx context.Context, oldParent *Inode, oldName string, newParent *Inode, newName string) error {
+	return ErrNotDirectory
+}
+
+func (_ StandardFileOps) SetPermissions(ctx context.Context, inode *Inode, perms int) error {
+	return ErrReadOnly
+}
+
+func (_ StandardFileOps) SetOwner(ctx context.Context, inode *Inode, uid, gid int) error {
+	return ErrReadOnly
+}
+
+func (_ StandardFileOps) SetTimestamps(ctx context.Context, inode *Inode, atime, mtime linux.Timespec) error {
+	return ErrReadOnly
+}
@@ -0,0 +1,889 @@
+// Package overlay implements a union filesystem that stacks read-only
+// lower layers under an optional writable upper layer, in the style of
+// Linux's overlayfs.
+//
+// Whiteouts use the OCI image layer convention in every layer, including
+// the upper one: a file named ".wh.<name>" hides <name> in the layers below
+// it, and a file named ".wh..wh..opq" in a directory hides the contents of
+// that directory in the layers below it. These marker files are never
+// visible through the overlay.
+package overlay
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/device"
+	"github.com/evanphx/columbia/fs"
+)
+
+const (
+	// WhiteoutPrefix marks a file that hides the named entry below it.
+	WhiteoutPrefix = ".wh."
+
+	// OpaqueWhiteout marks a directory whose lower contents are hidden.
+	OpaqueWhiteout = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+type OverlayFS struct {
+	Device *device.MultiDevice
+	root   *fs.Inode
+}
+
+// NewOverlayFS creates a filesystem combining the directories in lowers,
+// given top-most first, under upper. upper may be nil, in which case the
+// filesystem is read-only.
+func NewOverlayFS(ctx context.Context, upper *fs.Inode, lowers ...*fs.Inode) (*OverlayFS, error) {
+	o := &OverlayFS{
+		Device: device.NewAnonMultiDevice(),
+	}
+
+	var visible []*fs.Inode
+
+	if upper == nil || !isOpaque(ctx, upper) {
+		for _, l := range lowers {
+			visible = append(visible, l)
+
+			if isOpaque(ctx, l) {
+				break
+			}
+		}
+	}
+
+	o.root = o.newInode(nil, "", upper, visible)
+
+	return o, nil
+}
+
+func (o *OverlayFS) Root() (*fs.Inode, error) {
+	return o.root, nil
+}
+
+// Node is an entry in the overlay, tracking the inodes of each layer that
+// contribute to it.
+type Node struct {
+	fs     *OverlayFS
+	parent *Node
+	name   string
+
+	mu sync.Mutex
+
+	// upper is the inode in the upper layer, nil until the node has been
+	// copied up.
+	upper *fs.Inode
+
+	// lowers are the inodes from the lower layers, top-most first. Only
+	// directories have more than one.
+	lowers []*fs.Inode
+}
+
+func (o *OverlayFS) newInode(parent *Node, name string, upper *fs.Inode, lowers []*fs.Inode) *fs.Inode {
+	n := &Node{
+		fs:     o,
+		parent: parent,
+		name:   name,
+		upper:  upper,
+		lowers: lowers,
+	}
+
+	top := upper
+	if top == nil {
+		top = lowers[0]
+	}
+
+	// Base the inode number on the bottom-most layer so it stays the same
+	// when the file is copied up.
+	key := top
+	if len(lowers) > 0 {
+		key = lowers[len(lowers)-1]
+	}
+
+	attr := top.StableAttr
+	attr.DeviceID = o.Device.DeviceID()
+	attr.DeviceFileMajor = uint16(o.Device.Major)
+	attr.DeviceFileMinor = uint32(o.Device.Minor)
+	attr.InodeID = o.Device.Map(device.MultiDeviceKey{
+		Device: key.StableAttr.DeviceID,
+		Inode:  key.StableAttr.InodeID,
+	})
+
+	return fs.NewInode(attr, n)
+}
+
+func isDir(i *fs.Inode) bool {
+	switch i.StableAttr.Type {
+	case fs.Directory, fs.SpecialDirectory:
+		return true
+	default:
+		return false
+	}
+}
+
+func isWhiteoutName(name string) bool {
+	return strings.HasPrefix(name, WhiteoutPrefix)
+}
+
+// lookup returns the child of dir, or nil if there is none.
+func lookup(ctx context.Context, dir *fs.Inode, name string) (*fs.Inode, error) {
+	i, err := dir.Ops.LookupChild(ctx, dir, name)
+	if err != nil {
+		if err == fs.ErrUnknownPath {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return i, nil
+}
+
+func exists(ctx context.Context, dir *fs.Inode, name string) bool {
+	i, err := lookup(ctx, dir, name)
+	return err == nil && i != nil
+}
+
+func hasWhiteout(ctx context.Context, dir *fs.Inode, name string) bool {
+	return exists(ctx, dir, WhiteoutPrefix+name)
+}
+
+func isOpaque(ctx context.Context, dir *fs.Inode) bool {
+	return isDir(dir) && exists(ctx, dir, OpaqueWhiteout)
+}
+
+// upperInode returns the upper inode for n, picking up a copy made through
+// another Node for the same path.
+func (n *Node) upperInode(ctx context.Context) *fs.Inode {
+	n.mu.Lock()
+	upper := n.upper
+	n.mu.Unlock()
+
+	if upper != nil || n.parent == nil {
+		return upper
+	}
+
+	pu := n.parent.upperInode(ctx)
+	if pu == nil {
+		return nil
+	}
+
+	upper, err := lookup(ctx, pu, n.name)
+	if err != nil || upper == nil {
+		return nil
+	}
+
+	n.mu.Lock()
+	n.upper = upper
+	n.mu.Unlock()
+
+	return upper
+}
+
+func (n *Node) top(ctx context.Context) *fs.Inode {
+	if upper := n.upperInode(ctx); upper != nil {
+		return upper
+	}
+
+	return n.lowers[0]
+}
+
+// resolveChild finds the layers that contribute to the child name of n.
+func (n *Node) resolveChild(ctx context.Context, name string) (*fs.Inode, []*fs.Inode, error) {
+	if isWhiteoutName(name) {
+		return nil, nil, fs.ErrUnknownPath
+	}
+
+	var (
+		top    *fs.Inode
+		upper  *fs.Inode
+		lowers []*fs.Inode
+	)
+
+	if pu := n.upperInode(ctx); pu != nil {
+		i, err := lookup(ctx, pu, name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if i != nil {
+			if !isDir(i) || isOpaque(ctx, i) {
+				return i, nil, nil
+			}
+
+			upper = i
+			top = i
+		} else if hasWhiteout(ctx, pu, name) {
+			return nil, nil, fs.ErrUnknownPath
+		}
+	}
+
+	for _, l := range n.lowers {
+		i, err := lookup(ctx, l, name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if i == nil {
+			if hasWhiteout(ctx, l, name) {
+				break
+			}
+
+			continue
+		}
+
+		// A non-directory below a directory is hidden by it.
+		if top != nil && !isDir(i) {
+			break
+		}
+
+		if top == nil {
+			top = i
+		}
+
+		lowers = append(lowers, i)
+
+		if !isDir(i) || isOpaque(ctx, i) {
+			break
+		}
+	}
+
+	if top == nil {
+		return nil, nil, fs.ErrUnknownPath
+	}
+
+	return upper, lowers, nil
+}
+
+func (n *Node) LookupChild(ctx context.Context, inode *fs.Inode, name string) (*fs.Inode, error) {
+	if !isDir(inode) {
+		return nil, fs.ErrNotDirectory
+	}
+
+	upper, lowers, err := n.resolveChild(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.fs.newInode(n, name, upper, lowers), nil
+}
+
+func (n *Node) UnstableAttr(ctx context.Context, inode *fs.Inode) (*fs.InodeUnstableAttr, error) {
+	top := n.top(ctx)
+	return top.Ops.UnstableAttr(ctx, top)
+}
+
+func (n *Node) ReadLink(ctx context.Context, inode *fs.Inode) (string, error) {
+	top := n.top(ctx)
+	return top.Ops.ReadLink(ctx, top)
+}
+
+func (n *Node) Reader(inode *fs.Inode) (io.ReadSeeker, error) {
+	top := n.top(context.Background())
+	return top.Ops.Reader(top)
+}
+
+type collector struct {
+	names []string
+}
+
+func (c *collector) EmitEntry(name string, inode *fs.Inode) bool {
+	c.names = append(c.names, name)
+	return true
+}
+
+// mergedNames returns the visible entries of the directory, ordered by
+// layer from the top down and by the order each layer reports them.
+func (n *Node) mergedNames(ctx context.Context) ([]string, error) {
+	var layers []*fs.Inode
+
+	if upper := n.upperInode(ctx); upper != nil {
+		layers = append(layers, upper)
+	}
+
+	layers = append(layers, n.lowers...)
+
+	var (
+		names  []string
+		seen   = make(map[string]bool)
+		hidden = make(map[string]bool)
+	)
+
+	for _, layer := range layers {
+		var c collector
+
+		err := layer.Ops.ReadDir(ctx, layer, 0, &c)
+		if err != nil {
+			return nil, err
+		}
+
+		var whiteouts []string
+
+		for _, name := range c.names {
+			if name == OpaqueWhiteout {
+				continue
+			}
+
+			if isWhiteoutName(name) {
+				whiteouts = append(whiteouts, name[len(WhiteoutPrefix):])
+				continue
+			}
+
+			if seen[name] || hidden[name] {
+				continue
+			}
+
+			seen[name] = true
+			names = append(names, name)
+		}
+
+		// Whiteouts only hide entries in the layers below.
+		for _, name := range whiteouts {
+			hidden[name] = true
+		}
+	}
+
+	return names, nil
+}
+
+func (n *Node) ReadDir(ctx context.Context, inode *fs.Inode, offset int, emit fs.ReadDirEmit) error {
+	if !isDir(inode) {
+		return fs.ErrNotDirectory
+	}
+
+	names, err := n.mergedNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	if offset >= len(names) {
+		return nil
+	}
+
+	for _, name := range names[offset:] {
+		child, err := n.LookupChild(ctx, inode, name)
+		if err != nil {
+			return err
+		}
+
+		if !emit.EmitEntry(name, child) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// copyUp makes sure n exists in the upper layer, copying its contents and
+// attributes from the top-most lower layer, and returns the upper inode.
+func (n *Node) copyUp(ctx context.Context) (*fs.Inode, error) {
+	if upper := n.upperInode(ctx); upper != nil {
+		return upper, nil
+	}
+
+	if n.parent == nil {
+		return nil, fs.ErrReadOnly
+	}
+
+	pu, err := n.parent.copyUp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lower := n.lowers[0]
+
+	attr, err := lower.Ops.UnstableAttr(ctx, lower)
+	if err != nil {
+		return nil, err
+	}
+
+	switch lower.StableAttr.Type {
+	case fs.Directory, fs.SpecialDirectory:
+		err = pu.Ops.CreateDirectory(ctx, pu, n.name, attr.Perms)
+		if err != nil {
+			return nil, err
+		}
+	case fs.Symlink:
+		target, err := lower.Ops.ReadLink(ctx, lower)
+		if err != nil {
+			return nil, err
+		}
+
+		err = pu.Ops.CreateLink(ctx, pu, target, n.name)
+		if err != nil {
+			return nil, err
+		}
+	case fs.RegularFile, fs.SpecialFile:
+		err = copyFile(ctx, pu, n.name, lower, attr.Perms)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fs.ErrNotImplemented
+	}
+
+	upper, err := lookup(ctx, pu, n.name)
+	if err != nil {
+		return nil, err
+	}
+
+	if upper == nil {
+		return nil, fs.ErrUnknownPath
+	}
+
+	if lower.StableAttr.Type != fs.Symlink {
+		// Ownership and times are kept when the upper layer supports them.
+		upper.Ops.SetOwner(ctx, upper, attr.UserId, attr.GroupId)
+		upper.Ops.SetTimestamps(ctx, upper, attr.AccessTime, attr.ModificationTime)
+	}
+
+	n.mu.Lock()
+	n.upper = upper
+	n.mu.Unlock()
+
+	return upper, nil
+}
+
+// copyFile copies lower into a new file name in dir. A copy that fails
+// partway is removed again, since left behind it would hide the intact
+// lower file.
+func copyFile(ctx context.Context, dir *fs.Inode, name string, lower *fs.Inode, perms int) error {
+	upper, err := dir.Ops.Create(ctx, dir, name, perms)
+	if err != nil {
+		return err
+	}
+
+	err = copyData(upper, lower)
+	if err != nil {
+		dir.Ops.Remove(ctx, dir, name)
+	}
+
+	return err
+}
+
+// copyData copies the contents of lower into upper.
+func copyData(upper, lower *fs.Inode) error {
+	r, err := lower.Ops.Reader(lower)
+	if err != nil {
+		return err
+	}
+
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	w, err := upper.Ops.Writer(upper)
+	if err != nil {
+		return err
+	}
+
+	if c, ok := w.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// dirUpper copies n up so entries can be changed in it.
+func (n *Node) dirUpper(ctx context.Context, inode *fs.Inode) (*fs.Inode, error) {
+	if !isDir(inode) {
+		return nil, fs.ErrNotDirectory
+	}
+
+	return n.copyUp(ctx)
+}
+
+// prepareCreate checks name can be created in n and clears any whiteout
+// for it, returning the upper directory and whether a lower entry was
+// whited out.
+func (n *Node) prepareCreate(ctx context.Context, inode *fs.Inode, name string) (*fs.Inode, bool, error) {
+	if isWhiteoutName(name) {
+		return nil, false, fs.ErrReadOnly
+	}
+
+	_, _, err := n.resolveChild(ctx, name)
+	if err == nil {
+		return nil, false, fs.ErrExists
+	}
+
+	if err != fs.ErrUnknownPath {
+		return nil, false, err
+	}
+
+	pu, err := n.dirUpper(ctx, inode)
+	if err != nil {
+		return nil, false, err
+	}
+
+	whiteout := hasWhiteout(ctx, pu, name)
+	if whiteout {
+		err = pu.Ops.Remove(ctx, pu, WhiteoutPrefix+name)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return pu, whiteout, nil
+}
+
+func (n *Node) Create(ctx context.Context, dir *fs.Inode, name string, perms int) (*fs.Inode, error) {
+	pu, _, err := n.prepareCreate(ctx, dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	upper, err := pu.Ops.Create(ctx, pu, name, perms)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.fs.newInode(n, name, upper, nil), nil
+}
+
+func (n *Node) CreateSocket(ctx context.Context, dir *fs.Inode, name string, perms int) (*fs.Inode, error) {
+	pu, _, err := n.prepareCreate(ctx, dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	sc, ok := pu.Ops.(fs.SocketCreator)
+	if !ok {
+		return nil, fs.ErrNotImplemented
+	}
+
+	upper, err := sc.CreateSocket(ctx, pu, name, perms)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.fs.newInode(n, name, upper, nil), nil
+}
+
+func (n *Node) CreateDirectory(ctx context.Context, dir *fs.Inode, name string, perms int) error {
+	pu, whiteout, err := n.prepareCreate(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+
+	err = pu.Ops.CreateDirectory(ctx, pu, name, perms)
+	if err != nil {
+		return err
+	}
+
+	if !whiteout {
+		return nil
+	}
+
+	// The name was removed from a lower layer, so the new directory must
+	// not show that layer's old contents.
+	upper, err := lookup(ctx, pu, name)
+	if err != nil {
+		return err
+	}
+
+	if upper == nil {
+		return fs.ErrUnknownPath
+	}
+
+	_, err = upper.Ops.Create(ctx, upper, OpaqueWhiteout, 0)
+	return err
+}
+
+func (n *Node) CreateLink(ctx context.Context, dir *fs.Inode, target, name string) error {
+	pu, _, err := n.prepareCreate(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+
+	return pu.Ops.CreateLink(ctx, pu, target, name)
+}
+
+func (n *Node) CreateHardLink(ctx context.Context, dir *fs.Inode, target *fs.Inode, name string) error {
+	tn, ok := target.Ops.(*Node)
+	if !ok || tn.fs != n.fs {
+		return fs.ErrCrossDevice
+	}
+
+	if isDir(target) {
+		return fs.ErrIsDirectory
+	}
+
+	tu, err := tn.copyUp(ctx)
+	if err != nil {
+		return err
+	}
+
+	pu, _, err := n.prepareCreate(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+
+	return pu.Ops.CreateHardLink(ctx, pu, tu, name)
+}
+
+// removeEntry removes the upper copy of name, if any, and whites it out
+// if a lower layer still provides it.
+func (n *Node) removeEntry(ctx context.Context, pu *fs.Inode, name string, upper *fs.Inode, lowers []*fs.Inode) error {
+	if upper != nil {
+		var err error
+
+		if isDir(upper) {
+			err = clearMarkers(ctx, upper)
+			if err == nil {
+				err = pu.Ops.RemoveDirectory(ctx, pu, name)
+			}
+		} else {
+			err = pu.Ops.Remove(ctx, pu, name)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(lowers) == 0 {
+		return nil
+	}
+
+	_, err := pu.Ops.Create(ctx, pu, WhiteoutPrefix+name, 0)
+	return err
+}
+
+// clearMarkers removes the whiteouts inside an upper directory that is
+// about to be removed.
+func clearMarkers(ctx context.Context, dir *fs.Inode) error {
+	var c collector
+
+	err := dir.Ops.ReadDir(ctx, dir, 0, &c)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range c.names {
+		if !isWhiteoutName(name) {
+			return fs.ErrNotEmpty
+		}
+	}
+
+	for _, name := range c.names {
+		err = dir.Ops.Remove(ctx, dir, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (n *Node) Remove(ctx context.Context, dir *fs.Inode, name string) error {
+	upper, lowers, err := n.resolveChild(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	child := n.fs.newInode(n, name, upper, lowers)
+	if isDir(child) {
+		return fs.ErrIsDirectory
+	}
+
+	pu, err := n.dirUpper(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	return n.removeEntry(ctx, pu, name, upper, lowers)
+}
+
+func (n *Node) RemoveDirectory(ctx context.Context, dir *fs.Inode, name string) error {
+	upper, lowers, err := n.resolveChild(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	child := n.fs.newInode(n, name, upper, lowers)
+	if !isDir(child) {
+		return fs.ErrNotDirectory
+	}
+
+	names, err := child.Ops.(*Node).mergedNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(names) != 0 {
+		return fs.ErrNotEmpty
+	}
+
+	pu, err := n.dirUpper(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	return n.removeEntry(ctx, pu, name, upper, lowers)
+}
+
+func (n *Node) Rename(ctx context.Context, oldParent *fs.Inode, oldName string, newParent *fs.Inode, newName string) error {
+	np, ok := newParent.Ops.(*Node)
+	if !ok || np.fs != n.fs {
+		return fs.ErrCrossDevice
+	}
+
+	upper, lowers, err := n.resolveChild(ctx, oldName)
+	if err != nil {
+		return err
+	}
+
+	src := n.fs.newInode(n, oldName, upper, lowers)
+
+	// Like overlayfs without redirect_dir, directories that exist in a
+	// lower layer can't be moved.
+	if isDir(src) && len(lowers) != 0 {
+		return fs.ErrCrossDevice
+	}
+
+	srcUpper, err := src.Ops.(*Node).copyUp(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Replacing the destination has to leave a whiteout behind if a lower
+	// layer provides it, which the rename then lands on top of.
+	dstUpper, dstLowers, err := np.resolveChild(ctx, newName)
+	switch err {
+	case nil:
+		dst := n.fs.newInode(np, newName, dstUpper, dstLowers)
+		if isDir(dst) != isDir(src) {
+			if isDir(dst) {
+				return fs.ErrIsDirectory
+			}
+
+			return fs.ErrNotDirectory
+		}
+
+		if isDir(dst) {
+			names, err := dst.Ops.(*Node).mergedNames(ctx)
+			if err != nil {
+				return err
+			}
+
+			if len(names) != 0 {
+				return fs.ErrNotEmpty
+			}
+		}
+	case fs.ErrUnknownPath:
+		// ok
+	default:
+		return err
+	}
+
+	pu, err := n.dirUpper(ctx, oldParent)
+	if err != nil {
+		return err
+	}
+
+	npu, err := np.dirUpper(ctx, newParent)
+	if err != nil {
+		return err
+	}
+
+	whiteout := hasWhiteout(ctx, npu, newName)
+
+	if dstUpper != nil && isDir(dstUpper) {
+		err = clearMarkers(ctx, dstUpper)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = pu.Ops.Rename(ctx, pu, oldName, npu, newName)
+	if err != nil {
+		return err
+	}
+
+	if isDir(srcUpper) && (len(dstLowers) != 0 || whiteout) {
+		// The moved directory must hide the contents of a lower directory
+		// it replaced or that was removed from under the name, as
+		// CreateDirectory does.
+		moved, err := lookup(ctx, npu, newName)
+		if err != nil {
+			return err
+		}
+
+		if moved != nil && !isOpaque(ctx, moved) {
+			_, err = moved.Ops.Create(ctx, moved, OpaqueWhiteout, 0)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Only now that the moved entry hides it can the whiteout go.
+	if whiteout {
+		err = npu.Ops.Remove(ctx, npu, WhiteoutPrefix+newName)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(lowers) != 0 {
+		_, err = pu.Ops.Create(ctx, pu, WhiteoutPrefix+oldName, 0)
+		return err
+	}
+
+	return nil
+}
+
+func (n *Node) Writer(inode *fs.Inode) (io.WriteSeeker, error) {
+	if isDir(inode) {
+		return nil, fs.ErrIsDirectory
+	}
+
+	upper, err := n.copyUp(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return upper.Ops.Writer(upper)
+}
+
+func (n *Node) Truncate(ctx context.Context, inode *fs.Inode, size int64) error {
+	if isDir(inode) {
+		return fs.ErrIsDirectory
+	}
+
+	upper, err := n.copyUp(ctx)
+	if err != nil {
+		return err
+	}
+
+	return upper.Ops.Truncate(ctx, upper, size)
+}
+
+func (n *Node) SetPermissions(ctx context.Context, inode *fs.Inode, perms int) error {
+	upper, err := n.copyUp(ctx)
+	if err != nil {
+		return err
+	}
+
+	return upper.Ops.SetPermissions(ctx, upper, perms)
+}
+
+func (n *Node) SetOwner(ctx context.Context, inode *fs.Inode, uid, gid int) error {
+	upper, err := n.copyUp(ctx)
+	if err != nil {
+		return err
+	}
+
+	return upper.Ops.SetOwner(ctx, upper, uid, gid)
+}
+
+func (n *Node) SetTimestamps(ctx context.Context, inode *fs.Inode, atime, mtime linux.Timespec) error {
+	upper, err := n.copyUp(ctx)
+	if err != nil {
+		return err
+	}
+
+	return upper.Ops.SetTimestamps(ctx, upper, atime, mtime)
+}
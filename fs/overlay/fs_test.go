@@ -0,0 +1,284 @@
+package overlay
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/host"
+	"github.com/evanphx/columbia/fs/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func layer(t *testing.T, files map[string]string) *fs.Inode {
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+
+	for name, body := range files {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(body)),
+			Typeflag: tar.TypeReg,
+		}
+
+		if name[len(name)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		}
+
+		require.NoError(t, tw.WriteHeader(hdr))
+
+		_, err := tw.Write([]byte(body))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.Close())
+
+	tf, err := tarfs.NewTarFS(&buf)
+	require.NoError(t, err)
+
+	root, err := tf.Root()
+	require.NoError(t, err)
+
+	return root
+}
+
+type names struct {
+	list []string
+}
+
+func (n *names) EmitEntry(name string, inode *fs.Inode) bool {
+	n.list = append(n.list, name)
+	return true
+}
+
+func readDir(t *testing.T, m *fs.MountNamespace, path string) []string {
+	ctx := context.Background()
+
+	dirent, err := m.LookupPath(ctx, path)
+	require.NoError(t, err)
+
+	var n names
+
+	require.NoError(t, dirent.Inode.Ops.ReadDir(ctx, dirent.Inode, 0, &n))
+
+	return n.list
+}
+
+func read(t *testing.T, m *fs.MountNamespace, path string) string {
+	dirent, err := m.LookupPath(context.Background(), path)
+	require.NoError(t, err)
+
+	r, err := dirent.Reader()
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	if c, ok := r.(interface{ Close() error }); ok {
+		c.Close()
+	}
+
+	return string(data)
+}
+
+func setup(t *testing.T, lowers ...*fs.Inode) (*fs.MountNamespace, string) {
+	dir, err := ioutil.TempDir("", "overlay")
+	require.NoError(t, err)
+
+	hf, err := host.NewHostFS(dir)
+	require.NoError(t, err)
+
+	upper, err := hf.Root()
+	require.NoError(t, err)
+
+	o, err := NewOverlayFS(context.Background(), upper, lowers...)
+	require.NoError(t, err)
+
+	root, err := o.Root()
+	require.NoError(t, err)
+
+	m := fs.NewMountNamespace()
+	m.SetRoot(root)
+
+	return m, dir
+}
+
+func TestOverlay(t *testing.T) {
+	ctx := context.Background()
+
+	bottom := layer(t, map[string]string{
+		"etc/":        "",
+		"etc/passwd":  "bottom",
+		"etc/group":   "bottom",
+		"var/":        "",
+		"var/cache/":  "",
+		"var/cache/a": "a",
+		"var/cache/b": "b",
+	})
+
+	top := layer(t, map[string]string{
+		"etc/":                   "",
+		"etc/passwd":             "top",
+		"etc/hosts":              "top",
+		"etc/.wh.group":          "",
+		"var/":                   "",
+		"var/cache/":             "",
+		"var/cache/.wh..wh..opq": "",
+		"var/cache/c":            "c",
+	})
+
+	t.Run("merges layers honoring whiteouts", func(t *testing.T) {
+		m, dir := setup(t, top, bottom)
+		defer os.RemoveAll(dir)
+
+		require.Equal(t, "top", read(t, m, "/etc/passwd"))
+		require.Equal(t, "top", read(t, m, "/etc/hosts"))
+
+		_, err := m.LookupPath(ctx, "/etc/group")
+		require.Equal(t, fs.ErrUnknownPath, err)
+
+		_, err = m.LookupPath(ctx, "/etc/.wh.group")
+		require.Equal(t, fs.ErrUnknownPath, err)
+
+		require.ElementsMatch(t, []string{"passwd", "hosts"}, readDir(t, m, "/etc"))
+		require.Equal(t, []string{"c"}, readDir(t, m, "/var/cache"))
+	})
+
+	t.Run("copies up on write", func(t *testing.T) {
+		m, dir := setup(t, top, bottom)
+		defer os.RemoveAll(dir)
+
+		dirent, err := m.LookupPath(ctx, "/etc/passwd")
+		require.NoError(t, err)
+
+		w, err := dirent.Inode.Ops.Writer(dirent.Inode)
+		require.NoError(t, err)
+
+		_, err = w.Write([]byte("new"))
+		require.NoError(t, err)
+
+		w.(interface{ Close() error }).Close()
+
+		require.Equal(t, "new", read(t, m, "/etc/passwd"))
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "etc", "passwd"))
+		require.NoError(t, err)
+		require.Equal(t, "new", string(data))
+	})
+
+	t.Run("whites out removed lower entries", func(t *testing.T) {
+		m, dir := setup(t, top, bottom)
+		defer os.RemoveAll(dir)
+
+		etc, err := m.LookupPath(ctx, "/etc")
+		require.NoError(t, err)
+
+		require.NoError(t, etc.Inode.Ops.Remove(ctx, etc.Inode, "hosts"))
+
+		_, err = etc.Inode.Ops.LookupChild(ctx, etc.Inode, "hosts")
+		require.Equal(t, fs.ErrUnknownPath, err)
+
+		require.Equal(t, []string{"passwd"}, readDir(t, m, "/etc"))
+
+		_, err = os.Stat(filepath.Join(dir, "etc", ".wh.hosts"))
+		require.NoError(t, err)
+
+		_, err = etc.Inode.Ops.Create(ctx, etc.Inode, "hosts", 0644)
+		require.NoError(t, err)
+
+		require.Equal(t, "", read(t, m, "/etc/hosts"))
+	})
+
+	t.Run("makes recreated directories opaque", func(t *testing.T) {
+		m, dir := setup(t, top, bottom)
+		defer os.RemoveAll(dir)
+
+		root, err := m.LookupPath(ctx, "/")
+		require.NoError(t, err)
+
+		etc, err := m.LookupPath(ctx, "/etc")
+		require.NoError(t, err)
+
+		for _, name := range readDir(t, m, "/etc") {
+			require.NoError(t, etc.Inode.Ops.Remove(ctx, etc.Inode, name))
+		}
+
+		require.NoError(t, root.Inode.Ops.RemoveDirectory(ctx, root.Inode, "etc"))
+		require.NoError(t, root.Inode.Ops.CreateDirectory(ctx, root.Inode, "etc", 0755))
+
+		inode, err := root.Inode.Ops.LookupChild(ctx, root.Inode, "etc")
+		require.NoError(t, err)
+
+		var n names
+		require.NoError(t, inode.Ops.ReadDir(ctx, inode, 0, &n))
+		require.Empty(t, n.list)
+	})
+
+	t.Run("makes directories moved over removed ones opaque", func(t *testing.T) {
+		m, dir := setup(t, top, bottom)
+		defer os.RemoveAll(dir)
+
+		root, err := m.LookupPath(ctx, "/")
+		require.NoError(t, err)
+
+		etc, err := m.LookupPath(ctx, "/etc")
+		require.NoError(t, err)
+
+		for _, name := range readDir(t, m, "/etc") {
+			require.NoError(t, etc.Inode.Ops.Remove(ctx, etc.Inode, name))
+		}
+
+		require.NoError(t, root.Inode.Ops.RemoveDirectory(ctx, root.Inode, "etc"))
+		require.NoError(t, root.Inode.Ops.CreateDirectory(ctx, root.Inode, "fresh", 0755))
+
+		fresh, err := root.Inode.Ops.LookupChild(ctx, root.Inode, "fresh")
+		require.NoError(t, err)
+
+		_, err = fresh.Ops.Create(ctx, fresh, "x", 0644)
+		require.NoError(t, err)
+
+		require.NoError(t, root.Inode.Ops.Rename(ctx, root.Inode, "fresh", root.Inode, "etc"))
+
+		inode, err := root.Inode.Ops.LookupChild(ctx, root.Inode, "etc")
+		require.NoError(t, err)
+
+		var n names
+		require.NoError(t, inode.Ops.ReadDir(ctx, inode, 0, &n))
+		require.Equal(t, []string{"x"}, n.list)
+
+		_, err = os.Stat(filepath.Join(dir, ".wh.etc"))
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("refuses to remove non-empty directories", func(t *testing.T) {
+		m, dir := setup(t, top, bottom)
+		defer os.RemoveAll(dir)
+
+		root, err := m.LookupPath(ctx, "/")
+		require.NoError(t, err)
+
+		require.Equal(t, fs.ErrNotEmpty, root.Inode.Ops.RemoveDirectory(ctx, root.Inode, "var"))
+	})
+
+	t.Run("is read-only without an upper layer", func(t *testing.T) {
+		o, err := NewOverlayFS(ctx, nil, top, bottom)
+		require.NoError(t, err)
+
+		root, err := o.Root()
+		require.NoError(t, err)
+
+		etc, err := root.Ops.LookupChild(ctx, root, "etc")
+		require.NoError(t, err)
+
+		_, err = etc.Ops.Create(ctx, etc, "new", 0644)
+		require.Equal(t, fs.ErrReadOnly, err)
+	})
+}
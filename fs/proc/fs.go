@@ -0,0 +1,253 @@
+// Package proc implements procfs, generated from the processes of a
+// kernel. Nothing is stored: directories are listed and files are
+// generated when they're read, so they always show the current state.
+package proc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/device"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/pkg/errors"
+)
+
+var ErrNoKernel = errors.New("procfs needs a running process")
+
+func init() {
+	fs.RegisterFilesystem("proc", func(ctx context.Context, source, data string) (*fs.Inode, error) {
+		task, ok := kernel.GetTask(ctx)
+		if !ok {
+			return nil, ErrNoKernel
+		}
+
+		return NewProcFS(task.Kernel).Root()
+	})
+}
+
+type ProcFS struct {
+	Device *device.Device
+	kernel *kernel.Kernel
+	root   *fs.Inode
+}
+
+// NewProcFS creates a procfs showing the processes of k.
+func NewProcFS(k *kernel.Kernel) *ProcFS {
+	p := &ProcFS{
+		Device: device.NewAnonDevice(),
+		kernel: k,
+	}
+
+	p.root = p.newRoot()
+
+	return p
+}
+
+func (p *ProcFS) Root() (*fs.Inode, error) {
+	return p.root, nil
+}
+
+// Inodes are made afresh on every lookup, so their numbers are worked out
+// from what they show rather than handed out, and the same entry always
+// gets the same one. The root is rootIno with its entries after it, and
+// each process has the numbers with its pid in the upper half, which its
+// directory's entries and open files are numbered within.
+const (
+	rootIno = 1
+
+	// fdSlot is where the numbers of a process's open files start, past
+	// those of its directory's entries.
+	fdSlot = 1 << 16
+)
+
+// processIno returns the number of the inode in slot of pid's range.
+func processIno(pid int, slot uint64) uint64 {
+	return uint64(pid)<<32 | slot
+}
+
+func (p *ProcFS) newInode(ino uint64, typ fs.InodeType, ops fs.InodeOps) *fs.Inode {
+	return fs.NewInode(fs.InodeStableAttr{
+		Type:            typ,
+		DeviceID:        p.Device.DeviceID(),
+		InodeID:         ino,
+		BlockSize:       4096,
+		DeviceFileMajor: uint16(p.Device.Major),
+		DeviceFileMinor: uint32(p.Device.Minor),
+	}, ops)
+}
+
+// node holds the attributes common to every kind of inode.
+type node struct {
+	perms int
+
+	// proc owns the inode, which is owned by root when it's nil.
+	proc *kernel.Process
+
+	created linux.Timespec
+}
+
+func newNode(perms int, proc *kernel.Process) node {
+	return node{
+		perms:   perms,
+		proc:    proc,
+		created: linux.TimeToTimespec(time.Now()),
+	}
+}
+
+func (n *node) UnstableAttr(ctx context.Context, inode *fs.Inode) (*fs.InodeUnstableAttr, error) {
+	attr := &fs.InodeUnstableAttr{
+		Perms:            n.perms,
+		AccessTime:       n.created,
+		ModificationTime: n.created,
+		StatusChangeTime: n.created,
+		Links:            1,
+	}
+
+	if n.proc != nil {
+		attr.UserId, attr.GroupId = n.proc.User()
+	}
+
+	return attr, nil
+}
+
+// dir is a directory whose entries are listed afresh every time.
+type dir struct {
+	fs.StandardDirOps
+	node
+
+	// list returns the names of the entries, in order.
+	list func() []string
+
+	// lookup returns the inode of an entry, or fs.ErrUnknownPath.
+	lookup func(name string) (*fs.Inode, error)
+}
+
+func (p *ProcFS) newDir(ino uint64, n node, list func() []string, lookup func(name string) (*fs.Inode, error)) *fs.Inode {
+	return p.newInode(ino, fs.SpecialDirectory, &dir{node: n, list: list, lookup: lookup})
+}
+
+// newStaticDir returns a directory with a fixed set of entries, created by
+// the functions in entries whenever they're looked up. Each is given the
+// number after ino that its place in the directory gives it.
+func (p *ProcFS) newStaticDir(ino uint64, n node, entries map[string]func(ino uint64) *fs.Inode) *fs.Inode {
+	names := sortedKeys(entries)
+
+	return p.newDir(ino, n,
+		func() []string {
+			return names
+		},
+		func(name string) (*fs.Inode, error) {
+			return lookupStatic(ino, names, entries, name)
+		})
+}
+
+// lookupStatic creates the entry name of a directory numbered ino, whose
+// fixed entries are names, or returns fs.ErrUnknownPath if it's not one.
+func lookupStatic(ino uint64, names []string, entries map[string]func(ino uint64) *fs.Inode, name string) (*fs.Inode, error) {
+	i := sort.SearchStrings(names, name)
+	if i == len(names) || names[i] != name {
+		return nil, fs.ErrUnknownPath
+	}
+
+	return entries[name](ino + 1 + uint64(i)), nil
+}
+
+func sortedKeys(entries map[string]func(ino uint64) *fs.Inode) []string {
+	var names []string
+
+	for name := range entries {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (d *dir) LookupChild(ctx context.Context, inode *fs.Inode, name string) (*fs.Inode, error) {
+	return d.lookup(name)
+}
+
+func (d *dir) ReadDir(ctx context.Context, inode *fs.Inode, offset int, emit fs.ReadDirEmit) error {
+	names := d.list()
+
+	if offset >= len(names) {
+		return nil
+	}
+
+	for _, name := range names[offset:] {
+		child, err := d.lookup(name)
+		if err != nil {
+			// Gone since it was listed, like an exited process.
+			if err == fs.ErrUnknownPath {
+				continue
+			}
+
+			return err
+		}
+
+		if !emit.EmitEntry(name, child) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// file is a read-only file whose contents are generated when it's opened.
+type file struct {
+	fs.StandardFileOps
+	node
+
+	generate func() ([]byte, error)
+}
+
+func (p *ProcFS) newFile(ino uint64, n node, generate func() ([]byte, error)) *fs.Inode {
+	return p.newInode(ino, fs.SpecialFile, &file{node: n, generate: generate})
+}
+
+func (f *file) ReadLink(ctx context.Context, inode *fs.Inode) (string, error) {
+	return "", fs.ErrNotSymlink
+}
+
+func (f *file) Reader(inode *fs.Inode) (io.ReadSeeker, error) {
+	data, err := f.generate()
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// symlink is a symlink whose target is worked out when it's read, which
+// may depend on the task reading it.
+type symlink struct {
+	fs.StandardFileOps
+	node
+
+	target func(ctx context.Context) (string, error)
+}
+
+func (p *ProcFS) newSymlink(ino uint64, n node, target func(ctx context.Context) (string, error)) *fs.Inode {
+	return p.newInode(ino, fs.Symlink, &symlink{node: n, target: target})
+}
+
+func (s *symlink) ReadLink(ctx context.Context, inode *fs.Inode) (string, error) {
+	return s.target(ctx)
+}
+
+func (s *symlink) Reader(inode *fs.Inode) (io.ReadSeeker, error) {
+	return nil, fs.ErrNotImplemented
+}
+
+// staticTarget returns a symlink target function for a fixed target.
+func staticTarget(target string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		return target, nil
+	}
+}
@@ -0,0 +1,207 @@
+package proc_test
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/proc"
+	"github.com/evanphx/columbia/fs/tmpfs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/memory"
+	"github.com/evanphx/columbia/tty"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type names struct {
+	list []string
+}
+
+func (n *names) EmitEntry(name string, inode *fs.Inode) bool {
+	n.list = append(n.list, name)
+	return true
+}
+
+func TestProcFS(t *testing.T) {
+	k, err := kernel.NewKernel(nil)
+	require.NoError(t, err)
+
+	root, err := tmpfs.NewTmpFS(tmpfs.Options{}).Root()
+	require.NoError(t, err)
+
+	m := fs.NewMountNamespace()
+	m.SetRoot(root)
+
+	ctx := context.Background()
+
+	require.NoError(t, root.Ops.CreateDirectory(ctx, root, "proc", 0555))
+
+	init := k.NewProcess("/")
+	init.Mount = m
+	init.SetUser(1000, 1000)
+	init.SetProgram("/bin/sh", []string{"sh", "-c", "true"}, []string{"HOME=/root", "TERM=xterm"})
+
+	init.Mem = memory.NewVirtualMemory()
+	_, err = init.Mem.NewHeap(2, -1)
+	require.NoError(t, err)
+
+	other := k.NewProcess("/tmp")
+	other.Mount = m
+
+	ctx = kernel.SetTask(ctx, &kernel.Task{Process: init})
+
+	procfs, err := proc.NewProcFS(k).Root()
+	require.NoError(t, err)
+
+	require.NoError(t, m.Mount(ctx, "/proc", &fs.Mount{Root: procfs, Source: "proc", Type: "proc"}))
+
+	read := func(t *testing.T, path string) string {
+		dirent, err := m.LookupPath(ctx, path)
+		require.NoError(t, err)
+		require.Equal(t, fs.SpecialFile, dirent.Inode.StableAttr.Type)
+
+		r, err := dirent.Reader()
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+
+		return string(data)
+	}
+
+	readLink := func(t *testing.T, path string) string {
+		dirent, err := m.LookupDirent(ctx, path)
+		require.NoError(t, err)
+
+		target, err := dirent.Inode.Ops.ReadLink(ctx, dirent.Inode)
+		require.NoError(t, err)
+
+		return target
+	}
+
+	t.Run("lists processes", func(t *testing.T) {
+		dirent, err := m.LookupPath(ctx, "/proc")
+		require.NoError(t, err)
+		require.Equal(t, fs.SpecialDirectory, dirent.Inode.StableAttr.Type)
+
+		var n names
+		require.NoError(t, dirent.Inode.Ops.ReadDir(ctx, dirent.Inode, 0, &n))
+		require.Equal(t, []string{"meminfo", "mounts", "self", "uptime", "1", "2"}, n.list)
+
+		_, err = m.LookupPath(ctx, "/proc/3")
+		require.Equal(t, fs.ErrUnknownPath, errors.Cause(err))
+	})
+
+	t.Run("points self at the reading task", func(t *testing.T) {
+		require.Equal(t, "1", readLink(t, "/proc/self"))
+		require.Equal(t, "sh\x00-c\x00true\x00", read(t, "/proc/self/cmdline"))
+		require.Equal(t, "HOME=/root\x00TERM=xterm\x00", read(t, "/proc/1/environ"))
+	})
+
+	t.Run("describes processes", func(t *testing.T) {
+		status := read(t, "/proc/1/status")
+		require.Contains(t, status, "Name:\tsh\n")
+		require.Contains(t, status, "Pid:\t1\n")
+		require.Contains(t, status, "Uid:\t1000\t1000\t1000\t1000\n")
+		require.Contains(t, status, "VmSize:\t     128 kB\n")
+
+		require.Equal(t, "         0          0 4294967295\n", read(t, "/proc/1/uid_map"))
+
+		stat := strings.Fields(read(t, "/proc/1/stat"))
+		require.Len(t, stat, 52)
+		require.Equal(t, []string{"1", "(sh)", "R", "0"}, stat[:4])
+		require.Equal(t, "131072", stat[22])
+
+		require.Equal(t, "00000000-00020000 rw-p 00000000 00:00 0 [heap]\n", read(t, "/proc/1/maps"))
+
+		dirent, err := m.LookupPath(ctx, "/proc/1/status")
+		require.NoError(t, err)
+
+		attr, err := dirent.Inode.Ops.UnstableAttr(ctx, dirent.Inode)
+		require.NoError(t, err)
+		require.Equal(t, 1000, attr.UserId)
+		require.Equal(t, 0444, attr.Perms)
+	})
+
+	t.Run("reports the session and its terminal", func(t *testing.T) {
+		require.Equal(t, []string{"1", "1", "0", "-1"}, strings.Fields(read(t, "/proc/1/stat"))[4:8])
+
+		require.NoError(t, init.SetControllingTerminal(tty.New(nil, 3, nil), false))
+
+		require.Equal(t, []string{"1", "1", "34819", "1"}, strings.Fields(read(t, "/proc/1/stat"))[4:8])
+	})
+
+	t.Run("links cwd, exe and open files", func(t *testing.T) {
+		require.Equal(t, "/tmp", readLink(t, "/proc/2/cwd"))
+		require.Equal(t, "/bin/sh", readLink(t, "/proc/1/exe"))
+
+		fd, err := init.OpenFile(ctx, "/file", linux.O_CREAT|linux.O_RDWR, 0644)
+		require.NoError(t, err)
+
+		require.Equal(t, "/file", readLink(t, "/proc/self/fd/0"))
+
+		file, err := m.LookupPath(ctx, "/file")
+		require.NoError(t, err)
+
+		viaFD, err := m.LookupPath(ctx, "/proc/1/fd/0")
+		require.NoError(t, err)
+		require.Equal(t, file.Inode, viaFD.Inode)
+
+		_, err = m.LookupDirent(ctx, "/proc/1/fd/0")
+		require.NoError(t, err)
+
+		require.NoError(t, init.CloseFile(fd))
+
+		_, err = m.LookupDirent(ctx, "/proc/1/fd/0")
+		require.Equal(t, fs.ErrUnknownPath, errors.Cause(err))
+	})
+
+	t.Run("keeps inode numbers across lookups", func(t *testing.T) {
+		ino := func(t *testing.T, names ...string) uint64 {
+			inode := procfs
+
+			for _, name := range names {
+				var err error
+
+				inode, err = inode.Ops.LookupChild(ctx, inode, name)
+				require.NoError(t, err)
+			}
+
+			return inode.StableAttr.InodeID
+		}
+
+		seen := map[uint64]string{}
+
+		for _, path := range [][]string{{}, {"self"}, {"uptime"}, {"1"}, {"2"}, {"1", "stat"}, {"1", "fd"}, {"2", "stat"}} {
+			n := ino(t, path...)
+			require.Equal(t, n, ino(t, path...), "%v", path)
+
+			other, ok := seen[n]
+			require.False(t, ok, "%v and %s share %d", path, other, n)
+
+			seen[n] = strings.Join(path, "/")
+		}
+	})
+
+	t.Run("reports the system", func(t *testing.T) {
+		require.Equal(t, "none / rootfs rw 0 0\nproc /proc proc rw 0 0\n", read(t, "/proc/mounts"))
+		require.Contains(t, read(t, "/proc/meminfo"), "MemTotal:        2097088 kB\n")
+		require.Regexp(t, `^\d+\.\d\d 0\.00\n$`, read(t, "/proc/uptime"))
+	})
+
+	t.Run("mounts through mount(2)", func(t *testing.T) {
+		newFS, err := fs.FindFilesystem("proc")
+		require.NoError(t, err)
+
+		root, err := newFS(ctx, "proc", "")
+		require.NoError(t, err)
+		require.Equal(t, fs.SpecialDirectory, root.StableAttr.Type)
+
+		_, err = newFS(context.Background(), "proc", "")
+		require.Equal(t, proc.ErrNoKernel, err)
+	})
+}
@@ -0,0 +1,351 @@
+package proc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+)
+
+// clockTicks is the USER_HZ that times in stat are given in.
+const clockTicks = 100
+
+// newProcessDir returns /proc/[pid] for proc.
+func (p *ProcFS) newProcessDir(proc *kernel.Process) *fs.Inode {
+	file := func(perms int, generate func(proc *kernel.Process) ([]byte, error)) func(ino uint64) *fs.Inode {
+		return func(ino uint64) *fs.Inode {
+			return p.newFile(ino, newNode(perms, proc), func() ([]byte, error) {
+				return generate(proc)
+			})
+		}
+	}
+
+	return p.newStaticDir(processIno(proc.Pid, 0), newNode(0555, proc), map[string]func(ino uint64) *fs.Inode{
+		"cmdline": file(0444, cmdline),
+		"environ": file(0400, environ),
+		"maps":    file(0444, maps),
+		"mounts":  file(0444, mounts),
+		"stat":    file(0444, p.stat),
+		"status":  file(0444, status),
+		"uid_map": file(0444, p.uidMap),
+		"gid_map": file(0444, p.gidMap),
+		"cwd": func(ino uint64) *fs.Inode {
+			return p.newSymlink(ino, newNode(0777, proc), func(ctx context.Context) (string, error) {
+				return proc.Curwd(), nil
+			})
+		},
+		"exe": func(ino uint64) *fs.Inode {
+			return p.newSymlink(ino, newNode(0777, proc), func(ctx context.Context) (string, error) {
+				return proc.Exe(), nil
+			})
+		},
+		"fd": func(ino uint64) *fs.Inode {
+			return p.newFDDir(ino, proc)
+		},
+	})
+}
+
+// newFDDir returns /proc/[pid]/fd, which has a symlink to each open file
+// named by its descriptor.
+func (p *ProcFS) newFDDir(ino uint64, proc *kernel.Process) *fs.Inode {
+	return p.newDir(ino, newNode(0500, proc),
+		func() []string {
+			var names []string
+
+			for fd, f := range proc.Files() {
+				if f != nil {
+					names = append(names, strconv.Itoa(fd))
+				}
+			}
+
+			return names
+		},
+		func(name string) (*fs.Inode, error) {
+			fd, err := strconv.Atoi(name)
+			if err != nil {
+				return nil, fs.ErrUnknownPath
+			}
+
+			f, ok := proc.GetFile(fd)
+			if !ok {
+				return nil, fs.ErrUnknownPath
+			}
+
+			return p.newInode(processIno(proc.Pid, fdSlot+uint64(fd)), fs.Symlink, &fdLink{
+				symlink: symlink{
+					node: newNode(0700, proc),
+					target: func(ctx context.Context) (string, error) {
+						return fileName(f), nil
+					},
+				},
+				file: f,
+			}), nil
+		})
+}
+
+// fdLink is a symlink in /proc/[pid]/fd. Following it leads to the open
+// file itself, so even files without a path, like pipes, can be reopened.
+type fdLink struct {
+	symlink
+
+	file *kernel.File
+}
+
+func (l *fdLink) Follow(ctx context.Context, inode *fs.Inode) (*fs.Dirent, error) {
+	if l.file.Dirent == nil {
+		return nil, fs.ErrNoDevice
+	}
+
+	return l.file.Dirent, nil
+}
+
+// fileName is what /proc/[pid]/fd shows an open file as.
+func fileName(f *kernel.File) string {
+	switch {
+	case f.Dirent == nil:
+		return "anon_inode:[unknown]"
+	case f.Dirent.Parent == nil && f.Dirent.Name != "":
+		// Outside of the namespace, like a pipe.
+		return f.Dirent.Name
+	}
+
+	return f.Dirent.Path()
+}
+
+// nulSeparated joins strs the way the kernel lays out argv and envp.
+func nulSeparated(strs []string) []byte {
+	var buf bytes.Buffer
+
+	for _, str := range strs {
+		buf.WriteString(str)
+		buf.WriteByte(0)
+	}
+
+	return buf.Bytes()
+}
+
+func cmdline(proc *kernel.Process) ([]byte, error) {
+	return nulSeparated(proc.Args()), nil
+}
+
+func environ(proc *kernel.Process) ([]byte, error) {
+	return nulSeparated(proc.Environ()), nil
+}
+
+// comm is the name of the process, as the kernel truncates it.
+func comm(proc *kernel.Process) string {
+	name := path.Base(proc.Exe())
+	if name == "." || name == "/" {
+		return ""
+	}
+
+	if len(name) > 15 {
+		name = name[:15]
+	}
+
+	return name
+}
+
+func state(proc *kernel.Process) (byte, string) {
+	if proc.Status() == kernel.Dead {
+		return 'Z', "zombie"
+	}
+
+	return 'R', "running"
+}
+
+func ppid(proc *kernel.Process) int {
+	if parent := proc.Parent(); parent != nil {
+		return parent.Pid
+	}
+
+	return 0
+}
+
+// memUsage returns the virtual and resident size of proc in bytes.
+func memUsage(proc *kernel.Process) (int64, int64) {
+	if proc.Mem == nil || proc.Status() == kernel.Dead {
+		return 0, 0
+	}
+
+	var size int64
+
+	for _, m := range proc.Mem.Mappings() {
+		size += int64(m.Size)
+	}
+
+	return size, proc.Mem.Resident()
+}
+
+func (p *ProcFS) stat(proc *kernel.Process) ([]byte, error) {
+	st, _ := state(proc)
+	vsize, rss := memUsage(proc)
+
+	start := proc.StartTime().Sub(p.kernel.BootTime()).Seconds() * clockTicks
+
+	sid := proc.Sid()
+	ttyNr, tpgid := terminal(proc, sid)
+
+	fields := []string{
+		strconv.Itoa(proc.Pid),
+		"(" + comm(proc) + ")",
+		string(st),
+		strconv.Itoa(ppid(proc)),
+		strconv.Itoa(proc.Pgid()),
+		strconv.Itoa(sid),
+		strconv.FormatUint(uint64(ttyNr), 10),
+		strconv.Itoa(tpgid),
+	}
+
+	// flags, fault counts and cpu times.
+	for i := 0; i < 9; i++ {
+		fields = append(fields, "0")
+	}
+
+	fields = append(fields,
+		"20", // priority
+		"0",  // nice
+		"1",  // num_threads
+		"0",  // itrealvalue
+		strconv.FormatInt(int64(start), 10),
+		strconv.FormatInt(vsize, 10),
+		strconv.FormatInt(rss/4096, 10),
+		"18446744073709551615", // rsslim
+	)
+
+	// The rest, down to exit_code, don't apply.
+	for len(fields) < 52 {
+		fields = append(fields, "0")
+	}
+
+	return []byte(strings.Join(fields, " ") + "\n"), nil
+}
+
+// terminal returns the device number of the controlling terminal of
+// proc's session sid and the process group in its foreground, or 0 and -1
+// if it has none.
+func terminal(proc *kernel.Process, sid int) (uint32, int) {
+	t := proc.ControllingTerminal()
+	if t == nil {
+		return 0, -1
+	}
+
+	pgid, err := t.Foreground(sid)
+	if err != nil {
+		return 0, -1
+	}
+
+	return linux.MakeDeviceID(linux.UNIX98_PTY_SLAVE_MAJOR, uint32(t.Index())), pgid
+}
+
+func status(proc *kernel.Process) ([]byte, error) {
+	st, desc := state(proc)
+	vsize, rss := memUsage(proc)
+	creds := proc.Credentials()
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "Name:\t%s\n", comm(proc))
+	fmt.Fprintf(&buf, "State:\t%c (%s)\n", st, desc)
+	fmt.Fprintf(&buf, "Tgid:\t%d\n", proc.Pid)
+	fmt.Fprintf(&buf, "Pid:\t%d\n", proc.Pid)
+	fmt.Fprintf(&buf, "PPid:\t%d\n", ppid(proc))
+	fmt.Fprintf(&buf, "Uid:\t%d\t%d\t%d\t%d\n", creds.RealUID, creds.EffectiveUID, creds.SavedUID, creds.FilesystemUID)
+	fmt.Fprintf(&buf, "Gid:\t%d\t%d\t%d\t%d\n", creds.RealGID, creds.EffectiveGID, creds.SavedGID, creds.FilesystemGID)
+	fmt.Fprintf(&buf, "FDSize:\t%d\n", len(proc.Files()))
+	fmt.Fprintf(&buf, "Groups:\t%s\n", groupList(creds.Groups))
+	fmt.Fprintf(&buf, "VmSize:\t%8d kB\n", vsize/1024)
+	fmt.Fprintf(&buf, "VmRSS:\t%8d kB\n", rss/1024)
+	fmt.Fprintf(&buf, "Threads:\t1\n")
+	fmt.Fprintf(&buf, "CapInh:\t%016x\n", uint64(creds.InheritableCaps))
+	fmt.Fprintf(&buf, "CapPrm:\t%016x\n", uint64(creds.PermittedCaps))
+	fmt.Fprintf(&buf, "CapEff:\t%016x\n", uint64(creds.EffectiveCaps))
+	fmt.Fprintf(&buf, "CapBnd:\t%016x\n", uint64(creds.BoundingCaps))
+	fmt.Fprintf(&buf, "CapAmb:\t%016x\n", uint64(creds.AmbientCaps))
+
+	return buf.Bytes(), nil
+}
+
+// groupList formats groups as the Groups line of status does.
+func groupList(groups []int) string {
+	parts := make([]string, len(groups))
+
+	for i, g := range groups {
+		parts[i] = strconv.Itoa(g)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func maps(proc *kernel.Process) ([]byte, error) {
+	if proc.Mem == nil || proc.Status() == kernel.Dead {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+
+	for _, m := range proc.Mem.Mappings() {
+		name := ""
+		if m.Heap {
+			name = "[heap]"
+		}
+
+		fmt.Fprintf(&buf, "%08x-%08x rw-p 00000000 00:00 0 %s\n", m.Start, m.Start+m.Size, name)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// uidMap returns uid_map, which shows how the guest's uids map onto the
+// host's for its files.
+func (p *ProcFS) uidMap(proc *kernel.Process) ([]byte, error) {
+	uids, _ := p.kernel.IDMaps()
+	return []byte(uids.String()), nil
+}
+
+// gidMap returns gid_map, as uidMap does uid_map.
+func (p *ProcFS) gidMap(proc *kernel.Process) ([]byte, error) {
+	_, gids := p.kernel.IDMaps()
+	return []byte(gids.String()), nil
+}
+
+func mounts(proc *kernel.Process) ([]byte, error) {
+	if proc.Mount == nil {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+
+	for _, mnt := range proc.Mount.Mounts() {
+		source := mnt.Source
+		if source == "" {
+			source = "none"
+		}
+
+		opts := "rw"
+		if mnt.Flags.ReadOnly {
+			opts = "ro"
+		}
+
+		fmt.Fprintf(&buf, "%s %s %s %s 0 0\n", escapeMount(source), escapeMount(mnt.Path), mnt.Type, opts)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// escapeMount escapes the characters that would break up the fields of a
+// line of /proc/mounts, as the kernel does.
+func escapeMount(s string) string {
+	return strings.NewReplacer(
+		" ", `\040`,
+		"\t", `\011`,
+		"\n", `\012`,
+		`\`, `\134`,
+	).Replace(s)
+}
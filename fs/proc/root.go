@@ -0,0 +1,118 @@
+package proc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/memory"
+)
+
+func (p *ProcFS) newRoot() *fs.Inode {
+	entries := map[string]func(ino uint64) *fs.Inode{
+		"meminfo": func(ino uint64) *fs.Inode {
+			return p.newFile(ino, newNode(0444, nil), p.meminfo)
+		},
+		"uptime": func(ino uint64) *fs.Inode {
+			return p.newFile(ino, newNode(0444, nil), p.uptime)
+		},
+		"mounts": func(ino uint64) *fs.Inode {
+			return p.newSymlink(ino, newNode(0777, nil), staticTarget("self/mounts"))
+		},
+		"self": func(ino uint64) *fs.Inode {
+			return p.newSymlink(ino, newNode(0777, nil), selfTarget)
+		},
+	}
+
+	static := sortedKeys(entries)
+
+	return p.newDir(rootIno, newNode(0555, nil),
+		func() []string {
+			names := append([]string(nil), static...)
+
+			for _, proc := range p.kernel.Processes() {
+				names = append(names, strconv.Itoa(proc.Pid))
+			}
+
+			return names
+		},
+		func(name string) (*fs.Inode, error) {
+			if _, ok := entries[name]; ok {
+				return lookupStatic(rootIno, static, entries, name)
+			}
+
+			pid, err := strconv.Atoi(name)
+			if err != nil {
+				return nil, fs.ErrUnknownPath
+			}
+
+			proc, ok := p.kernel.FindProcess(pid)
+			if !ok {
+				return nil, fs.ErrUnknownPath
+			}
+
+			return p.newProcessDir(proc), nil
+		})
+}
+
+// selfTarget points /proc/self at the directory of the task reading it.
+func selfTarget(ctx context.Context) (string, error) {
+	task, ok := kernel.GetTask(ctx)
+	if !ok {
+		return "", fs.ErrUnknownPath
+	}
+
+	return strconv.Itoa(task.Pid), nil
+}
+
+// meminfo reports memory as the processes see it. The guest has no memory
+// limit of its own, so the total is the address space of a process and
+// what's used is what every process has touched.
+func (p *ProcFS) meminfo() ([]byte, error) {
+	total := int64(memory.AddressSpaceTop)
+
+	var used int64
+
+	for _, proc := range p.kernel.Processes() {
+		if proc.Status() != kernel.Dead && proc.Mem != nil {
+			used += proc.Mem.Resident()
+		}
+	}
+
+	free := total - used
+	if free < 0 {
+		free = 0
+	}
+
+	var buf bytes.Buffer
+
+	for _, line := range []struct {
+		name  string
+		bytes int64
+	}{
+		{"MemTotal", total},
+		{"MemFree", free},
+		{"MemAvailable", free},
+		{"Buffers", 0},
+		{"Cached", 0},
+		{"SwapCached", 0},
+		{"SwapTotal", 0},
+		{"SwapFree", 0},
+		{"Shmem", 0},
+	} {
+		fmt.Fprintf(&buf, "%-16s%8d kB\n", line.name+":", line.bytes/1024)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (p *ProcFS) uptime() ([]byte, error) {
+	up := time.Since(p.kernel.BootTime()).Seconds()
+
+	// Nothing tracks idle time, so none is reported.
+	return []byte(fmt.Sprintf("%.2f %.2f\n", up, 0.0)), nil
+}
@@ -35,19 +35,31 @@ type Dir struct {
 }
 
 func (d *Dir) AddChild(name string, inode *fs.Inode) {
+	if _, ok := d.Children[name]; !ok {
+		d.Order = append(d.Order, name)
+	}
+
 	d.Children[name] = inode
-	d.Order = append(d.Order, name)
 }
 
 type File struct {
 	fs.StandardFileOps
 	Unstable fs.InodeUnstableAttr
 	Body     []byte
+
+	// src holds the body when it is read on demand from an indexed
+	// archive rather than kept in Body.
+	src    io.ReaderAt
+	offset int64
 }
 
 type TarFS struct {
 	Device *device.Device
 	root   *fs.Inode
+	dir    *Dir
+
+	// src is the archive bodies are read from, when indexed.
+	src io.ReaderAt
 }
 
 func findParent(root *Dir, name string) (*Dir, error) {
@@ -64,10 +76,11 @@ func findParent(root *Dir, name string) (*Dir, error) {
 	for _, sec := range parts {
 		ch, ok := parent.Children[sec]
 		if !ok {
-			ch := &Dir{
+			dir := &Dir{
 				Children: make(map[string]*fs.Inode),
 			}
-			parent.Children[sec] = fs.NewInode(fs.InodeStableAttr{Type: fs.Directory}, ch)
+			ch = fs.NewInode(fs.InodeStableAttr{Type: fs.Directory}, dir)
+			parent.AddChild(sec, ch)
 		}
 
 		dir, ok := ch.Ops.(*Dir)
@@ -81,18 +94,47 @@ func findParent(root *Dir, name string) (*Dir, error) {
 	return parent, nil
 }
 
+// NewTarFS creates a filesystem from the contents of a single tar stream,
+// which may be gzip or zstd compressed. The file bodies are held in memory;
+// use NewSeekableTarFS to avoid that.
 func NewTarFS(r io.Reader) (*TarFS, error) {
-	tr := tar.NewReader(r)
+	t := NewEmptyTarFS()
 
-	dev := device.NewAnonDevice()
+	err := t.AddLayer(r)
+	if err != nil {
+		return nil, err
+	}
 
-	t := &TarFS{Device: dev}
+	return t, nil
+}
 
+// NewEmptyTarFS creates a filesystem containing only a root directory. Use
+// AddLayer to populate it.
+func NewEmptyTarFS() *TarFS {
 	root := &Dir{
 		Children: make(map[string]*fs.Inode),
 	}
 
-	var rootInode *fs.Inode
+	return &TarFS{
+		Device: device.NewAnonDevice(),
+		root:   fs.NewInode(fs.InodeStableAttr{Type: fs.Directory}, root),
+		dir:    root,
+	}
+}
+
+// AddLayer reads a tar stream, which may be gzip or zstd compressed, and
+// adds its entries to the filesystem. Entries replace any existing entry
+// at the same path, except that a directory replacing a directory only
+// updates its attributes and keeps its children.
+func (t *TarFS) AddLayer(r io.Reader) error {
+	dr, _, err := Decompress(r)
+	if err != nil {
+		return err
+	}
+
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
 
 	for {
 		hdr, err := tr.Next()
@@ -101,88 +143,206 @@ func NewTarFS(r io.Reader) (*TarFS, error) {
 		}
 
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		data, err := ioutil.ReadAll(tr)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		var attr fs.InodeStableAttr
-		attr.BlockSize = 4096
-		attr.DeviceFileMajor = uint16(dev.Major)
-		attr.DeviceFileMinor = uint32(dev.Minor)
-		attr.DeviceID = dev.DeviceID()
-		attr.InodeID = dev.NextIno()
-		attr.SetType(hdr.FileInfo().Mode())
+		err = t.addEntry(hdr, &File{Body: data})
+		if err != nil {
+			return err
+		}
+	}
 
-		var us fs.InodeUnstableAttr
-		us.AccessTime = linux.TimeToTimespec(hdr.AccessTime)
-		us.ModificationTime = linux.TimeToTimespec(hdr.ModTime)
-		us.StatusChangeTime = linux.TimeToTimespec(hdr.ChangeTime)
-		us.GroupId = hdr.Gid
-		us.UserId = hdr.Uid
-		us.Perms = int(os.FileMode(hdr.Mode).Perm())
-		us.Size = hdr.Size
+	return nil
+}
 
-		name := hdr.Name
+// NewSeekableTarFS indexes the uncompressed tar archive in r without
+// reading the file bodies, which are read from r as they're used. r must
+// remain readable for as long as the filesystem is used.
+func NewSeekableTarFS(r io.ReaderAt, size int64) (*TarFS, error) {
+	t := NewEmptyTarFS()
+	t.src = r
 
-		if len(name) > 2 && name[:2] == "./" {
-			name = name[2:]
-		}
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
 
-		if len(name) >= 1 && name[0] == '/' {
-			name = name[1:]
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
 		}
 
-		// root!
-		if name == "./" || name == "." {
-			rootInode = fs.NewInode(attr, root)
-			root.Unstable = us
-			continue
+		if err != nil {
+			return nil, err
 		}
 
-		var ops fs.InodeOps
+		file := &File{}
 
-		if attr.Type == fs.Directory {
-			name = name[:len(name)-1]
-			ops = &Dir{
-				Unstable: us,
-				Children: make(map[string]*fs.Inode),
+		if isSparse(hdr) {
+			// The body of a sparse file isn't stored contiguously, so it's
+			// expanded up front.
+			file.Body, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
 			}
 		} else {
-			if attr.Type == fs.Symlink {
-				us.Size = int64(len(hdr.Linkname))
-				data = []byte(hdr.Linkname)
+			// tar.Reader reads only the header blocks in Next, so the
+			// current position is the start of the body.
+			offset, err := sr.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
 			}
 
-			ops = &File{
-				Unstable: us,
-				Body:     data,
-			}
+			file.src = r
+			file.offset = offset
 		}
 
-		parent, err := findParent(root, name)
+		err = t.addEntry(hdr, file)
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	return t, nil
+}
 
-		inode := &fs.Inode{
-			StableAttr: attr,
-			Ops:        ops,
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
 		}
+	}
 
-		parent.AddChild(filepath.Base(name), inode)
+	return false
+}
+
+// Close releases the archive backing an indexed filesystem.
+func (t *TarFS) Close() error {
+	if c, ok := t.src.(io.Closer); ok {
+		return c.Close()
 	}
 
-	if rootInode == nil {
-		rootInode = fs.NewInode(fs.InodeStableAttr{Type: fs.Directory}, root)
+	return nil
+}
+
+// addEntry adds the entry described by hdr. For non-directories, file
+// holds where to find the body.
+func (t *TarFS) addEntry(hdr *tar.Header, file *File) error {
+	dev := t.Device
+
+	var attr fs.InodeStableAttr
+	attr.BlockSize = 4096
+	attr.DeviceFileMajor = uint16(dev.Major)
+	attr.DeviceFileMinor = uint32(dev.Minor)
+	attr.DeviceID = dev.DeviceID()
+	attr.InodeID = dev.NextIno()
+	attr.SetType(hdr.FileInfo().Mode())
+
+	var us fs.InodeUnstableAttr
+	us.AccessTime = linux.TimeToTimespec(hdr.AccessTime)
+	us.ModificationTime = linux.TimeToTimespec(hdr.ModTime)
+	us.StatusChangeTime = linux.TimeToTimespec(hdr.ChangeTime)
+	us.GroupId = hdr.Gid
+	us.UserId = hdr.Uid
+	us.Perms = int(os.FileMode(hdr.Mode).Perm())
+	us.Size = hdr.Size
+
+	name := hdr.Name
+
+	if len(name) > 2 && name[:2] == "./" {
+		name = name[2:]
 	}
 
-	t.root = rootInode
+	if len(name) >= 1 && name[0] == '/' {
+		name = name[1:]
+	}
 
-	return t, nil
+	// root!
+	if name == "./" || name == "." || name == "" {
+		t.root.StableAttr = attr
+		t.dir.Unstable = us
+		return nil
+	}
+
+	name = strings.TrimSuffix(name, "/")
+
+	parent, err := findParent(t.dir, name)
+	if err != nil {
+		return err
+	}
+
+	base := filepath.Base(name)
+
+	if hdr.Typeflag == tar.TypeLink {
+		target, err := t.lookup(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+
+		parent.AddChild(base, target)
+		return nil
+	}
+
+	var ops fs.InodeOps
+
+	if attr.Type == fs.Directory {
+		if cur, ok := parent.Children[base]; ok {
+			if dir, ok := cur.Ops.(*Dir); ok {
+				dir.Unstable = us
+				cur.StableAttr = attr
+				return nil
+			}
+		}
+
+		ops = &Dir{
+			Unstable: us,
+			Children: make(map[string]*fs.Inode),
+		}
+	} else {
+		if attr.Type == fs.Symlink {
+			us.Size = int64(len(hdr.Linkname))
+			file.Body = []byte(hdr.Linkname)
+			file.src = nil
+		}
+
+		file.Unstable = us
+		ops = file
+	}
+
+	inode := &fs.Inode{
+		StableAttr: attr,
+		Ops:        ops,
+	}
+
+	parent.AddChild(base, inode)
+
+	return nil
+}
+
+// lookup finds the inode for a path relative to the root, as used by
+// hard link entries.
+func (t *TarFS) lookup(name string) (*fs.Inode, error) {
+	name = strings.Trim(strings.TrimPrefix(name, "./"), "/")
+
+	parent, err := findParent(t.dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	inode, ok := parent.Children[filepath.Base(name)]
+	if !ok {
+		return nil, fs.ErrUnknownPath
+	}
+
+	return inode, nil
 }
 
 func (t *TarFS) Root() (*fs.Inode, error) {
@@ -215,6 +375,10 @@ func (f *File) ReadLink(ctx context.Context, inode *fs.Inode) (string, error) {
 }
 
 func (f *File) Reader(inode *fs.Inode) (io.ReadSeeker, error) {
+	if f.src != nil {
+		return io.NewSectionReader(f.src, f.offset, f.Unstable.Size), nil
+	}
+
 	return bytes.NewReader(f.Body), nil
 }
 
@@ -0,0 +1,124 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/stretchr/testify/require"
+)
+
+func archive(t *testing.T) []byte {
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+
+	entries := []struct {
+		name, body string
+		typ        byte
+	}{
+		{"etc/", "", tar.TypeDir},
+		{"etc/hosts", "127.0.0.1 localhost\n", tar.TypeReg},
+		{"etc/empty", "", tar.TypeReg},
+		{"etc/link", "hosts", tar.TypeSymlink},
+		{"bin/sh", "shell", tar.TypeReg},
+	}
+
+	for _, ent := range entries {
+		hdr := &tar.Header{
+			Name:     ent.name,
+			Mode:     0644,
+			Typeflag: ent.typ,
+		}
+
+		switch ent.typ {
+		case tar.TypeReg:
+			hdr.Size = int64(len(ent.body))
+		case tar.TypeSymlink:
+			hdr.Linkname = ent.body
+		}
+
+		require.NoError(t, tw.WriteHeader(hdr))
+
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte(ent.body))
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+func readFile(t *testing.T, tf *TarFS, path string) string {
+	root, err := tf.Root()
+	require.NoError(t, err)
+
+	m := fs.NewMountNamespace()
+	m.SetRoot(root)
+
+	dirent, err := m.LookupPath(context.Background(), path)
+	require.NoError(t, err)
+
+	r, err := dirent.Reader()
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	return string(data)
+}
+
+func TestTarFS(t *testing.T) {
+	data := archive(t)
+
+	t.Run("reads gzip compressed streams", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		require.Equal(t, Gzip, DetectCompression(buf.Bytes()))
+
+		tf, err := NewTarFS(&buf)
+		require.NoError(t, err)
+
+		require.Equal(t, "shell", readFile(t, tf, "/bin/sh"))
+	})
+
+	t.Run("reads bodies lazily from an index", func(t *testing.T) {
+		tf, err := NewSeekableTarFS(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+
+		root, err := tf.Root()
+		require.NoError(t, err)
+
+		etc, err := root.Ops.LookupChild(context.Background(), root, "etc")
+		require.NoError(t, err)
+
+		hosts, err := etc.Ops.LookupChild(context.Background(), etc, "hosts")
+		require.NoError(t, err)
+
+		file := hosts.Ops.(*File)
+		require.Nil(t, file.Body)
+		require.NotNil(t, file.src)
+
+		require.Equal(t, "127.0.0.1 localhost\n", readFile(t, tf, "/etc/hosts"))
+		require.Equal(t, "", readFile(t, tf, "/etc/empty"))
+		require.Equal(t, "shell", readFile(t, tf, "/bin/sh"))
+
+		link, err := etc.Ops.LookupChild(context.Background(), etc, "link")
+		require.NoError(t, err)
+
+		target, err := link.Ops.ReadLink(context.Background(), link)
+		require.NoError(t, err)
+		require.Equal(t, "hosts", target)
+	})
+}
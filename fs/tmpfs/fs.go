@@ -0,0 +1,856 @@
+// Package tmpfs implements a writable filesystem held entirely in memory,
+// for scratch directories like /tmp and for isolated writable roots.
+package tmpfs
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/device"
+	"github.com/evanphx/columbia/fs"
+)
+
+// DefaultSize is the limit on file data of a filesystem that isn't given
+// one. Like Linux's default of half the memory, it keeps a guest from
+// filling the host's memory with files.
+const DefaultSize = 1 << 30
+
+// growStep bounds the spare capacity a file's contents get as they grow,
+// so a big file holds little more memory than it uses.
+const growStep = 1 << 20
+
+// Options configures a new TmpFS.
+type Options struct {
+	// Size is the maximum number of bytes of file data stored, or 0 for
+	// DefaultSize.
+	Size int64
+
+	// Inodes is the maximum number of inodes, or 0 for no limit.
+	Inodes int64
+
+	// Mode is the permissions of the root directory, defaulting to 01777.
+	Mode int
+
+	// UID and GID own the root directory.
+	UID, GID int
+}
+
+type TmpFS struct {
+	Device *device.Device
+	root   *fs.Inode
+
+	// mu protects the structure of the tree as well as the attributes and
+	// contents of every inode in it.
+	mu sync.Mutex
+
+	opts   Options
+	used   int64
+	inodes int64
+}
+
+// NewTmpFS creates an empty filesystem.
+func NewTmpFS(opts Options) *TmpFS {
+	if opts.Mode == 0 {
+		opts.Mode = 01777
+	}
+
+	if opts.Size == 0 {
+		opts.Size = DefaultSize
+	}
+
+	t := &TmpFS{
+		Device: device.NewAnonDevice(),
+		opts:   opts,
+	}
+
+	dir := t.newDir(nil, opts.Mode)
+	dir.attr.UserId = opts.UID
+	dir.attr.GroupId = opts.GID
+
+	t.root = t.newInode(fs.Directory, dir)
+	t.inodes = 1
+
+	return t
+}
+
+func (t *TmpFS) Root() (*fs.Inode, error) {
+	return t.root, nil
+}
+
+// Usage returns the number of bytes of file data stored.
+func (t *TmpFS) Usage() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.used
+}
+
+func now() linux.Timespec {
+	return linux.TimeToTimespec(time.Now())
+}
+
+// node holds the attributes common to every kind of inode.
+type node struct {
+	fs   *TmpFS
+	attr fs.InodeUnstableAttr
+}
+
+func (t *TmpFS) newNode(perms int) node {
+	ts := now()
+
+	return node{
+		fs: t,
+		attr: fs.InodeUnstableAttr{
+			Perms:            perms,
+			AccessTime:       ts,
+			ModificationTime: ts,
+			StatusChangeTime: ts,
+			Links:            1,
+		},
+	}
+}
+
+// The attribute methods are shared by every kind of inode. They're named
+// differently from the InodeOps methods, which each type forwards to them,
+// so they don't clash with the defaults in fs.StandardDirOps and
+// fs.StandardFileOps.
+
+func (n *node) unstableAttr() (*fs.InodeUnstableAttr, error) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+
+	attr := n.attr
+	return &attr, nil
+}
+
+func (n *node) setPermissions(perms int) error {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+
+	n.attr.Perms = perms & 07777
+	n.attr.StatusChangeTime = now()
+
+	return nil
+}
+
+func (n *node) setOwner(uid, gid int) error {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+
+	if uid != -1 {
+		n.attr.UserId = uid
+	}
+
+	if gid != -1 {
+		n.attr.GroupId = gid
+	}
+
+	n.attr.StatusChangeTime = now()
+
+	return nil
+}
+
+func (n *node) setTimestamps(atime, mtime linux.Timespec) error {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+
+	n.attr.AccessTime = atime
+	n.attr.ModificationTime = mtime
+	n.attr.StatusChangeTime = now()
+
+	return nil
+}
+
+func (t *TmpFS) newInode(typ fs.InodeType, ops fs.InodeOps) *fs.Inode {
+	return fs.NewInode(fs.InodeStableAttr{
+		Type:            typ,
+		DeviceID:        t.Device.DeviceID(),
+		InodeID:         t.Device.NextIno(),
+		BlockSize:       4096,
+		DeviceFileMajor: uint16(t.Device.Major),
+		DeviceFileMinor: uint32(t.Device.Minor),
+	}, ops)
+}
+
+// allocInode charges a new inode against the limit. t.mu must be held.
+func (t *TmpFS) allocInode() error {
+	if t.opts.Inodes > 0 && t.inodes >= t.opts.Inodes {
+		return fs.ErrNoSpace
+	}
+
+	t.inodes++
+
+	return nil
+}
+
+// resize changes the size of f's contents, charging the difference against
+// the size limit. No file can be bigger than the limit, even one that's no
+// longer charged. t.mu must be held.
+func (t *TmpFS) resize(f *File, size int64) error {
+	cur := int64(len(f.data))
+	delta := size - cur
+
+	if size > t.opts.Size {
+		return fs.ErrNoSpace
+	}
+
+	if !f.orphaned {
+		if delta > 0 && t.used+delta > t.opts.Size {
+			return fs.ErrNoSpace
+		}
+
+		t.used += delta
+	}
+
+	if size <= int64(cap(f.data)) {
+		f.data = f.data[:size]
+
+		// The spare capacity may hold data from before a truncate.
+		if delta > 0 {
+			tail := f.data[cur:]
+			for i := range tail {
+				tail[i] = 0
+			}
+		}
+	} else {
+		c := 2 * int64(cap(f.data))
+
+		switch {
+		case c < size:
+			c = size
+		case c > size+growStep:
+			c = size + growStep
+		}
+
+		data := make([]byte, size, c)
+		copy(data, f.data)
+		f.data = data
+	}
+
+	f.attr.Size = size
+	f.attr.Usage = size
+
+	return nil
+}
+
+// release drops an inode whose last link was removed. Files that are still
+// open keep their contents, but they're no longer charged against the
+// limits. t.mu must be held.
+func (t *TmpFS) release(inode *fs.Inode) {
+	t.inodes--
+
+	if f, ok := inode.Ops.(*File); ok {
+		t.used -= int64(len(f.data))
+		f.orphaned = true
+	}
+}
+
+type Dir struct {
+	fs.StandardDirOps
+	node
+
+	parent   *Dir
+	children map[string]*fs.Inode
+	order    []string
+}
+
+func (t *TmpFS) newDir(parent *Dir, perms int) *Dir {
+	d := &Dir{
+		node:     t.newNode(perms),
+		parent:   parent,
+		children: make(map[string]*fs.Inode),
+	}
+
+	d.attr.Links = 2
+	d.attr.Size = 4096
+
+	return d
+}
+
+func (d *Dir) LookupChild(ctx context.Context, inode *fs.Inode, name string) (*fs.Inode, error) {
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+
+	child, ok := d.children[name]
+	if !ok {
+		return nil, fs.ErrUnknownPath
+	}
+
+	return child, nil
+}
+
+func (d *Dir) ReadDir(ctx context.Context, inode *fs.Inode, offset int, emit fs.ReadDirEmit) error {
+	d.fs.mu.Lock()
+
+	if offset >= len(d.order) {
+		d.fs.mu.Unlock()
+		return nil
+	}
+
+	names := append([]string(nil), d.order[offset:]...)
+	inodes := make([]*fs.Inode, len(names))
+
+	for i, name := range names {
+		inodes[i] = d.children[name]
+	}
+
+	d.fs.mu.Unlock()
+
+	for i, name := range names {
+		if !emit.EmitEntry(name, inodes[i]) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// add links inode into d as name. t.mu must be held.
+func (d *Dir) add(name string, inode *fs.Inode) {
+	if _, ok := d.children[name]; !ok {
+		d.order = append(d.order, name)
+	}
+
+	d.children[name] = inode
+
+	if sub, ok := inode.Ops.(*Dir); ok {
+		sub.parent = d
+		d.attr.Links++
+	}
+
+	ts := now()
+	d.attr.ModificationTime = ts
+	d.attr.StatusChangeTime = ts
+}
+
+// unlink removes name from d. t.mu must be held.
+func (d *Dir) unlink(name string) {
+	inode := d.children[name]
+
+	delete(d.children, name)
+
+	for i, n := range d.order {
+		if n == name {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+
+	if _, ok := inode.Ops.(*Dir); ok {
+		d.attr.Links--
+	}
+
+	ts := now()
+	d.attr.ModificationTime = ts
+	d.attr.StatusChangeTime = ts
+}
+
+// checkCreate validates that name can be created in d. t.mu must be held.
+func (d *Dir) checkCreate(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fs.ErrExists
+	}
+
+	if _, ok := d.children[name]; ok {
+		return fs.ErrExists
+	}
+
+	return nil
+}
+
+// newNode returns the node of an inode created in d by ctx, owned as
+// fs.Owner has it. t.mu must be held.
+func (d *Dir) newNode(ctx context.Context, perms int) node {
+	n := d.fs.newNode(perms)
+	n.attr.UserId, n.attr.GroupId = fs.Owner(ctx, &d.attr)
+
+	return n
+}
+
+func (d *Dir) Create(ctx context.Context, dir *fs.Inode, name string, perms int) (*fs.Inode, error) {
+	t := d.fs
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := d.checkCreate(name); err != nil {
+		return nil, err
+	}
+
+	if err := t.allocInode(); err != nil {
+		return nil, err
+	}
+
+	inode := t.newInode(fs.RegularFile, &File{node: d.newNode(ctx, perms&07777)})
+
+	d.add(name, inode)
+
+	return inode, nil
+}
+
+func (d *Dir) CreateDirectory(ctx context.Context, dir *fs.Inode, name string, perms int) error {
+	t := d.fs
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := d.checkCreate(name); err != nil {
+		return err
+	}
+
+	if err := t.allocInode(); err != nil {
+		return err
+	}
+
+	// A setgid directory hands that on to its subdirectories, so they
+	// give their group to what's created in them too.
+	perms &= 07777
+	if d.attr.Perms&linux.ModeSetGID != 0 {
+		perms |= linux.ModeSetGID
+	}
+
+	sub := t.newDir(d, perms)
+	sub.attr.UserId, sub.attr.GroupId = fs.Owner(ctx, &d.attr)
+
+	d.add(name, t.newInode(fs.Directory, sub))
+
+	return nil
+}
+
+func (d *Dir) CreateLink(ctx context.Context, dir *fs.Inode, target, name string) error {
+	t := d.fs
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := d.checkCreate(name); err != nil {
+		return err
+	}
+
+	if err := t.allocInode(); err != nil {
+		return err
+	}
+
+	link := &Symlink{node: d.newNode(ctx, 0777), target: target}
+	link.attr.Size = int64(len(target))
+
+	d.add(name, t.newInode(fs.Symlink, link))
+
+	return nil
+}
+
+func (d *Dir) CreateSocket(ctx context.Context, dir *fs.Inode, name string, perms int) (*fs.Inode, error) {
+	t := d.fs
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := d.checkCreate(name); err != nil {
+		return nil, err
+	}
+
+	if err := t.allocInode(); err != nil {
+		return nil, err
+	}
+
+	inode := t.newInode(fs.Socket, &Socket{node: d.newNode(ctx, perms&07777)})
+
+	d.add(name, inode)
+
+	return inode, nil
+}
+
+func (d *Dir) CreateHardLink(ctx context.Context, dir *fs.Inode, target *fs.Inode, name string) error {
+	t := d.fs
+
+	var n *node
+
+	switch ops := target.Ops.(type) {
+	case *File:
+		n = &ops.node
+	case *Symlink:
+		n = &ops.node
+	case *Socket:
+		n = &ops.node
+	case *Dir:
+		return fs.ErrIsDirectory
+	default:
+		return fs.ErrCrossDevice
+	}
+
+	if n.fs != t {
+		return fs.ErrCrossDevice
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := d.checkCreate(name); err != nil {
+		return err
+	}
+
+	n.attr.Links++
+	n.attr.StatusChangeTime = now()
+
+	d.add(name, target)
+
+	return nil
+}
+
+func (d *Dir) Remove(ctx context.Context, dir *fs.Inode, name string) error {
+	t := d.fs
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	inode, ok := d.children[name]
+	if !ok {
+		return fs.ErrUnknownPath
+	}
+
+	if _, ok := inode.Ops.(*Dir); ok {
+		return fs.ErrIsDirectory
+	}
+
+	d.unlink(name)
+	t.dropLink(inode)
+
+	return nil
+}
+
+// dropLink removes a link to inode, releasing it when it was the last one.
+// t.mu must be held.
+func (t *TmpFS) dropLink(inode *fs.Inode) {
+	var n *node
+
+	switch ops := inode.Ops.(type) {
+	case *File:
+		n = &ops.node
+	case *Symlink:
+		n = &ops.node
+	case *Socket:
+		n = &ops.node
+	case *Dir:
+		t.release(inode)
+		return
+	}
+
+	n.attr.Links--
+	n.attr.StatusChangeTime = now()
+
+	if n.attr.Links == 0 {
+		t.release(inode)
+	}
+}
+
+func (d *Dir) RemoveDirectory(ctx context.Context, dir *fs.Inode, name string) error {
+	t := d.fs
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	inode, ok := d.children[name]
+	if !ok {
+		return fs.ErrUnknownPath
+	}
+
+	sub, ok := inode.Ops.(*Dir)
+	if !ok {
+		return fs.ErrNotDirectory
+	}
+
+	if len(sub.children) != 0 {
+		return fs.ErrNotEmpty
+	}
+
+	d.unlink(name)
+	t.dropLink(inode)
+
+	return nil
+}
+
+func (d *Dir) Rename(ctx context.Context, oldParent *fs.Inode, oldName string, newParent *fs.Inode, newName string) error {
+	t := d.fs
+
+	dest, ok := newParent.Ops.(*Dir)
+	if !ok || dest.fs != t {
+		return fs.ErrCrossDevice
+	}
+
+	if newName == "" || newName == "." || newName == ".." {
+		return fs.ErrInvalid
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	inode, ok := d.children[oldName]
+	if !ok {
+		return fs.ErrUnknownPath
+	}
+
+	if d == dest && oldName == newName {
+		return nil
+	}
+
+	moving, isDir := inode.Ops.(*Dir)
+
+	if isDir {
+		// A directory can't be moved beneath itself.
+		for p := dest; p != nil; p = p.parent {
+			if p == moving {
+				return fs.ErrInvalid
+			}
+		}
+	}
+
+	if existing, ok := dest.children[newName]; ok {
+		if existing == inode {
+			return nil
+		}
+
+		sub, existingDir := existing.Ops.(*Dir)
+
+		switch {
+		case isDir && !existingDir:
+			return fs.ErrNotDirectory
+		case !isDir && existingDir:
+			return fs.ErrIsDirectory
+		case existingDir && len(sub.children) != 0:
+			return fs.ErrNotEmpty
+		}
+
+		dest.unlink(newName)
+		t.dropLink(existing)
+	}
+
+	d.unlink(oldName)
+	dest.add(newName, inode)
+
+	return nil
+}
+
+type File struct {
+	fs.StandardFileOps
+	node
+
+	data []byte
+
+	// orphaned is set once the last link is removed.
+	orphaned bool
+}
+
+func (f *File) ReadLink(ctx context.Context, inode *fs.Inode) (string, error) {
+	return "", fs.ErrNotSymlink
+}
+
+func (f *File) Reader(inode *fs.Inode) (io.ReadSeeker, error) {
+	return &handle{f: f}, nil
+}
+
+func (f *File) Writer(inode *fs.Inode) (io.WriteSeeker, error) {
+	return &handle{f: f}, nil
+}
+
+func (f *File) Truncate(ctx context.Context, inode *fs.Inode, size int64) error {
+	if size < 0 {
+		return fs.ErrInvalid
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	err := f.fs.resize(f, size)
+	if err != nil {
+		return err
+	}
+
+	ts := now()
+	f.attr.ModificationTime = ts
+	f.attr.StatusChangeTime = ts
+
+	return nil
+}
+
+// handle is an open file position, which sees every change to the file
+// made through other handles.
+type handle struct {
+	f   *File
+	pos int64
+}
+
+func (h *handle) Read(b []byte) (int, error) {
+	f := h.f
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if h.pos >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(b, f.data[h.pos:])
+	h.pos += int64(n)
+
+	f.attr.AccessTime = now()
+
+	return n, nil
+}
+
+func (h *handle) Write(b []byte) (int, error) {
+	f := h.f
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	end := h.pos + int64(len(b))
+	if end < h.pos {
+		return 0, fs.ErrFileTooBig
+	}
+
+	if end > int64(len(f.data)) {
+		err := f.fs.resize(f, end)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	copy(f.data[h.pos:], b)
+	h.pos = end
+
+	ts := now()
+	f.attr.ModificationTime = ts
+	f.attr.StatusChangeTime = ts
+
+	return len(b), nil
+}
+
+func (h *handle) Seek(offset int64, whence int) (int64, error) {
+	f := h.f
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	var pos int64
+
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = h.pos + offset
+	case io.SeekEnd:
+		pos = int64(len(f.data)) + offset
+	default:
+		return 0, fs.ErrInvalid
+	}
+
+	if pos < 0 {
+		return 0, fs.ErrInvalid
+	}
+
+	h.pos = pos
+
+	return pos, nil
+}
+
+type Symlink struct {
+	fs.StandardFileOps
+	node
+
+	target string
+}
+
+func (s *Symlink) ReadLink(ctx context.Context, inode *fs.Inode) (string, error) {
+	return s.target, nil
+}
+
+// Reader returns the target, as tarfs does for its symlinks.
+func (s *Symlink) Reader(inode *fs.Inode) (io.ReadSeeker, error) {
+	return strings.NewReader(s.target), nil
+}
+
+// Socket is the file an AF_UNIX socket is bound to. It can't be opened.
+type Socket struct {
+	fs.StandardFileOps
+	node
+}
+
+func (s *Socket) ReadLink(ctx context.Context, inode *fs.Inode) (string, error) {
+	return "", fs.ErrNotSymlink
+}
+
+func (s *Socket) Reader(inode *fs.Inode) (io.ReadSeeker, error) {
+	return nil, fs.ErrNoDevice
+}
+
+func (s *Socket) Writer(inode *fs.Inode) (io.WriteSeeker, error) {
+	return nil, fs.ErrNoDevice
+}
+
+func (d *Dir) UnstableAttr(ctx context.Context, inode *fs.Inode) (*fs.InodeUnstableAttr, error) {
+	return d.unstableAttr()
+}
+
+func (d *Dir) SetPermissions(ctx context.Context, inode *fs.Inode, perms int) error {
+	return d.setPermissions(perms)
+}
+
+func (d *Dir) SetOwner(ctx context.Context, inode *fs.Inode, uid, gid int) error {
+	return d.setOwner(uid, gid)
+}
+
+func (d *Dir) SetTimestamps(ctx context.Context, inode *fs.Inode, atime, mtime linux.Timespec) error {
+	return d.setTimestamps(atime, mtime)
+}
+
+func (f *File) UnstableAttr(ctx context.Context, inode *fs.Inode) (*fs.InodeUnstableAttr, error) {
+	return f.unstableAttr()
+}
+
+func (f *File) SetPermissions(ctx context.Context, inode *fs.Inode, perms int) error {
+	return f.setPermissions(perms)
+}
+
+func (f *File) SetOwner(ctx context.Context, inode *fs.Inode, uid, gid int) error {
+	return f.setOwner(uid, gid)
+}
+
+func (f *File) SetTimestamps(ctx context.Context, inode *fs.Inode, atime, mtime linux.Timespec) error {
+	return f.setTimestamps(atime, mtime)
+}
+
+func (s *Symlink) UnstableAttr(ctx context.Context, inode *fs.Inode) (*fs.InodeUnstableAttr, error) {
+	return s.unstableAttr()
+}
+
+func (s *Symlink) SetPermissions(ctx context.Context, inode *fs.Inode, perms int) error {
+	return s.setPermissions(perms)
+}
+
+func (s *Symlink) SetOwner(ctx context.Context, inode *fs.Inode, uid, gid int) error {
+	return s.setOwner(uid, gid)
+}
+
+func (s *Symlink) SetTimestamps(ctx context.Context, inode *fs.Inode, atime, mtime linux.Timespec) error {
+	return s.setTimestamps(atime, mtime)
+}
+
+func (s *Socket) UnstableAttr(ctx context.Context, inode *fs.Inode) (*fs.InodeUnstableAttr, error) {
+	return s.unstableAttr()
+}
+
+func (s *Socket) SetPermissions(ctx context.Context, inode *fs.Inode, perms int) error {
+	return s.setPermissions(perms)
+}
+
+func (s *Socket) SetOwner(ctx context.Context, inode *fs.Inode, uid, gid int) error {
+	return s.setOwner(uid, gid)
+}
+
+func (s *Socket) SetTimestamps(ctx context.Context, inode *fs.Inode, atime, mtime linux.Timespec) error {
+	return s.setTimestamps(atime, mtime)
+}
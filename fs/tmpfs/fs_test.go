@@ -0,0 +1,302 @@
+package tmpfs
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/fs"
+	"github.com/stretchr/testify/require"
+)
+
+type names struct {
+	list []string
+}
+
+func (n *names) EmitEntry(name string, inode *fs.Inode) bool {
+	n.list = append(n.list, name)
+	return true
+}
+
+func readDir(t *testing.T, dir *fs.Inode) []string {
+	var n names
+	require.NoError(t, dir.Ops.ReadDir(context.Background(), dir, 0, &n))
+	return n.list
+}
+
+func write(t *testing.T, inode *fs.Inode, data string) {
+	w, err := inode.Ops.Writer(inode)
+	require.NoError(t, err)
+
+	_, err = w.Write([]byte(data))
+	require.NoError(t, err)
+}
+
+func read(t *testing.T, inode *fs.Inode) string {
+	r, err := inode.Ops.Reader(inode)
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	return string(data)
+}
+
+func TestTmpFS(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("creates, writes and reads files", func(t *testing.T) {
+		root, err := NewTmpFS(Options{}).Root()
+		require.NoError(t, err)
+
+		attr, err := root.Ops.UnstableAttr(ctx, root)
+		require.NoError(t, err)
+		require.Equal(t, 01777, attr.Perms)
+
+		f, err := root.Ops.Create(ctx, root, "a", 0644)
+		require.NoError(t, err)
+
+		write(t, f, "hello world")
+		require.Equal(t, "hello world", read(t, f))
+
+		_, err = root.Ops.Create(ctx, root, "a", 0644)
+		require.Equal(t, fs.ErrExists, err)
+
+		require.NoError(t, f.Ops.Truncate(ctx, f, 5))
+		require.Equal(t, "hello", read(t, f))
+
+		require.NoError(t, f.Ops.Truncate(ctx, f, 7))
+		require.Equal(t, "hello\x00\x00", read(t, f))
+
+		w, err := f.Ops.Writer(f)
+		require.NoError(t, err)
+
+		_, err = w.Seek(10, io.SeekStart)
+		require.NoError(t, err)
+
+		_, err = w.Write([]byte("!"))
+		require.NoError(t, err)
+
+		attr, err = f.Ops.UnstableAttr(ctx, f)
+		require.NoError(t, err)
+		require.Equal(t, int64(11), attr.Size)
+	})
+
+	t.Run("manages directories", func(t *testing.T) {
+		root, err := NewTmpFS(Options{}).Root()
+		require.NoError(t, err)
+
+		require.NoError(t, root.Ops.CreateDirectory(ctx, root, "d", 0755))
+
+		d, err := root.Ops.LookupChild(ctx, root, "d")
+		require.NoError(t, err)
+		require.Equal(t, fs.Directory, d.StableAttr.Type)
+
+		_, err = d.Ops.Create(ctx, d, "f", 0644)
+		require.NoError(t, err)
+
+		require.NoError(t, d.Ops.CreateLink(ctx, d, "f", "l"))
+
+		l, err := d.Ops.LookupChild(ctx, d, "l")
+		require.NoError(t, err)
+
+		target, err := l.Ops.ReadLink(ctx, l)
+		require.NoError(t, err)
+		require.Equal(t, "f", target)
+
+		require.Equal(t, []string{"f", "l"}, readDir(t, d))
+
+		require.Equal(t, fs.ErrNotEmpty, root.Ops.RemoveDirectory(ctx, root, "d"))
+		require.Equal(t, fs.ErrIsDirectory, root.Ops.Remove(ctx, root, "d"))
+
+		require.NoError(t, d.Ops.Remove(ctx, d, "f"))
+		require.NoError(t, d.Ops.Remove(ctx, d, "l"))
+		require.NoError(t, root.Ops.RemoveDirectory(ctx, root, "d"))
+
+		require.Empty(t, readDir(t, root))
+	})
+
+	t.Run("renames entries", func(t *testing.T) {
+		root, err := NewTmpFS(Options{}).Root()
+		require.NoError(t, err)
+
+		require.NoError(t, root.Ops.CreateDirectory(ctx, root, "a", 0755))
+		require.NoError(t, root.Ops.CreateDirectory(ctx, root, "b", 0755))
+
+		a, err := root.Ops.LookupChild(ctx, root, "a")
+		require.NoError(t, err)
+
+		b, err := root.Ops.LookupChild(ctx, root, "b")
+		require.NoError(t, err)
+
+		f, err := a.Ops.Create(ctx, a, "f", 0644)
+		require.NoError(t, err)
+
+		write(t, f, "data")
+
+		g, err := b.Ops.Create(ctx, b, "g", 0644)
+		require.NoError(t, err)
+
+		require.NoError(t, a.Ops.Rename(ctx, a, "f", b, "g"))
+
+		require.Empty(t, readDir(t, a))
+		require.Equal(t, []string{"g"}, readDir(t, b))
+
+		moved, err := b.Ops.LookupChild(ctx, b, "g")
+		require.NoError(t, err)
+		require.Equal(t, f, moved)
+		require.NotEqual(t, g, moved)
+
+		require.Equal(t, fs.ErrInvalid, root.Ops.Rename(ctx, root, "a", a, "sub"))
+		require.Equal(t, fs.ErrIsDirectory, b.Ops.Rename(ctx, b, "g", root, "a"))
+
+		require.NoError(t, root.Ops.Rename(ctx, root, "a", b, "a"))
+		require.Equal(t, []string{"b"}, readDir(t, root))
+	})
+
+	t.Run("counts hard links", func(t *testing.T) {
+		root, err := NewTmpFS(Options{}).Root()
+		require.NoError(t, err)
+
+		f, err := root.Ops.Create(ctx, root, "a", 0644)
+		require.NoError(t, err)
+
+		require.NoError(t, root.Ops.CreateHardLink(ctx, root, f, "b"))
+
+		attr, err := f.Ops.UnstableAttr(ctx, f)
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), attr.Links)
+
+		require.NoError(t, root.Ops.Remove(ctx, root, "a"))
+
+		b, err := root.Ops.LookupChild(ctx, root, "b")
+		require.NoError(t, err)
+		require.Equal(t, f, b)
+
+		other, err := NewTmpFS(Options{}).Root()
+		require.NoError(t, err)
+
+		require.Equal(t, fs.ErrCrossDevice, other.Ops.CreateHardLink(ctx, other, f, "c"))
+	})
+
+	t.Run("enforces the size limit", func(t *testing.T) {
+		tfs := NewTmpFS(Options{Size: 10, Inodes: 3})
+
+		root, err := tfs.Root()
+		require.NoError(t, err)
+
+		f, err := root.Ops.Create(ctx, root, "a", 0644)
+		require.NoError(t, err)
+
+		write(t, f, "0123456789")
+
+		w, err := f.Ops.Writer(f)
+		require.NoError(t, err)
+
+		_, err = w.Seek(0, io.SeekEnd)
+		require.NoError(t, err)
+
+		_, err = w.Write([]byte("x"))
+		require.Equal(t, fs.ErrNoSpace, err)
+
+		require.Equal(t, fs.ErrNoSpace, f.Ops.Truncate(ctx, f, 11))
+		require.Equal(t, int64(10), tfs.Usage())
+
+		_, err = root.Ops.Create(ctx, root, "b", 0644)
+		require.NoError(t, err)
+
+		_, err = root.Ops.Create(ctx, root, "c", 0644)
+		require.Equal(t, fs.ErrNoSpace, err)
+
+		require.NoError(t, root.Ops.Remove(ctx, root, "a"))
+		require.Equal(t, int64(0), tfs.Usage())
+
+		// Still readable through the open handle.
+		r, err := f.Ops.Reader(f)
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, "0123456789", string(data))
+	})
+
+	t.Run("refuses huge files without a size limit", func(t *testing.T) {
+		tfs := NewTmpFS(Options{})
+
+		root, err := tfs.Root()
+		require.NoError(t, err)
+
+		f, err := root.Ops.Create(ctx, root, "a", 0644)
+		require.NoError(t, err)
+
+		require.Equal(t, fs.ErrNoSpace, f.Ops.Truncate(ctx, f, 1<<62))
+		require.Equal(t, fs.ErrNoSpace, f.Ops.Truncate(ctx, f, DefaultSize+1))
+		require.Equal(t, int64(0), tfs.Usage())
+
+		w, err := f.Ops.Writer(f)
+		require.NoError(t, err)
+
+		_, err = w.Seek(1<<62, io.SeekStart)
+		require.NoError(t, err)
+
+		_, err = w.Write([]byte("x"))
+		require.Equal(t, fs.ErrNoSpace, err)
+
+		_, err = w.Seek(math.MaxInt64, io.SeekStart)
+		require.NoError(t, err)
+
+		_, err = w.Write([]byte("x"))
+		require.Equal(t, fs.ErrFileTooBig, err)
+
+		require.NoError(t, f.Ops.Truncate(ctx, f, 1<<20))
+		require.Equal(t, int64(1<<20), tfs.Usage())
+	})
+
+	t.Run("gives new inodes to their creator", func(t *testing.T) {
+		root, err := NewTmpFS(Options{}).Root()
+		require.NoError(t, err)
+
+		user := auth.ContextWithCredentials(ctx, auth.New(1000, 100))
+
+		f, err := root.Ops.Create(user, root, "a", 0644)
+		require.NoError(t, err)
+
+		attr, err := f.Ops.UnstableAttr(ctx, f)
+		require.NoError(t, err)
+		require.Equal(t, 1000, attr.UserId)
+		require.Equal(t, 100, attr.GroupId)
+
+		// A setgid directory gives its group instead, and passes the bit on
+		// to subdirectories.
+		require.NoError(t, root.Ops.CreateDirectory(ctx, root, "shared", 02775))
+		require.NoError(t, root.Ops.SetOwner(ctx, root, 0, 50))
+
+		shared, err := root.Ops.LookupChild(ctx, root, "shared")
+		require.NoError(t, err)
+		require.NoError(t, shared.Ops.SetOwner(ctx, shared, 0, 50))
+
+		require.NoError(t, shared.Ops.CreateDirectory(user, shared, "sub", 0755))
+
+		sub, err := shared.Ops.LookupChild(ctx, shared, "sub")
+		require.NoError(t, err)
+
+		attr, err = sub.Ops.UnstableAttr(ctx, sub)
+		require.NoError(t, err)
+		require.Equal(t, 1000, attr.UserId)
+		require.Equal(t, 50, attr.GroupId)
+		require.Equal(t, 02755, attr.Perms)
+	})
+
+	t.Run("parses mount options", func(t *testing.T) {
+		opts, err := ParseOptions("size=64m,nr_inodes=1k,mode=700,uid=1,gid=2")
+		require.NoError(t, err)
+
+		require.Equal(t, Options{Size: 64 << 20, Inodes: 1024, Mode: 0700, UID: 1, GID: 2}, opts)
+
+		_, err = ParseOptions("bogus")
+		require.Error(t, err)
+	})
+}
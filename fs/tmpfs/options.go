@@ -0,0 +1,93 @@
+package tmpfs
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	fs.RegisterFilesystem("tmpfs", func(ctx context.Context, source, data string) (*fs.Inode, error) {
+		opts, err := ParseOptions(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewTmpFS(opts).Root()
+	})
+}
+
+// ParseOptions parses mount options in the form Linux's tmpfs takes them:
+// a comma separated list of size=N[k|m|g], nr_inodes=N[k|m|g], mode=OCTAL,
+// uid=N and gid=N.
+func ParseOptions(data string) (Options, error) {
+	var opts Options
+
+	for _, opt := range strings.Split(data, ",") {
+		if opt == "" || opt == "rw" {
+			continue
+		}
+
+		idx := strings.IndexByte(opt, '=')
+		if idx == -1 {
+			return opts, errors.Wrapf(fs.ErrInvalid, "tmpfs option: %s", opt)
+		}
+
+		key, val := opt[:idx], opt[idx+1:]
+
+		var err error
+
+		switch key {
+		case "size":
+			opts.Size, err = parseSize(val)
+		case "nr_inodes":
+			opts.Inodes, err = parseSize(val)
+		case "mode":
+			var mode int64
+			mode, err = strconv.ParseInt(val, 8, 32)
+			opts.Mode = int(mode) & 07777
+		case "uid":
+			opts.UID, err = strconv.Atoi(val)
+		case "gid":
+			opts.GID, err = strconv.Atoi(val)
+		default:
+			return opts, errors.Wrapf(fs.ErrInvalid, "tmpfs option: %s", opt)
+		}
+
+		if err != nil {
+			return opts, errors.Wrapf(fs.ErrInvalid, "tmpfs option %s: %s", opt, err)
+		}
+	}
+
+	return opts, nil
+}
+
+// parseSize parses a count with an optional k, m or g suffix.
+func parseSize(val string) (int64, error) {
+	mult := int64(1)
+
+	if val != "" {
+		switch val[len(val)-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		}
+
+		if mult != 1 {
+			val = val[:len(val)-1]
+		}
+	}
+
+	n, err := strconv.ParseUint(val, 10, 63)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(n) * mult, nil
+}
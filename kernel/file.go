@@ -12,14 +12,21 @@ type DirContext struct {
 }
 
 type File struct {
-	mu          sync.Mutex
-	refs        int
-	CloseOnExec bool
+	mu   sync.Mutex
+	refs int
+
+	// NonBlocking is set by O_NONBLOCK. Calls on the file that would block
+	// fail instead, though only sockets and terminals honour it so far.
+	NonBlocking bool
 
 	Dirent *fs.Dirent
 	r      io.ReadCloser
 	w      io.WriteCloser
 
+	// handle is what the file was opened as, before it was adapted into r
+	// and w.
+	handle interface{}
+
 	Context interface{}
 }
 
@@ -39,7 +46,29 @@ func (f *File) Reader() (io.Reader, bool) {
 	return f.r, true
 }
 
-func (f *File) incRef() {
+// Handle returns what the file was opened as: the handle from its inode, or
+// the stream it was created with. ioctl(2) looks to it for the operations
+// it supports.
+func (f *File) Handle() interface{} {
+	return f.handle
+}
+
+// NewFile returns a file for handle, which wasn't opened from a filesystem,
+// like a socket. dirent is what the file appears as in /proc/[pid]/fd.
+// Closing the file closes handle.
+func NewFile(dirent *fs.Dirent, handle io.ReadWriteCloser) *File {
+	return &File{
+		refs:   1,
+		Dirent: dirent,
+		r:      handle,
+		w:      noCloseWriter{handle},
+		handle: handle,
+	}
+}
+
+// IncRef takes another reference to the file, which Close drops, as when
+// it's duplicated into another descriptor.
+func (f *File) IncRef() {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
@@ -73,3 +102,53 @@ func (f *File) Close() error {
 
 	return err
 }
+
+// fileWriter adapts the writer of an inode for a File, implementing
+// O_APPEND and closing the writer if it needs to be.
+type fileWriter struct {
+	io.WriteSeeker
+	append bool
+}
+
+func (w *fileWriter) Write(b []byte) (int, error) {
+	if w.append {
+		_, err := w.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return w.WriteSeeker.Write(b)
+}
+
+// readCloser adapts the reader of an inode for a File, closing it if it
+// needs to be.
+type readCloser struct {
+	io.Reader
+}
+
+func (r readCloser) Close() error {
+	if c, ok := r.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+func (w *fileWriter) Close() error {
+	if c, ok := w.WriteSeeker.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// noCloseWriter is the writer of a file whose handle is closed through its
+// reader.
+type noCloseWriter struct {
+	io.Writer
+}
+
+func (noCloseWriter) Close() error {
+	return nil
+}
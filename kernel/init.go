@@ -5,8 +5,11 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"time"
 
+	"github.com/evanphx/columbia/auth"
 	"github.com/evanphx/columbia/exec"
+	"github.com/evanphx/columbia/fs"
 	"github.com/evanphx/columbia/loader"
 	"github.com/evanphx/columbia/log"
 	"github.com/evanphx/columbia/memory"
@@ -20,19 +23,47 @@ func (k *Kernel) StartProcess(proc *Process) error {
 var ErrNoStart = errors.New("no _start function defined")
 
 func (k *Kernel) InitProcess(ctx context.Context, path string, args []string, env []string, root string) (*Process, error) {
-	proc := &Process{
-		Kernel: k,
-		pg:     &ProcessGroup{},
-		cwd:    "/",
-	}
-
-	k.processes.AssignPid(proc)
+	proc := k.NewProcess("/")
 
 	err := proc.SetupHost(root) // Tar("tmp/test.tar")
 	if err != nil {
 		return nil, err
 	}
 
+	return k.startInit(ctx, proc, path, args, env)
+}
+
+// InitProcessInNamespace creates the init process inside an already
+// assembled mount namespace, such as the root filesystem of an image.
+func (k *Kernel) InitProcessInNamespace(ctx context.Context, mount *fs.MountNamespace, cwd, path string, args []string, env []string) (*Process, error) {
+	proc := k.NewProcess(cwd)
+	proc.Mount = mount
+
+	return k.startInit(ctx, proc, path, args, env)
+}
+
+// NewProcess creates a process in a process group and session of its own,
+// which isn't running a program until one is set up.
+func (k *Kernel) NewProcess(cwd string) *Process {
+	proc := &Process{
+		Kernel:  k,
+		pg:      &ProcessGroup{},
+		uts:     k.uts,
+		creds:   auth.New(0, 0),
+		umask:   0022,
+		cwd:     cwd,
+		started: time.Now(),
+	}
+
+	k.processes.AssignPid(proc)
+
+	proc.pgid = proc.Pid
+	proc.sid = proc.Pid
+
+	return proc
+}
+
+func (k *Kernel) startInit(ctx context.Context, proc *Process, path string, args []string, env []string) (*Process, error) {
 	log.L.Trace("setting up process")
 
 	task := &Task{Process: proc}
@@ -50,6 +81,15 @@ func (k *Kernel) SetupProcess(ctx context.Context, proc *Process, path string, a
 		return nil, err
 	}
 
+	if dirent.Inode.StableAttr.Type != fs.RegularFile {
+		return nil, fs.ErrPermission
+	}
+
+	err = fs.CheckAccess(ctx, dirent.Inode, auth.MayExec)
+	if err != nil {
+		return nil, err
+	}
+
 	r, err := dirent.Reader()
 	if err != nil {
 		return nil, err
@@ -61,8 +101,18 @@ func (k *Kernel) SetupProcess(ctx context.Context, proc *Process, path string, a
 		return nil, err
 	}
 
+	limits := m.Module.Memory.Entries[0].Limits
+
+	maximum := int32(-1)
+	if limits.Flags&1 != 0 {
+		maximum = memory.MaxPages
+		if limits.Maximum < memory.MaxPages {
+			maximum = int32(limits.Maximum)
+		}
+	}
+
 	virtmem := memory.NewVirtualMemory()
-	_, err = virtmem.NewRegion(0, int32(m.Module.Memory.Entries[0].Limits.Initial)*memory.WasmPageSize)
+	_, err = virtmem.NewHeap(int32(limits.Initial), maximum)
 	if err != nil {
 		return nil, err
 	}
@@ -91,6 +141,14 @@ func (k *Kernel) SetupProcess(ctx context.Context, proc *Process, path string, a
 
 	proc.EntryIndex = int64(entry.Index)
 
+	proc.SetProgram(dirent.Path(), args, env)
+
+	// The program starts with the capabilities execve(2) leaves it.
+	proc.UpdateCredentials(func(creds *auth.Credentials) error {
+		creds.Exec()
+		return nil
+	})
+
 	ent, ok := m.Module.Export.Entries["__heap_base"]
 	if !ok {
 		return nil, fmt.Errorf("no __heap_base")
@@ -0,0 +1,165 @@
+package kernel
+
+import (
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/tty"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoProcess    = errors.New("no such process")
+	ErrNotPermitted = errors.New("operation not permitted")
+	ErrInvalidGroup = errors.New("invalid process group")
+)
+
+// Pgid returns the process group of the process.
+func (p *Process) Pgid() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pgid
+}
+
+// Sid returns the session of the process.
+func (p *Process) Sid() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.sid
+}
+
+// SetPgid moves target, which must be p or one of its children, into the
+// process group pgid of p's session. A pgid of 0 or target's pid puts it in
+// a new group of its own.
+func (p *Process) SetPgid(target *Process, pgid int) error {
+	if target != p && target.Parent() != p {
+		return ErrNoProcess
+	}
+
+	sid := p.Sid()
+
+	target.mu.Lock()
+	defer target.mu.Unlock()
+
+	if target.sid != sid || target.Pid == target.sid {
+		return ErrNotPermitted
+	}
+
+	if pgid == 0 {
+		pgid = target.Pid
+	}
+
+	if pgid != target.Pid && !p.Kernel.groupInSession(pgid, sid, target) {
+		return ErrNotPermitted
+	}
+
+	target.pgid = pgid
+
+	return nil
+}
+
+// groupInSession reports whether any process other than except is in the
+// process group pgid of session sid.
+func (k *Kernel) groupInSession(pgid, sid int, except *Process) bool {
+	for _, proc := range k.Processes() {
+		if proc == except || proc.Status() == Dead {
+			continue
+		}
+
+		if proc.Pgid() == pgid && proc.Sid() == sid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Setsid makes p the leader of a new session and process group, without a
+// controlling terminal. A process group leader can't start a session, since
+// its group would be split between two.
+func (p *Process) Setsid() (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pgid == p.Pid {
+		return 0, ErrNotPermitted
+	}
+
+	p.sid = p.Pid
+	p.pgid = p.Pid
+	p.ctty = nil
+
+	return p.sid, nil
+}
+
+// ControllingTerminal returns the controlling terminal of p's session, or
+// nil if it has none.
+func (p *Process) ControllingTerminal() *tty.Terminal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.ctty
+}
+
+// SetControllingTerminal makes t the controlling terminal of the session p
+// leads, with p's process group in the foreground. A terminal that controls
+// another session is only taken with steal.
+func (p *Process) SetControllingTerminal(t *tty.Terminal, steal bool) error {
+	p.mu.Lock()
+	sid, pgid, ctty := p.sid, p.pgid, p.ctty
+	p.mu.Unlock()
+
+	if p.Pid != sid {
+		return ErrNotPermitted
+	}
+
+	if ctty == t {
+		return nil
+	}
+
+	if ctty != nil {
+		return ErrNotPermitted
+	}
+
+	err := t.SetSession(sid, pgid, steal)
+	if err != nil {
+		return err
+	}
+
+	for _, proc := range p.Kernel.Processes() {
+		proc.mu.Lock()
+
+		if proc.sid == sid {
+			proc.ctty = t
+		}
+
+		proc.mu.Unlock()
+	}
+
+	return nil
+}
+
+// SignalGroup sends signo to every live process in the process group pgid.
+func (k *Kernel) SignalGroup(pgid int, signo linux.Signal) {
+	for _, proc := range k.Processes() {
+		if proc.Pgid() == pgid && proc.Status() != Dead {
+			proc.DeliverSignal(int(signo))
+		}
+	}
+}
+
+// SetForeground puts the process group pgid of p's session in the
+// foreground of t, which must be the session's controlling terminal.
+func (p *Process) SetForeground(t *tty.Terminal, pgid int) error {
+	sid := p.Sid()
+
+	if pgid <= 0 {
+		return ErrInvalidGroup
+	}
+
+	if !p.Kernel.groupInSession(pgid, sid, nil) {
+		return ErrNotPermitted
+	}
+
+	return t.SetForeground(sid, pgid)
+}
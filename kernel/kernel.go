@@ -1,7 +1,13 @@
 package kernel
 
 import (
+	"sync"
+	"time"
+
+	"github.com/evanphx/columbia/auth"
 	"github.com/evanphx/columbia/loader"
+	"github.com/evanphx/columbia/netpolicy"
+	"github.com/evanphx/columbia/netstack"
 	"github.com/evanphx/columbia/wasm"
 )
 
@@ -10,6 +16,26 @@ type Kernel struct {
 	loaderCache *loader.LoaderCache
 
 	processes *ProcessManager
+
+	net *netstack.Stack
+
+	// policy is set when sockets pass through to the host's network.
+	policy *netpolicy.Policy
+
+	// uts is the UTS namespace processes start in.
+	uts *UTSNamespace
+
+	// uidMap and gidMap map the guest's ids onto the host's, for the files
+	// of host filesystems.
+	uidMap, gidMap auth.IDMap
+
+	started time.Time
+
+	mu sync.Mutex
+
+	// locals holds the state packages built on the kernel keep for it, by
+	// the keys they own.
+	locals map[interface{}]interface{}
 }
 
 func NewKernel(env *wasm.Module) (*Kernel, error) {
@@ -17,6 +43,9 @@ func NewKernel(env *wasm.Module) (*Kernel, error) {
 		env:         env,
 		loaderCache: loader.NewLoaderCache(),
 		processes:   NewProcessManager(),
+		net:         netstack.New(),
+		uts:         NewUTSNamespace(DefaultVersion),
+		started:     time.Now(),
 	}
 
 	return k, nil
@@ -25,3 +54,78 @@ func NewKernel(env *wasm.Module) (*Kernel, error) {
 func (k *Kernel) EnvModule() *wasm.Module {
 	return k.env
 }
+
+// BootTime returns when the kernel was started.
+func (k *Kernel) BootTime() time.Time {
+	return k.started
+}
+
+// Processes returns every process, sorted by pid.
+func (k *Kernel) Processes() []*Process {
+	return k.processes.List()
+}
+
+// FindProcess returns the process with pid.
+func (k *Kernel) FindProcess(pid int) (*Process, bool) {
+	return k.processes.Lookup(pid)
+}
+
+// Network returns the kernel's network stack, which its AF_INET and
+// AF_INET6 sockets are on.
+func (k *Kernel) Network() *netstack.Stack {
+	return k.net
+}
+
+// SetNetworkPolicy makes the AF_INET and AF_INET6 sockets created from now
+// on pass through to host sockets, rather than use the kernel's stack, and
+// only reach what policy allows. It's meant to be called before the first
+// process starts.
+func (k *Kernel) SetNetworkPolicy(policy *netpolicy.Policy) {
+	k.policy = policy
+}
+
+// NetworkPolicy returns the policy set by SetNetworkPolicy, or nil if
+// sockets use the kernel's stack.
+func (k *Kernel) NetworkPolicy() *netpolicy.Policy {
+	return k.policy
+}
+
+// UTSNamespace returns the UTS namespace processes start in, whose names
+// can be set before the first process starts.
+func (k *Kernel) UTSNamespace() *UTSNamespace {
+	return k.uts
+}
+
+// SetIDMaps maps the uids and gids of the guest onto the host's, for the
+// ownership of files on host filesystems. A nil map leaves ids as they
+// are. It's meant to be called before any host filesystem is created.
+func (k *Kernel) SetIDMaps(uids, gids auth.IDMap) {
+	k.uidMap, k.gidMap = uids, gids
+}
+
+// IDMaps returns the uid and gid maps set by SetIDMaps.
+func (k *Kernel) IDMaps() (auth.IDMap, auth.IDMap) {
+	return k.uidMap, k.gidMap
+}
+
+// Local returns the state kept for the kernel under key, making it with
+// create the first time. Packages built on the kernel, like the unix
+// sockets and their abstract namespace, keep their state with it this way
+// rather than in globals, with a key of an unexported type, as for a
+// context.Value.
+func (k *Kernel) Local(key interface{}, create func() interface{}) interface{} {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	v, ok := k.locals[key]
+	if !ok {
+		if k.locals == nil {
+			k.locals = make(map[interface{}]interface{})
+		}
+
+		v = create()
+		k.locals[key] = v
+	}
+
+	return v
+}
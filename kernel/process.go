@@ -4,14 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
-	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
 	"github.com/evanphx/columbia/exec"
 	"github.com/evanphx/columbia/fs"
 	"github.com/evanphx/columbia/fs/host"
@@ -19,6 +21,8 @@ import (
 	"github.com/evanphx/columbia/log"
 	"github.com/evanphx/columbia/memory"
 	"github.com/evanphx/columbia/pkg/ilist"
+	"github.com/evanphx/columbia/tty"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -85,6 +89,10 @@ type Process struct {
 	exitStatus ExitStatus
 	fds        []*File
 
+	// closeOnExec holds the descriptors with FD_CLOEXEC set. It's a flag of
+	// the descriptor rather than the file, which others may share.
+	closeOnExec map[int]bool
+
 	waiters []chan int
 
 	signals       Signals
@@ -92,6 +100,28 @@ type Process struct {
 
 	cwd string
 
+	// uts is the UTS namespace, which is shared with the processes forked
+	// in it.
+	uts *UTSNamespace
+
+	// creds are replaced, never changed, so they can be handed out.
+	creds *auth.Credentials
+
+	// umask is cleared from the permissions of the files the process
+	// creates.
+	umask int
+
+	// pgid and sid are the process group and session the process belongs
+	// to for job control, and ctty the controlling terminal of the
+	// session.
+	pgid, sid int
+	ctty      *tty.Terminal
+
+	// exe, args and env are what the running program was started with.
+	exe       string
+	args, env []string
+	started   time.Time
+
 	mu sync.Mutex
 }
 
@@ -99,6 +129,135 @@ func (p *Process) Curwd() string {
 	return p.cwd
 }
 
+// Parent returns the process that forked p, or nil for init.
+func (p *Process) Parent() *Process {
+	return p.parent
+}
+
+// Status returns whether the process is running or has exited.
+func (p *Process) Status() ProcessStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.status
+}
+
+// SetProgram records the program the process runs and what it was started
+// with.
+func (p *Process) SetProgram(exe string, args, env []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.exe = exe
+	p.args = args
+	p.env = env
+}
+
+// Exe returns the path of the program the process is running.
+func (p *Process) Exe() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.exe
+}
+
+// Args returns the arguments the program was started with.
+func (p *Process) Args() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.args
+}
+
+// Environ returns the environment the program was started with.
+func (p *Process) Environ() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.env
+}
+
+// StartTime returns when the process was created.
+func (p *Process) StartTime() time.Time {
+	return p.started
+}
+
+// Files returns the open files, indexed by descriptor. Closed descriptors
+// are nil.
+func (p *Process) Files() []*File {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]*File(nil), p.fds...)
+}
+
+// Credentials returns the ids the process runs as, which mustn't be
+// changed.
+func (p *Process) Credentials() *auth.Credentials {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.creds
+}
+
+// SetCredentials makes the process run as creds, which become its own.
+func (p *Process) SetCredentials(creds *auth.Credentials) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.creds = creds
+}
+
+// SetUser makes the process run as uid and gid in every respect, without
+// supplementary groups.
+func (p *Process) SetUser(uid, gid int) {
+	p.SetCredentials(auth.New(uid, gid))
+}
+
+// UpdateCredentials changes the process's credentials with fn, which is
+// given a copy of them to change. If fn fails, they're left as they were.
+func (p *Process) UpdateCredentials(fn func(*auth.Credentials) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	creds := p.creds.Copy()
+
+	if err := fn(creds); err != nil {
+		return err
+	}
+
+	p.creds = creds
+
+	return nil
+}
+
+// User returns the effective user and group the process acts as.
+func (p *Process) User() (int, int) {
+	creds := p.Credentials()
+
+	return creds.EffectiveUID, creds.EffectiveGID
+}
+
+// Umask returns the permissions cleared from the files the process
+// creates.
+func (p *Process) Umask() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.umask
+}
+
+// SetUmask changes the umask of the process, returning the old one.
+func (p *Process) SetUmask(mask int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := p.umask
+	p.umask = mask & 0777
+
+	return old
+}
+
 func (p *Process) PrintStack() {
 	stack := p.Vm.Backtrace()
 	os.Stderr.Write(stack)
@@ -122,11 +281,7 @@ func (p *Process) SetupTar(path string) error {
 		return err
 	}
 
-	p.Mount = fs.NewMountNamespace()
-	p.Mount.Root = &fs.Dirent{
-		Name:  "/",
-		Inode: root,
-	}
+	p.SetupRoot(root)
 
 	return nil
 }
@@ -137,20 +292,49 @@ func (p *Process) SetupHost(path string) error {
 		return err
 	}
 
+	hf.SetIDMaps(p.Kernel.IDMaps())
+
 	root, err := hf.Root()
 	if err != nil {
 		return err
 	}
 
-	p.Mount = fs.NewMountNamespace()
-	p.Mount.Root = &fs.Dirent{
-		Name:  "/",
-		Inode: root,
-	}
+	p.SetupRoot(root)
 
 	return nil
 }
 
+// SetupRoot gives the process a new mount namespace rooted at root.
+func (p *Process) SetupRoot(root *fs.Inode) {
+	p.Mount = fs.NewMountNamespace()
+	p.Mount.SetRoot(root)
+}
+
+// UnshareMount gives the process a private copy of its mount namespace.
+func (p *Process) UnshareMount() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.Mount = p.Mount.Clone()
+}
+
+// UTSNamespace returns the process's UTS namespace, which it shares with
+// the processes it forks.
+func (p *Process) UTSNamespace() *UTSNamespace {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.uts
+}
+
+// UnshareUTS gives the process a private copy of its UTS namespace.
+func (p *Process) UnshareUTS() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.uts = p.uts.Clone()
+}
+
 func (p *Process) ReadCString(ptr int32) ([]byte, error) {
 	var buf bytes.Buffer
 
@@ -194,18 +378,24 @@ func (p *Process) CopyIn(addr int32, val interface{}) error {
 
 func (p *Process) HookupStdio(i io.ReadCloser, o, e io.WriteCloser) {
 	p.fds = append(p.fds, &File{
-		refs: 1,
-		r:    i,
+		refs:   1,
+		r:      i,
+		handle: i,
+		Dirent: newStreamDirent("host:[stdin]", i, nil),
 	})
 
 	p.fds = append(p.fds, &File{
-		refs: 1,
-		w:    o,
+		refs:   1,
+		w:      o,
+		handle: o,
+		Dirent: newStreamDirent("host:[stdout]", nil, o),
 	})
 
 	p.fds = append(p.fds, &File{
-		refs: 1,
-		w:    e,
+		refs:   1,
+		w:      e,
+		handle: e,
+		Dirent: newStreamDirent("host:[stderr]", nil, e),
 	})
 }
 
@@ -215,16 +405,21 @@ func (p *Process) CreatePipe() (*File, int, *File, int, error) {
 
 	pread, pwrite := io.Pipe()
 
+	// Both ends share an inode, as on Linux.
+	dirent := newStreamDirent("", pread, pwrite)
+
 	rfd := len(p.fds)
 
 	read := &File{
-		refs: 1,
-		r:    pread,
+		refs:   1,
+		r:      pread,
+		Dirent: dirent,
 	}
 
 	write := &File{
-		refs: 1,
-		w:    pwrite,
+		refs:   1,
+		w:      pwrite,
+		Dirent: dirent,
 	}
 
 	p.fds = append(p.fds, read, write)
@@ -232,50 +427,273 @@ func (p *Process) CreatePipe() (*File, int, *File, int, error) {
 	return read, rfd, write, rfd + 1, nil
 }
 
-func (p *Process) OpenFile(ctx context.Context, path string, mode int) (int, error) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
+// OpenFile opens path according to the open(2) flags, creating it with
+// perms when O_CREAT is given and it doesn't exist.
+func (p *Process) OpenFile(ctx context.Context, path string, flags, perms int) (int, error) {
 	if !filepath.IsAbs(path) {
-		path = filepath.Join(p.Curwd(), path)
+		path = fs.JoinPath(p.Curwd(), path)
 	}
 
+	access := flags & linux.O_ACCMODE
+
 	ent, err := p.Mount.LookupPath(ctx, path)
-	if err != nil {
+	switch {
+	case err == nil:
+		if flags&(linux.O_CREAT|linux.O_EXCL) == linux.O_CREAT|linux.O_EXCL {
+			return 0, fs.ErrExists
+		}
+
+		err = fs.CheckAccess(ctx, ent.Inode, openMode(access, flags))
+		if err != nil {
+			return 0, err
+		}
+
+		// Devices, pipes and sockets can be written on a read-only
+		// mount, since that doesn't change the filesystem.
+		switch ent.Inode.StableAttr.Type {
+		case fs.CharacterDevice, fs.BlockDevice, fs.Pipe, fs.Socket:
+		default:
+			if openMode(access, flags)&auth.MayWrite != 0 {
+				err = fs.CheckWrite(ent)
+				if err != nil {
+					return 0, err
+				}
+			}
+		}
+	case errors.Cause(err) == fs.ErrUnknownPath && flags&linux.O_CREAT != 0:
+		// A new file is opened as asked whatever perms it's given.
+		ent, err = p.createFile(ctx, path, perms)
+		if err != nil {
+			return 0, err
+		}
+	default:
 		return 0, err
 	}
 
-	if mode&linux.O_DIRECTORY != 0 {
-		fd := len(p.fds)
+	file := &File{
+		refs:        1,
+		Dirent:      ent,
+		NonBlocking: flags&linux.O_NONBLOCK != 0,
+	}
+
+	switch ent.Inode.StableAttr.Type {
+	case fs.Directory, fs.SpecialDirectory:
+		if access != linux.O_RDONLY {
+			return 0, fs.ErrIsDirectory
+		}
+
+		file.Context = &DirContext{}
+	default:
+		if flags&linux.O_DIRECTORY != 0 {
+			return 0, fs.ErrNotDirectory
+		}
 
-		dir := &File{
-			refs:    1,
-			Dirent:  ent,
-			Context: &DirContext{},
+		// O_TRUNC is ignored for anything but a regular file, so that
+		// redirecting to a device or pipe works.
+		if access != linux.O_RDONLY && flags&linux.O_TRUNC != 0 && ent.Inode.StableAttr.Type == fs.RegularFile {
+			err = ent.Inode.Ops.Truncate(ctx, ent.Inode, 0)
+			if err != nil {
+				return 0, err
+			}
 		}
 
-		p.fds = append(p.fds, dir)
+		err = openIO(ctx, file, access, flags&linux.O_APPEND != 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// The lock is only taken now, since looking up the path can need it,
+	// like when the path leads through /proc/self/fd.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.addFile(file, flags&linux.O_CLOEXEC != 0), nil
+}
+
+// AddFile gives file the next descriptor of the process, closed on exec if
+// closeOnExec is set, and returns it. The reference to file passes to the
+// process.
+func (p *Process) AddFile(file *File, closeOnExec bool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.addFile(file, closeOnExec)
+}
+
+// addFile is AddFile with p.mu held.
+func (p *Process) addFile(file *File, closeOnExec bool) int {
+	fd := len(p.fds)
+
+	p.fds = append(p.fds, file)
+	p.setCloseOnExec(fd, closeOnExec)
+
+	return fd
+}
+
+func (p *Process) setCloseOnExec(fd int, set bool) {
+	switch {
+	case set && p.closeOnExec == nil:
+		p.closeOnExec = map[int]bool{fd: true}
+	case set:
+		p.closeOnExec[fd] = true
+	default:
+		delete(p.closeOnExec, fd)
+	}
+}
+
+// CloseOnExec reports whether FD_CLOEXEC is set on fd.
+func (p *Process) CloseOnExec(fd int) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		return fd, nil
+	if fd < 0 || fd >= len(p.fds) || p.fds[fd] == nil {
+		return false, ErrUnknownFile
 	}
 
-	// TODO actually consult the mode
+	return p.closeOnExec[fd], nil
+}
+
+// SetCloseOnExec sets or clears FD_CLOEXEC on fd, leaving other
+// descriptors for the same file as they are.
+func (p *Process) SetCloseOnExec(fd int, set bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if fd < 0 || fd >= len(p.fds) || p.fds[fd] == nil {
+		return ErrUnknownFile
+	}
 
-	r, err := ent.Reader()
+	p.setCloseOnExec(fd, set)
+
+	return nil
+}
+
+// openMode returns the access opening a file with flags needs.
+func openMode(access, flags int) int {
+	var mode int
+
+	switch access {
+	case linux.O_RDONLY:
+		mode = auth.MayRead
+	case linux.O_WRONLY:
+		mode = auth.MayWrite
+	case linux.O_RDWR:
+		mode = auth.MayRead | auth.MayWrite
+	}
+
+	if flags&linux.O_TRUNC != 0 {
+		mode |= auth.MayWrite
+	}
+
+	return mode
+}
+
+// createFile creates the regular file at path, which must not exist, with
+// perms less the umask.
+func (p *Process) createFile(ctx context.Context, path string, perms int) (*fs.Dirent, error) {
+	parent, name, err := p.Mount.LookupParent(ctx, path)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	fd := len(p.fds)
+	err = fs.CheckAccess(ctx, parent.Inode, auth.MayWrite|auth.MayExec)
+	if err != nil {
+		return nil, err
+	}
 
-	read := &File{
-		refs: 1,
-		r:    ioutil.NopCloser(r),
+	err = fs.CheckWrite(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	inode, err := parent.Inode.Ops.Create(ctx, parent.Inode, name, perms&07777&^p.Umask())
+	if err != nil {
+		return nil, err
+	}
+
+	return &fs.Dirent{Inode: inode, Parent: parent, Name: name, Mount: parent.Mount}, nil
+}
+
+// openIO sets up the reader and writer of file for the access mode.
+func openIO(ctx context.Context, file *File, access int, appending bool) error {
+	inode := file.Dirent.Inode
+
+	if opener, ok := inode.Ops.(fs.Opener); ok {
+		return openHandle(ctx, file, opener, access, appending)
+	}
+
+	switch access {
+	case linux.O_RDONLY:
+		r, err := inode.Ops.Reader(inode)
+		if err != nil {
+			return err
+		}
+
+		file.r = readCloser{r}
+		file.handle = r
+	case linux.O_WRONLY:
+		w, err := inode.Ops.Writer(inode)
+		if err != nil {
+			return err
+		}
+
+		file.w = &fileWriter{WriteSeeker: w, append: appending}
+		file.handle = w
+	case linux.O_RDWR:
+		w, err := inode.Ops.Writer(inode)
+		if err != nil {
+			return err
+		}
+
+		fw := &fileWriter{WriteSeeker: w, append: appending}
+
+		// Both directions must share one position, so the writer has to
+		// be readable too.
+		r, ok := w.(io.Reader)
+		if !ok {
+			fw.Close()
+			return fs.ErrNotImplemented
+		}
+
+		file.r = ioutil.NopCloser(r)
+		file.w = fw
+		file.handle = w
+	default:
+		return fs.ErrInvalid
+	}
+
+	return nil
+}
+
+// openHandle sets up file with the single handle opener gives for both
+// directions.
+func openHandle(ctx context.Context, file *File, opener fs.Opener, access int, appending bool) error {
+	switch access {
+	case linux.O_RDONLY, linux.O_WRONLY, linux.O_RDWR:
+		// ok
+	default:
+		return fs.ErrInvalid
+	}
+
+	h, err := opener.Open(ctx, file.Dirent.Inode)
+	if err != nil {
+		return err
 	}
 
-	p.fds = append(p.fds, read)
+	file.handle = h
+
+	switch access {
+	case linux.O_RDONLY:
+		file.r = readCloser{h}
+	case linux.O_WRONLY:
+		file.w = &fileWriter{WriteSeeker: h, append: appending}
+	case linux.O_RDWR:
+		file.r = ioutil.NopCloser(h)
+		file.w = &fileWriter{WriteSeeker: h, append: appending}
+	}
 
-	return fd, nil
+	return nil
 }
 
 func (p *Process) Fork() (*Process, error) {
@@ -283,10 +701,20 @@ func (p *Process) Fork() (*Process, error) {
 	defer p.mu.Unlock()
 
 	child := &Process{
-		Kernel: p.Kernel,
-		parent: p,
-		pg:     p.pg,
-		cwd:    p.cwd,
+		Kernel:  p.Kernel,
+		parent:  p,
+		pg:      p.pg,
+		uts:     p.uts,
+		cwd:     p.cwd,
+		creds:   p.creds,
+		umask:   p.umask,
+		pgid:    p.pgid,
+		sid:     p.sid,
+		ctty:    p.ctty,
+		exe:     p.exe,
+		args:    p.args,
+		env:     p.env,
+		started: time.Now(),
 	}
 
 	p.Kernel.processes.AssignPid(child)
@@ -295,11 +723,11 @@ func (p *Process) Fork() (*Process, error) {
 
 	child.Mem = p.Mem.Fork()
 
-	for _, file := range p.fds {
-		if file.CloseOnExec {
+	for fd, file := range p.fds {
+		if file == nil || p.closeOnExec[fd] {
 			child.fds = append(child.fds, nil) // got to keep those indexes the same
 		} else {
-			file.incRef()
+			file.IncRef()
 			child.fds = append(child.fds, file)
 		}
 	}
@@ -307,6 +735,8 @@ func (p *Process) Fork() (*Process, error) {
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, prockey{}, &Task{child})
 
+	// The mount namespace is shared, so mounts made by either process are
+	// seen by the other.
 	child.Mount = p.Mount
 	child.Vm = p.Vm.Fork(ctx, child.Mem)
 	child.Process = exec.NewProcess(child.Vm)
@@ -349,6 +779,7 @@ func (p *Process) CloseFile(fd int) error {
 	}
 
 	p.fds[fd] = nil
+	p.setCloseOnExec(fd, false)
 
 	return file.Close()
 }
@@ -363,8 +794,9 @@ func (p *Process) Dup2(from, to int) error {
 	}
 
 	p.fds[to] = p.fds[from]
+	p.setCloseOnExec(to, false)
 
-	p.fds[to].incRef()
+	p.fds[to].IncRef()
 
 	return nil
 }
@@ -409,7 +841,13 @@ func (p *Process) WaitAnyChild(ctx context.Context, block bool) (int, ExitStatus
 }
 
 func (p *Process) Exit(code int) {
-	log.L.Trace("process-exit", "pid", p.Pid, "code", code)
+	p.exit(ExitStatus{Code: code})
+}
+
+// exit ends the process with status, either an exit code or the signal
+// that killed it.
+func (p *Process) exit(status ExitStatus) {
+	log.L.Trace("process-exit", "pid", p.Pid, "code", status.Code, "signal", status.Signo)
 
 	for _, file := range p.fds {
 		if file != nil {
@@ -419,9 +857,14 @@ func (p *Process) Exit(code int) {
 
 	p.mu.Lock()
 
-	p.exitStatus.Code = code
+	p.exitStatus = status
 	p.status = Dead
 
+	// A session's terminal is given up when its leader exits.
+	if p.Pid == p.sid && p.ctty != nil {
+		p.ctty.ReleaseSession(p.sid)
+	}
+
 	p.mu.Unlock()
 
 	p.pg.ProcessExitted(p)
@@ -482,6 +925,33 @@ func (p *ProcessManager) AssignPid(proc *Process) int {
 	return pid
 }
 
+// Lookup returns the process with pid.
+func (p *ProcessManager) Lookup(pid int) (*Process, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	proc, ok := p.processes[pid]
+	return proc, ok
+}
+
+// List returns every process, sorted by pid.
+func (p *ProcessManager) List() []*Process {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	procs := make([]*Process, 0, len(p.processes))
+
+	for _, proc := range p.processes {
+		procs = append(procs, proc)
+	}
+
+	sort.Slice(procs, func(i, j int) bool {
+		return procs[i].Pid < procs[j].Pid
+	})
+
+	return procs
+}
+
 func (p *ProcessManager) RemoveProc(proc *Process) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
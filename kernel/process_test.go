@@ -5,14 +5,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/tmpfs"
 	"github.com/stretchr/testify/require"
-	"github.com/vektra/neko"
 )
 
 func TestWait(t *testing.T) {
-	n := neko.Modern(t)
-
-	n.It("detects another process has exitted", func(t *testing.T) {
+	t.Run("detects another process has exitted", func(t *testing.T) {
 		k, err := NewKernel(nil)
 		require.NoError(t, err)
 
@@ -22,7 +22,7 @@ func TestWait(t *testing.T) {
 			pg:     &ProcessGroup{},
 		}
 
-		parent.pg.PushBack(parent)
+		parent.pg.Add(parent)
 
 		child := &Process{
 			Kernel: k,
@@ -30,7 +30,7 @@ func TestWait(t *testing.T) {
 			pg:     parent.pg,
 		}
 
-		parent.pg.PushBack(child)
+		parent.pg.Add(child)
 
 		child.Exit(1)
 
@@ -38,7 +38,7 @@ func TestWait(t *testing.T) {
 		ctx, f := context.WithTimeout(ctx, 2*time.Second)
 		defer f()
 
-		pid, ret, err := parent.WaitAnyChild(ctx)
+		pid, ret, err := parent.WaitAnyChild(ctx, true)
 		require.NoError(t, err)
 
 		require.Equal(t, 2, pid)
@@ -46,7 +46,7 @@ func TestWait(t *testing.T) {
 		require.Equal(t, 1, ret.Code)
 	})
 
-	n.It("waits for a child to exit", func(t *testing.T) {
+	t.Run("waits for a child to exit", func(t *testing.T) {
 		k, err := NewKernel(nil)
 		require.NoError(t, err)
 
@@ -56,7 +56,7 @@ func TestWait(t *testing.T) {
 			pg:     &ProcessGroup{},
 		}
 
-		parent.pg.PushBack(parent)
+		parent.pg.Add(parent)
 
 		child := &Process{
 			Kernel: k,
@@ -64,7 +64,7 @@ func TestWait(t *testing.T) {
 			pg:     parent.pg,
 		}
 
-		parent.pg.PushBack(child)
+		parent.pg.Add(child)
 
 		go func() {
 			time.Sleep(time.Second)
@@ -75,13 +75,96 @@ func TestWait(t *testing.T) {
 		ctx, f := context.WithTimeout(ctx, 5*time.Second)
 		defer f()
 
-		pid, ret, err := parent.WaitAnyChild(ctx)
+		pid, ret, err := parent.WaitAnyChild(ctx, true)
 		require.NoError(t, err)
 
 		require.Equal(t, 2, pid)
 
 		require.Equal(t, 1, ret.Code)
 	})
+}
+
+func TestCloseOnExec(t *testing.T) {
+	k, err := NewKernel(nil)
+	require.NoError(t, err)
+
+	t.Run("is a flag of the descriptor", func(t *testing.T) {
+		p := k.NewProcess("/")
+
+		read, rfd, _, wfd, err := p.CreatePipe()
+		require.NoError(t, err)
+
+		require.NoError(t, p.SetCloseOnExec(rfd, true))
+
+		read.IncRef()
+		dup := p.AddFile(read, false)
+
+		cloexec, err := p.CloseOnExec(rfd)
+		require.NoError(t, err)
+		require.True(t, cloexec)
+
+		cloexec, err = p.CloseOnExec(dup)
+		require.NoError(t, err)
+		require.False(t, cloexec)
+
+		// Another process receiving the file sets the flag for itself.
+		other := k.NewProcess("/")
+
+		read.IncRef()
+		ofd := other.AddFile(read, true)
+
+		cloexec, err = other.CloseOnExec(ofd)
+		require.NoError(t, err)
+		require.True(t, cloexec)
+
+		cloexec, err = p.CloseOnExec(dup)
+		require.NoError(t, err)
+		require.False(t, cloexec)
+
+		// dup2(2) leaves the new descriptor without it.
+		require.NoError(t, p.Dup2(rfd, wfd))
+
+		cloexec, err = p.CloseOnExec(wfd)
+		require.NoError(t, err)
+		require.False(t, cloexec)
+
+		require.NoError(t, p.CloseFile(rfd))
+
+		_, err = p.CloseOnExec(rfd)
+		require.Equal(t, ErrUnknownFile, err)
+	})
+}
+
+func TestOpenFile(t *testing.T) {
+	ctx := context.Background()
+
+	k, err := NewKernel(nil)
+	require.NoError(t, err)
+
+	t.Run("follows the read-only flag of the mount", func(t *testing.T) {
+		root, err := tmpfs.NewTmpFS(tmpfs.Options{}).Root()
+		require.NoError(t, err)
+
+		_, err = root.Ops.Create(ctx, root, "file", 0644)
+		require.NoError(t, err)
+
+		p := k.NewProcess("/")
+		p.SetupRoot(root)
+
+		require.NoError(t, p.Mount.Remount(ctx, "/", fs.MountFlags{ReadOnly: true}))
+
+		_, err = p.OpenFile(ctx, "/file", linux.O_WRONLY, 0)
+		require.Equal(t, fs.ErrReadOnly, err)
+
+		_, err = p.OpenFile(ctx, "/new", linux.O_WRONLY|linux.O_CREAT, 0644)
+		require.Equal(t, fs.ErrReadOnly, err)
 
-	n.Meow()
+		_, err = p.OpenFile(ctx, "/file", linux.O_RDONLY, 0)
+		require.NoError(t, err)
+
+		require.NoError(t, p.Mount.Remount(ctx, "/", fs.MountFlags{}))
+
+		_, err = p.OpenFile(ctx, "/file", linux.O_WRONLY, 0)
+		require.NoError(t, err)
+	})
 }
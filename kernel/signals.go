@@ -3,6 +3,7 @@ package kernel
 import (
 	"sync"
 
+	"github.com/evanphx/columbia/abi/linux"
 	"github.com/evanphx/columbia/log"
 )
 
@@ -59,8 +60,18 @@ func (s *Signals) Dequeue() (int, int64, bool) {
 	return 0, 0, false
 }
 
+// sigIgnored is recorded as the handler of signals set to SIG_IGN.
+const sigIgnored = -1
+
 func (p *Process) AddSignalHandler(signo int, handler int64) {
-	handler = int64(p.Vm.ResolveFromTable(handler))
+	switch handler {
+	case linux.SIG_DFL:
+		// Removes the handler.
+	case linux.SIG_IGN:
+		handler = sigIgnored
+	default:
+		handler = int64(p.Vm.ResolveFromTable(handler))
+	}
 
 	log.L.Trace("add-signal-handler", "signal", signo, "handler", handler)
 	p.signals.AddHandler(signo, handler)
@@ -80,8 +91,120 @@ func (p *Task) CheckInterrupt(ret int64) bool {
 		return false
 	}
 
+	switch handler {
+	case sigIgnored:
+		return false
+	case linux.SIG_DFL:
+		p.defaultAction(linux.Signal(signo))
+		return false
+	}
+
 	log.L.Trace("process-setup-signal", "signal", signo, "handler", handler)
 
 	p.Vm.SetupIntoFunction(ret, handler, uint64(signo))
 	return true
 }
+
+// defaultIgnored are the signals that are ignored unless they're handled.
+// Processes can't be stopped, so the signals that would stop them are
+// ignored too.
+var defaultIgnored = map[linux.Signal]bool{
+	linux.SIGCHLD:  true,
+	linux.SIGCONT:  true,
+	linux.SIGURG:   true,
+	linux.SIGWINCH: true,
+	linux.SIGSTOP:  true,
+	linux.SIGTSTP:  true,
+	linux.SIGTTIN:  true,
+	linux.SIGTTOU:  true,
+}
+
+// defaultAction takes the action for signo of a process that doesn't
+// handle it, which for most signals is to be killed by it.
+func (p *Process) defaultAction(signo linux.Signal) {
+	if defaultIgnored[signo] {
+		return
+	}
+
+	log.L.Trace("process-killed", "pid", p.Pid, "signal", signo)
+
+	p.exit(ExitStatus{Signo: int(signo)})
+}
+
+// Signal sends signo to target on p's behalf, as kill(2) does. p must be
+// allowed to signal target, and a signo of 0 only checks that it is.
+func (p *Process) Signal(target *Process, signo linux.Signal) error {
+	if target.Status() == Dead {
+		return ErrNoProcess
+	}
+
+	if !p.maySignal(target, signo) {
+		return ErrNotPermitted
+	}
+
+	if signo != 0 {
+		target.DeliverSignal(int(signo))
+	}
+
+	return nil
+}
+
+// maySignal reports whether p can send signo to target: with CAP_KILL,
+// or as the same user, or with SIGCONT within the same session.
+func (p *Process) maySignal(target *Process, signo linux.Signal) bool {
+	if signo == linux.SIGCONT && p.Sid() == target.Sid() {
+		return true
+	}
+
+	return p.Credentials().MaySignal(target.Credentials())
+}
+
+// Kill is kill(2): pid is a process, 0 is p's process group, -1 every
+// process but init and p, and anything less the process group -pid. A
+// signal to many processes succeeds if any of them get it.
+func (p *Process) Kill(pid int, signo linux.Signal) error {
+	if pid > 0 {
+		target, ok := p.Kernel.FindProcess(pid)
+		if !ok {
+			return ErrNoProcess
+		}
+
+		return p.Signal(target, signo)
+	}
+
+	pgid := -pid
+	if pid == 0 {
+		pgid = p.Pgid()
+	}
+
+	var (
+		err  error = ErrNoProcess
+		sent bool
+	)
+
+	for _, proc := range p.Kernel.Processes() {
+		if proc.Status() == Dead {
+			continue
+		}
+
+		if pid == -1 {
+			if proc.Pid == 1 || proc == p {
+				continue
+			}
+		} else if proc.Pgid() != pgid {
+			continue
+		}
+
+		if perr := p.Signal(proc, signo); perr != nil {
+			err = perr
+		} else {
+			sent = true
+		}
+	}
+
+	if sent {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,107 @@
+package kernel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/device"
+	"github.com/evanphx/columbia/fs"
+)
+
+// streamDevice holds the inodes of streams that aren't on any filesystem,
+// such as pipes and the stdio of the first process.
+var streamDevice = device.NewAnonDevice()
+
+// stream is the inode of a pipe-like stream. It's what a file opened
+// through /proc/[pid]/fd refers to when the original file has no path.
+type stream struct {
+	fs.StandardFileOps
+
+	r io.Reader
+	w io.Writer
+
+	created linux.Timespec
+}
+
+// newStreamDirent returns a dirent, outside of any namespace, for a stream
+// reading from r and writing to w. Either may be nil. If name is empty, it's
+// named after the inode like a Linux pipe.
+func newStreamDirent(name string, r io.Reader, w io.Writer) *fs.Dirent {
+	inode := fs.NewInode(fs.InodeStableAttr{
+		Type:            fs.Pipe,
+		DeviceID:        streamDevice.DeviceID(),
+		InodeID:         streamDevice.NextIno(),
+		BlockSize:       4096,
+		DeviceFileMajor: uint16(streamDevice.Major),
+		DeviceFileMinor: uint32(streamDevice.Minor),
+	}, &stream{r: r, w: w, created: linux.TimeToTimespec(time.Now())})
+
+	if name == "" {
+		name = fmt.Sprintf("pipe:[%d]", inode.StableAttr.InodeID)
+	}
+
+	return &fs.Dirent{Name: name, Inode: inode}
+}
+
+func (s *stream) UnstableAttr(ctx context.Context, inode *fs.Inode) (*fs.InodeUnstableAttr, error) {
+	return &fs.InodeUnstableAttr{
+		Perms:            0600,
+		AccessTime:       s.created,
+		ModificationTime: s.created,
+		StatusChangeTime: s.created,
+		Links:            1,
+	}, nil
+}
+
+func (s *stream) ReadLink(ctx context.Context, inode *fs.Inode) (string, error) {
+	return "", fs.ErrNotSymlink
+}
+
+func (s *stream) Reader(inode *fs.Inode) (io.ReadSeeker, error) {
+	if s.r == nil {
+		return nil, fs.ErrInvalid
+	}
+
+	return &streamHandle{s}, nil
+}
+
+func (s *stream) Writer(inode *fs.Inode) (io.WriteSeeker, error) {
+	if s.w == nil {
+		return nil, fs.ErrInvalid
+	}
+
+	return &streamHandle{s}, nil
+}
+
+func (s *stream) Truncate(ctx context.Context, inode *fs.Inode, size int64) error {
+	return fs.ErrInvalid
+}
+
+// streamHandle is an open stream. It's never closed, since the stream
+// belongs to the file it was reopened from.
+type streamHandle struct {
+	s *stream
+}
+
+func (h *streamHandle) Read(b []byte) (int, error) {
+	if h.s.r == nil {
+		return 0, fs.ErrInvalid
+	}
+
+	return h.s.r.Read(b)
+}
+
+func (h *streamHandle) Write(b []byte) (int, error) {
+	if h.s.w == nil {
+		return 0, fs.ErrInvalid
+	}
+
+	return h.s.w.Write(b)
+}
+
+func (h *streamHandle) Seek(offset int64, whence int) (int64, error) {
+	return 0, fs.ErrInvalid
+}
@@ -0,0 +1,116 @@
+package kernel
+
+import (
+	"sync"
+
+	"github.com/evanphx/columbia/abi/linux"
+)
+
+// Version is what uname(2) reports about the kernel itself.
+type Version struct {
+	Sysname string
+	Release string
+	Version string
+	Machine string
+}
+
+// DefaultVersion claims a Linux new enough that libcs don't refuse to run
+// on it, on the machine the guest really has.
+var DefaultVersion = Version{
+	Sysname: "Linux",
+	Release: "4.4.0",
+	Version: "#1 SMP",
+	Machine: "wasm32",
+}
+
+// UTSNamespace holds the names uname(2) reports. Processes share the
+// namespace they're forked in, so a hostname set by one is seen by all.
+type UTSNamespace struct {
+	mu sync.Mutex
+
+	version    Version
+	hostname   string
+	domainname string
+}
+
+// NewUTSNamespace returns a namespace reporting version, with the names
+// Linux starts out with.
+func NewUTSNamespace(version Version) *UTSNamespace {
+	return &UTSNamespace{
+		version:    version,
+		hostname:   "localhost",
+		domainname: "(none)",
+	}
+}
+
+// Clone returns a new namespace with the names u has now.
+func (u *UTSNamespace) Clone() *UTSNamespace {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return &UTSNamespace{
+		version:    u.version,
+		hostname:   u.hostname,
+		domainname: u.domainname,
+	}
+}
+
+func (u *UTSNamespace) Version() Version {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.version
+}
+
+func (u *UTSNamespace) SetVersion(version Version) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.version = version
+}
+
+func (u *UTSNamespace) HostName() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.hostname
+}
+
+func (u *UTSNamespace) SetHostName(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.hostname = name
+}
+
+func (u *UTSNamespace) DomainName() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.domainname
+}
+
+func (u *UTSNamespace) SetDomainName(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.domainname = name
+}
+
+// UtsName returns the struct utsname of the namespace, with each name cut
+// to UTSLen bytes.
+func (u *UTSNamespace) UtsName() linux.UtsName {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var name linux.UtsName
+
+	copy(name.Sysname[:linux.UTSLen], u.version.Sysname)
+	copy(name.Nodename[:linux.UTSLen], u.hostname)
+	copy(name.Release[:linux.UTSLen], u.version.Release)
+	copy(name.Version[:linux.UTSLen], u.version.Version)
+	copy(name.Machine[:linux.UTSLen], u.version.Machine)
+	copy(name.Domainname[:linux.UTSLen], u.domainname)
+
+	return name
+}
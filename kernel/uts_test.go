@@ -0,0 +1,53 @@
+package kernel
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUTSNamespace(t *testing.T) {
+	field := func(b []byte) string {
+		return string(bytes.TrimRight(b, "\x00"))
+	}
+
+	t.Run("reports the names", func(t *testing.T) {
+		u := NewUTSNamespace(DefaultVersion)
+		u.SetHostName("box")
+		u.SetDomainName("example.com")
+
+		name := u.UtsName()
+		require.Equal(t, "Linux", field(name.Sysname[:]))
+		require.Equal(t, "box", field(name.Nodename[:]))
+		require.Equal(t, "wasm32", field(name.Machine[:]))
+		require.Equal(t, "example.com", field(name.Domainname[:]))
+	})
+
+	t.Run("keeps the names NUL terminated", func(t *testing.T) {
+		u := NewUTSNamespace(DefaultVersion)
+		u.SetHostName(strings.Repeat("x", 100))
+
+		name := u.UtsName()
+		require.Equal(t, byte(0), name.Nodename[len(name.Nodename)-1])
+		require.Equal(t, strings.Repeat("x", 64), field(name.Nodename[:]))
+	})
+
+	t.Run("is shared until a process unshares it", func(t *testing.T) {
+		k, err := NewKernel(nil)
+		require.NoError(t, err)
+
+		a := k.NewProcess("/")
+		b := k.NewProcess("/")
+
+		k.UTSNamespace().SetHostName("box")
+		require.Equal(t, "box", b.UTSNamespace().HostName())
+
+		a.UnshareUTS()
+		a.UTSNamespace().SetHostName("other")
+
+		require.Equal(t, "other", a.UTSNamespace().HostName())
+		require.Equal(t, "box", b.UTSNamespace().HostName())
+	})
+}
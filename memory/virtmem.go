@@ -1,11 +1,37 @@
 package memory
 
 import (
+	"sort"
+
 	"github.com/pkg/errors"
 )
 
 const WasmPageSize = 65536 // (64 KB)
 
+// The address space of a process is laid out as follows:
+//
+//	0                          heapReserve                      AddressSpaceTop
+//	| heap (wasm linear memory) -> |               <- mmap regions |
+//
+// The heap starts at 0 and grows upward via memory.grow. Regions created by
+// mmap are handed out top-down starting at AddressSpaceTop and never below
+// heapReserve. A MAP_FIXED mapping may still be placed anywhere that is
+// unoccupied, including above the current end of the heap, in which case
+// the heap can not grow past it.
+const (
+	// AddressSpaceTop is the first address above the usable address space.
+	AddressSpaceTop = 0x7fff0000
+
+	// MaxPages is the largest number of wasm pages that fit in the
+	// address space.
+	MaxPages = AddressSpaceTop / WasmPageSize
+
+	// DefaultHeapReserve is the amount of the address space kept free for
+	// the heap when the module does not declare a maximum memory size, and
+	// the most that's kept when it declares a larger one.
+	DefaultHeapReserve = 0x40000000
+)
+
 type Region struct {
 	Start, Size int32
 
@@ -37,6 +63,12 @@ func (reg *Region) Contains(x int32) bool {
 	return true
 }
 
+// Overlaps returns true if any part of [start, start+size) is within
+// the region.
+func (reg *Region) Overlaps(start, size int32) bool {
+	return start < reg.Start+reg.Size && reg.Start < start+size
+}
+
 func pageRound(sz int32) int32 {
 	if sz < WasmPageSize {
 		return WasmPageSize
@@ -70,32 +102,95 @@ func (reg *Region) Project(addr, sz int32) []byte {
 type VirtualMemory struct {
 	regions []*Region
 
+	// heap is the region backing the wasm linear memory, always at 0.
+	heap *Region
+
+	// heapMax is the largest size the heap may grow to, or -1 if the
+	// module did not declare a maximum.
+	heapMax int32
+
+	// heapReserve is the lowest address mmap will place a region at
+	// unless asked for a fixed address.
+	heapReserve int32
+
+	// nextMmapStart is the end of the next region handed out by mmap.
 	nextMmapStart int32
-	size          int32
 }
 
 func NewVirtualMemory() *VirtualMemory {
 	return &VirtualMemory{
-		nextMmapStart: 0x10000,
+		heapMax:       -1,
+		heapReserve:   DefaultHeapReserve,
+		nextMmapStart: AddressSpaceTop,
 	}
 }
 
 func (vm *VirtualMemory) Fork() *VirtualMemory {
 	child := &VirtualMemory{
+		heapMax:       vm.heapMax,
+		heapReserve:   vm.heapReserve,
 		nextMmapStart: vm.nextMmapStart,
-		size:          vm.size,
 		regions:       make([]*Region, len(vm.regions)),
 	}
 
 	for i, reg := range vm.regions {
 		child.regions[i] = reg.dup()
+
+		if reg == vm.heap {
+			child.heap = child.regions[i]
+		}
 	}
 
 	return child
 }
 
+// Size returns the size of the heap, which is what memory.size reports
+// to the wasm code.
 func (vm *VirtualMemory) Size() int {
-	return int(vm.size)
+	if vm.heap == nil {
+		return 0
+	}
+
+	return int(vm.heap.Size)
+}
+
+// Mapping describes one region of the address space.
+type Mapping struct {
+	Start, Size int32
+
+	// Heap is set for the region backing the wasm linear memory.
+	Heap bool
+}
+
+// Mappings returns the regions of the address space, sorted by address.
+func (vm *VirtualMemory) Mappings() []Mapping {
+	mappings := make([]Mapping, 0, len(vm.regions))
+
+	for _, reg := range vm.regions {
+		mappings = append(mappings, Mapping{
+			Start: reg.Start,
+			Size:  reg.Size,
+			Heap:  reg == vm.heap,
+		})
+	}
+
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].Start < mappings[j].Start
+	})
+
+	return mappings
+}
+
+// Resident returns how many bytes of the address space are backed by
+// memory. Regions are only backed once they're touched.
+func (vm *VirtualMemory) Resident() int64 {
+	var total int64
+
+	for _, reg := range vm.regions {
+		total += int64(len(reg.linear))
+	}
+
+	return total
 }
 
 func (vm *VirtualMemory) FindRegion(addr int32) (*Region, bool) {
@@ -108,6 +203,21 @@ func (vm *VirtualMemory) FindRegion(addr int32) (*Region, bool) {
 	return nil, false
 }
 
+func (vm *VirtualMemory) overlapping(start, size int32) (*Region, bool) {
+	for _, reg := range vm.regions {
+		if reg.Overlaps(start, size) {
+			return reg, true
+		}
+	}
+
+	return nil, false
+}
+
+func (vm *VirtualMemory) overlaps(start, size int32) bool {
+	_, ok := vm.overlapping(start, size)
+	return ok
+}
+
 var ErrInvalidMemoryAccess = errors.New("invalid memory access via projection")
 
 func (vm *VirtualMemory) Project(addr, sz int32) ([]byte, error) {
@@ -119,32 +229,147 @@ func (vm *VirtualMemory) Project(addr, sz int32) ([]byte, error) {
 	return reg.Project(addr, sz), nil
 }
 
+var (
+	ErrNoHeap          = errors.New("no heap region defined")
+	ErrHeapExists      = errors.New("heap region already defined")
+	ErrHeapLimit       = errors.New("heap would exceed its maximum size")
+	ErrRegionCollision = errors.New("region would collide with an existing mapping")
+	ErrNoAddressSpace  = errors.New("no address space left for region")
+)
+
+// NewHeap creates the region backing the wasm linear memory at address 0.
+// initial and maximum are in wasm pages, and a negative maximum means the
+// module didn't declare one.
+func (vm *VirtualMemory) NewHeap(initial, maximum int32) (*Region, error) {
+	if vm.heap != nil {
+		return nil, ErrHeapExists
+	}
+
+	if initial > MaxPages {
+		return nil, ErrNoAddressSpace
+	}
+
+	// A maximum past the address space, like the 4GiB a wasm32 module can
+	// declare, only goes as far as the address space does.
+	if maximum > MaxPages {
+		maximum = MaxPages
+	}
+
+	if maximum >= 0 && initial > maximum {
+		return nil, ErrHeapLimit
+	}
+
+	size := initial * WasmPageSize
+
+	if vm.overlaps(0, size) {
+		return nil, ErrRegionCollision
+	}
+
+	reg := &Region{
+		Start: 0,
+		Size:  size,
+	}
+
+	vm.heap = reg
+	vm.regions = append(vm.regions, reg)
+
+	if maximum >= 0 {
+		vm.heapMax = maximum * WasmPageSize
+
+		// The heap can still grow past the reserve into what mmap hasn't
+		// used, but a large maximum mustn't leave mmap without room.
+		vm.heapReserve = vm.heapMax
+		if vm.heapReserve > DefaultHeapReserve {
+			vm.heapReserve = DefaultHeapReserve
+		}
+	}
+
+	return reg, nil
+}
+
+// Grow extends the heap by additional bytes. It fails, leaving the heap
+// untouched, if that would exceed the maximum declared by the module or
+// run into another region.
 func (vm *VirtualMemory) Grow(additional int32) error {
-	reg, ok := vm.FindRegion(0)
-	if !ok {
-		return ErrInvalidMemoryAccess
+	if vm.heap == nil {
+		return ErrNoHeap
+	}
+
+	if additional < 0 {
+		return ErrHeapLimit
+	}
+
+	if additional == 0 {
+		return nil
+	}
+
+	if int64(vm.heap.Size)+int64(additional) > AddressSpaceTop {
+		return ErrNoAddressSpace
 	}
 
-	reg.Size += additional
+	newSize := vm.heap.Size + additional
+
+	if vm.heapMax >= 0 && newSize > vm.heapMax {
+		return ErrHeapLimit
+	}
+
+	for _, reg := range vm.regions {
+		if reg != vm.heap && reg.Overlaps(vm.heap.Size, additional) {
+			return ErrRegionCollision
+		}
+	}
+
+	vm.heap.Size = newSize
 
 	return nil
 }
 
 var ErrBadRegionRequest = errors.New("bad region request")
 
+// NewRegion creates a region of size bytes. If addr is -1, the region is
+// placed below all previously allocated mmap regions, otherwise it's placed
+// at addr.
 func (vm *VirtualMemory) NewRegion(addr, size int32) (*Region, error) {
+	if size <= 0 {
+		return nil, ErrBadRegionRequest
+	}
+
+	size = pageRound(size)
+
 	if addr == -1 {
-		addr = vm.nextMmapStart
-		vm.nextMmapStart += pageRound(size + (1024 * 1024)) // TODO: something better?
+		addr = vm.nextMmapStart - size
+
+		for addr >= vm.heapReserve {
+			reg, ok := vm.overlapping(addr, size)
+			if !ok {
+				break
+			}
+
+			addr = reg.Start - size
+		}
+
+		if addr < vm.heapReserve {
+			return nil, ErrNoAddressSpace
+		}
+
+		vm.nextMmapStart = addr
 	} else {
 		reg, ok := vm.FindRegion(addr)
 		if ok {
-			if reg.Size < size {
+			if reg.Start+reg.Size < addr+size {
 				return nil, ErrBadRegionRequest
 			}
 
 			return reg, nil
 		}
+
+		if addr < 0 || int64(addr)+int64(size) > AddressSpaceTop {
+			return nil, ErrBadRegionRequest
+		}
+
+		if vm.overlaps(addr, size) {
+			return nil, ErrRegionCollision
+		}
 	}
 
 	reg := &Region{
@@ -154,11 +379,5 @@ func (vm *VirtualMemory) NewRegion(addr, size int32) (*Region, error) {
 
 	vm.regions = append(vm.regions, reg)
 
-	vm.size += size
-
-	if reg.Contains(vm.nextMmapStart) {
-		vm.nextMmapStart = pageRound(addr + size)
-	}
-
 	return reg, nil
 }
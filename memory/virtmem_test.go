@@ -0,0 +1,97 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtualMemory(t *testing.T) {
+	t.Run("reports the heap size", func(t *testing.T) {
+		vm := NewVirtualMemory()
+
+		_, err := vm.NewHeap(2, -1)
+		require.NoError(t, err)
+
+		_, err = vm.NewRegion(-1, 100)
+		require.NoError(t, err)
+
+		require.Equal(t, 2*WasmPageSize, vm.Size())
+
+		require.NoError(t, vm.Grow(WasmPageSize))
+		require.Equal(t, 3*WasmPageSize, vm.Size())
+	})
+
+	t.Run("places mmap regions away from the heap", func(t *testing.T) {
+		vm := NewVirtualMemory()
+
+		_, err := vm.NewHeap(1, 4)
+		require.NoError(t, err)
+
+		a, err := vm.NewRegion(-1, WasmPageSize)
+		require.NoError(t, err)
+
+		b, err := vm.NewRegion(-1, 10)
+		require.NoError(t, err)
+
+		require.Equal(t, int32(AddressSpaceTop-WasmPageSize), a.Start)
+		require.Equal(t, a.Start-WasmPageSize, b.Start)
+
+		require.NoError(t, vm.Grow(3*WasmPageSize))
+	})
+
+	t.Run("respects the declared maximum", func(t *testing.T) {
+		vm := NewVirtualMemory()
+
+		_, err := vm.NewHeap(1, 2)
+		require.NoError(t, err)
+
+		require.NoError(t, vm.Grow(WasmPageSize))
+		require.Equal(t, ErrHeapLimit, vm.Grow(WasmPageSize))
+		require.Equal(t, 2*WasmPageSize, vm.Size())
+	})
+
+	t.Run("leaves room for mmap under a large maximum", func(t *testing.T) {
+		vm := NewVirtualMemory()
+
+		// 4GiB, the most a wasm32 module can declare.
+		heap, err := vm.NewHeap(1, 65536)
+		require.NoError(t, err)
+
+		reg, err := vm.NewRegion(-1, 64<<20)
+		require.NoError(t, err)
+		require.True(t, reg.Start >= DefaultHeapReserve)
+
+		// The heap grows past the reserve, up to what mmap has taken.
+		require.NoError(t, vm.Grow(DefaultHeapReserve))
+		require.NoError(t, vm.Grow(reg.Start-heap.Size))
+		require.Equal(t, ErrRegionCollision, vm.Grow(WasmPageSize))
+	})
+
+	t.Run("fails to grow into a fixed mapping", func(t *testing.T) {
+		vm := NewVirtualMemory()
+
+		_, err := vm.NewHeap(1, -1)
+		require.NoError(t, err)
+
+		_, err = vm.NewRegion(3*WasmPageSize, WasmPageSize)
+		require.NoError(t, err)
+
+		require.NoError(t, vm.Grow(2*WasmPageSize))
+		require.Equal(t, ErrRegionCollision, vm.Grow(WasmPageSize))
+		require.Equal(t, 3*WasmPageSize, vm.Size())
+	})
+
+	t.Run("keeps the layout across fork", func(t *testing.T) {
+		vm := NewVirtualMemory()
+
+		_, err := vm.NewHeap(1, -1)
+		require.NoError(t, err)
+
+		child := vm.Fork()
+
+		require.NoError(t, child.Grow(WasmPageSize))
+		require.Equal(t, WasmPageSize, vm.Size())
+		require.Equal(t, 2*WasmPageSize, child.Size())
+	})
+}
@@ -0,0 +1,165 @@
+// Package netpolicy decides what guests may reach when their sockets pass
+// through to the host's network rather than using the kernel's own stack.
+package netpolicy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrBadRule = errors.New("invalid network policy rule")
+
+// Direction is which side of a connection or datagram the guest is on.
+type Direction int
+
+const (
+	// Outbound is what the guest starts: connections it makes and
+	// datagrams it sends.
+	Outbound Direction = iota
+
+	// Inbound is what comes to ports the guest listens on or binds.
+	Inbound
+)
+
+func (d Direction) String() string {
+	if d == Inbound {
+		return "in"
+	}
+
+	return "out"
+}
+
+// Rule allows traffic in one direction with the addresses of a network on
+// a range of ports. For Outbound, the addresses and ports are those the
+// guest sends to; for Inbound, the addresses are those of peers and the
+// ports those of the guest.
+type Rule struct {
+	Direction Direction
+	Network   *net.IPNet
+
+	FirstPort, LastPort int
+}
+
+// ParseRule parses a rule given as DIRECTION:CIDR:PORTS, where DIRECTION is
+// in or out and PORTS is a port, a range like 8000-8999, or * for all of
+// them. An IPv6 CIDR is given in brackets.
+func ParseRule(s string) (Rule, error) {
+	var r Rule
+
+	idx := strings.IndexByte(s, ':')
+	if idx == -1 {
+		return r, errors.Wrapf(ErrBadRule, "expected DIRECTION:CIDR:PORTS: %s", s)
+	}
+
+	switch s[:idx] {
+	case "out":
+		r.Direction = Outbound
+	case "in":
+		r.Direction = Inbound
+	default:
+		return r, errors.Wrapf(ErrBadRule, "direction must be in or out: %s", s)
+	}
+
+	rest := s[idx+1:]
+
+	idx = strings.LastIndexByte(rest, ':')
+	if idx == -1 {
+		return r, errors.Wrapf(ErrBadRule, "expected DIRECTION:CIDR:PORTS: %s", s)
+	}
+
+	cidr := strings.TrimSuffix(strings.TrimPrefix(rest[:idx], "["), "]")
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return r, errors.Wrapf(ErrBadRule, "%s: %s", s, err)
+	}
+
+	r.Network = network
+
+	ports := rest[idx+1:]
+
+	if ports == "*" {
+		r.FirstPort, r.LastPort = 0, 65535
+		return r, nil
+	}
+
+	first, last := ports, ports
+
+	if idx := strings.IndexByte(ports, '-'); idx != -1 {
+		first, last = ports[:idx], ports[idx+1:]
+	}
+
+	r.FirstPort, err = strconv.Atoi(first)
+	if err == nil {
+		r.LastPort, err = strconv.Atoi(last)
+	}
+
+	if err != nil || r.FirstPort < 1 || r.LastPort > 65535 || r.FirstPort > r.LastPort {
+		return r, errors.Wrapf(ErrBadRule, "invalid ports: %s", s)
+	}
+
+	return r, nil
+}
+
+func (r Rule) String() string {
+	ports := strconv.Itoa(r.FirstPort)
+
+	switch {
+	case r.FirstPort == 0 && r.LastPort == 65535:
+		ports = "*"
+	case r.FirstPort != r.LastPort:
+		ports += "-" + strconv.Itoa(r.LastPort)
+	}
+
+	network := r.Network.String()
+	if r.Network.IP.To4() == nil {
+		network = "[" + network + "]"
+	}
+
+	return r.Direction.String() + ":" + network + ":" + ports
+}
+
+func (r Rule) hasPort(port int) bool {
+	return port >= r.FirstPort && port <= r.LastPort
+}
+
+// matches reports whether r covers ip, taking a v4-mapped address as the
+// IPv4 one it maps.
+func (r Rule) matches(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return r.Network.Contains(ip)
+}
+
+// Policy is an allow-list: what no rule allows is denied.
+type Policy struct {
+	Rules []Rule
+}
+
+// Allows reports whether a rule in dir allows the address ip and port.
+func (p *Policy) Allows(dir Direction, ip net.IP, port int) bool {
+	for _, r := range p.Rules {
+		if r.Direction == dir && r.hasPort(port) && r.matches(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsPort reports whether some peer is allowed in to port, which the
+// guest has to be allowed to bind or listen on it.
+func (p *Policy) AllowsPort(port int) bool {
+	for _, r := range p.Rules {
+		if r.Direction == Inbound && r.hasPort(port) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,72 @@
+package netpolicy_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/evanphx/columbia/netpolicy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		in          string
+		dir         netpolicy.Direction
+		network     string
+		first, last int
+	}{
+		{"out:10.0.0.0/8:443", netpolicy.Outbound, "10.0.0.0/8", 443, 443},
+		{"in:0.0.0.0/0:8000-8999", netpolicy.Inbound, "0.0.0.0/0", 8000, 8999},
+		{"out:[2001:db8::/32]:*", netpolicy.Outbound, "2001:db8::/32", 0, 65535},
+	}
+
+	for _, tt := range tests {
+		r, err := netpolicy.ParseRule(tt.in)
+		require.NoError(t, err, tt.in)
+
+		require.Equal(t, tt.dir, r.Direction, tt.in)
+		require.Equal(t, tt.network, r.Network.String(), tt.in)
+		require.Equal(t, tt.first, r.FirstPort, tt.in)
+		require.Equal(t, tt.last, r.LastPort, tt.in)
+		require.Equal(t, tt.in, r.String())
+	}
+
+	for _, bad := range []string{
+		"out", "sideways:10.0.0.0/8:80", "out:10.0.0.0:80", "out:10.0.0.0/8",
+		"out:10.0.0.0/8:0", "out:10.0.0.0/8:70000", "out:10.0.0.0/8:90-80", "in:10.0.0.0/8:x",
+	} {
+		_, err := netpolicy.ParseRule(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	var p netpolicy.Policy
+
+	for _, s := range []string{"out:10.0.0.0/8:443", "out:[::1/128]:*", "in:192.168.0.0/16:8000-8999"} {
+		r, err := netpolicy.ParseRule(s)
+		require.NoError(t, err)
+
+		p.Rules = append(p.Rules, r)
+	}
+
+	t.Run("allows only what a rule covers", func(t *testing.T) {
+		require.True(t, p.Allows(netpolicy.Outbound, net.ParseIP("10.1.2.3"), 443))
+		require.False(t, p.Allows(netpolicy.Outbound, net.ParseIP("10.1.2.3"), 80))
+		require.False(t, p.Allows(netpolicy.Outbound, net.ParseIP("11.1.2.3"), 443))
+		require.True(t, p.Allows(netpolicy.Outbound, net.IPv6loopback, 22))
+
+		// Directions don't mix.
+		require.False(t, p.Allows(netpolicy.Inbound, net.ParseIP("10.1.2.3"), 443))
+		require.True(t, p.Allows(netpolicy.Inbound, net.ParseIP("192.168.1.1"), 8080))
+	})
+
+	t.Run("takes v4-mapped addresses as IPv4", func(t *testing.T) {
+		require.True(t, p.Allows(netpolicy.Outbound, net.ParseIP("::ffff:10.1.2.3"), 443))
+	})
+
+	t.Run("allows the ports an inbound rule covers", func(t *testing.T) {
+		require.True(t, p.AllowsPort(8000))
+		require.False(t, p.AllowsPort(443))
+	})
+}
@@ -0,0 +1,454 @@
+package netstack_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/netstack"
+	"github.com/evanphx/columbia/pkg/waiter"
+	"github.com/stretchr/testify/require"
+)
+
+var localhost = net.IPv4(127, 0, 0, 1)
+
+func TestTCP(t *testing.T) {
+	ctx := context.Background()
+
+	listen := func(t *testing.T, s *netstack.Stack, addr netstack.Address) *netstack.TCPEndpoint {
+		l := s.NewTCPEndpoint(addr.IP.To4() == nil)
+		require.NoError(t, l.Bind(addr))
+		require.NoError(t, l.Listen(10))
+
+		return l
+	}
+
+	dial := func(t *testing.T, s *netstack.Stack, l *netstack.TCPEndpoint, addr netstack.Address) (*netstack.TCPEndpoint, *netstack.TCPEndpoint) {
+		c := s.NewTCPEndpoint(addr.IP.To4() == nil)
+		require.NoError(t, c.Connect(ctx, addr, false))
+
+		conn, err := l.Accept(ctx, false)
+		require.NoError(t, err)
+
+		return c, conn
+	}
+
+	t.Run("connects over 127.0.0.1", func(t *testing.T) {
+		s := netstack.New()
+
+		l := listen(t, s, netstack.Address{IP: localhost, Port: 8080})
+
+		_, err := l.Accept(ctx, true)
+		require.Equal(t, netstack.ErrWouldBlock, err)
+
+		c, conn := dial(t, s, l, netstack.Address{IP: localhost, Port: 8080})
+
+		local := c.LocalAddress()
+		require.True(t, local.IP.Equal(localhost))
+		require.True(t, local.Port >= 32768)
+
+		remote, err := conn.RemoteAddress()
+		require.NoError(t, err)
+		require.Equal(t, local, remote)
+
+		n, err := c.Write(ctx, []byte("hello"), false)
+		require.NoError(t, err)
+		require.Equal(t, 5, n)
+
+		buf := make([]byte, 10)
+
+		n, err = conn.Read(ctx, buf, false, false, false)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf[:n]))
+
+		_, err = conn.Read(ctx, buf, false, false, true)
+		require.Equal(t, netstack.ErrWouldBlock, err)
+
+		require.Equal(t, uint8(linux.TCP_ESTABLISHED), conn.Info().State)
+
+		c.Close()
+
+		n, err = conn.Read(ctx, buf, false, false, false)
+		require.NoError(t, err)
+		require.Equal(t, 0, n)
+
+		require.Equal(t, uint8(linux.TCP_CLOSE_WAIT), conn.Info().State)
+
+		_, err = conn.Write(ctx, []byte("x"), false)
+		require.Equal(t, netstack.ErrBrokenPipe, err)
+	})
+
+	t.Run("refuses connections to ports nobody listens on", func(t *testing.T) {
+		s := netstack.New()
+
+		c := s.NewTCPEndpoint(false)
+		require.Equal(t, netstack.ErrConnectionRefused, c.Connect(ctx, netstack.Address{IP: localhost, Port: 9}, false))
+
+		bound := s.NewTCPEndpoint(false)
+		require.NoError(t, bound.Bind(netstack.Address{IP: localhost, Port: 9}))
+		require.Equal(t, netstack.ErrConnectionRefused, c.Connect(ctx, netstack.Address{IP: localhost, Port: 9}, false))
+	})
+
+	t.Run("can't reach addresses off the stack", func(t *testing.T) {
+		s := netstack.New()
+
+		c := s.NewTCPEndpoint(false)
+		require.Equal(t, netstack.ErrNetworkUnreachable, c.Connect(ctx, netstack.Address{IP: net.IPv4(8, 8, 8, 8), Port: 53}, false))
+
+		s.AddNIC("eth0", nil, net.IPNet{IP: net.IPv4(10, 0, 0, 2).To4(), Mask: net.CIDRMask(24, 32)})
+
+		require.Equal(t, netstack.ErrHostUnreachable, c.Connect(ctx, netstack.Address{IP: net.IPv4(10, 0, 0, 3), Port: 80}, false))
+
+		l := listen(t, s, netstack.Address{IP: net.IPv4(10, 0, 0, 2), Port: 80})
+		dial(t, s, l, netstack.Address{IP: net.IPv4(10, 0, 0, 2), Port: 80})
+
+		other := s.NewTCPEndpoint(false)
+		require.Equal(t, netstack.ErrAddressNotAvailable, other.Bind(netstack.Address{IP: net.IPv4(10, 0, 0, 9)}))
+	})
+
+	t.Run("keeps ports to one endpoint", func(t *testing.T) {
+		s := netstack.New()
+
+		listen(t, s, netstack.Address{IP: net.IPv4zero, Port: 80})
+
+		other := s.NewTCPEndpoint(false)
+		require.Equal(t, netstack.ErrAddressInUse, other.Bind(netstack.Address{IP: localhost, Port: 80}))
+
+		// SO_REUSEADDR doesn't share the port of a listener.
+		other.SetReuseAddress(true)
+		require.Equal(t, netstack.ErrAddressInUse, other.Bind(netstack.Address{IP: localhost, Port: 80}))
+
+		a := s.NewTCPEndpoint(false)
+		a.SetReuseAddress(true)
+		require.NoError(t, a.Bind(netstack.Address{IP: localhost, Port: 81}))
+		require.NoError(t, other.Bind(netstack.Address{IP: localhost, Port: 81}))
+
+		a.Close()
+
+		again := s.NewTCPEndpoint(false)
+		require.NoError(t, again.Bind(netstack.Address{IP: net.IPv4zero, Port: 82}))
+		again.Close()
+
+		again = s.NewTCPEndpoint(false)
+		require.NoError(t, again.Bind(netstack.Address{IP: net.IPv4zero, Port: 82}))
+	})
+
+	t.Run("accepts IPv4 on an IPv6 wildcard unless v6only", func(t *testing.T) {
+		s := netstack.New()
+
+		l := listen(t, s, netstack.Address{IP: net.IPv6unspecified, Port: 80})
+
+		c, conn := dial(t, s, l, netstack.Address{IP: localhost, Port: 80})
+
+		local := conn.LocalAddress()
+		require.True(t, local.IP.Equal(localhost))
+		require.Equal(t, 80, local.Port)
+
+		c.Close()
+		conn.Close()
+
+		dial(t, s, l, netstack.Address{IP: net.IPv6loopback, Port: 80})
+
+		l6 := s.NewTCPEndpoint(true)
+		require.NoError(t, l6.SetV6Only(true))
+		require.NoError(t, l6.Bind(netstack.Address{IP: net.IPv6unspecified, Port: 81}))
+		require.NoError(t, l6.Listen(1))
+
+		c = s.NewTCPEndpoint(false)
+		require.Equal(t, netstack.ErrConnectionRefused, c.Connect(ctx, netstack.Address{IP: localhost, Port: 81}, false))
+
+		// An IPv4 endpoint can share the port.
+		l4 := listen(t, s, netstack.Address{IP: net.IPv4zero, Port: 81})
+		dial(t, s, l4, netstack.Address{IP: localhost, Port: 81})
+	})
+
+	t.Run("resets connections closed with unread data", func(t *testing.T) {
+		s := netstack.New()
+
+		l := listen(t, s, netstack.Address{IP: localhost, Port: 80})
+		c, conn := dial(t, s, l, netstack.Address{IP: localhost, Port: 80})
+
+		_, err := c.Write(ctx, []byte("unread"), false)
+		require.NoError(t, err)
+
+		conn.Close()
+
+		_, err = c.Read(ctx, make([]byte, 10), false, false, false)
+		require.Equal(t, netstack.ErrConnectionReset, err)
+
+		// Connections that are never accepted are reset too.
+		pending := s.NewTCPEndpoint(false)
+		require.NoError(t, pending.Connect(ctx, netstack.Address{IP: localhost, Port: 80}, false))
+
+		l.Close()
+
+		require.Equal(t, netstack.ErrConnectionReset, pending.TakeError())
+	})
+
+	t.Run("shuts down writing", func(t *testing.T) {
+		s := netstack.New()
+
+		l := listen(t, s, netstack.Address{IP: localhost, Port: 80})
+		c, conn := dial(t, s, l, netstack.Address{IP: localhost, Port: 80})
+
+		require.NoError(t, c.Shutdown(false, true))
+
+		_, err := c.Write(ctx, []byte("x"), false)
+		require.Equal(t, netstack.ErrBrokenPipe, err)
+
+		require.Equal(t, waiter.EventIn|waiter.EventRdHUp, conn.Readiness(waiter.EventIn|waiter.EventRdHUp))
+
+		n, err := conn.Read(ctx, make([]byte, 10), false, false, false)
+		require.NoError(t, err)
+		require.Equal(t, 0, n)
+
+		_, err = conn.Write(ctx, []byte("back"), false)
+		require.NoError(t, err)
+
+		buf := make([]byte, 10)
+
+		n, err = c.Read(ctx, buf, false, false, false)
+		require.NoError(t, err)
+		require.Equal(t, "back", string(buf[:n]))
+	})
+
+	t.Run("waits for the peer to make room", func(t *testing.T) {
+		s := netstack.New()
+
+		l := listen(t, s, netstack.Address{IP: localhost, Port: 80})
+		c, conn := dial(t, s, l, netstack.Address{IP: localhost, Port: 80})
+
+		big := make([]byte, 300000)
+
+		n, err := c.Write(ctx, big, true)
+		require.NoError(t, err)
+		require.True(t, n < len(big))
+
+		_, err = c.Write(ctx, big, true)
+		require.Equal(t, netstack.ErrWouldBlock, err)
+
+		require.Equal(t, waiter.EventMask(0), c.Readiness(waiter.EventOut))
+
+		done := make(chan error)
+
+		go func() {
+			_, err := c.Write(ctx, []byte("more"), false)
+			done <- err
+		}()
+
+		select {
+		case <-done:
+			t.Fatal("wrote to a full buffer")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		buf := make([]byte, n)
+
+		m, err := conn.Read(ctx, buf, false, true, false)
+		require.NoError(t, err)
+		require.Equal(t, n, m)
+
+		require.NoError(t, <-done)
+
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		// What was received before the interruption is returned.
+		m, err = conn.Read(cctx, buf, false, true, false)
+		require.NoError(t, err)
+		require.Equal(t, "more", string(buf[:m]))
+
+		_, err = conn.Read(cctx, buf, false, true, false)
+		require.Equal(t, fs.ErrInterrupted, err)
+	})
+}
+
+func TestUDP(t *testing.T) {
+	ctx := context.Background()
+
+	bind := func(t *testing.T, s *netstack.Stack, addr netstack.Address) *netstack.UDPEndpoint {
+		e := s.NewUDPEndpoint(addr.IP.To4() == nil)
+		require.NoError(t, e.Bind(addr))
+
+		return e
+	}
+
+	t.Run("delivers datagrams between local addresses", func(t *testing.T) {
+		s := netstack.New()
+
+		srv := bind(t, s, netstack.Address{IP: net.IPv4zero, Port: 53})
+		client := s.NewUDPEndpoint(false)
+
+		to := netstack.Address{IP: localhost, Port: 53}
+
+		_, err := client.SendTo([]byte("query"), &to)
+		require.NoError(t, err)
+
+		_, err = client.SendTo([]byte("second"), &to)
+		require.NoError(t, err)
+
+		data, from, full, err := srv.RecvFrom(ctx, 3, false, false)
+		require.NoError(t, err)
+		require.Equal(t, "que", string(data))
+		require.Equal(t, 5, full)
+		require.Equal(t, client.LocalAddress().Port, from.Port)
+		require.True(t, from.IP.Equal(localhost))
+
+		data, _, _, err = srv.RecvFrom(ctx, 100, true, false)
+		require.NoError(t, err)
+		require.Equal(t, "second", string(data))
+
+		data, _, _, err = srv.RecvFrom(ctx, 100, false, false)
+		require.NoError(t, err)
+		require.Equal(t, "second", string(data))
+
+		_, _, _, err = srv.RecvFrom(ctx, 100, false, true)
+		require.Equal(t, netstack.ErrWouldBlock, err)
+
+		_, err = srv.SendTo([]byte("answer"), &from)
+		require.NoError(t, err)
+
+		data, _, _, err = client.RecvFrom(ctx, 100, false, false)
+		require.NoError(t, err)
+		require.Equal(t, "answer", string(data))
+
+		_, err = client.SendTo(make([]byte, 70000), &to)
+		require.Equal(t, netstack.ErrMessageSize, err)
+	})
+
+	t.Run("only receives from the remote once connected", func(t *testing.T) {
+		s := netstack.New()
+
+		a := bind(t, s, netstack.Address{IP: localhost, Port: 1000})
+		b := bind(t, s, netstack.Address{IP: localhost, Port: 1001})
+		c := bind(t, s, netstack.Address{IP: localhost, Port: 1002})
+
+		require.NoError(t, a.Connect(&netstack.Address{IP: localhost, Port: 1001}))
+
+		_, err := a.SendTo([]byte("to b"), nil)
+		require.NoError(t, err)
+
+		data, _, _, err := b.RecvFrom(ctx, 100, false, false)
+		require.NoError(t, err)
+		require.Equal(t, "to b", string(data))
+
+		_, err = c.SendTo([]byte("from c"), &netstack.Address{IP: localhost, Port: 1000})
+		require.NoError(t, err)
+
+		_, _, _, err = a.RecvFrom(ctx, 100, false, true)
+		require.Equal(t, netstack.ErrWouldBlock, err)
+
+		require.NoError(t, a.Connect(nil))
+
+		_, err = a.SendTo([]byte("x"), nil)
+		require.Equal(t, netstack.ErrDestinationRequired, err)
+	})
+
+	t.Run("reports refusals to a connected endpoint", func(t *testing.T) {
+		s := netstack.New()
+
+		a := s.NewUDPEndpoint(false)
+		require.NoError(t, a.Connect(&netstack.Address{IP: localhost, Port: 9}))
+
+		_, err := a.SendTo([]byte("x"), nil)
+		require.NoError(t, err)
+
+		require.Equal(t, waiter.EventErr, a.Readiness(waiter.EventErr))
+
+		_, err = a.SendTo([]byte("x"), nil)
+		require.Equal(t, netstack.ErrConnectionRefused, err)
+	})
+
+	t.Run("drops what's sent off the stack", func(t *testing.T) {
+		s := netstack.New()
+		s.AddNIC("eth0", nil, net.IPNet{IP: net.IPv4(10, 0, 0, 2).To4(), Mask: net.CIDRMask(24, 32)})
+
+		a := s.NewUDPEndpoint(false)
+
+		n, err := a.SendTo([]byte("x"), &netstack.Address{IP: net.IPv4(10, 0, 0, 3), Port: 9})
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+
+		_, err = a.SendTo([]byte("x"), &netstack.Address{IP: net.IPv4(8, 8, 8, 8), Port: 9})
+		require.Equal(t, netstack.ErrNetworkUnreachable, err)
+	})
+}
+
+func TestRoutes(t *testing.T) {
+	cidr := func(s string) net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+
+		return *n
+	}
+
+	newStack := func() (*netstack.Stack, int) {
+		s := netstack.New()
+		nic := s.AddNIC("eth0", nil, net.IPNet{IP: net.IPv4(10, 0, 0, 2).To4(), Mask: net.CIDRMask(24, 32)})
+
+		return s, nic.Index
+	}
+
+	t.Run("has a route to the network of each address", func(t *testing.T) {
+		s, eth0 := newStack()
+
+		routes := s.Routes()
+		require.Len(t, routes, 1)
+		require.Equal(t, cidr("10.0.0.0/24"), routes[0].Destination)
+		require.Equal(t, eth0, routes[0].NIC)
+		require.True(t, routes[0].Source.Equal(net.IPv4(10, 0, 0, 2)))
+
+		require.NoError(t, s.AddAddress(eth0, cidr("192.168.1.5/16")))
+		require.Equal(t, netstack.ErrExists, s.AddAddress(eth0, net.IPNet{IP: net.IPv4(10, 0, 0, 2), Mask: net.CIDRMask(24, 32)}))
+		require.Equal(t, netstack.ErrNoInterface, s.AddAddress(99, cidr("172.16.0.1/12")))
+
+		routes = s.Routes()
+		require.Len(t, routes, 2)
+		require.Equal(t, cidr("192.168.0.0/16"), routes[1].Destination)
+	})
+
+	t.Run("adds routes by a gateway on the link", func(t *testing.T) {
+		s, eth0 := newStack()
+
+		def := netstack.Route{Destination: cidr("0.0.0.0/0"), Gateway: net.IPv4(10, 0, 0, 1)}
+		require.NoError(t, s.AddRoute(def, false))
+		require.Equal(t, netstack.ErrExists, s.AddRoute(def, false))
+
+		def.Gateway = net.IPv4(10, 0, 0, 254)
+		require.NoError(t, s.AddRoute(def, true))
+
+		require.Equal(t, netstack.ErrNetworkUnreachable, s.AddRoute(netstack.Route{Destination: cidr("172.16.0.0/12"), Gateway: net.IPv4(192, 168, 0, 1)}, false))
+		require.Equal(t, netstack.ErrNoInterface, s.AddRoute(netstack.Route{Destination: cidr("172.16.0.0/12")}, false))
+		require.Equal(t, netstack.ErrNoInterface, s.AddRoute(netstack.Route{Destination: cidr("172.16.0.0/12"), NIC: 99}, false))
+
+		routes := s.Routes()
+		require.Len(t, routes, 2)
+		require.Equal(t, eth0, routes[1].NIC)
+		require.True(t, routes[1].Gateway.Equal(net.IPv4(10, 0, 0, 254)))
+		require.Nil(t, routes[1].Source)
+	})
+
+	t.Run("sends off the link from the route's NIC", func(t *testing.T) {
+		s, _ := newStack()
+
+		dst := netstack.Address{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+
+		a := s.NewUDPEndpoint(false)
+		require.Equal(t, netstack.ErrNetworkUnreachable, a.Connect(&dst))
+
+		c := s.NewTCPEndpoint(false)
+		require.Equal(t, netstack.ErrNetworkUnreachable, c.Connect(context.Background(), dst, false))
+
+		require.NoError(t, s.AddRoute(netstack.Route{Destination: cidr("0.0.0.0/0"), Gateway: net.IPv4(10, 0, 0, 1)}, false))
+
+		require.NoError(t, a.Connect(&dst))
+		require.Equal(t, netstack.ErrHostUnreachable, c.Connect(context.Background(), dst, false))
+
+		n, err := a.SendTo([]byte("x"), nil)
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+	})
+}
@@ -0,0 +1,202 @@
+package netstack
+
+import (
+	"net"
+)
+
+// Route sends what's for the addresses of Destination out of the NIC with
+// the index NIC.
+type Route struct {
+	Destination net.IPNet
+
+	// Gateway is the router it's sent by, or nil if Destination is on the
+	// NIC's link.
+	Gateway net.IP
+
+	NIC int
+
+	// Source is set for the route to the network of one of the NIC's
+	// addresses, which it is.
+	Source net.IP
+}
+
+// Routes returns the routing table: a route to the network of each address
+// of the NICs other than lo, then those added by AddRoute.
+func (s *Stack) Routes() []Route {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var routes []Route
+
+	for _, nic := range s.nics {
+		if nic.Loopback {
+			continue
+		}
+
+		for _, a := range nic.Addrs {
+			routes = append(routes, Route{
+				Destination: net.IPNet{IP: a.IP.Mask(a.Mask), Mask: a.Mask},
+				NIC:         nic.Index,
+				Source:      a.IP,
+			})
+		}
+	}
+
+	return append(routes, s.routes...)
+}
+
+// AddAddress assigns addr to the NIC with index. It fails with ErrExists if
+// the NIC already has the address.
+func (s *Stack) AddAddress(index int, addr net.IPNet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nic := s.nic(index)
+	if nic == nil {
+		return ErrNoInterface
+	}
+
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		addr.IP = ip4
+	}
+
+	for _, a := range nic.Addrs {
+		if a.IP.Equal(addr.IP) {
+			return ErrExists
+		}
+	}
+
+	// NICs hands out copies, so the slice can be appended to in place.
+	nic.Addrs = append(nic.Addrs, addr)
+
+	return nil
+}
+
+// AddRoute adds r to the routing table. Without a NIC, r goes out of the
+// one whose network has the gateway, which has to be on the NIC's link
+// either way. A route to the same destination is replaced if replace is
+// set, and otherwise fails with ErrExists.
+func (s *Stack) AddRoute(r Route, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.Destination.IP = r.Destination.IP.Mask(r.Destination.Mask)
+	r.Source = nil
+
+	if r.Destination.IP == nil {
+		return ErrInvalidState
+	}
+
+	if r.NIC == 0 {
+		if r.Gateway == nil {
+			return ErrNoInterface
+		}
+
+		r.NIC = s.nicOnLink(r.Gateway)
+		if r.NIC == 0 {
+			return ErrNetworkUnreachable
+		}
+	}
+
+	if s.nic(r.NIC) == nil {
+		return ErrNoInterface
+	}
+
+	if r.Gateway != nil && s.nicOnLink(r.Gateway) != r.NIC {
+		return ErrNetworkUnreachable
+	}
+
+	for i, other := range s.routes {
+		if !sameNetwork(other.Destination, r.Destination) {
+			continue
+		}
+
+		if !replace {
+			return ErrExists
+		}
+
+		s.routes[i] = r
+
+		return nil
+	}
+
+	s.routes = append(s.routes, r)
+
+	return nil
+}
+
+func sameNetwork(a, b net.IPNet) bool {
+	aOnes, aBits := a.Mask.Size()
+	bOnes, bBits := b.Mask.Size()
+
+	return a.IP.Equal(b.IP) && aOnes == bOnes && aBits == bBits
+}
+
+// nic returns the NIC with index, or nil.
+func (s *Stack) nic(index int) *NIC {
+	for _, nic := range s.nics {
+		if nic.Index == index {
+			return nic
+		}
+	}
+
+	return nil
+}
+
+// nicOnLink returns the index of the NIC other than lo on whose network ip
+// is, or 0.
+func (s *Stack) nicOnLink(ip net.IP) int {
+	for _, nic := range s.nics {
+		if nic.Loopback {
+			continue
+		}
+
+		for _, a := range nic.Addrs {
+			if a.Contains(ip) {
+				return nic.Index
+			}
+		}
+	}
+
+	return 0
+}
+
+// routeTo returns the added route with the longest prefix that covers dst,
+// or nil.
+func (s *Stack) routeTo(dst net.IP) *Route {
+	var (
+		best     *Route
+		bestOnes = -1
+	)
+
+	for i := range s.routes {
+		r := &s.routes[i]
+
+		if !r.Destination.Contains(dst) {
+			continue
+		}
+
+		if ones, _ := r.Destination.Mask.Size(); ones > bestOnes {
+			best, bestOnes = r, ones
+		}
+	}
+
+	return best
+}
+
+// sourceOn returns the address of the NIC with index that sending to dst
+// goes from: its first of dst's family.
+func (s *Stack) sourceOn(index int, dst net.IP) net.IP {
+	nic := s.nic(index)
+	if nic == nil {
+		return nil
+	}
+
+	for _, a := range nic.Addrs {
+		if (a.IP.To4() != nil) == (dst.To4() != nil) {
+			return a.IP
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,384 @@
+// Package netstack is the network stack of a kernel: its interfaces and
+// their addresses, the ports bound on them, and the TCP and UDP endpoints
+// that guest sockets are built on. It never touches the host's network.
+// Traffic between the stack's own addresses is delivered in memory, as a
+// stream of bytes for TCP and whole datagrams for UDP, rather than as
+// packets.
+package netstack
+
+import (
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrAddressInUse        = errors.New("address already in use")
+	ErrAddressNotAvailable = errors.New("cannot assign requested address")
+	ErrConnectionRefused   = errors.New("connection refused")
+	ErrConnectionReset     = errors.New("connection reset by peer")
+	ErrNetworkUnreachable  = errors.New("network is unreachable")
+	ErrHostUnreachable     = errors.New("no route to host")
+	ErrWouldBlock          = errors.New("operation would block")
+	ErrNotConnected        = errors.New("endpoint is not connected")
+	ErrIsConnected         = errors.New("endpoint is already connected")
+	ErrInvalidState        = errors.New("invalid endpoint state")
+	ErrBrokenPipe          = errors.New("broken pipe")
+	ErrMessageSize         = errors.New("message too long")
+	ErrDestinationRequired = errors.New("destination address required")
+	ErrNoInterface         = errors.New("no such interface")
+	ErrExists              = errors.New("already exists")
+)
+
+const (
+	// bufferSize is how many bytes an endpoint holds for receiving before
+	// senders have to wait, or their datagrams are dropped.
+	bufferSize = 212992
+
+	// maxBacklog caps the connections waiting to be accepted, as
+	// net.core.somaxconn does.
+	maxBacklog = 4096
+
+	// The range ports are picked from when none is given, as
+	// net.ipv4.ip_local_port_range has it.
+	firstEphemeral = 32768
+	lastEphemeral  = 60999
+
+	// loopbackMTU is the MTU Linux gives lo.
+	loopbackMTU = 65536
+
+	// ethernetMTU is the MTU of a virtual NIC.
+	ethernetMTU = 1500
+)
+
+// NIC is a network interface.
+type NIC struct {
+	// Index is the interface's number, starting with 1 for lo.
+	Index int
+	Name  string
+
+	Loopback     bool
+	MTU          int
+	HardwareAddr net.HardwareAddr
+
+	// Addrs are the addresses assigned to the interface, with the prefix
+	// of the network each is on.
+	Addrs []net.IPNet
+}
+
+// Address is an IP address and port, as sockets are bound and connected
+// to.
+type Address struct {
+	IP   net.IP
+	Port int
+}
+
+func (a Address) String() string {
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+}
+
+// Stack is the network stack of one kernel.
+type Stack struct {
+	mu sync.Mutex
+
+	nics []*NIC
+
+	// routes are those added by AddRoute.
+	routes []Route
+
+	tcp, udp portTable
+
+	nextEphemeral int
+}
+
+// New returns a stack with only the loopback interface, lo, which has
+// 127.0.0.1/8 and ::1/128.
+func New() *Stack {
+	s := &Stack{
+		tcp:           make(portTable),
+		udp:           make(portTable),
+		nextEphemeral: firstEphemeral,
+	}
+
+	s.nics = append(s.nics, &NIC{
+		Index:    1,
+		Name:     "lo",
+		Loopback: true,
+		MTU:      loopbackMTU,
+		Addrs: []net.IPNet{
+			{IP: net.IPv4(127, 0, 0, 1).To4(), Mask: net.CIDRMask(8, 32)},
+			{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+		},
+	})
+
+	return s
+}
+
+// AddNIC adds a virtual NIC with addrs. It isn't connected to anything, so
+// only the stack's own addresses can be reached through it.
+func (s *Stack) AddNIC(name string, hw net.HardwareAddr, addrs ...net.IPNet) *NIC {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nic := &NIC{
+		Index:        len(s.nics) + 1,
+		Name:         name,
+		MTU:          ethernetMTU,
+		HardwareAddr: hw,
+		Addrs:        addrs,
+	}
+
+	s.nics = append(s.nics, nic)
+
+	return nic
+}
+
+// NICs returns copies of the interfaces, by index, which stay as they are
+// when addresses are added.
+func (s *Stack) NICs() []NIC {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nics := make([]NIC, len(s.nics))
+
+	for i, nic := range s.nics {
+		nics[i] = *nic
+		nics[i].Addrs = append([]net.IPNet(nil), nic.Addrs...)
+	}
+
+	return nics
+}
+
+// IsLocal reports whether ip is one of the stack's addresses. All of
+// 127.0.0.0/8 is, as on Linux.
+func (s *Stack) IsLocal(ip net.IP) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.isLocal(ip)
+}
+
+func (s *Stack) isLocal(ip net.IP) bool {
+	for _, nic := range s.nics {
+		for _, a := range nic.Addrs {
+			if a.IP.Equal(ip) || (nic.Loopback && a.Contains(ip)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// route picks the source address for sending to dst, and reports whether
+// dst is one of the stack's own addresses.
+func (s *Stack) route(dst net.IP) (net.IP, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if dst.IsUnspecified() {
+		// Connecting to the wildcard address connects to the host
+		// itself.
+		if dst.To4() != nil {
+			return net.IPv4(127, 0, 0, 1), true, nil
+		}
+
+		return net.IPv6loopback, true, nil
+	}
+
+	if s.isLocal(dst) {
+		if dst.IsLoopback() {
+			if dst.To4() != nil {
+				return net.IPv4(127, 0, 0, 1), true, nil
+			}
+
+			return net.IPv6loopback, true, nil
+		}
+
+		return dst, true, nil
+	}
+
+	for _, nic := range s.nics {
+		if nic.Loopback {
+			continue
+		}
+
+		for _, a := range nic.Addrs {
+			if a.Contains(dst) && (a.IP.To4() != nil) == (dst.To4() != nil) {
+				return a.IP, false, nil
+			}
+		}
+	}
+
+	if r := s.routeTo(dst); r != nil {
+		if src := s.sourceOn(r.NIC, dst); src != nil {
+			return src, false, nil
+		}
+	}
+
+	return nil, false, ErrNetworkUnreachable
+}
+
+// binding is an endpoint's hold on a port.
+type binding struct {
+	ip     net.IP
+	v6only bool
+	reuse  bool
+
+	// listening is set for a listening TCP endpoint, whose port can't be
+	// shared even with SO_REUSEADDR.
+	listening bool
+
+	owner interface{}
+}
+
+// portTable holds the bindings of a protocol, by port.
+type portTable map[int][]*binding
+
+var v4Any = net.IPv4zero.To16()
+
+// covers reports whether b receives what's sent to ip.
+func (b *binding) covers(ip net.IP) bool {
+	switch {
+	case b.ip.Equal(ip):
+		return true
+	case b.ip.Equal(v4Any):
+		return ip.To4() != nil
+	case b.ip.Equal(net.IPv6unspecified):
+		return ip.To4() == nil || !b.v6only
+	}
+
+	return false
+}
+
+func (b *binding) overlaps(other *binding) bool {
+	return b.covers(other.ip) || other.covers(b.ip)
+}
+
+// bind binds owner to ip and port in table, picking a port if it's 0.
+func (s *Stack) bind(table portTable, ip net.IP, port int, v6only, reuse bool, owner interface{}) (*binding, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !ip.IsUnspecified() && !s.isLocal(ip) {
+		return nil, 0, ErrAddressNotAvailable
+	}
+
+	b := &binding{ip: ip.To16(), v6only: v6only, reuse: reuse, owner: owner}
+
+	free := func(port int) bool {
+		for _, other := range table[port] {
+			if !b.overlaps(other) {
+				continue
+			}
+
+			if b.reuse && other.reuse && !other.listening {
+				continue
+			}
+
+			return false
+		}
+
+		return true
+	}
+
+	if port == 0 {
+		for i := 0; i <= lastEphemeral-firstEphemeral; i++ {
+			candidate := s.nextEphemeral
+
+			s.nextEphemeral++
+			if s.nextEphemeral > lastEphemeral {
+				s.nextEphemeral = firstEphemeral
+			}
+
+			// An ephemeral port is never shared.
+			if len(table[candidate]) == 0 {
+				port = candidate
+				break
+			}
+		}
+
+		if port == 0 {
+			return nil, 0, ErrAddressInUse
+		}
+	} else if !free(port) {
+		return nil, 0, ErrAddressInUse
+	}
+
+	table[port] = append(table[port], b)
+
+	return b, port, nil
+}
+
+func (s *Stack) unbind(table portTable, port int, b *binding) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bs := table[port]
+
+	for i, other := range bs {
+		if other == b {
+			bs = append(bs[:i:i], bs[i+1:]...)
+			break
+		}
+	}
+
+	if len(bs) == 0 {
+		delete(table, port)
+	} else {
+		table[port] = bs
+	}
+}
+
+// listen marks b as listening, failing if another endpoint is listening
+// on an overlapping address.
+func (s *Stack) listen(table portTable, port int, b *binding) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range table[port] {
+		if other != b && other.listening && b.overlaps(other) {
+			return ErrAddressInUse
+		}
+	}
+
+	b.listening = true
+
+	return nil
+}
+
+// lookup returns the owners of the bindings in table that receive what's
+// sent to ip and port, those bound to ip itself ahead of the wildcards.
+// match filters the bindings considered; it's called with the stack
+// locked.
+func (s *Stack) lookup(table portTable, ip net.IP, port int, match func(*binding) bool) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var exact, wildcard []interface{}
+
+	for _, b := range table[port] {
+		if !b.covers(ip) || !match(b) {
+			continue
+		}
+
+		if b.ip.Equal(ip) {
+			exact = append(exact, b.owner)
+		} else {
+			wildcard = append(wildcard, b.owner)
+		}
+	}
+
+	return append(exact, wildcard...)
+}
+
+// anyAddress is the wildcard address of a family.
+func anyAddress(v6 bool) net.IP {
+	if v6 {
+		return net.IPv6unspecified
+	}
+
+	return v4Any
+}
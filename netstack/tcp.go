@@ -0,0 +1,784 @@
+package netstack
+
+import (
+	"context"
+	"sync"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/pkg/waiter"
+)
+
+type tcpState int
+
+const (
+	tcpInitial tcpState = iota
+	tcpBound
+	tcpListening
+	tcpConnected
+	tcpClosed
+)
+
+// TCPEndpoint is a TCP socket's endpoint in the stack. The calls that can
+// block give up with fs.ErrInterrupted when their ctx is done, or fail with
+// ErrWouldBlock if they're nonblocking.
+type TCPEndpoint struct {
+	stack *Stack
+	v6    bool
+
+	q waiter.Queue
+
+	mu sync.Mutex
+
+	state tcpState
+
+	local, remote Address
+	bound         *binding
+
+	reuse, v6only bool
+
+	backlog int
+	pending []*TCPEndpoint
+
+	peer *TCPEndpoint
+
+	rcv []byte
+
+	// eof is set once nothing more will be received: the peer has shut
+	// down writing or closed, or this end has shut down reading.
+	eof bool
+
+	// sndShut is set once this end can't send.
+	sndShut bool
+
+	// err is a reset, reported by the next call.
+	err error
+
+	sent, received uint64
+}
+
+// NewTCPEndpoint returns an endpoint for a socket of the IPv6 family if v6
+// is set, or else of IPv4.
+func (s *Stack) NewTCPEndpoint(v6 bool) *TCPEndpoint {
+	return &TCPEndpoint{stack: s, v6: v6}
+}
+
+func (e *TCPEndpoint) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	e.q.EventRegister(ch, mask)
+}
+
+func (e *TCPEndpoint) EventUnregister(ch chan struct{}) {
+	e.q.EventUnregister(ch)
+}
+
+func (e *TCPEndpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
+	e.mu.Lock()
+
+	var ready waiter.EventMask
+
+	switch e.state {
+	case tcpListening:
+		if len(e.pending) > 0 {
+			ready |= waiter.EventIn
+		}
+
+		e.mu.Unlock()
+
+		return ready & mask
+	case tcpConnected:
+	default:
+		e.mu.Unlock()
+
+		return waiter.EventHUp & mask
+	}
+
+	if len(e.rcv) > 0 || e.eof || e.err != nil {
+		ready |= waiter.EventIn
+	}
+
+	if e.eof {
+		ready |= waiter.EventRdHUp
+	}
+
+	if e.eof && e.sndShut {
+		ready |= waiter.EventHUp
+	}
+
+	if e.err != nil {
+		ready |= waiter.EventErr | waiter.EventOut
+	}
+
+	peer, sndShut := e.peer, e.sndShut
+
+	e.mu.Unlock()
+
+	if !sndShut && peer.hasRoom() {
+		ready |= waiter.EventOut
+	}
+
+	return ready & mask
+}
+
+// hasRoom reports whether e can receive more, or whether sending to it
+// would fail anyway, so there's no point waiting.
+func (e *TCPEndpoint) hasRoom() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.state != tcpConnected || len(e.rcv) < bufferSize
+}
+
+// tcpRoom is a Waitable for when an endpoint can receive more.
+type tcpRoom struct {
+	e *TCPEndpoint
+}
+
+func (r tcpRoom) Readiness(mask waiter.EventMask) waiter.EventMask {
+	if r.e.hasRoom() {
+		return waiter.EventOut & mask
+	}
+
+	return 0
+}
+
+func (r tcpRoom) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	r.e.q.EventRegister(ch, mask)
+}
+
+func (r tcpRoom) EventUnregister(ch chan struct{}) {
+	r.e.q.EventUnregister(ch)
+}
+
+// SetReuseAddress sets SO_REUSEADDR, which lets endpoints bind to the same
+// port unless one of them is listening.
+func (e *TCPEndpoint) SetReuseAddress(reuse bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.reuse = reuse
+}
+
+func (e *TCPEndpoint) ReuseAddress() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.reuse
+}
+
+// SetV6Only sets IPV6_V6ONLY, which keeps an IPv6 endpoint from IPv4
+// traffic. It can't be changed once the endpoint is bound.
+func (e *TCPEndpoint) SetV6Only(v6only bool) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.v6 || e.state != tcpInitial {
+		return ErrInvalidState
+	}
+
+	e.v6only = v6only
+
+	return nil
+}
+
+func (e *TCPEndpoint) V6Only() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.v6only
+}
+
+// Bind binds the endpoint to addr. A port of 0 picks a free one.
+func (e *TCPEndpoint) Bind(addr Address) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.bindLocked(addr)
+}
+
+func (e *TCPEndpoint) bindLocked(addr Address) error {
+	if e.state != tcpInitial {
+		return ErrInvalidState
+	}
+
+	b, port, err := e.stack.bind(e.stack.tcp, addr.IP, addr.Port, e.v6only, e.reuse, e)
+	if err != nil {
+		return err
+	}
+
+	e.bound = b
+	e.local = Address{IP: addr.IP, Port: port}
+	e.state = tcpBound
+
+	return nil
+}
+
+// Listen makes the endpoint accept connections, binding it to a free port
+// first if it isn't bound.
+func (e *TCPEndpoint) Listen(backlog int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch e.state {
+	case tcpInitial:
+		if err := e.bindLocked(Address{IP: anyAddress(e.v6)}); err != nil {
+			return err
+		}
+	case tcpBound:
+	case tcpListening:
+		// Listening again only changes the backlog.
+	default:
+		return ErrInvalidState
+	}
+
+	if e.state == tcpBound {
+		if err := e.stack.listen(e.stack.tcp, e.local.Port, e.bound); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case backlog < 1:
+		backlog = 1
+	case backlog > maxBacklog:
+		backlog = maxBacklog
+	}
+
+	e.state = tcpListening
+	e.backlog = backlog
+
+	return nil
+}
+
+// Accept returns the next connection made to the listening endpoint.
+func (e *TCPEndpoint) Accept(ctx context.Context, nonblock bool) (*TCPEndpoint, error) {
+	for {
+		e.mu.Lock()
+
+		if e.state != tcpListening {
+			e.mu.Unlock()
+			return nil, ErrInvalidState
+		}
+
+		if len(e.pending) > 0 {
+			conn := e.pending[0]
+			e.pending = e.pending[1:]
+			e.mu.Unlock()
+
+			// Connecting may be waiting for a place in the backlog.
+			e.q.Notify(waiter.EventOut)
+
+			return conn, nil
+		}
+
+		e.mu.Unlock()
+
+		if nonblock {
+			return nil, ErrWouldBlock
+		}
+
+		if err := waiter.Wait(ctx, e, waiter.EventIn); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// tcpBacklog is a Waitable for when a listener has a place for another
+// connection.
+type tcpBacklog struct {
+	l *TCPEndpoint
+}
+
+func (b tcpBacklog) Readiness(mask waiter.EventMask) waiter.EventMask {
+	b.l.mu.Lock()
+	defer b.l.mu.Unlock()
+
+	if b.l.state != tcpListening || len(b.l.pending) < b.l.backlog {
+		return waiter.EventOut & mask
+	}
+
+	return 0
+}
+
+func (b tcpBacklog) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	b.l.q.EventRegister(ch, mask)
+}
+
+func (b tcpBacklog) EventUnregister(ch chan struct{}) {
+	b.l.q.EventUnregister(ch)
+}
+
+// Connect connects the endpoint to the listener at addr, binding it to a
+// free port first if it isn't bound. If the listener's backlog is full, it
+// waits for a place.
+func (e *TCPEndpoint) Connect(ctx context.Context, addr Address, nonblock bool) error {
+	src, local, err := e.stack.route(addr.IP)
+	if err != nil {
+		return err
+	}
+
+	if !local {
+		// Nothing is on the other end of a virtual NIC.
+		return ErrHostUnreachable
+	}
+
+	if addr.IP.IsUnspecified() {
+		addr.IP = src
+	}
+
+	e.mu.Lock()
+
+	switch e.state {
+	case tcpInitial:
+		if err := e.bindLocked(Address{IP: anyAddress(e.v6)}); err != nil {
+			e.mu.Unlock()
+			return err
+		}
+	case tcpBound:
+	case tcpConnected:
+		e.mu.Unlock()
+		return ErrIsConnected
+	default:
+		e.mu.Unlock()
+		return ErrInvalidState
+	}
+
+	if e.local.IP.IsUnspecified() {
+		e.local.IP = src
+	}
+
+	self := e.local
+
+	e.mu.Unlock()
+
+	var l *TCPEndpoint
+
+	for {
+		owners := e.stack.lookup(e.stack.tcp, addr.IP, addr.Port, func(b *binding) bool {
+			return b.listening
+		})
+
+		if len(owners) == 0 {
+			return ErrConnectionRefused
+		}
+
+		l = owners[0].(*TCPEndpoint)
+
+		l.mu.Lock()
+
+		if l.state != tcpListening {
+			l.mu.Unlock()
+			return ErrConnectionRefused
+		}
+
+		if len(l.pending) < l.backlog {
+			break
+		}
+
+		l.mu.Unlock()
+
+		if nonblock {
+			return ErrWouldBlock
+		}
+
+		if err := waiter.Wait(ctx, tcpBacklog{l}, waiter.EventOut); err != nil {
+			return err
+		}
+	}
+
+	// The accepted end is addressed as the listener is, with the address
+	// connected to in place of a wildcard.
+	serverAddr := Address{IP: l.local.IP, Port: l.local.Port}
+	if serverAddr.IP.IsUnspecified() {
+		serverAddr.IP = addr.IP
+	}
+
+	conn := &TCPEndpoint{
+		stack:  e.stack,
+		v6:     l.v6,
+		state:  tcpConnected,
+		local:  serverAddr,
+		remote: self,
+		peer:   e,
+	}
+
+	l.pending = append(l.pending, conn)
+
+	l.mu.Unlock()
+
+	e.mu.Lock()
+	e.state = tcpConnected
+	e.remote = addr
+	e.peer = conn
+	e.mu.Unlock()
+
+	l.q.Notify(waiter.EventIn)
+	e.q.Notify(waiter.EventOut)
+
+	return nil
+}
+
+// Read receives into b. With peek, what's read is left to be read again,
+// and with waitAll, it waits until b is full unless the stream ends. At
+// the end of the stream it returns 0.
+func (e *TCPEndpoint) Read(ctx context.Context, b []byte, peek, waitAll, nonblock bool) (int, error) {
+	total := 0
+
+	for {
+		e.mu.Lock()
+
+		if e.err != nil && total == 0 {
+			err := e.err
+			e.err = nil
+			e.mu.Unlock()
+
+			return 0, err
+		}
+
+		if state := e.state; state != tcpConnected && total == 0 {
+			e.mu.Unlock()
+
+			if state == tcpClosed {
+				return 0, nil
+			}
+
+			return 0, ErrNotConnected
+		}
+
+		if len(e.rcv) > 0 {
+			n := copy(b[total:], e.rcv)
+
+			if !peek {
+				e.rcv = e.rcv[n:]
+				if len(e.rcv) == 0 {
+					e.rcv = nil
+				}
+			}
+
+			total += n
+
+			peer := e.peer
+			e.mu.Unlock()
+
+			if !peek {
+				// There's room now for the peer to send.
+				e.q.Notify(waiter.EventOut)
+				peer.q.Notify(waiter.EventOut)
+			}
+
+			if total == len(b) || !waitAll || peek {
+				return total, nil
+			}
+
+			continue
+		}
+
+		eof := e.eof || e.state != tcpConnected
+		e.mu.Unlock()
+
+		if eof || total > 0 && !waitAll {
+			return total, nil
+		}
+
+		if nonblock {
+			if total > 0 {
+				return total, nil
+			}
+
+			return 0, ErrWouldBlock
+		}
+
+		if err := waiter.Wait(ctx, e, waiter.EventIn); err != nil {
+			if total > 0 {
+				return total, nil
+			}
+
+			return 0, err
+		}
+	}
+}
+
+// Write sends b as there's room for it at the peer, returning how much was
+// sent.
+func (e *TCPEndpoint) Write(ctx context.Context, b []byte, nonblock bool) (int, error) {
+	sent := 0
+
+	partial := func(err error) (int, error) {
+		if sent > 0 {
+			return sent, nil
+		}
+
+		return 0, err
+	}
+
+	for sent < len(b) || len(b) == 0 {
+		e.mu.Lock()
+
+		switch {
+		case e.err != nil:
+			err := e.err
+			e.err = nil
+			e.mu.Unlock()
+
+			return partial(err)
+		case e.sndShut:
+			e.mu.Unlock()
+			return partial(ErrBrokenPipe)
+		case e.state != tcpConnected:
+			e.mu.Unlock()
+			return 0, ErrNotConnected
+		}
+
+		peer := e.peer
+
+		e.mu.Unlock()
+
+		if len(b) == 0 {
+			return 0, nil
+		}
+
+		peer.mu.Lock()
+
+		if peer.state != tcpConnected {
+			peer.mu.Unlock()
+			return partial(ErrBrokenPipe)
+		}
+
+		space := bufferSize - len(peer.rcv)
+
+		if space <= 0 {
+			peer.mu.Unlock()
+
+			if nonblock {
+				return partial(ErrWouldBlock)
+			}
+
+			if err := waiter.Wait(ctx, tcpRoom{peer}, waiter.EventOut); err != nil {
+				return partial(err)
+			}
+
+			continue
+		}
+
+		chunk := b[sent:]
+		if len(chunk) > space {
+			chunk = chunk[:space]
+		}
+
+		if !peer.eof {
+			peer.rcv = append(peer.rcv, chunk...)
+			peer.received += uint64(len(chunk))
+		}
+
+		peer.mu.Unlock()
+
+		peer.q.Notify(waiter.EventIn)
+
+		e.mu.Lock()
+		e.sent += uint64(len(chunk))
+		e.mu.Unlock()
+
+		sent += len(chunk)
+	}
+
+	return sent, nil
+}
+
+// Shutdown shuts down reading, writing or both.
+func (e *TCPEndpoint) Shutdown(read, write bool) error {
+	e.mu.Lock()
+
+	if e.state != tcpConnected {
+		e.mu.Unlock()
+		return ErrNotConnected
+	}
+
+	if read {
+		e.eof = true
+		e.rcv = nil
+	}
+
+	if write {
+		e.sndShut = true
+	}
+
+	peer := e.peer
+
+	e.mu.Unlock()
+
+	if write {
+		peer.mu.Lock()
+		peer.eof = true
+		peer.mu.Unlock()
+
+		peer.q.Notify(waiter.EventIn | waiter.EventRdHUp | waiter.EventHUp)
+	}
+
+	e.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventRdHUp | waiter.EventHUp)
+
+	return nil
+}
+
+// Close closes the endpoint. If data it was sent is left unread, the
+// connection is reset rather than closed, as on Linux.
+func (e *TCPEndpoint) Close() {
+	e.mu.Lock()
+
+	if e.state == tcpClosed {
+		e.mu.Unlock()
+		return
+	}
+
+	state := e.state
+	bound, port := e.bound, e.local.Port
+	peer, pending := e.peer, e.pending
+	unread := len(e.rcv) > 0
+
+	e.state = tcpClosed
+	e.bound = nil
+	e.pending = nil
+	e.rcv = nil
+	e.eof = true
+	e.sndShut = true
+
+	e.mu.Unlock()
+
+	if bound != nil {
+		e.stack.unbind(e.stack.tcp, port, bound)
+	}
+
+	// Connections that weren't accepted are reset.
+	for _, conn := range pending {
+		conn.mu.Lock()
+		conn.rcv = nil
+		conn.mu.Unlock()
+
+		conn.Abort()
+	}
+
+	if state == tcpConnected {
+		if unread {
+			peer.resetBy()
+		} else {
+			peer.mu.Lock()
+			peer.eof = true
+			peer.mu.Unlock()
+		}
+
+		peer.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp | waiter.EventRdHUp | waiter.EventErr)
+	}
+
+	e.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp | waiter.EventRdHUp)
+}
+
+// Abort closes the endpoint and resets its peer, rather than letting it
+// read what's left, as closing with a zero SO_LINGER does.
+func (e *TCPEndpoint) Abort() {
+	e.mu.Lock()
+	peer := e.peer
+	e.mu.Unlock()
+
+	e.Close()
+
+	if peer != nil {
+		peer.resetBy()
+		peer.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp | waiter.EventErr)
+	}
+}
+
+// resetBy is the receipt of a reset by the peer: what was received is
+// dropped, and the next call fails with ErrConnectionReset.
+func (e *TCPEndpoint) resetBy() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.state != tcpConnected {
+		return
+	}
+
+	e.err = ErrConnectionReset
+	e.rcv = nil
+	e.eof = true
+	e.sndShut = true
+}
+
+// LocalAddress returns the address the endpoint is bound to, which is the
+// wildcard address and port 0 if it isn't.
+func (e *TCPEndpoint) LocalAddress() Address {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.state == tcpInitial || (e.state == tcpClosed && e.local.IP == nil) {
+		return Address{IP: anyAddress(e.v6)}
+	}
+
+	return e.local
+}
+
+func (e *TCPEndpoint) RemoteAddress() (Address, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.state != tcpConnected {
+		return Address{}, ErrNotConnected
+	}
+
+	return e.remote, nil
+}
+
+// TakeError returns and clears the error the next call would fail with,
+// for SO_ERROR.
+func (e *TCPEndpoint) TakeError() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.err
+	e.err = nil
+
+	return err
+}
+
+// Listening reports whether the endpoint accepts connections.
+func (e *TCPEndpoint) Listening() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.state == tcpListening
+}
+
+// TCPInfo is what TCP_INFO reports about an endpoint.
+type TCPInfo struct {
+	// State is one of linux.TCP_ESTABLISHED and the like.
+	State uint8
+
+	BytesSent, BytesReceived uint64
+
+	// Unread is how much has been received and not read.
+	Unread int
+}
+
+func (e *TCPEndpoint) Info() TCPInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	info := TCPInfo{
+		BytesSent:     e.sent,
+		BytesReceived: e.received,
+		Unread:        len(e.rcv),
+	}
+
+	switch {
+	case e.state == tcpListening:
+		info.State = linux.TCP_LISTEN
+	case e.state != tcpConnected:
+		info.State = linux.TCP_CLOSE
+	case e.eof && e.sndShut:
+		info.State = linux.TCP_CLOSE
+	case e.eof:
+		info.State = linux.TCP_CLOSE_WAIT
+	case e.sndShut:
+		info.State = linux.TCP_FIN_WAIT2
+	default:
+		info.State = linux.TCP_ESTABLISHED
+	}
+
+	return info
+}
@@ -0,0 +1,477 @@
+package netstack
+
+import (
+	"context"
+	"sync"
+
+	"github.com/evanphx/columbia/pkg/waiter"
+)
+
+// maxDatagram is the largest payload of a UDP datagram over IPv4.
+const maxDatagram = 65507
+
+type datagram struct {
+	data []byte
+	from Address
+}
+
+// UDPEndpoint is a UDP socket's endpoint in the stack. Datagrams are only
+// delivered between the stack's own addresses; those sent anywhere else
+// are dropped, as they would be by a link nothing answers on.
+type UDPEndpoint struct {
+	stack *Stack
+	v6    bool
+
+	q waiter.Queue
+
+	mu sync.Mutex
+
+	bound *binding
+	local Address
+
+	// connected is set once the endpoint has a remote, which is the only
+	// address it then receives from.
+	connected bool
+	remote    Address
+
+	reuse, v6only, broadcast bool
+
+	rcv     []datagram
+	rcvSize int
+
+	rdShut, wrShut, closed bool
+
+	// err is a refusal of what was sent to the remote, reported by the
+	// next call.
+	err error
+}
+
+// NewUDPEndpoint returns an endpoint for a socket of the IPv6 family if v6
+// is set, or else of IPv4.
+func (s *Stack) NewUDPEndpoint(v6 bool) *UDPEndpoint {
+	return &UDPEndpoint{stack: s, v6: v6}
+}
+
+func (e *UDPEndpoint) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	e.q.EventRegister(ch, mask)
+}
+
+func (e *UDPEndpoint) EventUnregister(ch chan struct{}) {
+	e.q.EventUnregister(ch)
+}
+
+func (e *UDPEndpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Sending never waits, as datagrams that don't fit are dropped.
+	ready := waiter.EventOut
+
+	if len(e.rcv) > 0 || e.rdShut || e.err != nil {
+		ready |= waiter.EventIn
+	}
+
+	if e.rdShut {
+		ready |= waiter.EventRdHUp
+	}
+
+	if e.rdShut && e.wrShut {
+		ready |= waiter.EventHUp
+	}
+
+	if e.err != nil {
+		ready |= waiter.EventErr
+	}
+
+	return ready & mask
+}
+
+// SetReuseAddress sets SO_REUSEADDR, which lets endpoints bind to the same
+// port. Each datagram is delivered to one of them.
+func (e *UDPEndpoint) SetReuseAddress(reuse bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.reuse = reuse
+}
+
+func (e *UDPEndpoint) ReuseAddress() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.reuse
+}
+
+// SetV6Only sets IPV6_V6ONLY, which keeps an IPv6 endpoint from IPv4
+// traffic. It can't be changed once the endpoint is bound.
+func (e *UDPEndpoint) SetV6Only(v6only bool) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.v6 || e.bound != nil {
+		return ErrInvalidState
+	}
+
+	e.v6only = v6only
+
+	return nil
+}
+
+func (e *UDPEndpoint) V6Only() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.v6only
+}
+
+// SetBroadcast sets SO_BROADCAST. It's only kept to be reported, as there
+// is no network to broadcast on.
+func (e *UDPEndpoint) SetBroadcast(broadcast bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.broadcast = broadcast
+}
+
+func (e *UDPEndpoint) Broadcast() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.broadcast
+}
+
+// Bind binds the endpoint to addr. A port of 0 picks a free one.
+func (e *UDPEndpoint) Bind(addr Address) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.bound != nil || e.closed {
+		return ErrInvalidState
+	}
+
+	return e.bindLocked(addr)
+}
+
+func (e *UDPEndpoint) bindLocked(addr Address) error {
+	b, port, err := e.stack.bind(e.stack.udp, addr.IP, addr.Port, e.v6only, e.reuse, e)
+	if err != nil {
+		return err
+	}
+
+	e.bound = b
+	e.local = Address{IP: addr.IP, Port: port}
+
+	return nil
+}
+
+// Connect sets the endpoint's remote, binding it to a free port first if
+// it isn't bound. A nil or unspecified addr removes the remote instead.
+func (e *UDPEndpoint) Connect(addr *Address) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return ErrInvalidState
+	}
+
+	if addr == nil || (addr.IP.IsUnspecified() && addr.Port == 0) {
+		e.connected = false
+		e.remote = Address{}
+
+		return nil
+	}
+
+	src, _, err := e.stack.route(addr.IP)
+	if err != nil {
+		return err
+	}
+
+	if e.bound == nil {
+		if err := e.bindLocked(Address{IP: anyAddress(e.v6)}); err != nil {
+			return err
+		}
+	}
+
+	remote := *addr
+	if remote.IP.IsUnspecified() {
+		remote.IP = src
+	}
+
+	e.connected = true
+	e.remote = remote
+
+	return nil
+}
+
+// SendTo sends data as one datagram to to, or to the remote if to is nil,
+// binding the endpoint to a free port first if it isn't bound.
+func (e *UDPEndpoint) SendTo(data []byte, to *Address) (int, error) {
+	if len(data) > maxDatagram {
+		return 0, ErrMessageSize
+	}
+
+	e.mu.Lock()
+
+	switch {
+	case e.err != nil:
+		err := e.err
+		e.err = nil
+		e.mu.Unlock()
+
+		return 0, err
+	case e.wrShut || e.closed:
+		e.mu.Unlock()
+		return 0, ErrBrokenPipe
+	case to == nil && !e.connected:
+		e.mu.Unlock()
+		return 0, ErrDestinationRequired
+	}
+
+	dst := e.remote
+	if to != nil {
+		dst = *to
+	}
+
+	e.mu.Unlock()
+
+	src, local, err := e.stack.route(dst.IP)
+	if err != nil {
+		return 0, err
+	}
+
+	if dst.IP.IsUnspecified() {
+		dst.IP = src
+	}
+
+	e.mu.Lock()
+
+	if e.bound == nil {
+		if err := e.bindLocked(Address{IP: anyAddress(e.v6)}); err != nil {
+			e.mu.Unlock()
+			return 0, err
+		}
+	}
+
+	from := e.local
+	if from.IP.IsUnspecified() {
+		from.IP = src
+	}
+
+	connected := to == nil
+
+	e.mu.Unlock()
+
+	if !local {
+		return len(data), nil
+	}
+
+	var receiver *UDPEndpoint
+
+	all := func(*binding) bool { return true }
+
+	// A connected endpoint only receives from its remote.
+	for _, owner := range e.stack.lookup(e.stack.udp, dst.IP, dst.Port, all) {
+		if r := owner.(*UDPEndpoint); r.accepts(from) {
+			receiver = r
+			break
+		}
+	}
+
+	if receiver == nil {
+		// The port unreachable that comes back is only reported to a
+		// connected endpoint.
+		if connected {
+			e.mu.Lock()
+			e.err = ErrConnectionRefused
+			e.mu.Unlock()
+
+			e.q.Notify(waiter.EventIn | waiter.EventErr)
+		}
+
+		return len(data), nil
+	}
+
+	receiver.deliver(datagram{
+		data: append([]byte(nil), data...),
+		from: from,
+	})
+
+	return len(data), nil
+}
+
+// accepts reports whether e receives datagrams from from.
+func (e *UDPEndpoint) accepts(from Address) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return !e.connected || (e.remote.IP.Equal(from.IP) && e.remote.Port == from.Port)
+}
+
+// deliver queues d to be received, dropping it if there's no room.
+func (e *UDPEndpoint) deliver(d datagram) {
+	e.mu.Lock()
+
+	if e.rdShut || e.closed || e.rcvSize+len(d.data) > bufferSize {
+		e.mu.Unlock()
+		return
+	}
+
+	e.rcv = append(e.rcv, d)
+	e.rcvSize += len(d.data)
+
+	e.mu.Unlock()
+
+	e.q.Notify(waiter.EventIn)
+}
+
+// RecvFrom receives the next datagram, up to size bytes of it, who it was
+// from and its full length; the rest of a longer datagram is dropped. With
+// peek, the datagram is left to be received again. Once reading is shut
+// down, it returns nothing.
+func (e *UDPEndpoint) RecvFrom(ctx context.Context, size int, peek, nonblock bool) ([]byte, Address, int, error) {
+	for {
+		e.mu.Lock()
+
+		if e.err != nil {
+			err := e.err
+			e.err = nil
+			e.mu.Unlock()
+
+			return nil, Address{}, 0, err
+		}
+
+		if len(e.rcv) > 0 {
+			d := e.rcv[0]
+
+			if !peek {
+				e.rcv[0] = datagram{}
+				e.rcv = e.rcv[1:]
+				e.rcvSize -= len(d.data)
+			}
+
+			e.mu.Unlock()
+
+			data := d.data
+			if len(data) > size {
+				data = data[:size]
+			}
+
+			return data, d.from, len(d.data), nil
+		}
+
+		shut := e.rdShut || e.closed
+
+		e.mu.Unlock()
+
+		if shut {
+			return nil, Address{}, 0, nil
+		}
+
+		if nonblock {
+			return nil, Address{}, 0, ErrWouldBlock
+		}
+
+		if err := waiter.Wait(ctx, e, waiter.EventIn); err != nil {
+			return nil, Address{}, 0, err
+		}
+	}
+}
+
+// Shutdown shuts down reading, writing or both. As on Linux, it needs the
+// endpoint to be connected.
+func (e *UDPEndpoint) Shutdown(read, write bool) error {
+	e.mu.Lock()
+
+	if !e.connected {
+		e.mu.Unlock()
+		return ErrNotConnected
+	}
+
+	if read {
+		e.rdShut = true
+		e.rcv = nil
+		e.rcvSize = 0
+	}
+
+	if write {
+		e.wrShut = true
+	}
+
+	e.mu.Unlock()
+
+	e.q.Notify(waiter.EventIn | waiter.EventRdHUp | waiter.EventHUp)
+
+	return nil
+}
+
+func (e *UDPEndpoint) Close() {
+	e.mu.Lock()
+
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+
+	bound, port := e.bound, e.local.Port
+
+	e.closed = true
+	e.bound = nil
+	e.rcv = nil
+	e.rcvSize = 0
+
+	e.mu.Unlock()
+
+	if bound != nil {
+		e.stack.unbind(e.stack.udp, port, bound)
+	}
+
+	e.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp)
+}
+
+// LocalAddress returns the address the endpoint is bound to, which is the
+// wildcard address and port 0 if it isn't.
+func (e *UDPEndpoint) LocalAddress() Address {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.bound == nil {
+		return Address{IP: anyAddress(e.v6)}
+	}
+
+	return e.local
+}
+
+func (e *UDPEndpoint) RemoteAddress() (Address, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.connected {
+		return Address{}, ErrNotConnected
+	}
+
+	return e.remote, nil
+}
+
+// TakeError returns and clears the error the next call would fail with,
+// for SO_ERROR.
+func (e *UDPEndpoint) TakeError() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.err
+	e.err = nil
+
+	return err
+}
+
+// Unread is the length of the next datagram to be received, for FIONREAD.
+func (e *UDPEndpoint) Unread() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.rcv) == 0 {
+		return 0
+	}
+
+	return len(e.rcv[0].data)
+}
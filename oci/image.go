@@ -0,0 +1,304 @@
+package oci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/overlay"
+	"github.com/evanphx/columbia/fs/tarfs"
+	"github.com/pkg/errors"
+)
+
+// ContainerConfig is the part of the image config describing how to run
+// the image.
+type ContainerConfig struct {
+	User       string   `json:"User,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+}
+
+// RootFS lists the uncompressed digests of the layers.
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// ImageConfig is the image config blob referenced by a manifest.
+type ImageConfig struct {
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       ContainerConfig `json:"config"`
+	RootFS       RootFS          `json:"rootfs"`
+}
+
+// Image is a single image within a layout.
+type Image struct {
+	Layout   *Layout
+	Manifest *Manifest
+	Config   *ImageConfig
+
+	// CacheDir, when set, is where decompressed layers are kept between
+	// runs, named by the digest of the compressed blob. Otherwise
+	// compressed layers are decompressed to unlinked temporary files.
+	CacheDir string
+}
+
+// Open reads the image stored under ref in the layout at path. An empty
+// ref selects the first image in the layout.
+func Open(path, ref string) (*Image, error) {
+	l, err := OpenLayout(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := l.Manifest(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	switch m.Config.MediaType {
+	case MediaTypeImageConfig, MediaTypeDockerImageConfig:
+		// ok
+	default:
+		return nil, errors.Wrapf(ErrUnsupportedMedia, "config media type: %s", m.Config.MediaType)
+	}
+
+	data, err := l.ReadBlob(m.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg ImageConfig
+
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing image config %s", m.Config.Digest)
+	}
+
+	if len(cfg.RootFS.DiffIDs) != 0 && len(cfg.RootFS.DiffIDs) != len(m.Layers) {
+		return nil, ErrLayerCountMismatch
+	}
+
+	return &Image{
+		Layout:   l,
+		Manifest: m,
+		Config:   &cfg,
+	}, nil
+}
+
+// layerFS indexes the i-th layer of the manifest. File bodies are read
+// from the layer on demand rather than held in memory, so compressed
+// layers are first decompressed to a file.
+func (img *Image) layerFS(i int) (*tarfs.TarFS, error) {
+	desc := img.Manifest.Layers[i]
+
+	var (
+		f   *os.File
+		err error
+	)
+
+	switch desc.MediaType {
+	case MediaTypeImageLayer, MediaTypeDockerLayer:
+		f, err = img.Layout.OpenBlobFile(desc)
+	case MediaTypeImageLayerGzip, MediaTypeImageLayerZstd, MediaTypeDockerLayerGzip:
+		f, err = img.decompressLayer(i)
+	default:
+		return nil, errors.Wrapf(ErrUnsupportedMedia, "layer %s", desc)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	t, err := tarfs.NewSeekableTarFS(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// decompressLayer returns a file holding the uncompressed contents of the
+// i-th layer, checking both the blob digest and the diff id from the
+// config.
+func (img *Image) decompressLayer(i int) (*os.File, error) {
+	desc := img.Manifest.Layers[i]
+
+	var cachePath string
+
+	if img.CacheDir != "" {
+		_, enc, err := img.Layout.blobPath(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		cachePath = filepath.Join(img.CacheDir, "sha256", enc)
+
+		// Entries are only renamed into place once verified.
+		if f, err := os.Open(cachePath); err == nil {
+			return f, nil
+		}
+
+		err = os.MkdirAll(filepath.Dir(cachePath), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := img.Layout.OpenBlob(desc)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	dr, _, err := tarfs.Decompress(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decompressing layer %s", desc.Digest)
+	}
+
+	defer dr.Close()
+
+	dir := os.TempDir()
+	if cachePath != "" {
+		dir = filepath.Dir(cachePath)
+	}
+
+	f, err := ioutil.TempFile(dir, "layer")
+	if err != nil {
+		return nil, err
+	}
+
+	done := false
+
+	defer func() {
+		if !done {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	h := sha256.New()
+
+	_, err = io.Copy(io.MultiWriter(f, h), dr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decompressing layer %s", desc.Digest)
+	}
+
+	// Drain anything after the compressed stream so the digest is checked.
+	_, err = io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if diffIDs := img.Config.RootFS.DiffIDs; len(diffIDs) > i {
+		diffID := diffIDs[i]
+
+		if strings.HasPrefix(diffID, "sha256:") && diffID != "sha256:"+hex.EncodeToString(h.Sum(nil)) {
+			return nil, errors.Wrapf(ErrDigestMismatch, "layer diff id: %s", diffID)
+		}
+	}
+
+	if cachePath != "" {
+		err = os.Rename(f.Name(), cachePath)
+	} else {
+		// The open file keeps the contents around until it's closed.
+		err = os.Remove(f.Name())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	done = true
+
+	return f, nil
+}
+
+// RootFS assembles the root filesystem by stacking the layers in an
+// overlay, honoring the whiteouts within them. upper is the writable layer
+// of the container, or nil for a read-only root.
+func (img *Image) RootFS(ctx context.Context, upper *fs.Inode) (*fs.Inode, error) {
+	lowers := make([]*fs.Inode, len(img.Manifest.Layers))
+
+	for i, desc := range img.Manifest.Layers {
+		t, err := img.layerFS(i)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading layer %s", desc.Digest)
+		}
+
+		root, err := t.Root()
+		if err != nil {
+			return nil, err
+		}
+
+		// The manifest lists the bottom layer first.
+		lowers[len(lowers)-1-i] = root
+	}
+
+	if len(lowers) == 0 {
+		root, err := tarfs.NewEmptyTarFS().Root()
+		if err != nil {
+			return nil, err
+		}
+
+		lowers = append(lowers, root)
+	}
+
+	o, err := overlay.NewOverlayFS(ctx, upper, lowers...)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.Root()
+}
+
+// Args returns the argv to run, with args replacing the image's Cmd when
+// given, as `docker run` does.
+func (img *Image) Args(args []string) []string {
+	if len(args) == 0 {
+		args = img.Config.Config.Cmd
+	}
+
+	var out []string
+	out = append(out, img.Config.Config.Entrypoint...)
+	out = append(out, args...)
+
+	return out
+}
+
+// Env returns the environment from the image config.
+func (img *Image) Env() []string {
+	return img.Config.Config.Env
+}
+
+// WorkingDir returns the directory to start in, defaulting to /.
+func (img *Image) WorkingDir() string {
+	if img.Config.Config.WorkingDir == "" {
+		return "/"
+	}
+
+	return img.Config.Config.WorkingDir
+}
@@ -0,0 +1,291 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/tarfs"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type tarEntry struct {
+	name, body string
+	typ        byte
+}
+
+func buildTar(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+
+	for _, ent := range entries {
+		hdr := &tar.Header{
+			Name:     ent.name,
+			Mode:     0644,
+			Size:     int64(len(ent.body)),
+			Typeflag: ent.typ,
+		}
+
+		if ent.typ == tar.TypeDir {
+			hdr.Mode = 0755
+			hdr.Size = 0
+		}
+
+		require.NoError(t, tw.WriteHeader(hdr))
+
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte(ent.body))
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+func zstdData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+
+	w, err := zstd.NewWriter(&buf)
+	require.NoError(t, err)
+
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+func writeBlob(t *testing.T, dir, mediaType string, data []byte) Descriptor {
+	sum := sha256.Sum256(data)
+	enc := hex.EncodeToString(sum[:])
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", enc), data, 0644))
+
+	return Descriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + enc,
+		Size:      int64(len(data)),
+	}
+}
+
+func writeJSONBlob(t *testing.T, dir, mediaType string, v interface{}) Descriptor {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	return writeBlob(t, dir, mediaType, data)
+}
+
+func buildLayout(t *testing.T, layers ...[]byte) string {
+	dir, err := ioutil.TempDir("", "oci")
+	require.NoError(t, err)
+
+	var descs []Descriptor
+
+	for _, layer := range layers {
+		mediaType := MediaTypeImageLayer
+
+		switch tarfs.DetectCompression(layer) {
+		case tarfs.Gzip:
+			mediaType = MediaTypeImageLayerGzip
+		case tarfs.Zstd:
+			mediaType = MediaTypeImageLayerZstd
+		}
+
+		descs = append(descs, writeBlob(t, dir, mediaType, layer))
+	}
+
+	config := writeJSONBlob(t, dir, MediaTypeImageConfig, ImageConfig{
+		Architecture: "wasm32",
+		OS:           "linux",
+		Config: ContainerConfig{
+			User:       "daemon",
+			Env:        []string{"PATH=/bin"},
+			Entrypoint: []string{"/bin/sh", "-c"},
+			Cmd:        []string{"echo hello"},
+			WorkingDir: "/srv",
+		},
+	})
+
+	manifest := writeJSONBlob(t, dir, MediaTypeImageManifest, Manifest{
+		SchemaVersion: 2,
+		Config:        config,
+		Layers:        descs,
+	})
+
+	manifest.Annotations = map[string]string{AnnotationRefName: "latest"}
+
+	idx, err := json.Marshal(Index{SchemaVersion: 2, Manifests: []Descriptor{manifest}})
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), idx, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644))
+
+	return dir
+}
+
+func readFile(t *testing.T, m *fs.MountNamespace, path string) string {
+	dirent, err := m.LookupPath(context.Background(), path)
+	require.NoError(t, err)
+
+	r, err := dirent.Reader()
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	return string(data)
+}
+
+func TestImage(t *testing.T) {
+	base := buildTar(t, []tarEntry{
+		{name: "bin/", typ: tar.TypeDir},
+		{name: "bin/sh", body: "base shell", typ: tar.TypeReg},
+		{name: "etc/passwd", body: "root:x:0:0::/root:/bin/sh\ndaemon:x:2:3::/:/bin/sh\n", typ: tar.TypeReg},
+		{name: "etc/group", body: "root:x:0:\nadm:x:4:root,daemon\ndisk:x:6:root\nlp:x:7:daemon\n", typ: tar.TypeReg},
+		{name: "etc/motd", body: "hello", typ: tar.TypeReg},
+	})
+
+	top := buildTar(t, []tarEntry{
+		{name: "bin/sh", body: "new shell", typ: tar.TypeReg},
+		{name: "srv/data", body: "data", typ: tar.TypeReg},
+		{name: "etc/.wh.motd", typ: tar.TypeReg},
+	})
+
+	dir := buildLayout(t, base, top)
+	defer os.RemoveAll(dir)
+
+	t.Run("applies the layers in order", func(t *testing.T) {
+		img, err := Open(dir, "latest")
+		require.NoError(t, err)
+
+		root, err := img.RootFS(context.Background(), nil)
+		require.NoError(t, err)
+
+		m := fs.NewMountNamespace()
+		m.SetRoot(root)
+
+		require.Equal(t, "new shell", readFile(t, m, "/bin/sh"))
+		require.Equal(t, "data", readFile(t, m, "/srv/data"))
+
+		_, err = m.LookupPath(context.Background(), "/etc/motd")
+		require.Equal(t, fs.ErrUnknownPath, err)
+
+		uid, gid, err := ResolveUser(context.Background(), m, img.Config.Config.User)
+		require.NoError(t, err)
+
+		require.Equal(t, 2, uid)
+		require.Equal(t, 3, gid)
+
+		groups, err := SupplementaryGroups(context.Background(), m, uid)
+		require.NoError(t, err)
+
+		require.Equal(t, []int{4, 7}, groups)
+
+		groups, err = SupplementaryGroups(context.Background(), m, 1000)
+		require.NoError(t, err)
+
+		require.Empty(t, groups)
+	})
+
+	t.Run("builds argv from the config", func(t *testing.T) {
+		img, err := Open(dir, "")
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"/bin/sh", "-c", "echo hello"}, img.Args(nil))
+		require.Equal(t, []string{"/bin/sh", "-c", "ls"}, img.Args([]string{"ls"}))
+		require.Equal(t, "/srv", img.WorkingDir())
+		require.Equal(t, []string{"PATH=/bin"}, img.Env())
+	})
+
+	t.Run("rejects unknown refs", func(t *testing.T) {
+		_, err := Open(dir, "nope")
+		require.Error(t, err)
+	})
+
+	t.Run("detects corrupted blobs", func(t *testing.T) {
+		img, err := Open(dir, "")
+		require.NoError(t, err)
+
+		path, _, err := img.Layout.blobPath(img.Manifest.Layers[1].Digest)
+		require.NoError(t, err)
+
+		require.NoError(t, ioutil.WriteFile(path, base, 0644))
+
+		_, err = img.RootFS(context.Background(), nil)
+		require.Error(t, err)
+	})
+
+	t.Run("reads compressed layers", func(t *testing.T) {
+		dir := buildLayout(t, gzipData(t, base), zstdData(t, top))
+		defer os.RemoveAll(dir)
+
+		cache, err := ioutil.TempDir("", "layers")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(cache)
+
+		for i := 0; i < 2; i++ {
+			img, err := Open(dir, "")
+			require.NoError(t, err)
+
+			img.CacheDir = cache
+
+			root, err := img.RootFS(context.Background(), nil)
+			require.NoError(t, err)
+
+			m := fs.NewMountNamespace()
+			m.SetRoot(root)
+
+			require.Equal(t, "new shell", readFile(t, m, "/bin/sh"))
+			require.Equal(t, "data", readFile(t, m, "/srv/data"))
+
+			_, err = m.LookupPath(context.Background(), "/etc/motd")
+			require.Equal(t, fs.ErrUnknownPath, err)
+		}
+
+		cached, err := ioutil.ReadDir(filepath.Join(cache, "sha256"))
+		require.NoError(t, err)
+		require.Len(t, cached, 2)
+	})
+
+	t.Run("checks the diff ids of compressed layers", func(t *testing.T) {
+		dir := buildLayout(t, gzipData(t, base))
+		defer os.RemoveAll(dir)
+
+		img, err := Open(dir, "")
+		require.NoError(t, err)
+
+		img.Config.RootFS.DiffIDs = []string{"sha256:" + strings.Repeat("0", 64)}
+
+		_, err = img.RootFS(context.Background(), nil)
+		require.Equal(t, ErrDigestMismatch, errors.Cause(err))
+	})
+}
@@ -0,0 +1,350 @@
+// Package oci reads container images stored in an OCI image layout
+// directory, as produced by tools like skopeo or `docker save` converted
+// with umoci.
+package oci
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	MediaTypeImageIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeImageConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeImageLayer    = "application/vnd.oci.image.layer.v1.tar"
+
+	MediaTypeImageLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// Docker's media types, which show up in layouts converted from
+	// docker images.
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerImageConfig  = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar"
+	MediaTypeDockerLayerGzip    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// AnnotationRefName is the annotation on an index entry holding the
+	// tag it was stored under.
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+)
+
+var (
+	ErrNotLayout          = errors.New("not an OCI image layout")
+	ErrNoManifest         = errors.New("no matching manifest in image index")
+	ErrDigestMismatch     = errors.New("blob does not match its digest")
+	ErrUnsupportedDigest  = errors.New("unsupported digest algorithm")
+	ErrUnsupportedMedia   = errors.New("unsupported media type")
+	ErrInvalidDescriptor  = errors.New("invalid descriptor")
+	ErrLayerCountMismatch = errors.New("config diff_ids do not match manifest layers")
+)
+
+// Descriptor references a blob in the layout.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Platform describes what an image in an index runs on.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// Index is the contents of index.json, or of a nested image index blob.
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Manifest describes the config and layers of a single image.
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+type layoutFile struct {
+	Version string `json:"imageLayoutVersion"`
+}
+
+// Layout is an OCI image layout directory on the host.
+type Layout struct {
+	Path string
+}
+
+// OpenLayout checks that path is an image layout and returns it.
+func OpenLayout(path string) (*Layout, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, "oci-layout"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrapf(ErrNotLayout, "missing oci-layout in %s", path)
+		}
+
+		return nil, err
+	}
+
+	var lf layoutFile
+
+	err = json.Unmarshal(data, &lf)
+	if err != nil {
+		return nil, errors.Wrapf(ErrNotLayout, "unable to parse oci-layout: %s", err)
+	}
+
+	if lf.Version == "" {
+		return nil, errors.Wrapf(ErrNotLayout, "missing imageLayoutVersion")
+	}
+
+	return &Layout{Path: path}, nil
+}
+
+// Index reads index.json.
+func (l *Layout) Index() (*Index, error) {
+	data, err := ioutil.ReadFile(filepath.Join(l.Path, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var idx Index
+
+	err = json.Unmarshal(data, &idx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing index.json")
+	}
+
+	return &idx, nil
+}
+
+func (l *Layout) blobPath(digest string) (string, string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", errors.Wrapf(ErrInvalidDescriptor, "bad digest: %s", digest)
+	}
+
+	alg, enc := parts[0], parts[1]
+
+	if alg != "sha256" {
+		return "", "", errors.Wrapf(ErrUnsupportedDigest, "digest: %s", digest)
+	}
+
+	// Guard against digests being used to walk out of the layout.
+	if strings.ContainsAny(enc, "/\\.") {
+		return "", "", errors.Wrapf(ErrInvalidDescriptor, "bad digest: %s", digest)
+	}
+
+	return filepath.Join(l.Path, "blobs", alg, enc), enc, nil
+}
+
+// OpenBlob returns the contents of the blob referenced by desc. The digest
+// is verified as the blob is read, with a mismatch reported by the final
+// Read instead of io.EOF.
+func (l *Layout) OpenBlob(desc Descriptor) (io.ReadCloser, error) {
+	path, enc, err := l.blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &verifyReader{
+		f:        f,
+		h:        sha256.New(),
+		expected: enc,
+		digest:   desc.Digest,
+	}, nil
+}
+
+// ReadBlob reads and verifies the entire blob referenced by desc.
+func (l *Layout) ReadBlob(desc Descriptor) ([]byte, error) {
+	r, err := l.OpenBlob(desc)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	var buf bytes.Buffer
+
+	_, err = io.Copy(&buf, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// OpenBlobFile opens the file holding the blob referenced by desc, for
+// callers that need random access. The digest is verified up front.
+func (l *Layout) OpenBlobFile(desc Descriptor) (*os.File, error) {
+	path, enc, err := l.blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+
+	_, err = io.Copy(h, f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != enc {
+		f.Close()
+		return nil, errors.Wrapf(ErrDigestMismatch, "blob: %s", desc.Digest)
+	}
+
+	return f, nil
+}
+
+type verifyReader struct {
+	f        *os.File
+	h        hash.Hash
+	expected string
+	digest   string
+}
+
+func (v *verifyReader) Read(b []byte) (int, error) {
+	n, err := v.f.Read(b)
+	v.h.Write(b[:n])
+
+	if err == io.EOF {
+		if hex.EncodeToString(v.h.Sum(nil)) != v.expected {
+			return n, errors.Wrapf(ErrDigestMismatch, "blob: %s", v.digest)
+		}
+	}
+
+	return n, err
+}
+
+func (v *verifyReader) Close() error {
+	return v.f.Close()
+}
+
+// Manifest finds the image manifest for ref, which is matched against the
+// ref name annotation of the entries in index.json. An empty ref selects
+// the first image. Nested indexes are searched for an image that can run
+// on columbia.
+func (l *Layout) Manifest(ref string) (*Manifest, error) {
+	idx, err := l.Index()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, desc := range idx.Manifests {
+		if ref != "" && desc.Annotations[AnnotationRefName] != ref {
+			continue
+		}
+
+		m, err := l.resolveManifest(desc)
+		if err != nil {
+			if errors.Cause(err) == ErrNoManifest {
+				continue
+			}
+
+			return nil, err
+		}
+
+		return m, nil
+	}
+
+	if ref != "" {
+		return nil, errors.Wrapf(ErrNoManifest, "ref: %s", ref)
+	}
+
+	return nil, ErrNoManifest
+}
+
+func (l *Layout) resolveManifest(desc Descriptor) (*Manifest, error) {
+	switch desc.MediaType {
+	case MediaTypeImageManifest, MediaTypeDockerManifest:
+		data, err := l.ReadBlob(desc)
+		if err != nil {
+			return nil, err
+		}
+
+		var m Manifest
+
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing manifest %s", desc.Digest)
+		}
+
+		return &m, nil
+	case MediaTypeImageIndex, MediaTypeDockerManifestList:
+		data, err := l.ReadBlob(desc)
+		if err != nil {
+			return nil, err
+		}
+
+		var idx Index
+
+		err = json.Unmarshal(data, &idx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing index %s", desc.Digest)
+		}
+
+		for _, sub := range idx.Manifests {
+			if sub.Platform != nil && !supportedPlatform(sub.Platform) {
+				continue
+			}
+
+			m, err := l.resolveManifest(sub)
+			if err != nil {
+				if errors.Cause(err) == ErrNoManifest {
+					continue
+				}
+
+				return nil, err
+			}
+
+			return m, nil
+		}
+
+		return nil, ErrNoManifest
+	default:
+		return nil, errors.Wrapf(ErrUnsupportedMedia, "manifest media type: %s", desc.MediaType)
+	}
+}
+
+func supportedPlatform(p *Platform) bool {
+	switch p.Architecture {
+	case "wasm", "wasm32":
+		return true
+	default:
+		return false
+	}
+}
+
+func (d Descriptor) String() string {
+	return fmt.Sprintf("%s (%s, %d bytes)", d.Digest, d.MediaType, d.Size)
+}
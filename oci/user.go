@@ -0,0 +1,199 @@
+package oci
+
+import (
+	"bufio"
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/pkg/errors"
+)
+
+var ErrUnknownUser = errors.New("unknown user")
+
+// ResolveUser turns the User field of an image config ("user", "uid",
+// "user:group", "uid:gid", ...) into numeric ids, consulting /etc/passwd
+// and /etc/group within the image for names. An empty user is root.
+func ResolveUser(ctx context.Context, mount *fs.MountNamespace, user string) (int, int, error) {
+	if user == "" {
+		return 0, 0, nil
+	}
+
+	var (
+		userPart  = user
+		groupPart string
+		hasGroup  bool
+	)
+
+	if idx := strings.IndexByte(user, ':'); idx != -1 {
+		userPart = user[:idx]
+		groupPart = user[idx+1:]
+		hasGroup = true
+	}
+
+	uid, gid := -1, -1
+
+	if id, err := strconv.Atoi(userPart); err == nil {
+		uid = id
+	}
+
+	// Look the user up by name or id to find their primary group.
+	found := false
+
+	err := scanDB(ctx, mount, "/etc/passwd", func(fields []string) bool {
+		if len(fields) < 4 {
+			return false
+		}
+
+		if fields[0] != userPart && fields[2] != userPart {
+			return false
+		}
+
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return false
+		}
+
+		g, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return false
+		}
+
+		uid, gid = id, g
+		found = true
+		return true
+	})
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if uid == -1 {
+		return 0, 0, errors.Wrapf(ErrUnknownUser, "user: %s", userPart)
+	}
+
+	if !found {
+		// Numeric users don't need to exist in the image.
+		gid = 0
+	}
+
+	if !hasGroup {
+		return uid, gid, nil
+	}
+
+	if id, err := strconv.Atoi(groupPart); err == nil {
+		return uid, id, nil
+	}
+
+	gid = -1
+
+	err = scanDB(ctx, mount, "/etc/group", func(fields []string) bool {
+		if len(fields) < 3 || fields[0] != groupPart {
+			return false
+		}
+
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return false
+		}
+
+		gid = id
+		return true
+	})
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if gid == -1 {
+		return 0, 0, errors.Wrapf(ErrUnknownUser, "group: %s", groupPart)
+	}
+
+	return uid, gid, nil
+}
+
+// scanDB calls f with the colon separated fields of each line of the file
+// at path, stopping when f returns true. A missing file is treated as
+// empty.
+func scanDB(ctx context.Context, mount *fs.MountNamespace, path string, f func([]string) bool) error {
+	dirent, err := mount.LookupPath(ctx, path)
+	if err != nil {
+		if errors.Cause(err) == fs.ErrUnknownPath {
+			return nil
+		}
+
+		return err
+	}
+
+	r, err := dirent.Reader()
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if f(strings.Split(line, ":")) {
+			break
+		}
+	}
+
+	return scanner.Err()
+}
+
+// SupplementaryGroups returns the groups /etc/group within the image lists
+// the user with uid as a member of, sorted. A uid without a name in
+// /etc/passwd is in no groups.
+func SupplementaryGroups(ctx context.Context, mount *fs.MountNamespace, uid int) ([]int, error) {
+	var name string
+
+	err := scanDB(ctx, mount, "/etc/passwd", func(fields []string) bool {
+		if len(fields) < 3 || fields[2] != strconv.Itoa(uid) {
+			return false
+		}
+
+		name = fields[0]
+		return true
+	})
+
+	if err != nil || name == "" {
+		return nil, err
+	}
+
+	var groups []int
+
+	err = scanDB(ctx, mount, "/etc/group", func(fields []string) bool {
+		if len(fields) < 4 {
+			return false
+		}
+
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return false
+		}
+
+		for _, member := range strings.Split(fields[3], ",") {
+			if member == name {
+				groups = append(groups, id)
+				break
+			}
+		}
+
+		return false
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Ints(groups)
+
+	return groups, nil
+}
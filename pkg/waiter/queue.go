@@ -0,0 +1,103 @@
+// Package waiter lets poll(2) and blocking calls wait for files to become
+// ready, without holding the locks of the files while they wait.
+package waiter
+
+import (
+	"context"
+	"sync"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+)
+
+// EventMask is a set of the events of poll(2).
+type EventMask uint16
+
+const (
+	EventIn    EventMask = linux.POLLIN
+	EventPri   EventMask = linux.POLLPRI
+	EventOut   EventMask = linux.POLLOUT
+	EventErr   EventMask = linux.POLLERR
+	EventHUp   EventMask = linux.POLLHUP
+	EventRdHUp EventMask = linux.POLLRDHUP
+
+	// alwaysReported are reported whether or not they were asked for.
+	alwaysReported = EventErr | EventHUp
+)
+
+// Waitable is implemented by the handles of files that can be waited on.
+type Waitable interface {
+	// Readiness returns which of the events in mask are ready now.
+	Readiness(mask EventMask) EventMask
+
+	// EventRegister arranges for ch to be sent to, without blocking, when
+	// one of the events in mask may have become ready.
+	EventRegister(ch chan struct{}, mask EventMask)
+
+	// EventUnregister undoes EventRegister.
+	EventUnregister(ch chan struct{})
+}
+
+// Queue holds the channels registered with a Waitable, and is what it
+// notifies as its state changes. The zero value is ready to use.
+type Queue struct {
+	mu      sync.Mutex
+	waiters map[chan struct{}]EventMask
+}
+
+func (q *Queue) EventRegister(ch chan struct{}, mask EventMask) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.waiters == nil {
+		q.waiters = make(map[chan struct{}]EventMask)
+	}
+
+	q.waiters[ch] = mask | alwaysReported
+}
+
+func (q *Queue) EventUnregister(ch chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.waiters, ch)
+}
+
+// Notify wakes the waiters for any of the events in mask.
+func (q *Queue) Notify(mask EventMask) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for ch, want := range q.waiters {
+		if want&mask == 0 {
+			continue
+		}
+
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Wait blocks until one of the events in mask is ready on w, returning
+// fs.ErrInterrupted if ctx is done first.
+func Wait(ctx context.Context, w Waitable, mask EventMask) error {
+	ch := make(chan struct{}, 1)
+
+	w.EventRegister(ch, mask)
+	defer w.EventUnregister(ch)
+
+	// Checked only after registering, so a change in between still wakes
+	// us.
+	if w.Readiness(mask|alwaysReported) != 0 {
+		return nil
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return fs.ErrInterrupted
+	}
+}
@@ -0,0 +1,269 @@
+// Package publish exposes ports of a guest on the host, as docker run -p
+// does: it listens on the host and proxies what arrives to the port on the
+// kernel's network stack.
+package publish
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/evanphx/columbia/netstack"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+var ErrBadSpec = errors.New("invalid publish specification")
+
+// bufferSize is how much is copied at a time in each direction. The proxy
+// holds no more than that, so a peer that stops reading stops the other
+// from sending once the buffers in between fill up.
+const bufferSize = 32 * 1024
+
+// Spec is a port to publish.
+type Spec struct {
+	// HostIP is the address to listen on, which is every address if it's
+	// nil.
+	HostIP   net.IP
+	HostPort int
+
+	GuestPort int
+
+	// Proto is "tcp" or "udp".
+	Proto string
+}
+
+// ParseSpec parses a --publish value, [HOSTIP:]HOSTPORT:GUESTPORT[/PROTO],
+// where PROTO is tcp, the default, or udp. An IPv6 HOSTIP is given in
+// brackets.
+func ParseSpec(s string) (Spec, error) {
+	spec := Spec{Proto: "tcp"}
+
+	rest := s
+
+	if idx := strings.LastIndexByte(rest, '/'); idx != -1 {
+		spec.Proto = rest[idx+1:]
+		rest = rest[:idx]
+
+		if spec.Proto != "tcp" && spec.Proto != "udp" {
+			return Spec{}, errors.Wrapf(ErrBadSpec, "unknown protocol: %s", s)
+		}
+	}
+
+	idx := strings.LastIndexByte(rest, ':')
+	if idx == -1 {
+		return Spec{}, errors.Wrapf(ErrBadSpec, "expected HOSTPORT:GUESTPORT: %s", s)
+	}
+
+	guest := rest[idx+1:]
+	rest = rest[:idx]
+
+	host := rest
+
+	if idx := strings.LastIndexByte(rest, ':'); idx != -1 {
+		ip := strings.TrimSuffix(strings.TrimPrefix(rest[:idx], "["), "]")
+		host = rest[idx+1:]
+
+		spec.HostIP = net.ParseIP(ip)
+		if spec.HostIP == nil {
+			return Spec{}, errors.Wrapf(ErrBadSpec, "invalid host address: %s", s)
+		}
+	}
+
+	var err error
+
+	spec.HostPort, err = parsePort(host)
+	if err != nil {
+		return Spec{}, errors.Wrapf(ErrBadSpec, "invalid host port: %s", s)
+	}
+
+	spec.GuestPort, err = parsePort(guest)
+	if err != nil || spec.GuestPort == 0 {
+		return Spec{}, errors.Wrapf(ErrBadSpec, "invalid guest port: %s", s)
+	}
+
+	return spec, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if port < 0 || port > 65535 {
+		return 0, ErrBadSpec
+	}
+
+	return port, nil
+}
+
+func (s Spec) hostAddr() string {
+	ip := ""
+	if s.HostIP != nil {
+		ip = s.HostIP.String()
+	}
+
+	return net.JoinHostPort(ip, strconv.Itoa(s.HostPort))
+}
+
+// Publisher is a published port.
+type Publisher struct {
+	l     hclog.Logger
+	stack *netstack.Stack
+	spec  Spec
+
+	// guest is where connections and datagrams are sent on the stack.
+	guest netstack.Address
+
+	ctx    context.Context
+	cancel func()
+
+	wg sync.WaitGroup
+
+	listener net.Listener
+	packets  *net.UDPConn
+
+	mu    sync.Mutex
+	conns map[io.Closer]struct{}
+	flows map[string]*flow
+
+	// clientFlows counts the flows of each client address.
+	clientFlows map[string]int
+}
+
+// Publish starts listening on the host and proxying to the guest port of
+// stack, until the Publisher is closed.
+func Publish(l hclog.Logger, stack *netstack.Stack, spec Spec) (*Publisher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := &Publisher{
+		l:           l,
+		stack:       stack,
+		spec:        spec,
+		guest:       netstack.Address{IP: guestIP(stack), Port: spec.GuestPort},
+		ctx:         ctx,
+		cancel:      cancel,
+		conns:       make(map[io.Closer]struct{}),
+		flows:       make(map[string]*flow),
+		clientFlows: make(map[string]int),
+	}
+
+	var err error
+
+	switch spec.Proto {
+	case "tcp":
+		p.listener, err = net.Listen("tcp", spec.hostAddr())
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		p.wg.Add(1)
+		go p.acceptLoop()
+	case "udp":
+		var addr *net.UDPAddr
+
+		addr, err = net.ResolveUDPAddr("udp", spec.hostAddr())
+		if err == nil {
+			p.packets, err = net.ListenUDP("udp", addr)
+		}
+
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		p.wg.Add(2)
+		go p.packetLoop()
+		go p.expireLoop()
+	default:
+		cancel()
+		return nil, errors.Wrapf(ErrBadSpec, "unknown protocol: %s", spec.Proto)
+	}
+
+	return p, nil
+}
+
+// guestIP is where the guest is reached: the address of its NIC if it has
+// one, as Docker connects to the address of a container, or else
+// 127.0.0.1.
+func guestIP(stack *netstack.Stack) net.IP {
+	for _, nic := range stack.NICs() {
+		if nic.Loopback {
+			continue
+		}
+
+		for _, a := range nic.Addrs {
+			if a.IP.To4() != nil {
+				return a.IP
+			}
+		}
+	}
+
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// Addr returns the address listened on, which has the port picked if the
+// spec's HostPort is 0.
+func (p *Publisher) Addr() net.Addr {
+	if p.listener != nil {
+		return p.listener.Addr()
+	}
+
+	return p.packets.LocalAddr()
+}
+
+// Close stops listening and tears down the connections being proxied.
+func (p *Publisher) Close() error {
+	p.cancel()
+
+	var err error
+
+	if p.listener != nil {
+		err = p.listener.Close()
+	} else {
+		err = p.packets.Close()
+	}
+
+	p.mu.Lock()
+
+	for c := range p.conns {
+		c.Close()
+	}
+
+	for _, f := range p.flows {
+		f.ep.Close()
+	}
+
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	return err
+}
+
+// track keeps c to be closed with the Publisher, returning false if it's
+// already closed.
+func (p *Publisher) track(c io.Closer) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ctx.Err() != nil {
+		return false
+	}
+
+	p.conns[c] = struct{}{}
+
+	return true
+}
+
+func (p *Publisher) untrack(c io.Closer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.conns, c)
+}
@@ -0,0 +1,428 @@
+package publish_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evanphx/columbia/boundary"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/netstack"
+	"github.com/evanphx/columbia/publish"
+	"github.com/evanphx/columbia/syscalls"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSpec(t *testing.T) {
+	tests := []struct {
+		in   string
+		spec publish.Spec
+	}{
+		{"8080:80", publish.Spec{HostPort: 8080, GuestPort: 80, Proto: "tcp"}},
+		{"53:53/udp", publish.Spec{HostPort: 53, GuestPort: 53, Proto: "udp"}},
+		{"127.0.0.1:8080:80/tcp", publish.Spec{HostIP: net.ParseIP("127.0.0.1"), HostPort: 8080, GuestPort: 80, Proto: "tcp"}},
+		{"[::1]:0:80", publish.Spec{HostIP: net.ParseIP("::1"), HostPort: 0, GuestPort: 80, Proto: "tcp"}},
+	}
+
+	for _, tt := range tests {
+		spec, err := publish.ParseSpec(tt.in)
+		require.NoError(t, err, tt.in)
+		require.Equal(t, tt.spec, spec, tt.in)
+	}
+
+	for _, bad := range []string{"80", "8080:80/sctp", "x:80", "8080:0", "8080:70000", "nohost:8080:80"} {
+		_, err := publish.ParseSpec(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+// echo stands in for a guest echo server: it accepts connections on port of
+// stack and sends back what each sends until it shuts down writing.
+func echo(t *testing.T, stack *netstack.Stack, port int) *netstack.TCPEndpoint {
+	ctx := context.Background()
+
+	l := stack.NewTCPEndpoint(false)
+	require.NoError(t, l.Bind(netstack.Address{IP: net.IPv4zero, Port: port}))
+	require.NoError(t, l.Listen(10))
+
+	go func() {
+		for {
+			conn, err := l.Accept(ctx, false)
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				buf := make([]byte, 1024)
+
+				for {
+					n, err := conn.Read(ctx, buf, false, false, false)
+					if err != nil || n == 0 {
+						return
+					}
+
+					if _, err := conn.Write(ctx, buf[:n], false); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+// runGuest starts testdata/echo.wasm in a kernel of its own, which echoes
+// the first connection to port 7, and returns the kernel's stack once the
+// guest is listening. The guest's exit is sent on the channel.
+func runGuest(t *testing.T) (*netstack.Stack, chan error) {
+	ctx := context.Background()
+
+	code, err := ioutil.ReadFile("testdata/echo.wasm")
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "publish")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "echo.wasm"), code, 0755))
+
+	var wi boundary.WasmInterface
+	wi.L = hclog.NewNullLogger()
+
+	k, err := kernel.NewKernel(wi.EnvModule())
+	require.NoError(t, err)
+
+	wi.Invoker = &syscalls.Invoker{Kernel: k}
+
+	proc, err := k.InitProcess(ctx, "/echo.wasm", []string{"echo"}, nil, dir)
+	require.NoError(t, err)
+
+	r, w := io.Pipe()
+	proc.HookupStdio(ioutil.NopCloser(strings.NewReader("")), w, w)
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- k.StartProcess(proc)
+		w.Close()
+	}()
+
+	line, err := bufio.NewReader(r).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "listening\n", line)
+
+	return k.Network(), done
+}
+
+func TestPublishTCP(t *testing.T) {
+	ctx := context.Background()
+	l := hclog.NewNullLogger()
+
+	spec := publish.Spec{HostIP: net.IPv4(127, 0, 0, 1), GuestPort: 7, Proto: "tcp"}
+
+	t.Run("proxies connections to the guest port", func(t *testing.T) {
+		stack := netstack.New()
+		echo(t, stack, 7)
+
+		p, err := publish.Publish(l, stack, spec)
+		require.NoError(t, err)
+		defer p.Close()
+
+		conn, err := net.Dial("tcp", p.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+
+		// Closing our writing reaches the guest, which closes in turn.
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+		rest, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		require.Empty(t, rest)
+	})
+
+	t.Run("proxies connections to a program listening in the guest", func(t *testing.T) {
+		stack, done := runGuest(t)
+
+		p, err := publish.Publish(l, stack, spec)
+		require.NoError(t, err)
+		defer p.Close()
+
+		conn, err := net.Dial("tcp", p.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+
+		// The guest closes the connection once it has echoed it.
+		rest, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		require.Empty(t, rest)
+
+		require.NoError(t, <-done)
+	})
+
+	t.Run("reaches the guest at the address of its NIC", func(t *testing.T) {
+		stack := netstack.New()
+		stack.AddNIC("eth0", nil, net.IPNet{IP: net.IPv4(10, 0, 0, 2).To4(), Mask: net.CIDRMask(24, 32)})
+
+		guest := stack.NewTCPEndpoint(false)
+		require.NoError(t, guest.Bind(netstack.Address{IP: net.IPv4(10, 0, 0, 2), Port: 7}))
+		require.NoError(t, guest.Listen(1))
+
+		p, err := publish.Publish(l, stack, spec)
+		require.NoError(t, err)
+		defer p.Close()
+
+		conn, err := net.Dial("tcp", p.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		accepted, err := guest.Accept(ctx, false)
+		require.NoError(t, err)
+
+		local := accepted.LocalAddress()
+		require.True(t, local.IP.Equal(net.IPv4(10, 0, 0, 2)))
+	})
+
+	t.Run("closes connections the guest refuses", func(t *testing.T) {
+		stack := netstack.New()
+
+		p, err := publish.Publish(l, stack, spec)
+		require.NoError(t, err)
+		defer p.Close()
+
+		conn, err := net.Dial("tcp", p.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		_, err = conn.Read(make([]byte, 1))
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("stops reading from the host while the guest doesn't read", func(t *testing.T) {
+		stack := netstack.New()
+
+		guest := stack.NewTCPEndpoint(false)
+		require.NoError(t, guest.Bind(netstack.Address{IP: net.IPv4zero, Port: 7}))
+		require.NoError(t, guest.Listen(1))
+
+		p, err := publish.Publish(l, stack, spec)
+		require.NoError(t, err)
+		defer p.Close()
+
+		conn, err := net.Dial("tcp", p.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		accepted, err := guest.Accept(ctx, false)
+		require.NoError(t, err)
+
+		data := bytes.Repeat([]byte("0123456789abcdef"), 4<<20)
+
+		written := make(chan error)
+
+		go func() {
+			_, err := conn.Write(data)
+			if err == nil {
+				err = conn.(*net.TCPConn).CloseWrite()
+			}
+
+			written <- err
+		}()
+
+		select {
+		case <-written:
+			t.Fatal("everything was taken while the guest wasn't reading")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		var got bytes.Buffer
+
+		buf := make([]byte, 64*1024)
+
+		for {
+			n, err := accepted.Read(ctx, buf, false, false, false)
+			require.NoError(t, err)
+
+			if n == 0 {
+				break
+			}
+
+			got.Write(buf[:n])
+		}
+
+		require.NoError(t, <-written)
+		require.True(t, bytes.Equal(data, got.Bytes()))
+	})
+
+	t.Run("tears down connections when closed", func(t *testing.T) {
+		stack := netstack.New()
+		echo(t, stack, 7)
+
+		p, err := publish.Publish(l, stack, spec)
+		require.NoError(t, err)
+
+		conn, err := net.Dial("tcp", p.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("x"))
+		require.NoError(t, err)
+
+		_, err = io.ReadFull(conn, make([]byte, 1))
+		require.NoError(t, err)
+
+		require.NoError(t, p.Close())
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		_, err = conn.Read(make([]byte, 1))
+		require.Error(t, err)
+
+		_, err = net.Dial("tcp", p.Addr().String())
+		require.Error(t, err)
+	})
+}
+
+func TestPublishUDP(t *testing.T) {
+	ctx := context.Background()
+
+	stack := netstack.New()
+
+	guest := stack.NewUDPEndpoint(false)
+	require.NoError(t, guest.Bind(netstack.Address{IP: net.IPv4zero, Port: 53}))
+
+	go func() {
+		for {
+			data, from, _, err := guest.RecvFrom(ctx, 1024, false, false)
+			if err != nil || from.IP == nil {
+				return
+			}
+
+			guest.SendTo(append([]byte("re: "), data...), &from)
+		}
+	}()
+
+	defer guest.Close()
+
+	p, err := publish.Publish(hclog.NewNullLogger(), stack, publish.Spec{
+		HostIP:    net.IPv4(127, 0, 0, 1),
+		GuestPort: 53,
+		Proto:     "udp",
+	})
+	require.NoError(t, err)
+	defer p.Close()
+
+	for _, msg := range []string{"one", "two"} {
+		conn, err := net.Dial("udp", p.Addr().String())
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte(msg))
+		require.NoError(t, err)
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		buf := make([]byte, 100)
+
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, "re: "+msg, string(buf[:n]))
+
+		conn.Close()
+	}
+}
+
+func TestPublishUDPFlowLimit(t *testing.T) {
+	ctx := context.Background()
+
+	stack := netstack.New()
+
+	// The guest answers with the port each datagram came from, which is
+	// the endpoint of its flow.
+	guest := stack.NewUDPEndpoint(false)
+	require.NoError(t, guest.Bind(netstack.Address{IP: net.IPv4zero, Port: 53}))
+
+	go func() {
+		for {
+			_, from, _, err := guest.RecvFrom(ctx, 1024, false, false)
+			if err != nil || from.IP == nil {
+				return
+			}
+
+			guest.SendTo([]byte(strconv.Itoa(from.Port)), &from)
+		}
+	}()
+
+	defer guest.Close()
+
+	p, err := publish.Publish(hclog.NewNullLogger(), stack, publish.Spec{
+		HostIP:    net.IPv4(127, 0, 0, 1),
+		GuestPort: 53,
+		Proto:     "udp",
+	})
+	require.NoError(t, err)
+	defer p.Close()
+
+	send := func(conn net.Conn) string {
+		_, err := conn.Write([]byte("x"))
+		require.NoError(t, err)
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		buf := make([]byte, 100)
+
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+
+		return string(buf[:n])
+	}
+
+	first, err := net.Dial("udp", p.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+
+	port := send(first)
+	require.Equal(t, port, send(first))
+
+	// Enough other ports of the same address to reach the limit push out
+	// the flow idle longest, so the first gets a new one.
+	for i := 0; i < 64; i++ {
+		conn, err := net.Dial("udp", p.Addr().String())
+		require.NoError(t, err)
+
+		send(conn)
+
+		conn.Close()
+	}
+
+	require.NotEqual(t, port, send(first))
+}
@@ -0,0 +1,151 @@
+package publish
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/evanphx/columbia/netstack"
+)
+
+func (p *Publisher) acceptLoop() {
+	defer p.wg.Done()
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if p.ctx.Err() == nil {
+				p.l.Error("error accepting published connection", "addr", p.listener.Addr(), "error", err)
+			}
+
+			return
+		}
+
+		if !p.track(conn) {
+			conn.Close()
+			return
+		}
+
+		p.wg.Add(1)
+		go p.proxy(conn)
+	}
+}
+
+// endpointCloser closes an endpoint with the connection it's proxied for.
+type endpointCloser struct {
+	ep *netstack.TCPEndpoint
+}
+
+func (c endpointCloser) Close() error {
+	c.ep.Close()
+	return nil
+}
+
+// proxy connects to the guest port and copies between it and conn until
+// both directions are done. The end of either side's stream is passed on
+// as a shutdown of writing, so a half-closed connection keeps working.
+func (p *Publisher) proxy(conn net.Conn) {
+	defer p.wg.Done()
+	defer p.untrack(conn)
+	defer conn.Close()
+
+	ep := p.stack.NewTCPEndpoint(false)
+
+	if !p.track(endpointCloser{ep}) {
+		ep.Close()
+		return
+	}
+
+	defer p.untrack(endpointCloser{ep})
+	defer ep.Close()
+
+	if err := ep.Connect(p.ctx, p.guest, false); err != nil {
+		p.l.Debug("published connection refused by guest", "guest", p.guest, "error", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		err := p.toGuest(conn, ep)
+		if err != nil {
+			// Whatever went wrong with the host side resets the guest's
+			// connection, so it isn't left waiting.
+			ep.Abort()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		err := p.toHost(ep, conn)
+		if err == nil {
+			return
+		}
+
+		if err == netstack.ErrConnectionReset {
+			if tc, ok := conn.(*net.TCPConn); ok {
+				tc.SetLinger(0)
+			}
+		}
+
+		conn.Close()
+	}()
+
+	wg.Wait()
+}
+
+// toGuest copies from conn to ep, shutting down ep's writing at the end of
+// conn's stream. ep.Write blocks while the guest isn't reading, and with it
+// the reading of conn.
+func (p *Publisher) toGuest(conn net.Conn, ep *netstack.TCPEndpoint) error {
+	buf := make([]byte, bufferSize)
+
+	for {
+		n, err := conn.Read(buf)
+
+		if n > 0 {
+			if _, werr := ep.Write(p.ctx, buf[:n], false); werr != nil {
+				return werr
+			}
+		}
+
+		if err == io.EOF {
+			ep.Shutdown(false, true)
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// toHost copies from ep to conn, closing conn's writing at the end of ep's
+// stream.
+func (p *Publisher) toHost(ep *netstack.TCPEndpoint, conn net.Conn) error {
+	buf := make([]byte, bufferSize)
+
+	for {
+		n, err := ep.Read(p.ctx, buf, false, false, false)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			if tc, ok := conn.(*net.TCPConn); ok {
+				return tc.CloseWrite()
+			}
+
+			return conn.Close()
+		}
+
+		if _, err := conn.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,38 @@
+;; a guest that listens on port 7, says so on stdout, and echoes what the
+;; first connection sends before closing it.
+;;
+;; see https://github.com/WebAssembly/spec/tree/master/interpreter/#s-expression-syntax
+;; for a reference about the syntax.
+(module
+  (import "env" "__syscall1" (func $syscall1 (param i32 i32) (result i32)))
+  (import "env" "__syscall2" (func $syscall2 (param i32 i32 i32) (result i32)))
+  (import "env" "__syscall3" (func $syscall3 (param i32 i32 i32 i32) (result i32)))
+  (import "env" "__syscall4" (func $syscall4 (param i32 i32 i32 i32 i32) (result i32)))
+
+  (memory 1)
+
+  (global (export "__heap_base") i32 (i32.const 4096))
+
+  ;; struct sockaddr_in for 0.0.0.0:7
+  (data (i32.const 16) "\02\00\00\07\00\00\00\00\00\00\00\00\00\00\00\00")
+  (data (i32.const 32) "listening\n")
+
+  (func (export "_start") (local $l i32) (local $c i32) (local $n i32)
+    ;; socket(AF_INET, SOCK_STREAM, 0)
+    (set_local $l (call $syscall3 (i32.const 359) (i32.const 2) (i32.const 1) (i32.const 0)))
+    ;; bind
+    (drop (call $syscall3 (i32.const 361) (get_local $l) (i32.const 16) (i32.const 16)))
+    ;; listen
+    (drop (call $syscall2 (i32.const 363) (get_local $l) (i32.const 1)))
+    ;; write(1, "listening\n")
+    (drop (call $syscall3 (i32.const 4) (i32.const 1) (i32.const 32) (i32.const 10)))
+    ;; accept4
+    (set_local $c (call $syscall4 (i32.const 364) (get_local $l) (i32.const 0) (i32.const 0) (i32.const 0)))
+    ;; read and write back
+    (set_local $n (call $syscall3 (i32.const 3) (get_local $c) (i32.const 64) (i32.const 64)))
+    (drop (call $syscall3 (i32.const 4) (get_local $c) (i32.const 64) (get_local $n)))
+    ;; close
+    (drop (call $syscall1 (i32.const 6) (get_local $c)))
+    (drop (call $syscall1 (i32.const 6) (get_local $l)))
+  )
+)
@@ -0,0 +1,186 @@
+package publish
+
+import (
+	"net"
+	"time"
+
+	"github.com/evanphx/columbia/netstack"
+)
+
+// udpTimeout is how long a flow lasts without datagrams in either
+// direction.
+const udpTimeout = 90 * time.Second
+
+// maxClientFlows is how many flows the ports of one client address can
+// have at once. Another closes the one idle longest, so a client sending
+// from ever more ports can't use up the endpoints of the stack.
+const maxClientFlows = 64
+
+// flow is the datagrams between one host client and the guest port, which
+// go through an endpoint of their own so the guest's replies find their
+// way back.
+type flow struct {
+	ep     *netstack.UDPEndpoint
+	client *net.UDPAddr
+
+	// host is the client's address without its port, which the flows
+	// are capped by.
+	host string
+
+	// last is when a datagram last went through, as UnixNano. It's only
+	// accessed with the Publisher's mu held.
+	last int64
+}
+
+func (p *Publisher) packetLoop() {
+	defer p.wg.Done()
+
+	buf := make([]byte, 65535)
+
+	for {
+		n, client, err := p.packets.ReadFromUDP(buf)
+		if err != nil {
+			if p.ctx.Err() == nil {
+				p.l.Error("error reading published datagram", "addr", p.packets.LocalAddr(), "error", err)
+			}
+
+			return
+		}
+
+		f := p.flow(client)
+		if f == nil {
+			return
+		}
+
+		if _, err := f.ep.SendTo(buf[:n], nil); err != nil {
+			p.l.Debug("published datagram not delivered", "guest", p.guest, "error", err)
+		}
+	}
+}
+
+// flow returns the flow for client, starting one if there isn't one. It
+// returns nil once the Publisher is closed.
+func (p *Publisher) flow(client *net.UDPAddr) *flow {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ctx.Err() != nil {
+		return nil
+	}
+
+	key := client.String()
+
+	if f, ok := p.flows[key]; ok {
+		f.last = time.Now().UnixNano()
+		return f
+	}
+
+	host := client.IP.String()
+
+	if p.clientFlows[host] >= maxClientFlows {
+		p.dropIdlest(host)
+	}
+
+	f := &flow{
+		ep:     p.stack.NewUDPEndpoint(false),
+		client: client,
+		host:   host,
+		last:   time.Now().UnixNano(),
+	}
+
+	if err := f.ep.Connect(&p.guest); err != nil {
+		p.l.Debug("published datagram not delivered", "guest", p.guest, "error", err)
+	}
+
+	p.flows[key] = f
+	p.clientFlows[host]++
+
+	p.wg.Add(1)
+	go p.replies(f)
+
+	return f
+}
+
+// replies sends what the guest sends to f's endpoint back to the client,
+// until the endpoint is closed.
+func (p *Publisher) replies(f *flow) {
+	defer p.wg.Done()
+
+	for {
+		data, from, _, err := f.ep.RecvFrom(p.ctx, 65535, false, false)
+		if err == netstack.ErrConnectionRefused {
+			// Nothing is listening on the guest port, yet.
+			continue
+		}
+
+		if err != nil || from.IP == nil {
+			return
+		}
+
+		p.mu.Lock()
+		f.last = time.Now().UnixNano()
+		p.mu.Unlock()
+
+		if _, err := p.packets.WriteToUDP(data, f.client); err != nil {
+			p.l.Debug("published reply not delivered", "client", f.client, "error", err)
+		}
+	}
+}
+
+// expireLoop closes the flows that have been idle for udpTimeout.
+func (p *Publisher) expireLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(udpTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.expire(now)
+		}
+	}
+}
+
+func (p *Publisher) expire(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, f := range p.flows {
+		if now.UnixNano()-f.last >= int64(udpTimeout) {
+			p.drop(key, f)
+		}
+	}
+}
+
+// dropIdlest closes the flow of host that has been idle longest. It's
+// called with mu held.
+func (p *Publisher) dropIdlest(host string) {
+	var (
+		idlest    *flow
+		idlestKey string
+	)
+
+	for key, f := range p.flows {
+		if f.host == host && (idlest == nil || f.last < idlest.last) {
+			idlest, idlestKey = f, key
+		}
+	}
+
+	if idlest != nil {
+		p.drop(idlestKey, idlest)
+	}
+}
+
+// drop closes f, the flow under key. It's called with mu held.
+func (p *Publisher) drop(key string, f *flow) {
+	f.ep.Close()
+	delete(p.flows, key)
+
+	p.clientFlows[f.host]--
+	if p.clientFlows[f.host] == 0 {
+		delete(p.clientFlows, f.host)
+	}
+}
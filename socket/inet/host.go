@@ -0,0 +1,172 @@
+package inet
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/log"
+	"github.com/evanphx/columbia/netpolicy"
+	"github.com/evanphx/columbia/netstack"
+	"github.com/evanphx/columbia/socket"
+	"github.com/pkg/errors"
+)
+
+// guard holds the policy a passed-through socket is checked against, and
+// who to blame for it in the log.
+type guard struct {
+	policy *netpolicy.Policy
+	pid    int
+}
+
+func newGuard(ctx context.Context, policy *netpolicy.Policy) guard {
+	g := guard{policy: policy}
+
+	if task, ok := kernel.GetTask(ctx); ok {
+		g.pid = task.Pid
+	}
+
+	return g
+}
+
+// decided logs what the policy decided about op, which is in dir with the
+// peer a, and returns it.
+func (g guard) decided(op string, dir netpolicy.Direction, a netstack.Address, allowed bool) bool {
+	if allowed {
+		log.L.Info("network policy allowed", "op", op, "direction", dir, "addr", a, "pid", g.pid)
+	} else {
+		log.L.Warn("network policy denied", "op", op, "direction", dir, "addr", a, "pid", g.pid)
+	}
+
+	return allowed
+}
+
+// allowsOut reports whether the guest may connect or send to a.
+func (g guard) allowsOut(op string, a netstack.Address) bool {
+	return g.decided(op, netpolicy.Outbound, a, g.policy.Allows(netpolicy.Outbound, a.IP, a.Port))
+}
+
+// allowsIn reports whether peer may connect to the guest's port.
+func (g guard) allowsIn(op string, peer netstack.Address, port int) bool {
+	return g.decided(op, netpolicy.Inbound, peer, g.policy.Allows(netpolicy.Inbound, peer.IP, port))
+}
+
+// allowsReply reports whether a datagram from peer may be received on
+// port: either the guest may send to peer, so it's a reply, or peer may
+// send to the guest.
+func (g guard) allowsReply(op string, peer netstack.Address, port int) bool {
+	allowed := g.policy.Allows(netpolicy.Outbound, peer.IP, peer.Port) ||
+		g.policy.Allows(netpolicy.Inbound, peer.IP, port)
+
+	return g.decided(op, netpolicy.Inbound, peer, allowed)
+}
+
+// allowsPort reports whether the guest may bind or listen on port, which
+// it may if some peer is allowed in to it. Port 0 is always allowed.
+func (g guard) allowsPort(op string, port int) bool {
+	if port == 0 {
+		return true
+	}
+
+	allowed := g.policy.AllowsPort(port)
+
+	if allowed {
+		log.L.Info("network policy allowed", "op", op, "port", port, "pid", g.pid)
+	} else {
+		log.L.Warn("network policy denied", "op", op, "port", port, "pid", g.pid)
+	}
+
+	return allowed
+}
+
+// destination is where connecting or sending to a goes: the wildcard
+// address means the host itself, as on Linux, which the policy has to see
+// as such.
+func destination(v6 bool, a netstack.Address) netstack.Address {
+	if !a.IP.IsUnspecified() {
+		return a
+	}
+
+	if a.IP.To4() != nil {
+		return netstack.Address{IP: net.IPv4(127, 0, 0, 1), Port: a.Port}
+	}
+
+	return netstack.Address{IP: net.IPv6loopback, Port: a.Port}
+}
+
+// hostError converts an error from a host socket into the socket error the
+// syscalls know.
+func hostError(err error) error {
+	var errno syscall.Errno
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.Canceled):
+		return fs.ErrInterrupted
+	case !errors.As(err, &errno):
+		return err
+	}
+
+	switch errno {
+	case syscall.ECONNREFUSED:
+		return socket.ErrConnectionRefused
+	case syscall.ECONNRESET:
+		return socket.ErrConnectionReset
+	case syscall.ENETUNREACH:
+		return socket.ErrNetworkUnreachable
+	case syscall.EHOSTUNREACH:
+		return socket.ErrHostUnreachable
+	case syscall.ETIMEDOUT:
+		return socket.ErrTimedOut
+	case syscall.EADDRINUSE:
+		return socket.ErrAddressInUse
+	case syscall.EADDRNOTAVAIL:
+		return socket.ErrAddressNotAvailable
+	case syscall.EPIPE:
+		return socket.ErrBrokenPipe
+	case syscall.EMSGSIZE:
+		return socket.ErrMessageSize
+	case syscall.EACCES, syscall.EPERM:
+		return socket.ErrAccessDenied
+	}
+
+	return err
+}
+
+// hostNetwork is the Go network a socket of the IPv6 family if v6 is set,
+// or else of IPv4, uses on the host for a. An IPv6 socket uses IPv4 for a
+// v4-mapped address.
+func hostNetwork(proto string, v6 bool, a netstack.Address) string {
+	if !v6 || a.IP.To4() != nil {
+		return proto + "4"
+	}
+
+	return proto + "6"
+}
+
+// fromHost converts an address of the host into one of the stack's.
+func fromHost(addr net.Addr) netstack.Address {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return netstack.Address{IP: a.IP, Port: a.Port}
+	case *net.UDPAddr:
+		return netstack.Address{IP: a.IP, Port: a.Port}
+	}
+
+	return netstack.Address{}
+}
+
+// hostAddr is the address for Go's net of a, which is left out if it's the
+// wildcard.
+func hostAddr(a netstack.Address) string {
+	ip := ""
+	if a.IP != nil && !a.IP.IsUnspecified() {
+		ip = a.IP.String()
+	}
+
+	return net.JoinHostPort(ip, strconv.Itoa(a.Port))
+}
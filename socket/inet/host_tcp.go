@@ -0,0 +1,978 @@
+package inet
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/netstack"
+	"github.com/evanphx/columbia/pkg/waiter"
+	"github.com/evanphx/columbia/socket"
+)
+
+// drainTimeout is how long a closed connection has to send what's left to
+// the host before it's reset.
+const drainTimeout = time.Minute
+
+type hostTCPState int
+
+const (
+	hostInitial hostTCPState = iota
+	hostConnecting
+	hostConnected
+	hostListening
+	hostClosed
+)
+
+// hostTCPSocket is a TCP socket passed through to one of the host. A
+// connection is read ahead into rcv and written behind from snd, each by a
+// goroutine of its own, so the guest can poll it and use it without
+// blocking as it does a socket of the stack.
+type hostTCPSocket struct {
+	v6    bool
+	guard guard
+
+	opts *options
+	tcp  *tcpOptions
+
+	q waiter.Queue
+
+	mu sync.Mutex
+
+	// cond is broadcast when rcv has room, snd has something to send or
+	// the state changes, which the goroutines wait for.
+	cond *sync.Cond
+
+	state  hostTCPState
+	reuse  bool
+	v6only bool
+
+	// local is the address the socket was bound to, if it was.
+	local *netstack.Address
+
+	// cancel stops a connect in progress.
+	cancel func()
+
+	conn     *net.TCPConn
+	listener *net.TCPListener
+	backlog  int
+	pending  []*hostTCPSocket
+
+	rcv []byte
+	eof bool
+	err error
+
+	snd     []byte
+	sending int
+	sndShut bool
+
+	// flushed is set once nothing more will be written to conn.
+	flushed bool
+
+	sent, received uint64
+}
+
+func newHostTCPSocket(v6 bool, g guard) *hostTCPSocket {
+	s := &hostTCPSocket{
+		v6:    v6,
+		guard: g,
+		opts:  newOptions(v6, linux.SOCK_STREAM, linux.IPPROTO_TCP),
+		tcp:   newTCPOptions(),
+	}
+
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+func (s *hostTCPSocket) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	s.q.EventRegister(ch, mask)
+}
+
+func (s *hostTCPSocket) EventUnregister(ch chan struct{}) {
+	s.q.EventUnregister(ch)
+}
+
+func (s *hostTCPSocket) Readiness(mask waiter.EventMask) waiter.EventMask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ready waiter.EventMask
+
+	switch s.state {
+	case hostListening:
+		if len(s.pending) > 0 {
+			ready |= waiter.EventIn
+		}
+
+		return ready & mask
+	case hostConnecting:
+		return 0
+	case hostConnected:
+	default:
+		// A connect that failed leaves its error to be taken.
+		if s.err != nil {
+			ready |= waiter.EventErr | waiter.EventOut
+		}
+
+		return (ready | waiter.EventHUp) & mask
+	}
+
+	if len(s.rcv) > 0 || s.eof || s.err != nil {
+		ready |= waiter.EventIn
+	}
+
+	if s.eof {
+		ready |= waiter.EventRdHUp
+	}
+
+	if s.eof && s.sndShut {
+		ready |= waiter.EventHUp
+	}
+
+	if s.err != nil {
+		ready |= waiter.EventErr | waiter.EventOut
+	}
+
+	if !s.sndShut && len(s.snd)+s.sending < bufferSize {
+		ready |= waiter.EventOut
+	}
+
+	return ready & mask
+}
+
+func (s *hostTCPSocket) Close() error {
+	s.close(s.opts.abortive())
+	return nil
+}
+
+// close closes the socket. With reset, or with what was received left
+// unread, the connection is reset as Linux does; otherwise what's left to
+// send still goes, for up to drainTimeout.
+func (s *hostTCPSocket) close(reset bool) {
+	s.mu.Lock()
+
+	if s.state == hostClosed {
+		s.mu.Unlock()
+		return
+	}
+
+	s.state = hostClosed
+
+	cancel, listener, pending, conn := s.cancel, s.listener, s.pending, s.conn
+
+	reset = reset || len(s.rcv) > 0
+	flushed := s.flushed
+
+	s.cancel = nil
+	s.pending = nil
+	s.rcv = nil
+	s.sndShut = true
+
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+
+	if listener != nil {
+		listener.Close()
+	}
+
+	for _, p := range pending {
+		p.close(true)
+	}
+
+	if conn != nil {
+		switch {
+		case reset:
+			conn.SetLinger(0)
+			conn.Close()
+		case flushed:
+			conn.Close()
+		default:
+			// The writer closes conn once it's sent the rest.
+			conn.SetWriteDeadline(time.Now().Add(drainTimeout))
+		}
+	}
+
+	s.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp)
+}
+
+func (s *hostTCPSocket) Bind(ctx context.Context, addr []byte) error {
+	a, err := parseAddress(s.v6, addr)
+	if err != nil {
+		return err
+	}
+
+	if err := checkBindPort(ctx, a.Port); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != hostInitial || s.local != nil || v6OnlyConflict(s.v6only, a) {
+		return fs.ErrInvalid
+	}
+
+	if !s.guard.allowsPort("bind", a.Port) {
+		return socket.ErrAccessDenied
+	}
+
+	s.local = &a
+
+	return nil
+}
+
+// listenNetwork is the Go network to listen on local with: an IPv6 socket
+// on the wildcard address takes IPv4 connections too, unless it's
+// IPV6_V6ONLY.
+func (s *hostTCPSocket) listenNetwork(local netstack.Address) string {
+	if s.v6 && !s.v6only && local.IP.IsUnspecified() {
+		return "tcp"
+	}
+
+	return hostNetwork("tcp", s.v6, local)
+}
+
+func (s *hostTCPSocket) Listen(backlog int) error {
+	if backlog < 1 {
+		backlog = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.state {
+	case hostListening:
+		s.backlog = backlog
+		s.cond.Broadcast()
+
+		return nil
+	case hostInitial:
+	default:
+		return fs.ErrInvalid
+	}
+
+	local := s.wildcard()
+	if s.local != nil {
+		local = *s.local
+	}
+
+	if !s.guard.allowsPort("listen", local.Port) {
+		return socket.ErrAccessDenied
+	}
+
+	l, err := net.Listen(s.listenNetwork(local), hostAddr(local))
+	if err != nil {
+		return hostError(err)
+	}
+
+	listener := l.(*net.TCPListener)
+
+	// The host picked the port, which the guest has to be allowed to
+	// listen on too.
+	if local.Port == 0 {
+		port := fromHost(listener.Addr()).Port
+
+		if !s.guard.allowsPort("listen", port) {
+			listener.Close()
+			return socket.ErrAccessDenied
+		}
+	}
+
+	s.state = hostListening
+	s.listener = listener
+	s.backlog = backlog
+
+	go s.acceptLoop(listener)
+
+	return nil
+}
+
+// wildcard is the address of a socket that isn't bound.
+func (s *hostTCPSocket) wildcard() netstack.Address {
+	if s.v6 {
+		return netstack.Address{IP: net.IPv6unspecified}
+	}
+
+	return netstack.Address{IP: net.IPv4zero}
+}
+
+// acceptLoop accepts connections from the host while the backlog has room
+// for them, resetting those from peers the policy doesn't allow in.
+func (s *hostTCPSocket) acceptLoop(listener *net.TCPListener) {
+	port := fromHost(listener.Addr()).Port
+
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+
+		if !s.guard.allowsIn("accept", fromHost(conn.RemoteAddr()), port) {
+			conn.SetLinger(0)
+			conn.Close()
+
+			continue
+		}
+
+		// The options are locked before mu, so they're copied first.
+		child := newHostTCPSocket(s.v6, s.guard)
+		child.opts = s.opts.clone()
+		child.tcp = s.tcp.clone()
+		child.applyOptions(conn)
+
+		s.mu.Lock()
+
+		for s.state == hostListening && len(s.pending) >= s.backlog {
+			s.cond.Wait()
+		}
+
+		if s.state != hostListening {
+			s.mu.Unlock()
+
+			conn.SetLinger(0)
+			conn.Close()
+
+			return
+		}
+
+		child.v6only = s.v6only
+
+		child.mu.Lock()
+		child.start(conn)
+		child.mu.Unlock()
+
+		s.pending = append(s.pending, child)
+
+		s.mu.Unlock()
+
+		s.q.Notify(waiter.EventIn)
+	}
+}
+
+func (s *hostTCPSocket) Accept(ctx context.Context, nonblock bool) (socket.Socket, error) {
+	for {
+		s.mu.Lock()
+
+		if s.state != hostListening {
+			s.mu.Unlock()
+			return nil, fs.ErrInvalid
+		}
+
+		if len(s.pending) > 0 {
+			child := s.pending[0]
+			s.pending = s.pending[1:]
+
+			// There's room in the backlog again.
+			s.cond.Broadcast()
+			s.mu.Unlock()
+
+			return child, nil
+		}
+
+		s.mu.Unlock()
+
+		if nonblock {
+			return nil, socket.ErrWouldBlock
+		}
+
+		if err := waiter.Wait(ctx, s, waiter.EventIn|waiter.EventHUp); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Connect connects to addr on the host if the policy allows it. The
+// connection is made in the background: a nonblocking connect returns
+// ErrInProgress, and a connect that's interrupted carries on, as on Linux.
+func (s *hostTCPSocket) Connect(ctx context.Context, addr []byte, nonblock bool) error {
+	a, err := parseAddress(s.v6, addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+
+	switch s.state {
+	case hostConnecting:
+		s.mu.Unlock()
+		return socket.ErrAlreadyInProgress
+	case hostConnected:
+		s.mu.Unlock()
+		return socket.ErrIsConnected
+	case hostInitial:
+	default:
+		s.mu.Unlock()
+		return fs.ErrInvalid
+	}
+
+	if v6OnlyConflict(s.v6only, a) {
+		s.mu.Unlock()
+		return socket.ErrNetworkUnreachable
+	}
+
+	a = destination(s.v6, a)
+
+	if !s.guard.allowsOut("connect", a) {
+		s.mu.Unlock()
+		return socket.ErrConnectionRefused
+	}
+
+	dctx, cancel := context.WithCancel(context.Background())
+
+	s.state = hostConnecting
+	s.cancel = cancel
+	s.err = nil
+
+	go s.dial(dctx, a, s.local)
+
+	s.mu.Unlock()
+
+	if nonblock {
+		return socket.ErrInProgress
+	}
+
+	if err := waiter.Wait(ctx, s, waiter.EventOut|waiter.EventHUp); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == hostConnected {
+		return nil
+	}
+
+	if err := s.err; err != nil {
+		s.err = nil
+		return err
+	}
+
+	return socket.ErrConnectionRefused
+}
+
+// dial connects to a from local, if the socket was bound.
+func (s *hostTCPSocket) dial(ctx context.Context, a netstack.Address, local *netstack.Address) {
+	var d net.Dialer
+
+	if local != nil {
+		la := &net.TCPAddr{Port: local.Port}
+
+		if !local.IP.IsUnspecified() {
+			la.IP = local.IP
+		}
+
+		d.LocalAddr = la
+	}
+
+	c, err := d.DialContext(ctx, hostNetwork("tcp", s.v6, a), hostAddr(a))
+
+	s.mu.Lock()
+
+	if s.state != hostConnecting {
+		// Closed while connecting.
+		s.mu.Unlock()
+
+		if c != nil {
+			c.Close()
+		}
+
+		return
+	}
+
+	s.cancel = nil
+
+	if err != nil {
+		s.state = hostInitial
+		s.err = hostError(err)
+	} else {
+		s.start(c.(*net.TCPConn))
+	}
+
+	s.mu.Unlock()
+
+	if err == nil {
+		s.applyOptions(c.(*net.TCPConn))
+	}
+
+	s.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventErr | waiter.EventHUp)
+}
+
+// start has the socket use conn, which it's connected with. It's called
+// with mu held.
+func (s *hostTCPSocket) start(conn *net.TCPConn) {
+	s.state = hostConnected
+	s.conn = conn
+
+	go s.readLoop(conn)
+	go s.writeLoop(conn)
+}
+
+// applyOptions sets the options the host's stack acts on for conn. It's
+// called without mu held, as the options are locked before mu.
+func (s *hostTCPSocket) applyOptions(conn *net.TCPConn) {
+	conn.SetNoDelay(s.tcp.noDelay())
+	conn.SetKeepAlive(s.opts.keepAlive())
+
+	s.tcp.mu.Lock()
+	idle := s.tcp.keepIdle
+	s.tcp.mu.Unlock()
+
+	conn.SetKeepAlivePeriod(time.Duration(idle) * time.Second)
+}
+
+// readLoop reads from conn into rcv while there's room there, until the
+// stream ends.
+func (s *hostTCPSocket) readLoop(conn *net.TCPConn) {
+	buf := make([]byte, 64*1024)
+
+	for {
+		s.mu.Lock()
+
+		for s.state == hostConnected && !s.eof && len(s.rcv) >= bufferSize {
+			s.cond.Wait()
+		}
+
+		done := s.state != hostConnected || s.eof
+		s.mu.Unlock()
+
+		if done {
+			return
+		}
+
+		n, err := conn.Read(buf)
+
+		s.mu.Lock()
+
+		if n > 0 && !s.eof {
+			s.rcv = append(s.rcv, buf[:n]...)
+			s.received += uint64(n)
+		}
+
+		if err != nil {
+			s.eof = true
+
+			if err != io.EOF && s.state == hostConnected {
+				s.err = hostError(err)
+
+				if s.err == socket.ErrConnectionReset {
+					s.rcv = nil
+					s.sndShut = true
+					s.cond.Broadcast()
+				}
+			}
+		}
+
+		s.mu.Unlock()
+
+		s.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventErr | waiter.EventHUp | waiter.EventRdHUp)
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeLoop writes what's in snd to conn. Once writing is shut down and
+// snd is empty, it closes conn's writing, or conn itself if the socket is
+// closed.
+func (s *hostTCPSocket) writeLoop(conn *net.TCPConn) {
+	for {
+		s.mu.Lock()
+
+		for s.state == hostConnected && !s.sndShut && len(s.snd) == 0 {
+			s.cond.Wait()
+		}
+
+		if len(s.snd) == 0 {
+			s.flushed = true
+			closed := s.state == hostClosed
+			s.mu.Unlock()
+
+			if closed {
+				conn.Close()
+			} else {
+				conn.CloseWrite()
+			}
+
+			return
+		}
+
+		chunk := s.snd
+		s.snd = nil
+		s.sending = len(chunk)
+
+		s.mu.Unlock()
+
+		_, err := conn.Write(chunk)
+
+		s.mu.Lock()
+
+		s.sending = 0
+
+		if err != nil {
+			if s.state == hostConnected && s.err == nil {
+				s.err = hostError(err)
+			}
+
+			s.flushed = true
+			s.sndShut = true
+			s.snd = nil
+
+			closed := s.state == hostClosed
+			s.mu.Unlock()
+
+			if closed {
+				conn.SetLinger(0)
+				conn.Close()
+			}
+
+			s.q.Notify(waiter.EventOut | waiter.EventErr)
+
+			return
+		}
+
+		s.sent += uint64(len(chunk))
+
+		s.mu.Unlock()
+
+		s.q.Notify(waiter.EventOut)
+	}
+}
+
+func (s *hostTCPSocket) Shutdown(how int) error {
+	read := how == linux.SHUT_RD || how == linux.SHUT_RDWR
+	write := how == linux.SHUT_WR || how == linux.SHUT_RDWR
+
+	s.mu.Lock()
+
+	if s.state != hostConnected {
+		s.mu.Unlock()
+		return socket.ErrNotConnected
+	}
+
+	conn := s.conn
+
+	if read {
+		s.eof = true
+		s.rcv = nil
+	}
+
+	if write {
+		s.sndShut = true
+	}
+
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if read {
+		conn.CloseRead()
+	}
+
+	s.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp | waiter.EventRdHUp)
+
+	return nil
+}
+
+// SendMsg queues data to be written to the connection, waiting for room
+// unless MSG_DONTWAIT is given. An address is ignored, as Linux does for a
+// connected TCP socket.
+func (s *hostTCPSocket) SendMsg(ctx context.Context, data, addr []byte, cm socket.ControlMessages, flags int) (int, error) {
+	if len(cm.Rights) > 0 {
+		cm.Release()
+		return 0, fs.ErrInvalid
+	}
+
+	nonblock := flags&linux.MSG_DONTWAIT != 0
+
+	sent := 0
+
+	partial := func(err error) (int, error) {
+		if sent > 0 {
+			return sent, nil
+		}
+
+		return 0, err
+	}
+
+	for {
+		s.mu.Lock()
+
+		switch {
+		case s.err != nil:
+			err := s.err
+			s.err = nil
+			s.mu.Unlock()
+
+			return partial(err)
+		case s.state != hostConnected:
+			s.mu.Unlock()
+			return partial(socket.ErrNotConnected)
+		case s.sndShut:
+			s.mu.Unlock()
+			return partial(socket.ErrBrokenPipe)
+		}
+
+		if room := bufferSize - len(s.snd) - s.sending; room > 0 {
+			chunk := data[sent:]
+			if len(chunk) > room {
+				chunk = chunk[:room]
+			}
+
+			s.snd = append(s.snd, chunk...)
+			sent += len(chunk)
+
+			s.cond.Broadcast()
+		}
+
+		s.mu.Unlock()
+
+		if sent == len(data) {
+			return sent, nil
+		}
+
+		if nonblock {
+			return partial(socket.ErrWouldBlock)
+		}
+
+		if err := waiter.Wait(ctx, s, waiter.EventOut|waiter.EventErr|waiter.EventHUp); err != nil {
+			return partial(err)
+		}
+	}
+}
+
+func (s *hostTCPSocket) RecvMsg(ctx context.Context, size int, flags int) ([]byte, []byte, socket.ControlMessages, int, error) {
+	buf := make([]byte, size)
+
+	n, err := s.read(ctx, buf,
+		flags&linux.MSG_PEEK != 0,
+		flags&linux.MSG_WAITALL != 0,
+		flags&linux.MSG_DONTWAIT != 0)
+	if err != nil {
+		return nil, nil, socket.ControlMessages{}, 0, err
+	}
+
+	return buf[:n], nil, socket.ControlMessages{}, 0, nil
+}
+
+// read receives into b as TCPEndpoint.Read does.
+func (s *hostTCPSocket) read(ctx context.Context, b []byte, peek, waitAll, nonblock bool) (int, error) {
+	total := 0
+
+	for {
+		s.mu.Lock()
+
+		if s.err != nil && total == 0 {
+			err := s.err
+			s.err = nil
+			s.mu.Unlock()
+
+			return 0, err
+		}
+
+		if state := s.state; state != hostConnected && total == 0 {
+			s.mu.Unlock()
+
+			if state == hostClosed {
+				return 0, nil
+			}
+
+			return 0, socket.ErrNotConnected
+		}
+
+		if len(s.rcv) > 0 {
+			n := copy(b[total:], s.rcv)
+
+			if !peek {
+				s.rcv = s.rcv[n:]
+				if len(s.rcv) == 0 {
+					s.rcv = nil
+				}
+
+				// There's room now for the reader.
+				s.cond.Broadcast()
+			}
+
+			total += n
+
+			s.mu.Unlock()
+
+			if total == len(b) || !waitAll || peek {
+				return total, nil
+			}
+
+			continue
+		}
+
+		eof := s.eof || s.state != hostConnected
+		s.mu.Unlock()
+
+		if eof || total > 0 && !waitAll {
+			return total, nil
+		}
+
+		if nonblock {
+			if total > 0 {
+				return total, nil
+			}
+
+			return 0, socket.ErrWouldBlock
+		}
+
+		if err := waiter.Wait(ctx, s, waiter.EventIn); err != nil {
+			if total > 0 {
+				return total, nil
+			}
+
+			return 0, err
+		}
+	}
+}
+
+func (s *hostTCPSocket) SockName() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.conn != nil:
+		return formatAddress(s.v6, fromHost(s.conn.LocalAddr())), nil
+	case s.listener != nil:
+		return formatAddress(s.v6, fromHost(s.listener.Addr())), nil
+	case s.local != nil:
+		return formatAddress(s.v6, *s.local), nil
+	}
+
+	return formatAddress(s.v6, s.wildcard()), nil
+}
+
+func (s *hostTCPSocket) PeerName() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != hostConnected {
+		return nil, socket.ErrNotConnected
+	}
+
+	return formatAddress(s.v6, fromHost(s.conn.RemoteAddr())), nil
+}
+
+func (s *hostTCPSocket) GetSockOpt(level, name int) (interface{}, error) {
+	switch level {
+	case linux.SOL_SOCKET:
+		if name == linux.SO_ACCEPTCONN {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			return boolOpt(s.state == hostListening), nil
+		}
+	case linux.SOL_TCP:
+		if name == linux.TCP_INFO {
+			return s.info(), nil
+		}
+
+		return s.tcp.get(name)
+	}
+
+	return s.opts.get(s, level, name)
+}
+
+// info is what TCP_INFO reports: only what's seen of the connection from
+// outside the host's stack.
+func (s *hostTCPSocket) info() linux.TCPInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var state uint8
+
+	switch s.state {
+	case hostConnecting:
+		state = linux.TCP_SYN_SENT
+	case hostConnected:
+		state = linux.TCP_ESTABLISHED
+	case hostListening:
+		state = linux.TCP_LISTEN
+	default:
+		state = linux.TCP_CLOSE
+	}
+
+	return linux.TCPInfo{
+		State:         state,
+		RcvSpace:      bufferSize,
+		BytesAcked:    s.sent,
+		BytesReceived: s.received,
+	}
+}
+
+func (s *hostTCPSocket) SetSockOpt(level, name int, val []byte) error {
+	if level == linux.SOL_TCP {
+		if err := s.tcp.set(name, val); err != nil {
+			return err
+		}
+	} else if err := s.opts.set(s, level, name, val); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+
+	if conn != nil {
+		s.applyOptions(conn)
+	}
+
+	return nil
+}
+
+func (s *hostTCPSocket) TakeError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.err
+	s.err = nil
+
+	return err
+}
+
+func (s *hostTCPSocket) ReuseAddress() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.reuse
+}
+
+// SetReuseAddress only records SO_REUSEADDR: Go sets it on the host's
+// listeners anyway.
+func (s *hostTCPSocket) SetReuseAddress(reuse bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reuse = reuse
+}
+
+func (s *hostTCPSocket) V6Only() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.v6only
+}
+
+func (s *hostTCPSocket) SetV6Only(v6only bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != hostInitial || s.local != nil {
+		return fs.ErrInvalid
+	}
+
+	s.v6only = v6only
+
+	return nil
+}
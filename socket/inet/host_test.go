@@ -0,0 +1,240 @@
+package inet_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/netpolicy"
+	"github.com/evanphx/columbia/pkg/waiter"
+	"github.com/evanphx/columbia/socket"
+	"github.com/stretchr/testify/require"
+)
+
+// freePort returns a port of the host nothing listens on.
+func freePort(t *testing.T, network string) int {
+	switch network {
+	case "udp":
+		c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer c.Close()
+
+		return c.LocalAddr().(*net.UDPAddr).Port
+	default:
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+
+		return l.Addr().(*net.TCPAddr).Port
+	}
+}
+
+func TestHostPassthrough(t *testing.T) {
+	localhost := net.IPv4(127, 0, 0, 1)
+
+	// The host's echo server, which the policy lets the guest reach.
+	echo, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// The host's UDP server, which replies to what it's sent.
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localhost})
+	require.NoError(t, err)
+	defer udp.Close()
+
+	go func() {
+		buf := make([]byte, 100)
+
+		for {
+			n, from, err := udp.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			udp.WriteToUDP(append([]byte("re: "), buf[:n]...), from)
+		}
+	}()
+
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+	udpPort := udp.LocalAddr().(*net.UDPAddr).Port
+	listenPort := freePort(t, "tcp")
+	closedPort := freePort(t, "tcp")
+
+	policy := &netpolicy.Policy{}
+
+	for _, s := range []string{
+		"out:127.0.0.1/32:" + strconv.Itoa(echoPort),
+		"out:127.0.0.1/32:" + strconv.Itoa(udpPort),
+		"out:127.0.0.1/32:" + strconv.Itoa(closedPort),
+		"in:127.0.0.0/8:" + strconv.Itoa(listenPort),
+	} {
+		r, err := netpolicy.ParseRule(s)
+		require.NoError(t, err)
+
+		policy.Rules = append(policy.Rules, r)
+	}
+
+	k, err := kernel.NewKernel(nil)
+	require.NoError(t, err)
+
+	k.SetNetworkPolicy(policy)
+
+	ctx := kernel.SetTask(context.Background(), &kernel.Task{Process: k.NewProcess("/")})
+
+	newSocket := func(t *testing.T, family, typ int) socket.Socket {
+		s, err := socket.New(ctx, family, typ, 0)
+		require.NoError(t, err)
+
+		t.Cleanup(func() { s.Close() })
+
+		return s
+	}
+
+	t.Run("connects to what the policy allows", func(t *testing.T) {
+		client := newSocket(t, linux.AF_INET, linux.SOCK_STREAM)
+		require.NoError(t, client.Connect(ctx, inet4(localhost, echoPort), false))
+
+		peer, err := client.PeerName()
+		require.NoError(t, err)
+		require.Equal(t, inet4(localhost, echoPort), peer)
+
+		_, err = client.SendMsg(ctx, []byte("hello"), nil, socket.ControlMessages{}, 0)
+		require.NoError(t, err)
+
+		data, _, _, _, err := client.RecvMsg(ctx, 5, linux.MSG_WAITALL)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+
+		// The echo server closes once our writing is shut down.
+		require.NoError(t, client.Shutdown(linux.SHUT_WR))
+
+		data, _, _, _, err = client.RecvMsg(ctx, 5, 0)
+		require.NoError(t, err)
+		require.Empty(t, data)
+	})
+
+	t.Run("connects in the background when nonblocking", func(t *testing.T) {
+		client := newSocket(t, linux.AF_INET6, linux.SOCK_STREAM)
+
+		err := client.Connect(ctx, inet6(net.ParseIP("::ffff:127.0.0.1"), echoPort), true)
+		require.Equal(t, socket.ErrInProgress, err)
+
+		wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		require.NoError(t, waiter.Wait(wctx, client, waiter.EventOut))
+
+		soerr, err := client.GetSockOpt(linux.SOL_SOCKET, linux.SO_ERROR)
+		require.NoError(t, err)
+		require.Equal(t, int32(0), soerr)
+
+		require.Equal(t, socket.ErrIsConnected, client.Connect(ctx, inet6(net.ParseIP("::ffff:127.0.0.1"), echoPort), false))
+	})
+
+	t.Run("refuses connects the policy denies", func(t *testing.T) {
+		client := newSocket(t, linux.AF_INET, linux.SOCK_STREAM)
+
+		require.Equal(t, socket.ErrConnectionRefused, client.Connect(ctx, inet4(localhost, freePort(t, "tcp")), false))
+
+		// The wildcard address is the host itself, which the policy sees.
+		require.Equal(t, socket.ErrConnectionRefused, client.Connect(ctx, inet4(net.IPv4zero, freePort(t, "tcp")), false))
+	})
+
+	t.Run("reports refusals by the host", func(t *testing.T) {
+		client := newSocket(t, linux.AF_INET, linux.SOCK_STREAM)
+		require.Equal(t, socket.ErrConnectionRefused, client.Connect(ctx, inet4(localhost, closedPort), false))
+	})
+
+	t.Run("accepts connections the policy allows in", func(t *testing.T) {
+		srv := newSocket(t, linux.AF_INET, linux.SOCK_STREAM)
+
+		denied := newSocket(t, linux.AF_INET, linux.SOCK_STREAM)
+		require.Equal(t, socket.ErrAccessDenied, denied.Bind(ctx, inet4(localhost, echoPort)))
+
+		require.NoError(t, srv.Bind(ctx, inet4(localhost, listenPort)))
+		require.NoError(t, srv.Listen(5))
+
+		conn, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(listenPort)))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		accepted, err := srv.Accept(ctx, false)
+		require.NoError(t, err)
+		defer accepted.Close()
+
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+
+		data, _, _, _, err := accepted.RecvMsg(ctx, 4, linux.MSG_WAITALL)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(data))
+
+		_, err = accepted.SendMsg(ctx, []byte("pong"), nil, socket.ControlMessages{}, 0)
+		require.NoError(t, err)
+
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "pong", string(buf))
+	})
+
+	t.Run("denies listening on ports no peer may reach", func(t *testing.T) {
+		srv := newSocket(t, linux.AF_INET, linux.SOCK_STREAM)
+
+		// The port the host picks isn't one the policy has.
+		require.Equal(t, socket.ErrAccessDenied, srv.Listen(5))
+	})
+
+	t.Run("passes UDP through", func(t *testing.T) {
+		s := newSocket(t, linux.AF_INET, linux.SOCK_DGRAM)
+
+		_, err = s.SendMsg(ctx, []byte("one"), inet4(localhost, freePort(t, "udp")), socket.ControlMessages{}, 0)
+		require.Equal(t, socket.ErrAccessDenied, err)
+
+		_, err = s.SendMsg(ctx, []byte("one"), inet4(localhost, udpPort), socket.ControlMessages{}, 0)
+		require.NoError(t, err)
+
+		rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		data, from, _, _, err := s.RecvMsg(rctx, 100, 0)
+		require.NoError(t, err)
+		require.Equal(t, "re: one", string(data))
+		require.Equal(t, inet4(localhost, udpPort), from)
+
+		// A peer the policy doesn't allow isn't heard from.
+		stranger, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localhost})
+		require.NoError(t, err)
+		defer stranger.Close()
+
+		name, err := s.SockName()
+		require.NoError(t, err)
+
+		_, err = stranger.WriteToUDP([]byte("hi"), &net.UDPAddr{IP: localhost, Port: int(name[2])<<8 | int(name[3])})
+		require.NoError(t, err)
+
+		time.Sleep(100 * time.Millisecond)
+
+		_, _, _, _, err = s.RecvMsg(ctx, 100, linux.MSG_DONTWAIT)
+		require.Equal(t, socket.ErrWouldBlock, err)
+	})
+}
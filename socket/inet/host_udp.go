@@ -0,0 +1,548 @@
+package inet
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/netstack"
+	"github.com/evanphx/columbia/pkg/waiter"
+	"github.com/evanphx/columbia/socket"
+)
+
+const (
+	// maxDatagram is the most a UDP datagram can carry.
+	maxDatagram = 65507
+
+	// maxDecisions is how many decisions a socket remembers before it
+	// forgets them all and starts over.
+	maxDecisions = 1024
+)
+
+// hostDatagram is a datagram received from the host.
+type hostDatagram struct {
+	data []byte
+	from netstack.Address
+}
+
+// hostUDPSocket is a UDP socket passed through to one of the host, which
+// is opened when the socket is first bound, connected or sent from. What
+// the host receives is queued by a goroutine, dropping datagrams from
+// peers the policy doesn't allow.
+type hostUDPSocket struct {
+	v6    bool
+	guard guard
+
+	opts *options
+
+	q waiter.Queue
+
+	mu sync.Mutex
+
+	conn  *net.UDPConn
+	local *netstack.Address
+
+	connected bool
+	remote    netstack.Address
+
+	reuse, v6only, broadcast bool
+
+	rcv     []hostDatagram
+	rcvSize int
+
+	rdShut, wrShut, closed bool
+
+	// decisions remembers what the policy said about each peer, so each
+	// is only asked and logged once. Keys are prefixed with the op.
+	decisions map[string]bool
+}
+
+func newHostUDPSocket(v6 bool, g guard) *hostUDPSocket {
+	return &hostUDPSocket{
+		v6:        v6,
+		guard:     g,
+		opts:      newOptions(v6, linux.SOCK_DGRAM, linux.IPPROTO_UDP),
+		decisions: make(map[string]bool),
+	}
+}
+
+func (s *hostUDPSocket) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	s.q.EventRegister(ch, mask)
+}
+
+func (s *hostUDPSocket) EventUnregister(ch chan struct{}) {
+	s.q.EventUnregister(ch)
+}
+
+func (s *hostUDPSocket) Readiness(mask waiter.EventMask) waiter.EventMask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ready waiter.EventMask
+
+	if s.closed {
+		return waiter.EventHUp & mask
+	}
+
+	if len(s.rcv) > 0 || s.rdShut {
+		ready |= waiter.EventIn
+	}
+
+	if s.rdShut && s.wrShut {
+		ready |= waiter.EventHUp
+	}
+
+	if !s.wrShut {
+		ready |= waiter.EventOut
+	}
+
+	return ready & mask
+}
+
+func (s *hostUDPSocket) Close() error {
+	s.mu.Lock()
+
+	conn := s.conn
+
+	s.closed = true
+	s.rcv = nil
+	s.rcvSize = 0
+
+	s.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+
+	s.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp)
+
+	return nil
+}
+
+// open opens the host's socket if it isn't yet. It's called with mu held.
+func (s *hostUDPSocket) open() error {
+	if s.closed {
+		return fs.ErrInvalid
+	}
+
+	if s.conn != nil {
+		return nil
+	}
+
+	local := netstack.Address{IP: net.IPv4zero}
+	if s.v6 {
+		local.IP = net.IPv6unspecified
+	}
+
+	if s.local != nil {
+		local = *s.local
+	}
+
+	network := hostNetwork("udp", s.v6, local)
+
+	// An IPv6 socket on the wildcard address takes IPv4 too, unless it's
+	// IPV6_V6ONLY.
+	if s.v6 && !s.v6only && local.IP.IsUnspecified() {
+		network = "udp"
+	}
+
+	la := &net.UDPAddr{Port: local.Port}
+
+	if !local.IP.IsUnspecified() {
+		la.IP = local.IP
+	}
+
+	conn, err := net.ListenUDP(network, la)
+	if err != nil {
+		return hostError(err)
+	}
+
+	s.conn = conn
+
+	go s.readLoop(conn)
+
+	return nil
+}
+
+// allowed asks the guard about a, unless it's been asked already. It's
+// called with mu held.
+func (s *hostUDPSocket) allowed(op string, a netstack.Address, ask func() bool) bool {
+	key := op + " " + a.String()
+
+	if allowed, ok := s.decisions[key]; ok {
+		return allowed
+	}
+
+	if len(s.decisions) >= maxDecisions {
+		s.decisions = make(map[string]bool)
+	}
+
+	allowed := ask()
+	s.decisions[key] = allowed
+
+	return allowed
+}
+
+// readLoop queues what conn receives from peers the socket may receive
+// from, while there's room for it, until conn is closed.
+func (s *hostUDPSocket) readLoop(conn *net.UDPConn) {
+	buf := make([]byte, 65536)
+
+	port := fromHost(conn.LocalAddr()).Port
+
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		from := fromHost(addr)
+
+		s.mu.Lock()
+
+		keep := !s.closed && !s.rdShut && s.rcvSize+n <= bufferSize
+
+		if keep && s.connected {
+			keep = from.IP.Equal(s.remote.IP) && from.Port == s.remote.Port
+		}
+
+		if keep {
+			keep = s.allowed("receive", from, func() bool {
+				return s.guard.allowsReply("receive", from, port)
+			})
+		}
+
+		if keep {
+			s.rcv = append(s.rcv, hostDatagram{
+				data: append([]byte(nil), buf[:n]...),
+				from: from,
+			})
+
+			s.rcvSize += n
+		}
+
+		s.mu.Unlock()
+
+		if keep {
+			s.q.Notify(waiter.EventIn)
+		}
+	}
+}
+
+func (s *hostUDPSocket) Bind(ctx context.Context, addr []byte) error {
+	a, err := parseAddress(s.v6, addr)
+	if err != nil {
+		return err
+	}
+
+	if err := checkBindPort(ctx, a.Port); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil || s.local != nil || v6OnlyConflict(s.v6only, a) {
+		return fs.ErrInvalid
+	}
+
+	if !s.guard.allowsPort("bind", a.Port) {
+		return socket.ErrAccessDenied
+	}
+
+	s.local = &a
+
+	if err := s.open(); err != nil {
+		s.local = nil
+		return err
+	}
+
+	return nil
+}
+
+func (s *hostUDPSocket) Listen(backlog int) error {
+	return socket.ErrNotSupported
+}
+
+func (s *hostUDPSocket) Accept(ctx context.Context, nonblock bool) (socket.Socket, error) {
+	return nil, socket.ErrNotSupported
+}
+
+// Connect sets where sends without an address go, and the only address
+// datagrams are received from, if the policy allows sending there. An
+// AF_UNSPEC address disconnects.
+func (s *hostUDPSocket) Connect(ctx context.Context, addr []byte, nonblock bool) error {
+	family, err := addrFamily(addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if family == linux.AF_UNSPEC {
+		s.connected = false
+		s.remote = netstack.Address{}
+
+		return nil
+	}
+
+	a, err := parseAddress(s.v6, addr)
+	if err != nil {
+		return err
+	}
+
+	if v6OnlyConflict(s.v6only, a) {
+		return socket.ErrNetworkUnreachable
+	}
+
+	a = destination(s.v6, a)
+
+	if !s.allowed("connect", a, func() bool { return s.guard.allowsOut("connect", a) }) {
+		return socket.ErrConnectionRefused
+	}
+
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	s.connected = true
+	s.remote = a
+
+	return nil
+}
+
+func (s *hostUDPSocket) Shutdown(how int) error {
+	read := how == linux.SHUT_RD || how == linux.SHUT_RDWR
+	write := how == linux.SHUT_WR || how == linux.SHUT_RDWR
+
+	s.mu.Lock()
+
+	if !s.connected {
+		s.mu.Unlock()
+		return socket.ErrNotConnected
+	}
+
+	if read {
+		s.rdShut = true
+	}
+
+	if write {
+		s.wrShut = true
+	}
+
+	s.mu.Unlock()
+
+	s.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp)
+
+	return nil
+}
+
+// SendMsg sends data to addr, or where the socket is connected to, if the
+// policy allows it. Sends it doesn't allow fail with ErrAccessDenied.
+func (s *hostUDPSocket) SendMsg(ctx context.Context, data, addr []byte, cm socket.ControlMessages, flags int) (int, error) {
+	if len(cm.Rights) > 0 {
+		cm.Release()
+		return 0, fs.ErrInvalid
+	}
+
+	s.mu.Lock()
+
+	if s.wrShut {
+		s.mu.Unlock()
+		return 0, socket.ErrBrokenPipe
+	}
+
+	var to netstack.Address
+
+	switch {
+	case addr != nil:
+		a, err := parseAddress(s.v6, addr)
+		if err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+
+		if v6OnlyConflict(s.v6only, a) {
+			s.mu.Unlock()
+			return 0, socket.ErrNetworkUnreachable
+		}
+
+		to = destination(s.v6, a)
+
+		if !s.allowed("send", to, func() bool { return s.guard.allowsOut("send", to) }) {
+			s.mu.Unlock()
+			return 0, socket.ErrAccessDenied
+		}
+	case s.connected:
+		to = s.remote
+	default:
+		s.mu.Unlock()
+		return 0, socket.ErrDestinationRequired
+	}
+
+	if len(data) > maxDatagram {
+		s.mu.Unlock()
+		return 0, socket.ErrMessageSize
+	}
+
+	if err := s.open(); err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+
+	conn := s.conn
+
+	s.mu.Unlock()
+
+	n, err := conn.WriteToUDP(data, &net.UDPAddr{IP: to.IP, Port: to.Port})
+
+	return n, hostError(err)
+}
+
+func (s *hostUDPSocket) RecvMsg(ctx context.Context, size int, flags int) ([]byte, []byte, socket.ControlMessages, int, error) {
+	peek := flags&linux.MSG_PEEK != 0
+
+	for {
+		s.mu.Lock()
+
+		if len(s.rcv) > 0 {
+			d := s.rcv[0]
+
+			if !peek {
+				s.rcv = s.rcv[1:]
+				s.rcvSize -= len(d.data)
+			}
+
+			s.mu.Unlock()
+
+			data := d.data
+
+			var msgFlags int
+
+			if len(data) > size {
+				data = data[:size]
+				msgFlags |= linux.MSG_TRUNC
+			}
+
+			return data, formatAddress(s.v6, d.from), socket.ControlMessages{}, msgFlags, nil
+		}
+
+		done := s.rdShut || s.closed
+		s.mu.Unlock()
+
+		if done {
+			return nil, nil, socket.ControlMessages{}, 0, nil
+		}
+
+		if flags&linux.MSG_DONTWAIT != 0 {
+			return nil, nil, socket.ControlMessages{}, 0, socket.ErrWouldBlock
+		}
+
+		if err := waiter.Wait(ctx, s, waiter.EventIn); err != nil {
+			return nil, nil, socket.ControlMessages{}, 0, err
+		}
+	}
+}
+
+func (s *hostUDPSocket) SockName() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.conn != nil:
+		return formatAddress(s.v6, fromHost(s.conn.LocalAddr())), nil
+	case s.local != nil:
+		return formatAddress(s.v6, *s.local), nil
+	case s.v6:
+		return formatAddress(s.v6, netstack.Address{IP: net.IPv6unspecified}), nil
+	}
+
+	return formatAddress(s.v6, netstack.Address{IP: net.IPv4zero}), nil
+}
+
+func (s *hostUDPSocket) PeerName() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.connected {
+		return nil, socket.ErrNotConnected
+	}
+
+	return formatAddress(s.v6, s.remote), nil
+}
+
+func (s *hostUDPSocket) GetSockOpt(level, name int) (interface{}, error) {
+	if level == linux.SOL_SOCKET {
+		switch name {
+		case linux.SO_ACCEPTCONN:
+			return int32(0), nil
+		case linux.SO_BROADCAST:
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			return boolOpt(s.broadcast), nil
+		}
+	}
+
+	return s.opts.get(s, level, name)
+}
+
+func (s *hostUDPSocket) SetSockOpt(level, name int, val []byte) error {
+	if level == linux.SOL_SOCKET && name == linux.SO_BROADCAST {
+		v, err := intOpt(val)
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		s.broadcast = v != 0
+		s.mu.Unlock()
+
+		return nil
+	}
+
+	return s.opts.set(s, level, name, val)
+}
+
+// TakeError has nothing to take: errors of the host's socket come back
+// from the calls that cause them.
+func (s *hostUDPSocket) TakeError() error {
+	return nil
+}
+
+func (s *hostUDPSocket) ReuseAddress() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.reuse
+}
+
+func (s *hostUDPSocket) SetReuseAddress(reuse bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reuse = reuse
+}
+
+func (s *hostUDPSocket) V6Only() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.v6only
+}
+
+func (s *hostUDPSocket) SetV6Only(v6only bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		return fs.ErrInvalid
+	}
+
+	s.v6only = v6only
+
+	return nil
+}
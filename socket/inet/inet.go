@@ -0,0 +1,239 @@
+// Package inet implements AF_INET and AF_INET6 sockets, TCP and UDP, on the
+// network stack of the kernel they're created in, or passed through to the
+// host's sockets if the kernel has a network policy to check them against.
+package inet
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/netstack"
+	"github.com/evanphx/columbia/socket"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	socket.RegisterFamily(linux.AF_INET, family{})
+	socket.RegisterFamily(linux.AF_INET6, family{v6: true})
+}
+
+type family struct {
+	v6 bool
+}
+
+func (f family) Socket(ctx context.Context, typ, protocol int) (socket.Socket, error) {
+	task, ok := kernel.GetTask(ctx)
+	if !ok {
+		return nil, socket.ErrNotSupported
+	}
+
+	if policy := task.Kernel.NetworkPolicy(); policy != nil {
+		return f.hostSocket(newGuard(ctx, policy), typ, protocol)
+	}
+
+	stack := task.Kernel.Network()
+
+	switch typ {
+	case linux.SOCK_STREAM:
+		if protocol != 0 && protocol != linux.IPPROTO_TCP {
+			return nil, socket.ErrProtocolNotSupported
+		}
+
+		return newTCPSocket(f.v6, stack.NewTCPEndpoint(f.v6)), nil
+	case linux.SOCK_DGRAM:
+		if protocol != 0 && protocol != linux.IPPROTO_UDP {
+			return nil, socket.ErrProtocolNotSupported
+		}
+
+		return newUDPSocket(f.v6, stack.NewUDPEndpoint(f.v6)), nil
+	}
+
+	return nil, socket.ErrTypeNotSupported
+}
+
+// hostSocket creates a socket passed through to the host, checked by g.
+func (f family) hostSocket(g guard, typ, protocol int) (socket.Socket, error) {
+	switch typ {
+	case linux.SOCK_STREAM:
+		if protocol != 0 && protocol != linux.IPPROTO_TCP {
+			return nil, socket.ErrProtocolNotSupported
+		}
+
+		return newHostTCPSocket(f.v6, g), nil
+	case linux.SOCK_DGRAM:
+		if protocol != 0 && protocol != linux.IPPROTO_UDP {
+			return nil, socket.ErrProtocolNotSupported
+		}
+
+		return newHostUDPSocket(f.v6, g), nil
+	}
+
+	return nil, socket.ErrTypeNotSupported
+}
+
+func (family) Pair(ctx context.Context, typ, protocol int) (socket.Socket, socket.Socket, error) {
+	return nil, nil, socket.ErrNotSupported
+}
+
+// translate converts an error of the stack into the socket error the
+// syscalls know.
+func translate(err error) error {
+	switch errors.Cause(err) {
+	case nil:
+		return nil
+	case netstack.ErrAddressInUse:
+		return socket.ErrAddressInUse
+	case netstack.ErrAddressNotAvailable:
+		return socket.ErrAddressNotAvailable
+	case netstack.ErrConnectionRefused:
+		return socket.ErrConnectionRefused
+	case netstack.ErrConnectionReset:
+		return socket.ErrConnectionReset
+	case netstack.ErrNetworkUnreachable:
+		return socket.ErrNetworkUnreachable
+	case netstack.ErrHostUnreachable:
+		return socket.ErrHostUnreachable
+	case netstack.ErrWouldBlock:
+		return socket.ErrWouldBlock
+	case netstack.ErrNotConnected:
+		return socket.ErrNotConnected
+	case netstack.ErrIsConnected:
+		return socket.ErrIsConnected
+	case netstack.ErrInvalidState:
+		return fs.ErrInvalid
+	case netstack.ErrBrokenPipe:
+		return socket.ErrBrokenPipe
+	case netstack.ErrMessageSize:
+		return socket.ErrMessageSize
+	case netstack.ErrDestinationRequired:
+		return socket.ErrDestinationRequired
+	}
+
+	return err
+}
+
+// htons swaps a port between host and network order, as the structs of
+// abi/linux are written out little-endian.
+func htons(port uint16) uint16 {
+	return port<<8 | port>>8
+}
+
+// addrFamily returns the family of a sockaddr.
+func addrFamily(addr []byte) (int, error) {
+	if len(addr) < 2 {
+		return 0, fs.ErrInvalid
+	}
+
+	return int(binary.LittleEndian.Uint16(addr)), nil
+}
+
+// reservedPorts is the number of ports, from 0, that only a process with
+// CAP_NET_BIND_SERVICE can bind.
+const reservedPorts = 1024
+
+// checkBindPort refuses to bind a reserved port for a process without
+// CAP_NET_BIND_SERVICE. Port 0 asks for any port, so it's allowed.
+func checkBindPort(ctx context.Context, port int) error {
+	if port == 0 || port >= reservedPorts {
+		return nil
+	}
+
+	creds, ok := auth.CredentialsFromContext(ctx)
+	if ok && !creds.HasCapability(linux.CAP_NET_BIND_SERVICE) {
+		return socket.ErrAccessDenied
+	}
+
+	return nil
+}
+
+// parseAddress parses the sockaddr_in or sockaddr_in6 of a socket of the
+// IPv6 family if v6 is set, or else of IPv4. An IPv4 address given to an
+// IPv6 socket is v4-mapped, as ::ffff:a.b.c.d.
+func parseAddress(v6 bool, addr []byte) (netstack.Address, error) {
+	family, err := addrFamily(addr)
+	if err != nil {
+		return netstack.Address{}, err
+	}
+
+	r := bytes.NewReader(addr)
+
+	if !v6 {
+		var sa linux.SockAddrInet
+
+		switch {
+		case family != linux.AF_INET:
+			return netstack.Address{}, socket.ErrFamilyNotSupported
+		case binary.Read(r, binary.LittleEndian, &sa) != nil:
+			return netstack.Address{}, fs.ErrInvalid
+		}
+
+		return netstack.Address{
+			IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+			Port: int(htons(sa.Port)),
+		}, nil
+	}
+
+	var sa linux.SockAddrInet6
+
+	// The scope id was added later, so a sockaddr_in6 can be without it.
+	if len(addr) == binary.Size(sa)-4 {
+		addr = append(addr[:len(addr):len(addr)], 0, 0, 0, 0)
+		r = bytes.NewReader(addr)
+	}
+
+	switch {
+	case family != linux.AF_INET6:
+		return netstack.Address{}, socket.ErrFamilyNotSupported
+	case binary.Read(r, binary.LittleEndian, &sa) != nil:
+		return netstack.Address{}, fs.ErrInvalid
+	}
+
+	return netstack.Address{
+		IP:   net.IP(append([]byte(nil), sa.Addr[:]...)),
+		Port: int(htons(sa.Port)),
+	}, nil
+}
+
+// formatAddress returns the sockaddr of a, as a socket of the IPv6 family
+// sees it if v6 is set, or else of IPv4.
+func formatAddress(v6 bool, a netstack.Address) []byte {
+	var buf bytes.Buffer
+
+	if !v6 {
+		sa := linux.SockAddrInet{
+			Family: linux.AF_INET,
+			Port:   htons(uint16(a.Port)),
+		}
+
+		if ip := a.IP.To4(); ip != nil {
+			copy(sa.Addr[:], ip)
+		}
+
+		binary.Write(&buf, binary.LittleEndian, &sa)
+
+		return buf.Bytes()
+	}
+
+	sa := linux.SockAddrInet6{
+		Family: linux.AF_INET6,
+		Port:   htons(uint16(a.Port)),
+	}
+
+	copy(sa.Addr[:], a.IP.To16())
+
+	binary.Write(&buf, binary.LittleEndian, &sa)
+
+	return buf.Bytes()
+}
+
+// v6OnlyConflict reports whether a is an IPv4 address an IPV6_V6ONLY
+// socket can't use.
+func v6OnlyConflict(v6only bool, a netstack.Address) bool {
+	return v6only && a.IP.To4() != nil
+}
@@ -0,0 +1,248 @@
+package inet_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/socket"
+	_ "github.com/evanphx/columbia/socket/inet"
+	"github.com/stretchr/testify/require"
+)
+
+func inet4(ip net.IP, port int) []byte {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint16(b, linux.AF_INET)
+	binary.BigEndian.PutUint16(b[2:], uint16(port))
+	copy(b[4:], ip.To4())
+
+	return b
+}
+
+func inet6(ip net.IP, port int) []byte {
+	b := make([]byte, 28)
+	binary.LittleEndian.PutUint16(b, linux.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:], uint16(port))
+	copy(b[8:], ip.To16())
+
+	return b
+}
+
+func intOpt(v int32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(v))
+
+	return b
+}
+
+func TestInet(t *testing.T) {
+	k, err := kernel.NewKernel(nil)
+	require.NoError(t, err)
+
+	ctx := kernel.SetTask(context.Background(), &kernel.Task{Process: k.NewProcess("/")})
+
+	localhost := net.IPv4(127, 0, 0, 1)
+
+	newSocket := func(t *testing.T, family, typ int) socket.Socket {
+		s, err := socket.New(ctx, family, typ, 0)
+		require.NoError(t, err)
+
+		return s
+	}
+
+	t.Run("rejects types and protocols it doesn't have", func(t *testing.T) {
+		_, err := socket.New(ctx, linux.AF_INET, linux.SOCK_SEQPACKET, 0)
+		require.Equal(t, socket.ErrTypeNotSupported, err)
+
+		_, err = socket.New(ctx, linux.AF_INET, linux.SOCK_STREAM, linux.IPPROTO_UDP)
+		require.Equal(t, socket.ErrProtocolNotSupported, err)
+
+		_, _, err = socket.NewPair(ctx, linux.AF_INET, linux.SOCK_STREAM, 0)
+		require.Equal(t, socket.ErrNotSupported, err)
+	})
+
+	t.Run("binds reserved ports only with CAP_NET_BIND_SERVICE", func(t *testing.T) {
+		user := auth.ContextWithCredentials(ctx, auth.New(1000, 1000))
+		root := auth.ContextWithCredentials(ctx, auth.New(0, 0))
+
+		s := newSocket(t, linux.AF_INET, linux.SOCK_STREAM)
+		defer s.Close()
+
+		require.Equal(t, socket.ErrAccessDenied, s.Bind(user, inet4(localhost, 443)))
+		require.NoError(t, s.Bind(root, inet4(localhost, 443)))
+
+		u := newSocket(t, linux.AF_INET, linux.SOCK_DGRAM)
+		defer u.Close()
+
+		require.NoError(t, u.Bind(user, inet4(localhost, 0)))
+	})
+
+	t.Run("serves TCP over 127.0.0.1", func(t *testing.T) {
+		srv := newSocket(t, linux.AF_INET, linux.SOCK_STREAM)
+
+		require.Equal(t, socket.ErrFamilyNotSupported, srv.Bind(ctx, inet6(net.IPv6loopback, 80)))
+		require.Equal(t, fs.ErrInvalid, srv.Bind(ctx, inet4(localhost, 80)[:8]))
+
+		require.NoError(t, srv.SetSockOpt(linux.SOL_SOCKET, linux.SO_REUSEADDR, intOpt(1)))
+		require.NoError(t, srv.Bind(ctx, inet4(net.IPv4zero, 8080)))
+		require.NoError(t, srv.Listen(5))
+
+		name, err := srv.SockName()
+		require.NoError(t, err)
+		require.Equal(t, inet4(net.IPv4zero, 8080), name)
+
+		accepting, err := srv.GetSockOpt(linux.SOL_SOCKET, linux.SO_ACCEPTCONN)
+		require.NoError(t, err)
+		require.Equal(t, int32(1), accepting)
+
+		client := newSocket(t, linux.AF_INET, linux.SOCK_STREAM)
+		require.NoError(t, client.Connect(ctx, inet4(localhost, 8080), false))
+
+		conn, err := srv.Accept(ctx, false)
+		require.NoError(t, err)
+
+		reuse, err := conn.GetSockOpt(linux.SOL_SOCKET, linux.SO_REUSEADDR)
+		require.NoError(t, err)
+		require.Equal(t, int32(0), reuse)
+
+		local, err := client.SockName()
+		require.NoError(t, err)
+
+		peer, err := conn.PeerName()
+		require.NoError(t, err)
+		require.Equal(t, local, peer)
+
+		name, err = conn.SockName()
+		require.NoError(t, err)
+		require.Equal(t, inet4(localhost, 8080), name)
+
+		_, err = client.SendMsg(ctx, []byte("GET /"), nil, socket.ControlMessages{}, 0)
+		require.NoError(t, err)
+
+		data, from, _, _, err := conn.RecvMsg(ctx, 100, 0)
+		require.NoError(t, err)
+		require.Equal(t, "GET /", string(data))
+		require.Nil(t, from)
+
+		opt, err := conn.GetSockOpt(linux.SOL_TCP, linux.TCP_INFO)
+		require.NoError(t, err)
+
+		info := opt.(linux.TCPInfo)
+		require.Equal(t, uint8(linux.TCP_ESTABLISHED), info.State)
+		require.Equal(t, uint64(5), info.BytesReceived)
+
+		require.NoError(t, client.Close())
+
+		data, _, _, _, err = conn.RecvMsg(ctx, 100, 0)
+		require.NoError(t, err)
+		require.Empty(t, data)
+
+		require.NoError(t, conn.Close())
+		require.NoError(t, srv.Close())
+	})
+
+	t.Run("uses v4-mapped addresses on AF_INET6", func(t *testing.T) {
+		srv := newSocket(t, linux.AF_INET6, linux.SOCK_STREAM)
+		require.NoError(t, srv.Bind(ctx, inet6(net.IPv6unspecified, 8081)))
+		require.NoError(t, srv.Listen(5))
+
+		client := newSocket(t, linux.AF_INET, linux.SOCK_STREAM)
+		require.NoError(t, client.Connect(ctx, inet4(localhost, 8081), false))
+
+		conn, err := srv.Accept(ctx, false)
+		require.NoError(t, err)
+
+		local, err := client.SockName()
+		require.NoError(t, err)
+
+		peer, err := conn.PeerName()
+		require.NoError(t, err)
+		require.Equal(t, inet6(localhost, int(binary.BigEndian.Uint16(local[2:]))), peer)
+
+		v6only := newSocket(t, linux.AF_INET6, linux.SOCK_STREAM)
+		require.NoError(t, v6only.SetSockOpt(linux.SOL_IPV6, linux.IPV6_V6ONLY, intOpt(1)))
+		require.Equal(t, fs.ErrInvalid, v6only.Bind(ctx, inet6(localhost, 8082)))
+
+		_, err = client.GetSockOpt(linux.SOL_IPV6, linux.IPV6_V6ONLY)
+		require.Equal(t, socket.ErrNoProtocolOption, err)
+	})
+
+	t.Run("exchanges UDP datagrams", func(t *testing.T) {
+		srv := newSocket(t, linux.AF_INET, linux.SOCK_DGRAM)
+		require.NoError(t, srv.Bind(ctx, inet4(localhost, 5353)))
+
+		client := newSocket(t, linux.AF_INET, linux.SOCK_DGRAM)
+
+		_, err := client.SendMsg(ctx, []byte("question"), inet4(localhost, 5353), socket.ControlMessages{}, 0)
+		require.NoError(t, err)
+
+		data, from, _, flags, err := srv.RecvMsg(ctx, 4, 0)
+		require.NoError(t, err)
+		require.Equal(t, "ques", string(data))
+		require.Equal(t, linux.MSG_TRUNC, flags)
+
+		local, err := client.SockName()
+		require.NoError(t, err)
+		require.Equal(t, local[2:4], from[2:4])
+
+		_, err = srv.SendMsg(ctx, []byte("answer"), from, socket.ControlMessages{}, 0)
+		require.NoError(t, err)
+
+		data, _, _, _, err = client.RecvMsg(ctx, 100, 0)
+		require.NoError(t, err)
+		require.Equal(t, "answer", string(data))
+
+		_, _, _, _, err = client.RecvMsg(ctx, 100, linux.MSG_DONTWAIT)
+		require.Equal(t, socket.ErrWouldBlock, err)
+
+		require.NoError(t, client.Connect(ctx, inet4(localhost, 9), false))
+
+		_, err = client.SendMsg(ctx, []byte("x"), nil, socket.ControlMessages{}, 0)
+		require.NoError(t, err)
+
+		soErr, err := client.GetSockOpt(linux.SOL_SOCKET, linux.SO_ERROR)
+		require.NoError(t, err)
+		require.NotEqual(t, int32(0), soErr)
+
+		unspec := make([]byte, 16)
+		require.NoError(t, client.Connect(ctx, unspec, false))
+
+		_, err = client.PeerName()
+		require.Equal(t, socket.ErrNotConnected, err)
+	})
+
+	t.Run("keeps options", func(t *testing.T) {
+		s := newSocket(t, linux.AF_INET, linux.SOCK_STREAM)
+
+		require.NoError(t, s.SetSockOpt(linux.SOL_TCP, linux.TCP_NODELAY, intOpt(1)))
+
+		v, err := s.GetSockOpt(linux.SOL_TCP, linux.TCP_NODELAY)
+		require.NoError(t, err)
+		require.Equal(t, int32(1), v)
+
+		require.NoError(t, s.SetSockOpt(linux.SOL_SOCKET, linux.SO_RCVBUF, intOpt(8192)))
+
+		v, err = s.GetSockOpt(linux.SOL_SOCKET, linux.SO_RCVBUF)
+		require.NoError(t, err)
+		require.Equal(t, int32(16384), v)
+
+		v, err = s.GetSockOpt(linux.SOL_IP, linux.IP_TTL)
+		require.NoError(t, err)
+		require.Equal(t, int32(64), v)
+
+		require.Equal(t, fs.ErrInvalid, s.SetSockOpt(linux.SOL_IP, linux.IP_TTL, intOpt(300)))
+
+		v, err = s.GetSockOpt(linux.SOL_SOCKET, linux.SO_DOMAIN)
+		require.NoError(t, err)
+		require.Equal(t, int32(linux.AF_INET), v)
+
+		v, err = s.GetSockOpt(linux.SOL_SOCKET, linux.SO_PROTOCOL)
+		require.NoError(t, err)
+		require.Equal(t, int32(linux.IPPROTO_TCP), v)
+	})
+}
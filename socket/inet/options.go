@@ -0,0 +1,436 @@
+package inet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/socket"
+)
+
+const (
+	// bufferSize is what SO_SNDBUF and SO_RCVBUF report until they're
+	// set, Linux's default.
+	bufferSize = 212992
+
+	// minBufferSize is the least SO_SNDBUF and SO_RCVBUF can be set to.
+	minBufferSize = 4608
+
+	// defaultTTL is the TTL and hop limit of sent packets, as
+	// net.ipv4.ip_default_ttl has it.
+	defaultTTL = 64
+)
+
+// linger is struct linger.
+type linger struct {
+	OnOff, Linger int32
+}
+
+// timeval is struct timeval on i386.
+type timeval struct {
+	Sec, USec int32
+}
+
+// endpoint is what the options need of a socket's endpoint in the stack.
+type endpoint interface {
+	TakeError() error
+	ReuseAddress() bool
+	SetReuseAddress(bool)
+	V6Only() bool
+	SetV6Only(bool) error
+}
+
+// options are the options TCP and UDP sockets have in common. Apart from
+// those the stack acts on, they're only kept to be reported back, as
+// there's no real network for them to affect.
+type options struct {
+	v6            bool
+	typ, protocol int
+
+	mu sync.Mutex
+
+	keepalive bool
+	linger    linger
+
+	sndbuf, rcvbuf int32
+
+	rcvTimeout, sndTimeout timeval
+
+	tos, ttl, hops int32
+}
+
+func newOptions(v6 bool, typ, protocol int) *options {
+	return &options{
+		v6:       v6,
+		typ:      typ,
+		protocol: protocol,
+		sndbuf:   bufferSize,
+		rcvbuf:   bufferSize,
+		ttl:      defaultTTL,
+		hops:     defaultTTL,
+	}
+}
+
+// clone returns options for a socket accepted from one with o, which
+// inherits them.
+func (o *options) clone() *options {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return &options{
+		v6:         o.v6,
+		typ:        o.typ,
+		protocol:   o.protocol,
+		keepalive:  o.keepalive,
+		linger:     o.linger,
+		sndbuf:     o.sndbuf,
+		rcvbuf:     o.rcvbuf,
+		rcvTimeout: o.rcvTimeout,
+		sndTimeout: o.sndTimeout,
+		tos:        o.tos,
+		ttl:        o.ttl,
+		hops:       o.hops,
+	}
+}
+
+func boolOpt(b bool) int32 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// soError is the errno SO_ERROR reports for err.
+func soError(err error) int32 {
+	switch translate(err) {
+	case nil:
+		return 0
+	case socket.ErrConnectionRefused:
+		return abi.ECONNREFUSED
+	case socket.ErrConnectionReset:
+		return abi.ECONNRESET
+	case socket.ErrNetworkUnreachable:
+		return abi.ENETUNREACH
+	case socket.ErrHostUnreachable:
+		return abi.EHOSTUNREACH
+	case socket.ErrTimedOut:
+		return abi.ETIMEDOUT
+	case socket.ErrAccessDenied:
+		return abi.EACCES
+	}
+
+	return abi.EIO
+}
+
+// keepAlive reports whether SO_KEEPALIVE is set.
+func (o *options) keepAlive() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.keepalive
+}
+
+// abortive reports whether SO_LINGER is on with a timeout of 0, which has
+// closing a connection reset it rather than finish it.
+func (o *options) abortive() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.linger.OnOff != 0 && o.linger.Linger == 0
+}
+
+func (o *options) get(ep endpoint, level, name int) (interface{}, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch level {
+	case linux.SOL_SOCKET:
+		switch name {
+		case linux.SO_TYPE:
+			return int32(o.typ), nil
+		case linux.SO_DOMAIN:
+			if o.v6 {
+				return int32(linux.AF_INET6), nil
+			}
+
+			return int32(linux.AF_INET), nil
+		case linux.SO_PROTOCOL:
+			return int32(o.protocol), nil
+		case linux.SO_ERROR:
+			return soError(ep.TakeError()), nil
+		case linux.SO_REUSEADDR, linux.SO_REUSEPORT:
+			return boolOpt(ep.ReuseAddress()), nil
+		case linux.SO_KEEPALIVE:
+			return boolOpt(o.keepalive), nil
+		case linux.SO_SNDBUF:
+			return o.sndbuf, nil
+		case linux.SO_RCVBUF:
+			return o.rcvbuf, nil
+		case linux.SO_LINGER:
+			return o.linger, nil
+		case linux.SO_RCVTIMEO:
+			return o.rcvTimeout, nil
+		case linux.SO_SNDTIMEO:
+			return o.sndTimeout, nil
+		}
+	case linux.SOL_IP:
+		switch name {
+		case linux.IP_TOS:
+			return o.tos, nil
+		case linux.IP_TTL:
+			return o.ttl, nil
+		}
+	case linux.SOL_IPV6:
+		if !o.v6 {
+			break
+		}
+
+		switch name {
+		case linux.IPV6_V6ONLY:
+			return boolOpt(ep.V6Only()), nil
+		case linux.IPV6_UNICAST_HOPS:
+			return o.hops, nil
+		}
+	}
+
+	return nil, socket.ErrNoProtocolOption
+}
+
+func (o *options) set(ep endpoint, level, name int, val []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch level {
+	case linux.SOL_SOCKET:
+		switch name {
+		case linux.SO_LINGER:
+			return decode(val, &o.linger)
+		case linux.SO_RCVTIMEO:
+			return o.setTimeout(val, &o.rcvTimeout)
+		case linux.SO_SNDTIMEO:
+			return o.setTimeout(val, &o.sndTimeout)
+		}
+
+		v, err := intOpt(val)
+		if err != nil {
+			return err
+		}
+
+		switch name {
+		case linux.SO_REUSEADDR, linux.SO_REUSEPORT:
+			ep.SetReuseAddress(v != 0)
+		case linux.SO_KEEPALIVE:
+			o.keepalive = v != 0
+		case linux.SO_SNDBUF:
+			o.sndbuf = bufferOpt(v)
+		case linux.SO_RCVBUF:
+			o.rcvbuf = bufferOpt(v)
+		default:
+			return socket.ErrNoProtocolOption
+		}
+
+		return nil
+	case linux.SOL_IP:
+		v, err := intOpt(val)
+		if err != nil {
+			return err
+		}
+
+		switch name {
+		case linux.IP_TOS:
+			o.tos = v & 0xff
+		case linux.IP_TTL:
+			switch {
+			case v == -1:
+				v = defaultTTL
+			case v < 1 || v > 255:
+				return fs.ErrInvalid
+			}
+
+			o.ttl = v
+		default:
+			return socket.ErrNoProtocolOption
+		}
+
+		return nil
+	case linux.SOL_IPV6:
+		if !o.v6 {
+			break
+		}
+
+		v, err := intOpt(val)
+		if err != nil {
+			return err
+		}
+
+		switch name {
+		case linux.IPV6_V6ONLY:
+			return translate(ep.SetV6Only(v != 0))
+		case linux.IPV6_UNICAST_HOPS:
+			switch {
+			case v == -1:
+				v = defaultTTL
+			case v < 0 || v > 255:
+				return fs.ErrInvalid
+			}
+
+			o.hops = v
+		default:
+			return socket.ErrNoProtocolOption
+		}
+
+		return nil
+	}
+
+	return socket.ErrNoProtocolOption
+}
+
+func (o *options) setTimeout(val []byte, tv *timeval) error {
+	var t timeval
+
+	if err := decode(val, &t); err != nil {
+		return err
+	}
+
+	if t.USec < 0 || t.USec >= 1e6 {
+		return fs.ErrInvalid
+	}
+
+	*tv = t
+
+	return nil
+}
+
+// bufferOpt is the size SO_SNDBUF and SO_RCVBUF report after being set to
+// v. As on Linux, it's capped at the default and doubled to leave room for
+// bookkeeping.
+func bufferOpt(v int32) int32 {
+	if v > bufferSize {
+		v = bufferSize
+	}
+
+	if v*2 < minBufferSize {
+		return minBufferSize
+	}
+
+	return v * 2
+}
+
+// intOpt decodes the int most options are set with.
+func intOpt(val []byte) (int32, error) {
+	if len(val) < 4 {
+		return 0, fs.ErrInvalid
+	}
+
+	return int32(binary.LittleEndian.Uint32(val)), nil
+}
+
+// decode decodes the struct an option is set with into v.
+func decode(val []byte, v interface{}) error {
+	if len(val) < binary.Size(v) {
+		return fs.ErrInvalid
+	}
+
+	return binary.Read(bytes.NewReader(val), binary.LittleEndian, v)
+}
+
+// tcpOptions are the SOL_TCP options kept for a TCP socket.
+type tcpOptions struct {
+	mu sync.Mutex
+
+	nodelay bool
+
+	keepIdle, keepIntvl, keepCnt int32
+}
+
+// newTCPOptions returns the options with Linux's defaults.
+func newTCPOptions() *tcpOptions {
+	return &tcpOptions{
+		keepIdle:  7200,
+		keepIntvl: 75,
+		keepCnt:   9,
+	}
+}
+
+func (o *tcpOptions) clone() *tcpOptions {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return &tcpOptions{
+		nodelay:   o.nodelay,
+		keepIdle:  o.keepIdle,
+		keepIntvl: o.keepIntvl,
+		keepCnt:   o.keepCnt,
+	}
+}
+
+// noDelay reports whether TCP_NODELAY is set.
+func (o *tcpOptions) noDelay() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.nodelay
+}
+
+func (o *tcpOptions) get(name int) (interface{}, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch name {
+	case linux.TCP_NODELAY:
+		return boolOpt(o.nodelay), nil
+	case linux.TCP_KEEPIDLE:
+		return o.keepIdle, nil
+	case linux.TCP_KEEPINTVL:
+		return o.keepIntvl, nil
+	case linux.TCP_KEEPCNT:
+		return o.keepCnt, nil
+	case linux.TCP_MAXSEG:
+		return int32(loopbackMSS), nil
+	}
+
+	return nil, socket.ErrNoProtocolOption
+}
+
+func (o *tcpOptions) set(name int, val []byte) error {
+	v, err := intOpt(val)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch name {
+	case linux.TCP_NODELAY:
+		o.nodelay = v != 0
+	case linux.TCP_KEEPIDLE:
+		if v < 1 || v > linux.MAX_TCP_KEEPIDLE {
+			return fs.ErrInvalid
+		}
+
+		o.keepIdle = v
+	case linux.TCP_KEEPINTVL:
+		if v < 1 || v > linux.MAX_TCP_KEEPINTVL {
+			return fs.ErrInvalid
+		}
+
+		o.keepIntvl = v
+	case linux.TCP_KEEPCNT:
+		if v < 1 || v > 127 {
+			return fs.ErrInvalid
+		}
+
+		o.keepCnt = v
+	case linux.TCP_MAXSEG, linux.TCP_CORK, linux.TCP_QUICKACK:
+		// Accepted, but there are no segments for them to shape.
+	default:
+		return socket.ErrNoProtocolOption
+	}
+
+	return nil
+}
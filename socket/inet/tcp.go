@@ -0,0 +1,190 @@
+package inet
+
+import (
+	"context"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/netstack"
+	"github.com/evanphx/columbia/pkg/waiter"
+	"github.com/evanphx/columbia/socket"
+)
+
+// loopbackMSS is the MSS Linux reports for connections over lo.
+const loopbackMSS = 65483
+
+type tcpSocket struct {
+	v6 bool
+	ep *netstack.TCPEndpoint
+
+	opts *options
+	tcp  *tcpOptions
+}
+
+func newTCPSocket(v6 bool, ep *netstack.TCPEndpoint) *tcpSocket {
+	return &tcpSocket{
+		v6:   v6,
+		ep:   ep,
+		opts: newOptions(v6, linux.SOCK_STREAM, linux.IPPROTO_TCP),
+		tcp:  newTCPOptions(),
+	}
+}
+
+func (s *tcpSocket) Readiness(mask waiter.EventMask) waiter.EventMask {
+	return s.ep.Readiness(mask)
+}
+
+func (s *tcpSocket) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	s.ep.EventRegister(ch, mask)
+}
+
+func (s *tcpSocket) EventUnregister(ch chan struct{}) {
+	s.ep.EventUnregister(ch)
+}
+
+func (s *tcpSocket) Close() error {
+	if s.opts.abortive() {
+		s.ep.Abort()
+	} else {
+		s.ep.Close()
+	}
+
+	return nil
+}
+
+func (s *tcpSocket) Bind(ctx context.Context, addr []byte) error {
+	a, err := parseAddress(s.v6, addr)
+	if err != nil {
+		return err
+	}
+
+	if err := checkBindPort(ctx, a.Port); err != nil {
+		return err
+	}
+
+	if v6OnlyConflict(s.ep.V6Only(), a) {
+		return fs.ErrInvalid
+	}
+
+	return translate(s.ep.Bind(a))
+}
+
+func (s *tcpSocket) Listen(backlog int) error {
+	return translate(s.ep.Listen(backlog))
+}
+
+func (s *tcpSocket) Accept(ctx context.Context, nonblock bool) (socket.Socket, error) {
+	ep, err := s.ep.Accept(ctx, nonblock)
+	if err != nil {
+		return nil, translate(err)
+	}
+
+	return &tcpSocket{
+		v6:   s.v6,
+		ep:   ep,
+		opts: s.opts.clone(),
+		tcp:  s.tcp.clone(),
+	}, nil
+}
+
+func (s *tcpSocket) Connect(ctx context.Context, addr []byte, nonblock bool) error {
+	a, err := parseAddress(s.v6, addr)
+	if err != nil {
+		return err
+	}
+
+	if v6OnlyConflict(s.ep.V6Only(), a) {
+		return socket.ErrNetworkUnreachable
+	}
+
+	return translate(s.ep.Connect(ctx, a, nonblock))
+}
+
+func (s *tcpSocket) Shutdown(how int) error {
+	read := how == linux.SHUT_RD || how == linux.SHUT_RDWR
+	write := how == linux.SHUT_WR || how == linux.SHUT_RDWR
+
+	return translate(s.ep.Shutdown(read, write))
+}
+
+// SendMsg writes data to the connection. An address is ignored, as Linux
+// does for a connected TCP socket.
+func (s *tcpSocket) SendMsg(ctx context.Context, data, addr []byte, cm socket.ControlMessages, flags int) (int, error) {
+	if len(cm.Rights) > 0 {
+		cm.Release()
+		return 0, fs.ErrInvalid
+	}
+
+	n, err := s.ep.Write(ctx, data, flags&linux.MSG_DONTWAIT != 0)
+
+	return n, translate(err)
+}
+
+func (s *tcpSocket) RecvMsg(ctx context.Context, size int, flags int) ([]byte, []byte, socket.ControlMessages, int, error) {
+	buf := make([]byte, size)
+
+	n, err := s.ep.Read(ctx, buf,
+		flags&linux.MSG_PEEK != 0,
+		flags&linux.MSG_WAITALL != 0,
+		flags&linux.MSG_DONTWAIT != 0)
+	if err != nil {
+		return nil, nil, socket.ControlMessages{}, 0, translate(err)
+	}
+
+	return buf[:n], nil, socket.ControlMessages{}, 0, nil
+}
+
+func (s *tcpSocket) SockName() ([]byte, error) {
+	return formatAddress(s.v6, s.ep.LocalAddress()), nil
+}
+
+func (s *tcpSocket) PeerName() ([]byte, error) {
+	a, err := s.ep.RemoteAddress()
+	if err != nil {
+		return nil, translate(err)
+	}
+
+	return formatAddress(s.v6, a), nil
+}
+
+func (s *tcpSocket) GetSockOpt(level, name int) (interface{}, error) {
+	switch level {
+	case linux.SOL_SOCKET:
+		if name == linux.SO_ACCEPTCONN {
+			return boolOpt(s.ep.Listening()), nil
+		}
+	case linux.SOL_TCP:
+		if name == linux.TCP_INFO {
+			return s.info(), nil
+		}
+
+		return s.tcp.get(name)
+	}
+
+	return s.opts.get(s.ep, level, name)
+}
+
+// info is what TCP_INFO reports, filled in from what the stack keeps.
+func (s *tcpSocket) info() linux.TCPInfo {
+	info := s.ep.Info()
+
+	return linux.TCPInfo{
+		State:         info.State,
+		SndMss:        loopbackMSS,
+		RcvMss:        loopbackMSS,
+		Advmss:        loopbackMSS,
+		PMTU:          65536,
+		SndCwnd:       10,
+		RcvSpace:      bufferSize,
+		BytesAcked:    info.BytesSent,
+		BytesReceived: info.BytesReceived,
+	}
+}
+
+func (s *tcpSocket) SetSockOpt(level, name int, val []byte) error {
+	if level == linux.SOL_TCP {
+		return s.tcp.set(name, val)
+	}
+
+	return s.opts.set(s.ep, level, name, val)
+}
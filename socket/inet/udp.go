@@ -0,0 +1,188 @@
+package inet
+
+import (
+	"context"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/netstack"
+	"github.com/evanphx/columbia/pkg/waiter"
+	"github.com/evanphx/columbia/socket"
+)
+
+type udpSocket struct {
+	v6 bool
+	ep *netstack.UDPEndpoint
+
+	opts *options
+}
+
+func newUDPSocket(v6 bool, ep *netstack.UDPEndpoint) *udpSocket {
+	return &udpSocket{
+		v6:   v6,
+		ep:   ep,
+		opts: newOptions(v6, linux.SOCK_DGRAM, linux.IPPROTO_UDP),
+	}
+}
+
+func (s *udpSocket) Readiness(mask waiter.EventMask) waiter.EventMask {
+	return s.ep.Readiness(mask)
+}
+
+func (s *udpSocket) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	s.ep.EventRegister(ch, mask)
+}
+
+func (s *udpSocket) EventUnregister(ch chan struct{}) {
+	s.ep.EventUnregister(ch)
+}
+
+func (s *udpSocket) Close() error {
+	s.ep.Close()
+	return nil
+}
+
+func (s *udpSocket) Bind(ctx context.Context, addr []byte) error {
+	a, err := parseAddress(s.v6, addr)
+	if err != nil {
+		return err
+	}
+
+	if err := checkBindPort(ctx, a.Port); err != nil {
+		return err
+	}
+
+	if v6OnlyConflict(s.ep.V6Only(), a) {
+		return fs.ErrInvalid
+	}
+
+	return translate(s.ep.Bind(a))
+}
+
+func (s *udpSocket) Listen(backlog int) error {
+	return socket.ErrNotSupported
+}
+
+func (s *udpSocket) Accept(ctx context.Context, nonblock bool) (socket.Socket, error) {
+	return nil, socket.ErrNotSupported
+}
+
+// Connect sets where sends without an address go, and the only address
+// datagrams are received from. An AF_UNSPEC address disconnects.
+func (s *udpSocket) Connect(ctx context.Context, addr []byte, nonblock bool) error {
+	family, err := addrFamily(addr)
+	if err != nil {
+		return err
+	}
+
+	if family == linux.AF_UNSPEC {
+		return translate(s.ep.Connect(nil))
+	}
+
+	a, err := parseAddress(s.v6, addr)
+	if err != nil {
+		return err
+	}
+
+	if v6OnlyConflict(s.ep.V6Only(), a) {
+		return socket.ErrNetworkUnreachable
+	}
+
+	return translate(s.ep.Connect(&a))
+}
+
+func (s *udpSocket) Shutdown(how int) error {
+	read := how == linux.SHUT_RD || how == linux.SHUT_RDWR
+	write := how == linux.SHUT_WR || how == linux.SHUT_RDWR
+
+	return translate(s.ep.Shutdown(read, write))
+}
+
+func (s *udpSocket) SendMsg(ctx context.Context, data, addr []byte, cm socket.ControlMessages, flags int) (int, error) {
+	if len(cm.Rights) > 0 {
+		cm.Release()
+		return 0, fs.ErrInvalid
+	}
+
+	var to *netstack.Address
+
+	if addr != nil {
+		a, err := parseAddress(s.v6, addr)
+		if err != nil {
+			return 0, err
+		}
+
+		if v6OnlyConflict(s.ep.V6Only(), a) {
+			return 0, socket.ErrNetworkUnreachable
+		}
+
+		to = &a
+	}
+
+	n, err := s.ep.SendTo(data, to)
+
+	return n, translate(err)
+}
+
+func (s *udpSocket) RecvMsg(ctx context.Context, size int, flags int) ([]byte, []byte, socket.ControlMessages, int, error) {
+	data, from, full, err := s.ep.RecvFrom(ctx, size,
+		flags&linux.MSG_PEEK != 0,
+		flags&linux.MSG_DONTWAIT != 0)
+	if err != nil {
+		return nil, nil, socket.ControlMessages{}, 0, translate(err)
+	}
+
+	if from.IP == nil {
+		// Reading was shut down.
+		return nil, nil, socket.ControlMessages{}, 0, nil
+	}
+
+	var msgFlags int
+
+	if full > len(data) {
+		msgFlags |= linux.MSG_TRUNC
+	}
+
+	return data, formatAddress(s.v6, from), socket.ControlMessages{}, msgFlags, nil
+}
+
+func (s *udpSocket) SockName() ([]byte, error) {
+	return formatAddress(s.v6, s.ep.LocalAddress()), nil
+}
+
+func (s *udpSocket) PeerName() ([]byte, error) {
+	a, err := s.ep.RemoteAddress()
+	if err != nil {
+		return nil, translate(err)
+	}
+
+	return formatAddress(s.v6, a), nil
+}
+
+func (s *udpSocket) GetSockOpt(level, name int) (interface{}, error) {
+	if level == linux.SOL_SOCKET {
+		switch name {
+		case linux.SO_ACCEPTCONN:
+			return int32(0), nil
+		case linux.SO_BROADCAST:
+			return boolOpt(s.ep.Broadcast()), nil
+		}
+	}
+
+	return s.opts.get(s.ep, level, name)
+}
+
+func (s *udpSocket) SetSockOpt(level, name int, val []byte) error {
+	if level == linux.SOL_SOCKET && name == linux.SO_BROADCAST {
+		v, err := intOpt(val)
+		if err != nil {
+			return err
+		}
+
+		s.ep.SetBroadcast(v != 0)
+
+		return nil
+	}
+
+	return s.opts.set(s.ep, level, name, val)
+}
@@ -0,0 +1,158 @@
+package netlink
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/evanphx/columbia/abi/linux"
+)
+
+// align rounds n up to the alignment of netlink messages and attributes,
+// which is the same for both.
+func align(n int) int {
+	return (n + linux.NLMSG_ALIGNTO - 1) &^ (linux.NLMSG_ALIGNTO - 1)
+}
+
+// message is a netlink message being built.
+type message struct {
+	buf bytes.Buffer
+}
+
+func newMessage(hdr linux.NetlinkMessageHeader) *message {
+	m := &message{}
+	m.put(hdr)
+
+	return m
+}
+
+// pad pads the message to the alignment.
+func (m *message) pad() {
+	for m.buf.Len() != align(m.buf.Len()) {
+		m.buf.WriteByte(0)
+	}
+}
+
+// put appends v, a struct of abi/linux or a value encoding/binary can
+// write.
+func (m *message) put(v interface{}) {
+	binary.Write(&m.buf, binary.LittleEndian, v)
+	m.pad()
+}
+
+// putAttr appends an attribute. A string is written with its NUL, as the
+// kernel writes names.
+func (m *message) putAttr(typ uint16, v interface{}) {
+	var payload []byte
+
+	switch v := v.(type) {
+	case []byte:
+		payload = v
+	case string:
+		payload = append([]byte(v), 0)
+	default:
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, v)
+		payload = buf.Bytes()
+	}
+
+	m.put(linux.NetlinkAttrHeader{
+		Length: uint16(linux.NetlinkAttrHeaderSize + len(payload)),
+		Type:   typ,
+	})
+
+	m.buf.Write(payload)
+	m.pad()
+}
+
+// bytes returns the message with its length filled in.
+func (m *message) bytes() []byte {
+	b := m.buf.Bytes()
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+
+	return b
+}
+
+// request is a message received from the guest.
+type request struct {
+	hdr     linux.NetlinkMessageHeader
+	payload []byte
+
+	// raw is the whole message, which an error reply echoes.
+	raw []byte
+}
+
+// parseRequests splits data into its messages. What's left over that
+// can't be a message is ignored, as Linux does.
+func parseRequests(data []byte) []request {
+	var reqs []request
+
+	for len(data) >= linux.NetlinkMessageHeaderSize {
+		var hdr linux.NetlinkMessageHeader
+
+		binary.Read(bytes.NewReader(data), binary.LittleEndian, &hdr)
+
+		size := int(hdr.Length)
+		if size < linux.NetlinkMessageHeaderSize || size > len(data) {
+			break
+		}
+
+		reqs = append(reqs, request{
+			hdr:     hdr,
+			payload: data[linux.NetlinkMessageHeaderSize:size],
+			raw:     data[:size],
+		})
+
+		if align(size) >= len(data) {
+			break
+		}
+
+		data = data[align(size):]
+	}
+
+	return reqs
+}
+
+// decode reads the fixed header of a request's payload into v, returning
+// what follows it. It reports false if the payload is too short.
+func (r *request) decode(v interface{}) ([]byte, bool) {
+	size := binary.Size(v)
+
+	if len(r.payload) < size {
+		return nil, false
+	}
+
+	binary.Read(bytes.NewReader(r.payload), binary.LittleEndian, v)
+
+	if align(size) >= len(r.payload) {
+		return nil, true
+	}
+
+	return r.payload[align(size):], true
+}
+
+// parseAttrs returns the payloads of the attributes in b, by type. A
+// malformed attribute ends them.
+func parseAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+
+	for len(b) >= linux.NetlinkAttrHeaderSize {
+		size := int(binary.LittleEndian.Uint16(b))
+		// The top bits of the type are NLA_F_NESTED and
+		// NLA_F_NET_BYTEORDER.
+		typ := binary.LittleEndian.Uint16(b[2:]) & 0x3fff
+
+		if size < linux.NetlinkAttrHeaderSize || size > len(b) {
+			break
+		}
+
+		attrs[typ] = b[linux.NetlinkAttrHeaderSize:size]
+
+		if align(size) >= len(b) {
+			break
+		}
+
+		b = b[align(size):]
+	}
+
+	return attrs
+}
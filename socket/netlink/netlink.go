@@ -0,0 +1,587 @@
+// Package netlink implements AF_NETLINK sockets for NETLINK_ROUTE, which
+// answer the requests of ip(8) and getifaddrs(3) from the interfaces and
+// routes of the kernel's network stack. Nothing is ever multicast: the
+// stack only changes when a socket asks it to.
+package netlink
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/netstack"
+	"github.com/evanphx/columbia/pkg/waiter"
+	"github.com/evanphx/columbia/socket"
+	"github.com/pkg/errors"
+)
+
+const (
+	// bufferSize is what SO_SNDBUF and SO_RCVBUF report, and how many
+	// bytes of replies a socket holds before requests are refused.
+	bufferSize = 212992
+
+	// dumpSize is how many bytes of a dump go in each datagram, as Linux
+	// fills a page with them.
+	dumpSize = 4096
+
+	// firstAutoPort is where the port ids Linux picks for a process's
+	// further sockets start, counting down.
+	firstAutoPort = -4096
+)
+
+func init() {
+	socket.RegisterFamily(linux.AF_NETLINK, family{})
+}
+
+type family struct{}
+
+func (family) Socket(ctx context.Context, typ, protocol int) (socket.Socket, error) {
+	if typ != linux.SOCK_RAW && typ != linux.SOCK_DGRAM {
+		return nil, socket.ErrTypeNotSupported
+	}
+
+	if protocol != linux.NETLINK_ROUTE {
+		return nil, socket.ErrProtocolNotSupported
+	}
+
+	task, ok := kernel.GetTask(ctx)
+	if !ok {
+		return nil, socket.ErrNotSupported
+	}
+
+	return &sock{
+		typ:   typ,
+		stack: task.Kernel.Network(),
+		pid:   task.Pid,
+	}, nil
+}
+
+func (family) Pair(ctx context.Context, typ, protocol int) (socket.Socket, socket.Socket, error) {
+	return nil, nil, socket.ErrNotSupported
+}
+
+var (
+	portsMu sync.Mutex
+
+	// ports are the port ids sockets are bound to.
+	ports = map[uint32]bool{}
+
+	nextAutoPort int32 = firstAutoPort
+)
+
+// claimPort takes port for a socket. A port of 0 picks one, pid if it's
+// free, as a process's first socket gets its pid on Linux.
+func claimPort(port uint32, pid int) (uint32, error) {
+	portsMu.Lock()
+	defer portsMu.Unlock()
+
+	if port == 0 {
+		port = uint32(pid)
+
+		for port == 0 || ports[port] {
+			port = uint32(nextAutoPort)
+			nextAutoPort--
+		}
+	} else if ports[port] {
+		return 0, socket.ErrAddressInUse
+	}
+
+	ports[port] = true
+
+	return port, nil
+}
+
+func releasePort(port uint32) {
+	portsMu.Lock()
+	defer portsMu.Unlock()
+
+	delete(ports, port)
+}
+
+type sock struct {
+	typ   int
+	stack *netstack.Stack
+	pid   int
+
+	q waiter.Queue
+
+	mu sync.Mutex
+
+	port   uint32
+	bound  bool
+	groups uint32
+
+	// rcv are the datagrams of replies waiting to be received.
+	rcv     [][]byte
+	rcvSize int
+
+	passcred bool
+
+	// options are the SOL_NETLINK options that were set, which only
+	// NETLINK_CAP_ACK does anything about.
+	options map[int]bool
+
+	closed bool
+}
+
+func (s *sock) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	s.q.EventRegister(ch, mask)
+}
+
+func (s *sock) EventUnregister(ch chan struct{}) {
+	s.q.EventUnregister(ch)
+}
+
+func (s *sock) Readiness(mask waiter.EventMask) waiter.EventMask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ready := waiter.EventOut
+
+	if len(s.rcv) > 0 {
+		ready |= waiter.EventIn
+	}
+
+	return ready & mask
+}
+
+func (s *sock) Close() error {
+	s.mu.Lock()
+
+	if s.bound {
+		releasePort(s.port)
+	}
+
+	s.closed = true
+	s.bound = false
+	s.rcv = nil
+
+	s.mu.Unlock()
+
+	s.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp)
+
+	return nil
+}
+
+// parseAddress parses a sockaddr_nl.
+func parseAddress(addr []byte) (linux.SockAddrNetlink, error) {
+	var sa linux.SockAddrNetlink
+
+	if len(addr) < linux.SockAddrNetlinkSize {
+		return sa, fs.ErrInvalid
+	}
+
+	binary.Read(bytes.NewReader(addr), binary.LittleEndian, &sa)
+
+	if sa.Family != linux.AF_NETLINK {
+		return sa, fs.ErrInvalid
+	}
+
+	return sa, nil
+}
+
+func formatAddress(port, groups uint32) []byte {
+	var buf bytes.Buffer
+
+	binary.Write(&buf, binary.LittleEndian, linux.SockAddrNetlink{
+		Family: linux.AF_NETLINK,
+		PortID: port,
+		Groups: groups,
+	})
+
+	return buf.Bytes()
+}
+
+// bind binds the socket to port, picking one if it's 0. A socket that's
+// bound already stays as it is, if port is 0 or its own. It's called with
+// mu held.
+func (s *sock) bind(port uint32) error {
+	if s.bound {
+		if port != 0 && port != s.port {
+			return fs.ErrInvalid
+		}
+
+		return nil
+	}
+
+	port, err := claimPort(port, s.pid)
+	if err != nil {
+		return err
+	}
+
+	s.port = port
+	s.bound = true
+
+	return nil
+}
+
+func (s *sock) Bind(ctx context.Context, addr []byte) error {
+	sa, err := parseAddress(addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.bind(sa.PortID); err != nil {
+		return err
+	}
+
+	s.groups = sa.Groups
+
+	return nil
+}
+
+func (s *sock) Listen(backlog int) error {
+	return socket.ErrNotSupported
+}
+
+func (s *sock) Accept(ctx context.Context, nonblock bool) (socket.Socket, error) {
+	return nil, socket.ErrNotSupported
+}
+
+// Connect only binds the socket, as the kernel is the only peer there is
+// to send to.
+func (s *sock) Connect(ctx context.Context, addr []byte, nonblock bool) error {
+	if len(addr) >= 2 && binary.LittleEndian.Uint16(addr) == linux.AF_UNSPEC {
+		return nil
+	}
+
+	if _, err := parseAddress(addr); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.bind(0)
+}
+
+func (s *sock) Shutdown(how int) error {
+	return socket.ErrNotSupported
+}
+
+// SendMsg handles the requests in data, queueing the replies to be
+// received. Sending to anyone but the kernel is refused, as no other
+// sockets receive.
+func (s *sock) SendMsg(ctx context.Context, data, addr []byte, cm socket.ControlMessages, flags int) (int, error) {
+	cm.Release()
+
+	if addr != nil {
+		sa, err := parseAddress(addr)
+		if err != nil {
+			return 0, err
+		}
+
+		if sa.PortID != 0 {
+			return 0, socket.ErrConnectionRefused
+		}
+	}
+
+	s.mu.Lock()
+
+	if err := s.bind(0); err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+
+	if s.rcvSize >= bufferSize {
+		s.mu.Unlock()
+		return 0, socket.ErrNoBufferSpace
+	}
+
+	port, capAck := s.port, s.options[linux.NETLINK_CAP_ACK]
+
+	s.mu.Unlock()
+
+	var replies [][]byte
+
+	for _, req := range parseRequests(data) {
+		if req.hdr.Flags&linux.NLM_F_REQUEST == 0 || req.hdr.Type < linux.NLMSG_MIN_TYPE {
+			continue
+		}
+
+		msgs, dump, err := handleRoute(ctx, s.stack, req)
+
+		switch {
+		case dump:
+			replies = append(replies, packDump(req, port, msgs)...)
+		case err != nil:
+			replies = append(replies, errorMessage(req, port, err, capAck))
+		default:
+			for _, m := range msgs {
+				replies = append(replies, finish(m, req, port, 0))
+			}
+
+			if req.hdr.Flags&linux.NLM_F_ACK != 0 {
+				replies = append(replies, errorMessage(req, port, nil, true))
+			}
+		}
+	}
+
+	s.mu.Lock()
+
+	for _, r := range replies {
+		s.rcv = append(s.rcv, r)
+		s.rcvSize += len(r)
+	}
+
+	s.mu.Unlock()
+
+	if len(replies) > 0 {
+		s.q.Notify(waiter.EventIn)
+	}
+
+	return len(data), nil
+}
+
+// finish fills in the header of the reply m to req, which goes to port.
+func finish(m *message, req request, port uint32, flags uint16) []byte {
+	b := m.bytes()
+
+	binary.LittleEndian.PutUint16(b[6:], flags)
+	binary.LittleEndian.PutUint32(b[8:], req.hdr.Seq)
+	binary.LittleEndian.PutUint32(b[12:], port)
+
+	return b
+}
+
+// packDump packs the replies to the dump req, ended by NLMSG_DONE, into
+// datagrams of up to dumpSize bytes.
+func packDump(req request, port uint32, msgs []*message) [][]byte {
+	done := newMessage(linux.NetlinkMessageHeader{Type: linux.NLMSG_DONE})
+	done.put(int32(0))
+
+	var (
+		datagrams [][]byte
+		cur       []byte
+	)
+
+	add := func(b []byte) {
+		if len(cur) > 0 && len(cur)+len(b) > dumpSize {
+			datagrams = append(datagrams, cur)
+			cur = nil
+		}
+
+		cur = append(cur, b...)
+	}
+
+	for _, m := range msgs {
+		add(finish(m, req, port, linux.NLM_F_MULTI))
+	}
+
+	add(finish(done, req, port, linux.NLM_F_MULTI))
+
+	return append(datagrams, cur)
+}
+
+// errorMessage returns the NLMSG_ERROR reply to req, which carries the
+// errno of err, or 0 for an acknowledgement. Unless capped, it echoes the
+// whole request rather than just its header.
+func errorMessage(req request, port uint32, err error, capped bool) []byte {
+	m := newMessage(linux.NetlinkMessageHeader{Type: linux.NLMSG_ERROR})
+
+	m.put(-errno(err))
+
+	var flags uint16
+
+	if capped || err == nil {
+		m.put(req.hdr)
+
+		if err != nil {
+			flags = linux.NLM_F_CAPPED
+		}
+	} else {
+		m.buf.Write(req.raw)
+		m.pad()
+	}
+
+	return finish(m, req, port, flags)
+}
+
+// errno is the errno Linux replies with for err.
+func errno(err error) int32 {
+	switch errors.Cause(err) {
+	case nil:
+		return 0
+	case netstack.ErrNoInterface:
+		return abi.ENODEV
+	case netstack.ErrExists:
+		return abi.EEXIST
+	case netstack.ErrNetworkUnreachable:
+		return abi.ENETUNREACH
+	case netstack.ErrAddressNotAvailable:
+		return abi.EADDRNOTAVAIL
+	case socket.ErrNotSupported:
+		return abi.EOPNOTSUPP
+	case socket.ErrPermission:
+		return abi.EPERM
+	}
+
+	return abi.EINVAL
+}
+
+// RecvMsg receives the next datagram of replies. With MSG_TRUNC, all of
+// it is returned even if it's longer than size, so the caller learns its
+// length.
+func (s *sock) RecvMsg(ctx context.Context, size int, flags int) ([]byte, []byte, socket.ControlMessages, int, error) {
+	for {
+		s.mu.Lock()
+
+		if len(s.rcv) > 0 {
+			data := s.rcv[0]
+
+			if flags&linux.MSG_PEEK == 0 {
+				s.rcv = s.rcv[1:]
+				s.rcvSize -= len(data)
+			}
+
+			s.mu.Unlock()
+
+			var msgFlags int
+
+			if len(data) > size {
+				msgFlags |= linux.MSG_TRUNC
+
+				if flags&linux.MSG_TRUNC == 0 {
+					data = data[:size]
+				}
+			}
+
+			return data, formatAddress(0, 0), socket.ControlMessages{}, msgFlags, nil
+		}
+
+		closed := s.closed
+		s.mu.Unlock()
+
+		if closed {
+			return nil, nil, socket.ControlMessages{}, 0, nil
+		}
+
+		if flags&linux.MSG_DONTWAIT != 0 {
+			return nil, nil, socket.ControlMessages{}, 0, socket.ErrWouldBlock
+		}
+
+		if err := waiter.Wait(ctx, s, waiter.EventIn); err != nil {
+			return nil, nil, socket.ControlMessages{}, 0, err
+		}
+	}
+}
+
+// SockName returns the port the socket is bound to, which is 0 until it's
+// bound.
+func (s *sock) SockName() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return formatAddress(s.port, s.groups), nil
+}
+
+// PeerName returns the kernel's address, where sends go.
+func (s *sock) PeerName() ([]byte, error) {
+	return formatAddress(0, 0), nil
+}
+
+func boolOpt(b bool) int32 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+func (s *sock) GetSockOpt(level, name int) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch level {
+	case linux.SOL_SOCKET:
+		switch name {
+		case linux.SO_TYPE:
+			return int32(s.typ), nil
+		case linux.SO_DOMAIN:
+			return int32(linux.AF_NETLINK), nil
+		case linux.SO_PROTOCOL:
+			return int32(linux.NETLINK_ROUTE), nil
+		case linux.SO_ERROR:
+			return int32(0), nil
+		case linux.SO_PASSCRED:
+			return boolOpt(s.passcred), nil
+		case linux.SO_SNDBUF, linux.SO_RCVBUF:
+			return int32(bufferSize), nil
+		}
+	case linux.SOL_NETLINK:
+		switch name {
+		case linux.NETLINK_PKTINFO, linux.NETLINK_BROADCAST_ERROR, linux.NETLINK_NO_ENOBUFS,
+			linux.NETLINK_LISTEN_ALL_NSID, linux.NETLINK_CAP_ACK, linux.NETLINK_EXT_ACK,
+			linux.NETLINK_DUMP_STRICT_CHK:
+			return boolOpt(s.options[name]), nil
+		}
+	}
+
+	return nil, socket.ErrNoProtocolOption
+}
+
+func (s *sock) SetSockOpt(level, name int, val []byte) error {
+	if len(val) < 4 {
+		return fs.ErrInvalid
+	}
+
+	v := binary.LittleEndian.Uint32(val)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch level {
+	case linux.SOL_SOCKET:
+		switch name {
+		case linux.SO_PASSCRED:
+			s.passcred = v != 0
+		case linux.SO_SNDBUF, linux.SO_RCVBUF, linux.SO_SNDBUFFORCE, linux.SO_RCVBUFFORCE:
+			// Accepted, but the buffers stay the same size.
+		default:
+			return socket.ErrNoProtocolOption
+		}
+
+		return nil
+	case linux.SOL_NETLINK:
+		switch name {
+		case linux.NETLINK_ADD_MEMBERSHIP, linux.NETLINK_DROP_MEMBERSHIP:
+			// Joining is remembered in the groups getsockname(2)
+			// shows, but nothing is ever sent to them.
+			if v == 0 {
+				return fs.ErrInvalid
+			}
+
+			if v <= 32 {
+				bit := uint32(1) << (v - 1)
+
+				if name == linux.NETLINK_ADD_MEMBERSHIP {
+					s.groups |= bit
+				} else {
+					s.groups &^= bit
+				}
+			}
+
+			return nil
+		case linux.NETLINK_PKTINFO, linux.NETLINK_BROADCAST_ERROR, linux.NETLINK_NO_ENOBUFS,
+			linux.NETLINK_LISTEN_ALL_NSID, linux.NETLINK_CAP_ACK, linux.NETLINK_EXT_ACK,
+			linux.NETLINK_DUMP_STRICT_CHK:
+			if s.options == nil {
+				s.options = make(map[int]bool)
+			}
+
+			s.options[name] = v != 0
+
+			return nil
+		}
+	}
+
+	return socket.ErrNoProtocolOption
+}
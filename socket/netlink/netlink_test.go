@@ -0,0 +1,335 @@
+package netlink_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/socket"
+	_ "github.com/evanphx/columbia/socket/netlink"
+	"github.com/stretchr/testify/require"
+)
+
+type reply struct {
+	hdr     linux.NetlinkMessageHeader
+	payload []byte
+}
+
+// request builds a netlink message of typ, with body and then attrs.
+func request(typ, flags uint16, seq uint32, body interface{}, attrs ...[]byte) []byte {
+	var buf bytes.Buffer
+
+	binary.Write(&buf, binary.LittleEndian, linux.NetlinkMessageHeader{
+		Type:  typ,
+		Flags: flags | linux.NLM_F_REQUEST,
+		Seq:   seq,
+	})
+
+	binary.Write(&buf, binary.LittleEndian, body)
+
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+
+	for _, a := range attrs {
+		buf.Write(a)
+	}
+
+	b := buf.Bytes()
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+
+	return b
+}
+
+func attr(typ uint16, payload []byte) []byte {
+	b := make([]byte, 4, 4+len(payload)+3)
+	binary.LittleEndian.PutUint16(b, uint16(4+len(payload)))
+	binary.LittleEndian.PutUint16(b[2:], typ)
+
+	b = append(b, payload...)
+
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+
+	return b
+}
+
+func parseReplies(t *testing.T, data []byte) []reply {
+	var replies []reply
+
+	for len(data) > 0 {
+		var r reply
+
+		require.NoError(t, binary.Read(bytes.NewReader(data), binary.LittleEndian, &r.hdr))
+		require.True(t, int(r.hdr.Length) <= len(data))
+
+		r.payload = data[linux.NetlinkMessageHeaderSize:r.hdr.Length]
+		replies = append(replies, r)
+
+		next := (int(r.hdr.Length) + 3) &^ 3
+		if next >= len(data) {
+			break
+		}
+
+		data = data[next:]
+	}
+
+	return replies
+}
+
+// attrs returns the attributes following a fixed header of size bytes.
+func attrs(payload []byte, size int) map[uint16][]byte {
+	m := map[uint16][]byte{}
+	b := payload[size:]
+
+	for len(b) >= 4 {
+		l := int(binary.LittleEndian.Uint16(b))
+		m[binary.LittleEndian.Uint16(b[2:])] = b[4:l]
+
+		if (l+3)&^3 >= len(b) {
+			break
+		}
+
+		b = b[(l+3)&^3:]
+	}
+
+	return m
+}
+
+func errorOf(t *testing.T, r reply) int32 {
+	require.Equal(t, uint16(linux.NLMSG_ERROR), r.hdr.Type)
+
+	return int32(binary.LittleEndian.Uint32(r.payload))
+}
+
+func TestNetlink(t *testing.T) {
+	k, err := kernel.NewKernel(nil)
+	require.NoError(t, err)
+
+	eth0 := k.Network().AddNIC("eth0", net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		net.IPNet{IP: net.IPv4(10, 0, 0, 2).To4(), Mask: net.CIDRMask(24, 32)})
+
+	proc := k.NewProcess("/")
+	ctx := kernel.SetTask(context.Background(), &kernel.Task{Process: proc})
+
+	newSocket := func(t *testing.T) socket.Socket {
+		s, err := socket.New(ctx, linux.AF_NETLINK, linux.SOCK_RAW, linux.NETLINK_ROUTE)
+		require.NoError(t, err)
+
+		t.Cleanup(func() { s.Close() })
+
+		return s
+	}
+
+	// roundTrip sends req and receives the replies up to NLMSG_DONE for a
+	// dump, or the first datagram otherwise.
+	roundTrip := func(t *testing.T, s socket.Socket, req []byte) []reply {
+		_, err := s.SendMsg(ctx, req, nil, socket.ControlMessages{}, 0)
+		require.NoError(t, err)
+
+		var replies []reply
+
+		for {
+			data, _, _, _, err := s.RecvMsg(ctx, 8192, linux.MSG_DONTWAIT)
+			require.NoError(t, err)
+
+			rs := parseReplies(t, data)
+			replies = append(replies, rs...)
+
+			last := rs[len(rs)-1]
+			if last.hdr.Flags&linux.NLM_F_MULTI == 0 || last.hdr.Type == linux.NLMSG_DONE {
+				return replies
+			}
+		}
+	}
+
+	t.Run("only does NETLINK_ROUTE", func(t *testing.T) {
+		_, err := socket.New(ctx, linux.AF_NETLINK, linux.SOCK_STREAM, linux.NETLINK_ROUTE)
+		require.Equal(t, socket.ErrTypeNotSupported, err)
+
+		_, err = socket.New(ctx, linux.AF_NETLINK, linux.SOCK_RAW, linux.NETLINK_AUDIT)
+		require.Equal(t, socket.ErrProtocolNotSupported, err)
+	})
+
+	t.Run("dumps the links", func(t *testing.T) {
+		s := newSocket(t)
+
+		replies := roundTrip(t, s, request(linux.RTM_GETLINK, linux.NLM_F_DUMP, 7, linux.InterfaceInfoMessage{}))
+		require.Len(t, replies, 3)
+		require.Equal(t, uint16(linux.NLMSG_DONE), replies[2].hdr.Type)
+
+		var names []string
+
+		for _, r := range replies[:2] {
+			require.Equal(t, uint16(linux.RTM_NEWLINK), r.hdr.Type)
+			require.Equal(t, uint32(7), r.hdr.Seq)
+
+			a := attrs(r.payload, binary.Size(linux.InterfaceInfoMessage{}))
+			names = append(names, string(bytes.TrimRight(a[linux.IFLA_IFNAME], "\x00")))
+		}
+
+		require.Equal(t, []string{"lo", "eth0"}, names)
+
+		a := attrs(replies[1].payload, binary.Size(linux.InterfaceInfoMessage{}))
+		require.Equal(t, []byte(eth0.HardwareAddr), a[linux.IFLA_ADDRESS])
+
+		name, err := s.SockName()
+		require.NoError(t, err)
+		require.Equal(t, uint32(proc.Pid), binary.LittleEndian.Uint32(name[4:]))
+		require.Equal(t, uint32(proc.Pid), replies[0].hdr.PortID)
+	})
+
+	t.Run("gets a link by name", func(t *testing.T) {
+		s := newSocket(t)
+
+		replies := roundTrip(t, s, request(linux.RTM_GETLINK, 0, 1, linux.InterfaceInfoMessage{},
+			attr(linux.IFLA_IFNAME, []byte("eth0\x00"))))
+		require.Len(t, replies, 1)
+		require.Equal(t, uint16(linux.RTM_NEWLINK), replies[0].hdr.Type)
+		require.Equal(t, int32(eth0.Index), int32(binary.LittleEndian.Uint32(replies[0].payload[4:])))
+
+		replies = roundTrip(t, s, request(linux.RTM_GETLINK, 0, 2, linux.InterfaceInfoMessage{Index: 99}))
+		require.Equal(t, -int32(abi.ENODEV), errorOf(t, replies[0]))
+	})
+
+	t.Run("dumps addresses by family", func(t *testing.T) {
+		s := newSocket(t)
+
+		replies := roundTrip(t, s, request(linux.RTM_GETADDR, linux.NLM_F_DUMP, 1, linux.InterfaceAddrMessage{Family: linux.AF_INET}))
+
+		var addrs []string
+
+		for _, r := range replies[:len(replies)-1] {
+			require.Equal(t, uint8(linux.AF_INET), r.payload[0])
+
+			a := attrs(r.payload, binary.Size(linux.InterfaceAddrMessage{}))
+			addrs = append(addrs, net.IP(a[linux.IFA_LOCAL]).String())
+		}
+
+		require.Equal(t, []string{"127.0.0.1", "10.0.0.2"}, addrs)
+
+		eth := attrs(replies[1].payload, binary.Size(linux.InterfaceAddrMessage{}))
+		require.Equal(t, net.IPv4(10, 0, 0, 255).To4(), net.IP(eth[linux.IFA_BROADCAST]))
+	})
+
+	t.Run("adds addresses and routes", func(t *testing.T) {
+		s := newSocket(t)
+
+		add := request(linux.RTM_NEWADDR, linux.NLM_F_ACK|linux.NLM_F_CREATE|linux.NLM_F_EXCL, 1,
+			linux.InterfaceAddrMessage{Family: linux.AF_INET, PrefixLen: 16, Index: uint32(eth0.Index)},
+			attr(linux.IFA_LOCAL, []byte{192, 168, 0, 5}))
+
+		replies := roundTrip(t, s, add)
+		require.Len(t, replies, 1)
+		require.Equal(t, int32(0), errorOf(t, replies[0]))
+
+		replies = roundTrip(t, s, add)
+		require.Equal(t, -int32(abi.EEXIST), errorOf(t, replies[0]))
+		require.Equal(t, add, replies[0].payload[4:])
+
+		route := request(linux.RTM_NEWROUTE, linux.NLM_F_ACK|linux.NLM_F_CREATE|linux.NLM_F_EXCL, 2,
+			linux.RouteMessage{Family: linux.AF_INET, Table: linux.RT_TABLE_MAIN, Type: linux.RTN_UNICAST},
+			attr(linux.RTA_GATEWAY, []byte{10, 0, 0, 1}))
+
+		replies = roundTrip(t, s, route)
+		require.Equal(t, int32(0), errorOf(t, replies[0]))
+
+		replies = roundTrip(t, s, request(linux.RTM_NEWROUTE, linux.NLM_F_ACK, 3,
+			linux.RouteMessage{Family: linux.AF_INET, DstLen: 8, Table: linux.RT_TABLE_MAIN, Type: linux.RTN_UNICAST},
+			attr(linux.RTA_DST, []byte{172, 0, 0, 0}), attr(linux.RTA_GATEWAY, []byte{8, 8, 8, 8})))
+		require.Equal(t, -int32(abi.ENETUNREACH), errorOf(t, replies[0]))
+
+		replies = roundTrip(t, s, request(linux.RTM_GETROUTE, linux.NLM_F_DUMP, 4, linux.RouteMessage{Family: linux.AF_INET}))
+		require.Len(t, replies, 4)
+
+		def := attrs(replies[2].payload, binary.Size(linux.RouteMessage{}))
+		require.Equal(t, uint8(0), replies[2].payload[1])
+		require.Equal(t, []byte{10, 0, 0, 1}, def[linux.RTA_GATEWAY])
+		require.Equal(t, u32(uint32(eth0.Index)), def[linux.RTA_OIF])
+	})
+
+	t.Run("needs CAP_NET_ADMIN to change the stack", func(t *testing.T) {
+		s := newSocket(t)
+
+		add := request(linux.RTM_NEWADDR, linux.NLM_F_ACK|linux.NLM_F_CREATE, 1,
+			linux.InterfaceAddrMessage{Family: linux.AF_INET, PrefixLen: 24, Index: uint32(eth0.Index)},
+			attr(linux.IFA_LOCAL, []byte{192, 168, 7, 5}))
+
+		route := request(linux.RTM_NEWROUTE, linux.NLM_F_ACK|linux.NLM_F_CREATE, 2,
+			linux.RouteMessage{Family: linux.AF_INET, DstLen: 24, Table: linux.RT_TABLE_MAIN, Type: linux.RTN_UNICAST},
+			attr(linux.RTA_DST, []byte{172, 16, 9, 9}), attr(linux.RTA_GATEWAY, []byte{10, 0, 0, 1}))
+
+		ack := func(t *testing.T, ctx context.Context, req []byte) int32 {
+			_, err := s.SendMsg(ctx, req, nil, socket.ControlMessages{}, 0)
+			require.NoError(t, err)
+
+			data, _, _, _, err := s.RecvMsg(ctx, 8192, linux.MSG_DONTWAIT)
+			require.NoError(t, err)
+
+			return errorOf(t, parseReplies(t, data)[0])
+		}
+
+		root := auth.ContextWithCredentials(ctx, auth.New(0, 0))
+		require.Equal(t, -int32(abi.EPERM), ack(t, root, add))
+		require.Equal(t, -int32(abi.EPERM), ack(t, root, route))
+
+		creds := auth.New(0, 0)
+		creds.EffectiveCaps |= auth.CapabilitySetOf(linux.CAP_NET_ADMIN)
+
+		admin := auth.ContextWithCredentials(ctx, creds)
+		require.Equal(t, int32(0), ack(t, admin, add))
+		require.Equal(t, int32(0), ack(t, admin, route))
+
+		// The host bits of the destination are dropped.
+		var dsts [][]byte
+
+		for _, r := range roundTrip(t, s, request(linux.RTM_GETROUTE, linux.NLM_F_DUMP, 3, linux.RouteMessage{Family: linux.AF_INET})) {
+			if r.hdr.Type == linux.RTM_NEWROUTE {
+				dsts = append(dsts, attrs(r.payload, binary.Size(linux.RouteMessage{}))[linux.RTA_DST])
+			}
+		}
+
+		require.Contains(t, dsts, []byte{172, 16, 9, 0})
+	})
+
+	t.Run("peeks at the length of a reply", func(t *testing.T) {
+		s := newSocket(t)
+
+		_, err := s.SendMsg(ctx, request(linux.RTM_GETLINK, linux.NLM_F_DUMP, 1, linux.InterfaceInfoMessage{}), nil, socket.ControlMessages{}, 0)
+		require.NoError(t, err)
+
+		data, _, _, msgFlags, err := s.RecvMsg(ctx, 0, linux.MSG_PEEK|linux.MSG_TRUNC)
+		require.NoError(t, err)
+		require.Equal(t, linux.MSG_TRUNC, msgFlags)
+
+		full, _, _, msgFlags, err := s.RecvMsg(ctx, len(data), 0)
+		require.NoError(t, err)
+		require.Equal(t, 0, msgFlags)
+		require.Equal(t, data, full)
+	})
+
+	t.Run("only sends to the kernel", func(t *testing.T) {
+		s := newSocket(t)
+
+		to := make([]byte, linux.SockAddrNetlinkSize)
+		binary.LittleEndian.PutUint16(to, linux.AF_NETLINK)
+		binary.LittleEndian.PutUint32(to[4:], 1234)
+
+		_, err := s.SendMsg(ctx, request(linux.RTM_GETLINK, linux.NLM_F_DUMP, 1, linux.InterfaceInfoMessage{}), to, socket.ControlMessages{}, 0)
+		require.Equal(t, socket.ErrConnectionRefused, err)
+	})
+}
@@ -0,0 +1,404 @@
+package netlink
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/netstack"
+	"github.com/evanphx/columbia/socket"
+)
+
+// txQueueLen is the txqueuelen Linux gives an interface.
+const txQueueLen = 1000
+
+// handleRoute handles a NETLINK_ROUTE request on stack for the sender
+// acting with ctx. It returns the replies, and whether they're a dump,
+// which is answered even when it's empty.
+func handleRoute(ctx context.Context, stack *netstack.Stack, req request) ([]*message, bool, error) {
+	dump := req.hdr.Flags&linux.NLM_F_DUMP != 0
+
+	switch req.hdr.Type {
+	case linux.RTM_GETLINK:
+		if dump {
+			return dumpLinks(stack), true, nil
+		}
+
+		m, err := getLink(stack, req)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return []*message{m}, false, nil
+	case linux.RTM_GETADDR:
+		if !dump {
+			return nil, false, socket.ErrNotSupported
+		}
+
+		return dumpAddrs(stack, requestFamily(req)), true, nil
+	case linux.RTM_GETROUTE:
+		if !dump {
+			return nil, false, socket.ErrNotSupported
+		}
+
+		return dumpRoutes(stack, requestFamily(req)), true, nil
+	case linux.RTM_NEWADDR:
+		if !netAdmin(ctx) {
+			return nil, false, socket.ErrPermission
+		}
+
+		return nil, false, newAddr(stack, req)
+	case linux.RTM_NEWROUTE:
+		if !netAdmin(ctx) {
+			return nil, false, socket.ErrPermission
+		}
+
+		return nil, false, newRoute(stack, req)
+	}
+
+	return nil, false, socket.ErrNotSupported
+}
+
+// netAdmin reports whether ctx may change the stack, which takes
+// CAP_NET_ADMIN. A context without credentials is the kernel's own.
+func netAdmin(ctx context.Context) bool {
+	creds, ok := auth.CredentialsFromContext(ctx)
+	return !ok || creds.HasCapability(linux.CAP_NET_ADMIN)
+}
+
+// requestFamily returns the family a dump is for, which is the first byte
+// of ifinfomsg, ifaddrmsg and rtmsg alike, and all a struct rtgenmsg has.
+func requestFamily(req request) uint8 {
+	if len(req.payload) == 0 {
+		return linux.AF_UNSPEC
+	}
+
+	return req.payload[0]
+}
+
+// ipFamily is the address family of ip.
+func ipFamily(ip net.IP) uint8 {
+	if ip.To4() != nil {
+		return linux.AF_INET
+	}
+
+	return linux.AF_INET6
+}
+
+// ipBytes is ip as netlink has it: 4 bytes for IPv4, 16 for IPv6.
+func ipBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip.To16()
+}
+
+// parseIP parses an address attribute of family.
+func parseIP(family uint8, b []byte) (net.IP, bool) {
+	switch {
+	case family == linux.AF_INET && len(b) == net.IPv4len:
+		return net.IPv4(b[0], b[1], b[2], b[3]), true
+	case family == linux.AF_INET6 && len(b) == net.IPv6len:
+		return net.IP(append([]byte(nil), b...)), true
+	}
+
+	return nil, false
+}
+
+func bitsOf(family uint8) int {
+	if family == linux.AF_INET {
+		return 8 * net.IPv4len
+	}
+
+	return 8 * net.IPv6len
+}
+
+func linkMessage(nic netstack.NIC) *message {
+	m := newMessage(linux.NetlinkMessageHeader{Type: linux.RTM_NEWLINK})
+
+	info := linux.InterfaceInfoMessage{
+		Family: linux.AF_UNSPEC,
+		Index:  int32(nic.Index),
+		Flags:  linux.IFF_UP | linux.IFF_RUNNING | linux.IFF_LOWER_UP,
+	}
+
+	hw := make([]byte, 6)
+	broadcast := make([]byte, 6)
+	operstate := uint8(linux.IF_OPER_UP)
+
+	if nic.Loopback {
+		info.Type = linux.ARPHRD_LOOPBACK
+		info.Flags |= linux.IFF_LOOPBACK
+		operstate = linux.IF_OPER_UNKNOWN
+	} else {
+		info.Type = linux.ARPHRD_ETHER
+		info.Flags |= linux.IFF_BROADCAST | linux.IFF_MULTICAST
+
+		copy(hw, nic.HardwareAddr)
+
+		for i := range broadcast {
+			broadcast[i] = 0xff
+		}
+	}
+
+	m.put(info)
+	m.putAttr(linux.IFLA_IFNAME, nic.Name)
+	m.putAttr(linux.IFLA_MTU, uint32(nic.MTU))
+	m.putAttr(linux.IFLA_TXQLEN, uint32(txQueueLen))
+	m.putAttr(linux.IFLA_OPERSTATE, operstate)
+	m.putAttr(linux.IFLA_ADDRESS, hw)
+	m.putAttr(linux.IFLA_BROADCAST, broadcast)
+
+	return m
+}
+
+func dumpLinks(stack *netstack.Stack) []*message {
+	var msgs []*message
+
+	for _, nic := range stack.NICs() {
+		msgs = append(msgs, linkMessage(nic))
+	}
+
+	return msgs
+}
+
+// getLink answers a request for one link, by its index or IFLA_IFNAME.
+func getLink(stack *netstack.Stack, req request) (*message, error) {
+	var info linux.InterfaceInfoMessage
+
+	rest, ok := req.decode(&info)
+	if !ok {
+		return nil, fs.ErrInvalid
+	}
+
+	name := ""
+
+	if b, ok := parseAttrs(rest)[linux.IFLA_IFNAME]; ok {
+		if i := bytes.IndexByte(b, 0); i != -1 {
+			b = b[:i]
+		}
+
+		name = string(b)
+	}
+
+	for _, nic := range stack.NICs() {
+		if (info.Index > 0 && nic.Index == int(info.Index)) || (info.Index == 0 && name != "" && nic.Name == name) {
+			return linkMessage(nic), nil
+		}
+	}
+
+	return nil, netstack.ErrNoInterface
+}
+
+func dumpAddrs(stack *netstack.Stack, family uint8) []*message {
+	var msgs []*message
+
+	for _, nic := range stack.NICs() {
+		for _, a := range nic.Addrs {
+			f := ipFamily(a.IP)
+			if family != linux.AF_UNSPEC && family != f {
+				continue
+			}
+
+			ones, bits := a.Mask.Size()
+
+			scope := uint8(linux.RT_SCOPE_UNIVERSE)
+
+			switch {
+			case a.IP.IsLoopback():
+				scope = linux.RT_SCOPE_HOST
+			case a.IP.IsLinkLocalUnicast():
+				scope = linux.RT_SCOPE_LINK
+			}
+
+			m := newMessage(linux.NetlinkMessageHeader{Type: linux.RTM_NEWADDR})
+
+			m.put(linux.InterfaceAddrMessage{
+				Family:    f,
+				PrefixLen: uint8(ones),
+				Flags:     linux.IFA_F_PERMANENT,
+				Scope:     scope,
+				Index:     uint32(nic.Index),
+			})
+
+			m.putAttr(linux.IFA_ADDRESS, ipBytes(a.IP))
+
+			if f == linux.AF_INET {
+				m.putAttr(linux.IFA_LOCAL, ipBytes(a.IP))
+
+				if !nic.Loopback && ones < bits-1 {
+					ip := ipBytes(a.IP)
+					broadcast := make([]byte, len(ip))
+
+					for i := range ip {
+						broadcast[i] = ip[i] | ^a.Mask[len(a.Mask)-len(ip)+i]
+					}
+
+					m.putAttr(linux.IFA_BROADCAST, broadcast)
+				}
+
+				m.putAttr(linux.IFA_LABEL, nic.Name)
+			}
+
+			m.putAttr(linux.IFA_FLAGS, uint32(linux.IFA_F_PERMANENT))
+
+			msgs = append(msgs, m)
+		}
+	}
+
+	return msgs
+}
+
+// dumpRoutes lists the main table, as ip route shows it.
+func dumpRoutes(stack *netstack.Stack, family uint8) []*message {
+	var msgs []*message
+
+	for _, r := range stack.Routes() {
+		f := ipFamily(r.Destination.IP)
+		if family != linux.AF_UNSPEC && family != f {
+			continue
+		}
+
+		ones, _ := r.Destination.Mask.Size()
+
+		rtm := linux.RouteMessage{
+			Family:   f,
+			DstLen:   uint8(ones),
+			Table:    linux.RT_TABLE_MAIN,
+			Protocol: linux.RTPROT_BOOT,
+			Scope:    linux.RT_SCOPE_UNIVERSE,
+			Type:     linux.RTN_UNICAST,
+		}
+
+		switch {
+		case r.Source != nil:
+			rtm.Protocol = linux.RTPROT_KERNEL
+			rtm.Scope = linux.RT_SCOPE_LINK
+		case r.Gateway == nil:
+			rtm.Scope = linux.RT_SCOPE_LINK
+		}
+
+		m := newMessage(linux.NetlinkMessageHeader{Type: linux.RTM_NEWROUTE})
+
+		m.put(rtm)
+		m.putAttr(linux.RTA_TABLE, uint32(linux.RT_TABLE_MAIN))
+
+		if ones > 0 {
+			m.putAttr(linux.RTA_DST, ipBytes(r.Destination.IP))
+		}
+
+		if r.Source != nil && f == linux.AF_INET {
+			m.putAttr(linux.RTA_PREFSRC, ipBytes(r.Source))
+		}
+
+		if r.Gateway != nil {
+			m.putAttr(linux.RTA_GATEWAY, ipBytes(r.Gateway))
+		}
+
+		m.putAttr(linux.RTA_OIF, uint32(r.NIC))
+
+		msgs = append(msgs, m)
+	}
+
+	return msgs
+}
+
+// newAddr assigns the address of an RTM_NEWADDR, given by IFA_LOCAL or
+// else IFA_ADDRESS. An address the interface has already is only an
+// error with NLM_F_EXCL, as on Linux.
+func newAddr(stack *netstack.Stack, req request) error {
+	var ifa linux.InterfaceAddrMessage
+
+	rest, ok := req.decode(&ifa)
+	if !ok || (ifa.Family != linux.AF_INET && ifa.Family != linux.AF_INET6) {
+		return fs.ErrInvalid
+	}
+
+	attrs := parseAttrs(rest)
+
+	b, ok := attrs[linux.IFA_LOCAL]
+	if !ok {
+		b = attrs[linux.IFA_ADDRESS]
+	}
+
+	ip, ok := parseIP(ifa.Family, b)
+	if !ok || int(ifa.PrefixLen) > bitsOf(ifa.Family) {
+		return fs.ErrInvalid
+	}
+
+	err := stack.AddAddress(int(ifa.Index), net.IPNet{
+		IP:   ip,
+		Mask: net.CIDRMask(int(ifa.PrefixLen), bitsOf(ifa.Family)),
+	})
+
+	if err == netstack.ErrExists && req.hdr.Flags&linux.NLM_F_EXCL == 0 {
+		return nil
+	}
+
+	return err
+}
+
+// newRoute adds the route of an RTM_NEWROUTE to the main table, replacing
+// one to the same destination with NLM_F_REPLACE.
+func newRoute(stack *netstack.Stack, req request) error {
+	var rtm linux.RouteMessage
+
+	rest, ok := req.decode(&rtm)
+	if !ok || (rtm.Family != linux.AF_INET && rtm.Family != linux.AF_INET6) {
+		return fs.ErrInvalid
+	}
+
+	if rtm.Table != linux.RT_TABLE_MAIN && rtm.Table != linux.RT_TABLE_UNSPEC {
+		return socket.ErrNotSupported
+	}
+
+	if rtm.Type != linux.RTN_UNICAST || int(rtm.DstLen) > bitsOf(rtm.Family) {
+		return socket.ErrNotSupported
+	}
+
+	attrs := parseAttrs(rest)
+
+	r := netstack.Route{
+		Destination: net.IPNet{
+			IP:   net.IPv4zero,
+			Mask: net.CIDRMask(int(rtm.DstLen), bitsOf(rtm.Family)),
+		},
+	}
+
+	if rtm.Family == linux.AF_INET6 {
+		r.Destination.IP = net.IPv6unspecified
+	}
+
+	if b, ok := attrs[linux.RTA_DST]; ok {
+		if r.Destination.IP, ok = parseIP(rtm.Family, b); !ok {
+			return fs.ErrInvalid
+		}
+	}
+
+	if rtm.Family == linux.AF_INET {
+		r.Destination.IP = r.Destination.IP.To4()
+	}
+
+	r.Destination.IP = r.Destination.IP.Mask(r.Destination.Mask)
+
+	if b, ok := attrs[linux.RTA_GATEWAY]; ok {
+		if r.Gateway, ok = parseIP(rtm.Family, b); !ok {
+			return fs.ErrInvalid
+		}
+	}
+
+	if b, ok := attrs[linux.RTA_OIF]; ok {
+		if len(b) != 4 {
+			return fs.ErrInvalid
+		}
+
+		r.NIC = int(binary.LittleEndian.Uint32(b))
+	}
+
+	return stack.AddRoute(r, req.hdr.Flags&linux.NLM_F_REPLACE != 0)
+}
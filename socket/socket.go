@@ -0,0 +1,239 @@
+// Package socket holds what the socket families have in common: the
+// interface the syscalls drive them through, the errors they return and the
+// registry that socket(2) finds them in.
+package socket
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/device"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/pkg/waiter"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrWouldBlock           = errors.New("operation would block")
+	ErrNotConnected         = errors.New("socket is not connected")
+	ErrIsConnected          = errors.New("socket is already connected")
+	ErrConnectionRefused    = errors.New("connection refused")
+	ErrConnectionReset      = errors.New("connection reset by peer")
+	ErrNetworkUnreachable   = errors.New("network is unreachable")
+	ErrHostUnreachable      = errors.New("no route to host")
+	ErrAddressInUse         = errors.New("address already in use")
+	ErrAddressNotAvailable  = errors.New("cannot assign requested address")
+	ErrBrokenPipe           = errors.New("broken pipe")
+	ErrMessageSize          = errors.New("message too long")
+	ErrDestinationRequired  = errors.New("destination address required")
+	ErrNotSupported         = errors.New("operation not supported")
+	ErrFamilyNotSupported   = errors.New("address family not supported")
+	ErrTypeNotSupported     = errors.New("socket type not supported")
+	ErrProtocolNotSupported = errors.New("protocol not supported")
+	ErrNoProtocolOption     = errors.New("protocol not available")
+	ErrPermission           = errors.New("operation not permitted")
+	ErrWrongType            = errors.New("protocol wrong type for socket")
+	ErrInProgress           = errors.New("operation now in progress")
+	ErrAlreadyInProgress    = errors.New("operation already in progress")
+	ErrAccessDenied         = errors.New("permission denied")
+	ErrTimedOut             = errors.New("connection timed out")
+	ErrNoBufferSpace        = errors.New("no buffer space available")
+)
+
+// ControlMessages is the ancillary data of a message.
+type ControlMessages struct {
+	// Rights are the files of SCM_RIGHTS. Each holds a reference that
+	// whoever ends up with the message must install or close.
+	Rights []*kernel.File
+
+	// Credentials are those of SCM_CREDENTIALS.
+	Credentials *linux.ControlMessageCredentials
+}
+
+// Release closes the files of cm, for when they won't be delivered.
+func (cm *ControlMessages) Release() {
+	for _, f := range cm.Rights {
+		f.Close()
+	}
+
+	cm.Rights = nil
+}
+
+// Socket is an open socket. Addresses are passed as the sockaddr of the
+// family, as the guest gave them or will see them. Calls that can block
+// give up with fs.ErrInterrupted when ctx is done, and fail with
+// ErrWouldBlock instead if they're nonblocking, which for sends and
+// receives is given by MSG_DONTWAIT.
+type Socket interface {
+	waiter.Waitable
+	io.Closer
+
+	Bind(ctx context.Context, addr []byte) error
+	Listen(backlog int) error
+	Accept(ctx context.Context, nonblock bool) (Socket, error)
+	Connect(ctx context.Context, addr []byte, nonblock bool) error
+	Shutdown(how int) error
+
+	// SendMsg sends data to the connected peer, or to addr if it's set.
+	// The socket takes over the references to the files in cm.
+	SendMsg(ctx context.Context, data, addr []byte, cm ControlMessages, flags int) (int, error)
+
+	// RecvMsg receives up to size bytes, returning the address of the
+	// sender and the MSG_ flags that describe the result, like
+	// MSG_TRUNC.
+	RecvMsg(ctx context.Context, size int, flags int) (data, addr []byte, cm ControlMessages, msgFlags int, err error)
+
+	SockName() ([]byte, error)
+	PeerName() ([]byte, error)
+
+	// GetSockOpt returns the value of an option, as a value for
+	// encoding/binary to write out.
+	GetSockOpt(level, name int) (interface{}, error)
+	SetSockOpt(level, name int, val []byte) error
+}
+
+// Family creates the sockets of an address family.
+type Family interface {
+	Socket(ctx context.Context, typ, protocol int) (Socket, error)
+
+	// Pair returns two sockets connected to each other, for
+	// socketpair(2). Families that can't fail with ErrNotSupported.
+	Pair(ctx context.Context, typ, protocol int) (Socket, Socket, error)
+}
+
+var (
+	familiesMu sync.Mutex
+	families   = map[int]Family{}
+)
+
+// RegisterFamily makes the sockets of family available to socket(2).
+func RegisterFamily(family int, f Family) {
+	familiesMu.Lock()
+	defer familiesMu.Unlock()
+
+	families[family] = f
+}
+
+func lookupFamily(family int) (Family, error) {
+	familiesMu.Lock()
+	defer familiesMu.Unlock()
+
+	f, ok := families[family]
+	if !ok {
+		return nil, ErrFamilyNotSupported
+	}
+
+	return f, nil
+}
+
+// New creates a socket, as socket(2) does.
+func New(ctx context.Context, family, typ, protocol int) (Socket, error) {
+	f, err := lookupFamily(family)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Socket(ctx, typ, protocol)
+}
+
+// NewPair creates a pair of connected sockets, as socketpair(2) does.
+func NewPair(ctx context.Context, family, typ, protocol int) (Socket, Socket, error) {
+	f, err := lookupFamily(family)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f.Pair(ctx, typ, protocol)
+}
+
+// socketDevice holds the inodes of open sockets, which aren't on any
+// filesystem.
+var socketDevice = device.NewAnonDevice()
+
+// NewFile returns a file for s, named like a Linux socket in
+// /proc/[pid]/fd.
+func NewFile(s Socket) *kernel.File {
+	inode := fs.NewInode(fs.InodeStableAttr{
+		Type:            fs.Socket,
+		DeviceID:        socketDevice.DeviceID(),
+		InodeID:         socketDevice.NextIno(),
+		BlockSize:       4096,
+		DeviceFileMajor: uint16(socketDevice.Major),
+		DeviceFileMinor: uint32(socketDevice.Minor),
+	}, &inodeOps{created: linux.TimeToTimespec(time.Now())})
+
+	name := fmt.Sprintf("socket:[%d]", inode.StableAttr.InodeID)
+
+	return kernel.NewFile(&fs.Dirent{Name: name, Inode: inode}, &handle{s})
+}
+
+// inodeOps is the inode of an open socket. It can't be opened again, as
+// through /proc/[pid]/fd.
+type inodeOps struct {
+	fs.StandardFileOps
+
+	created linux.Timespec
+}
+
+func (i *inodeOps) UnstableAttr(ctx context.Context, inode *fs.Inode) (*fs.InodeUnstableAttr, error) {
+	return &fs.InodeUnstableAttr{
+		Perms:            0777,
+		AccessTime:       i.created,
+		ModificationTime: i.created,
+		StatusChangeTime: i.created,
+		Links:            1,
+	}, nil
+}
+
+func (i *inodeOps) ReadLink(ctx context.Context, inode *fs.Inode) (string, error) {
+	return "", fs.ErrNotSymlink
+}
+
+func (i *inodeOps) Reader(inode *fs.Inode) (io.ReadSeeker, error) {
+	return nil, fs.ErrNoDevice
+}
+
+func (i *inodeOps) Writer(inode *fs.Inode) (io.WriteSeeker, error) {
+	return nil, fs.ErrNoDevice
+}
+
+// handle is the handle of a socket's file. read(2) and write(2) on a socket
+// go through FromFile instead, which gives them a context; handle is only
+// for when the file is used as a plain stream.
+type handle struct {
+	Socket
+}
+
+func (h *handle) Read(b []byte) (int, error) {
+	data, _, cm, _, err := h.RecvMsg(context.Background(), len(b), 0)
+	cm.Release()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(data) == 0 && len(b) > 0 {
+		return 0, io.EOF
+	}
+
+	return copy(b, data), nil
+}
+
+func (h *handle) Write(b []byte) (int, error) {
+	return h.SendMsg(context.Background(), b, nil, ControlMessages{}, 0)
+}
+
+// FromFile returns the socket f was created for, if it was.
+func FromFile(f *kernel.File) (Socket, bool) {
+	h, ok := f.Handle().(*handle)
+	if !ok {
+		return nil, false
+	}
+
+	return h.Socket, true
+}
@@ -0,0 +1,265 @@
+package unix
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/socket"
+	"github.com/pkg/errors"
+)
+
+// address is a parsed sockaddr_un. An abstract address has no file, and
+// its name may hold any bytes.
+type address struct {
+	name     string
+	abstract bool
+}
+
+// parseAddress parses a sockaddr_un. It returns nil for an unnamed
+// address, which is just the family.
+func parseAddress(addr []byte) (*address, error) {
+	if len(addr) < 2 || binary.LittleEndian.Uint16(addr) != linux.AF_UNIX {
+		return nil, fs.ErrInvalid
+	}
+
+	path := addr[2:]
+
+	if len(path) > linux.UnixPathMax {
+		return nil, fs.ErrInvalid
+	}
+
+	if len(path) == 0 {
+		return nil, nil
+	}
+
+	if path[0] == 0 {
+		return &address{name: string(path[1:]), abstract: true}, nil
+	}
+
+	for i, c := range path {
+		if c == 0 {
+			path = path[:i]
+			break
+		}
+	}
+
+	return &address{name: string(path)}, nil
+}
+
+// sockaddr returns the sockaddr_un for a, as getsockname(2) shows it. A
+// path is followed by its NUL, as on Linux.
+func (a *address) sockaddr() []byte {
+	b := make([]byte, 2, 3+len(a.name))
+	binary.LittleEndian.PutUint16(b, linux.AF_UNIX)
+
+	if a.abstract {
+		b = append(b, 0)
+		return append(b, a.name...)
+	}
+
+	b = append(b, a.name...)
+	return append(b, 0)
+}
+
+// unnamed is the sockaddr of a socket that isn't bound.
+func unnamed() []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, linux.AF_UNIX)
+	return b
+}
+
+// inodeKey identifies the socket file a socket is bound to.
+type inodeKey struct {
+	device, inode uint64
+}
+
+func keyOf(inode *fs.Inode) inodeKey {
+	return inodeKey{inode.StableAttr.DeviceID, inode.StableAttr.InodeID}
+}
+
+// namespace is where bound sockets are found by connect(2) and sendto(2):
+// the abstract names, and the socket files by their inodes.
+type namespace struct {
+	mu       sync.Mutex
+	abstract map[string]*sock
+	files    map[inodeKey]*sock
+	autobind int
+}
+
+// namespaceKey is the key of a kernel's namespace.
+type namespaceKey struct{}
+
+// namespaceOf returns the namespace of the kernel the task in ctx runs in.
+func namespaceOf(ctx context.Context) (*namespace, error) {
+	task, ok := kernel.GetTask(ctx)
+	if !ok {
+		return nil, socket.ErrNotSupported
+	}
+
+	n := task.Kernel.Local(namespaceKey{}, func() interface{} {
+		return &namespace{
+			abstract: make(map[string]*sock),
+			files:    make(map[inodeKey]*sock),
+		}
+	})
+
+	return n.(*namespace), nil
+}
+
+// resolvePath makes path absolute against the cwd of the task in ctx.
+func resolvePath(ctx context.Context, path string) (*kernel.Task, string, error) {
+	task, ok := kernel.GetTask(ctx)
+	if !ok {
+		return nil, "", socket.ErrNotSupported
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(task.Curwd(), path)
+	}
+
+	return task, path, nil
+}
+
+// bind registers s under a, creating the socket file for a path. A nil a
+// binds to a new abstract name. It returns where s ended up.
+func (n *namespace) bind(ctx context.Context, s *sock, a *address) (*address, *inodeKey, error) {
+	if a == nil {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		for {
+			n.autobind++
+
+			name := fmt.Sprintf("%05x", n.autobind&0xfffff)
+			if _, ok := n.abstract[name]; !ok {
+				n.abstract[name] = s
+				return &address{name: name, abstract: true}, nil, nil
+			}
+		}
+	}
+
+	if a.abstract {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		if _, ok := n.abstract[a.name]; ok {
+			return nil, nil, socket.ErrAddressInUse
+		}
+
+		n.abstract[a.name] = s
+
+		return a, nil, nil
+	}
+
+	task, path, err := resolvePath(ctx, a.name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parent, name, err := task.Mount.LookupParent(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sc, ok := parent.Inode.Ops.(fs.SocketCreator)
+	if !ok {
+		return nil, nil, socket.ErrNotSupported
+	}
+
+	err = fs.CheckAccess(ctx, parent.Inode, auth.MayWrite|auth.MayExec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = fs.CheckWrite(parent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inode, err := sc.CreateSocket(ctx, parent.Inode, name, 0777&^task.Umask())
+	if err != nil {
+		if errors.Cause(err) == fs.ErrExists {
+			return nil, nil, socket.ErrAddressInUse
+		}
+
+		return nil, nil, err
+	}
+
+	key := keyOf(inode)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.files[key] = s
+
+	return a, &key, nil
+}
+
+// unbind removes s from the namespace. Its socket file is left behind, and
+// connecting to it is refused.
+func (n *namespace) unbind(s *sock, a *address, key *inodeKey) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch {
+	case key != nil:
+		if n.files[*key] == s {
+			delete(n.files, *key)
+		}
+	case a != nil && a.abstract:
+		if n.abstract[a.name] == s {
+			delete(n.abstract, a.name)
+		}
+	}
+}
+
+// lookup finds the socket bound to a.
+func (n *namespace) lookup(ctx context.Context, a *address) (*sock, error) {
+	if a.abstract {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		s, ok := n.abstract[a.name]
+		if !ok {
+			return nil, socket.ErrConnectionRefused
+		}
+
+		return s, nil
+	}
+
+	task, path, err := resolvePath(ctx, a.name)
+	if err != nil {
+		return nil, err
+	}
+
+	ent, err := task.Mount.LookupPath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if ent.Inode.StableAttr.Type != fs.Socket {
+		return nil, socket.ErrConnectionRefused
+	}
+
+	// Connecting, or sending to the socket, is writing to its file.
+	if err := fs.CheckAccess(ctx, ent.Inode, auth.MayWrite); err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	s, ok := n.files[keyOf(ent.Inode)]
+	if !ok {
+		return nil, socket.ErrConnectionRefused
+	}
+
+	return s, nil
+}
@@ -0,0 +1,975 @@
+// Package unix implements AF_UNIX sockets: stream, datagram and seqpacket
+// sockets bound to files or abstract names, which can pass open files and
+// the credentials of the sender between processes.
+package unix
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/pkg/waiter"
+	"github.com/evanphx/columbia/socket"
+)
+
+const (
+	// bufferSize is how many bytes a socket holds for receiving before
+	// senders have to wait, Linux's default.
+	bufferSize = 212992
+
+	// maxBacklog caps the connections waiting to be accepted, as
+	// net.core.somaxconn does.
+	maxBacklog = 4096
+)
+
+func init() {
+	socket.RegisterFamily(linux.AF_UNIX, family{})
+}
+
+type family struct{}
+
+func checkType(typ, protocol int) error {
+	switch typ {
+	case linux.SOCK_STREAM, linux.SOCK_DGRAM, linux.SOCK_SEQPACKET:
+	default:
+		return socket.ErrTypeNotSupported
+	}
+
+	if protocol != 0 {
+		return socket.ErrProtocolNotSupported
+	}
+
+	return nil
+}
+
+func (family) Socket(ctx context.Context, typ, protocol int) (socket.Socket, error) {
+	if err := checkType(typ, protocol); err != nil {
+		return nil, err
+	}
+
+	return newSock(typ, credentials(ctx)), nil
+}
+
+func (family) Pair(ctx context.Context, typ, protocol int) (socket.Socket, socket.Socket, error) {
+	if err := checkType(typ, protocol); err != nil {
+		return nil, nil, err
+	}
+
+	creds := credentials(ctx)
+
+	a := newSock(typ, creds)
+	b := newSock(typ, creds)
+
+	a.peer, a.peerCreds = b, creds
+	b.peer, b.peerCreds = a, creds
+
+	return a, b, nil
+}
+
+// credentials returns the credentials of the task in ctx, as the receiver
+// of a message or the peer of a connection sees them.
+func credentials(ctx context.Context) linux.ControlMessageCredentials {
+	task, ok := kernel.GetTask(ctx)
+	if !ok {
+		return linux.ControlMessageCredentials{}
+	}
+
+	uid, gid := task.User()
+
+	return linux.ControlMessageCredentials{
+		PID: int32(task.Pid),
+		UID: uint32(uid),
+		GID: uint32(gid),
+	}
+}
+
+// message is a send waiting to be received.
+type message struct {
+	data   []byte
+	from   []byte
+	sender *sock
+	creds  linux.ControlMessageCredentials
+	cm     socket.ControlMessages
+}
+
+type sock struct {
+	typ   int
+	creds linux.ControlMessageCredentials
+
+	q waiter.Queue
+
+	mu sync.Mutex
+
+	// addr is where the socket is bound, or for an accepted socket the
+	// address of the listener, which it doesn't own.
+	addr  *address
+	key   *inodeKey
+	owned bool
+
+	// names is the namespace the socket is bound in.
+	names *namespace
+
+	listening bool
+	backlog   int
+	pending   []*sock
+
+	// peer is the other end of a connection. For a datagram socket, it's
+	// just where sends without an address go.
+	peer      *sock
+	peerCreds linux.ControlMessageCredentials
+
+	queue  []*message
+	queued int
+
+	// readShut and writeShut are set by shutdown(2) from either end, and
+	// once the peer is closed.
+	readShut, writeShut bool
+
+	passcred bool
+	closed   bool
+}
+
+func newSock(typ int, creds linux.ControlMessageCredentials) *sock {
+	return &sock{typ: typ, creds: creds}
+}
+
+// connectionOriented reports whether the socket has to be connected to
+// send, rather than addressing each datagram.
+func (s *sock) connectionOriented() bool {
+	return s.typ != linux.SOCK_DGRAM
+}
+
+func (s *sock) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	s.q.EventRegister(ch, mask)
+}
+
+func (s *sock) EventUnregister(ch chan struct{}) {
+	s.q.EventUnregister(ch)
+}
+
+func (s *sock) Readiness(mask waiter.EventMask) waiter.EventMask {
+	s.mu.Lock()
+
+	var ready waiter.EventMask
+
+	if len(s.queue) > 0 || s.readShut || (s.listening && len(s.pending) > 0) {
+		ready |= waiter.EventIn
+	}
+
+	if s.readShut {
+		ready |= waiter.EventRdHUp
+	}
+
+	if s.readShut && s.writeShut {
+		ready |= waiter.EventHUp
+	}
+
+	peer, writeShut := s.peer, s.writeShut
+	canWrite := !s.listening && (peer != nil || !s.connectionOriented())
+
+	s.mu.Unlock()
+
+	if canWrite && !writeShut && (peer == nil || peer.hasRoom(1)) {
+		ready |= waiter.EventOut
+	}
+
+	return ready & mask
+}
+
+// hasRoom reports whether n bytes can be queued for s to receive, or
+// whether sending would fail anyway, so there's no point waiting.
+func (s *sock) hasRoom(n int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed || s.readShut || s.queued == 0 || s.queued+n <= bufferSize
+}
+
+// room is a Waitable for when a socket can take a send of n bytes.
+type room struct {
+	s *sock
+	n int
+}
+
+func (r room) Readiness(mask waiter.EventMask) waiter.EventMask {
+	if r.s.hasRoom(r.n) {
+		return waiter.EventOut & mask
+	}
+
+	return 0
+}
+
+func (r room) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	r.s.q.EventRegister(ch, mask)
+}
+
+func (r room) EventUnregister(ch chan struct{}) {
+	r.s.q.EventUnregister(ch)
+}
+
+func (s *sock) Bind(ctx context.Context, addr []byte) error {
+	a, err := parseAddress(addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	bound := s.addr != nil
+	s.mu.Unlock()
+
+	if bound {
+		return fs.ErrInvalid
+	}
+
+	names, err := namespaceOf(ctx)
+	if err != nil {
+		return err
+	}
+
+	a, key, err := names.bind(ctx, s, a)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.addr != nil {
+		names.unbind(s, a, key)
+		return fs.ErrInvalid
+	}
+
+	s.addr, s.key, s.owned, s.names = a, key, true, names
+
+	return nil
+}
+
+func (s *sock) Listen(backlog int) error {
+	if !s.connectionOriented() {
+		return socket.ErrNotSupported
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.addr == nil || s.peer != nil {
+		return fs.ErrInvalid
+	}
+
+	switch {
+	case backlog < 1:
+		backlog = 1
+	case backlog > maxBacklog:
+		backlog = maxBacklog
+	}
+
+	s.listening = true
+	s.backlog = backlog
+
+	return nil
+}
+
+func (s *sock) Accept(ctx context.Context, nonblock bool) (socket.Socket, error) {
+	for {
+		s.mu.Lock()
+
+		if !s.listening {
+			s.mu.Unlock()
+			return nil, fs.ErrInvalid
+		}
+
+		if len(s.pending) > 0 {
+			conn := s.pending[0]
+			s.pending = s.pending[1:]
+			s.mu.Unlock()
+
+			// Connecting may be waiting for a place in the backlog.
+			s.q.Notify(waiter.EventOut)
+
+			return conn, nil
+		}
+
+		s.mu.Unlock()
+
+		if nonblock {
+			return nil, socket.ErrWouldBlock
+		}
+
+		if err := waiter.Wait(ctx, s, waiter.EventIn); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// backlog is a Waitable for when a listener has a place for another
+// connection.
+type backlog struct {
+	l *sock
+}
+
+func (b backlog) Readiness(mask waiter.EventMask) waiter.EventMask {
+	b.l.mu.Lock()
+	defer b.l.mu.Unlock()
+
+	if !b.l.listening || b.l.closed || len(b.l.pending) < b.l.backlog {
+		return waiter.EventOut & mask
+	}
+
+	return 0
+}
+
+func (b backlog) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	b.l.q.EventRegister(ch, mask)
+}
+
+func (b backlog) EventUnregister(ch chan struct{}) {
+	b.l.q.EventUnregister(ch)
+}
+
+func (s *sock) Connect(ctx context.Context, addr []byte, nonblock bool) error {
+	a, err := parseAddress(addr)
+	if err != nil {
+		return err
+	}
+
+	if a == nil {
+		return fs.ErrInvalid
+	}
+
+	names, err := namespaceOf(ctx)
+	if err != nil {
+		return err
+	}
+
+	target, err := names.lookup(ctx, a)
+	if err != nil {
+		return err
+	}
+
+	if target.typ != s.typ {
+		return socket.ErrWrongType
+	}
+
+	if !s.connectionOriented() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.peer = target
+
+		return nil
+	}
+
+	s.mu.Lock()
+
+	switch {
+	case s.listening:
+		s.mu.Unlock()
+		return fs.ErrInvalid
+	case s.peer != nil:
+		s.mu.Unlock()
+		return socket.ErrIsConnected
+	}
+
+	s.mu.Unlock()
+
+	creds := credentials(ctx)
+
+	for {
+		target.mu.Lock()
+
+		if !target.listening || target.closed {
+			target.mu.Unlock()
+			return socket.ErrConnectionRefused
+		}
+
+		if len(target.pending) < target.backlog {
+			break
+		}
+
+		target.mu.Unlock()
+
+		if nonblock {
+			return socket.ErrWouldBlock
+		}
+
+		if err := waiter.Wait(ctx, backlog{target}, waiter.EventOut); err != nil {
+			return err
+		}
+	}
+
+	// The accepted socket has the listener's address, and each end sees
+	// the credentials of the other as they were at connect and listen.
+	conn := newSock(s.typ, target.creds)
+	conn.addr = target.addr
+	conn.peer = s
+	conn.peerCreds = creds
+
+	target.pending = append(target.pending, conn)
+	listenerCreds := target.creds
+
+	target.mu.Unlock()
+
+	s.mu.Lock()
+	s.peer = conn
+	s.peerCreds = listenerCreds
+	s.mu.Unlock()
+
+	target.q.Notify(waiter.EventIn)
+	s.q.Notify(waiter.EventOut)
+
+	return nil
+}
+
+func (s *sock) Shutdown(how int) error {
+	s.mu.Lock()
+
+	peer := s.peer
+	if peer == nil {
+		s.mu.Unlock()
+		return socket.ErrNotConnected
+	}
+
+	if how == linux.SHUT_RD || how == linux.SHUT_RDWR {
+		s.readShut = true
+	}
+
+	if how == linux.SHUT_WR || how == linux.SHUT_RDWR {
+		s.writeShut = true
+	}
+
+	s.mu.Unlock()
+
+	// A datagram socket's peer is only where it sends to.
+	if s.connectionOriented() {
+		peer.mu.Lock()
+
+		if how == linux.SHUT_RD || how == linux.SHUT_RDWR {
+			peer.writeShut = true
+		}
+
+		if how == linux.SHUT_WR || how == linux.SHUT_RDWR {
+			peer.readShut = true
+		}
+
+		peer.mu.Unlock()
+
+		peer.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp | waiter.EventRdHUp)
+	}
+
+	s.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp | waiter.EventRdHUp)
+
+	return nil
+}
+
+func (s *sock) SendMsg(ctx context.Context, data, addr []byte, cm socket.ControlMessages, flags int) (int, error) {
+	n, err := s.send(ctx, data, addr, &cm, flags)
+
+	// Whatever wasn't sent along with the data is dropped.
+	cm.Release()
+
+	return n, err
+}
+
+func (s *sock) send(ctx context.Context, data, addr []byte, cm *socket.ControlMessages, flags int) (int, error) {
+	s.mu.Lock()
+	target, writeShut, from := s.peer, s.writeShut, s.addr
+	s.mu.Unlock()
+
+	if addr != nil {
+		if s.connectionOriented() {
+			if target != nil {
+				return 0, socket.ErrIsConnected
+			}
+
+			return 0, socket.ErrNotSupported
+		}
+
+		a, err := parseAddress(addr)
+		if err != nil {
+			return 0, err
+		}
+
+		if a == nil {
+			return 0, fs.ErrInvalid
+		}
+
+		names, err := namespaceOf(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		target, err = names.lookup(ctx, a)
+		if err != nil {
+			return 0, err
+		}
+
+		if target.typ != s.typ {
+			return 0, socket.ErrWrongType
+		}
+	}
+
+	if writeShut {
+		return 0, socket.ErrBrokenPipe
+	}
+
+	if target == nil {
+		if s.connectionOriented() {
+			return 0, socket.ErrNotConnected
+		}
+
+		return 0, socket.ErrDestinationRequired
+	}
+
+	creds := credentials(ctx)
+	if cm.Credentials != nil {
+		creds = *cm.Credentials
+	}
+
+	var fromAddr []byte
+	if from != nil {
+		fromAddr = from.sockaddr()
+	}
+
+	if s.typ == linux.SOCK_STREAM {
+		return s.sendStream(ctx, target, data, creds, cm, flags)
+	}
+
+	if len(data) > bufferSize {
+		return 0, socket.ErrMessageSize
+	}
+
+	for {
+		target.mu.Lock()
+
+		if err := target.checkReceive(s); err != nil {
+			target.mu.Unlock()
+			return 0, err
+		}
+
+		if target.queued == 0 || target.queued+len(data) <= bufferSize {
+			break
+		}
+
+		target.mu.Unlock()
+
+		if flags&linux.MSG_DONTWAIT != 0 {
+			return 0, socket.ErrWouldBlock
+		}
+
+		if err := waiter.Wait(ctx, room{target, len(data)}, waiter.EventOut); err != nil {
+			return 0, err
+		}
+	}
+
+	target.enqueue(&message{
+		data:   append([]byte(nil), data...),
+		from:   fromAddr,
+		sender: s,
+		creds:  creds,
+		cm:     takeControl(cm),
+	})
+
+	target.mu.Unlock()
+
+	target.q.Notify(waiter.EventIn)
+
+	return len(data), nil
+}
+
+// checkReceive returns why s can't receive from sender, if it can't.
+// s.mu must be held.
+func (s *sock) checkReceive(sender *sock) error {
+	switch {
+	case s.closed && !s.connectionOriented():
+		return socket.ErrConnectionRefused
+	case s.closed || s.readShut:
+		return socket.ErrBrokenPipe
+	case !s.connectionOriented() && s.peer != nil && s.peer != sender:
+		// A connected datagram socket only hears from its peer.
+		return socket.ErrPermission
+	}
+
+	return nil
+}
+
+// enqueue adds m to what s has to receive. s.mu must be held.
+func (s *sock) enqueue(m *message) {
+	s.queue = append(s.queue, m)
+	s.queued += len(m.data)
+}
+
+// takeControl moves the control messages from cm into a message, so that
+// they're no longer released by the sender.
+func takeControl(cm *socket.ControlMessages) socket.ControlMessages {
+	taken := socket.ControlMessages{Rights: cm.Rights}
+	cm.Rights = nil
+
+	return taken
+}
+
+// sendStream sends data as it fits in what target can hold, waiting for
+// room unless the send is nonblocking, and returns how much was sent.
+func (s *sock) sendStream(ctx context.Context, target *sock, data []byte, creds linux.ControlMessageCredentials, cm *socket.ControlMessages, flags int) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	sent := 0
+
+	for sent < len(data) {
+		target.mu.Lock()
+
+		if err := target.checkReceive(s); err != nil {
+			target.mu.Unlock()
+
+			if sent > 0 {
+				return sent, nil
+			}
+
+			return 0, err
+		}
+
+		space := bufferSize - target.queued
+
+		if space <= 0 {
+			target.mu.Unlock()
+
+			if flags&linux.MSG_DONTWAIT != 0 {
+				if sent > 0 {
+					return sent, nil
+				}
+
+				return 0, socket.ErrWouldBlock
+			}
+
+			if err := waiter.Wait(ctx, room{target, 1}, waiter.EventOut); err != nil {
+				if sent > 0 {
+					return sent, nil
+				}
+
+				return 0, err
+			}
+
+			continue
+		}
+
+		chunk := data[sent:]
+		if len(chunk) > space {
+			chunk = chunk[:space]
+		}
+
+		// The files go with the first part of the data.
+		target.enqueue(&message{
+			data:   append([]byte(nil), chunk...),
+			sender: s,
+			creds:  creds,
+			cm:     takeControl(cm),
+		})
+
+		target.mu.Unlock()
+
+		target.q.Notify(waiter.EventIn)
+
+		sent += len(chunk)
+	}
+
+	return sent, nil
+}
+
+func (s *sock) RecvMsg(ctx context.Context, size int, flags int) ([]byte, []byte, socket.ControlMessages, int, error) {
+	data, from, cm, msgFlags, err := s.recvWait(ctx, size, flags)
+
+	if err != nil || s.typ != linux.SOCK_STREAM || flags&linux.MSG_WAITALL == 0 || flags&linux.MSG_PEEK != 0 {
+		return data, from, cm, msgFlags, err
+	}
+
+	// MSG_WAITALL keeps receiving until size bytes have arrived, unless
+	// files arrive, the stream ends or the wait is interrupted.
+	for len(data) < size && len(cm.Rights) == 0 && len(data) > 0 {
+		more, _, moreCM, _, err := s.recvWait(ctx, size-len(data), flags)
+		if err != nil || len(more) == 0 {
+			break
+		}
+
+		data = append(data, more...)
+		cm.Rights = moreCM.Rights
+	}
+
+	return data, from, cm, msgFlags, nil
+}
+
+// recvWait receives what's queued, waiting for something to be unless the
+// receive is nonblocking.
+func (s *sock) recvWait(ctx context.Context, size int, flags int) ([]byte, []byte, socket.ControlMessages, int, error) {
+	for {
+		data, from, cm, msgFlags, err := s.recv(size, flags)
+		if err != socket.ErrWouldBlock || flags&linux.MSG_DONTWAIT != 0 {
+			return data, from, cm, msgFlags, err
+		}
+
+		if err := waiter.Wait(ctx, s, waiter.EventIn); err != nil {
+			return nil, nil, socket.ControlMessages{}, 0, err
+		}
+	}
+}
+
+// recv receives what's queued, failing with ErrWouldBlock if there's
+// nothing yet.
+func (s *sock) recv(size int, flags int) ([]byte, []byte, socket.ControlMessages, int, error) {
+	s.mu.Lock()
+
+	var (
+		cm      socket.ControlMessages
+		senders []*sock
+	)
+
+	if len(s.queue) == 0 {
+		defer s.mu.Unlock()
+
+		switch {
+		case s.readShut:
+			return nil, nil, cm, 0, nil
+		case s.connectionOriented() && s.peer == nil:
+			return nil, nil, cm, 0, socket.ErrNotConnected
+		}
+
+		return nil, nil, cm, 0, socket.ErrWouldBlock
+	}
+
+	peek := flags&linux.MSG_PEEK != 0
+
+	var (
+		data     []byte
+		from     []byte
+		msgFlags int
+	)
+
+	first := s.queue[0]
+	from = first.from
+
+	if s.passcred {
+		creds := first.creds
+		cm.Credentials = &creds
+	}
+
+	if s.typ == linux.SOCK_STREAM {
+		data = make([]byte, 0, size)
+
+		for i := 0; i < len(s.queue) && len(data) < size; i++ {
+			m := s.queue[i]
+
+			// Files are only received with the data they were sent with,
+			// and the credentials of the sender mustn't be mixed up.
+			rights := len(m.cm.Rights) > 0
+			if i > 0 && (rights || (s.passcred && m.creds != first.creds)) {
+				break
+			}
+
+			n := copy(data[len(data):size], m.data)
+			data = data[:len(data)+n]
+
+			if peek {
+				if rights {
+					break
+				}
+
+				continue
+			}
+
+			senders = append(senders, m.sender)
+
+			if i == 0 {
+				cm.Rights = m.cm.Rights
+				m.cm.Rights = nil
+			}
+
+			m.data = m.data[n:]
+			s.queued -= n
+
+			if rights {
+				break
+			}
+		}
+
+		if !peek {
+			for len(s.queue) > 0 && len(s.queue[0].data) == 0 && len(s.queue[0].cm.Rights) == 0 {
+				s.queue = s.queue[1:]
+			}
+		}
+	} else {
+		data = first.data
+
+		if len(data) > size {
+			data = data[:size]
+			msgFlags |= linux.MSG_TRUNC
+		}
+
+		if peek {
+			for _, f := range first.cm.Rights {
+				f.IncRef()
+			}
+
+			cm.Rights = append([]*kernel.File(nil), first.cm.Rights...)
+		} else {
+			cm.Rights = first.cm.Rights
+			s.queue = s.queue[1:]
+			s.queued -= len(first.data)
+			senders = append(senders, first.sender)
+		}
+	}
+
+	s.mu.Unlock()
+
+	if len(senders) > 0 {
+		// There's room now for those waiting to send.
+		s.q.Notify(waiter.EventOut)
+
+		for _, sender := range senders {
+			if sender != s {
+				sender.q.Notify(waiter.EventOut)
+			}
+		}
+	}
+
+	return data, from, cm, msgFlags, nil
+}
+
+func (s *sock) Close() error {
+	s.mu.Lock()
+
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	s.readShut = true
+	s.writeShut = true
+
+	peer, pending, queue := s.peer, s.pending, s.queue
+	addr, key, owned, names := s.addr, s.key, s.owned, s.names
+
+	s.listening = false
+	s.pending = nil
+	s.queue = nil
+	s.queued = 0
+
+	s.mu.Unlock()
+
+	if owned {
+		names.unbind(s, addr, key)
+	}
+
+	for _, m := range queue {
+		m.cm.Release()
+	}
+
+	for _, conn := range pending {
+		conn.Close()
+	}
+
+	if peer != nil && s.connectionOriented() {
+		peer.mu.Lock()
+		peer.readShut = true
+		peer.writeShut = true
+		peer.mu.Unlock()
+
+		peer.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp | waiter.EventRdHUp)
+	}
+
+	s.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp | waiter.EventRdHUp)
+
+	return nil
+}
+
+func (s *sock) SockName() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.addr == nil {
+		return unnamed(), nil
+	}
+
+	return s.addr.sockaddr(), nil
+}
+
+func (s *sock) PeerName() ([]byte, error) {
+	s.mu.Lock()
+	peer := s.peer
+	s.mu.Unlock()
+
+	if peer == nil {
+		return nil, socket.ErrNotConnected
+	}
+
+	return peer.SockName()
+}
+
+func boolOpt(b bool) int32 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+func (s *sock) GetSockOpt(level, name int) (interface{}, error) {
+	if level != linux.SOL_SOCKET {
+		return nil, socket.ErrNoProtocolOption
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch name {
+	case linux.SO_TYPE:
+		return int32(s.typ), nil
+	case linux.SO_DOMAIN:
+		return int32(linux.AF_UNIX), nil
+	case linux.SO_PROTOCOL, linux.SO_ERROR, linux.SO_REUSEADDR, linux.SO_KEEPALIVE:
+		return int32(0), nil
+	case linux.SO_ACCEPTCONN:
+		return boolOpt(s.listening), nil
+	case linux.SO_PASSCRED:
+		return boolOpt(s.passcred), nil
+	case linux.SO_SNDBUF, linux.SO_RCVBUF:
+		return int32(bufferSize), nil
+	case linux.SO_PEERCRED:
+		if s.peer == nil || !s.connectionOriented() {
+			// What Linux gives for a socket without a peer.
+			return linux.ControlMessageCredentials{PID: 0, UID: ^uint32(0), GID: ^uint32(0)}, nil
+		}
+
+		return s.peerCreds, nil
+	}
+
+	return nil, socket.ErrNoProtocolOption
+}
+
+func (s *sock) SetSockOpt(level, name int, val []byte) error {
+	if level != linux.SOL_SOCKET {
+		return socket.ErrNoProtocolOption
+	}
+
+	if len(val) < 4 {
+		return fs.ErrInvalid
+	}
+
+	on := binary.LittleEndian.Uint32(val) != 0
+
+	switch name {
+	case linux.SO_PASSCRED:
+		s.mu.Lock()
+		s.passcred = on
+		s.mu.Unlock()
+	case linux.SO_SNDBUF, linux.SO_RCVBUF, linux.SO_REUSEADDR, linux.SO_KEEPALIVE:
+		// Accepted, but the buffers stay the same size.
+	default:
+		return socket.ErrNoProtocolOption
+	}
+
+	return nil
+}
@@ -0,0 +1,366 @@
+package unix_test
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/tmpfs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/pkg/waiter"
+	"github.com/evanphx/columbia/socket"
+	_ "github.com/evanphx/columbia/socket/unix"
+	"github.com/stretchr/testify/require"
+)
+
+func abstract(name string) []byte {
+	b := make([]byte, 3, 3+len(name))
+	binary.LittleEndian.PutUint16(b, linux.AF_UNIX)
+
+	return append(b, name...)
+}
+
+func path(name string) []byte {
+	b := make([]byte, 2, 2+len(name))
+	binary.LittleEndian.PutUint16(b, linux.AF_UNIX)
+
+	return append(b, name...)
+}
+
+func TestUnix(t *testing.T) {
+	k, err := kernel.NewKernel(nil)
+	require.NoError(t, err)
+
+	root, err := tmpfs.NewTmpFS(tmpfs.Options{}).Root()
+	require.NoError(t, err)
+
+	m := fs.NewMountNamespace()
+	m.SetRoot(root)
+
+	init := k.NewProcess("/")
+	init.Mount = m
+	init.SetUser(1000, 100)
+
+	ctx := kernel.SetTask(context.Background(), &kernel.Task{Process: init})
+
+	pair := func(t *testing.T, typ int) (socket.Socket, socket.Socket) {
+		a, b, err := socket.NewPair(ctx, linux.AF_UNIX, typ, 0)
+		require.NoError(t, err)
+
+		return a, b
+	}
+
+	send := func(t *testing.T, s socket.Socket, data string) {
+		n, err := s.SendMsg(ctx, []byte(data), nil, socket.ControlMessages{}, 0)
+		require.NoError(t, err)
+		require.Equal(t, len(data), n)
+	}
+
+	recv := func(t *testing.T, s socket.Socket, size int) (string, int) {
+		data, _, cm, flags, err := s.RecvMsg(ctx, size, 0)
+		require.NoError(t, err)
+
+		cm.Release()
+
+		return string(data), flags
+	}
+
+	t.Run("rejects types and protocols it doesn't have", func(t *testing.T) {
+		_, err := socket.New(ctx, linux.AF_UNIX, linux.SOCK_RAW, 0)
+		require.Equal(t, socket.ErrTypeNotSupported, err)
+
+		_, err = socket.New(ctx, linux.AF_UNIX, linux.SOCK_STREAM, 6)
+		require.Equal(t, socket.ErrProtocolNotSupported, err)
+	})
+
+	t.Run("streams bytes between a pair", func(t *testing.T) {
+		a, b := pair(t, linux.SOCK_STREAM)
+
+		send(t, a, "hello ")
+		send(t, a, "world")
+
+		data, _ := recv(t, b, 100)
+		require.Equal(t, "hello world", data)
+
+		send(t, b, "back")
+
+		data, _ = recv(t, a, 2)
+		require.Equal(t, "ba", data)
+
+		data, _ = recv(t, a, 2)
+		require.Equal(t, "ck", data)
+
+		_, _, _, _, err := a.RecvMsg(ctx, 10, linux.MSG_DONTWAIT)
+		require.Equal(t, socket.ErrWouldBlock, err)
+
+		require.NoError(t, a.Close())
+
+		data, _ = recv(t, b, 10)
+		require.Equal(t, "", data)
+
+		_, err = b.SendMsg(ctx, []byte("x"), nil, socket.ControlMessages{}, 0)
+		require.Equal(t, socket.ErrBrokenPipe, err)
+	})
+
+	t.Run("keeps the boundaries of datagrams", func(t *testing.T) {
+		for _, typ := range []int{linux.SOCK_DGRAM, linux.SOCK_SEQPACKET} {
+			a, b := pair(t, typ)
+
+			send(t, a, "one")
+			send(t, a, "three")
+
+			data, flags := recv(t, b, 100)
+			require.Equal(t, "one", data)
+			require.Equal(t, 0, flags)
+
+			data, flags = recv(t, b, 2)
+			require.Equal(t, "th", data)
+			require.Equal(t, linux.MSG_TRUNC, flags)
+
+			_, _, _, _, err := b.RecvMsg(ctx, 10, linux.MSG_DONTWAIT)
+			require.Equal(t, socket.ErrWouldBlock, err)
+		}
+	})
+
+	t.Run("peeks without consuming", func(t *testing.T) {
+		a, b := pair(t, linux.SOCK_STREAM)
+
+		send(t, a, "data")
+
+		data, _, _, _, err := b.RecvMsg(ctx, 10, linux.MSG_PEEK)
+		require.NoError(t, err)
+		require.Equal(t, "data", string(data))
+
+		data2, _ := recv(t, b, 10)
+		require.Equal(t, "data", data2)
+	})
+
+	t.Run("waits for the whole receive with MSG_WAITALL", func(t *testing.T) {
+		a, b := pair(t, linux.SOCK_STREAM)
+
+		send(t, a, "ab")
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			send(t, a, "cd")
+		}()
+
+		data, _, _, _, err := b.RecvMsg(ctx, 4, linux.MSG_WAITALL)
+		require.NoError(t, err)
+		require.Equal(t, "abcd", string(data))
+	})
+
+	t.Run("listens and accepts on an abstract name", func(t *testing.T) {
+		srv, err := socket.New(ctx, linux.AF_UNIX, linux.SOCK_STREAM, 0)
+		require.NoError(t, err)
+
+		require.Equal(t, fs.ErrInvalid, srv.Listen(1))
+
+		require.NoError(t, srv.Bind(ctx, abstract("test-server")))
+		require.NoError(t, srv.Listen(1))
+
+		other, err := socket.New(ctx, linux.AF_UNIX, linux.SOCK_STREAM, 0)
+		require.NoError(t, err)
+		require.Equal(t, socket.ErrAddressInUse, other.Bind(ctx, abstract("test-server")))
+
+		_, err = srv.Accept(ctx, true)
+		require.Equal(t, socket.ErrWouldBlock, err)
+
+		require.Equal(t, socket.ErrConnectionRefused, other.Connect(ctx, abstract("nobody"), false))
+		require.NoError(t, other.Connect(ctx, abstract("test-server"), false))
+
+		require.Equal(t, waiter.EventIn, srv.Readiness(waiter.EventIn|waiter.EventOut))
+
+		// The backlog is full.
+		third, err := socket.New(ctx, linux.AF_UNIX, linux.SOCK_STREAM, 0)
+		require.NoError(t, err)
+		require.Equal(t, socket.ErrWouldBlock, third.Connect(ctx, abstract("test-server"), true))
+
+		conn, err := srv.Accept(ctx, false)
+		require.NoError(t, err)
+
+		name, err := conn.SockName()
+		require.NoError(t, err)
+		require.Equal(t, abstract("test-server"), name)
+
+		peer, err := other.PeerName()
+		require.NoError(t, err)
+		require.Equal(t, abstract("test-server"), peer)
+
+		send(t, other, "ping")
+
+		data, _ := recv(t, conn, 10)
+		require.Equal(t, "ping", data)
+
+		cred, err := conn.GetSockOpt(linux.SOL_SOCKET, linux.SO_PEERCRED)
+		require.NoError(t, err)
+		require.Equal(t, linux.ControlMessageCredentials{PID: int32(init.Pid), UID: 1000, GID: 100}, cred)
+
+		require.NoError(t, srv.Close())
+		require.NoError(t, conn.Close())
+
+		// The name is free once the listener is closed.
+		require.NoError(t, third.Bind(ctx, abstract("test-server")))
+	})
+
+	t.Run("keeps abstract names to their kernel", func(t *testing.T) {
+		other, err := kernel.NewKernel(nil)
+		require.NoError(t, err)
+
+		octx := kernel.SetTask(context.Background(), &kernel.Task{Process: other.NewProcess("/")})
+
+		srv, err := socket.New(ctx, linux.AF_UNIX, linux.SOCK_STREAM, 0)
+		require.NoError(t, err)
+		defer srv.Close()
+
+		require.NoError(t, srv.Bind(ctx, abstract("per-kernel")))
+		require.NoError(t, srv.Listen(1))
+
+		c, err := socket.New(octx, linux.AF_UNIX, linux.SOCK_STREAM, 0)
+		require.NoError(t, err)
+		defer c.Close()
+
+		require.Equal(t, socket.ErrConnectionRefused, c.Connect(octx, abstract("per-kernel"), false))
+
+		osrv, err := socket.New(octx, linux.AF_UNIX, linux.SOCK_STREAM, 0)
+		require.NoError(t, err)
+		defer osrv.Close()
+
+		require.NoError(t, osrv.Bind(octx, abstract("per-kernel")))
+	})
+
+	t.Run("binds to a socket file", func(t *testing.T) {
+		srv, err := socket.New(ctx, linux.AF_UNIX, linux.SOCK_DGRAM, 0)
+		require.NoError(t, err)
+
+		require.NoError(t, srv.Bind(ctx, path("/sock\x00")))
+
+		ent, err := m.LookupPath(ctx, "/sock")
+		require.NoError(t, err)
+		require.Equal(t, fs.Socket, ent.Inode.StableAttr.Type)
+
+		name, err := srv.SockName()
+		require.NoError(t, err)
+		require.Equal(t, path("/sock\x00"), name)
+
+		again, err := socket.New(ctx, linux.AF_UNIX, linux.SOCK_DGRAM, 0)
+		require.NoError(t, err)
+		require.Equal(t, socket.ErrAddressInUse, again.Bind(ctx, path("/sock")))
+
+		client, err := socket.New(ctx, linux.AF_UNIX, linux.SOCK_DGRAM, 0)
+		require.NoError(t, err)
+
+		_, err = client.SendMsg(ctx, []byte("hi"), path("sock"), socket.ControlMessages{}, 0)
+		require.NoError(t, err)
+
+		data, from, _, _, err := srv.RecvMsg(ctx, 10, 0)
+		require.NoError(t, err)
+		require.Equal(t, "hi", string(data))
+		require.Nil(t, from)
+
+		stream, err := socket.New(ctx, linux.AF_UNIX, linux.SOCK_STREAM, 0)
+		require.NoError(t, err)
+		require.Equal(t, socket.ErrWrongType, stream.Connect(ctx, path("/sock"), false))
+
+		require.NoError(t, srv.Close())
+
+		_, err = client.SendMsg(ctx, []byte("hi"), path("/sock"), socket.ControlMessages{}, 0)
+		require.Equal(t, socket.ErrConnectionRefused, err)
+	})
+
+	t.Run("passes files", func(t *testing.T) {
+		a, b := pair(t, linux.SOCK_STREAM)
+
+		passed, _ := pair(t, linux.SOCK_DGRAM)
+		file := socket.NewFile(passed)
+
+		file.IncRef()
+
+		_, err := a.SendMsg(ctx, []byte("f"), nil, socket.ControlMessages{Rights: []*kernel.File{file}}, 0)
+		require.NoError(t, err)
+
+		send(t, a, "g")
+
+		// The data sent with the file isn't merged with what follows.
+		data, _, cm, _, err := b.RecvMsg(ctx, 10, 0)
+		require.NoError(t, err)
+		require.Equal(t, "f", string(data))
+		require.Equal(t, []*kernel.File{file}, cm.Rights)
+
+		s, ok := socket.FromFile(cm.Rights[0])
+		require.True(t, ok)
+		require.Equal(t, passed, s)
+
+		cm.Release()
+		require.NoError(t, file.Close())
+
+		data2, _ := recv(t, b, 10)
+		require.Equal(t, "g", data2)
+	})
+
+	t.Run("passes credentials", func(t *testing.T) {
+		a, b := pair(t, linux.SOCK_DGRAM)
+
+		on := make([]byte, 4)
+		binary.LittleEndian.PutUint32(on, 1)
+		require.NoError(t, b.SetSockOpt(linux.SOL_SOCKET, linux.SO_PASSCRED, on))
+
+		send(t, a, "x")
+
+		_, _, cm, _, err := b.RecvMsg(ctx, 10, 0)
+		require.NoError(t, err)
+		require.Equal(t, &linux.ControlMessageCredentials{PID: int32(init.Pid), UID: 1000, GID: 100}, cm.Credentials)
+
+		_, err = b.GetSockOpt(linux.SOL_SOCKET, linux.SO_RCVTIMEO)
+		require.Equal(t, socket.ErrNoProtocolOption, err)
+	})
+
+	t.Run("shuts down each direction", func(t *testing.T) {
+		a, b := pair(t, linux.SOCK_STREAM)
+
+		require.Equal(t, waiter.EventOut, a.Readiness(waiter.EventIn|waiter.EventOut))
+
+		require.NoError(t, a.Shutdown(linux.SHUT_WR))
+
+		_, err := a.SendMsg(ctx, []byte("x"), nil, socket.ControlMessages{}, 0)
+		require.Equal(t, socket.ErrBrokenPipe, err)
+
+		require.Equal(t, waiter.EventIn|waiter.EventRdHUp, b.Readiness(waiter.EventIn|waiter.EventRdHUp))
+
+		data, _ := recv(t, b, 10)
+		require.Equal(t, "", data)
+
+		send(t, b, "still")
+
+		data, _ = recv(t, a, 10)
+		require.Equal(t, "still", data)
+	})
+
+	t.Run("wakes waiters when ready", func(t *testing.T) {
+		a, b := pair(t, linux.SOCK_SEQPACKET)
+
+		done := make(chan error)
+
+		go func() {
+			done <- waiter.Wait(ctx, b, waiter.EventIn)
+		}()
+
+		select {
+		case <-done:
+			t.Fatal("ready before anything was sent")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		send(t, a, "wake")
+		require.NoError(t, <-done)
+
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, _, _, _, err := a.RecvMsg(cctx, 10, 0)
+		require.Equal(t, fs.ErrInterrupted, err)
+	})
+}
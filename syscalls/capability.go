@@ -0,0 +1,137 @@
+package syscalls
+
+import (
+	"context"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/kernel"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// capHeader reads the capget(2) and capset(2) header at addr, returning
+// how many data structs its version takes. An unknown version is answered
+// with the one that's preferred, as Linux does so libcap can probe for it.
+func capHeader(p *kernel.Task, addr int32) (linux.CapUserHeader, int, int32) {
+	var hdr linux.CapUserHeader
+
+	if err := p.CopyIn(addr, &hdr); err != nil {
+		return hdr, 0, -abi.EFAULT
+	}
+
+	switch hdr.Version {
+	case linux.LINUX_CAPABILITY_VERSION_1:
+		return hdr, 1, 0
+	case linux.LINUX_CAPABILITY_VERSION_2, linux.LINUX_CAPABILITY_VERSION_3:
+		return hdr, 2, 0
+	}
+
+	hdr.Version = linux.HighestCapabilityVersion
+
+	if err := p.CopyOut(addr, &hdr); err != nil {
+		return hdr, 0, -abi.EFAULT
+	}
+
+	return hdr, 0, -abi.EINVAL
+}
+
+// capable reports whether p has the capability cp.
+func capable(p *kernel.Task, cp linux.Capability) bool {
+	return p.Credentials().HasCapability(cp)
+}
+
+func sysCapget(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		hdrAddr  = args.Args.R0
+		dataAddr = args.Args.R1
+	)
+
+	hdr, n, errno := capHeader(p, hdrAddr)
+	if errno != 0 {
+		return errno
+	}
+
+	if hdr.Pid < 0 {
+		return -abi.EINVAL
+	}
+
+	creds := p.Credentials()
+
+	if hdr.Pid != 0 && int(hdr.Pid) != p.Pid {
+		target, ok := p.Kernel.FindProcess(int(hdr.Pid))
+		if !ok || target.Status() == kernel.Dead {
+			return -abi.ESRCH
+		}
+
+		creds = target.Credentials()
+	}
+
+	if dataAddr == 0 {
+		return 0
+	}
+
+	data := make([]linux.CapUserData, n)
+
+	for i := range data {
+		shift := uint(32 * i)
+
+		data[i] = linux.CapUserData{
+			Effective:   uint32(creds.EffectiveCaps >> shift),
+			Permitted:   uint32(creds.PermittedCaps >> shift),
+			Inheritable: uint32(creds.InheritableCaps >> shift),
+		}
+	}
+
+	if err := p.CopyOut(dataAddr, data); err != nil {
+		return -abi.EFAULT
+	}
+
+	return 0
+}
+
+// sysCapset is capset(2), which a process can only use on itself.
+func sysCapset(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		hdrAddr  = args.Args.R0
+		dataAddr = args.Args.R1
+	)
+
+	hdr, n, errno := capHeader(p, hdrAddr)
+	if errno != 0 {
+		return errno
+	}
+
+	if hdr.Pid != 0 && int(hdr.Pid) != p.Pid {
+		return -abi.EPERM
+	}
+
+	data := make([]linux.CapUserData, n)
+
+	if err := p.CopyIn(dataAddr, data); err != nil {
+		return -abi.EFAULT
+	}
+
+	var permitted, inheritable, effective auth.CapabilitySet
+
+	for i, d := range data {
+		shift := uint(32 * i)
+
+		permitted |= auth.CapabilitySet(d.Permitted) << shift
+		inheritable |= auth.CapabilitySet(d.Inheritable) << shift
+		effective |= auth.CapabilitySet(d.Effective) << shift
+	}
+
+	return updateCredentials(l, p, func(c *auth.Credentials) error {
+		return c.SetCapabilities(
+			permitted&auth.AllCapabilities,
+			inheritable&auth.AllCapabilities,
+			effective&auth.AllCapabilities,
+		)
+	})
+}
+
+func init() {
+	Syscalls[184] = sysCapget
+	Syscalls[185] = sysCapset
+}
@@ -65,8 +65,11 @@ func sysExecve(ctx context.Context, l hclog.Logger, task *kernel.Task, args SysA
 
 	_, err = task.Process.Kernel.SetupProcess(ctx, task.Process, string(path), execArgs, execEnv)
 	if err != nil {
-		if errors.Cause(err) == fs.ErrUnknownPath {
+		switch errors.Cause(err) {
+		case fs.ErrUnknownPath:
 			return -abi.ENOENT
+		case fs.ErrPermission:
+			return -abi.EACCES
 		}
 
 		l.Error("unable to exec process", "error", err, "path", path)
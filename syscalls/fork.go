@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
 	"github.com/evanphx/columbia/kernel"
 	"github.com/evanphx/columbia/log"
 	hclog "github.com/hashicorp/go-hclog"
@@ -22,6 +23,33 @@ func sysFork(ctx context.Context, l hclog.Logger, p *kernel.Task, arg SysArgs) i
 	return int32(child.Pid)
 }
 
+// sysUnshare supports giving the process its own copy of the mount or UTS
+// namespace, which are otherwise shared with the processes it forks. Both
+// take CAP_SYS_ADMIN.
+func sysUnshare(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		flags = args.Args.R0
+	)
+
+	if flags&^(linux.CLONE_NEWNS|linux.CLONE_NEWUTS) != 0 {
+		return -abi.EINVAL
+	}
+
+	if flags != 0 && !capable(p, linux.CAP_SYS_ADMIN) {
+		return -abi.EPERM
+	}
+
+	if flags&linux.CLONE_NEWNS != 0 {
+		p.UnshareMount()
+	}
+
+	if flags&linux.CLONE_NEWUTS != 0 {
+		p.UnshareUTS()
+	}
+
+	return 0
+}
+
 const (
 	WNOHANG = 1
 )
@@ -63,4 +91,5 @@ func sysWait4(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs)
 func init() {
 	Syscalls[2] = sysFork
 	Syscalls[114] = sysWait4
+	Syscalls[310] = sysUnshare
 }
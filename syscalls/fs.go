@@ -7,15 +7,19 @@ import (
 
 	"github.com/evanphx/columbia/abi"
 	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
 	"github.com/evanphx/columbia/fs"
 	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/tty"
 	hclog "github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
 )
 
 func sysOpen(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
 	var (
-		ptr  = args.Args.R0
-		mode = args.Args.R1
+		ptr   = args.Args.R0
+		flags = args.Args.R1
+		perms = args.Args.R2
 	)
 
 	path, err := p.ReadCString(ptr)
@@ -24,22 +28,106 @@ func sysOpen(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs)
 		return -1
 	}
 
-	l.Trace("open file", "path", string(path), "mode", mode)
+	l.Trace("open file", "path", string(path), "flags", flags)
 
-	fd, err := p.OpenFile(ctx, string(path), int(mode))
+	fd, err := p.OpenFile(ctx, string(path), int(flags), int(perms))
 	if err != nil {
-		if err == fs.ErrUnknownPath {
-			return -abi.ENOENT
-		}
+		return fsErrno(l, err)
+	}
 
-		l.Error("error opening file", "error", err)
+	return int32(fd)
+}
 
-		return -abi.ENOSYS
+func sysCreat(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		ptr   = args.Args.R0
+		perms = args.Args.R1
+	)
+
+	path, err := p.ReadCString(ptr)
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	fd, err := p.OpenFile(ctx, string(path), linux.O_CREAT|linux.O_WRONLY|linux.O_TRUNC, int(perms))
+	if err != nil {
+		return fsErrno(l, err)
 	}
 
 	return int32(fd)
 }
 
+// fsErrno converts an error from the filesystem into a syscall return
+// value.
+func fsErrno(l hclog.Logger, err error) int32 {
+	switch errors.Cause(err) {
+	case fs.ErrUnknownPath:
+		return -abi.ENOENT
+	case fs.ErrNotDirectory:
+		return -abi.ENOTDIR
+	case fs.ErrNotSymlink, fs.ErrInvalid:
+		return -abi.EINVAL
+	case fs.ErrReadOnly:
+		return -abi.EROFS
+	case fs.ErrExists:
+		return -abi.EEXIST
+	case fs.ErrNotEmpty:
+		return -abi.ENOTEMPTY
+	case fs.ErrIsDirectory:
+		return -abi.EISDIR
+	case fs.ErrCrossDevice:
+		return -abi.EXDEV
+	case fs.ErrNoSpace:
+		return -abi.ENOSPC
+	case fs.ErrFileTooBig:
+		return -abi.EFBIG
+	case fs.ErrLoop:
+		return -abi.ELOOP
+	case fs.ErrNoDevice:
+		return -abi.ENXIO
+	case fs.ErrInterrupted:
+		return -abi.EINTR
+	case fs.ErrWouldBlock:
+		return -abi.EAGAIN
+	case fs.ErrPermission:
+		return -abi.EACCES
+	case fs.ErrNotPermitted:
+		return -abi.EPERM
+	case tty.ErrHangup:
+		return -abi.EIO
+	case fs.ErrNotImplemented:
+		return -abi.ENOSYS
+	case fs.ErrBusy:
+		return -abi.EBUSY
+	case fs.ErrNotMountPoint:
+		return -abi.EINVAL
+	case fs.ErrUnknownFSType:
+		return -abi.ENODEV
+	case fs.ErrOverflow:
+		return -abi.EOVERFLOW
+	}
+
+	l.Error("filesystem error", "error", err)
+
+	return -abi.EIO
+}
+
+// readPath reads the path at ptr, making it absolute against the cwd.
+func readPath(p *kernel.Task, ptr int32) (string, error) {
+	path, err := p.ReadCString(ptr)
+	if err != nil {
+		return "", err
+	}
+
+	abs := string(path)
+
+	if !filepath.IsAbs(abs) {
+		abs = fs.JoinPath(p.Curwd(), abs)
+	}
+
+	return abs, nil
+}
+
 func sysStat64(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
 	return stat(ctx, l, p, args, true)
 }
@@ -63,33 +151,51 @@ func stat(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs, res
 	abs := string(path)
 
 	if !filepath.IsAbs(abs) {
-		abs = filepath.Join(p.Curwd(), abs)
+		abs = fs.JoinPath(p.Curwd(), abs)
 	}
 
 	l.Trace("syscall/stat", "path", abs)
 
-	var dentry *fs.Dirent
+	sb, err := statPath(ctx, p.Mount, abs, resolve)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = p.CopyOut(buf, sb)
+	if err != nil {
+		l.Error("error copying out stat struct", "error", err)
+		return -kernel.EINVAL
+	}
+
+	return 0
+}
+
+// statPath looks up path in m for the caller in ctx, following a final
+// symlink if resolve is set, and returns its stat(2) result.
+func statPath(ctx context.Context, m *fs.MountNamespace, path string, resolve bool) (linux.Stat, error) {
+	var (
+		dentry *fs.Dirent
+		err    error
+	)
 
 	if resolve {
-		dentry, err = p.Mount.LookupPath(ctx, abs)
+		dentry, err = m.LookupPath(ctx, path)
 	} else {
-		dentry, err = p.Mount.LookupDirent(ctx, abs)
+		dentry, err = m.LookupDirent(ctx, path)
 	}
 	if err != nil {
-		if err == fs.ErrUnknownPath {
-			return -kernel.ENOENT
-		}
-
-		l.Error("error looking up path", "error", err)
-		return -kernel.ENOSYS
+		return linux.Stat{}, err
 	}
 
-	i := dentry.Inode
+	return statInode(ctx, dentry.Inode)
+}
 
+// statInode returns the stat(2) result for i. Blocks counts the 512 byte
+// units the inode actually takes up, as st_blocks does.
+func statInode(ctx context.Context, i *fs.Inode) (linux.Stat, error) {
 	us, err := i.Ops.UnstableAttr(ctx, i)
 	if err != nil {
-		l.Error("unable to retrieve unstable inode attrs", "error", err)
-		return -kernel.ENOSYS
+		return linux.Stat{}, err
 	}
 
 	var mode uint32
@@ -113,24 +219,26 @@ func stat(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs, res
 	sb := linux.Stat{
 		Dev:     uint64(linux.MakeDeviceID(i.StableAttr.DeviceFileMajor, i.StableAttr.DeviceFileMinor)),
 		Ino:     i.StableAttr.InodeID,
+		Nlink:   us.Links,
 		Mode:    mode | uint32(us.Perms),
-		UID:     uint32(us.UserId),
-		GID:     uint32(us.GroupId),
+		UID:     uint32(auth.ShownID(us.UserId)),
+		GID:     uint32(auth.ShownID(us.GroupId)),
 		Size:    us.Size,
 		Blksize: i.StableAttr.BlockSize,
-		Blocks:  int64(us.Size / 512),
+		Blocks:  (us.Usage + 511) / 512,
 		ATime:   us.AccessTime,
 		MTime:   us.ModificationTime,
 		CTime:   us.StatusChangeTime,
 	}
 
-	err = p.CopyOut(buf, sb)
-	if err != nil {
-		l.Error("error copying out stat struct", "error", err)
-		return -kernel.EINVAL
+	// A device file's own number is its rdev, and it lives on the device
+	// of its filesystem.
+	if i.StableAttr.Type == fs.CharacterDevice || i.StableAttr.Type == fs.BlockDevice {
+		sb.Rdev = sb.Dev
+		sb.Dev = i.StableAttr.DeviceID
 	}
 
-	return 0
+	return sb, nil
 }
 
 type direntHeader struct {
@@ -172,10 +280,14 @@ func (d *direntEmitter) EmitEntry(name string, inode *fs.Inode) bool {
 		typ = 6
 	case fs.CharacterDevice:
 		typ = 2
-	case fs.Directory:
+	case fs.Directory, fs.SpecialDirectory:
 		typ = 4
-	case fs.RegularFile:
+	case fs.RegularFile, fs.SpecialFile:
 		typ = 8
+	case fs.Pipe:
+		typ = 1
+	case fs.Socket:
+		typ = 12
 	}
 
 	de := dirent{
@@ -265,18 +377,12 @@ func sysReadlink(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysAr
 
 	dirent, err := p.Mount.LookupDirent(ctx, string(path))
 	if err != nil {
-		if err == fs.ErrUnknownPath {
-			return -abi.ENOENT
-		}
-
-		l.Error("error resolving dirent", "error", err)
-		return -abi.ENOSYS
+		return fsErrno(l, err)
 	}
 
 	target, err := dirent.Inode.Ops.ReadLink(ctx, dirent.Inode)
 	if err != nil {
-		l.Error("error resolving link", "error", err)
-		return -abi.ENOSYS
+		return fsErrno(l, err)
 	}
 
 	if len(target) > int(size) {
@@ -292,8 +398,341 @@ func sysReadlink(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysAr
 	return int32(len(target))
 }
 
+func sysMkdir(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		ptr   = args.Args.R0
+		perms = args.Args.R1
+	)
+
+	path, err := readPath(p, ptr)
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	parent, name, err := p.Mount.LookupParent(ctx, path)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = fs.CheckAccess(ctx, parent.Inode, auth.MayWrite|auth.MayExec)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = fs.CheckWrite(parent)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = parent.Inode.Ops.CreateDirectory(ctx, parent.Inode, name, int(perms)&07777&^p.Umask())
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	return 0
+}
+
+func sysRmdir(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return remove(ctx, l, p, args.Args.R0, true)
+}
+
+func sysUnlink(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return remove(ctx, l, p, args.Args.R0, false)
+}
+
+func remove(ctx context.Context, l hclog.Logger, p *kernel.Task, ptr int32, dir bool) int32 {
+	path, err := readPath(p, ptr)
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	parent, name, err := p.Mount.LookupParent(ctx, path)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = fs.CheckRemove(ctx, parent.Inode, name)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = fs.CheckWrite(parent)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	if dir {
+		err = parent.Inode.Ops.RemoveDirectory(ctx, parent.Inode, name)
+	} else {
+		err = parent.Inode.Ops.Remove(ctx, parent.Inode, name)
+	}
+
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	p.Mount.Invalidate(path)
+
+	return 0
+}
+
+func sysRename(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		oldPtr = args.Args.R0
+		newPtr = args.Args.R1
+	)
+
+	oldPath, err := readPath(p, oldPtr)
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	newPath, err := readPath(p, newPtr)
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	oldParent, oldName, err := p.Mount.LookupParent(ctx, oldPath)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	newParent, newName, err := p.Mount.LookupParent(ctx, newPath)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	if oldParent.Mount != newParent.Mount {
+		return -abi.EXDEV
+	}
+
+	err = checkRename(ctx, oldParent, oldName, newParent, newName)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = fs.CheckWrite(oldParent)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = oldParent.Inode.Ops.Rename(ctx, oldParent.Inode, oldName, newParent.Inode, newName)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	p.Mount.Invalidate(oldPath)
+	p.Mount.Invalidate(newPath)
+
+	return 0
+}
+
+// checkRename checks that the process may move oldName in oldParent to
+// newName in newParent: remove the old entry, and create or replace the
+// new one. A directory moving to a new parent must be writable too, as its
+// ".." changes.
+func checkRename(ctx context.Context, oldParent *fs.Dirent, oldName string, newParent *fs.Dirent, newName string) error {
+	err := fs.CheckRemove(ctx, oldParent.Inode, oldName)
+	if err != nil {
+		return err
+	}
+
+	err = fs.CheckRemove(ctx, newParent.Inode, newName)
+	switch errors.Cause(err) {
+	case nil, fs.ErrUnknownPath:
+		// Nothing is replaced.
+	default:
+		return err
+	}
+
+	if oldParent.Inode == newParent.Inode {
+		return nil
+	}
+
+	source, err := oldParent.Inode.Ops.LookupChild(ctx, oldParent.Inode, oldName)
+	if err != nil {
+		return err
+	}
+
+	if source.StableAttr.Type != fs.Directory {
+		return nil
+	}
+
+	return fs.CheckAccess(ctx, source, auth.MayWrite)
+}
+
+func sysLink(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		oldPtr = args.Args.R0
+		newPtr = args.Args.R1
+	)
+
+	oldPath, err := readPath(p, oldPtr)
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	newPath, err := readPath(p, newPtr)
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	target, err := p.Mount.LookupDirent(ctx, oldPath)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	parent, name, err := p.Mount.LookupParent(ctx, newPath)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	if target.Mount != parent.Mount {
+		return -abi.EXDEV
+	}
+
+	err = fs.CheckAccess(ctx, parent.Inode, auth.MayWrite|auth.MayExec)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = fs.CheckWrite(parent)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = parent.Inode.Ops.CreateHardLink(ctx, parent.Inode, target.Inode, name)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	return 0
+}
+
+func sysSymlink(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		targetPtr = args.Args.R0
+		linkPtr   = args.Args.R1
+	)
+
+	target, err := p.ReadCString(targetPtr)
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	path, err := readPath(p, linkPtr)
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	parent, name, err := p.Mount.LookupParent(ctx, path)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = fs.CheckAccess(ctx, parent.Inode, auth.MayWrite|auth.MayExec)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = fs.CheckWrite(parent)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = parent.Inode.Ops.CreateLink(ctx, parent.Inode, string(target), name)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	return 0
+}
+
+func sysTruncate(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return truncatePath(ctx, l, p, args.Args.R0, int64(args.Args.R1))
+}
+
+// sysTruncate64 takes the length split across two registers, low word
+// first.
+func sysTruncate64(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return truncatePath(ctx, l, p, args.Args.R0, join64(args.Args.R1, args.Args.R2))
+}
+
+func truncatePath(ctx context.Context, l hclog.Logger, p *kernel.Task, ptr int32, size int64) int32 {
+	path, err := readPath(p, ptr)
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	dirent, err := p.Mount.LookupPath(ctx, path)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = fs.CheckAccess(ctx, dirent.Inode, auth.MayWrite)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	err = fs.CheckWrite(dirent)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	return truncate(ctx, l, dirent, size)
+}
+
+func sysFtruncate(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return truncateFd(ctx, l, p, args.Args.R0, int64(args.Args.R1))
+}
+
+func sysFtruncate64(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return truncateFd(ctx, l, p, args.Args.R0, join64(args.Args.R1, args.Args.R2))
+}
+
+func truncateFd(ctx context.Context, l hclog.Logger, p *kernel.Task, fd int32, size int64) int32 {
+	f, ok := p.GetFile(int(fd))
+	if !ok {
+		return -abi.EBADF
+	}
+
+	if _, ok := f.Writer(); !ok || f.Dirent == nil {
+		return -abi.EINVAL
+	}
+
+	return truncate(ctx, l, f.Dirent, size)
+}
+
+func truncate(ctx context.Context, l hclog.Logger, dirent *fs.Dirent, size int64) int32 {
+	if size < 0 {
+		return -abi.EINVAL
+	}
+
+	err := dirent.Inode.Ops.Truncate(ctx, dirent.Inode, size)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	return 0
+}
+
+func join64(lo, hi int32) int64 {
+	return int64(uint64(uint32(lo)) | uint64(uint32(hi))<<32)
+}
+
 func init() {
 	Syscalls[5] = sysOpen
+	Syscalls[8] = sysCreat
+	Syscalls[9] = sysLink
+	Syscalls[10] = sysUnlink
+	Syscalls[38] = sysRename
+	Syscalls[39] = sysMkdir
+	Syscalls[40] = sysRmdir
+	Syscalls[83] = sysSymlink
+	Syscalls[92] = sysTruncate
+	Syscalls[93] = sysFtruncate
+	Syscalls[193] = sysTruncate64
+	Syscalls[194] = sysFtruncate64
 	Syscalls[195] = sysStat64
 	Syscalls[196] = sysLstat64
 	Syscalls[220] = sysGetdents64
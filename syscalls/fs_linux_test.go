@@ -0,0 +1,118 @@
+package syscalls
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/host"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestStatInode(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "stat")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), make([]byte, 8192), 0644))
+	require.NoError(t, os.Link(filepath.Join(dir, "file"), filepath.Join(dir, "hardlink")))
+
+	// A file with a hole is bigger than what it takes up.
+	sparse, err := os.Create(filepath.Join(dir, "sparse"))
+	require.NoError(t, err)
+	require.NoError(t, sparse.Truncate(1<<20))
+	require.NoError(t, sparse.Close())
+
+	hf, err := host.NewHostFS(dir)
+	require.NoError(t, err)
+
+	defer hf.Close()
+
+	root, err := hf.Root()
+	require.NoError(t, err)
+
+	t.Run("reports the link count", func(t *testing.T) {
+		inode, err := root.Ops.LookupChild(ctx, root, "file")
+		require.NoError(t, err)
+
+		sb, err := statInode(ctx, inode)
+		require.NoError(t, err)
+
+		require.Equal(t, uint64(2), sb.Nlink)
+	})
+
+	t.Run("reports blocks used rather than the size", func(t *testing.T) {
+		for _, name := range []string{"file", "sparse"} {
+			var hs unix.Stat_t
+			require.NoError(t, unix.Stat(filepath.Join(dir, name), &hs))
+
+			inode, err := root.Ops.LookupChild(ctx, root, name)
+			require.NoError(t, err)
+
+			sb, err := statInode(ctx, inode)
+			require.NoError(t, err)
+
+			require.Equal(t, hs.Blocks, sb.Blocks, name)
+		}
+	})
+}
+
+func TestUnmappedOwner(t *testing.T) {
+	ctx := context.Background()
+	l := hclog.NewNullLogger()
+
+	dir, err := ioutil.TempDir("", "unmapped")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644))
+
+	// The guest's nobody is mapped, but not whoever owns the file.
+	uids, err := auth.NewIDMap(auth.IDMapEntry{First: auth.OverflowID, HostFirst: os.Getuid() + 1, Count: 1})
+	require.NoError(t, err)
+
+	gids, err := auth.NewIDMap(auth.IDMapEntry{First: auth.OverflowID, HostFirst: os.Getgid() + 1, Count: 1})
+	require.NoError(t, err)
+
+	hf, err := host.NewHostFS(dir)
+	require.NoError(t, err)
+
+	defer hf.Close()
+
+	hf.SetIDMaps(uids, gids)
+
+	root, err := hf.Root()
+	require.NoError(t, err)
+
+	inode, err := root.Ops.LookupChild(ctx, root, "file")
+	require.NoError(t, err)
+
+	t.Run("shows the overflow id", func(t *testing.T) {
+		sb, err := statInode(ctx, inode)
+		require.NoError(t, err)
+
+		require.Equal(t, uint32(auth.OverflowID), sb.UID)
+		require.Equal(t, uint32(auth.OverflowID), sb.GID)
+	})
+
+	t.Run("doesn't make nobody the owner", func(t *testing.T) {
+		nobody := auth.ContextWithCredentials(ctx, auth.New(auth.OverflowID, auth.OverflowID))
+
+		require.Equal(t, int32(-abi.EPERM), chmod(nobody, l, &fs.Dirent{Inode: inode}, 0777))
+
+		fi, err := os.Stat(filepath.Join(dir, "file"))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+	})
+}
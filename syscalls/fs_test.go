@@ -0,0 +1,55 @@
+package syscalls
+
+import (
+	"context"
+	"testing"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/fs/tmpfs"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatPath(t *testing.T) {
+	ctx := context.Background()
+	l := hclog.NewNullLogger()
+
+	root, err := tmpfs.NewTmpFS(tmpfs.Options{}).Root()
+	require.NoError(t, err)
+
+	require.NoError(t, root.Ops.CreateDirectory(ctx, root, "private", 0700))
+
+	private, err := root.Ops.LookupChild(ctx, root, "private")
+	require.NoError(t, err)
+
+	_, err = private.Ops.Create(ctx, private, "file", 0644)
+	require.NoError(t, err)
+
+	require.NoError(t, root.Ops.CreateLink(ctx, root, "file", "dangling"))
+
+	m := fs.NewMountNamespace()
+	m.SetRoot(root)
+
+	user := auth.ContextWithCredentials(ctx, auth.New(1000, 1000))
+
+	t.Run("needs search permission on the directories", func(t *testing.T) {
+		_, err := statPath(user, m, "/private/file", true)
+		require.Equal(t, int32(-abi.EACCES), fsErrno(l, err))
+
+		_, err = statPath(auth.ContextWithCredentials(ctx, auth.New(0, 0)), m, "/private/file", true)
+		require.NoError(t, err)
+	})
+
+	t.Run("reports missing files", func(t *testing.T) {
+		_, err := statPath(user, m, "/missing", true)
+		require.Equal(t, int32(-abi.ENOENT), fsErrno(l, err))
+
+		_, err = statPath(user, m, "/dangling", true)
+		require.Equal(t, int32(-abi.ENOENT), fsErrno(l, err))
+
+		_, err = statPath(user, m, "/dangling", false)
+		require.NoError(t, err)
+	})
+}
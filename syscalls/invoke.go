@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/auth"
 	"github.com/evanphx/columbia/kernel"
 	"github.com/evanphx/columbia/log"
 )
@@ -23,6 +24,10 @@ func (i *Invoker) InvokeSyscall(ctx context.Context, args SysArgs) int32 {
 
 		p.SetInterrupt(cancel)
 
+		// The call acts with the credentials the process has as it's
+		// made, even if it changes them midway.
+		ctx = auth.ContextWithCredentials(ctx, p.Credentials())
+
 		ret := f(ctx, log.L, p, args)
 
 		if p.CheckInterrupt(int64(ret)) {
@@ -10,8 +10,11 @@ import (
 	"github.com/evanphx/columbia/abi"
 	"github.com/evanphx/columbia/abi/linux"
 	"github.com/evanphx/columbia/abi/posix"
+	"github.com/evanphx/columbia/fs"
 	"github.com/evanphx/columbia/kernel"
 	"github.com/evanphx/columbia/log"
+	"github.com/evanphx/columbia/socket"
+	"github.com/evanphx/columbia/tty"
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/pkg/errors"
 )
@@ -59,10 +62,13 @@ func sysWrite(ctx context.Context, l hclog.Logger, task *kernel.Task, args SysAr
 		return -abi.EFAULT
 	}
 
+	if s, ok := socket.FromFile(f); ok {
+		return send(ctx, l, task, f, s, data, nil, socket.ControlMessages{}, 0)
+	}
+
 	n, err := w.Write(data)
 	if err != nil {
-		log.L.Error("error writing data", "error", err)
-		return -abi.EFAULT
+		return fsErrno(l, err)
 	}
 
 	// log.L.Debug("write-data", "pid", task.Pid, "fd", fd, "data", spew.Sdump(data))
@@ -89,7 +95,13 @@ func sysWritev(ctx context.Context, l hclog.Logger, task *kernel.Task, args SysA
 
 	tmp := make([]byte, 8)
 
-	var ret int32
+	// A socket is sent the data in one go, so that a datagram isn't split.
+	s, isSocket := socket.FromFile(f)
+
+	var (
+		ret  int32
+		sent []byte
+	)
 
 	for i := int32(0); i < cnt; i++ {
 		_, err := task.ReadAt(tmp, int64(iov+(i*8)))
@@ -113,9 +125,18 @@ func sysWritev(ctx context.Context, l hclog.Logger, task *kernel.Task, args SysA
 
 		// log.L.Debug("write-data", "pid", task.Pid, "fd", fd, "data", spew.Sdump(data))
 
+		if isSocket {
+			sent = append(sent, data...)
+			continue
+		}
+
 		w.Write(data)
 	}
 
+	if isSocket {
+		return send(ctx, l, task, f, s, sent, nil, socket.ControlMessages{}, 0)
+	}
+
 	return ret
 }
 
@@ -136,17 +157,42 @@ func sysRead(ctx context.Context, l hclog.Logger, task *kernel.Task, args SysArg
 		return -abi.EBADF
 	}
 
+	if s, ok := socket.FromFile(f); ok {
+		data, _, cm, _, err := s.RecvMsg(ctx, int(sz), sendFlags(f, 0))
+		if err != nil {
+			return socketErrno(l, err)
+		}
+
+		cm.Release()
+
+		if err := task.CopyOut(buf, data); err != nil {
+			l.Error("error copying data out", "error", err)
+			return -abi.EFAULT
+		}
+
+		return int32(len(data))
+	}
+
 	tmp := make([]byte, sz)
 
-	n, err := r.Read(tmp)
+	var (
+		n   int
+		err error
+	)
+
+	if cr, ok := f.Handle().(fs.ContextReader); ok {
+		n, err = cr.ReadContext(ctx, tmp, f.NonBlocking)
+	} else {
+		n, err = r.Read(tmp)
+	}
+
 	if err != nil {
 		if err == io.EOF {
 			return 0
 		}
 
 		if n == 0 || err != io.ErrUnexpectedEOF {
-			l.Error("error reading", "error", err, "fd", fd)
-			return -abi.EIO
+			return fsErrno(l, err)
 		}
 	}
 
@@ -218,6 +264,14 @@ func sysIOCTL(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs)
 		return -abi.EBADF
 	}
 
+	if h, ok := file.Handle().(tty.Handle); ok {
+		return ttyIoctl(l, p, h, uint32(cmd), addr)
+	}
+
+	if _, ok := socket.FromFile(file); ok {
+		return socketIoctl(l, p, uint32(cmd), addr)
+	}
+
 	switch cmd {
 	case posix.TIOCGWINSZ:
 		var io getFD
@@ -256,7 +310,7 @@ func sysIOCTL(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs)
 
 		return 0
 	default:
-		return -abi.EINVAL
+		return -abi.ENOTTY
 	}
 }
 
@@ -274,22 +328,46 @@ func sysFcntl(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs)
 
 	switch cmd {
 	case linux.F_SETFD:
-		if val != linux.FD_CLOEXEC {
-			return -abi.EINVAL
+		// FD_CLOEXEC is the descriptor's, so it's set there rather than
+		// on the file, which other descriptors may share.
+		if err := p.SetCloseOnExec(int(fd), val&linux.FD_CLOEXEC != 0); err != nil {
+			return -abi.EBADF
 		}
 
-		file.CloseOnExec = true
-
 		return 0
 	case linux.F_GETFD:
-		if val != linux.FD_CLOEXEC {
-			return -abi.EINVAL
+		cloexec, err := p.CloseOnExec(int(fd))
+		if err != nil {
+			return -abi.EBADF
+		}
+
+		if cloexec {
+			return linux.FD_CLOEXEC
+		}
+
+		return 0
+	case linux.F_GETFL:
+		_, readable := file.Reader()
+		_, writable := file.Writer()
+
+		var flags int32
+
+		switch {
+		case readable && writable:
+			flags = linux.O_RDWR
+		case writable:
+			flags = linux.O_WRONLY
 		}
 
-		if file.CloseOnExec {
-			return 1
+		if file.NonBlocking {
+			flags |= linux.O_NONBLOCK
 		}
 
+		return flags
+	case linux.F_SETFL:
+		// Of the flags F_SETFL can change, only O_NONBLOCK is supported.
+		file.NonBlocking = val&linux.O_NONBLOCK != 0
+
 		return 0
 	}
 
@@ -0,0 +1,99 @@
+package syscalls
+
+import (
+	"context"
+
+	"github.com/evanphx/columbia/kernel"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+func sysGetpid(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return int32(p.Pid)
+}
+
+func sysGetppid(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	parent := p.Parent()
+	if parent == nil {
+		return 0
+	}
+
+	return int32(parent.Pid)
+}
+
+// findProcess returns the process pid refers to, where 0 is p itself.
+func findProcess(p *kernel.Task, pid int32) (*kernel.Process, error) {
+	if pid == 0 {
+		return p.Process, nil
+	}
+
+	proc, ok := p.Kernel.FindProcess(int(pid))
+	if !ok || proc.Status() == kernel.Dead {
+		return nil, kernel.ErrNoProcess
+	}
+
+	return proc, nil
+}
+
+func sysSetpgid(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		pid  = args.Args.R0
+		pgid = args.Args.R1
+	)
+
+	if pgid < 0 {
+		return jobErrno(l, kernel.ErrInvalidGroup)
+	}
+
+	target, err := findProcess(p, pid)
+	if err != nil {
+		return jobErrno(l, err)
+	}
+
+	err = p.SetPgid(target, int(pgid))
+	if err != nil {
+		return jobErrno(l, err)
+	}
+
+	return 0
+}
+
+func sysGetpgrp(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return int32(p.Pgid())
+}
+
+func sysGetpgid(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	proc, err := findProcess(p, args.Args.R0)
+	if err != nil {
+		return jobErrno(l, err)
+	}
+
+	return int32(proc.Pgid())
+}
+
+func sysSetsid(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	sid, err := p.Setsid()
+	if err != nil {
+		return jobErrno(l, err)
+	}
+
+	return int32(sid)
+}
+
+func sysGetsid(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	proc, err := findProcess(p, args.Args.R0)
+	if err != nil {
+		return jobErrno(l, err)
+	}
+
+	return int32(proc.Sid())
+}
+
+func init() {
+	Syscalls[20] = sysGetpid
+	Syscalls[57] = sysSetpgid
+	Syscalls[64] = sysGetppid
+	Syscalls[65] = sysGetpgrp
+	Syscalls[66] = sysSetsid
+	Syscalls[132] = sysGetpgid
+	Syscalls[147] = sysGetsid
+}
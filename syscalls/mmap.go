@@ -5,6 +5,7 @@ import (
 
 	"github.com/evanphx/columbia/abi/linux"
 	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/memory"
 	hclog "github.com/hashicorp/go-hclog"
 )
 
@@ -35,6 +36,10 @@ func sysMmap(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs)
 
 	reg, err := p.Mem.NewRegion(ptr, size)
 	if err != nil {
+		if err == memory.ErrNoAddressSpace {
+			return -kernel.ENOMEM
+		}
+
 		return -kernel.EINVAL
 	}
 
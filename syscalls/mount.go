@@ -0,0 +1,159 @@
+package syscalls
+
+import (
+	"context"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	hclog "github.com/hashicorp/go-hclog"
+
+	// Filesystems available to mount(2)
+	_ "github.com/evanphx/columbia/fs/dev"
+	_ "github.com/evanphx/columbia/fs/proc"
+	_ "github.com/evanphx/columbia/fs/tmpfs"
+)
+
+// readOptionalString reads the string at ptr, treating NULL as empty.
+func readOptionalString(p *kernel.Task, ptr int32) (string, error) {
+	if ptr == 0 {
+		return "", nil
+	}
+
+	str, err := p.ReadCString(ptr)
+	if err != nil {
+		return "", err
+	}
+
+	return string(str), nil
+}
+
+const propagationFlags = linux.MS_SHARED | linux.MS_PRIVATE | linux.MS_SLAVE | linux.MS_UNBINDABLE
+
+func sysMount(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		sourcePtr = args.Args.R0
+		targetPtr = args.Args.R1
+		typePtr   = args.Args.R2
+		flags     = uint32(args.Args.R3)
+		dataPtr   = args.Args.R4
+	)
+
+	if !capable(p, linux.CAP_SYS_ADMIN) {
+		return -abi.EPERM
+	}
+
+	if flags&linux.MS_MGC_MSK == linux.MS_MGC_VAL {
+		flags &^= linux.MS_MGC_MSK
+	}
+
+	target, err := readPath(p, targetPtr)
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	source, err := readOptionalString(p, sourcePtr)
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	mflags := fs.MountFlags{
+		ReadOnly: flags&linux.MS_RDONLY != 0,
+	}
+
+	l.Trace("mount", "source", source, "target", target, "flags", flags)
+
+	switch {
+	case flags&linux.MS_REMOUNT != 0:
+		err = p.Mount.Remount(ctx, target, mflags)
+	case flags&linux.MS_BIND != 0:
+		source, err = readPath(p, sourcePtr)
+		if err != nil {
+			return -abi.EFAULT
+		}
+
+		err = p.Mount.BindMount(ctx, source, target, mflags, flags&linux.MS_REC != 0)
+	case flags&linux.MS_MOVE != 0:
+		return -abi.EINVAL
+	case flags&propagationFlags != 0:
+		// Mounts are never propagated between namespaces, so every mount
+		// is already private.
+		_, err = p.Mount.LookupPath(ctx, target)
+	default:
+		typ, err := readOptionalString(p, typePtr)
+		if err != nil {
+			return -abi.EFAULT
+		}
+
+		data, err := readOptionalString(p, dataPtr)
+		if err != nil {
+			return -abi.EFAULT
+		}
+
+		newFS, err := fs.FindFilesystem(typ)
+		if err != nil {
+			return fsErrno(l, err)
+		}
+
+		root, err := newFS(ctx, source, data)
+		if err != nil {
+			return fsErrno(l, err)
+		}
+
+		err = p.Mount.Mount(ctx, target, &fs.Mount{
+			Root:   root,
+			Flags:  mflags,
+			Source: source,
+			Type:   typ,
+		})
+
+		if err != nil {
+			return fsErrno(l, err)
+		}
+
+		return 0
+	}
+
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	return 0
+}
+
+func sysUmount(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return umount(ctx, l, p, args.Args.R0, 0)
+}
+
+func sysUmount2(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return umount(ctx, l, p, args.Args.R0, args.Args.R1)
+}
+
+func umount(ctx context.Context, l hclog.Logger, p *kernel.Task, ptr, flags int32) int32 {
+	if flags&^(linux.MNT_FORCE|linux.MNT_DETACH|linux.UMOUNT_NOFOLLOW) != 0 {
+		return -abi.EINVAL
+	}
+
+	if !capable(p, linux.CAP_SYS_ADMIN) {
+		return -abi.EPERM
+	}
+
+	target, err := readPath(p, ptr)
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	err = p.Mount.Unmount(ctx, target, flags&linux.MNT_DETACH != 0)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	return 0
+}
+
+func init() {
+	Syscalls[21] = sysMount
+	Syscalls[22] = sysUmount
+	Syscalls[52] = sysUmount2
+}
@@ -0,0 +1,327 @@
+package syscalls
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// readPathAt reads the path at ptr, making it absolute against the
+// directory open on dirfd, or the cwd for AT_FDCWD.
+func readPathAt(p *kernel.Task, dirfd, ptr int32) (string, int32) {
+	path, err := p.ReadCString(ptr)
+	if err != nil {
+		return "", -abi.EFAULT
+	}
+
+	abs := string(path)
+
+	switch {
+	case filepath.IsAbs(abs):
+		return abs, 0
+	case dirfd == linux.AT_FDCWD:
+		return fs.JoinPath(p.Curwd(), abs), 0
+	}
+
+	f, ok := p.GetFile(int(dirfd))
+	if !ok || f.Dirent == nil {
+		return "", -abi.EBADF
+	}
+
+	switch f.Dirent.Inode.StableAttr.Type {
+	case fs.Directory, fs.SpecialDirectory:
+		return fs.JoinPath(f.Dirent.Path(), abs), 0
+	default:
+		return "", -abi.ENOTDIR
+	}
+}
+
+// lookupAt resolves path, following a final symlink if follow is set.
+func lookupAt(ctx context.Context, p *kernel.Task, path string, follow bool) (*fs.Dirent, error) {
+	if follow {
+		return p.Mount.LookupPath(ctx, path)
+	}
+
+	return p.Mount.LookupDirent(ctx, path)
+}
+
+func sysAccess(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return access(ctx, l, p, linux.AT_FDCWD, args.Args.R0, args.Args.R1, 0)
+}
+
+func sysFaccessat(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return access(ctx, l, p, args.Args.R0, args.Args.R1, args.Args.R2, args.Args.R3)
+}
+
+// access checks the path at ptr as access(2) does: with the real ids of
+// the process rather than the ones it acts with, unless AT_EACCESS says
+// otherwise, so a setuid program can check what its user could do.
+func access(ctx context.Context, l hclog.Logger, p *kernel.Task, dirfd, ptr, mode, flags int32) int32 {
+	if mode&^(linux.R_OK|linux.W_OK|linux.X_OK) != 0 {
+		return -abi.EINVAL
+	}
+
+	if flags&^(linux.AT_EACCESS|linux.AT_SYMLINK_NOFOLLOW) != 0 {
+		return -abi.EINVAL
+	}
+
+	path, errno := readPathAt(p, dirfd, ptr)
+	if errno != 0 {
+		return errno
+	}
+
+	if flags&linux.AT_EACCESS == 0 {
+		creds := p.Credentials().Copy()
+		creds.FilesystemUID = creds.RealUID
+		creds.FilesystemGID = creds.RealGID
+
+		// As Linux does, the check is made with all the permitted
+		// capabilities if the real uid is root, and none otherwise.
+		if creds.RealUID == 0 {
+			creds.EffectiveCaps = creds.PermittedCaps
+		} else {
+			creds.EffectiveCaps = 0
+		}
+
+		ctx = auth.ContextWithCredentials(ctx, creds)
+	}
+
+	dirent, err := lookupAt(ctx, p, path, flags&linux.AT_SYMLINK_NOFOLLOW == 0)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	if mode == linux.F_OK {
+		return 0
+	}
+
+	err = fs.CheckAccess(ctx, dirent.Inode, int(mode))
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	if mode&linux.W_OK != 0 {
+		switch dirent.Inode.StableAttr.Type {
+		case fs.RegularFile, fs.Directory, fs.Symlink:
+			err = fs.CheckWrite(dirent)
+			if err != nil {
+				return fsErrno(l, err)
+			}
+		}
+	}
+
+	return 0
+}
+
+func sysChmod(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return chmodAt(ctx, l, p, linux.AT_FDCWD, args.Args.R0, args.Args.R1)
+}
+
+func sysFchmodat(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return chmodAt(ctx, l, p, args.Args.R0, args.Args.R1, args.Args.R2)
+}
+
+func chmodAt(ctx context.Context, l hclog.Logger, p *kernel.Task, dirfd, ptr, mode int32) int32 {
+	path, errno := readPathAt(p, dirfd, ptr)
+	if errno != 0 {
+		return errno
+	}
+
+	dirent, err := p.Mount.LookupPath(ctx, path)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	return chmod(ctx, l, dirent, int(mode))
+}
+
+func sysFchmod(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	f, ok := p.GetFile(int(args.Args.R0))
+	if !ok {
+		return -abi.EBADF
+	}
+
+	if f.Dirent == nil {
+		return -abi.EINVAL
+	}
+
+	return chmod(ctx, l, f.Dirent, int(args.Args.R1))
+}
+
+// chmod changes the permissions of dirent, which only its owner can do.
+// The setgid bit is dropped unless the process is in the file's group.
+func chmod(ctx context.Context, l hclog.Logger, dirent *fs.Dirent, mode int) int32 {
+	inode := dirent.Inode
+
+	err := fs.CheckWrite(dirent)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	attr, err := inode.Ops.UnstableAttr(ctx, inode)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	perms := mode & 07777
+
+	if creds, ok := auth.CredentialsFromContext(ctx); ok {
+		if !creds.IsOwner(attr.UserId) {
+			return -abi.EPERM
+		}
+
+		if !creds.MayKeepSetGID(attr.GroupId) {
+			perms &^= linux.ModeSetGID
+		}
+	}
+
+	err = inode.Ops.SetPermissions(ctx, inode, perms)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	return 0
+}
+
+// toID16 converts an id argument of the calls from before uid_t was 32
+// bits, where (uid16_t)-1 is NoID.
+func toID16(v int32) int {
+	if uint16(v) == 0xffff {
+		return auth.NoID
+	}
+
+	return int(uint16(v))
+}
+
+func sysChown32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return chownAt(ctx, l, p, linux.AT_FDCWD, args.Args.R0, toID(args.Args.R1), toID(args.Args.R2), 0)
+}
+
+func sysLchown32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return chownAt(ctx, l, p, linux.AT_FDCWD, args.Args.R0, toID(args.Args.R1), toID(args.Args.R2), linux.AT_SYMLINK_NOFOLLOW)
+}
+
+func sysChown(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return chownAt(ctx, l, p, linux.AT_FDCWD, args.Args.R0, toID16(args.Args.R1), toID16(args.Args.R2), 0)
+}
+
+func sysLchown(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return chownAt(ctx, l, p, linux.AT_FDCWD, args.Args.R0, toID16(args.Args.R1), toID16(args.Args.R2), linux.AT_SYMLINK_NOFOLLOW)
+}
+
+func sysFchownat(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return chownAt(ctx, l, p, args.Args.R0, args.Args.R1, toID(args.Args.R2), toID(args.Args.R3), args.Args.R4)
+}
+
+func chownAt(ctx context.Context, l hclog.Logger, p *kernel.Task, dirfd, ptr int32, uid, gid int, flags int32) int32 {
+	if flags&^linux.AT_SYMLINK_NOFOLLOW != 0 {
+		return -abi.EINVAL
+	}
+
+	path, errno := readPathAt(p, dirfd, ptr)
+	if errno != 0 {
+		return errno
+	}
+
+	dirent, err := lookupAt(ctx, p, path, flags&linux.AT_SYMLINK_NOFOLLOW == 0)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	return chown(ctx, l, dirent, uid, gid)
+}
+
+func sysFchown32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return fchown(ctx, l, p, args.Args.R0, toID(args.Args.R1), toID(args.Args.R2))
+}
+
+func sysFchown(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return fchown(ctx, l, p, args.Args.R0, toID16(args.Args.R1), toID16(args.Args.R2))
+}
+
+func fchown(ctx context.Context, l hclog.Logger, p *kernel.Task, fd int32, uid, gid int) int32 {
+	f, ok := p.GetFile(int(fd))
+	if !ok {
+		return -abi.EBADF
+	}
+
+	if f.Dirent == nil {
+		return -abi.EINVAL
+	}
+
+	return chown(ctx, l, f.Dirent, uid, gid)
+}
+
+// chown gives dirent to uid and gid, either of which can be NoID to leave
+// it. Anything but a directory stops being setuid, and setgid if that
+// means anything, so a program doesn't run as someone it wasn't made by.
+func chown(ctx context.Context, l hclog.Logger, dirent *fs.Dirent, uid, gid int) int32 {
+	inode := dirent.Inode
+
+	err := fs.CheckWrite(dirent)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	attr, err := inode.Ops.UnstableAttr(ctx, inode)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	if creds, ok := auth.CredentialsFromContext(ctx); ok {
+		if !creds.MayChown(attr.UserId, attr.GroupId, uid, gid) {
+			return -abi.EPERM
+		}
+	}
+
+	err = inode.Ops.SetOwner(ctx, inode, uid, gid)
+	if err != nil {
+		return fsErrno(l, err)
+	}
+
+	switch inode.StableAttr.Type {
+	case fs.Directory, fs.SpecialDirectory, fs.Symlink:
+		return 0
+	}
+
+	perms := attr.Perms &^ linux.ModeSetUID
+
+	if perms&(linux.ModeSetGID|linux.ModeGroupExec) == linux.ModeSetGID|linux.ModeGroupExec {
+		perms &^= linux.ModeSetGID
+	}
+
+	if perms != attr.Perms {
+		err = inode.Ops.SetPermissions(ctx, inode, perms)
+		if err != nil {
+			return fsErrno(l, err)
+		}
+	}
+
+	return 0
+}
+
+func sysUmask(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return int32(p.SetUmask(int(args.Args.R0)))
+}
+
+func init() {
+	Syscalls[15] = sysChmod
+	Syscalls[16] = sysLchown
+	Syscalls[33] = sysAccess
+	Syscalls[60] = sysUmask
+	Syscalls[94] = sysFchmod
+	Syscalls[95] = sysFchown
+	Syscalls[182] = sysChown
+	Syscalls[198] = sysLchown32
+	Syscalls[207] = sysFchown32
+	Syscalls[212] = sysChown32
+	Syscalls[298] = sysFchownat
+	Syscalls[306] = sysFchmodat
+	Syscalls[307] = sysFaccessat
+}
@@ -0,0 +1,208 @@
+package syscalls
+
+import (
+	"context"
+	"time"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/pkg/waiter"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// maxPollFDs caps the descriptors of one poll(2), as RLIMIT_NOFILE does.
+const maxPollFDs = 1024
+
+// pollEvents converts the events of a pollfd into an EventMask. The
+// RDNORM and WRNORM variants mean the same as IN and OUT.
+func pollEvents(events int16) waiter.EventMask {
+	mask := waiter.EventMask(uint16(events))
+
+	if events&linux.POLLRDNORM != 0 {
+		mask |= waiter.EventIn
+	}
+
+	if events&linux.POLLWRNORM != 0 {
+		mask |= waiter.EventOut
+	}
+
+	return mask
+}
+
+// pollRevents reports the events of ready that were asked for in events,
+// along with those that always are.
+func pollRevents(events int16, ready waiter.EventMask) int16 {
+	revents := int16(ready & (waiter.EventMask(uint16(events)) | waiter.EventErr | waiter.EventHUp))
+
+	if ready&waiter.EventIn != 0 && events&linux.POLLRDNORM != 0 {
+		revents |= linux.POLLRDNORM
+	}
+
+	if ready&waiter.EventOut != 0 && events&linux.POLLWRNORM != 0 {
+		revents |= linux.POLLWRNORM
+	}
+
+	return revents
+}
+
+// poll waits for the events of fds, setting their REvents, and returns how
+// many of them are ready. A negative timeout waits indefinitely.
+func poll(ctx context.Context, p *kernel.Task, fds []linux.PollFD, timeout time.Duration) (int, error) {
+	ch := make(chan struct{}, 1)
+
+	var registered []waiter.Waitable
+
+	defer func() {
+		for _, w := range registered {
+			w.EventUnregister(ch)
+		}
+	}()
+
+	// Files that can't be waited on are always ready, as regular files
+	// are on Linux.
+	waitables := make([]waiter.Waitable, len(fds))
+
+	for i, pfd := range fds {
+		if pfd.FD < 0 {
+			continue
+		}
+
+		file, ok := p.GetFile(int(pfd.FD))
+		if !ok {
+			continue
+		}
+
+		if w, ok := file.Handle().(waiter.Waitable); ok {
+			w.EventRegister(ch, pollEvents(pfd.Events))
+			registered = append(registered, w)
+			waitables[i] = w
+		}
+	}
+
+	var timer <-chan time.Time
+
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+
+		timer = t.C
+	}
+
+	for {
+		n := 0
+
+		for i := range fds {
+			pfd := &fds[i]
+			pfd.REvents = 0
+
+			if pfd.FD < 0 {
+				continue
+			}
+
+			switch file, ok := p.GetFile(int(pfd.FD)); {
+			case !ok:
+				pfd.REvents = linux.POLLNVAL
+			case waitables[i] != nil && file.Handle() == waitables[i]:
+				pfd.REvents = pollRevents(pfd.Events, waitables[i].Readiness(pollEvents(pfd.Events)|waiter.EventErr|waiter.EventHUp))
+			default:
+				pfd.REvents = pollRevents(pfd.Events, waiter.EventIn|waiter.EventOut)
+			}
+
+			if pfd.REvents != 0 {
+				n++
+			}
+		}
+
+		if n > 0 || timeout == 0 {
+			return n, nil
+		}
+
+		select {
+		case <-ch:
+		case <-timer:
+			return 0, nil
+		case <-ctx.Done():
+			return 0, fs.ErrInterrupted
+		}
+	}
+}
+
+// pollTask reads the nfds pollfds at addr, polls them and writes back
+// their revents.
+func pollTask(ctx context.Context, l hclog.Logger, p *kernel.Task, addr, nfds int32, timeout time.Duration) int32 {
+	if nfds < 0 || nfds > maxPollFDs {
+		return -abi.EINVAL
+	}
+
+	fds := make([]linux.PollFD, nfds)
+
+	if err := p.CopyIn(addr, fds); err != nil {
+		return -abi.EFAULT
+	}
+
+	n, err := poll(ctx, p, fds, timeout)
+	if err != nil {
+		return -abi.EINTR
+	}
+
+	if err := p.CopyOut(addr, fds); err != nil {
+		return -abi.EFAULT
+	}
+
+	return int32(n)
+}
+
+func sysPoll(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		addr    = args.Args.R0
+		nfds    = args.Args.R1
+		timeout = args.Args.R2
+	)
+
+	dur := time.Duration(-1)
+	if timeout >= 0 {
+		dur = time.Duration(timeout) * time.Millisecond
+	}
+
+	return pollTask(ctx, l, p, addr, nfds, dur)
+}
+
+// pollTimespec is struct timespec on i386.
+type pollTimespec struct {
+	Sec, NSec int32
+}
+
+// sysPpoll is poll(2) with a timespec timeout. The signal mask isn't
+// applied, as signals can't be blocked.
+func sysPpoll(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		addr = args.Args.R0
+		nfds = args.Args.R1
+		tsp  = args.Args.R2
+	)
+
+	dur := time.Duration(-1)
+
+	if tsp != 0 {
+		var ts pollTimespec
+
+		if err := p.CopyIn(tsp, &ts); err != nil {
+			return -abi.EFAULT
+		}
+
+		if ts.Sec < 0 || ts.NSec < 0 || ts.NSec >= 1e9 {
+			return -abi.EINVAL
+		}
+
+		dur = time.Duration(ts.Sec)*time.Second + time.Duration(ts.NSec)
+	}
+
+	return pollTask(ctx, l, p, addr, nfds, dur)
+}
+
+func init() {
+	Syscalls[168] = sysPoll
+	Syscalls[309] = sysPpoll
+}
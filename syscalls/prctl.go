@@ -0,0 +1,103 @@
+package syscalls
+
+import (
+	"context"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/kernel"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// sysPrctl is prctl(2), of which only the capability operations are
+// supported.
+func sysPrctl(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		option = args.Args.R0
+		arg2   = args.Args.R1
+		arg3   = args.Args.R2
+	)
+
+	switch option {
+	case linux.PR_GET_KEEPCAPS:
+		if p.Credentials().KeepCaps {
+			return 1
+		}
+
+		return 0
+
+	case linux.PR_SET_KEEPCAPS:
+		if arg2 != 0 && arg2 != 1 {
+			return -abi.EINVAL
+		}
+
+		return updateCredentials(l, p, func(c *auth.Credentials) error {
+			c.KeepCaps = arg2 == 1
+			return nil
+		})
+
+	case linux.PR_CAPBSET_READ:
+		cp := linux.Capability(arg2)
+		if !cp.Ok() {
+			return -abi.EINVAL
+		}
+
+		if p.Credentials().BoundingCaps.Has(cp) {
+			return 1
+		}
+
+		return 0
+
+	case linux.PR_CAPBSET_DROP:
+		return updateCredentials(l, p, func(c *auth.Credentials) error {
+			return c.DropBoundingCapability(linux.Capability(arg2))
+		})
+
+	case linux.PR_CAP_AMBIENT:
+		return capAmbient(l, p, arg2, linux.Capability(arg3))
+	}
+
+	return -abi.EINVAL
+}
+
+// capAmbient performs the PR_CAP_AMBIENT operation op, on cp for those
+// that take a capability.
+func capAmbient(l hclog.Logger, p *kernel.Task, op int32, cp linux.Capability) int32 {
+	if op == linux.PR_CAP_AMBIENT_CLEAR_ALL {
+		return updateCredentials(l, p, func(c *auth.Credentials) error {
+			c.AmbientCaps = 0
+			return nil
+		})
+	}
+
+	if !cp.Ok() {
+		return -abi.EINVAL
+	}
+
+	switch op {
+	case linux.PR_CAP_AMBIENT_IS_SET:
+		if p.Credentials().AmbientCaps.Has(cp) {
+			return 1
+		}
+
+		return 0
+
+	case linux.PR_CAP_AMBIENT_RAISE:
+		return updateCredentials(l, p, func(c *auth.Credentials) error {
+			return c.RaiseAmbientCapability(cp)
+		})
+
+	case linux.PR_CAP_AMBIENT_LOWER:
+		return updateCredentials(l, p, func(c *auth.Credentials) error {
+			c.AmbientCaps &^= auth.CapabilitySetOf(cp)
+			return nil
+		})
+	}
+
+	return -abi.EINVAL
+}
+
+func init() {
+	Syscalls[172] = sysPrctl
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
 	"github.com/evanphx/columbia/kernel"
 	hclog "github.com/hashicorp/go-hclog"
 )
@@ -36,6 +37,75 @@ func sysRtSigaction(ctx context.Context, l hclog.Logger, p *kernel.Task, args Sy
 	return 0
 }
 
+// toSignal converts a signal number argument, where 0 only checks the
+// target can be signalled.
+func toSignal(v int32) (linux.Signal, bool) {
+	signo := linux.Signal(v)
+	return signo, signo == 0 || signo.IsValid()
+}
+
+func sysKill(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	signo, ok := toSignal(args.Args.R1)
+	if !ok {
+		return -abi.EINVAL
+	}
+
+	if err := p.Kill(int(args.Args.R0), signo); err != nil {
+		return jobErrno(l, err)
+	}
+
+	return 0
+}
+
+// signalThread sends signo to the process tid, for tkill(2) and tgkill(2).
+// Processes have a single thread, whose id is the pid.
+func signalThread(l hclog.Logger, p *kernel.Task, tid int32, signo linux.Signal) int32 {
+	if tid <= 0 {
+		return -abi.EINVAL
+	}
+
+	target, ok := p.Kernel.FindProcess(int(tid))
+	if !ok {
+		return -abi.ESRCH
+	}
+
+	if err := p.Signal(target, signo); err != nil {
+		return jobErrno(l, err)
+	}
+
+	return 0
+}
+
+func sysTkill(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	signo, ok := toSignal(args.Args.R1)
+	if !ok {
+		return -abi.EINVAL
+	}
+
+	return signalThread(l, p, args.Args.R0, signo)
+}
+
+func sysTgkill(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		tgid = args.Args.R0
+		tid  = args.Args.R1
+	)
+
+	signo, ok := toSignal(args.Args.R2)
+	if !ok || tgid <= 0 {
+		return -abi.EINVAL
+	}
+
+	if tgid != tid {
+		return -abi.ESRCH
+	}
+
+	return signalThread(l, p, tid, signo)
+}
+
 func init() {
+	Syscalls[37] = sysKill
 	Syscalls[174] = sysRtSigaction
+	Syscalls[238] = sysTkill
+	Syscalls[270] = sysTgkill
 }
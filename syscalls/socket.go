@@ -0,0 +1,1022 @@
+package syscalls
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/socket"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+
+	// Socket families available to socket(2)
+	_ "github.com/evanphx/columbia/socket/inet"
+	_ "github.com/evanphx/columbia/socket/netlink"
+	_ "github.com/evanphx/columbia/socket/unix"
+)
+
+const (
+	// maxSockaddr is the size of struct sockaddr_storage, the largest
+	// address any family takes.
+	maxSockaddr = 128
+
+	// maxControl caps the ancillary data of a sendmsg(2), as the
+	// optmem_max sysctl does.
+	maxControl = 20480
+)
+
+// socketErrno converts an error from a socket into a syscall return value.
+func socketErrno(l hclog.Logger, err error) int32 {
+	switch errors.Cause(err) {
+	case socket.ErrWouldBlock:
+		return -abi.EAGAIN
+	case socket.ErrNotConnected:
+		return -abi.ENOTCONN
+	case socket.ErrIsConnected:
+		return -abi.EISCONN
+	case socket.ErrConnectionRefused:
+		return -abi.ECONNREFUSED
+	case socket.ErrConnectionReset:
+		return -abi.ECONNRESET
+	case socket.ErrNetworkUnreachable:
+		return -abi.ENETUNREACH
+	case socket.ErrHostUnreachable:
+		return -abi.EHOSTUNREACH
+	case socket.ErrAddressInUse:
+		return -abi.EADDRINUSE
+	case socket.ErrAddressNotAvailable:
+		return -abi.EADDRNOTAVAIL
+	case socket.ErrBrokenPipe:
+		return -abi.EPIPE
+	case socket.ErrMessageSize:
+		return -abi.EMSGSIZE
+	case socket.ErrDestinationRequired:
+		return -abi.EDESTADDRREQ
+	case socket.ErrNotSupported:
+		return -abi.EOPNOTSUPP
+	case socket.ErrFamilyNotSupported:
+		return -abi.EAFNOSUPPORT
+	case socket.ErrTypeNotSupported:
+		return -abi.ESOCKTNOSUPPORT
+	case socket.ErrProtocolNotSupported:
+		return -abi.EPROTONOSUPPORT
+	case socket.ErrNoProtocolOption:
+		return -abi.ENOPROTOOPT
+	case socket.ErrPermission:
+		return -abi.EPERM
+	case socket.ErrWrongType:
+		return -abi.EPROTOTYPE
+	case socket.ErrInProgress:
+		return -abi.EINPROGRESS
+	case socket.ErrAlreadyInProgress:
+		return -abi.EALREADY
+	case socket.ErrAccessDenied:
+		return -abi.EACCES
+	case socket.ErrTimedOut:
+		return -abi.ETIMEDOUT
+	case socket.ErrNoBufferSpace:
+		return -abi.ENOBUFS
+	}
+
+	return fsErrno(l, err)
+}
+
+// getSocket returns the socket open on fd, or the errno for why there
+// isn't one.
+func getSocket(p *kernel.Task, fd int32) (*kernel.File, socket.Socket, int32) {
+	file, ok := p.GetFile(int(fd))
+	if !ok {
+		return nil, nil, -abi.EBADF
+	}
+
+	s, ok := socket.FromFile(file)
+	if !ok {
+		return nil, nil, -abi.ENOTSOCK
+	}
+
+	return file, s, 0
+}
+
+// installSocket opens a descriptor for s with the SOCK_ flags of socket(2)
+// and accept4(2).
+func installSocket(p *kernel.Task, s socket.Socket, flags int32) int32 {
+	file := socket.NewFile(s)
+	file.NonBlocking = flags&linux.SOCK_NONBLOCK != 0
+
+	return int32(p.AddFile(file, flags&linux.SOCK_CLOEXEC != 0))
+}
+
+// splitType separates the type argument of socket(2) into the type and
+// its flags.
+func splitType(typ int32) (int, int32, bool) {
+	flags := typ &^ linux.SOCK_TYPE_MASK
+
+	if flags&^(linux.SOCK_NONBLOCK|linux.SOCK_CLOEXEC) != 0 {
+		return 0, 0, false
+	}
+
+	return int(typ & linux.SOCK_TYPE_MASK), flags, true
+}
+
+// readSockaddr reads the address of size bytes at addr.
+func readSockaddr(p *kernel.Task, addr, size int32) ([]byte, int32) {
+	if size < 0 || size > maxSockaddr {
+		return nil, -abi.EINVAL
+	}
+
+	sa := make([]byte, size)
+
+	if _, err := p.ReadAt(sa, int64(addr)); err != nil {
+		return nil, -abi.EFAULT
+	}
+
+	return sa, 0
+}
+
+// writeSockaddr copies sa out to addr as far as the length at lenAddr
+// allows, and sets the length to the full size of sa, as accept(2) and
+// getsockname(2) do.
+func writeSockaddr(p *kernel.Task, addr, lenAddr int32, sa []byte) int32 {
+	if addr == 0 || lenAddr == 0 {
+		return 0
+	}
+
+	var size int32
+
+	if err := p.CopyIn(lenAddr, &size); err != nil {
+		return -abi.EFAULT
+	}
+
+	if size < 0 {
+		return -abi.EINVAL
+	}
+
+	out := sa
+	if int(size) < len(out) {
+		out = out[:size]
+	}
+
+	if err := p.CopyOut(addr, out); err != nil {
+		return -abi.EFAULT
+	}
+
+	if err := p.CopyOut(lenAddr, int32(len(sa))); err != nil {
+		return -abi.EFAULT
+	}
+
+	return 0
+}
+
+func sysSocket(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		domain   = args.Args.R0
+		typ      = args.Args.R1
+		protocol = args.Args.R2
+	)
+
+	t, flags, ok := splitType(typ)
+	if !ok {
+		return -abi.EINVAL
+	}
+
+	s, err := socket.New(ctx, int(domain), t, int(protocol))
+	if err != nil {
+		return socketErrno(l, err)
+	}
+
+	return installSocket(p, s, flags)
+}
+
+func sysSocketpair(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		domain   = args.Args.R0
+		typ      = args.Args.R1
+		protocol = args.Args.R2
+		sv       = args.Args.R3
+	)
+
+	t, flags, ok := splitType(typ)
+	if !ok {
+		return -abi.EINVAL
+	}
+
+	a, b, err := socket.NewPair(ctx, int(domain), t, int(protocol))
+	if err != nil {
+		return socketErrno(l, err)
+	}
+
+	fds := [2]int32{
+		installSocket(p, a, flags),
+		installSocket(p, b, flags),
+	}
+
+	if err := p.CopyOut(sv, fds); err != nil {
+		p.CloseFile(int(fds[0]))
+		p.CloseFile(int(fds[1]))
+
+		return -abi.EFAULT
+	}
+
+	return 0
+}
+
+func sysBind(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		fd   = args.Args.R0
+		addr = args.Args.R1
+		size = args.Args.R2
+	)
+
+	_, s, errno := getSocket(p, fd)
+	if errno != 0 {
+		return errno
+	}
+
+	sa, errno := readSockaddr(p, addr, size)
+	if errno != 0 {
+		return errno
+	}
+
+	if err := s.Bind(ctx, sa); err != nil {
+		return socketErrno(l, err)
+	}
+
+	return 0
+}
+
+func sysConnect(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		fd   = args.Args.R0
+		addr = args.Args.R1
+		size = args.Args.R2
+	)
+
+	file, s, errno := getSocket(p, fd)
+	if errno != 0 {
+		return errno
+	}
+
+	sa, errno := readSockaddr(p, addr, size)
+	if errno != 0 {
+		return errno
+	}
+
+	if err := s.Connect(ctx, sa, file.NonBlocking); err != nil {
+		return socketErrno(l, err)
+	}
+
+	return 0
+}
+
+func sysListen(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		fd      = args.Args.R0
+		backlog = args.Args.R1
+	)
+
+	_, s, errno := getSocket(p, fd)
+	if errno != 0 {
+		return errno
+	}
+
+	if err := s.Listen(int(backlog)); err != nil {
+		return socketErrno(l, err)
+	}
+
+	return 0
+}
+
+func sysAccept4(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		fd      = args.Args.R0
+		addr    = args.Args.R1
+		lenAddr = args.Args.R2
+		flags   = args.Args.R3
+	)
+
+	if flags&^(linux.SOCK_NONBLOCK|linux.SOCK_CLOEXEC) != 0 {
+		return -abi.EINVAL
+	}
+
+	file, s, errno := getSocket(p, fd)
+	if errno != 0 {
+		return errno
+	}
+
+	conn, err := s.Accept(ctx, file.NonBlocking)
+	if err != nil {
+		return socketErrno(l, err)
+	}
+
+	if addr != 0 {
+		sa, err := conn.PeerName()
+		if err != nil {
+			conn.Close()
+			return socketErrno(l, err)
+		}
+
+		if errno := writeSockaddr(p, addr, lenAddr, sa); errno != 0 {
+			conn.Close()
+			return errno
+		}
+	}
+
+	return installSocket(p, conn, flags)
+}
+
+func sysAccept(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	args.Args.R3 = 0
+	return sysAccept4(ctx, l, p, args)
+}
+
+func sysGetsockname(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return sockName(l, p, args, socket.Socket.SockName)
+}
+
+func sysGetpeername(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return sockName(l, p, args, socket.Socket.PeerName)
+}
+
+func sockName(l hclog.Logger, p *kernel.Task, args SysArgs, name func(socket.Socket) ([]byte, error)) int32 {
+	var (
+		fd      = args.Args.R0
+		addr    = args.Args.R1
+		lenAddr = args.Args.R2
+	)
+
+	_, s, errno := getSocket(p, fd)
+	if errno != 0 {
+		return errno
+	}
+
+	sa, err := name(s)
+	if err != nil {
+		return socketErrno(l, err)
+	}
+
+	return writeSockaddr(p, addr, lenAddr, sa)
+}
+
+func sysGetsockopt(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		fd      = args.Args.R0
+		level   = args.Args.R1
+		name    = args.Args.R2
+		val     = args.Args.R3
+		lenAddr = args.Args.R4
+	)
+
+	_, s, errno := getSocket(p, fd)
+	if errno != 0 {
+		return errno
+	}
+
+	opt, err := s.GetSockOpt(int(level), int(name))
+	if err != nil {
+		return socketErrno(l, err)
+	}
+
+	var size int32
+
+	if err := p.CopyIn(lenAddr, &size); err != nil {
+		return -abi.EFAULT
+	}
+
+	if size < 0 {
+		return -abi.EINVAL
+	}
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, opt)
+
+	buf := out.Bytes()
+
+	if int(size) < len(buf) {
+		buf = buf[:size]
+	}
+
+	if err := p.CopyOut(val, buf); err != nil {
+		return -abi.EFAULT
+	}
+
+	if err := p.CopyOut(lenAddr, int32(len(buf))); err != nil {
+		return -abi.EFAULT
+	}
+
+	return 0
+}
+
+func sysSetsockopt(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		fd    = args.Args.R0
+		level = args.Args.R1
+		name  = args.Args.R2
+		val   = args.Args.R3
+		size  = args.Args.R4
+	)
+
+	_, s, errno := getSocket(p, fd)
+	if errno != 0 {
+		return errno
+	}
+
+	if size < 0 || size > maxControl {
+		return -abi.EINVAL
+	}
+
+	buf := make([]byte, size)
+
+	if _, err := p.ReadAt(buf, int64(val)); err != nil {
+		return -abi.EFAULT
+	}
+
+	if err := s.SetSockOpt(int(level), int(name), buf); err != nil {
+		return socketErrno(l, err)
+	}
+
+	return 0
+}
+
+func sysShutdown(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		fd  = args.Args.R0
+		how = args.Args.R1
+	)
+
+	_, s, errno := getSocket(p, fd)
+	if errno != 0 {
+		return errno
+	}
+
+	switch how {
+	case linux.SHUT_RD, linux.SHUT_WR, linux.SHUT_RDWR:
+	default:
+		return -abi.EINVAL
+	}
+
+	if err := s.Shutdown(int(how)); err != nil {
+		return socketErrno(l, err)
+	}
+
+	return 0
+}
+
+// sendFlags adds MSG_DONTWAIT to flags if the file is nonblocking.
+func sendFlags(file *kernel.File, flags int32) int {
+	if file.NonBlocking {
+		flags |= linux.MSG_DONTWAIT
+	}
+
+	return int(flags)
+}
+
+// send sends data on s, raising SIGPIPE for a broken connection unless
+// MSG_NOSIGNAL is set, as write(2) on a socket does too.
+func send(ctx context.Context, l hclog.Logger, p *kernel.Task, file *kernel.File, s socket.Socket, data, addr []byte, cm socket.ControlMessages, flags int32) int32 {
+	n, err := s.SendMsg(ctx, data, addr, cm, sendFlags(file, flags))
+	if err != nil {
+		if errors.Cause(err) == socket.ErrBrokenPipe && flags&linux.MSG_NOSIGNAL == 0 {
+			p.DeliverSignal(int(linux.SIGPIPE))
+		}
+
+		return socketErrno(l, err)
+	}
+
+	return int32(n)
+}
+
+func sysSendto(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		fd    = args.Args.R0
+		buf   = args.Args.R1
+		size  = args.Args.R2
+		flags = args.Args.R3
+		addr  = args.Args.R4
+		alen  = args.Args.R5
+	)
+
+	file, s, errno := getSocket(p, fd)
+	if errno != 0 {
+		return errno
+	}
+
+	if size < 0 {
+		return -abi.EINVAL
+	}
+
+	var sa []byte
+
+	if addr != 0 {
+		sa, errno = readSockaddr(p, addr, alen)
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	data := make([]byte, size)
+
+	if _, err := p.ReadAt(data, int64(buf)); err != nil {
+		return -abi.EFAULT
+	}
+
+	return send(ctx, l, p, file, s, data, sa, socket.ControlMessages{}, flags)
+}
+
+func sysSend(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	args.Args.R4 = 0
+	args.Args.R5 = 0
+	return sysSendto(ctx, l, p, args)
+}
+
+func sysRecvfrom(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		fd      = args.Args.R0
+		buf     = args.Args.R1
+		size    = args.Args.R2
+		flags   = args.Args.R3
+		addr    = args.Args.R4
+		lenAddr = args.Args.R5
+	)
+
+	file, s, errno := getSocket(p, fd)
+	if errno != 0 {
+		return errno
+	}
+
+	if size < 0 {
+		return -abi.EINVAL
+	}
+
+	data, from, cm, _, err := s.RecvMsg(ctx, int(size), sendFlags(file, flags))
+	if err != nil {
+		return socketErrno(l, err)
+	}
+
+	// There's nowhere for files to go without recvmsg(2).
+	cm.Release()
+
+	// With MSG_TRUNC, a datagram can be longer than the buffer.
+	out := data
+	if len(out) > int(size) {
+		out = out[:size]
+	}
+
+	if err := p.CopyOut(buf, out); err != nil {
+		return -abi.EFAULT
+	}
+
+	if from != nil {
+		if errno := writeSockaddr(p, addr, lenAddr, from); errno != 0 {
+			return errno
+		}
+	}
+
+	return int32(len(data))
+}
+
+func sysRecv(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	args.Args.R4 = 0
+	args.Args.R5 = 0
+	return sysRecvfrom(ctx, l, p, args)
+}
+
+// msghdr is struct msghdr on i386.
+type msghdr struct {
+	Name       uint32
+	NameLen    uint32
+	Iov        uint32
+	IovLen     uint32
+	Control    uint32
+	ControlLen uint32
+	Flags      int32
+}
+
+// cmsghdr is struct cmsghdr on i386. linux.ControlMessageHeader is the
+// 64-bit one.
+type cmsghdr struct {
+	Len   uint32
+	Level int32
+	Type  int32
+}
+
+const (
+	sizeOfMsghdr  = 28
+	sizeOfCmsghdr = 12
+)
+
+// cmsgAlign rounds n up to the alignment of control messages.
+func cmsgAlign(n int) int {
+	return (n + 3) &^ 3
+}
+
+type iovec struct {
+	Base, Len uint32
+}
+
+// readIovecs reads the cnt iovecs at addr, returning them and their total
+// length.
+func readIovecs(p *kernel.Task, addr, cnt uint32) ([]iovec, int, int32) {
+	if cnt > linux.UIO_MAXIOV {
+		return nil, 0, -abi.EMSGSIZE
+	}
+
+	iovs := make([]iovec, cnt)
+	total := 0
+
+	for i := range iovs {
+		if err := p.CopyIn(int32(addr)+int32(i*8), &iovs[i]); err != nil {
+			return nil, 0, -abi.EFAULT
+		}
+
+		total += int(iovs[i].Len)
+	}
+
+	if total < 0 || total > 1<<30 {
+		return nil, 0, -abi.EINVAL
+	}
+
+	return iovs, total, 0
+}
+
+// readControl reads the control messages of a sendmsg(2), taking
+// references to the files of SCM_RIGHTS.
+func readControl(p *kernel.Task, addr, size uint32) (socket.ControlMessages, int32) {
+	var cm socket.ControlMessages
+
+	if size > maxControl {
+		return cm, -abi.ENOBUFS
+	}
+
+	buf := make([]byte, size)
+
+	if _, err := p.ReadAt(buf, int64(addr)); err != nil {
+		return cm, -abi.EFAULT
+	}
+
+	for len(buf) >= sizeOfCmsghdr {
+		length := int(binary.LittleEndian.Uint32(buf))
+		level := int32(binary.LittleEndian.Uint32(buf[4:]))
+		typ := int32(binary.LittleEndian.Uint32(buf[8:]))
+
+		if length < sizeOfCmsghdr || length > len(buf) {
+			cm.Release()
+			return cm, -abi.EINVAL
+		}
+
+		data := buf[sizeOfCmsghdr:length]
+
+		if level == linux.SOL_SOCKET {
+			switch typ {
+			case linux.SCM_RIGHTS:
+				for ; len(data) >= 4; data = data[4:] {
+					fd := int32(binary.LittleEndian.Uint32(data))
+
+					file, ok := p.GetFile(int(fd))
+					if !ok {
+						cm.Release()
+						return cm, -abi.EBADF
+					}
+
+					file.IncRef()
+					cm.Rights = append(cm.Rights, file)
+				}
+			case linux.SCM_CREDENTIALS:
+				if len(data) < linux.SizeOfControlMessageCredentials {
+					cm.Release()
+					return cm, -abi.EINVAL
+				}
+
+				creds := linux.ControlMessageCredentials{
+					PID: int32(binary.LittleEndian.Uint32(data)),
+					UID: binary.LittleEndian.Uint32(data[4:]),
+					GID: binary.LittleEndian.Uint32(data[8:]),
+				}
+
+				// Only a privileged process can claim to be someone
+				// else.
+				own := p.Credentials()
+
+				if creds.PID != int32(p.Pid) || !own.MayClaimUID(int(creds.UID)) || !own.MayClaimGID(int(creds.GID)) {
+					cm.Release()
+					return cm, -abi.EPERM
+				}
+
+				cm.Credentials = &creds
+			default:
+				cm.Release()
+				return cm, -abi.EINVAL
+			}
+		}
+
+		next := cmsgAlign(length)
+		if next > len(buf) {
+			break
+		}
+
+		buf = buf[next:]
+	}
+
+	return cm, 0
+}
+
+func sysSendmsg(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		fd    = args.Args.R0
+		addr  = args.Args.R1
+		flags = args.Args.R2
+	)
+
+	file, s, errno := getSocket(p, fd)
+	if errno != 0 {
+		return errno
+	}
+
+	var msg msghdr
+
+	if err := p.CopyIn(addr, &msg); err != nil {
+		return -abi.EFAULT
+	}
+
+	var sa []byte
+
+	if msg.Name != 0 {
+		sa, errno = readSockaddr(p, int32(msg.Name), int32(msg.NameLen))
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	iovs, total, errno := readIovecs(p, msg.Iov, msg.IovLen)
+	if errno != 0 {
+		return errno
+	}
+
+	data := make([]byte, 0, total)
+
+	for _, iov := range iovs {
+		chunk := make([]byte, iov.Len)
+
+		if _, err := p.ReadAt(chunk, int64(iov.Base)); err != nil {
+			return -abi.EFAULT
+		}
+
+		data = append(data, chunk...)
+	}
+
+	var cm socket.ControlMessages
+
+	if msg.Control != 0 && msg.ControlLen != 0 {
+		cm, errno = readControl(p, msg.Control, msg.ControlLen)
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	return send(ctx, l, p, file, s, data, sa, cm, flags)
+}
+
+// writeControl writes the control messages of a recvmsg(2) into buf,
+// installing the files it has room for. It returns how much of buf was
+// used, and whether anything had to be left out.
+func writeControl(p *kernel.Task, buf []byte, cm socket.ControlMessages, cloexec bool) (int, bool) {
+	used := 0
+	truncated := false
+
+	put := func(typ int32, data []byte) {
+		h := cmsghdr{
+			Len:   uint32(sizeOfCmsghdr + len(data)),
+			Level: linux.SOL_SOCKET,
+			Type:  typ,
+		}
+
+		b := buf[used:]
+
+		binary.LittleEndian.PutUint32(b, h.Len)
+		binary.LittleEndian.PutUint32(b[4:], uint32(h.Level))
+		binary.LittleEndian.PutUint32(b[8:], uint32(h.Type))
+		copy(b[sizeOfCmsghdr:], data)
+
+		used += cmsgAlign(int(h.Len))
+		if used > len(buf) {
+			used = len(buf)
+		}
+	}
+
+	if cm.Credentials != nil {
+		if len(buf)-used < sizeOfCmsghdr+linux.SizeOfControlMessageCredentials {
+			truncated = true
+		} else {
+			data := make([]byte, linux.SizeOfControlMessageCredentials)
+			binary.LittleEndian.PutUint32(data, uint32(cm.Credentials.PID))
+			binary.LittleEndian.PutUint32(data[4:], cm.Credentials.UID)
+			binary.LittleEndian.PutUint32(data[8:], cm.Credentials.GID)
+
+			put(linux.SCM_CREDENTIALS, data)
+		}
+	}
+
+	if len(cm.Rights) > 0 {
+		fit := 0
+		if room := len(buf) - used - sizeOfCmsghdr; room > 0 {
+			fit = room / 4
+		}
+
+		if fit > len(cm.Rights) {
+			fit = len(cm.Rights)
+		}
+
+		// Files there's no room for are closed, as on Linux.
+		for _, file := range cm.Rights[fit:] {
+			file.Close()
+			truncated = true
+		}
+
+		if fit > 0 {
+			data := make([]byte, 4*fit)
+
+			for i, file := range cm.Rights[:fit] {
+				binary.LittleEndian.PutUint32(data[4*i:], uint32(p.AddFile(file, cloexec)))
+			}
+
+			put(linux.SCM_RIGHTS, data)
+		}
+	}
+
+	return used, truncated
+}
+
+func sysRecvmsg(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		fd    = args.Args.R0
+		addr  = args.Args.R1
+		flags = args.Args.R2
+	)
+
+	file, s, errno := getSocket(p, fd)
+	if errno != 0 {
+		return errno
+	}
+
+	var msg msghdr
+
+	if err := p.CopyIn(addr, &msg); err != nil {
+		return -abi.EFAULT
+	}
+
+	iovs, total, errno := readIovecs(p, msg.Iov, msg.IovLen)
+	if errno != 0 {
+		return errno
+	}
+
+	if msg.ControlLen > maxControl {
+		msg.ControlLen = maxControl
+	}
+
+	data, from, cm, msgFlags, err := s.RecvMsg(ctx, total, sendFlags(file, flags))
+	if err != nil {
+		return socketErrno(l, err)
+	}
+
+	rest := data
+
+	for _, iov := range iovs {
+		if len(rest) == 0 {
+			break
+		}
+
+		n := int(iov.Len)
+		if n > len(rest) {
+			n = len(rest)
+		}
+
+		if err := p.CopyOut(int32(iov.Base), rest[:n]); err != nil {
+			cm.Release()
+			return -abi.EFAULT
+		}
+
+		rest = rest[n:]
+	}
+
+	if msg.Name != 0 {
+		if from == nil {
+			msg.NameLen = 0
+		} else {
+			out := from
+			if int(msg.NameLen) < len(out) {
+				out = out[:msg.NameLen]
+			}
+
+			if err := p.CopyOut(int32(msg.Name), out); err != nil {
+				cm.Release()
+				return -abi.EFAULT
+			}
+
+			msg.NameLen = uint32(len(from))
+		}
+	}
+
+	control := make([]byte, msg.ControlLen)
+
+	used, truncated := writeControl(p, control, cm, flags&linux.MSG_CMSG_CLOEXEC != 0)
+	if truncated {
+		msgFlags |= linux.MSG_CTRUNC
+	}
+
+	if used > 0 {
+		if err := p.CopyOut(int32(msg.Control), control[:used]); err != nil {
+			return -abi.EFAULT
+		}
+	}
+
+	msg.ControlLen = uint32(used)
+	msg.Flags = int32(msgFlags)
+
+	if err := p.CopyOut(addr, msg); err != nil {
+		return -abi.EFAULT
+	}
+
+	return int32(len(data))
+}
+
+// socketcallArgs is how many arguments each call of socketcall(2) takes,
+// by its number.
+var socketcallArgs = [...]int{
+	1: 3, 2: 3, 3: 3, 4: 2, 5: 3, 6: 3, 7: 3, 8: 4, 9: 4,
+	10: 4, 11: 6, 12: 6, 13: 2, 14: 5, 15: 5, 16: 3, 17: 3, 18: 4,
+}
+
+var socketcalls = [...]func(context.Context, hclog.Logger, *kernel.Task, SysArgs) int32{
+	1:  sysSocket,
+	2:  sysBind,
+	3:  sysConnect,
+	4:  sysListen,
+	5:  sysAccept,
+	6:  sysGetsockname,
+	7:  sysGetpeername,
+	8:  sysSocketpair,
+	9:  sysSend,
+	10: sysRecv,
+	11: sysSendto,
+	12: sysRecvfrom,
+	13: sysShutdown,
+	14: sysSetsockopt,
+	15: sysGetsockopt,
+	16: sysSendmsg,
+	17: sysRecvmsg,
+	18: sysAccept4,
+}
+
+// sysSocketcall is the multiplexer i386 programs used before the socket
+// calls had their own numbers. The arguments of the call are in an array
+// at args.
+func sysSocketcall(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		call = args.Args.R0
+		addr = args.Args.R1
+	)
+
+	if call < 1 || int(call) >= len(socketcalls) {
+		return -abi.EINVAL
+	}
+
+	vals := make([]int32, 6)
+
+	if err := p.CopyIn(addr, vals[:socketcallArgs[call]]); err != nil {
+		return -abi.EFAULT
+	}
+
+	return socketcalls[call](ctx, l, p, SysArgs{
+		Index: args.Index,
+		Args: SyscallRequest{
+			R0: vals[0],
+			R1: vals[1],
+			R2: vals[2],
+			R3: vals[3],
+			R4: vals[4],
+			R5: vals[5],
+		},
+	})
+}
+
+func init() {
+	Syscalls[102] = sysSocketcall
+
+	Syscalls[359] = sysSocket
+	Syscalls[360] = sysSocketpair
+	Syscalls[361] = sysBind
+	Syscalls[362] = sysConnect
+	Syscalls[363] = sysListen
+	Syscalls[364] = sysAccept4
+	Syscalls[365] = sysGetsockopt
+	Syscalls[366] = sysSetsockopt
+	Syscalls[367] = sysGetsockname
+	Syscalls[368] = sysGetpeername
+	Syscalls[369] = sysSendto
+	Syscalls[370] = sysSendmsg
+	Syscalls[371] = sysRecvfrom
+	Syscalls[372] = sysRecvmsg
+	Syscalls[373] = sysShutdown
+}
@@ -0,0 +1,249 @@
+package syscalls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/netstack"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// ifreq is struct ifreq on i386, whose union is smaller than that of the
+// 64-bit linux.IFReq.
+type ifreq struct {
+	Name [linux.IFNAMSIZ]byte
+	Data [16]byte
+}
+
+// ifconf is struct ifconf on i386.
+type ifconf struct {
+	Len int32
+	Buf uint32
+}
+
+const sizeOfIfreq = 32
+
+func (r *ifreq) name() string {
+	if i := bytes.IndexByte(r.Name[:], 0); i != -1 {
+		return string(r.Name[:i])
+	}
+
+	return string(r.Name[:])
+}
+
+// put writes v over the union.
+func (r *ifreq) put(v interface{}) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, v)
+
+	r.Data = [16]byte{}
+	copy(r.Data[:], buf.Bytes())
+}
+
+// sockaddrIn is the struct sockaddr_in of ip, as the interface ioctls
+// give addresses.
+func sockaddrIn(ip net.IP) linux.SockAddrInet {
+	sa := linux.SockAddrInet{Family: linux.AF_INET}
+	copy(sa.Addr[:], ip.To4())
+
+	return sa
+}
+
+// ipv4Addr returns the first IPv4 address of nic, which is the one the
+// interface ioctls know about.
+func ipv4Addr(nic netstack.NIC) (net.IPNet, bool) {
+	for _, a := range nic.Addrs {
+		if ip4 := a.IP.To4(); ip4 != nil {
+			return net.IPNet{IP: ip4, Mask: a.Mask[len(a.Mask)-net.IPv4len:]}, true
+		}
+	}
+
+	return net.IPNet{}, false
+}
+
+// socketIoctl performs the netdevice(7) ioctls, which describe the
+// interfaces of the kernel's network stack through any socket. The ones
+// that would change an interface take CAP_NET_ADMIN, as they do in Linux,
+// and are refused even then: interfaces are only changed through netlink.
+func socketIoctl(l hclog.Logger, p *kernel.Task, cmd uint32, addr int32) int32 {
+	switch cmd {
+	case linux.SIOCSIFFLAGS, linux.SIOCSIFADDR, linux.SIOCSIFDSTADDR, linux.SIOCSIFBRDADDR,
+		linux.SIOCSIFNETMASK, linux.SIOCSIFMETRIC, linux.SIOCSIFMTU, linux.SIOCSIFNAME,
+		linux.SIOCSIFHWADDR, linux.SIOCSIFTXQLEN, linux.SIOCSIFMAP:
+		if !capable(p, linux.CAP_NET_ADMIN) {
+			return -abi.EPERM
+		}
+
+		l.Debug("unsupported socket ioctl", "cmd", cmd)
+		return -abi.EOPNOTSUPP
+	}
+
+	nics := p.Kernel.Network().NICs()
+
+	if cmd == linux.SIOCGIFCONF {
+		return ifConf(p, nics, addr)
+	}
+
+	switch cmd {
+	case linux.SIOCGIFNAME, linux.SIOCGIFINDEX, linux.SIOCGIFFLAGS, linux.SIOCGIFADDR,
+		linux.SIOCGIFDSTADDR, linux.SIOCGIFBRDADDR, linux.SIOCGIFNETMASK, linux.SIOCGIFMETRIC,
+		linux.SIOCGIFMTU, linux.SIOCGIFHWADDR, linux.SIOCGIFTXQLEN, linux.SIOCGIFMAP:
+	default:
+		l.Debug("unsupported socket ioctl", "cmd", cmd)
+		return -abi.ENOTTY
+	}
+
+	var req ifreq
+
+	if err := p.CopyIn(addr, &req); err != nil {
+		return -abi.EFAULT
+	}
+
+	var (
+		nic   netstack.NIC
+		found bool
+	)
+
+	for _, n := range nics {
+		if cmd == linux.SIOCGIFNAME {
+			found = n.Index == int(binary.LittleEndian.Uint32(req.Data[:]))
+		} else {
+			found = n.Name == req.name()
+		}
+
+		if found {
+			nic = n
+			break
+		}
+	}
+
+	if !found {
+		return -abi.ENODEV
+	}
+
+	a, hasAddr := ipv4Addr(nic)
+
+	switch cmd {
+	case linux.SIOCGIFNAME:
+		req.Name = [linux.IFNAMSIZ]byte{}
+		copy(req.Name[:linux.IFNAMSIZ-1], nic.Name)
+	case linux.SIOCGIFINDEX:
+		req.put(int32(nic.Index))
+	case linux.SIOCGIFFLAGS:
+		flags := linux.IFF_UP | linux.IFF_RUNNING
+
+		if nic.Loopback {
+			flags |= linux.IFF_LOOPBACK
+		} else {
+			flags |= linux.IFF_BROADCAST | linux.IFF_MULTICAST
+		}
+
+		req.put(int16(flags))
+	case linux.SIOCGIFADDR, linux.SIOCGIFDSTADDR:
+		if !hasAddr {
+			return -abi.EADDRNOTAVAIL
+		}
+
+		req.put(sockaddrIn(a.IP))
+	case linux.SIOCGIFNETMASK:
+		if !hasAddr {
+			return -abi.EADDRNOTAVAIL
+		}
+
+		req.put(sockaddrIn(net.IP(a.Mask)))
+	case linux.SIOCGIFBRDADDR:
+		if !hasAddr {
+			return -abi.EADDRNOTAVAIL
+		}
+
+		broadcast := make(net.IP, net.IPv4len)
+
+		if !nic.Loopback {
+			for i := range broadcast {
+				broadcast[i] = a.IP[i] | ^a.Mask[i]
+			}
+		}
+
+		req.put(sockaddrIn(broadcast))
+	case linux.SIOCGIFMETRIC:
+		req.put(int32(0))
+	case linux.SIOCGIFMTU:
+		req.put(int32(nic.MTU))
+	case linux.SIOCGIFTXQLEN:
+		req.put(int32(1000))
+	case linux.SIOCGIFHWADDR:
+		var sa struct {
+			Family uint16
+			Data   [14]byte
+		}
+
+		sa.Family = linux.ARPHRD_ETHER
+		if nic.Loopback {
+			sa.Family = linux.ARPHRD_LOOPBACK
+		}
+
+		copy(sa.Data[:], nic.HardwareAddr)
+		req.put(sa)
+	case linux.SIOCGIFMAP:
+		req.put([16]byte{})
+	}
+
+	if err := p.CopyOut(addr, req); err != nil {
+		return -abi.EFAULT
+	}
+
+	return 0
+}
+
+// ifConf lists the interfaces with an IPv4 address, each as an ifreq with
+// its address, as far as the buffer has room. Without a buffer, it only
+// gives the length needed.
+func ifConf(p *kernel.Task, nics []netstack.NIC, addr int32) int32 {
+	var conf ifconf
+
+	if err := p.CopyIn(addr, &conf); err != nil {
+		return -abi.EFAULT
+	}
+
+	var reqs []ifreq
+
+	for _, nic := range nics {
+		a, ok := ipv4Addr(nic)
+		if !ok {
+			continue
+		}
+
+		var req ifreq
+
+		copy(req.Name[:linux.IFNAMSIZ-1], nic.Name)
+		req.put(sockaddrIn(a.IP))
+
+		reqs = append(reqs, req)
+	}
+
+	if conf.Buf == 0 {
+		conf.Len = int32(len(reqs) * sizeOfIfreq)
+	} else {
+		if n := int(conf.Len) / sizeOfIfreq; n < len(reqs) {
+			reqs = reqs[:n]
+		}
+
+		if len(reqs) > 0 {
+			if err := p.CopyOut(int32(conf.Buf), reqs); err != nil {
+				return -abi.EFAULT
+			}
+		}
+
+		conf.Len = int32(len(reqs) * sizeOfIfreq)
+	}
+
+	if err := p.CopyOut(addr, conf); err != nil {
+		return -abi.EFAULT
+	}
+
+	return 0
+}
@@ -0,0 +1,35 @@
+package syscalls
+
+import (
+	"testing"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/auth"
+	"github.com/evanphx/columbia/kernel"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocketIoctl(t *testing.T) {
+	l := hclog.NewNullLogger()
+
+	k, err := kernel.NewKernel(nil)
+	require.NoError(t, err)
+
+	p := &kernel.Task{Process: k.NewProcess("/")}
+
+	t.Run("needs CAP_NET_ADMIN to change an interface", func(t *testing.T) {
+		p.SetCredentials(auth.New(0, 0))
+
+		for _, cmd := range []uint32{linux.SIOCSIFADDR, linux.SIOCSIFFLAGS, linux.SIOCSIFMTU} {
+			require.Equal(t, int32(-abi.EPERM), socketIoctl(l, p, cmd, 0))
+		}
+
+		creds := auth.New(0, 0)
+		creds.EffectiveCaps |= auth.CapabilitySetOf(linux.CAP_NET_ADMIN)
+		p.SetCredentials(creds)
+
+		require.Equal(t, int32(-abi.EOPNOTSUPP), socketIoctl(l, p, linux.SIOCSIFADDR, 0))
+	})
+}
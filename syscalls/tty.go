@@ -0,0 +1,119 @@
+package syscalls
+
+import (
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/kernel"
+	"github.com/evanphx/columbia/tty"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// jobErrno maps the errors of job control to the errno Linux returns.
+func jobErrno(l hclog.Logger, err error) int32 {
+	switch errors.Cause(err) {
+	case kernel.ErrNoProcess:
+		return -abi.ESRCH
+	case kernel.ErrNotPermitted, tty.ErrOtherSession:
+		return -abi.EPERM
+	case kernel.ErrInvalidGroup:
+		return -abi.EINVAL
+	case tty.ErrNotControlling:
+		return -abi.ENOTTY
+	default:
+		l.Error("job control error", "error", err)
+		return -abi.EINVAL
+	}
+}
+
+// ttyIoctl performs the ioctls of a terminal on h, an open end of one.
+func ttyIoctl(l hclog.Logger, p *kernel.Task, h tty.Handle, cmd uint32, addr int32) int32 {
+	t := h.Terminal()
+
+	var err error
+
+	switch cmd {
+	case linux.TCGETS:
+		termios := t.Termios()
+		err = p.CopyOut(addr, termios.ToTermios())
+	case linux.TCSETS, linux.TCSETSW, linux.TCSETSF:
+		var in linux.Termios
+
+		err = p.CopyIn(addr, &in)
+		if err != nil {
+			break
+		}
+
+		// Output is never queued, so TCSETSW has nothing to wait for.
+		termios := t.Termios()
+		termios.FromTermios(in)
+		t.SetTermios(termios, cmd == linux.TCSETSF)
+	case linux.TIOCGWINSZ:
+		err = p.CopyOut(addr, t.WindowSize())
+	case linux.TIOCSWINSZ:
+		var ws linux.Winsize
+
+		err = p.CopyIn(addr, &ws)
+		if err == nil {
+			t.SetWindowSize(ws)
+		}
+	case linux.TIOCGPGRP:
+		pgid, jerr := t.Foreground(p.Sid())
+		if jerr != nil {
+			return jobErrno(l, jerr)
+		}
+
+		err = p.CopyOut(addr, int32(pgid))
+	case linux.TIOCSPGRP:
+		var pgid int32
+
+		err = p.CopyIn(addr, &pgid)
+		if err != nil {
+			break
+		}
+
+		if jerr := p.SetForeground(t, int(pgid)); jerr != nil {
+			return jobErrno(l, jerr)
+		}
+	case linux.TIOCSCTTY:
+		// The argument is passed by value: 1 steals the terminal from
+		// another session.
+		if jerr := p.SetControllingTerminal(t, addr == 1); jerr != nil {
+			return jobErrno(l, jerr)
+		}
+	case linux.TIOCGSID:
+		if t != p.ControllingTerminal() {
+			return -abi.ENOTTY
+		}
+
+		err = p.CopyOut(addr, int32(t.Session()))
+	case linux.FIONREAD:
+		err = p.CopyOut(addr, int32(t.Readable()))
+	case linux.TIOCGPTN, linux.TIOCSPTLCK:
+		if _, ok := h.(*tty.Master); !ok {
+			return -abi.ENOTTY
+		}
+
+		if cmd == linux.TIOCGPTN {
+			err = p.CopyOut(addr, uint32(t.Index()))
+			break
+		}
+
+		var locked int32
+
+		err = p.CopyIn(addr, &locked)
+		if err == nil {
+			t.SetLocked(locked != 0)
+		}
+	default:
+		l.Debug("unsupported terminal ioctl", "cmd", cmd)
+		return -abi.ENOTTY
+	}
+
+	if err != nil {
+		l.Error("error copying terminal ioctl data", "error", err)
+		return -abi.EFAULT
+	}
+
+	return 0
+}
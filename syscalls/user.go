@@ -3,24 +3,253 @@ package syscalls
 import (
 	"context"
 
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/auth"
 	"github.com/evanphx/columbia/kernel"
 	hclog "github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
 )
 
-func sysGetUID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+// credsErrno maps the errors of changing credentials to the errno Linux
+// returns.
+func credsErrno(l hclog.Logger, err error) int32 {
+	switch errors.Cause(err) {
+	case auth.ErrNotPermitted:
+		return -abi.EPERM
+	case auth.ErrInvalidID, auth.ErrUnknownCapability:
+		return -abi.EINVAL
+	default:
+		l.Error("credentials error", "error", err)
+		return -abi.EINVAL
+	}
+}
+
+// toID converts an id argument, a uid_t, to an id of auth, where -1 is
+// NoID.
+func toID(v int32) int {
+	if v == -1 {
+		return auth.NoID
+	}
+
+	return int(uint32(v))
+}
+
+func updateCredentials(l hclog.Logger, p *kernel.Task, fn func(c *auth.Credentials) error) int32 {
+	if err := p.UpdateCredentials(fn); err != nil {
+		return credsErrno(l, err)
+	}
+
 	return 0
 }
 
+func sysGetUID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return int32(p.Credentials().RealUID)
+}
+
 func sysGetGID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
-	return 0
+	return int32(p.Credentials().RealGID)
+}
+
+func sysGetEUID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return int32(p.Credentials().EffectiveUID)
+}
+
+func sysGetEGID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	return int32(p.Credentials().EffectiveGID)
+}
+
+func sysSetUID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	uid := toID(args.Args.R0)
+
+	return updateCredentials(l, p, func(c *auth.Credentials) error {
+		return c.SetUID(uid)
+	})
 }
 
 func sysSetGID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	gid := toID(args.Args.R0)
+
+	return updateCredentials(l, p, func(c *auth.Credentials) error {
+		return c.SetGID(gid)
+	})
+}
+
+func sysSetREUID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		r = toID(args.Args.R0)
+		e = toID(args.Args.R1)
+	)
+
+	return updateCredentials(l, p, func(c *auth.Credentials) error {
+		return c.SetREUID(r, e)
+	})
+}
+
+func sysSetREGID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		r = toID(args.Args.R0)
+		e = toID(args.Args.R1)
+	)
+
+	return updateCredentials(l, p, func(c *auth.Credentials) error {
+		return c.SetREGID(r, e)
+	})
+}
+
+func sysSetRESUID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		r = toID(args.Args.R0)
+		e = toID(args.Args.R1)
+		s = toID(args.Args.R2)
+	)
+
+	return updateCredentials(l, p, func(c *auth.Credentials) error {
+		return c.SetRESUID(r, e, s)
+	})
+}
+
+func sysSetRESGID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		r = toID(args.Args.R0)
+		e = toID(args.Args.R1)
+		s = toID(args.Args.R2)
+	)
+
+	return updateCredentials(l, p, func(c *auth.Credentials) error {
+		return c.SetRESGID(r, e, s)
+	})
+}
+
+// copyOutIDs writes ids, each to its own address, as getresuid(2) does.
+func copyOutIDs(p *kernel.Task, addrs [3]int32, ids [3]int) int32 {
+	for i, addr := range addrs {
+		if err := p.CopyOut(addr, uint32(ids[i])); err != nil {
+			return -abi.EFAULT
+		}
+	}
+
 	return 0
 }
 
+func sysGetRESUID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	c := p.Credentials()
+
+	return copyOutIDs(p,
+		[3]int32{args.Args.R0, args.Args.R1, args.Args.R2},
+		[3]int{c.RealUID, c.EffectiveUID, c.SavedUID})
+}
+
+func sysGetRESGID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	c := p.Credentials()
+
+	return copyOutIDs(p,
+		[3]int32{args.Args.R0, args.Args.R1, args.Args.R2},
+		[3]int{c.RealGID, c.EffectiveGID, c.SavedGID})
+}
+
+// setfsuid(2) and setfsgid(2) can't fail; they return the id from before
+// whether it was changed or not.
+
+func sysSetFSUID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		uid = toID(args.Args.R0)
+		old int
+	)
+
+	p.UpdateCredentials(func(c *auth.Credentials) error {
+		old = c.SetFSUID(uid)
+		return nil
+	})
+
+	return int32(old)
+}
+
+func sysSetFSGID32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		gid = toID(args.Args.R0)
+		old int
+	)
+
+	p.UpdateCredentials(func(c *auth.Credentials) error {
+		old = c.SetFSGID(gid)
+		return nil
+	})
+
+	return int32(old)
+}
+
+func sysGetGroups32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		size = args.Args.R0
+		addr = args.Args.R1
+	)
+
+	groups := p.Credentials().Groups
+
+	switch {
+	case size < 0:
+		return -abi.EINVAL
+	case size == 0:
+		return int32(len(groups))
+	case int(size) < len(groups):
+		return -abi.EINVAL
+	}
+
+	out := make([]uint32, len(groups))
+
+	for i, g := range groups {
+		out[i] = uint32(g)
+	}
+
+	if err := p.CopyOut(addr, out); err != nil {
+		return -abi.EFAULT
+	}
+
+	return int32(len(groups))
+}
+
+func sysSetGroups32(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		size = args.Args.R0
+		addr = args.Args.R1
+	)
+
+	if size < 0 || size > auth.MaxGroups {
+		return -abi.EINVAL
+	}
+
+	in := make([]uint32, size)
+
+	if err := p.CopyIn(addr, in); err != nil {
+		return -abi.EFAULT
+	}
+
+	groups := make([]int, size)
+
+	for i, g := range in {
+		groups[i] = int(g)
+	}
+
+	return updateCredentials(l, p, func(c *auth.Credentials) error {
+		return c.SetGroups(groups)
+	})
+}
+
 func init() {
 	Syscalls[199] = sysGetUID32
 	Syscalls[200] = sysGetGID32
+	Syscalls[201] = sysGetEUID32
+	Syscalls[202] = sysGetEGID32
+	Syscalls[203] = sysSetREUID32
+	Syscalls[204] = sysSetREGID32
+	Syscalls[205] = sysGetGroups32
+	Syscalls[206] = sysSetGroups32
+	Syscalls[208] = sysSetRESUID32
+	Syscalls[209] = sysGetRESUID32
+	Syscalls[210] = sysSetRESGID32
+	Syscalls[211] = sysGetRESGID32
+	Syscalls[213] = sysSetUID32
 	Syscalls[214] = sysSetGID32
+	Syscalls[215] = sysSetFSUID32
+	Syscalls[216] = sysSetFSGID32
 }
@@ -0,0 +1,85 @@
+package syscalls
+
+import (
+	"context"
+
+	"github.com/evanphx/columbia/abi"
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/kernel"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+func sysUname(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		addr = args.Args.R0
+	)
+
+	err := p.CopyOut(addr, p.UTSNamespace().UtsName())
+	if err != nil {
+		return -abi.EFAULT
+	}
+
+	return 0
+}
+
+// readUTSName reads the name sethostname(2) and setdomainname(2) are
+// given, which isn't NUL terminated.
+func readUTSName(p *kernel.Task, addr, size int32) (string, int32) {
+	if size < 0 || size > linux.UTSLen {
+		return "", -abi.EINVAL
+	}
+
+	name := make([]byte, size)
+
+	if _, err := p.ReadAt(name, int64(addr)); err != nil {
+		return "", -abi.EFAULT
+	}
+
+	return string(name), 0
+}
+
+func sysSetHostname(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		addr = args.Args.R0
+		size = args.Args.R1
+	)
+
+	if !capable(p, linux.CAP_SYS_ADMIN) {
+		return -abi.EPERM
+	}
+
+	name, errno := readUTSName(p, addr, size)
+	if errno != 0 {
+		return errno
+	}
+
+	p.UTSNamespace().SetHostName(name)
+
+	return 0
+}
+
+func sysSetDomainname(ctx context.Context, l hclog.Logger, p *kernel.Task, args SysArgs) int32 {
+	var (
+		addr = args.Args.R0
+		size = args.Args.R1
+	)
+
+	if !capable(p, linux.CAP_SYS_ADMIN) {
+		return -abi.EPERM
+	}
+
+	name, errno := readUTSName(p, addr, size)
+	if errno != 0 {
+		return errno
+	}
+
+	p.UTSNamespace().SetDomainName(name)
+
+	return 0
+}
+
+func init() {
+	Syscalls[74] = sysSetHostname
+	Syscalls[121] = sysSetDomainname
+	Syscalls[122] = sysUname
+}
@@ -0,0 +1,246 @@
+package tty
+
+import (
+	"context"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/pkg/waiter"
+)
+
+// Handle is implemented by the open ends of a terminal, giving ioctl(2)
+// the terminal to work on.
+type Handle interface {
+	Terminal() *Terminal
+}
+
+// Master is the open master end of a pty. Writing to it is typing at the
+// terminal, and reading from it shows what the terminal displays.
+type Master struct {
+	t *Terminal
+}
+
+// NewPTY creates a pty numbered index and returns its master, which owns
+// the terminal. See New for signaler and release.
+func NewPTY(signaler Signaler, index int, release func()) *Master {
+	return &Master{t: New(signaler, index, release)}
+}
+
+func (m *Master) Terminal() *Terminal {
+	return m.t
+}
+
+// Read returns what the terminal has displayed, waiting for something to
+// be. Once every slave has been closed it fails with ErrHangup, as reading
+// a Linux master fails with EIO.
+func (m *Master) Read(b []byte) (int, error) {
+	return m.ReadContext(context.Background(), b, false)
+}
+
+// ReadContext is Read, waiting through ctx, or failing with
+// fs.ErrWouldBlock if nonBlocking is set and nothing has been displayed.
+func (m *Master) ReadContext(ctx context.Context, b []byte, nonBlocking bool) (int, error) {
+	t := m.t
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(t.output) == 0 {
+		if t.slaveClosed && t.slaves == 0 {
+			return 0, ErrHangup
+		}
+
+		if nonBlocking {
+			return 0, fs.ErrWouldBlock
+		}
+
+		if err := t.wait(ctx, m, waiter.EventIn); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, t.output)
+	t.output = t.output[n:]
+
+	// A slave waiting for room can write again.
+	t.broadcast()
+
+	return n, nil
+}
+
+// Write types b at the terminal.
+func (m *Master) Write(b []byte) (int, error) {
+	t := m.t
+
+	t.mu.Lock()
+	signals := t.receive(b)
+	fg := t.foreground
+	t.mu.Unlock()
+
+	for _, signo := range signals {
+		t.signal(fg, signo)
+	}
+
+	return len(b), nil
+}
+
+// Readiness reports the master readable once the terminal has displayed
+// something, and hung up once every slave has been closed.
+func (m *Master) Readiness(mask waiter.EventMask) waiter.EventMask {
+	t := m.t
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ready := waiter.EventOut
+
+	if len(t.output) > 0 {
+		ready |= waiter.EventIn
+	}
+
+	if t.slaveClosed && t.slaves == 0 {
+		ready |= waiter.EventIn | waiter.EventHUp
+	}
+
+	return ready & mask
+}
+
+func (m *Master) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	m.t.q.EventRegister(ch, mask)
+}
+
+func (m *Master) EventUnregister(ch chan struct{}) {
+	m.t.q.EventUnregister(ch)
+}
+
+func (m *Master) Seek(offset int64, whence int) (int64, error) {
+	return 0, fs.ErrInvalid
+}
+
+// Close hangs up the terminal: the slave reads the end of file, writing to
+// it fails, and the foreground process group is sent SIGHUP.
+func (m *Master) Close() error {
+	t := m.t
+
+	t.mu.Lock()
+
+	if !t.masterOpen {
+		t.mu.Unlock()
+		return nil
+	}
+
+	t.masterOpen = false
+	fg := t.foreground
+	release := t.release
+
+	t.broadcast()
+	t.mu.Unlock()
+
+	t.signal(fg, linux.SIGHUP)
+
+	if release != nil {
+		release()
+	}
+
+	return nil
+}
+
+// Slave is an open slave end of a pty, which is the terminal as the
+// programs using it see it.
+type Slave struct {
+	t      *Terminal
+	closed bool
+}
+
+// OpenSlave opens the slave end of t. It fails with ErrHangup if the slave
+// is locked or the master has been closed.
+func OpenSlave(t *Terminal) (*Slave, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.locked || !t.masterOpen {
+		return nil, ErrHangup
+	}
+
+	t.slaves++
+
+	return &Slave{t: t}, nil
+}
+
+func (s *Slave) Terminal() *Terminal {
+	return s.t
+}
+
+func (s *Slave) Read(b []byte) (int, error) {
+	return s.t.read(context.Background(), s, b, false)
+}
+
+// ReadContext is Read, waiting for input through ctx, or failing with
+// fs.ErrWouldBlock if nonBlocking is set and there's none.
+func (s *Slave) ReadContext(ctx context.Context, b []byte, nonBlocking bool) (int, error) {
+	return s.t.read(ctx, s, b, nonBlocking)
+}
+
+// Write displays b on the terminal, waiting for the master to read what's
+// already displayed if there's too much of it.
+func (s *Slave) Write(b []byte) (int, error) {
+	return s.t.write(s, b)
+}
+
+// Readiness reports the slave readable once there's input, which in
+// canonical mode is once a line is finished, writable while the output
+// has room, and hung up once the master has been closed.
+func (s *Slave) Readiness(mask waiter.EventMask) waiter.EventMask {
+	t := s.t
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ready waiter.EventMask
+
+	if len(t.input) > 0 {
+		ready |= waiter.EventIn
+	}
+
+	if !t.masterOpen {
+		ready |= waiter.EventIn | waiter.EventHUp
+	} else if len(t.output) < bufferSize {
+		ready |= waiter.EventOut
+	}
+
+	return ready & mask
+}
+
+func (s *Slave) EventRegister(ch chan struct{}, mask waiter.EventMask) {
+	s.t.q.EventRegister(ch, mask)
+}
+
+func (s *Slave) EventUnregister(ch chan struct{}) {
+	s.t.q.EventUnregister(ch)
+}
+
+func (s *Slave) Seek(offset int64, whence int) (int64, error) {
+	return 0, fs.ErrInvalid
+}
+
+func (s *Slave) Close() error {
+	t := s.t
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+
+	t.slaves--
+	if t.slaves == 0 {
+		t.slaveClosed = true
+	}
+
+	t.broadcast()
+
+	return nil
+}
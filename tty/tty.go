@@ -0,0 +1,690 @@
+// Package tty implements terminals: the line discipline that turns what's
+// typed into what's read, and the pseudo-terminal pairs that connect it to
+// a program playing the part of the keyboard and screen.
+package tty
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/pkg/waiter"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrHangup is returned for I/O on a terminal whose other end has been
+	// closed, or whose slave end is still locked.
+	ErrHangup = errors.New("terminal hung up")
+
+	// ErrNotControlling is returned for job control on a terminal that
+	// isn't the controlling terminal of the caller's session.
+	ErrNotControlling = errors.New("not a controlling terminal")
+
+	// ErrOtherSession is returned when the terminal or process group
+	// belongs to another session.
+	ErrOtherSession = errors.New("belongs to another session")
+)
+
+const (
+	// maxLine is the most a canonical line holds, as on Linux. Characters
+	// typed beyond it are dropped.
+	maxLine = 4096
+
+	// bufferSize is N_TTY_BUF_SIZE, the most input and output a terminal
+	// holds. Input beyond it is dropped, and the slave's writes wait for
+	// the master to read.
+	bufferSize = 4096
+)
+
+// Signaler delivers the signals a terminal generates to the processes in
+// a process group.
+type Signaler interface {
+	SignalGroup(pgid int, signo linux.Signal)
+}
+
+// Terminal is the state of a terminal shared by both ends of a pty: the
+// termios settings, the line discipline's queues and the session it
+// controls.
+type Terminal struct {
+	mu sync.Mutex
+
+	// q is notified as the terminal changes, for poll(2) and the reads
+	// waiting on it.
+	q waiter.Queue
+
+	signaler Signaler
+	index    int
+
+	termios linux.KernelTermios
+	winsize linux.Winsize
+
+	// session is the session the terminal controls, and foreground the
+	// process group that reads from it and receives its signals. Both
+	// are 0 until a session takes the terminal.
+	session    int
+	foreground int
+
+	// input holds what the slave can read. In canonical mode each chunk
+	// is a line, and an empty one is an end of file.
+	input [][]byte
+
+	// line is the canonical line being edited.
+	line []byte
+
+	// output holds what the master can read.
+	output []byte
+
+	// interrupts counts the signals generated from input, so that readers
+	// blocked when one is typed give up.
+	interrupts int
+
+	masterOpen  bool
+	slaves      int
+	slaveClosed bool
+	locked      bool
+
+	// release is called once the master is closed.
+	release func()
+}
+
+// New returns a terminal with Linux's default settings for a pty slave,
+// numbered index. Signals it generates go to signaler, which may be nil.
+// release, if set, is called once the master has been closed.
+func New(signaler Signaler, index int, release func()) *Terminal {
+	return &Terminal{
+		signaler:   signaler,
+		index:      index,
+		termios:    linux.DefaultSlaveTermios,
+		masterOpen: true,
+		locked:     true,
+		release:    release,
+	}
+}
+
+// Index is the number of the terminal, as in /dev/pts/N.
+func (t *Terminal) Index() int {
+	return t.index
+}
+
+func (t *Terminal) Termios() linux.KernelTermios {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.termios
+}
+
+// SetTermios changes the settings of the terminal, first discarding
+// unread input if flush is set.
+func (t *Terminal) SetTermios(termios linux.KernelTermios, flush bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if flush {
+		t.input = nil
+		t.line = nil
+	}
+
+	// A line being edited becomes readable when canonical mode is left.
+	if t.termios.LEnabled(linux.ICANON) && termios.LocalFlags&linux.ICANON == 0 && len(t.line) > 0 {
+		t.input = append(t.input, t.line)
+		t.line = nil
+	}
+
+	t.termios = termios
+
+	t.broadcast()
+}
+
+// FlushInput discards input that hasn't been read.
+func (t *Terminal) FlushInput() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.input = nil
+	t.line = nil
+}
+
+// Readable returns how many bytes the slave can read right away.
+func (t *Terminal) Readable() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.readable()
+}
+
+// readable is Readable with t.mu held.
+func (t *Terminal) readable() int {
+	n := 0
+
+	for _, chunk := range t.input {
+		n += len(chunk)
+	}
+
+	return n
+}
+
+// full reports whether there's no room for another character of input,
+// counting the line being edited. A canonical line keeps room for the
+// character that finishes it unless terminating is set.
+func (t *Terminal) full(terminating bool) bool {
+	n := t.readable() + len(t.line)
+
+	if t.termios.LEnabled(linux.ICANON) && !terminating {
+		n++
+	}
+
+	return n >= bufferSize
+}
+
+// drop is what happens to a character there's no room for: it's lost,
+// and with IMAXBEL the bell rings.
+func (t *Terminal) drop() {
+	if t.termios.IEnabled(linux.IMAXBEL) {
+		t.emit('\a')
+	}
+}
+
+func (t *Terminal) WindowSize() linux.Winsize {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.winsize
+}
+
+// SetWindowSize changes the size of the terminal, telling the foreground
+// process group with SIGWINCH if it's different.
+func (t *Terminal) SetWindowSize(ws linux.Winsize) {
+	t.mu.Lock()
+
+	changed := ws != t.winsize
+	t.winsize = ws
+	fg := t.foreground
+
+	t.mu.Unlock()
+
+	if changed {
+		t.signal(fg, linux.SIGWINCH)
+	}
+}
+
+// SetLocked locks or unlocks the slave end. Like the Linux ptmx, the slave
+// starts out locked, so unlockpt(3) must be called before it's opened.
+func (t *Terminal) SetLocked(locked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.locked = locked
+}
+
+// Session returns the session the terminal controls, or 0.
+func (t *Terminal) Session() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.session
+}
+
+// SetSession makes the terminal the controlling terminal of session, with
+// pgid in the foreground. A terminal controlling another session can only
+// be taken with steal.
+func (t *Terminal) SetSession(session, pgid int, steal bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.session != 0 && t.session != session && !steal {
+		return ErrOtherSession
+	}
+
+	t.session = session
+	t.foreground = pgid
+
+	return nil
+}
+
+// ReleaseSession stops the terminal controlling session, as when its
+// leader exits.
+func (t *Terminal) ReleaseSession(session int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.session == session {
+		t.session = 0
+		t.foreground = 0
+	}
+}
+
+// Foreground returns the foreground process group of session, which must
+// be the one the terminal controls.
+func (t *Terminal) Foreground(session int) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.session == 0 || t.session != session {
+		return 0, ErrNotControlling
+	}
+
+	return t.foreground, nil
+}
+
+// SetForeground puts pgid, a process group of session, in the foreground.
+func (t *Terminal) SetForeground(session, pgid int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.session == 0 || t.session != session {
+		return ErrNotControlling
+	}
+
+	t.foreground = pgid
+
+	return nil
+}
+
+// broadcast wakes everything waiting for the state of the terminal to
+// change. t.mu must be held.
+func (t *Terminal) broadcast() {
+	t.q.Notify(waiter.EventIn | waiter.EventOut | waiter.EventHUp)
+}
+
+func (t *Terminal) signal(pgid int, signo linux.Signal) {
+	if t.signaler != nil && pgid != 0 {
+		t.signaler.SignalGroup(pgid, signo)
+	}
+}
+
+// signalChars are the control characters that generate signals with ISIG.
+var signalChars = []struct {
+	idx   int
+	signo linux.Signal
+}{
+	{linux.VINTR, linux.SIGINT},
+	{linux.VQUIT, linux.SIGQUIT},
+	{linux.VSUSP, linux.SIGTSTP},
+}
+
+// receive runs what the master wrote through the line discipline. Signals
+// it generates are returned to be sent once the lock is released.
+func (t *Terminal) receive(b []byte) []linux.Signal {
+	var signals []linux.Signal
+
+	for _, c := range b {
+		if signo, ok := t.receiveByte(c); ok {
+			signals = append(signals, signo)
+		}
+	}
+
+	t.broadcast()
+
+	return signals
+}
+
+func (t *Terminal) receiveByte(c byte) (linux.Signal, bool) {
+	tio := &t.termios
+	cc := &tio.ControlCharacters
+
+	if tio.IEnabled(linux.ISTRIP) {
+		c &= 0x7f
+	}
+
+	switch {
+	case c == '\r' && tio.IEnabled(linux.IGNCR):
+		return 0, false
+	case c == '\r' && tio.IEnabled(linux.ICRNL):
+		c = '\n'
+	case c == '\n' && tio.IEnabled(linux.INLCR):
+		c = '\r'
+	}
+
+	isChar := func(idx int) bool {
+		return cc[idx] != 0 && c == cc[idx]
+	}
+
+	if tio.LEnabled(linux.ISIG) {
+		for _, sig := range signalChars {
+			if isChar(sig.idx) {
+				if !tio.LEnabled(linux.NOFLSH) {
+					t.input = nil
+					t.line = nil
+				}
+
+				t.echo(c)
+				t.interrupts++
+
+				return sig.signo, true
+			}
+		}
+	}
+
+	if !tio.LEnabled(linux.ICANON) {
+		if t.full(false) {
+			t.drop()
+			return 0, false
+		}
+
+		t.echo(c)
+
+		if n := len(t.input); n > 0 {
+			t.input[n-1] = append(t.input[n-1], c)
+		} else {
+			t.input = append(t.input, []byte{c})
+		}
+
+		return 0, false
+	}
+
+	switch {
+	case isChar(linux.VERASE):
+		t.erase(1)
+	case isChar(linux.VKILL):
+		t.erase(len(t.line))
+
+		if !tio.LEnabled(linux.ECHOKE) && tio.LEnabled(linux.ECHOK) {
+			t.echo(c)
+			t.echo('\n')
+		}
+	case isChar(linux.VWERASE) && tio.LEnabled(linux.IEXTEN):
+		t.erase(wordLen(t.line))
+	case isChar(linux.VEOF):
+		// The line is finished without the character, and an empty one
+		// reads as the end of file.
+		t.input = append(t.input, t.line)
+		t.line = nil
+	case tio.IsTerminating(rune(c)):
+		if t.full(true) {
+			t.drop()
+			break
+		}
+
+		t.line = append(t.line, c)
+		t.input = append(t.input, t.line)
+		t.line = nil
+
+		if c == '\n' && tio.LEnabled(linux.ECHONL) && !tio.LEnabled(linux.ECHO) {
+			t.emit(t.process([]byte{c})...)
+		}
+
+		t.echo(c)
+	case len(t.line) >= maxLine || t.full(false):
+		t.drop()
+	default:
+		t.line = append(t.line, c)
+		t.echo(c)
+	}
+
+	return 0, false
+}
+
+// wordLen returns how much of line VWERASE erases: the last word and the
+// blanks after it.
+func wordLen(line []byte) int {
+	i := len(line)
+
+	for i > 0 && (line[i-1] == ' ' || line[i-1] == '\t') {
+		i--
+	}
+
+	for i > 0 && line[i-1] != ' ' && line[i-1] != '\t' {
+		i--
+	}
+
+	return len(line) - i
+}
+
+// erase removes n characters from the end of the line being edited,
+// rubbing them out on the screen if ECHOE is set.
+func (t *Terminal) erase(n int) {
+	if n > len(t.line) {
+		n = len(t.line)
+	}
+
+	rubout := t.termios.LEnabled(linux.ECHO) && t.termios.LEnabled(linux.ECHOE)
+
+	for i := 0; i < n; i++ {
+		c := t.line[len(t.line)-1]
+		t.line = t.line[:len(t.line)-1]
+
+		if !rubout {
+			continue
+		}
+
+		width := 1
+		if t.termios.LEnabled(linux.ECHOCTL) && isControl(c) {
+			width = 2
+		}
+
+		for j := 0; j < width; j++ {
+			t.emit('\b', ' ', '\b')
+		}
+	}
+}
+
+// isControl reports whether ECHOCTL shows c as ^X.
+func isControl(c byte) bool {
+	return (c < 0x20 && c != '\t' && c != '\n') || c == 0x7f
+}
+
+// echo shows c on the screen, if ECHO is set.
+func (t *Terminal) echo(c byte) {
+	if !t.termios.LEnabled(linux.ECHO) {
+		return
+	}
+
+	if t.termios.LEnabled(linux.ECHOCTL) && isControl(c) {
+		t.emit('^', c^0x40)
+		return
+	}
+
+	t.emit(t.process([]byte{c})...)
+}
+
+// emit puts b in the output for the master if there's room for it, as
+// echoes are lost when the master isn't reading.
+func (t *Terminal) emit(b ...byte) {
+	if len(t.output)+len(b) <= bufferSize {
+		t.output = append(t.output, b...)
+	}
+}
+
+// process applies the output settings to what's on its way to the
+// master.
+func (t *Terminal) process(b []byte) []byte {
+	if !t.termios.OEnabled(linux.OPOST) {
+		return b
+	}
+
+	out := make([]byte, 0, len(b))
+
+	for _, c := range b {
+		switch {
+		case c == '\n' && t.termios.OEnabled(linux.ONLCR):
+			out = append(out, '\r', '\n')
+		case c == '\r' && t.termios.OEnabled(linux.OCRNL):
+			out = append(out, '\n')
+		default:
+			out = append(out, c)
+		}
+	}
+
+	return out
+}
+
+// read is a read by the slave s. It waits for input through ctx, or fails
+// with fs.ErrWouldBlock if nonBlocking is set. Without ICANON, VMIN and
+// VTIME decide how long it waits, as termios(3) describes:
+//
+//   - With neither, it returns what's there without waiting.
+//   - With only VMIN, it waits until it has VMIN bytes.
+//   - With only VTIME, it waits that long for any input.
+//   - With both, it waits for VMIN bytes, but once it has some, it only
+//     waits VTIME for each of the rest.
+func (t *Terminal) read(ctx context.Context, s *Slave, b []byte, nonBlocking bool) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	interrupts := t.interrupts
+
+	var (
+		total int
+
+		// deadline is when VTIME runs out, once it's started.
+		deadline time.Time
+	)
+
+	for {
+		canonical := t.termios.LEnabled(linux.ICANON)
+
+		if canonical && total == 0 && len(t.input) > 0 {
+			return t.readLine(b)
+		}
+
+		vmin := int(t.termios.ControlCharacters[linux.VMIN])
+		vtime := time.Duration(t.termios.ControlCharacters[linux.VTIME]) * 100 * time.Millisecond
+
+		if !canonical && len(t.input) > 0 {
+			total += t.readAvailable(b[total:])
+
+			if vmin > 0 && vtime > 0 {
+				deadline = time.Now().Add(vtime)
+			}
+		}
+
+		switch {
+		case total > 0 && (canonical || total >= vmin || total == len(b)):
+			return total, nil
+		case canonical:
+		case vmin == 0 && vtime == 0:
+			return 0, io.EOF
+		case vmin == 0 && deadline.IsZero():
+			deadline = time.Now().Add(vtime)
+		}
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return t.partial(total, io.EOF)
+		}
+
+		if !t.masterOpen {
+			return t.partial(total, io.EOF)
+		}
+
+		if t.interrupts != interrupts {
+			return t.partial(total, fs.ErrInterrupted)
+		}
+
+		if nonBlocking {
+			return t.partial(total, fs.ErrWouldBlock)
+		}
+
+		wctx, cancel := ctx, context.CancelFunc(func() {})
+		if !deadline.IsZero() {
+			wctx, cancel = context.WithDeadline(ctx, deadline)
+		}
+
+		err := t.wait(wctx, s, waiter.EventIn)
+		cancel()
+
+		// Only ctx being done interrupts the read; the deadline passing
+		// is noticed going round again.
+		if err != nil && ctx.Err() != nil {
+			return t.partial(total, err)
+		}
+	}
+}
+
+// partial ends a read that has read total bytes, failing with err if it
+// hasn't read any.
+func (t *Terminal) partial(total int, err error) (int, error) {
+	if total > 0 {
+		return total, nil
+	}
+
+	return 0, err
+}
+
+// wait waits for w to have one of the events in mask, with t unlocked in
+// the meantime. It fails with fs.ErrInterrupted once ctx is done.
+func (t *Terminal) wait(ctx context.Context, w waiter.Waitable, mask waiter.EventMask) error {
+	t.mu.Unlock()
+	defer t.mu.Lock()
+
+	return waiter.Wait(ctx, w, mask)
+}
+
+// readLine reads from the first line of input, which is only consumed once
+// it's been read completely.
+func (t *Terminal) readLine(b []byte) (int, error) {
+	line := t.input[0]
+
+	if len(line) == 0 {
+		t.input = t.input[1:]
+		return 0, io.EOF
+	}
+
+	n := copy(b, line)
+
+	if n == len(line) {
+		t.input = t.input[1:]
+	} else {
+		t.input[0] = line[n:]
+	}
+
+	return n, nil
+}
+
+// readAvailable reads as much of the input as fits in b.
+func (t *Terminal) readAvailable(b []byte) int {
+	total := 0
+
+	for len(t.input) > 0 && total < len(b) {
+		n := copy(b[total:], t.input[0])
+		total += n
+
+		if n == len(t.input[0]) {
+			t.input = t.input[1:]
+		} else {
+			t.input[0] = t.input[0][n:]
+		}
+	}
+
+	return total
+}
+
+// write is a write by the slave s. It waits for the master to read while
+// the output is full.
+func (t *Terminal) write(s *Slave, b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	written := 0
+
+	for {
+		if !t.masterOpen {
+			return written, ErrHangup
+		}
+
+		for written < len(b) {
+			out := t.process(b[written : written+1])
+			if len(t.output)+len(out) > bufferSize {
+				break
+			}
+
+			t.output = append(t.output, out...)
+			written++
+		}
+
+		t.broadcast()
+
+		if written == len(b) {
+			return written, nil
+		}
+
+		t.wait(context.Background(), s, waiter.EventOut)
+	}
+}
@@ -0,0 +1,505 @@
+package tty_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evanphx/columbia/abi/linux"
+	"github.com/evanphx/columbia/fs"
+	"github.com/evanphx/columbia/pkg/waiter"
+	"github.com/evanphx/columbia/tty"
+	"github.com/stretchr/testify/require"
+)
+
+type signal struct {
+	pgid  int
+	signo linux.Signal
+}
+
+type signals struct {
+	mu   sync.Mutex
+	sent []signal
+}
+
+func (s *signals) SignalGroup(pgid int, signo linux.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sent = append(s.sent, signal{pgid, signo})
+}
+
+func (s *signals) list() []signal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]signal(nil), s.sent...)
+}
+
+func TestPTY(t *testing.T) {
+	open := func(t *testing.T) (*tty.Master, *tty.Slave, *signals) {
+		var sigs signals
+
+		master := tty.NewPTY(&sigs, 0, nil)
+		master.Terminal().SetLocked(false)
+
+		slave, err := tty.OpenSlave(master.Terminal())
+		require.NoError(t, err)
+
+		return master, slave, &sigs
+	}
+
+	read := func(t *testing.T, r io.Reader) string {
+		buf := make([]byte, 100)
+
+		n, err := r.Read(buf)
+		require.NoError(t, err)
+
+		return string(buf[:n])
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	t.Run("locks the slave until it's unlocked", func(t *testing.T) {
+		master := tty.NewPTY(nil, 3, nil)
+		require.Equal(t, 3, master.Terminal().Index())
+
+		_, err := tty.OpenSlave(master.Terminal())
+		require.Equal(t, tty.ErrHangup, err)
+
+		master.Terminal().SetLocked(false)
+
+		_, err = tty.OpenSlave(master.Terminal())
+		require.NoError(t, err)
+	})
+
+	t.Run("reads a line at a time and echoes it", func(t *testing.T) {
+		master, slave, _ := open(t)
+
+		_, err := master.Write([]byte("echo hi\rls\r"))
+		require.NoError(t, err)
+
+		require.Equal(t, "echo hi\n", read(t, slave))
+		require.Equal(t, "ls\n", read(t, slave))
+		require.Equal(t, "echo hi\r\nls\r\n", read(t, master))
+	})
+
+	t.Run("waits for the line to be finished", func(t *testing.T) {
+		master, slave, _ := open(t)
+
+		_, err := master.Write([]byte("ab"))
+		require.NoError(t, err)
+
+		done := make(chan string)
+
+		go func() {
+			done <- read(t, slave)
+		}()
+
+		select {
+		case <-done:
+			t.Fatal("read an unfinished line")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		_, err = master.Write([]byte("c\n"))
+		require.NoError(t, err)
+
+		require.Equal(t, "abc\n", <-done)
+	})
+
+	t.Run("edits the line", func(t *testing.T) {
+		master, slave, _ := open(t)
+
+		_, err := master.Write([]byte("lx\x7fs -la foo\x17bar\r"))
+		require.NoError(t, err)
+
+		require.Equal(t, "ls -la bar\n", read(t, slave))
+		require.Equal(t, "lx\b \bs -la foo\b \b\b \b\b \bbar\r\n", read(t, master))
+
+		_, err = master.Write([]byte("wrong\x15right\n"))
+		require.NoError(t, err)
+
+		require.Equal(t, "right\n", read(t, slave))
+	})
+
+	t.Run("reads an empty line at EOF as the end of file", func(t *testing.T) {
+		master, slave, _ := open(t)
+
+		_, err := master.Write([]byte("partial\x04\x04"))
+		require.NoError(t, err)
+
+		require.Equal(t, "partial", read(t, slave))
+
+		_, err = slave.Read(make([]byte, 10))
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("signals the foreground process group", func(t *testing.T) {
+		master, slave, sigs := open(t)
+
+		require.NoError(t, master.Terminal().SetSession(1, 7, false))
+
+		_, err := master.Write([]byte("half"))
+		require.NoError(t, err)
+
+		done := make(chan result)
+
+		go func() {
+			n, err := slave.Read(make([]byte, 10))
+			done <- result{n, err}
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+
+		_, err = master.Write([]byte{0x03})
+		require.NoError(t, err)
+
+		require.Equal(t, result{0, fs.ErrInterrupted}, <-done)
+		require.Equal(t, []signal{{7, linux.SIGINT}}, sigs.list())
+		require.Equal(t, "half^C", read(t, master))
+
+		// The interrupt discarded the line.
+		_, err = master.Write([]byte("next\n"))
+		require.NoError(t, err)
+		require.Equal(t, "next\n", read(t, slave))
+	})
+
+	t.Run("keeps job control to the controlled session", func(t *testing.T) {
+		master, _, sigs := open(t)
+		term := master.Terminal()
+
+		_, err := term.Foreground(1)
+		require.Equal(t, tty.ErrNotControlling, err)
+
+		require.NoError(t, term.SetSession(1, 1, false))
+		require.Equal(t, tty.ErrOtherSession, term.SetSession(2, 2, false))
+		require.Equal(t, tty.ErrNotControlling, term.SetForeground(2, 2))
+
+		require.NoError(t, term.SetForeground(1, 4))
+
+		pgid, err := term.Foreground(1)
+		require.NoError(t, err)
+		require.Equal(t, 4, pgid)
+
+		term.SetWindowSize(linux.Winsize{Row: 24, Col: 80})
+		require.Equal(t, []signal{{4, linux.SIGWINCH}}, sigs.list())
+
+		term.ReleaseSession(1)
+		require.Equal(t, 0, term.Session())
+	})
+
+	t.Run("passes input straight through without ICANON", func(t *testing.T) {
+		master, slave, _ := open(t)
+		term := master.Terminal()
+
+		termios := term.Termios()
+		termios.LocalFlags &^= linux.ICANON | linux.ECHO
+		termios.ControlCharacters[linux.VMIN] = 0
+		termios.ControlCharacters[linux.VTIME] = 0
+		term.SetTermios(termios, false)
+
+		_, err := slave.Read(make([]byte, 10))
+		require.Equal(t, io.EOF, err)
+
+		_, err = master.Write([]byte("a\x7fb"))
+		require.NoError(t, err)
+
+		require.Equal(t, 3, term.Readable())
+		require.Equal(t, "a\x7fb", read(t, slave))
+
+		termios.ControlCharacters[linux.VMIN] = 1
+		term.SetTermios(termios, false)
+
+		done := make(chan string)
+
+		go func() {
+			done <- read(t, slave)
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+
+		_, err = master.Write([]byte("q"))
+		require.NoError(t, err)
+		require.Equal(t, "q", <-done)
+	})
+
+	t.Run("reports readiness for poll", func(t *testing.T) {
+		master, slave, _ := open(t)
+
+		require.Equal(t, waiter.EventOut, slave.Readiness(waiter.EventIn|waiter.EventOut))
+
+		done := make(chan error)
+
+		go func() {
+			done <- waiter.Wait(context.Background(), slave, waiter.EventIn)
+		}()
+
+		_, err := master.Write([]byte("line\n"))
+		require.NoError(t, err)
+		require.NoError(t, <-done)
+
+		require.Equal(t, waiter.EventIn, master.Readiness(waiter.EventIn))
+
+		require.NoError(t, master.Close())
+		require.Equal(t, waiter.EventIn|waiter.EventHUp, slave.Readiness(waiter.EventIn|waiter.EventOut|waiter.EventHUp))
+	})
+
+	t.Run("reads without blocking when asked to", func(t *testing.T) {
+		master, slave, _ := open(t)
+		ctx := context.Background()
+
+		_, err := slave.ReadContext(ctx, make([]byte, 10), true)
+		require.Equal(t, fs.ErrWouldBlock, err)
+
+		_, err = master.ReadContext(ctx, make([]byte, 10), true)
+		require.Equal(t, fs.ErrWouldBlock, err)
+
+		_, err = master.Write([]byte("x\n"))
+		require.NoError(t, err)
+
+		n, err := slave.ReadContext(ctx, make([]byte, 10), true)
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+	})
+
+	t.Run("gives up waiting once the context is done", func(t *testing.T) {
+		master, slave, _ := open(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		done := make(chan error)
+
+		go func() {
+			_, err := slave.ReadContext(ctx, make([]byte, 10), false)
+			done <- err
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+
+		require.Equal(t, fs.ErrInterrupted, <-done)
+
+		_, err := master.ReadContext(ctx, make([]byte, 10), false)
+		require.Equal(t, fs.ErrInterrupted, err)
+	})
+
+	t.Run("times out after VTIME without ICANON", func(t *testing.T) {
+		master, slave, _ := open(t)
+		term := master.Terminal()
+
+		termios := term.Termios()
+		termios.LocalFlags &^= linux.ICANON
+		termios.ControlCharacters[linux.VMIN] = 0
+		termios.ControlCharacters[linux.VTIME] = 1
+		term.SetTermios(termios, false)
+
+		start := time.Now()
+
+		_, err := slave.Read(make([]byte, 10))
+		require.Equal(t, io.EOF, err)
+		require.True(t, time.Since(start) >= 100*time.Millisecond)
+	})
+
+	t.Run("waits for VMIN bytes", func(t *testing.T) {
+		master, slave, _ := open(t)
+		term := master.Terminal()
+
+		termios := term.Termios()
+		termios.LocalFlags &^= linux.ICANON | linux.ECHO
+		termios.ControlCharacters[linux.VMIN] = 3
+		termios.ControlCharacters[linux.VTIME] = 0
+		term.SetTermios(termios, false)
+
+		done := make(chan string)
+
+		go func() {
+			done <- read(t, slave)
+		}()
+
+		_, err := master.Write([]byte("ab"))
+		require.NoError(t, err)
+
+		select {
+		case <-done:
+			t.Fatal("read fewer than VMIN bytes")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		_, err = master.Write([]byte("cd"))
+		require.NoError(t, err)
+
+		require.Equal(t, "abcd", <-done)
+
+		// A smaller buffer is filled instead.
+		_, err = master.Write([]byte("xy"))
+		require.NoError(t, err)
+
+		buf := make([]byte, 2)
+
+		n, err := slave.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, "xy", string(buf[:n]))
+	})
+
+	t.Run("returns the first input within VTIME", func(t *testing.T) {
+		master, slave, _ := open(t)
+		term := master.Terminal()
+
+		termios := term.Termios()
+		termios.LocalFlags &^= linux.ICANON | linux.ECHO
+		termios.ControlCharacters[linux.VMIN] = 0
+		termios.ControlCharacters[linux.VTIME] = 10
+		term.SetTermios(termios, false)
+
+		start := time.Now()
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			master.Write([]byte("a"))
+		}()
+
+		require.Equal(t, "a", read(t, slave))
+		require.True(t, time.Since(start) < time.Second)
+	})
+
+	t.Run("times the gaps between bytes with VMIN and VTIME", func(t *testing.T) {
+		master, slave, _ := open(t)
+		term := master.Terminal()
+
+		termios := term.Termios()
+		termios.LocalFlags &^= linux.ICANON | linux.ECHO
+		termios.ControlCharacters[linux.VMIN] = 3
+		termios.ControlCharacters[linux.VTIME] = 1
+		term.SetTermios(termios, false)
+
+		done := make(chan string)
+
+		go func() {
+			done <- read(t, slave)
+		}()
+
+		// The timer doesn't start until there's input.
+		select {
+		case <-done:
+			t.Fatal("timed out without input")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		_, err := master.Write([]byte("a"))
+		require.NoError(t, err)
+
+		start := time.Now()
+
+		require.Equal(t, "a", <-done)
+		require.True(t, time.Since(start) >= 90*time.Millisecond)
+
+		_, err = master.Write([]byte("abc"))
+		require.NoError(t, err)
+
+		require.Equal(t, "abc", read(t, slave))
+	})
+
+	t.Run("drops input beyond the buffer", func(t *testing.T) {
+		master, slave, _ := open(t)
+		term := master.Terminal()
+
+		termios := term.Termios()
+		termios.InputFlags |= linux.IMAXBEL
+		termios.LocalFlags &^= linux.ICANON | linux.ECHO
+		term.SetTermios(termios, false)
+
+		_, err := master.Write(make([]byte, 5000))
+		require.NoError(t, err)
+		require.Equal(t, 4096, term.Readable())
+		require.Equal(t, "\a", read(t, master)[:1])
+
+		termios.LocalFlags |= linux.ICANON
+		term.SetTermios(termios, true)
+
+		_, err = master.Write(append(bytes.Repeat([]byte("x"), 5000), '\n'))
+		require.NoError(t, err)
+
+		line := make([]byte, 5000)
+
+		n, err := slave.Read(line)
+		require.NoError(t, err)
+		require.Equal(t, 4096, n)
+		require.Equal(t, byte('\n'), line[n-1])
+	})
+
+	t.Run("makes the slave wait for the master to read", func(t *testing.T) {
+		master, slave, _ := open(t)
+
+		require.Equal(t, waiter.EventOut, slave.Readiness(waiter.EventOut))
+
+		done := make(chan result)
+
+		go func() {
+			n, err := slave.Write(bytes.Repeat([]byte("x"), 5000))
+			done <- result{n, err}
+		}()
+
+		select {
+		case <-done:
+			t.Fatal("wrote past the buffer")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		require.Equal(t, waiter.EventMask(0), slave.Readiness(waiter.EventOut))
+
+		var got int
+
+		buf := make([]byte, 1000)
+
+		for got < 5000 {
+			n, err := master.Read(buf)
+			require.NoError(t, err)
+
+			got += n
+		}
+
+		require.Equal(t, result{5000, nil}, <-done)
+	})
+
+	t.Run("hangs up when an end is closed", func(t *testing.T) {
+		master, slave, sigs := open(t)
+
+		require.NoError(t, master.Terminal().SetSession(1, 1, false))
+
+		_, err := slave.Write([]byte("bye\n"))
+		require.NoError(t, err)
+		require.NoError(t, slave.Close())
+
+		require.Equal(t, "bye\r\n", read(t, master))
+
+		_, err = master.Read(make([]byte, 10))
+		require.Equal(t, tty.ErrHangup, err)
+
+		released := false
+
+		master = tty.NewPTY(sigs, 1, func() { released = true })
+		master.Terminal().SetLocked(false)
+
+		slave, err = tty.OpenSlave(master.Terminal())
+		require.NoError(t, err)
+
+		require.NoError(t, master.Terminal().SetSession(1, 1, false))
+		require.NoError(t, master.Close())
+		require.True(t, released)
+
+		_, err = slave.Read(make([]byte, 10))
+		require.Equal(t, io.EOF, err)
+
+		_, err = slave.Write([]byte("x"))
+		require.Equal(t, tty.ErrHangup, err)
+
+		require.Equal(t, []signal{{1, linux.SIGHUP}}, sigs.list())
+	})
+}
@@ -1037,7 +1037,7 @@ func (f *FunctionBody) UnmarshalWASM(r io.Reader, offset int64) (int64, error) {
 		return 0, ErrFunctionNoEnd
 	}
 
-	f.Code = code // [:len(code)-1]
+	f.Code = code[:len(code)-1]
 
 	return offset, nil
 }